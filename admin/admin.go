@@ -0,0 +1,126 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package admin is an HTTP API for the SurgeMQ server, for integrating it with
+// web backends and for operating it. The Handler can be mounted on any
+// http.ServeMux, and it's up to the application to restrict who can get to it.
+//
+//	svr := &service.Server{}
+//	http.Handle("/mqtt/", http.StripPrefix("/mqtt", admin.NewHandler(svr)))
+//	go http.ListenAndServe(":8080", nil)
+//
+// Endpoints:
+//
+//	POST /publish      Publish a message, as if a client had published it
+//	GET /recovery      Report the retained messages recovered on startup, and
+//	                   the records set aside in safe mode
+//	GET /subscribe     Stream the messages on a topic filter, as server-sent
+//	                   events or JSON
+//	GET /retained      List who set the retained messages
+//	GET /retained/messages
+//	                   List the retained messages matching a topic filter
+//	DELETE /retained/messages
+//	                   Clear the retained messages matching a topic filter
+//	GET /keepalive     List the clients that should use a shorter keepalive
+//	GET /topics/stats  Report the shape of the subscription tree
+//	GET /topics/tree   Render the subscription subtree under a topic filter
+//	                   prefix
+//	GET /bans          List the bans in force
+//	POST /bans         Ban clients by client ID, username, IP or certificate
+//	DELETE /bans       Lift a ban
+//	GET /quotas        List the publish quotas of the clients and what's left
+//	                   of them
+//	GET /presence      List when the clients were last seen, and why they
+//	                   disconnected
+//	GET /inflight      List the messages sent to a client waiting for their
+//	                   acks
+//	POST /inflight     Send one of them again
+//	DELETE /inflight   Discard one of them
+//	GET /tenants       List the tenants with connected clients
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/surgemq/service"
+)
+
+// DefaultClientId is the client ID messages published over HTTP are published as.
+const DefaultClientId = "$http"
+
+// Handler serves the HTTP API for a server.
+type Handler struct {
+	// ClientId is the client ID messages published over HTTP are published as, as
+	// seen by the pipeline stages and the bridges. If not set then default to
+	// "$http".
+	ClientId string
+
+	svr *service.Server
+	mux *http.ServeMux
+}
+
+// NewHandler returns the HTTP API for the server.
+func NewHandler(svr *service.Server) *Handler {
+	this := &Handler{
+		svr: svr,
+		mux: http.NewServeMux(),
+	}
+
+	this.mux.HandleFunc("/publish", this.publish)
+	this.mux.HandleFunc("/recovery", this.recovery)
+	this.mux.HandleFunc("/subscribe", this.subscribe)
+	this.mux.HandleFunc("/retained", this.retained)
+	this.mux.HandleFunc("/retained/messages", this.retainedMessages)
+	this.mux.HandleFunc("/keepalive", this.keepAlive)
+	this.mux.HandleFunc("/topics/stats", this.topicStats)
+	this.mux.HandleFunc("/topics/tree", this.topicTree)
+	this.mux.HandleFunc("/bans", this.bans)
+	this.mux.HandleFunc("/quotas", this.quotas)
+	this.mux.HandleFunc("/presence", this.presence)
+	this.mux.HandleFunc("/inflight", this.inflight)
+	this.mux.HandleFunc("/tenants", this.tenants)
+
+	return this
+}
+
+func (this *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	this.mux.ServeHTTP(w, r)
+}
+
+func (this *Handler) clientId() string {
+	if this.ClientId == "" {
+		return DefaultClientId
+	}
+
+	return this.ClientId
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Errorf("admin/writeJSON: Error writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
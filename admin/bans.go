@@ -0,0 +1,97 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// maxBanBody is the largest request body accepted by POST /bans.
+const maxBanBody = 64 * 1024
+
+// BanRequest is the body of POST /bans. TTL is how long the ban lasts, e.g.
+// "24h". If not set then it's never lifted.
+type BanRequest struct {
+	Kind   sessions.BanKind `json:"kind"`
+	Value  string           `json:"value"`
+	Reason string           `json:"reason,omitempty"`
+	TTL    string           `json:"ttl,omitempty"`
+}
+
+// bans handles the ban list. GET /bans lists the bans in force, POST /bans adds
+// one, and DELETE /bans?kind=<kind>&value=<value> removes one.
+func (this *Handler) bans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, this.svr.Bans())
+
+	case "POST":
+		var req BanRequest
+
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBanBody)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("admin/bans: Invalid request: %v", err))
+			return
+		}
+
+		ban := sessions.Ban{Kind: req.Kind, Value: req.Value, Reason: req.Reason, Created: time.Now()}
+
+		if req.TTL != "" {
+			ttl, err := time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("admin/bans: Invalid ttl %q", req.TTL))
+				return
+			}
+
+			ban.Expires = ban.Created.Add(ttl)
+		}
+
+		if err := this.svr.Ban(ban); err == service.ErrInvalidBan {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		q := r.URL.Query()
+
+		if err := this.svr.Unban(sessions.BanKind(q.Get("kind")), q.Get("value")); err == service.ErrBanNotFound {
+			writeError(w, http.StatusNotFound, err)
+			return
+		} else if err == service.ErrInvalidBan {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/bans: Method %s not allowed", r.Method))
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+func TestBans(t *testing.T) {
+	svr := newTestServer(t)
+	h := NewHandler(svr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/bans", strings.NewReader(`{"kind":"client_id","value":"rogue","reason":"flooding","ttl":"1h"}`)))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/bans", strings.NewReader(`{"kind":"ip","value":"not an ip"}`)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/bans", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var bans []sessions.Ban
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &bans))
+	require.Len(t, bans, 1)
+	require.Equal(t, "rogue", bans[0].Value)
+	require.Equal(t, "flooding", bans[0].Reason)
+	require.False(t, bans[0].Expires.IsZero())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/bans?kind=client_id&value=rogue", nil))
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/bans?kind=client_id&value=rogue", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	require.Len(t, svr.Bans(), 0)
+}
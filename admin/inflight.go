@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// inflight handles the QoS 1 and 2 messages sent to a connected client that are
+// waiting for their acks. GET /inflight?client=<id> lists them, oldest first,
+// POST /inflight?client=<id>&packet_id=<n> sends one again, and DELETE with the
+// same parameters discards it, all without disconnecting the client.
+func (this *Handler) inflight(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	cid := q.Get("client")
+	if cid == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/inflight: Missing client"))
+		return
+	}
+
+	if r.Method == "GET" {
+		msgs, err := this.svr.Inflight(cid)
+		if err != nil {
+			writeInflightError(w, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, msgs)
+		return
+	}
+
+	if r.Method != "POST" && r.Method != "DELETE" {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/inflight: Method %s not allowed", r.Method))
+		return
+	}
+
+	pktid, err := strconv.ParseUint(q.Get("packet_id"), 10, 16)
+	if err != nil || pktid == 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/inflight: Invalid packet_id %q", q.Get("packet_id")))
+		return
+	}
+
+	if r.Method == "POST" {
+		err = this.svr.RetryInflight(cid, uint16(pktid))
+	} else {
+		err = this.svr.DiscardInflight(cid, uint16(pktid))
+	}
+
+	if err != nil {
+		writeInflightError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeInflightError(w http.ResponseWriter, err error) {
+	if err == service.ErrClientNotFound || err == sessions.ErrAckNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflight(t *testing.T) {
+	svr := newTestServer(t)
+	h := NewHandler(svr)
+
+	for _, test := range []struct {
+		method, path string
+		code         int
+	}{
+		{"GET", "/inflight", http.StatusBadRequest},
+		{"GET", "/inflight?client=nobody", http.StatusNotFound},
+		{"POST", "/inflight?client=nobody&packet_id=1", http.StatusNotFound},
+		{"DELETE", "/inflight?client=nobody&packet_id=1", http.StatusNotFound},
+		{"POST", "/inflight?client=nobody", http.StatusBadRequest},
+		{"DELETE", "/inflight?client=nobody&packet_id=65536", http.StatusBadRequest},
+		{"PUT", "/inflight?client=nobody", http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		require.Equal(t, test.code, w.Code, "%s %s", test.method, test.path)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/surgemq/surgemq/service"
+)
+
+// keepAlive handles GET /keepalive, which lists the clients that have a shorter
+// keepalive suggested, the ones whose connections were dropped the most first.
+// With client=<id>, it's what's been seen of that client instead, whether
+// there's a suggestion or not.
+func (this *Handler) keepAlive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/keepAlive: Method %s not allowed", r.Method))
+		return
+	}
+
+	q := r.URL.Query()
+
+	if _, ok := q["client"]; !ok {
+		writeJSON(w, http.StatusOK, this.svr.KeepAliveReports())
+		return
+	}
+
+	report, err := this.svr.KeepAliveReport(q.Get("client"))
+	if err == service.ErrClientNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
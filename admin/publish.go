@@ -0,0 +1,95 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+// maxPublishBody is the largest request body accepted by /publish. It leaves
+// plenty of room for a base64 encoded payload of the default MaxPacketSize, and
+// the message itself is checked against the MaxPacketSize of the server.
+const maxPublishBody = 4 * 1024 * 1024
+
+// PublishRequest is the body of POST /publish. Payload is the message payload as
+// is, unless PayloadBase64 is set, which is for binary payloads.
+type PublishRequest struct {
+	Topic         string `json:"topic"`
+	QoS           byte   `json:"qos"`
+	Retain        bool   `json:"retain"`
+	Payload       string `json:"payload,omitempty"`
+	PayloadBase64 string `json:"payload_base64,omitempty"`
+}
+
+// publish handles POST /publish. The message goes through the server exactly as
+// if a client had published it, so it's retained if asked to be and is seen by
+// the pipeline and the bridges. For QoS 1 and 2 messages, the response is only
+// sent once the bridges have the message.
+func (this *Handler) publish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/publish: Method %s not allowed", r.Method))
+		return
+	}
+
+	var req PublishRequest
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxPublishBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/publish: Invalid request: %v", err))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+
+	if err := msg.SetTopic([]byte(req.Topic)); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := msg.SetQoS(req.QoS); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	msg.SetRetain(req.Retain)
+
+	if req.PayloadBase64 != "" {
+		payload, err := base64.StdEncoding.DecodeString(req.PayloadBase64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("admin/publish: Invalid payload_base64: %v", err))
+			return
+		}
+		msg.SetPayload(payload)
+	} else {
+		msg.SetPayload([]byte(req.Payload))
+	}
+
+	if _, err := this.svr.Publish(msg, &service.PublishOptions{ClientId: this.clientId()}); err == service.ErrPacketTooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func newTestServer(t *testing.T) *service.Server {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	return &service.Server{MaxPacketSize: 64 * 1024, Pipeline: &service.Pipeline{}}
+}
+
+func subscribe(t *testing.T, svr *service.Server, topic string) *[]*message.PublishMessage {
+	var got []*message.PublishMessage
+
+	var onpub service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		got = append(got, msg)
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte(topic), message.QosExactlyOnce, &onpub)
+	require.NoError(t, err)
+
+	return &got
+}
+
+func post(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return w
+}
+
+func TestPublish(t *testing.T) {
+	svr := newTestServer(t)
+	defer svr.Close()
+
+	var cids []string
+	require.NoError(t, svr.Pipeline.Add(service.Stage{
+		Name:  "record",
+		Phase: service.PhaseAuth,
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			cids = append(cids, cid)
+			return msg, nil
+		},
+	}))
+
+	got := subscribe(t, svr, "a/#")
+	h := NewHandler(svr)
+
+	w := post(h, "/publish", `{"topic": "a/b", "qos": 1, "retain": true, "payload": "hello"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	require.Len(t, *got, 1)
+	require.Equal(t, "a/b", string((*got)[0].Topic()))
+	require.Equal(t, "hello", string((*got)[0].Payload()))
+	require.Equal(t, message.QosAtLeastOnce, (*got)[0].QoS())
+	require.Equal(t, []string{DefaultClientId}, cids)
+
+	rmsgs, err := svr.Retained([]byte("a/b"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 1)
+	require.Equal(t, "hello", string(rmsgs[0].Payload()))
+
+	h.ClientId = "backend"
+
+	w = post(h, "/publish", `{"topic": "a/c", "payload_base64": "AAEC"}`)
+	require.Equal(t, http.StatusNoContent, w.Code)
+
+	require.Len(t, *got, 2)
+	require.Equal(t, []byte{0, 1, 2}, (*got)[1].Payload())
+	require.Equal(t, []string{DefaultClientId, "backend"}, cids)
+}
+
+func TestPublishErrors(t *testing.T) {
+	svr := newTestServer(t)
+	defer svr.Close()
+
+	h := NewHandler(svr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/publish", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	require.Equal(t, http.StatusBadRequest, post(h, "/publish", `{"topic": `).Code)
+	require.Equal(t, http.StatusBadRequest, post(h, "/publish", `{"topic": "a/#"}`).Code)
+	require.Equal(t, http.StatusBadRequest, post(h, "/publish", `{"topic": "a/b", "qos": 3}`).Code)
+	require.Equal(t, http.StatusBadRequest, post(h, "/publish", `{"topic": "a/b", "payload_base64": "!"}`).Code)
+
+	w = post(h, "/publish", `{"topic": "a/b", "payload": "`+strings.Repeat("x", 64*1024)+`"}`)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	require.Contains(t, w.Body.String(), service.ErrPacketTooLarge.Error())
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// quotas handles GET /quotas, which lists the quotas of the clients that have
+// published today and what's left of them. With client=<id>, it's the quota of
+// that client, whether it has published or not.
+func (this *Handler) quotas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/quotas: Method %s not allowed", r.Method))
+		return
+	}
+
+	q := r.URL.Query()
+
+	if _, ok := q["client"]; !ok {
+		writeJSON(w, http.StatusOK, this.svr.QuotaStatuses())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, this.svr.QuotaStatus(q.Get("client")))
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/service"
+)
+
+func TestQuotas(t *testing.T) {
+	svr := newTestServer(t)
+	svr.Quota = func(cid string) service.Quota {
+		return service.Quota{HourlyMessages: 10}
+	}
+	h := NewHandler(svr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/quotas", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var sts []service.QuotaStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sts))
+	require.Empty(t, sts)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/quotas?client=abc", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var st service.QuotaStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	require.Equal(t, "abc", st.ClientId)
+	require.Equal(t, service.Quota{HourlyMessages: 10, HourlyBytes: -1, DailyMessages: -1, DailyBytes: -1}, st.Remaining)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/quotas", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var errNotRecovered = errors.New("admin/recovery: Server has not started")
+
+type badRecord struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+type recoveryReport struct {
+	Retained    int         `json:"retained"`
+	BadRetained []badRecord `json:"bad_retained"`
+}
+
+// recovery handles GET /recovery, which reports the retained messages the server
+// recovered on startup, including the records it set aside in safe mode.
+func (this *Handler) recovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/recovery: Method %s not allowed", r.Method))
+		return
+	}
+
+	report := this.svr.RecoveryReport()
+	if report == nil {
+		writeError(w, http.StatusServiceUnavailable, errNotRecovered)
+		return
+	}
+
+	res := recoveryReport{
+		Retained:    report.Retained,
+		BadRetained: []badRecord{},
+	}
+
+	for _, b := range report.BadRetained {
+		res.BadRetained = append(res.BadRetained, badRecord{b.Key, b.Err.Error()})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
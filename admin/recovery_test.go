@@ -0,0 +1,70 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestRecovery(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bad"), []byte{0x30, 0xff}, 0600))
+
+	p, err := topics.NewFileProvider(dir)
+	require.NoError(t, err)
+
+	topics.Register("file", p)
+	defer topics.Unregister("file")
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	svr := &service.Server{TopicsProvider: "file", SafeMode: true}
+	h := NewHandler(svr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/recovery", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// Recovered once the server starts, which any call on it does
+	_, err = svr.Retained([]byte("#"))
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/recovery", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var report recoveryReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	require.Equal(t, 0, report.Retained)
+	require.Len(t, report.BadRetained, 1)
+	require.Equal(t, "bad", report.BadRetained[0].Key)
+	require.NotEmpty(t, report.BadRetained[0].Error)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/recovery", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
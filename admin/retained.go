@@ -0,0 +1,116 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/surgemq/surgemq/service"
+)
+
+// RetainedMessages is the response of GET /retained/messages.
+type RetainedMessages struct {
+	Messages []json.RawMessage `json:"messages"`
+
+	// The counters of all the retained messages, not only the ones matching
+	Stats service.RetainedStats `json:"stats"`
+}
+
+// DeleteRetainedResponse is the response of DELETE /retained/messages.
+type DeleteRetainedResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// retained handles GET /retained, which lists the clients that have set
+// retained messages, the ones with the most first, so it's easy to see who's
+// filling up the store. With client=<id>, it's the topics of the retained
+// messages set by that client instead.
+func (this *Handler) retained(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/retained: Method %s not allowed", r.Method))
+		return
+	}
+
+	q := r.URL.Query()
+
+	if _, ok := q["client"]; !ok {
+		writeJSON(w, http.StatusOK, this.svr.RetainedOwners())
+		return
+	}
+
+	o, err := this.svr.RetainedOwner(q.Get("client"))
+	if err == service.ErrClientNotFound {
+		writeError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, o)
+}
+
+// retainedMessages handles /retained/messages. GET lists the retained messages
+// matching the topic filter filter=<filter>, each in the same form as the body
+// of POST /publish, and DELETE clears them. The filter defaults to "#", which
+// doesn't match the topics starting with "$".
+func (this *Handler) retainedMessages(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("filter")
+	if filter == "" {
+		filter = "#"
+	}
+
+	switch r.Method {
+	case "GET":
+		msgs, err := this.svr.Retained([]byte(filter))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		resp := RetainedMessages{
+			Messages: make([]json.RawMessage, 0, len(msgs)),
+			Stats:    this.svr.RetainedStats(),
+		}
+
+		for _, msg := range msgs {
+			b, err := encodeMessage(msg)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			resp.Messages = append(resp.Messages, b)
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+
+	case "DELETE":
+		n, err := this.svr.DeleteRetained([]byte(filter))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, DeleteRetainedResponse{Deleted: n})
+
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/retained: Method %s not allowed", r.Method))
+	}
+}
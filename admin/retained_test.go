@@ -0,0 +1,102 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/service"
+)
+
+func TestRetainedOwners(t *testing.T) {
+	svr := newTestServer(t)
+	h := NewHandler(svr)
+
+	for _, topic := range []string{"a/1", "a/2"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/publish", strings.NewReader(`{"topic":"`+topic+`","payload":"x","retain":true}`)))
+		require.Equal(t, http.StatusNoContent, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/retained", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var owners []service.RetainedOwner
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &owners))
+	require.Equal(t, []service.RetainedOwner{{ClientId: DefaultClientId, Retained: 2}}, owners)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/retained?client=%24http", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var owner service.RetainedOwner
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &owner))
+	require.Equal(t, []string{"a/1", "a/2"}, owner.Topics)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/retained?client=nobody", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestRetainedMessages(t *testing.T) {
+	svr := newTestServer(t)
+	h := NewHandler(svr)
+
+	for _, topic := range []string{"a/1", "a/2", "b/1"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/publish", strings.NewReader(`{"topic":"`+topic+`","payload":"x","retain":true}`)))
+		require.Equal(t, http.StatusNoContent, w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/retained/messages?filter=a/%2B", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var resp RetainedMessages
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Messages, 2)
+	require.Equal(t, 3, resp.Stats.Count)
+
+	var msg PublishRequest
+	require.NoError(t, json.Unmarshal(resp.Messages[0], &msg))
+	require.Equal(t, "x", msg.Payload)
+	require.True(t, msg.Retain)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("DELETE", "/retained/messages?filter=a/%23", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var del DeleteRetainedResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &del))
+	require.Equal(t, 2, del.Deleted)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/retained/messages", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp = RetainedMessages{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	require.Len(t, resp.Messages, 1)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("PUT", "/retained/messages", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
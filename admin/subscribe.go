@@ -0,0 +1,192 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+// streamQueueSize is the number of messages buffered for each HTTP subscriber.
+// Publishers never wait for a slow subscriber, messages that don't fit are
+// dropped instead, the same as QoS 0 messages on a congested network.
+const streamQueueSize = 256
+
+// subscribe handles GET /subscribe?topic=<filter>, which streams the messages
+// published on the matching topics until the client goes away. Each message is
+// sent in the same form as a PublishRequest. By default the response is a
+// text/event-stream for EventSource clients. With format=json, it's a chunked
+// stream of JSON objects, one per line. The optional qos parameter is the
+// maximum QoS of the subscription, and retained=false skips the retained
+// messages that are otherwise sent first.
+func (this *Handler) subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/subscribe: Method %s not allowed", r.Method))
+		return
+	}
+
+	q := r.URL.Query()
+
+	topic := q.Get("topic")
+	if topic == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/subscribe: Missing topic"))
+		return
+	}
+
+	var qos byte
+
+	if s := q.Get("qos"); s != "" {
+		n, err := strconv.ParseUint(s, 10, 8)
+		if err != nil || !message.ValidQos(byte(n)) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("admin/subscribe: Invalid qos %q", s))
+			return
+		}
+		qos = byte(n)
+	}
+
+	sse := true
+
+	switch q.Get("format") {
+	case "", "sse":
+	case "json":
+		sse = false
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/subscribe: Unknown format %q", q.Get("format")))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("admin/subscribe: Streaming not supported"))
+		return
+	}
+
+	msgs := make(chan []byte, streamQueueSize)
+
+	// onPublish is called by the publishers, so it encodes the message right away
+	// as the message can be reused once it returns.
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		b, err := encodeMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case msgs <- b:
+		default:
+			glog.Errorf("admin/subscribe: Dropping message to topic %q for slow HTTP subscriber", msg.Topic())
+		}
+
+		return nil
+	}
+
+	if rqos, err := this.svr.Subscribe([]byte(topic), qos, &onPublish); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	} else if rqos == message.QosFailure {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/subscribe: Subscription to %q failed", topic))
+		return
+	}
+
+	defer func() {
+		if err := this.svr.Unsubscribe([]byte(topic), &onPublish); err != nil {
+			glog.Errorf("admin/subscribe: Error unsubscribing topic %q: %v", topic, err)
+		}
+	}()
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(b []byte) error {
+		var err error
+
+		if sse {
+			_, err = fmt.Fprintf(w, "event: message\ndata: %s\n\n", b)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", b)
+		}
+
+		if err == nil {
+			flusher.Flush()
+		}
+
+		return err
+	}
+
+	if q.Get("retained") != "false" {
+		rmsgs, err := this.svr.Retained([]byte(topic))
+		if err != nil {
+			glog.Errorf("admin/subscribe: Error getting retained messages for topic %q: %v", topic, err)
+		}
+
+		for _, rm := range rmsgs {
+			b, err := encodeMessage(rm)
+			if err != nil {
+				glog.Errorf("admin/subscribe: %v", err)
+				continue
+			}
+
+			if err := write(b); err != nil {
+				return
+			}
+		}
+	}
+
+	flusher.Flush()
+
+	for {
+		select {
+		case b := <-msgs:
+			if err := write(b); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// encodeMessage encodes the message as a PublishRequest. Payloads that aren't
+// valid UTF-8 are base64 encoded.
+func encodeMessage(msg *message.PublishMessage) ([]byte, error) {
+	m := PublishRequest{
+		Topic:  string(msg.Topic()),
+		QoS:    msg.QoS(),
+		Retain: msg.Retain(),
+	}
+
+	if payload := msg.Payload(); utf8.Valid(payload) {
+		m.Payload = string(payload)
+	} else {
+		m.PayloadBase64 = base64.StdEncoding.EncodeToString(payload)
+	}
+
+	return json.Marshal(m)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+func publishTo(t *testing.T, svr *service.Server, topic, payload string, retain bool) {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic([]byte(topic)))
+	msg.SetPayload([]byte(payload))
+	msg.SetRetain(retain)
+
+	_, err := svr.Publish(msg, nil)
+	require.NoError(t, err)
+}
+
+func TestSubscribeJSON(t *testing.T) {
+	svr := newTestServer(t)
+	publishTo(t, svr, "a/b", "retained", true)
+
+	ts := httptest.NewServer(NewHandler(svr))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/subscribe?topic=a/%2B&format=json")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+
+	read := func() PublishRequest {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+
+		var m PublishRequest
+		require.NoError(t, json.Unmarshal([]byte(line), &m))
+		return m
+	}
+
+	require.Equal(t, PublishRequest{Topic: "a/b", Retain: true, Payload: "retained"}, read())
+
+	publishTo(t, svr, "a/c", "hello", false)
+	publishTo(t, svr, "b/c", "other", false)
+	publishTo(t, svr, "a/d", "\xff\xfe", false)
+
+	require.Equal(t, PublishRequest{Topic: "a/c", Payload: "hello"}, read())
+	require.Equal(t, PublishRequest{Topic: "a/d", PayloadBase64: "//4="}, read())
+}
+
+func TestSubscribeSSE(t *testing.T) {
+	svr := newTestServer(t)
+	publishTo(t, svr, "a/b", "retained", true)
+
+	ts := httptest.NewServer(NewHandler(svr))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/subscribe?topic=a/b&retained=false")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	publishTo(t, svr, "a/b", "hello", false)
+
+	r := bufio.NewReader(resp.Body)
+
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	require.Equal(t, []string{"event: message", `data: {"topic":"a/b","qos":0,"retain":false,"payload":"hello"}`, ""}, lines)
+}
+
+func TestSubscribeInvalid(t *testing.T) {
+	h := NewHandler(newTestServer(t))
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	require.Equal(t, http.StatusBadRequest, get("/subscribe"))
+	require.Equal(t, http.StatusBadRequest, get("/subscribe?topic=a&qos=3"))
+	require.Equal(t, http.StatusBadRequest, get("/subscribe?topic=a&format=xml"))
+	require.Equal(t, http.StatusBadRequest, get("/subscribe?topic=a/%23/b"))
+	require.Equal(t, http.StatusMethodNotAllowed, post(h, "/subscribe?topic=a", "").Code)
+}
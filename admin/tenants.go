@@ -0,0 +1,33 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// tenants handles GET /tenants, which lists the tenants with connected clients.
+// Their topics are under service.TenantPrefix, followed by the tenant, where
+// /subscribe, /publish and /retained/messages can get to them.
+func (this *Handler) tenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/tenants: Method %s not allowed", r.Method))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, this.svr.Tenants())
+}
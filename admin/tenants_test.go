@@ -0,0 +1,43 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/service"
+)
+
+func TestTenants(t *testing.T) {
+	svr := newTestServer(t)
+	svr.Tenancy = service.TenancyUsername
+	h := NewHandler(svr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tenants", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var infos []service.TenantInfo
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &infos))
+	require.Equal(t, []service.TenantInfo{}, infos)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/tenants", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
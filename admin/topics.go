@@ -0,0 +1,124 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/surgemq/surgemq/topics"
+)
+
+const (
+	// The defaults for the number of widest nodes in the stats, and the size of
+	// the rendered subtree
+	defaultWidest    = 10
+	defaultTreeDepth = 3
+	defaultTreeWidth = 50
+
+	// The limits, so rendering a subtree stays cheap however big the tree is
+	maxWidest    = 100
+	maxTreeDepth = 16
+	maxTreeWidth = 1000
+)
+
+// topicStats handles GET /topics/stats, which reports the shape of the
+// subscription tree. The optional widest parameter is the number of nodes with
+// the most next levels to list.
+func (this *Handler) topicStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/topicStats: Method %s not allowed", r.Method))
+		return
+	}
+
+	widest, err := intParam(r.URL.Query(), "widest", defaultWidest, maxWidest)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/topicStats: %v", err))
+		return
+	}
+
+	st, err := this.svr.TopicStats(widest)
+	if err != nil {
+		writeError(w, inspectStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, st)
+}
+
+// topicTree handles GET /topics/tree, which renders the subscription subtree
+// under the topic filter prefix, or the whole tree if there's no prefix. The
+// optional depth and width parameters are the number of levels to render, and
+// the number of next levels to render for each node. Whatever is left out is
+// counted in the truncated field of the node.
+func (this *Handler) topicTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("admin/topicTree: Method %s not allowed", r.Method))
+		return
+	}
+
+	q := r.URL.Query()
+
+	depth, err := intParam(q, "depth", defaultTreeDepth, maxTreeDepth)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/topicTree: %v", err))
+		return
+	}
+
+	width, err := intParam(q, "width", defaultTreeWidth, maxTreeWidth)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("admin/topicTree: %v", err))
+		return
+	}
+
+	tn, err := this.svr.TopicTree(q.Get("prefix"), depth, width)
+	if err != nil {
+		writeError(w, inspectStatus(err), err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tn)
+}
+
+// intParam returns the query parameter as an int between 0 and max, or def if
+// it's not set.
+func intParam(q url.Values, name string, def, max int) (int, error) {
+	s := q.Get(name)
+	if s == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("Invalid %s %q, must be between 0 and %d", name, s, max)
+	}
+
+	return n, nil
+}
+
+func inspectStatus(err error) int {
+	switch err {
+	case topics.ErrTopicNotFound:
+		return http.StatusNotFound
+	case topics.ErrInspectNotSupported:
+		return http.StatusNotImplemented
+	}
+
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestTopicStats(t *testing.T) {
+	svr := newTestServer(t)
+	subscribe(t, svr, "a/b")
+	subscribe(t, svr, "a/c")
+
+	h := NewHandler(svr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/topics/stats?widest=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var st topics.TreeStats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &st))
+	require.Equal(t, 3, st.Nodes)
+	require.Equal(t, 2, st.Subscriptions)
+	require.Equal(t, []int{1, 2}, st.Depth)
+	require.Equal(t, []topics.NodeFanout{{Topic: "a", Children: 2}}, st.Widest)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/topics/stats?widest=-1", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTopicTree(t *testing.T) {
+	svr := newTestServer(t)
+	subscribe(t, svr, "a/b")
+	subscribe(t, svr, "a/c")
+
+	h := NewHandler(svr)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/topics/tree?prefix=a&width=1", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var tn topics.TreeNode
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &tn))
+	require.Equal(t, "a", tn.Topic)
+	require.Equal(t, 1, tn.Truncated)
+	require.Len(t, tn.Children, 1)
+	require.Equal(t, "a/b", tn.Children[0].Topic)
+	require.Equal(t, 1, tn.Children[0].Subscribers)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/topics/tree?prefix=x", nil))
+	require.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/topics/tree?depth=100", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/topics/tree", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
@@ -17,6 +17,7 @@ package auth
 import (
 	"errors"
 	"fmt"
+	"net"
 )
 
 var (
@@ -30,6 +31,14 @@ type Authenticator interface {
 	Authenticate(id string, cred interface{}) error
 }
 
+// AddrAuthenticator is implemented by authentication providers that also want to
+// know the network address of the client, for example to only allow some users
+// from some networks. When the server is behind a load balancer using the PROXY
+// protocol, it's the address of the original client.
+type AddrAuthenticator interface {
+	AuthenticateAddr(id string, cred interface{}, addr net.Addr) error
+}
+
 func Register(name string, provider Authenticator) {
 	if provider == nil {
 		panic("auth: Register provide is nil")
@@ -62,3 +71,13 @@ func NewManager(providerName string) (*Manager, error) {
 func (this *Manager) Authenticate(id string, cred interface{}) error {
 	return this.p.Authenticate(id, cred)
 }
+
+// AuthenticateAddr is the same as Authenticate, but also passes on the address of
+// the client if the provider is an AddrAuthenticator.
+func (this *Manager) AuthenticateAddr(id string, cred interface{}, addr net.Addr) error {
+	if p, ok := this.p.(AddrAuthenticator); ok {
+		return p.AuthenticateAddr(id, cred, addr)
+	}
+
+	return this.p.Authenticate(id, cred)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package authtest checks that an auth.Authenticator behaves the way the server
+// expects it to.
+//
+// The server calls the authenticator with the user name and password of every
+// client that connects, from as many goroutines as there are clients
+// connecting, and only lets the client in if it returns nil. TestAuthenticator
+// checks the authenticator accepts and refuses the credentials it's given, and
+// keeps doing so when called concurrently. Authenticators that also implement
+// auth.AddrAuthenticator are called with the address of each credential, the
+// same as the server does.
+//
+// To check an authenticator, call TestAuthenticator from one of its tests with
+// credentials it should accept and credentials it should refuse:
+//
+//	func TestConformance(t *testing.T) {
+//		authtest.TestAuthenticator(t, newLDAPAuthenticator(testAddr),
+//			[]authtest.Credentials{{ID: "alice", Cred: "secret"}},
+//			[]authtest.Credentials{{ID: "alice", Cred: "wrong"}, {ID: "mallory", Cred: "secret"}})
+//	}
+package authtest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/auth"
+)
+
+// Credentials are the user name and password of a client, and the address it
+// connects from.
+type Credentials struct {
+	// ID is the user name
+	ID string
+
+	// Cred is the password. The server passes it as a string.
+	Cred interface{}
+
+	// Addr is the address of the client. If not set then 127.0.0.1:1883 is used.
+	Addr net.Addr
+}
+
+func (this Credentials) String() string {
+	return fmt.Sprintf("%q/%v from %v", this.ID, this.Cred, this.addr())
+}
+
+func (this Credentials) addr() net.Addr {
+	if this.Addr != nil {
+		return this.Addr
+	}
+
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1883}
+}
+
+// TestAuthenticator runs the conformance tests against a. It must accept all the
+// valid credentials, and refuse all the invalid ones.
+func TestAuthenticator(t *testing.T, a auth.Authenticator, valid, invalid []Credentials) {
+	require.NotNil(t, a, "authenticator is nil")
+
+	t.Run("Valid", func(t *testing.T) {
+		for _, c := range valid {
+			require.NoError(t, authenticate(a, c), "credentials %s", c)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, c := range invalid {
+			require.Error(t, authenticate(a, c), "credentials %s", c)
+		}
+	})
+
+	// Clients can send anything, or nothing at all, so odd credentials must be
+	// refused or accepted rather than crash the server
+	t.Run("Odd", func(t *testing.T) {
+		for _, c := range []Credentials{{}, {ID: "authtest"}, {ID: "authtest", Cred: ""}, {ID: "authtest", Cred: []byte("x")}} {
+			require.NotPanics(t, func() { authenticate(a, c) }, "credentials %s", c)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const n = 10
+
+		var (
+			wg   sync.WaitGroup
+			errs = make(chan error, n*(len(valid)+len(invalid)))
+		)
+
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for _, c := range valid {
+					if err := authenticate(a, c); err != nil {
+						errs <- fmt.Errorf("credentials %s refused: %v", c, err)
+					}
+				}
+
+				for _, c := range invalid {
+					if err := authenticate(a, c); err == nil {
+						errs <- fmt.Errorf("credentials %s accepted", c)
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	})
+}
+
+// authenticate calls the authenticator the way the server does.
+func authenticate(a auth.Authenticator, c Credentials) error {
+	if aa, ok := a.(auth.AddrAuthenticator); ok {
+		return aa.AuthenticateAddr(c.ID, c.Cred, c.addr())
+	}
+
+	return a.Authenticate(c.ID, c.Cred)
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth_test
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/auth/authtest"
+)
+
+func TestMockAuthenticatorConformance(t *testing.T) {
+	success, err := auth.NewManager("mockSuccess")
+	require.NoError(t, err)
+
+	authtest.TestAuthenticator(t, success, []authtest.Credentials{{ID: "surgemq", Cred: "verysecret"}}, nil)
+
+	failure, err := auth.NewManager("mockFailure")
+	require.NoError(t, err)
+
+	authtest.TestAuthenticator(t, failure, nil, []authtest.Credentials{{ID: "surgemq", Cred: "verysecret"}})
+}
+
+// The plugin is the helper process of the auth package tests, which are in the
+// same test binary.
+func TestPluginAuthenticatorConformance(t *testing.T) {
+	p := auth.NewPluginAuthenticator(os.Args[0], "-test.run=TestPluginHelperProcess")
+	p.Env = []string{"SURGEMQ_TEST_PLUGIN=1"}
+	defer p.Close()
+
+	authtest.TestAuthenticator(t, p,
+		[]authtest.Credentials{
+			{ID: "surgemq", Cred: "verysecret"},
+			{ID: "surgemq", Cred: "verysecret", Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1883}},
+		},
+		[]authtest.Credentials{
+			{ID: "surgemq", Cred: "wrong"},
+			{ID: "nobody", Cred: "verysecret"},
+			{ID: "surgemq", Cred: "verysecret", Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1883}},
+		})
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrMechanismNotFound = errors.New("auth: Authentication mechanism not found")
+)
+
+// Mechanism is an enhanced authentication method, which authenticates a client
+// in an exchange of challenges and responses, such as the one carried by the
+// MQTT 5 AUTH packet, rather than from a password sent in the clear.
+type Mechanism interface {
+	// Name is the authentication method, e.g. "SCRAM-SHA-256".
+	Name() string
+
+	// Start begins an exchange with a client.
+	Start() Exchange
+}
+
+// Exchange is the server side of one authentication exchange.
+type Exchange interface {
+	// Next takes the data sent by the client, and returns the data to send back.
+	// done is true once the client is authenticated, in which case resp is the
+	// last data for it. Any error, such as ErrAuthFailure, ends the exchange.
+	Next(data []byte) (resp []byte, done bool, err error)
+
+	// ID is the identity the client authenticated as, once done.
+	ID() string
+}
+
+var (
+	mmu        sync.RWMutex
+	mechanisms = make(map[string]Mechanism)
+)
+
+// RegisterMechanism makes m available by its Name to LookupMechanism.
+func RegisterMechanism(m Mechanism) {
+	if m == nil {
+		panic("auth: RegisterMechanism mechanism is nil")
+	}
+
+	mmu.Lock()
+	defer mmu.Unlock()
+
+	if _, dup := mechanisms[m.Name()]; dup {
+		panic("auth: RegisterMechanism called twice for mechanism " + m.Name())
+	}
+
+	mechanisms[m.Name()] = m
+}
+
+func UnregisterMechanism(name string) {
+	mmu.Lock()
+	defer mmu.Unlock()
+
+	delete(mechanisms, name)
+}
+
+// LookupMechanism returns the mechanism registered for the authentication method
+// name.
+func LookupMechanism(name string) (Mechanism, error) {
+	mmu.RLock()
+	defer mmu.RUnlock()
+
+	m, ok := mechanisms[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrMechanismNotFound, name)
+	}
+
+	return m, nil
+}
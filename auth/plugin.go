@@ -0,0 +1,222 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPluginTimeout = 5 * time.Second
+)
+
+var (
+	ErrPluginTimeout = errors.New("auth: Plugin did not respond in time")
+)
+
+var (
+	_ Authenticator     = (*PluginAuthenticator)(nil)
+	_ AddrAuthenticator = (*PluginAuthenticator)(nil)
+)
+
+// PluginRequest is written, as a single line of JSON, to the standard input of a
+// plugin process for every authentication request.
+type PluginRequest struct {
+	Id   string `json:"id"`
+	Cred string `json:"cred"`
+
+	// The network address of the client, if known
+	Addr string `json:"addr,omitempty"`
+}
+
+// PluginResponse is read, as a single line of JSON, from the standard output of a
+// plugin process in response to a PluginRequest.
+type PluginResponse struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// PluginAuthenticator is an Authenticator that delegates to an external process,
+// so authentication providers can be written in any language and can crash
+// without taking down the server.
+//
+// The process is started on the first request. Each request is written to its
+// standard input as a PluginRequest, and the process must answer each one, in
+// order, with a PluginResponse on its standard output. If the process exits,
+// misbehaves or doesn't answer within Timeout, the request fails and the process
+// is restarted on the next request.
+type PluginAuthenticator struct {
+	// Path is the executable of the plugin process.
+	Path string
+
+	// Args are the arguments passed to the plugin process.
+	Args []string
+
+	// Env is the environment of the plugin process. If nil then the process
+	// inherits the environment of the server.
+	Env []string
+
+	// Timeout is how long to wait for the plugin to answer a request. If not set
+	// then default to 5 seconds.
+	Timeout time.Duration
+
+	// Serializes requests to the plugin process
+	mu sync.Mutex
+
+	cmd *exec.Cmd
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// NewPluginAuthenticator returns a PluginAuthenticator that runs the executable at
+// path with the supplied arguments. To use it, register it under a name of your
+// choice with Register, and set the Server's Authenticator to that name.
+func NewPluginAuthenticator(path string, args ...string) *PluginAuthenticator {
+	return &PluginAuthenticator{
+		Path: path,
+		Args: args,
+	}
+}
+
+func (this *PluginAuthenticator) Authenticate(id string, cred interface{}) error {
+	return this.AuthenticateAddr(id, cred, nil)
+}
+
+// AuthenticateAddr is the same as Authenticate, but also passes the address of the
+// client on to the plugin.
+func (this *PluginAuthenticator) AuthenticateAddr(id string, cred interface{}, addr net.Addr) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.cmd == nil {
+		if err := this.start(); err != nil {
+			return err
+		}
+	}
+
+	preq := &PluginRequest{Id: id, Cred: fmt.Sprint(cred)}
+	if addr != nil {
+		preq.Addr = addr.String()
+	}
+
+	req, err := json.Marshal(preq)
+	if err != nil {
+		return err
+	}
+
+	if _, err := this.in.Write(append(req, '\n')); err != nil {
+		this.stop()
+		return err
+	}
+
+	timeout := this.Timeout
+	if timeout == 0 {
+		timeout = defaultPluginTimeout
+	}
+
+	type result struct {
+		line []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+	out := this.out
+
+	go func() {
+		line, err := out.ReadBytes('\n')
+		done <- result{line, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			this.stop()
+			return r.err
+		}
+
+		resp := &PluginResponse{}
+		if err := json.Unmarshal(r.line, resp); err != nil {
+			this.stop()
+			return err
+		}
+
+		if !resp.Ok {
+			return ErrAuthFailure
+		}
+
+		return nil
+
+	case <-time.After(timeout):
+		this.stop()
+		return ErrPluginTimeout
+	}
+}
+
+// Close stops the plugin process if it's running.
+func (this *PluginAuthenticator) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.stop()
+	return nil
+}
+
+func (this *PluginAuthenticator) start() error {
+	cmd := exec.Command(this.Path, this.Args...)
+	cmd.Env = this.Env
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	this.cmd = cmd
+	this.in = in
+	this.out = bufio.NewReader(out)
+
+	return nil
+}
+
+// stop kills the plugin process, if any, so the next request starts a new one.
+func (this *PluginAuthenticator) stop() {
+	if this.cmd == nil {
+		return
+	}
+
+	this.in.Close()
+	this.cmd.Process.Kill()
+	this.cmd.Wait()
+
+	this.cmd = nil
+	this.in = nil
+	this.out = nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestPluginHelperProcess isn't a real test. It's the plugin process started by
+// the other tests, which accepts the "surgemq" id, unless it's from 192.0.2.0/24,
+// and exits on the "crash" id.
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("SURGEMQ_TEST_PLUGIN") != "1" {
+		return
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+
+	for in.Scan() {
+		req := &PluginRequest{}
+		if err := json.Unmarshal(in.Bytes(), req); err != nil {
+			os.Exit(2)
+		}
+
+		switch req.Id {
+		case "crash":
+			os.Exit(1)
+
+		case "slow":
+			time.Sleep(time.Second)
+
+		default:
+			ok := req.Id == "surgemq" && req.Cred == "verysecret" && !strings.HasPrefix(req.Addr, "192.0.2.")
+			out.Encode(&PluginResponse{Ok: ok})
+		}
+	}
+
+	os.Exit(0)
+}
+
+func newTestPlugin() *PluginAuthenticator {
+	p := NewPluginAuthenticator(os.Args[0], "-test.run=TestPluginHelperProcess")
+	p.Env = []string{"SURGEMQ_TEST_PLUGIN=1"}
+	return p
+}
+
+func TestPluginAuthenticator(t *testing.T) {
+	p := newTestPlugin()
+	defer p.Close()
+
+	require.NoError(t, p.Authenticate("surgemq", "verysecret"))
+	require.Equal(t, ErrAuthFailure, p.Authenticate("surgemq", "wrong"))
+	require.Equal(t, ErrAuthFailure, p.Authenticate("nobody", "verysecret"))
+}
+
+func TestPluginAuthenticatorAddr(t *testing.T) {
+	p := newTestPlugin()
+	defer p.Close()
+
+	require.NoError(t, p.AuthenticateAddr("surgemq", "verysecret", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1883}))
+	require.Equal(t, ErrAuthFailure, p.AuthenticateAddr("surgemq", "verysecret", &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1883}))
+}
+
+func TestPluginAuthenticatorRestart(t *testing.T) {
+	p := newTestPlugin()
+	defer p.Close()
+
+	require.NoError(t, p.Authenticate("surgemq", "verysecret"))
+
+	// The plugin dies, the request fails, and the next one gets a new process
+	require.Error(t, p.Authenticate("crash", ""))
+	require.NoError(t, p.Authenticate("surgemq", "verysecret"))
+}
+
+func TestPluginAuthenticatorTimeout(t *testing.T) {
+	p := newTestPlugin()
+	p.Timeout = 50 * time.Millisecond
+	defer p.Close()
+
+	require.Equal(t, ErrPluginTimeout, p.Authenticate("slow", ""))
+	require.NoError(t, p.Authenticate("surgemq", "verysecret"))
+}
+
+func TestPluginAuthenticatorManager(t *testing.T) {
+	p := newTestPlugin()
+	defer p.Close()
+
+	Register("testPlugin", p)
+	defer Unregister("testPlugin")
+
+	mgr, err := NewManager("testPlugin")
+	require.NoError(t, err)
+	require.NoError(t, mgr.Authenticate("surgemq", "verysecret"))
+}
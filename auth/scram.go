@@ -0,0 +1,374 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// SCRAMSHA256 is the name of the SCRAM-SHA-256 authentication method.
+const SCRAMSHA256 = "SCRAM-SHA-256"
+
+// DefaultSCRAMIterations is the iteration count recommended by RFC 7677.
+const DefaultSCRAMIterations = 4096
+
+var (
+	ErrInvalidSCRAM = errors.New("auth: Invalid SCRAM message")
+)
+
+var _ Mechanism = (*SCRAM)(nil)
+
+// SCRAMCredentials is what the server keeps of a password for SCRAM. The password
+// can't be recovered from it, and a client can't log in with it either.
+type SCRAMCredentials struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	StoredKey  []byte `json:"stored_key"`
+	ServerKey  []byte `json:"server_key"`
+}
+
+// NewSCRAMCredentials derives the SCRAM-SHA-256 credentials of password, with a
+// random salt if salt is nil, and DefaultSCRAMIterations if iterations is 0.
+func NewSCRAMCredentials(password string, salt []byte, iterations int) (SCRAMCredentials, error) {
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return SCRAMCredentials{}, err
+		}
+	}
+
+	if iterations == 0 {
+		iterations = DefaultSCRAMIterations
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return SCRAMCredentials{}, err
+	}
+
+	stored := sha256.Sum256(scramHMAC(salted, "Client Key"))
+
+	return SCRAMCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  stored[:],
+		ServerKey:  scramHMAC(salted, "Server Key"),
+	}, nil
+}
+
+// SCRAM is the SCRAM-SHA-256 Mechanism of RFC 7677, without channel binding, so
+// the clients authenticate without the password ever being sent to the server.
+type SCRAM struct {
+	// Credentials returns the credentials of user, or ErrAuthFailure if there's
+	// no such user.
+	Credentials func(user string) (SCRAMCredentials, error)
+}
+
+func (this *SCRAM) Name() string {
+	return SCRAMSHA256
+}
+
+func (this *SCRAM) Start() Exchange {
+	return &scramExchange{m: this}
+}
+
+// scramExchange is the server side of a SCRAM exchange: the client-first message
+// is answered with the server-first one, and the client-final message with the
+// server-final one once the proof checks out.
+type scramExchange struct {
+	m    *SCRAM
+	step int
+	user string
+	cred SCRAMCredentials
+
+	nonce           string
+	gs2             string
+	clientFirstBare string
+	serverFirst     string
+}
+
+func (this *scramExchange) ID() string {
+	if this.step < 2 {
+		return ""
+	}
+
+	return this.user
+}
+
+func (this *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	switch this.step {
+	case 0:
+		resp, err := this.first(string(data))
+		if err != nil {
+			return nil, false, err
+		}
+
+		this.step++
+		return resp, false, nil
+
+	case 1:
+		resp, err := this.final(string(data))
+		if err != nil {
+			return nil, false, err
+		}
+
+		this.step++
+		return resp, true, nil
+	}
+
+	return nil, false, ErrInvalidSCRAM
+}
+
+// first takes the client-first message, "n,,n=<user>,r=<client nonce>".
+func (this *scramExchange) first(msg string) ([]byte, error) {
+	// Only the "no channel binding" GS2 headers, and without an authzid
+	var bare string
+	switch {
+	case strings.HasPrefix(msg, "n,,"), strings.HasPrefix(msg, "y,,"):
+		this.gs2, bare = msg[:3], msg[3:]
+	default:
+		return nil, ErrInvalidSCRAM
+	}
+
+	attrs, err := scramAttributes(bare)
+	if err != nil {
+		return nil, err
+	}
+
+	user, ok := scramUnescape(attrs["n"])
+	if !ok || user == "" || attrs["r"] == "" {
+		return nil, ErrInvalidSCRAM
+	}
+
+	if this.cred, err = this.m.Credentials(user); err != nil {
+		return nil, err
+	}
+
+	snonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	this.user = user
+	this.nonce = attrs["r"] + snonce
+	this.clientFirstBare = bare
+	this.serverFirst = "r=" + this.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(this.cred.Salt) +
+		",i=" + strconv.Itoa(this.cred.Iterations)
+
+	return []byte(this.serverFirst), nil
+}
+
+// final takes the client-final message, "c=<GS2 header>,r=<nonce>,p=<proof>".
+func (this *scramExchange) final(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, ErrInvalidSCRAM
+	}
+
+	withoutProof := msg[:i]
+
+	attrs, err := scramAttributes(withoutProof)
+	if err != nil {
+		return nil, err
+	}
+
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(this.gs2)) || attrs["r"] != this.nonce {
+		return nil, ErrInvalidSCRAM
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrInvalidSCRAM
+	}
+
+	authMsg := this.clientFirstBare + "," + this.serverFirst + "," + withoutProof
+
+	// The proof is the client key XORed with the client signature, and the
+	// client key hashes to the stored key
+	sig := scramHMAC(this.cred.StoredKey, authMsg)
+	for j := range proof {
+		proof[j] ^= sig[j]
+	}
+
+	key := sha256.Sum256(proof)
+	if subtle.ConstantTimeCompare(key[:], this.cred.StoredKey) != 1 {
+		return nil, ErrAuthFailure
+	}
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(scramHMAC(this.cred.ServerKey, authMsg))), nil
+}
+
+// SCRAMClient is the client side of a SCRAM-SHA-256 exchange.
+type SCRAMClient struct {
+	user     string
+	password string
+
+	nonce           string
+	clientFirstBare string
+	serverKey       []byte
+	authMsg         string
+}
+
+func NewSCRAMClient(user, password string) *SCRAMClient {
+	return &SCRAMClient{user: user, password: password}
+}
+
+// First returns the client-first message, which starts the exchange.
+func (this *SCRAMClient) First() ([]byte, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	this.nonce = nonce
+	this.clientFirstBare = "n=" + scramEscape(this.user) + ",r=" + nonce
+
+	return []byte("n,," + this.clientFirstBare), nil
+}
+
+// Final returns the client-final message, with the proof of the password, in
+// response to the server-first message.
+func (this *SCRAMClient) Final(serverFirst []byte) ([]byte, error) {
+	attrs, err := scramAttributes(string(serverFirst))
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, this.nonce) || len(nonce) == len(this.nonce) {
+		return nil, ErrInvalidSCRAM
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, ErrInvalidSCRAM
+	}
+
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return nil, ErrInvalidSCRAM
+	}
+
+	salted, err := pbkdf2.Key(sha256.New, this.password, salt, iterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte("n,,")) + ",r=" + nonce
+	this.authMsg = this.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	this.serverKey = scramHMAC(salted, "Server Key")
+
+	clientKey := scramHMAC(salted, "Client Key")
+	stored := sha256.Sum256(clientKey)
+	sig := scramHMAC(stored[:], this.authMsg)
+
+	for i := range clientKey {
+		clientKey[i] ^= sig[i]
+	}
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)), nil
+}
+
+// Verify checks the server-final message proves the server knows the
+// credentials, and isn't just accepting anyone.
+func (this *SCRAMClient) Verify(serverFinal []byte) error {
+	attrs, err := scramAttributes(string(serverFinal))
+	if err != nil {
+		return err
+	}
+
+	if e, ok := attrs["e"]; ok {
+		return errors.New("auth: SCRAM server error: " + e)
+	}
+
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || this.serverKey == nil {
+		return ErrInvalidSCRAM
+	}
+
+	if !hmac.Equal(v, scramHMAC(this.serverKey, this.authMsg)) {
+		return ErrAuthFailure
+	}
+
+	return nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(msg))
+	return h.Sum(nil)
+}
+
+func scramNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// scramAttributes parses the attributes of a SCRAM message, "a=1,b=2".
+func scramAttributes(msg string) (map[string]string, error) {
+	attrs := make(map[string]string)
+
+	for _, kv := range strings.Split(msg, ",") {
+		if len(kv) < 2 || kv[1] != '=' {
+			return nil, ErrInvalidSCRAM
+		}
+
+		attrs[kv[:1]] = kv[2:]
+	}
+
+	return attrs, nil
+}
+
+// scramEscape escapes a user name for SCRAM, where "," and "=" are special.
+func scramEscape(user string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(user)
+}
+
+func scramUnescape(user string) (string, bool) {
+	var b strings.Builder
+
+	for i := 0; i < len(user); i++ {
+		if user[i] != '=' {
+			b.WriteByte(user[i])
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(user[i:], "=3D"):
+			b.WriteByte('=')
+		case strings.HasPrefix(user[i:], "=2C"):
+			b.WriteByte(',')
+		default:
+			return "", false
+		}
+
+		i += 2
+	}
+
+	return b.String(), true
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSCRAM(t *testing.T, user, password string) *SCRAM {
+	cred, err := NewSCRAMCredentials(password, nil, 0)
+	require.NoError(t, err)
+	require.Equal(t, DefaultSCRAMIterations, cred.Iterations)
+
+	return &SCRAM{
+		Credentials: func(u string) (SCRAMCredentials, error) {
+			if u != user {
+				return SCRAMCredentials{}, ErrAuthFailure
+			}
+			return cred, nil
+		},
+	}
+}
+
+// runSCRAM runs an exchange between c and the server side of m, and returns
+// the result of the client-final message.
+func runSCRAM(t *testing.T, m Mechanism, c *SCRAMClient) (Exchange, []byte, bool, error) {
+	x := m.Start()
+
+	first, err := c.First()
+	require.NoError(t, err)
+
+	serverFirst, done, err := x.Next(first)
+	if err != nil {
+		return x, nil, done, err
+	}
+	require.False(t, done)
+
+	final, err := c.Final(serverFirst)
+	require.NoError(t, err)
+
+	serverFinal, done, err := x.Next(final)
+	return x, serverFinal, done, err
+}
+
+func TestSCRAM(t *testing.T) {
+	m := newTestSCRAM(t, "us,er=1", "pencil")
+
+	c := NewSCRAMClient("us,er=1", "pencil")
+
+	x, serverFinal, done, err := runSCRAM(t, m, c)
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Equal(t, "us,er=1", x.ID())
+
+	require.NoError(t, c.Verify(serverFinal))
+
+	// The exchange is over
+	_, _, err = x.Next([]byte("n,,n=user,r=abc"))
+	require.Equal(t, ErrInvalidSCRAM, err)
+}
+
+func TestSCRAMWrongPassword(t *testing.T) {
+	m := newTestSCRAM(t, "user", "pencil")
+
+	x, _, done, err := runSCRAM(t, m, NewSCRAMClient("user", "crayon"))
+	require.Equal(t, ErrAuthFailure, err)
+	require.False(t, done)
+	require.Equal(t, "", x.ID())
+
+	_, _, _, err = runSCRAM(t, m, NewSCRAMClient("nobody", "pencil"))
+	require.Equal(t, ErrAuthFailure, err)
+}
+
+func TestSCRAMServerVerified(t *testing.T) {
+	m := newTestSCRAM(t, "user", "pencil")
+
+	c := NewSCRAMClient("user", "pencil")
+
+	_, _, _, err := runSCRAM(t, m, c)
+	require.NoError(t, err)
+
+	// A server that doesn't know the credentials can't prove it does
+	require.Equal(t, ErrAuthFailure, c.Verify([]byte("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=")))
+	require.Error(t, c.Verify([]byte("e=invalid-proof")))
+}
+
+func TestSCRAMInvalid(t *testing.T) {
+	m := newTestSCRAM(t, "user", "pencil")
+
+	for _, first := range []string{"", "p=tls-unique,,n=user,r=abc", "n,,n=user", "n,,r=abc", "n,,n=us=2Xer,r=abc", "n,,garbage"} {
+		_, _, err := m.Start().Next([]byte(first))
+		require.Equal(t, ErrInvalidSCRAM, err, "client-first %q", first)
+	}
+
+	// The client-final message must carry on with the nonce of the server
+	x := m.Start()
+
+	_, _, err := x.Next([]byte("n,,n=user,r=abc"))
+	require.NoError(t, err)
+
+	_, _, err = x.Next([]byte("c=biws,r=abc,p=AAAA"))
+	require.Equal(t, ErrInvalidSCRAM, err)
+}
+
+func TestRegisterMechanism(t *testing.T) {
+	m := newTestSCRAM(t, "user", "pencil")
+
+	RegisterMechanism(m)
+	defer UnregisterMechanism(SCRAMSHA256)
+
+	got, err := LookupMechanism(SCRAMSHA256)
+	require.NoError(t, err)
+	require.Equal(t, m, got)
+
+	require.Panics(t, func() { RegisterMechanism(m) })
+
+	_, err = LookupMechanism("KERBEROS")
+	require.ErrorIs(t, err, ErrMechanismNotFound)
+}
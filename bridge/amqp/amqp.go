@@ -0,0 +1,305 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package amqp is a bridge between the server and an AMQP 0.9.1 broker such as
+// RabbitMQ. Messages published by clients to selected topics are republished to
+// RabbitMQ exchanges, and messages consumed from a RabbitMQ queue are published
+// back into the server.
+//
+// Topics and routing keys are mapped the same way as the RabbitMQ MQTT plugin
+// does: the "/" separators become ".", and "+" becomes "*", so "sensors/1/temp"
+// is routed with the key "sensors.1.temp", and the other way around.
+//
+// The bridge doesn't depend on any particular AMQP client. Channel is a small
+// interface that's easily satisfied by wrapping an amqp091-go Channel, with
+// publisher confirms turned on so Publish only returns once the broker has the
+// message.
+//
+//	b := &amqp.Bridge{
+//		Server:  svr,
+//		Channel: ch,
+//		Rules:   []amqp.Rule{{Filter: "sensors/#", Exchange: "amq.topic"}},
+//		Queue:   "mqtt-in",
+//	}
+//	svr.Bridges = []service.Bridge{b}
+//	b.Start()
+package amqp
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/topics"
+)
+
+var (
+	// ErrBridgeClosed is returned for messages forwarded after the bridge is closed.
+	ErrBridgeClosed = errors.New("amqp: Bridge closed")
+
+	// ErrNoChannel is returned when the bridge is used without a Channel.
+	ErrNoChannel = errors.New("amqp: Channel not set")
+)
+
+// Delivery is a message consumed from a queue.
+type Delivery struct {
+	RoutingKey string
+	Body       []byte
+
+	// Ack acknowledges the message, and Nack gives it back to the broker.
+	Ack  func() error
+	Nack func(requeue bool) error
+}
+
+// Channel is the connection to the AMQP broker.
+type Channel interface {
+	// Publish publishes the message to the exchange with the routing key, and
+	// returns once the broker has confirmed it.
+	Publish(exchange, key string, body []byte) error
+
+	// Consume starts consuming the queue. The returned channel is closed when the
+	// consumer stops, e.g., because the Channel is closed.
+	Consume(queue string) (<-chan Delivery, error)
+
+	// Close closes the channel. It's called when the bridge is closed.
+	Close() error
+}
+
+// Rule republishes messages published to the topics matching Filter to
+// Exchange. If RoutingKey is set then it's used as the routing key of all the
+// messages, otherwise the topic is mapped to a routing key.
+type Rule struct {
+	Filter     string
+	Exchange   string
+	RoutingKey string
+}
+
+// TopicToRoutingKey maps an MQTT topic or topic filter to an AMQP routing key.
+func TopicToRoutingKey(topic string) string {
+	levels := strings.Split(topic, "/")
+	for i, l := range levels {
+		if l == topics.SWC {
+			levels[i] = "*"
+		}
+	}
+	return strings.Join(levels, ".")
+}
+
+// RoutingKeyToTopic maps an AMQP routing key to an MQTT topic.
+func RoutingKeyToTopic(key string) string {
+	return strings.Replace(key, ".", "/", -1)
+}
+
+// Bridge connects the server to an AMQP broker. It implements service.Bridge.
+type Bridge struct {
+	// Server is where the messages consumed from Queue are published. It's only
+	// needed if Queue is set.
+	Server *service.Server
+
+	// Channel is the connection to the AMQP broker.
+	Channel Channel
+
+	// Rules select the messages that are republished to RabbitMQ, and where to. The
+	// first rule that matches the topic of a message is used. Messages that don't
+	// match any rule are not republished.
+	Rules []Rule
+
+	// Queue is the queue consumed to publish messages back into the server. If not
+	// set then nothing is consumed.
+	Queue string
+
+	// TopicPrefix is prepended to the topics of the messages consumed from Queue.
+	// If not set then the topics are just the mapped routing keys.
+	TopicPrefix string
+
+	// QoS is the QoS the messages consumed from Queue are published with. If not
+	// set then default to 0.
+	QoS byte
+
+	mu        sync.RWMutex
+	closed    bool
+	out       chan *outgoing
+	published chan struct{}
+	wg        sync.WaitGroup
+	once      sync.Once
+}
+
+type outgoing struct {
+	exchange, key string
+	body          []byte
+	done          func(error)
+}
+
+// Start starts consuming Queue, if it's set.
+func (this *Bridge) Start() error {
+	if this.Channel == nil {
+		return ErrNoChannel
+	}
+
+	this.once.Do(this.start)
+
+	if this.Queue == "" {
+		return nil
+	}
+
+	if this.Server == nil {
+		return errors.New("amqp/Start: Server is not set")
+	}
+
+	ds, err := this.Channel.Consume(this.Queue)
+	if err != nil {
+		return err
+	}
+
+	this.wg.Add(1)
+	go this.consumer(ds)
+
+	return nil
+}
+
+// Forward republishes the message to the exchange of the first matching rule.
+// done is called once the broker has confirmed it.
+func (this *Bridge) Forward(cid string, msg *message.PublishMessage, done func(error)) {
+	rule := this.rule(msg.Topic())
+	if rule == nil {
+		done(nil)
+		return
+	}
+
+	if this.Channel == nil {
+		done(ErrNoChannel)
+		return
+	}
+
+	this.once.Do(this.start)
+
+	out := &outgoing{
+		exchange: rule.Exchange,
+		key:      rule.RoutingKey,
+		body:     append([]byte(nil), msg.Payload()...),
+		done:     done,
+	}
+
+	if out.key == "" {
+		out.key = TopicToRoutingKey(string(msg.Topic()))
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if this.closed {
+		done(ErrBridgeClosed)
+		return
+	}
+
+	this.out <- out
+}
+
+// Close stops consuming, publishes whatever messages are queued, then closes the
+// channel.
+func (this *Bridge) Close() error {
+	this.once.Do(this.start)
+
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.out)
+	this.mu.Unlock()
+
+	// Closing the channel stops the consumer, so wait for the publisher first
+	// since it needs the channel open.
+	<-this.published
+
+	var err error
+	if this.Channel != nil {
+		err = this.Channel.Close()
+	}
+
+	this.wg.Wait()
+
+	return err
+}
+
+func (this *Bridge) rule(topic []byte) *Rule {
+	for i := range this.Rules {
+		if topics.Match([]byte(this.Rules[i].Filter), topic) {
+			return &this.Rules[i]
+		}
+	}
+
+	return nil
+}
+
+func (this *Bridge) start() {
+	this.out = make(chan *outgoing, 100)
+	this.published = make(chan struct{})
+
+	go this.publisher()
+}
+
+// publisher publishes the forwarded messages one at a time, so they reach the
+// broker in the order they were published.
+func (this *Bridge) publisher() {
+	defer close(this.published)
+
+	for out := range this.out {
+		out.done(this.Channel.Publish(out.exchange, out.key, out.body))
+	}
+}
+
+// consumer publishes the messages consumed from the queue into the server, and
+// acknowledges them once that's done.
+func (this *Bridge) consumer(ds <-chan Delivery) {
+	defer this.wg.Done()
+
+	for d := range ds {
+		msg := message.NewPublishMessage()
+
+		if err := msg.SetTopic([]byte(this.TopicPrefix + RoutingKeyToTopic(d.RoutingKey))); err != nil {
+			glog.Errorf("amqp/consumer: Invalid topic for routing key %q: %v", d.RoutingKey, err)
+			if d.Nack != nil {
+				d.Nack(false)
+			}
+			continue
+		}
+
+		msg.SetPayload(d.Body)
+
+		if err := msg.SetQoS(this.QoS); err != nil {
+			glog.Errorf("amqp/consumer: %v", err)
+		}
+
+		// Published as is, without a client ID, so it isn't forwarded to the bridges
+		// and back out to the broker
+		if _, err := this.Server.Publish(msg, nil); err != nil {
+			glog.Errorf("amqp/consumer: Error publishing message from routing key %q: %v", d.RoutingKey, err)
+			if d.Nack != nil {
+				d.Nack(true)
+			}
+			continue
+		}
+
+		if d.Ack != nil {
+			if err := d.Ack(); err != nil {
+				glog.Errorf("amqp/consumer: Error acknowledging message: %v", err)
+			}
+		}
+	}
+}
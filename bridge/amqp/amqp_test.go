@@ -0,0 +1,187 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package amqp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/service/servicetest"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+type published struct {
+	exchange, key, body string
+}
+
+type testChannel struct {
+	mu        sync.Mutex
+	published []published
+	queue     string
+	ds        chan Delivery
+	closed    bool
+}
+
+func (this *testChannel) Publish(exchange, key string, body []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.published = append(this.published, published{exchange, key, string(body)})
+	return nil
+}
+
+func (this *testChannel) Consume(queue string) (<-chan Delivery, error) {
+	this.queue = queue
+	return this.ds, nil
+}
+
+func (this *testChannel) Close() error {
+	this.closed = true
+	close(this.ds)
+	return nil
+}
+
+func newPublishMessage(topic, payload string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+	return msg
+}
+
+func wait(t *testing.T, ch chan error) error {
+	select {
+	case err := <-ch:
+		return err
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message to be published")
+	}
+
+	return nil
+}
+
+func TestTopicRoutingKeyMapping(t *testing.T) {
+	require.Equal(t, "sensors.1.temp", TopicToRoutingKey("sensors/1/temp"))
+	require.Equal(t, "sensors.*.temp", TopicToRoutingKey("sensors/+/temp"))
+	require.Equal(t, "sensors.#", TopicToRoutingKey("sensors/#"))
+	require.Equal(t, "sensors/1/temp", RoutingKeyToTopic("sensors.1.temp"))
+}
+
+func TestBridgeForward(t *testing.T) {
+	ch := &testChannel{ds: make(chan Delivery)}
+	b := &Bridge{
+		Channel: ch,
+		Rules: []Rule{
+			{Filter: "alarms/#", Exchange: "alarms", RoutingKey: "all"},
+			{Filter: "sensors/#", Exchange: "amq.topic"},
+		},
+	}
+
+	forward := func(topic, payload string) error {
+		done := make(chan error, 1)
+		b.Forward("c1", newPublishMessage(topic, payload), func(err error) {
+			done <- err
+		})
+		return wait(t, done)
+	}
+
+	require.NoError(t, forward("sensors/1/temp", "21"))
+	require.NoError(t, forward("alarms/fire", "!"))
+	require.NoError(t, forward("other", "x"))
+
+	require.NoError(t, b.Close())
+	require.True(t, ch.closed)
+
+	require.Equal(t, []published{
+		{"amq.topic", "sensors.1.temp", "21"},
+		{"alarms", "all", "!"},
+	}, ch.published)
+
+	require.Equal(t, ErrBridgeClosed, forward("sensors/1/temp", "21"))
+}
+
+func TestBridgeConformance(t *testing.T) {
+	b := &Bridge{
+		Channel: &testChannel{ds: make(chan Delivery)},
+		Rules:   []Rule{{Filter: "sensors/#", Exchange: "amq.topic"}},
+	}
+	defer b.Close()
+
+	servicetest.TestBridge(t, b, "sensors/1/temp", "other")
+}
+
+func TestBridgeConsume(t *testing.T) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	svr := &service.Server{}
+	defer svr.Close()
+
+	msgs := make(chan *message.PublishMessage, 1)
+	var onpub service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		msgs <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("rabbit/#"), message.QosAtLeastOnce, &onpub)
+	require.NoError(t, err)
+
+	ch := &testChannel{ds: make(chan Delivery)}
+	b := &Bridge{
+		Server:      svr,
+		Channel:     ch,
+		Queue:       "mqtt-in",
+		TopicPrefix: "rabbit/",
+		QoS:         message.QosAtLeastOnce,
+	}
+	require.NoError(t, b.Start())
+	require.Equal(t, "mqtt-in", ch.queue)
+
+	acked := make(chan struct{})
+	ch.ds <- Delivery{
+		RoutingKey: "orders.42",
+		Body:       []byte("shipped"),
+		Ack: func() error {
+			close(acked)
+			return nil
+		},
+	}
+
+	select {
+	case msg := <-msgs:
+		require.Equal(t, "rabbit/orders/42", string(msg.Topic()))
+		require.Equal(t, "shipped", string(msg.Payload()))
+		require.Equal(t, message.QosAtLeastOnce, msg.QoS())
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message")
+	}
+
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the delivery to be acknowledged")
+	}
+
+	require.NoError(t, b.Close())
+}
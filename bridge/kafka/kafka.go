@@ -0,0 +1,340 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kafka is a bridge that forwards the messages clients publish to Kafka
+// topics. MQTT topic filters are mapped to Kafka topics, and the messages are
+// batched up before being handed to the Kafka producer.
+//
+// Delivery is at least once for QoS 1 messages: the server only sends the PUBACK
+// once the batch the message is in has been acknowledged by Kafka. If producing
+// the batch fails, the server disconnects the clients waiting on it, and those
+// with a persistent session publish the messages again once they reconnect. QoS 0
+// messages are forwarded on a best effort basis, and QoS 2 messages are forwarded
+// once they are released.
+//
+// Every message carries the ID the server assigned to it, which producers can send
+// as a header for consumers to deduplicate the messages with. The IDs keep going
+// up across restarts of the server, so a batch produced again, after an error
+// where Kafka did in fact get it, or after a restart of whatever the messages are
+// forwarded on to, can be told apart from new messages.
+//
+// When the server traces the messages, the trace context of each message is in
+// its Headers, as set by the global OpenTelemetry propagator, for producers to
+// send along so consumers can carry on the trace.
+//
+// The bridge doesn't depend on any particular Kafka client. Producer is a small
+// interface that's easily satisfied by wrapping, for example, a kafka-go Writer
+// or a sarama SyncProducer.
+//
+//	svr := &service.Server{
+//		Bridges: []service.Bridge{
+//			&kafka.Bridge{
+//				Producer: producer,
+//				Routes:   []kafka.Route{{Filter: "sensors/#", Topic: "sensors"}},
+//				Key:      kafka.TopicLevelKey(1),
+//			},
+//		},
+//	}
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultBatchSize    = 100
+	DefaultBatchTimeout = 100 * time.Millisecond
+)
+
+var (
+	// ErrBridgeClosed is returned for messages forwarded after the bridge is closed.
+	ErrBridgeClosed = errors.New("kafka: Bridge closed")
+
+	// ErrNoProducer is returned for messages forwarded to a bridge without a
+	// Producer.
+	ErrNoProducer = errors.New("kafka: Producer not set")
+)
+
+// Message is a message to be produced to Kafka.
+type Message struct {
+	Topic string
+	Key   []byte
+	Value []byte
+
+	// ID is the ID the server assigned to the message, to be used as its
+	// idempotency key, or 0 if it doesn't have one.
+	ID uint64
+
+	// Headers are the trace context of the message, e.g. "traceparent", or nil
+	// if it isn't traced.
+	Headers map[string]string
+}
+
+// IDHeader is the name of the Kafka header producers are suggested to send the
+// ID of each message in, as a decimal string.
+const IDHeader = "mqtt-message-id"
+
+// Producer sends messages to Kafka.
+type Producer interface {
+	// Produce sends a batch of messages, and returns once Kafka has acknowledged
+	// all of them, or with an error if any of them failed.
+	Produce(msgs []Message) error
+
+	// Close closes the producer. It's called when the bridge is closed.
+	Close() error
+}
+
+// Route maps the MQTT topics matching Filter to the Kafka topic Topic.
+type Route struct {
+	Filter string
+	Topic  string
+}
+
+// KeyFunc returns the Kafka message key for a message published to the MQTT topic
+// by the client cid.
+type KeyFunc func(cid string, topic []byte) []byte
+
+// ClientIDKey uses the ID of the publishing client as the key, so all the
+// messages from one client end up in the same partition.
+func ClientIDKey(cid string, topic []byte) []byte {
+	return []byte(cid)
+}
+
+// TopicLevelKey uses the nth level of the MQTT topic, counting from 0, as the key.
+// For example, TopicLevelKey(1) keys "sensors/42/temp" by "42". Topics with fewer
+// levels have no key.
+func TopicLevelKey(n int) KeyFunc {
+	return func(cid string, topic []byte) []byte {
+		for start, level := 0, 0; start <= len(topic); level++ {
+			end := start
+			for end < len(topic) && topic[end] != '/' {
+				end++
+			}
+
+			if level == n {
+				return append([]byte{}, topic[start:end]...)
+			}
+
+			start = end + 1
+		}
+
+		return nil
+	}
+}
+
+// Bridge forwards messages to Kafka. It implements service.Bridge.
+type Bridge struct {
+	// Producer is the Kafka producer the messages are sent with.
+	Producer Producer
+
+	// Routes map MQTT topic filters to Kafka topics. The first route that matches
+	// the topic of a message is used. Messages that don't match any route are not
+	// forwarded.
+	Routes []Route
+
+	// Key returns the key of the Kafka messages. If not set then the messages have
+	// no key.
+	Key KeyFunc
+
+	// BatchSize is the number of messages sent to the producer at once. If not set
+	// then default to 100.
+	BatchSize int
+
+	// BatchTimeout is how long to wait for a batch to fill up before sending it
+	// anyway. If not set then default to 100ms.
+	BatchTimeout time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	in     chan *pending
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+type pending struct {
+	msg  Message
+	done func(error)
+}
+
+// Forward queues the message for the Kafka topic it's routed to. done is called
+// once the batch it's in has been produced. The message has no ID.
+func (this *Bridge) Forward(cid string, msg *message.PublishMessage, done func(error)) {
+	this.ForwardID(0, cid, msg, done)
+}
+
+// ForwardID is Forward for a message with the ID id. It makes the bridge a
+// service.IDBridge.
+func (this *Bridge) ForwardID(id uint64, cid string, msg *message.PublishMessage, done func(error)) {
+	this.ForwardContext(context.Background(), id, cid, msg, done)
+}
+
+// ForwardContext is ForwardID for a message published in ctx, whose trace
+// context goes in the Headers. It makes the bridge a service.ContextBridge.
+func (this *Bridge) ForwardContext(ctx context.Context, id uint64, cid string, msg *message.PublishMessage, done func(error)) {
+	route := this.route(msg.Topic())
+	if route == nil {
+		done(nil)
+		return
+	}
+
+	if this.Producer == nil {
+		done(ErrNoProducer)
+		return
+	}
+
+	this.once.Do(this.start)
+
+	p := &pending{
+		msg: Message{
+			Topic: route.Topic,
+			Value: append([]byte(nil), msg.Payload()...),
+			ID:    id,
+		},
+		done: done,
+	}
+
+	if this.Key != nil {
+		p.msg.Key = this.Key(cid, msg.Topic())
+	}
+
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		p.msg.Headers = make(map[string]string)
+		otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(p.msg.Headers))
+	}
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if this.closed {
+		done(ErrBridgeClosed)
+		return
+	}
+
+	this.in <- p
+}
+
+// Close sends whatever messages are queued, then closes the producer.
+func (this *Bridge) Close() error {
+	this.once.Do(this.start)
+
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil
+	}
+	this.closed = true
+	close(this.in)
+	this.mu.Unlock()
+
+	this.wg.Wait()
+
+	if this.Producer == nil {
+		return nil
+	}
+
+	return this.Producer.Close()
+}
+
+func (this *Bridge) route(topic []byte) *Route {
+	for i := range this.Routes {
+		if topics.Match([]byte(this.Routes[i].Filter), topic) {
+			return &this.Routes[i]
+		}
+	}
+
+	return nil
+}
+
+func (this *Bridge) start() {
+	if this.BatchSize <= 0 {
+		this.BatchSize = DefaultBatchSize
+	}
+
+	if this.BatchTimeout <= 0 {
+		this.BatchTimeout = DefaultBatchTimeout
+	}
+
+	this.in = make(chan *pending, this.BatchSize)
+
+	this.wg.Add(1)
+	go this.batcher()
+}
+
+// batcher collects the queued messages into batches, and sends a batch when it's
+// full, or when the oldest message in it has waited for BatchTimeout.
+func (this *Bridge) batcher() {
+	defer this.wg.Done()
+
+	var (
+		batch []*pending
+		timer *time.Timer
+		tc    <-chan time.Time
+	)
+
+	flush := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, tc = nil, nil
+		}
+
+		if len(batch) == 0 {
+			return
+		}
+
+		msgs := make([]Message, len(batch))
+		for i, p := range batch {
+			msgs[i] = p.msg
+		}
+
+		err := this.Producer.Produce(msgs)
+
+		for _, p := range batch {
+			p.done(err)
+		}
+
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case p, ok := <-this.in:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, p)
+
+			if len(batch) >= this.BatchSize {
+				flush()
+			} else if timer == nil {
+				timer = time.NewTimer(this.BatchTimeout)
+				tc = timer.C
+			}
+
+		case <-tc:
+			timer, tc = nil, nil
+			flush()
+		}
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/service/servicetest"
+)
+
+type testProducer struct {
+	mu      sync.Mutex
+	batches [][]Message
+	err     error
+	closed  bool
+}
+
+func (this *testProducer) Produce(msgs []Message) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.batches = append(this.batches, msgs)
+	return this.err
+}
+
+func (this *testProducer) Close() error {
+	this.closed = true
+	return nil
+}
+
+func (this *testProducer) count() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.batches)
+}
+
+func newPublishMessage(topic, payload string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+	return msg
+}
+
+func forward(b *Bridge, cid, topic, payload string) chan error {
+	ch := make(chan error, 1)
+	b.Forward(cid, newPublishMessage(topic, payload), func(err error) {
+		ch <- err
+	})
+	return ch
+}
+
+func wait(t *testing.T, ch chan error) error {
+	select {
+	case err := <-ch:
+		return err
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message to be produced")
+	}
+
+	return nil
+}
+
+func TestBridgeRoutes(t *testing.T) {
+	p := &testProducer{}
+	b := &Bridge{
+		Producer: p,
+		Routes: []Route{
+			{Filter: "sensors/+/temp", Topic: "temperature"},
+			{Filter: "sensors/#", Topic: "sensors"},
+		},
+		Key:          ClientIDKey,
+		BatchTimeout: 10 * time.Millisecond,
+	}
+
+	// Not routed anywhere
+	require.NoError(t, wait(t, forward(b, "c1", "other/topic", "x")))
+
+	require.NoError(t, wait(t, forward(b, "c1", "sensors/1/temp", "21")))
+	require.NoError(t, wait(t, forward(b, "c2", "sensors/1/humidity", "60")))
+
+	require.NoError(t, b.Close())
+	require.True(t, p.closed)
+
+	require.Equal(t, [][]Message{
+		{{Topic: "temperature", Key: []byte("c1"), Value: []byte("21")}},
+		{{Topic: "sensors", Key: []byte("c2"), Value: []byte("60")}},
+	}, p.batches)
+
+	require.Equal(t, ErrBridgeClosed, wait(t, forward(b, "c1", "sensors/1/temp", "21")))
+}
+
+func TestBridgeConformance(t *testing.T) {
+	b := &Bridge{
+		Producer:     &testProducer{},
+		Routes:       []Route{{Filter: "sensors/#", Topic: "sensors"}},
+		BatchTimeout: 10 * time.Millisecond,
+	}
+	defer b.Close()
+
+	servicetest.TestBridge(t, b, "sensors/1/temp", "other/topic")
+}
+
+func TestBridgeBatchSize(t *testing.T) {
+	p := &testProducer{}
+	b := &Bridge{
+		Producer:     p,
+		Routes:       []Route{{Filter: "#", Topic: "all"}},
+		BatchSize:    3,
+		BatchTimeout: time.Hour,
+	}
+	defer b.Close()
+
+	var chs []chan error
+	for i := 0; i < 3; i++ {
+		chs = append(chs, forward(b, "c1", "a/b", "x"))
+	}
+
+	for _, ch := range chs {
+		require.NoError(t, wait(t, ch))
+	}
+
+	require.Equal(t, 1, p.count())
+	require.Len(t, p.batches[0], 3)
+}
+
+func TestBridgeBatchTimeout(t *testing.T) {
+	p := &testProducer{}
+	b := &Bridge{
+		Producer:     p,
+		Routes:       []Route{{Filter: "#", Topic: "all"}},
+		BatchTimeout: 20 * time.Millisecond,
+	}
+	defer b.Close()
+
+	ch1 := forward(b, "c1", "a/b", "1")
+	ch2 := forward(b, "c1", "a/b", "2")
+
+	start := time.Now()
+	require.NoError(t, wait(t, ch1))
+	require.NoError(t, wait(t, ch2))
+	require.True(t, time.Since(start) >= 10*time.Millisecond)
+
+	require.Equal(t, 1, p.count())
+	require.Len(t, p.batches[0], 2)
+}
+
+func TestBridgeProducerError(t *testing.T) {
+	p := &testProducer{err: errors.New("broker down")}
+	b := &Bridge{
+		Producer:     p,
+		Routes:       []Route{{Filter: "#", Topic: "all"}},
+		BatchTimeout: time.Millisecond,
+	}
+	defer b.Close()
+
+	require.Equal(t, p.err, wait(t, forward(b, "c1", "a/b", "1")))
+}
+
+func TestTopicLevelKey(t *testing.T) {
+	key := TopicLevelKey(1)
+	require.Equal(t, []byte("42"), key("c1", []byte("sensors/42/temp")))
+	require.Equal(t, []byte("42"), key("c1", []byte("sensors/42")))
+	require.Equal(t, []byte(""), key("c1", []byte("sensors//temp")))
+	require.Nil(t, key("c1", []byte("sensors")))
+
+	require.Equal(t, []byte("sensors"), TopicLevelKey(0)("c1", []byte("sensors")))
+}
+
+func TestBridgeForwardID(t *testing.T) {
+	p := &testProducer{}
+	b := &Bridge{
+		Producer:     p,
+		Routes:       []Route{{Filter: "#", Topic: "all"}},
+		BatchTimeout: time.Millisecond,
+	}
+
+	var _ service.IDBridge = b
+
+	ch := make(chan error, 1)
+	b.ForwardID(42, "c1", newPublishMessage("a/b", "1"), func(err error) {
+		ch <- err
+	})
+	require.NoError(t, wait(t, ch))
+
+	require.NoError(t, wait(t, forward(b, "c1", "a/b", "2")))
+
+	require.NoError(t, b.Close())
+
+	require.Equal(t, [][]Message{
+		{{Topic: "all", Value: []byte("1"), ID: 42}},
+		{{Topic: "all", Value: []byte("2")}},
+	}, p.batches)
+}
@@ -0,0 +1,369 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+// Config is what to run, see the flags in main.
+type Config struct {
+	URI         string
+	Publishers  int
+	Subscribers int
+	QoS         byte
+	Size        int
+	Topics      int
+	Prefix      string
+	Rate        int
+	Count       int
+	Duration    time.Duration
+	Drain       time.Duration
+	Username    string
+	Password    string
+}
+
+// check makes sure the config makes sense, and fills in the defaults.
+func (this *Config) check() error {
+	if this.Publishers <= 0 || this.Topics <= 0 {
+		return errors.New("There must be at least one publisher and one topic")
+	}
+
+	if this.Subscribers < 0 || this.Rate < 0 || this.Count < 0 {
+		return errors.New("Subscribers, rate and count can't be negative")
+	}
+
+	if !message.ValidQos(this.QoS) {
+		return fmt.Errorf("Invalid QoS %d", this.QoS)
+	}
+
+	if this.Size < 8 {
+		this.Size = 8
+	}
+
+	if this.Count == 0 && this.Duration <= 0 {
+		return errors.New("Either count or duration must be set")
+	}
+
+	return nil
+}
+
+// Result is what a run measured.
+type Result struct {
+	// Published is the number of messages published, and Received the number
+	// the subscribers received, out of Expected, which is Published times the
+	// number of subscribers.
+	Published int64
+	Received  int64
+	Expected  int64
+
+	// Elapsed is how long the publishers took, and Drained how long it took
+	// from the first message published to the last one received.
+	Elapsed time.Duration
+	Drained time.Duration
+
+	// Size is the payload size, for the throughput in bytes
+	Size int
+
+	// Latencies are those of every message received, sorted.
+	Latencies []time.Duration
+}
+
+// Percentile returns the latency p percent of the messages received were under,
+// e.g. 99 for the 99th percentile.
+func (this *Result) Percentile(p float64) time.Duration {
+	if len(this.Latencies) == 0 {
+		return 0
+	}
+
+	i := int(float64(len(this.Latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(this.Latencies) {
+		i = len(this.Latencies) - 1
+	}
+
+	return this.Latencies[i]
+}
+
+// Print writes the result as a report for people.
+func (this *Result) Print(w io.Writer) {
+	rate := func(n int64, d time.Duration) float64 {
+		if d <= 0 {
+			return 0
+		}
+		return float64(n) / d.Seconds()
+	}
+
+	fmt.Fprintf(w, "Published:  %d msgs in %v, %.0f msgs/s\n", this.Published, this.Elapsed.Round(time.Millisecond), rate(this.Published, this.Elapsed))
+	fmt.Fprintf(w, "Received:   %d/%d msgs in %v, %.0f msgs/s, %.2f MB/s\n", this.Received, this.Expected, this.Drained.Round(time.Millisecond),
+		rate(this.Received, this.Drained), rate(this.Received*int64(this.Size), this.Drained)/1e6)
+
+	if this.Expected > 0 {
+		fmt.Fprintf(w, "Lost:       %.2f%%\n", 100*float64(this.Expected-this.Received)/float64(this.Expected))
+	}
+
+	if len(this.Latencies) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "Latency:    p50 %v, p90 %v, p99 %v, p99.9 %v, max %v\n",
+		this.Percentile(50), this.Percentile(90), this.Percentile(99), this.Percentile(99.9), this.Latencies[len(this.Latencies)-1])
+}
+
+// Run connects the subscribers, then the publishers, publishes for as long or as
+// many messages as cfg says, and waits up to cfg.Drain for the subscribers to
+// get the rest.
+func Run(cfg *Config) (*Result, error) {
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+
+	res := &Result{Size: cfg.Size}
+
+	var (
+		mu        sync.Mutex
+		received  int64
+		first     int64
+		last      int64
+		latencies = make([][]time.Duration, cfg.Subscribers)
+	)
+
+	subs := make([]*service.Client, 0, cfg.Subscribers)
+	defer func() {
+		for _, c := range subs {
+			c.Disconnect()
+		}
+	}()
+
+	for i := 0; i < cfg.Subscribers; i++ {
+		c, err := connect(cfg, "sub", i)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, c)
+
+		lat := &latencies[i]
+		var onpub service.OnPublishFunc = func(msg *message.PublishMessage) error {
+			now := time.Now().UnixNano()
+			sent := int64(binary.BigEndian.Uint64(msg.Payload()))
+
+			mu.Lock()
+			*lat = append(*lat, time.Duration(now-sent))
+			mu.Unlock()
+
+			atomic.AddInt64(&received, 1)
+			atomic.StoreInt64(&last, now)
+			return nil
+		}
+
+		sub := message.NewSubscribeMessage()
+		sub.SetPacketId(1)
+		sub.AddTopic([]byte(cfg.Prefix+"/+"), cfg.QoS)
+
+		if err := subscribe(c, sub, onpub); err != nil {
+			return nil, err
+		}
+	}
+
+	pubs := make([]*service.Client, 0, cfg.Publishers)
+	defer func() {
+		for _, c := range pubs {
+			c.Disconnect()
+		}
+	}()
+
+	for i := 0; i < cfg.Publishers; i++ {
+		c, err := connect(cfg, "pub", i)
+		if err != nil {
+			return nil, err
+		}
+		pubs = append(pubs, c)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		published int64
+		perr      error
+		once      sync.Once
+	)
+
+	start := time.Now()
+	atomic.StoreInt64(&first, start.UnixNano())
+
+	deadline := start.Add(cfg.Duration)
+
+	for i, c := range pubs {
+		wg.Add(1)
+
+		go func(i int, c *service.Client) {
+			defer wg.Done()
+
+			if err := publish(cfg, c, i, deadline, &published); err != nil {
+				once.Do(func() { perr = err })
+			}
+		}(i, c)
+	}
+
+	wg.Wait()
+
+	res.Elapsed = time.Since(start)
+	res.Published = atomic.LoadInt64(&published)
+	res.Expected = res.Published * int64(cfg.Subscribers)
+
+	if perr != nil {
+		return nil, perr
+	}
+
+	// Wait for the subscribers to get the rest, or to give up on them
+	for end := time.Now().Add(cfg.Drain); atomic.LoadInt64(&received) < res.Expected && time.Now().Before(end); {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	res.Received = atomic.LoadInt64(&received)
+	if l := atomic.LoadInt64(&last); l > 0 {
+		res.Drained = time.Duration(l - atomic.LoadInt64(&first))
+	}
+
+	mu.Lock()
+	for _, lat := range latencies {
+		res.Latencies = append(res.Latencies, lat...)
+	}
+	mu.Unlock()
+
+	sort.Slice(res.Latencies, func(i, j int) bool {
+		return res.Latencies[i] < res.Latencies[j]
+	})
+
+	return res, nil
+}
+
+// connect connects client n of the role, e.g. "pub" or "sub".
+func connect(cfg *Config, role string, n int) (*service.Client, error) {
+	msg := message.NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetCleanSession(true)
+	msg.SetClientId([]byte(fmt.Sprintf("surgemq-bench-%s-%d-%d", role, n, time.Now().UnixNano()%1e6)))
+	msg.SetKeepAlive(60)
+
+	if cfg.Username != "" {
+		msg.SetUsername([]byte(cfg.Username))
+		msg.SetPassword([]byte(cfg.Password))
+	}
+
+	c := &service.Client{}
+	if err := c.Connect(cfg.URI, msg); err != nil {
+		return nil, fmt.Errorf("%s %d: %v", role, n, err)
+	}
+
+	return c, nil
+}
+
+// subscribe subscribes c, and waits for the SUBACK.
+func subscribe(c *service.Client, sub *message.SubscribeMessage, onpub service.OnPublishFunc) error {
+	done := make(chan error, 1)
+
+	err := c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		done <- err
+		return nil
+	}, onpub)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+
+	case <-time.After(10 * time.Second):
+		return errors.New("Timed out waiting for SUBACK")
+	}
+}
+
+// publish is publisher n, publishing round robin to the topics until it has
+// published cfg.Count messages, or until deadline if there's no count.
+func publish(cfg *Config, c *service.Client, n int, deadline time.Time, published *int64) error {
+	var tick <-chan time.Time
+	if cfg.Rate > 0 {
+		t := time.NewTicker(time.Second / time.Duration(cfg.Rate))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	topics := make([][]byte, cfg.Topics)
+	for i := range topics {
+		topics[i] = []byte(cfg.Prefix + "/" + strconv.Itoa(i))
+	}
+
+	// The QoS 1 and 2 messages are let through as the acks come back, so the
+	// publisher doesn't run ahead of the broker
+	window := make(chan struct{}, 100)
+
+	for i := 0; cfg.Count == 0 || i < cfg.Count; i++ {
+		if cfg.Count == 0 && time.Now().After(deadline) {
+			break
+		}
+
+		if tick != nil {
+			<-tick
+		}
+
+		msg := message.NewPublishMessage()
+		msg.SetTopic(topics[(n+i)%len(topics)])
+		msg.SetQoS(cfg.QoS)
+		msg.SetPacketId(uint16(i%65535 + 1))
+
+		payload := make([]byte, cfg.Size)
+		binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+		msg.SetPayload(payload)
+
+		var onc service.OnCompleteFunc
+		if cfg.QoS > 0 {
+			window <- struct{}{}
+			onc = func(msg, ack message.Message, err error) error {
+				<-window
+				return nil
+			}
+		}
+
+		if err := c.Publish(msg, onc); err != nil {
+			return fmt.Errorf("pub %d: %v", n, err)
+		}
+
+		atomic.AddInt64(published, 1)
+	}
+
+	// Wait for the acks of the last ones
+	for i := 0; i < cap(window); i++ {
+		select {
+		case window <- struct{}{}:
+		case <-time.After(cfg.Drain):
+			return nil
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/service"
+)
+
+func TestResultPercentile(t *testing.T) {
+	res := &Result{}
+	require.Equal(t, time.Duration(0), res.Percentile(50))
+
+	for i := 1; i <= 100; i++ {
+		res.Latencies = append(res.Latencies, time.Duration(i)*time.Millisecond)
+	}
+
+	require.Equal(t, 50*time.Millisecond, res.Percentile(50))
+	require.Equal(t, 99*time.Millisecond, res.Percentile(99))
+	require.Equal(t, 100*time.Millisecond, res.Percentile(99.9))
+	require.Equal(t, time.Millisecond, res.Percentile(0))
+}
+
+func TestConfigCheck(t *testing.T) {
+	cfg := &Config{Publishers: 1, Topics: 1, Count: 1}
+	require.NoError(t, cfg.check())
+	require.Equal(t, 8, cfg.Size)
+
+	require.Error(t, (&Config{Publishers: 1, Topics: 1}).check())
+	require.Error(t, (&Config{Publishers: 1, Topics: 1, Count: 1, QoS: 3}).check())
+	require.Error(t, (&Config{Topics: 1, Count: 1}).check())
+}
+
+func TestRun(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	svr := &service.Server{}
+	go svr.Serve(ln)
+	defer svr.Close()
+
+	res, err := Run(&Config{
+		URI:         "tcp://" + ln.Addr().String(),
+		Publishers:  2,
+		Subscribers: 3,
+		QoS:         1,
+		Size:        32,
+		Topics:      5,
+		Prefix:      "bench",
+		Count:       50,
+		Drain:       5 * time.Second,
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, int64(100), res.Published)
+	require.Equal(t, int64(300), res.Expected)
+	require.Equal(t, res.Expected, res.Received)
+	require.Len(t, res.Latencies, 300)
+
+	var buf bytes.Buffer
+	res.Print(&buf)
+	require.Contains(t, buf.String(), "Received:   300/300 msgs")
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command surgemq-bench is a load generator for MQTT brokers. It connects N
+// publishers and M subscribers, has the publishers publish to a number of
+// topics as fast as they can, or at a set rate, and reports the throughput and
+// the latency percentiles of the messages the subscribers receive:
+//
+//	surgemq-bench -uri tcp://127.0.0.1:1883 -pubs 10 -subs 10 -qos 1 -size 256 -topics 100 -duration 30s
+//
+// Every subscriber subscribes to all the topics, so each message is received M
+// times. The latency is from just before a message is published to when a
+// subscriber gets it, as the send time is in the first 8 bytes of the payload,
+// so the payloads are at least 8 bytes.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func main() {
+	cfg := &Config{}
+
+	flag.StringVar(&cfg.URI, "uri", "tcp://127.0.0.1:1883", "Broker to connect to")
+	flag.IntVar(&cfg.Publishers, "pubs", 10, "Number of publishers")
+	flag.IntVar(&cfg.Subscribers, "subs", 10, "Number of subscribers")
+	qos := flag.Int("qos", 0, "QoS of the messages and the subscriptions")
+	flag.IntVar(&cfg.Size, "size", 64, "Payload size, in bytes")
+	flag.IntVar(&cfg.Topics, "topics", 1, "Number of topics the publishers publish to")
+	flag.StringVar(&cfg.Prefix, "prefix", "bench", "Topic prefix, the topics are {prefix}/{n}")
+	flag.IntVar(&cfg.Rate, "rate", 0, "Messages per second per publisher, 0 for as fast as possible")
+	flag.IntVar(&cfg.Count, "count", 0, "Messages per publisher, 0 to publish for -duration")
+	flag.DurationVar(&cfg.Duration, "duration", 10*time.Second, "How long to publish for")
+	flag.DurationVar(&cfg.Drain, "drain", 5*time.Second, "How long to wait for the last messages once publishing is done")
+	flag.StringVar(&cfg.Username, "username", "", "Username to connect with")
+	flag.StringVar(&cfg.Password, "password", "", "Password to connect with")
+	flag.Parse()
+
+	cfg.QoS = byte(*qos)
+
+	res, err := Run(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "surgemq-bench: %v\n", err)
+		os.Exit(1)
+	}
+
+	res.Print(os.Stdout)
+}
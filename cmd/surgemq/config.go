@@ -0,0 +1,386 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/topics"
+	"gopkg.in/yaml.v3"
+)
+
+// pluginAuthenticator is the name the authentication plugin of the config is
+// registered under.
+const pluginAuthenticator = "plugin"
+
+// Config is the configuration file of the broker, in YAML or TOML. Everything
+// left out keeps the defaults of service.Server.
+type Config struct {
+	Listeners   []ListenerConfig  `yaml:"listeners" toml:"listeners"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	ACL         ACLConfig         `yaml:"acl" toml:"acl"`
+	Persistence PersistenceConfig `yaml:"persistence" toml:"persistence"`
+	Bridges     []BridgeConfig    `yaml:"bridges" toml:"bridges"`
+	Limits      LimitsConfig      `yaml:"limits" toml:"limits"`
+	Logging     LoggingConfig     `yaml:"logging" toml:"logging"`
+
+	// Admin is the address of the HTTP admin API, e.g. ":8082". If not set then
+	// there's no admin API.
+	Admin string `yaml:"admin" toml:"admin"`
+}
+
+// ListenerConfig is one of the listeners, see service.ListenerConfig. Cert and
+// Key are the files of the certificate of the tls and wss listeners.
+type ListenerConfig struct {
+	Name           string `yaml:"name" toml:"name"`
+	URI            string `yaml:"uri" toml:"uri"`
+	Cert           string `yaml:"cert" toml:"cert"`
+	Key            string `yaml:"key" toml:"key"`
+	Authenticator  string `yaml:"authenticator" toml:"authenticator"`
+	MaxConnections int    `yaml:"max_connections" toml:"max_connections"`
+}
+
+// AuthConfig is how the clients are authenticated.
+type AuthConfig struct {
+	// Authenticator is the name of the default authenticator. It's "plugin"
+	// for Plugin.
+	Authenticator string `yaml:"authenticator" toml:"authenticator"`
+
+	// Anonymous is "authenticate", "allow" or "deny".
+	Anonymous string `yaml:"anonymous" toml:"anonymous"`
+
+	// Plugin is the command line of an auth.PluginAuthenticator.
+	Plugin []string `yaml:"plugin" toml:"plugin"`
+}
+
+// ACLConfig is who can publish to which topics. The first rule that matches a
+// message decides, and Default, "allow" or "deny", decides for the rest.
+type ACLConfig struct {
+	Default string    `yaml:"default" toml:"default"`
+	Rules   []ACLRule `yaml:"rules" toml:"rules"`
+}
+
+// ACLRule allows or denies the clients in Clients publishing to the topics
+// matching Topic. A client ID ending in "*" matches the IDs starting with what
+// comes before it, and no Clients matches them all.
+type ACLRule struct {
+	Topic   string   `yaml:"topic" toml:"topic"`
+	Clients []string `yaml:"clients" toml:"clients"`
+	Allow   bool     `yaml:"allow" toml:"allow"`
+}
+
+// PersistenceConfig is where the sessions and topics are kept.
+type PersistenceConfig struct {
+	Sessions string `yaml:"sessions" toml:"sessions"`
+	Topics   string `yaml:"topics" toml:"topics"`
+	SafeMode bool   `yaml:"safe_mode" toml:"safe_mode"`
+}
+
+// BridgeConfig is a Mirror bridge, forwarding everything published to the
+// server at URI.
+type BridgeConfig struct {
+	URI        string        `yaml:"uri" toml:"uri"`
+	ClientId   string        `yaml:"client_id" toml:"client_id"`
+	Username   string        `yaml:"username" toml:"username"`
+	Password   string        `yaml:"password" toml:"password"`
+	BatchSize  int           `yaml:"batch_size" toml:"batch_size"`
+	BatchDelay time.Duration `yaml:"batch_delay" toml:"batch_delay"`
+	Compress   bool          `yaml:"compress" toml:"compress"`
+}
+
+// LimitsConfig are the limits of the server, see service.Server.
+type LimitsConfig struct {
+	MaxConnections      int           `yaml:"max_connections" toml:"max_connections"`
+	MaxConnectionsPerIP int           `yaml:"max_connections_per_ip" toml:"max_connections_per_ip"`
+	MaxPacketSize       int           `yaml:"max_packet_size" toml:"max_packet_size"`
+	MaxTopicLevels      int           `yaml:"max_topic_levels" toml:"max_topic_levels"`
+	MaxTopicLevelLength int           `yaml:"max_topic_level_length" toml:"max_topic_level_length"`
+	MaxRetained         int           `yaml:"max_retained" toml:"max_retained"`
+	MaxRetainedBytes    int64         `yaml:"max_retained_bytes" toml:"max_retained_bytes"`
+	MemoryBudget        int64         `yaml:"memory_budget" toml:"memory_budget"`
+	BufferSize          int           `yaml:"buffer_size" toml:"buffer_size"`
+	OutBufferSize       int           `yaml:"out_buffer_size" toml:"out_buffer_size"`
+	ConnectTimeout      int           `yaml:"connect_timeout" toml:"connect_timeout"`
+	HandshakeTimeout    time.Duration `yaml:"handshake_timeout" toml:"handshake_timeout"`
+	AckTimeout          int           `yaml:"ack_timeout" toml:"ack_timeout"`
+	TimeoutRetries      int           `yaml:"timeout_retries" toml:"timeout_retries"`
+}
+
+// LoggingConfig is how the server logs, with Level "debug", "info", "warn" or
+// "error", and Format "text" or "json". If Format isn't set then it logs with
+// glog, the same as when embedded.
+type LoggingConfig struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+}
+
+// loadConfig reads the config file at path, as TOML if it ends in ".toml" and as
+// YAML otherwise.
+func loadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(b, cfg)
+	} else {
+		err = yaml.Unmarshal(b, cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []ListenerConfig{{URI: "tcp://:1883"}}
+	}
+
+	return cfg, nil
+}
+
+// server returns the server configured by the config. Its listeners are started
+// by listen once it's running.
+func (this *Config) server() (*service.Server, error) {
+	svr := &service.Server{
+		Authenticator:       this.Auth.Authenticator,
+		SessionsProvider:    this.Persistence.Sessions,
+		TopicsProvider:      this.Persistence.Topics,
+		SafeMode:            this.Persistence.SafeMode,
+		MaxConnections:      this.Limits.MaxConnections,
+		MaxConnectionsPerIP: this.Limits.MaxConnectionsPerIP,
+		MaxPacketSize:       this.Limits.MaxPacketSize,
+		MaxTopicLevels:      this.Limits.MaxTopicLevels,
+		MaxTopicLevelLength: this.Limits.MaxTopicLevelLength,
+		MaxRetained:         this.Limits.MaxRetained,
+		MaxRetainedBytes:    this.Limits.MaxRetainedBytes,
+		MemoryBudget:        this.Limits.MemoryBudget,
+		BufferSize:          this.Limits.BufferSize,
+		OutBufferSize:       this.Limits.OutBufferSize,
+		ConnectTimeout:      this.Limits.ConnectTimeout,
+		HandshakeTimeout:    this.Limits.HandshakeTimeout,
+		AckTimeout:          this.Limits.AckTimeout,
+		TimeoutRetries:      this.Limits.TimeoutRetries,
+	}
+
+	var err error
+
+	if svr.Anonymous, err = anonymousPolicy(this.Auth.Anonymous); err != nil {
+		return nil, err
+	}
+
+	if len(this.Auth.Plugin) > 0 {
+		auth.Register(pluginAuthenticator, auth.NewPluginAuthenticator(this.Auth.Plugin[0], this.Auth.Plugin[1:]...))
+
+		if svr.Authenticator == "" {
+			svr.Authenticator = pluginAuthenticator
+		}
+	}
+
+	if svr.Logger, err = this.Logging.logger(); err != nil {
+		return nil, err
+	}
+
+	if svr.DefaultACL, err = aclPolicy(this.ACL.Default); err != nil {
+		return nil, err
+	}
+
+	if len(this.ACL.Rules) > 0 {
+		svr.Pipeline = &service.Pipeline{}
+		if err := svr.Pipeline.Add(this.ACL.stage(svr.DefaultACL)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, b := range this.Bridges {
+		m, err := b.mirror()
+		if err != nil {
+			return nil, err
+		}
+
+		svr.Bridges = append(svr.Bridges, m)
+	}
+
+	return svr, nil
+}
+
+// listen starts the listeners of the config on svr.
+func (this *Config) listen(svr *service.Server) error {
+	for _, l := range this.Listeners {
+		lc := service.ListenerConfig{
+			Name:           l.Name,
+			URI:            l.URI,
+			Authenticator:  l.Authenticator,
+			MaxConnections: l.MaxConnections,
+		}
+
+		if l.Cert != "" {
+			cert, err := tls.LoadX509KeyPair(l.Cert, l.Key)
+			if err != nil {
+				return err
+			}
+
+			lc.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+
+		if err := svr.AddListener(lc); err != nil {
+			return fmt.Errorf("listener %s: %v", l.URI, err)
+		}
+	}
+
+	return nil
+}
+
+func anonymousPolicy(s string) (service.AnonymousPolicy, error) {
+	switch s {
+	case "", "authenticate":
+		return service.AnonymousAuthenticate, nil
+	case "allow":
+		return service.AnonymousAllow, nil
+	case "deny":
+		return service.AnonymousDeny, nil
+	}
+
+	return 0, fmt.Errorf("auth: Unknown anonymous policy %q", s)
+}
+
+func aclPolicy(s string) (service.ACLPolicy, error) {
+	switch s {
+	case "", "allow":
+		return service.ACLAllow, nil
+	case "deny":
+		return service.ACLDeny, nil
+	}
+
+	return 0, fmt.Errorf("acl: Unknown default policy %q", s)
+}
+
+// stage returns the pipeline stage enforcing the rules, with def for the
+// messages none of them match.
+func (this *ACLConfig) stage(def service.ACLPolicy) service.Stage {
+	rules := this.Rules
+
+	return service.Stage{
+		Name:  "acl",
+		Phase: service.PhaseAuth,
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			for _, r := range rules {
+				if r.matches(cid, msg.Topic()) {
+					if r.Allow {
+						return msg, nil
+					}
+					return nil, nil
+				}
+			}
+
+			if def == service.ACLDeny {
+				return nil, nil
+			}
+
+			return msg, nil
+		},
+	}
+}
+
+func (this ACLRule) matches(cid string, topic []byte) bool {
+	if !topics.Match([]byte(this.Topic), topic) {
+		return false
+	}
+
+	if len(this.Clients) == 0 {
+		return true
+	}
+
+	for _, c := range this.Clients {
+		if c == cid || (strings.HasSuffix(c, "*") && strings.HasPrefix(cid, c[:len(c)-1])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mirror returns the Mirror bridge, connected to the other server.
+func (this BridgeConfig) mirror() (*service.Mirror, error) {
+	opts := service.NewConnectOptions(this.ClientId)
+	if this.Username != "" {
+		opts.SetCredentials(this.Username, this.Password)
+	}
+
+	msg, err := opts.Message()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &service.Client{AutoReconnect: true}
+	if err := c.Connect(this.URI, msg); err != nil {
+		return nil, fmt.Errorf("bridge %s: %v", this.URI, err)
+	}
+
+	m := &service.Mirror{
+		Client:     c,
+		BatchSize:  this.BatchSize,
+		BatchDelay: this.BatchDelay,
+	}
+
+	if this.Compress {
+		m.Compressor = service.FlateCompressor{Level: -1}
+	}
+
+	return m, nil
+}
+
+// logger returns the logger of the config, nil for glog.
+func (this LoggingConfig) logger() (logging.Logger, error) {
+	var level slog.Level
+
+	switch this.Level {
+	case "", "info":
+		level = slog.LevelInfo
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, fmt.Errorf("logging: Unknown level %q", this.Level)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch this.Format {
+	case "":
+		return nil, nil
+	case "text":
+		return logging.NewSlog(slog.New(slog.NewTextHandler(os.Stderr, opts))), nil
+	case "json":
+		return logging.NewSlog(slog.New(slog.NewJSONHandler(os.Stderr, opts))), nil
+	}
+
+	return nil, fmt.Errorf("logging: Unknown format %q", this.Format)
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+func TestLoadConfigYAML(t *testing.T) {
+	cfg, err := loadConfig("surgemq.yaml")
+	require.NoError(t, err)
+
+	require.Len(t, cfg.Listeners, 2)
+	require.Equal(t, "ws://:8080/mqtt", cfg.Listeners[1].URI)
+	require.Equal(t, 10*time.Second, cfg.Limits.HandshakeTimeout)
+	require.Equal(t, ":8082", cfg.Admin)
+
+	svr, err := cfg.server()
+	require.NoError(t, err)
+	require.Equal(t, service.AnonymousDeny, svr.Anonymous)
+	require.Equal(t, service.ACLDeny, svr.DefaultACL)
+	require.Equal(t, 100, svr.MaxConnectionsPerIP)
+	require.NotNil(t, svr.Logger)
+}
+
+func TestLoadConfigTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "surgemq.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+admin = ":8082"
+
+[[listeners]]
+uri = "tcp://:1883"
+authenticator = "mockFailure"
+
+[auth]
+anonymous = "allow"
+
+[limits]
+max_connections = 5
+handshake_timeout = "5s"
+`), 0600))
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, "mockFailure", cfg.Listeners[0].Authenticator)
+	require.Equal(t, 5*time.Second, cfg.Limits.HandshakeTimeout)
+
+	svr, err := cfg.server()
+	require.NoError(t, err)
+	require.Equal(t, service.AnonymousAllow, svr.Anonymous)
+	require.Equal(t, 5, svr.MaxConnections)
+	require.Nil(t, svr.Logger)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.yaml")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	cfg, err := loadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, []ListenerConfig{{URI: "tcp://:1883"}}, cfg.Listeners)
+
+	cfg.Auth.Anonymous = "maybe"
+	_, err = cfg.server()
+	require.Error(t, err)
+}
+
+func TestConfigACL(t *testing.T) {
+	acl := ACLConfig{
+		Rules: []ACLRule{
+			{Topic: "sensors/#", Clients: []string{"sensor-*"}, Allow: true},
+			{Topic: "admin/#", Allow: false},
+		},
+	}
+
+	stage := acl.stage(service.ACLDeny)
+
+	publish := func(cid, topic string) bool {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+
+		out, err := stage.Process(cid, msg)
+		require.NoError(t, err)
+		return out != nil
+	}
+
+	require.True(t, publish("sensor-1", "sensors/temp"))
+	require.False(t, publish("web-1", "sensors/temp"))
+	require.False(t, publish("sensor-1", "admin/reboot"))
+	require.False(t, publish("sensor-1", "other"))
+
+	// The messages no rule matches are allowed by default
+	stage = acl.stage(service.ACLAllow)
+	require.True(t, publish("web-1", "other"))
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command surgemq is the SurgeMQ broker, configured by a YAML or TOML file
+// covering its listeners, authentication, ACLs, persistence, bridges, limits and
+// logging, so it can be deployed without writing any Go:
+//
+//	surgemq -config /etc/surgemq/surgemq.yaml
+//
+// See surgemq.yaml for an example of every setting. Without a config file, it
+// listens on tcp://:1883 with the defaults of service.Server.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/surgemq/surgemq/admin"
+)
+
+func main() {
+	path := flag.String("config", "", "Config file, YAML or TOML by its extension")
+	flag.Parse()
+
+	if err := run(*path); err != nil {
+		fmt.Fprintf(os.Stderr, "surgemq: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(path string) error {
+	cfg := &Config{Listeners: []ListenerConfig{{URI: "tcp://:1883"}}}
+
+	if path != "" {
+		var err error
+		if cfg, err = loadConfig(path); err != nil {
+			return err
+		}
+	}
+
+	svr, err := cfg.server()
+	if err != nil {
+		return err
+	}
+	defer svr.Close()
+
+	if err := cfg.listen(svr); err != nil {
+		return err
+	}
+
+	if cfg.Admin != "" {
+		go func() {
+			if err := http.ListenAndServe(cfg.Admin, admin.NewHandler(svr)); err != nil {
+				fmt.Fprintf(os.Stderr, "surgemq: admin: %v\n", err)
+			}
+		}()
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)
+	<-sigchan
+
+	return nil
+}
@@ -0,0 +1,284 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package codec reads and writes MQTT packets on arbitrary streams. It takes care
+// of framing, i.e. finding where each packet starts and ends using the fixed
+// header, and leaves the encoding and decoding of the packets themselves to the
+// github.com/surgemq/message package.
+//
+// Both the client and the server in the service package use it, and it can be
+// used on its own by anything that needs to speak MQTT over an io.Reader or an
+// io.Writer, e.g.
+//
+//	r := codec.NewReader(conn)
+//	r.MaxSize = 64 * 1024
+//
+//	msg, err := r.ReadMessage()
+//
+// Decode decodes a packet read some other way with the same checks, so that a
+// malformed one is an error rather than a panic.
+//
+// It also has the buffer pool the service package encodes and decodes with,
+// GetBuffer and PutBuffer, whose hit rate is reported by BufferPoolStats.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/surgemq/message"
+)
+
+var (
+	ErrPacketTooLarge    = errors.New("codec: Packet exceeds the maximum packet size")
+	ErrMalformedLength   = errors.New("codec: 4th byte of remaining length has continuation bit set")
+	ErrUnexpectedConnect = errors.New("codec: Expected a CONNECT packet")
+	ErrMalformedPacket   = errors.New("codec: Malformed packet")
+)
+
+// readChunk is how much of a packet is read at a time once it's larger than
+// that, so the buffer only grows as fast as the bytes actually come in, rather
+// than to whatever size the remaining length claims up front.
+const readChunk = 64 * 1024
+
+// Reader reads MQTT packets from a stream. It doesn't buffer, so it never reads
+// past the end of the packet it's asked for, and the stream can be handed over to
+// something else between packets.
+type Reader struct {
+	// MaxSize is the maximum size, in bytes, of a packet, fixed header included.
+	// Larger packets are rejected with ErrPacketTooLarge after reading only the
+	// fixed header. If not set then there's no limit.
+	MaxSize int
+
+	// Version is the protocol level, e.g. 4 for 3.1.1, a CONNECT packet must have.
+	// A CONNECT with a different level is rejected with
+	// message.ErrInvalidProtocolVersion, which can be sent back in a CONNACK. If
+	// not set then any version the message package can decode is accepted.
+	Version byte
+
+	r   io.Reader
+	b   [1]byte
+	hdr [5]byte
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadPacket reads the next packet and returns it, fixed header included, without
+// decoding it.
+func (this *Reader) ReadPacket() ([]byte, error) {
+	return this.readPacket(false)
+}
+
+// readPacket is ReadPacket. If connect is set, anything but a CONNECT is rejected
+// with ErrUnexpectedConnect as soon as its first byte is read, rather than once
+// the whole of it is, which may never come if it's not MQTT at all.
+func (this *Reader) readPacket(connect bool) ([]byte, error) {
+	// Let's read enough bytes to get the fixed header (type, remaining length).
+	// The remaining length takes up to 4 bytes.
+	buf := this.hdr[:0]
+
+	for {
+		if len(buf) == 5 {
+			return nil, ErrMalformedLength
+		}
+
+		n, err := this.r.Read(this.b[:])
+		if n == 0 {
+			if err == nil {
+				continue
+			}
+
+			if err == io.EOF && len(buf) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		buf = append(buf, this.b[0])
+
+		if connect && len(buf) == 1 && message.MessageType(buf[0]>>4) != message.CONNECT {
+			return nil, ErrUnexpectedConnect
+		}
+
+		// Check the remaining length bytes (1+) to see if the continuation bit is
+		// set. If so, keep reading. Otherwise we have the whole fixed header.
+		if len(buf) > 1 && this.b[0] < 0x80 {
+			break
+		}
+	}
+
+	remlen, _ := binary.Uvarint(buf[1:])
+	total := len(buf) + int(remlen)
+
+	if this.MaxSize > 0 && total > this.MaxSize {
+		return nil, ErrPacketTooLarge
+	}
+
+	// The packet is read a chunk at a time, so a remaining length that's a lie
+	// only costs as much memory as what was actually sent
+	size := total
+	if size > readChunk {
+		size = readChunk
+	}
+
+	pkt := make([]byte, len(buf), size)
+	copy(pkt, buf)
+
+	for len(pkt) < total {
+		n := total - len(pkt)
+		if n > readChunk {
+			n = readChunk
+		}
+
+		start := len(pkt)
+		pkt = append(pkt, make([]byte, n)...)
+
+		if _, err := io.ReadFull(this.r, pkt[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	return pkt, nil
+}
+
+// Decode decodes a whole packet, fixed header included, such as one returned by
+// ReadPacket, and returns the message and the number of bytes it took up. The
+// message package trusts the lengths in the packet, so a malformed one can make
+// it panic, which Decode turns into ErrMalformedPacket, as it does a packet that
+// says it's longer than it is.
+func Decode(pkt []byte) (msg message.Message, n int, err error) {
+	if len(pkt) < 2 {
+		return nil, 0, ErrMalformedPacket
+	}
+
+	remlen, m := binary.Uvarint(pkt[1:])
+	if m <= 0 || m > 4 || uint64(len(pkt)-1-m) < remlen {
+		return nil, 0, ErrMalformedPacket
+	}
+
+	msg, err = message.MessageType(pkt[0] >> 4).New()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			msg, n, err = nil, 0, ErrMalformedPacket
+		}
+	}()
+
+	n, err = msg.Decode(pkt[:1+m+int(remlen)])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return msg, n, nil
+}
+
+// ReadMessage reads and decodes the next packet.
+func (this *Reader) ReadMessage() (message.Message, error) {
+	pkt, err := this.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return this.decode(pkt)
+}
+
+// decode decodes pkt, checking the protocol level if it's a CONNECT.
+func (this *Reader) decode(pkt []byte) (message.Message, error) {
+	msg, _, err := Decode(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	if cm, ok := msg.(*message.ConnectMessage); ok && this.Version != 0 && cm.Version() != this.Version {
+		return nil, message.ErrInvalidProtocolVersion
+	}
+
+	return msg, nil
+}
+
+// ReadConnect reads the next packet, which must be a CONNECT, and decodes it. Any
+// error decoding it that's a message.ConnackCode should be sent back to the
+// client in a CONNACK.
+func (this *Reader) ReadConnect() (*message.ConnectMessage, error) {
+	pkt, err := this.readPacket(true)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := this.decode(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	cm, ok := msg.(*message.ConnectMessage)
+	if !ok {
+		return nil, ErrUnexpectedConnect
+	}
+
+	return cm, nil
+}
+
+// Writer writes MQTT packets to a stream.
+type Writer struct {
+	// MaxSize is the maximum size, in bytes, of a packet. Larger packets are not
+	// written, and ErrPacketTooLarge is returned instead. If not set then there's
+	// no limit.
+	MaxSize int
+
+	w io.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteMessage encodes msg and writes it as a single packet.
+func (this *Writer) WriteMessage(msg message.Message) error {
+	l := msg.Len()
+
+	if this.MaxSize > 0 && l > this.MaxSize {
+		return ErrPacketTooLarge
+	}
+
+	buf := GetBuffer(l)
+	defer PutBuffer(buf)
+
+	n, err := msg.Encode(buf)
+	if err != nil {
+		return err
+	}
+
+	return this.WritePacket(buf[:n])
+}
+
+// WritePacket writes a packet that has already been encoded.
+func (this *Writer) WritePacket(pkt []byte) error {
+	if this.MaxSize > 0 && len(pkt) > this.MaxSize {
+		return ErrPacketTooLarge
+	}
+
+	_, err := this.w.Write(pkt)
+	return err
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func newTestConnectMessage() *message.ConnectMessage {
+	msg := message.NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetCleanSession(true)
+	msg.SetClientId([]byte("surgemq"))
+	msg.SetKeepAlive(10)
+
+	return msg
+}
+
+func newTestPublishMessage(payload int) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("surgemq/codec"))
+	msg.SetQoS(1)
+	msg.SetPacketId(7)
+	msg.SetPayload(make([]byte, payload))
+
+	return msg
+}
+
+func TestReadWriteMessage(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := NewWriter(&buf)
+	require.NoError(t, w.WriteMessage(newTestConnectMessage()))
+	require.NoError(t, w.WriteMessage(newTestPublishMessage(1000)))
+	require.NoError(t, w.WriteMessage(message.NewPingreqMessage()))
+
+	r := NewReader(&buf)
+
+	cm, err := r.ReadConnect()
+	require.NoError(t, err)
+	require.Equal(t, "surgemq", string(cm.ClientId()))
+
+	msg, err := r.ReadMessage()
+	require.NoError(t, err)
+
+	pm, ok := msg.(*message.PublishMessage)
+	require.True(t, ok)
+	require.Equal(t, "surgemq/codec", string(pm.Topic()))
+	require.Equal(t, 1000, len(pm.Payload()))
+
+	msg, err = r.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, message.PINGREQ, msg.Type())
+
+	_, err = r.ReadMessage()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestReaderDoesNotReadAhead(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, NewWriter(&buf).WriteMessage(message.NewPingreqMessage()))
+	buf.WriteString("rest")
+
+	_, err := NewReader(&buf).ReadPacket()
+	require.NoError(t, err)
+	require.Equal(t, "rest", buf.String())
+}
+
+func TestReaderMaxSize(t *testing.T) {
+	var buf bytes.Buffer
+
+	msg := newTestPublishMessage(1000)
+	require.NoError(t, NewWriter(&buf).WriteMessage(msg))
+
+	r := NewReader(&buf)
+	r.MaxSize = msg.Len() - 1
+
+	_, err := r.ReadPacket()
+	require.Equal(t, ErrPacketTooLarge, err)
+
+	// Only the fixed header should have been read
+	require.Equal(t, msg.Len()-3, buf.Len())
+
+	w := NewWriter(&buf)
+	w.MaxSize = msg.Len() - 1
+	require.Equal(t, ErrPacketTooLarge, w.WriteMessage(msg))
+}
+
+func TestReaderMalformed(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})).ReadPacket()
+	require.Equal(t, ErrMalformedLength, err)
+
+	_, err = NewReader(bytes.NewReader([]byte{0x30, 0x0a, 0x00})).ReadPacket()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	_, err = NewReader(bytes.NewReader([]byte{0x30})).ReadPacket()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestReaderVersion(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, NewWriter(&buf).WriteMessage(newTestConnectMessage()))
+
+	r := NewReader(&buf)
+	r.Version = 3
+
+	_, err := r.ReadConnect()
+	require.Equal(t, message.ErrInvalidProtocolVersion, err)
+}
+
+func TestReadConnectUnexpected(t *testing.T) {
+	var buf bytes.Buffer
+
+	require.NoError(t, NewWriter(&buf).WriteMessage(message.NewPingreqMessage()))
+
+	_, err := NewReader(&buf).ReadConnect()
+	require.Equal(t, ErrUnexpectedConnect, err)
+
+	// Nothing past the first byte is read of what isn't a CONNECT
+	req := strings.NewReader("GET /health HTTP/1.1\r\n\r\n")
+
+	_, err = NewReader(req).ReadConnect()
+	require.Equal(t, ErrUnexpectedConnect, err)
+	require.Equal(t, int(req.Size())-1, req.Len())
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// The fuzz targets decode whatever they're given as a packet of their type, and
+// check that it never panics, and that whatever decodes encodes to the same
+// length. The regression corpus is in testdata/fuzz, with the packets that
+// used to panic or over-allocate.
+
+func FuzzDecodeConnect(f *testing.F) {
+	fuzzDecode(f, message.CONNECT, newTestConnectMessage())
+}
+
+func FuzzDecodeConnack(f *testing.F) {
+	fuzzDecode(f, message.CONNACK, message.NewConnackMessage())
+}
+
+func FuzzDecodePublish(f *testing.F) {
+	fuzzDecode(f, message.PUBLISH, newTestPublishMessage(10))
+}
+
+func FuzzDecodePuback(f *testing.F) {
+	fuzzDecode(f, message.PUBACK, message.NewPubackMessage())
+}
+
+func FuzzDecodePubrec(f *testing.F) {
+	fuzzDecode(f, message.PUBREC, message.NewPubrecMessage())
+}
+
+func FuzzDecodePubrel(f *testing.F) {
+	fuzzDecode(f, message.PUBREL, message.NewPubrelMessage())
+}
+
+func FuzzDecodePubcomp(f *testing.F) {
+	fuzzDecode(f, message.PUBCOMP, message.NewPubcompMessage())
+}
+
+func FuzzDecodeSubscribe(f *testing.F) {
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketId(1)
+	msg.AddTopic([]byte("surgemq/#"), message.QosAtLeastOnce)
+	msg.AddTopic([]byte("+/codec"), message.QosExactlyOnce)
+
+	fuzzDecode(f, message.SUBSCRIBE, msg)
+}
+
+func FuzzDecodeSuback(f *testing.F) {
+	msg := message.NewSubackMessage()
+	msg.SetPacketId(1)
+	msg.AddReturnCodes([]byte{message.QosAtLeastOnce, message.QosFailure})
+
+	fuzzDecode(f, message.SUBACK, msg)
+}
+
+func FuzzDecodeUnsubscribe(f *testing.F) {
+	msg := message.NewUnsubscribeMessage()
+	msg.SetPacketId(1)
+	msg.AddTopic([]byte("surgemq/#"))
+
+	fuzzDecode(f, message.UNSUBSCRIBE, msg)
+}
+
+func FuzzDecodeUnsuback(f *testing.F) {
+	fuzzDecode(f, message.UNSUBACK, message.NewUnsubackMessage())
+}
+
+func FuzzDecodePingreq(f *testing.F) {
+	fuzzDecode(f, message.PINGREQ, message.NewPingreqMessage())
+}
+
+func FuzzDecodePingresp(f *testing.F) {
+	fuzzDecode(f, message.PINGRESP, message.NewPingrespMessage())
+}
+
+func FuzzDecodeDisconnect(f *testing.F) {
+	fuzzDecode(f, message.DISCONNECT, message.NewDisconnectMessage())
+}
+
+// FuzzReadPacket reads packets off a stream, which must never return more than
+// what's in the stream, whatever the remaining lengths say.
+func FuzzReadPacket(f *testing.F) {
+	f.Add([]byte{0xc0, 0x00})
+	f.Add([]byte{0x30, 0xff, 0xff, 0xff, 0x7f})
+	f.Add([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReader(bytes.NewReader(data))
+
+		for {
+			pkt, err := r.ReadPacket()
+			if err != nil {
+				return
+			}
+
+			require.LessOrEqual(t, len(pkt), len(data))
+		}
+	})
+}
+
+// fuzzDecode fuzzes Decode for the packets of type mtype, seeded with seed.
+func fuzzDecode(f *testing.F, mtype message.MessageType, seed message.Message) {
+	buf := make([]byte, seed.Len())
+	n, err := seed.Encode(buf)
+	require.NoError(f, err)
+
+	f.Add(buf[:n])
+	f.Add(buf[:n-1])
+	f.Add(buf[:2])
+
+	f.Fuzz(func(t *testing.T, pkt []byte) {
+		if len(pkt) == 0 {
+			return
+		}
+
+		// Keep the flags, so the decoder's checks of them are fuzzed as well
+		pkt[0] = byte(mtype)<<4 | pkt[0]&0x0f
+
+		msg, n, err := Decode(pkt)
+		if err != nil {
+			return
+		}
+
+		require.Equal(t, mtype, msg.Type())
+		require.LessOrEqual(t, n, len(pkt))
+	})
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		{0xc0},
+
+		// Remaining length longer than the packet
+		{0x30, 0x7f, 0x00, 0x01, 'a'},
+
+		// Remaining length over 4 bytes
+		{0x30, 0xff, 0xff, 0xff, 0xff, 0x01},
+	}
+
+	for _, pkt := range tests {
+		_, _, err := Decode(pkt)
+		require.Equal(t, ErrMalformedPacket, err, "%x", pkt)
+	}
+
+	msg, n, err := Decode([]byte{0xc0, 0x00, 'x'})
+	require.NoError(t, err)
+	require.Equal(t, message.PINGREQ, msg.Type())
+	require.Equal(t, 2, n)
+}
+
+// A remaining length of 256MB with nothing after it takes a chunk, not 256MB.
+func TestReaderLyingLength(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x01, 'a'}))
+
+	_, err := r.ReadPacket()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// The buffers are pooled in size classes of powers of two, from minPooledSize up
+// to maxPooledSize. Anything larger is rare enough to be left to the GC.
+const (
+	minPooledShift = 8  // 256 bytes
+	maxPooledShift = 20 // 1MB
+
+	minPooledSize = 1 << minPooledShift
+	maxPooledSize = 1 << maxPooledShift
+)
+
+// PoolStats is how well the buffer pool is doing.
+type PoolStats struct {
+	// The number of buffers handed out by GetBuffer that were reused, and that
+	// had to be allocated
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+
+	// The number of buffers asked for that were too large to be pooled
+	Oversize int64 `json:"oversize"`
+}
+
+var (
+	pools [maxPooledShift - minPooledShift + 1]sync.Pool
+
+	gets, misses, oversize int64
+)
+
+func init() {
+	for i := range pools {
+		size := minPooledSize << uint(i)
+
+		pools[i].New = func() interface{} {
+			atomic.AddInt64(&misses, 1)
+			return make([]byte, size)
+		}
+	}
+}
+
+// GetBuffer returns a buffer of n bytes, for encoding and decoding messages. Its
+// content is undefined. It should be given back with PutBuffer once it's not
+// used anymore, and not used after that.
+func GetBuffer(n int) []byte {
+	if n > maxPooledSize {
+		atomic.AddInt64(&oversize, 1)
+		return make([]byte, n)
+	}
+
+	atomic.AddInt64(&gets, 1)
+
+	return pools[poolIndex(n)].Get().([]byte)[:n]
+}
+
+// PutBuffer gives a buffer from GetBuffer back to the pool. Buffers that are not
+// from GetBuffer are ignored.
+func PutBuffer(b []byte) {
+	c := cap(b)
+	if c < minPooledSize || c > maxPooledSize || c&(c-1) != 0 {
+		return
+	}
+
+	pools[poolIndex(c)].Put(b[:c])
+}
+
+// BufferPoolStats returns the buffer pool stats since the process started.
+func BufferPoolStats() PoolStats {
+	g, m := atomic.LoadInt64(&gets), atomic.LoadInt64(&misses)
+
+	return PoolStats{
+		Hits:     g - m,
+		Misses:   m,
+		Oversize: atomic.LoadInt64(&oversize),
+	}
+}
+
+// poolIndex returns the size class n bytes fit in.
+func poolIndex(n int) int {
+	i := 0
+	for size := minPooledSize; size < n; size <<= 1 {
+		i++
+	}
+	return i
+}
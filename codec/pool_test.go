@@ -0,0 +1,69 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 1, 256, 257, 4000, maxPooledSize} {
+		b := GetBuffer(n)
+		require.Equal(t, n, len(b))
+
+		c := cap(b)
+		require.True(t, c >= n && c >= minPooledSize && c&(c-1) == 0, "Got cap %d for %d bytes", c, n)
+
+		PutBuffer(b)
+	}
+
+	before := BufferPoolStats()
+
+	b := GetBuffer(maxPooledSize + 1)
+	require.Equal(t, maxPooledSize+1, len(b))
+	PutBuffer(b)
+
+	// Buffers that aren't from the pool are left alone
+	PutBuffer(make([]byte, 300))
+	PutBuffer(nil)
+
+	after := BufferPoolStats()
+	require.Equal(t, before.Oversize+1, after.Oversize)
+	require.Equal(t, before.Hits+before.Misses, after.Hits+after.Misses)
+}
+
+func TestPoolIndex(t *testing.T) {
+	require.Equal(t, 0, poolIndex(0))
+	require.Equal(t, 0, poolIndex(minPooledSize))
+	require.Equal(t, 1, poolIndex(minPooledSize+1))
+	require.Equal(t, len(pools)-1, poolIndex(maxPooledSize))
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	var buf bytes.Buffer
+
+	w := NewWriter(&buf)
+	msg := newTestPublishMessage(1000)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w.WriteMessage(msg)
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build grpc
+// +build grpc
+
+// Package control is a gRPC API for managing the SurgeMQ server, for operators
+// that would rather script against gRPC than the REST API in package admin. It's
+// only built with the "grpc" build tag.
+//
+//	s := grpc.NewServer()
+//	control.Register(s, svr)
+//	go s.Serve(ln)
+//
+// The service is surgemq.control.Control. Its messages are encoded as JSON
+// rather than protocol buffers, so there's no generated code to keep in step
+// with the server, and clients select it with the "json" content subtype, e.g.
+// grpc.CallContentSubtype("json") in Go. The methods are:
+//
+//	ListSessions     The connected clients
+//	Kick             Disconnect a client
+//	Publish          Publish a message, as if a client had published it
+//	Retained         The retained messages matching a topic filter
+//	Subscribe        Stream the messages on a topic filter, e.g., broker events
+package control
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultClientId is the client ID messages published over gRPC are published as.
+const DefaultClientId = "$grpc"
+
+// streamQueueSize is the number of messages buffered for each Subscribe stream.
+// Messages that don't fit are dropped, so publishers never wait on a stream.
+const streamQueueSize = 256
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// jsonCodec encodes the messages of the service as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return "json" }
+
+type ListSessionsRequest struct{}
+
+type ListSessionsResponse struct {
+	Sessions []service.ClientInfo `json:"sessions"`
+}
+
+type KickRequest struct {
+	ClientId string `json:"client_id"`
+}
+
+type KickResponse struct{}
+
+// Message is a PUBLISH message. Payload is raw bytes, which is base64 in JSON.
+type Message struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload []byte `json:"payload"`
+}
+
+type PublishRequest struct {
+	Message
+
+	// BypassACL skips the authorization stages of the server's pipeline
+	BypassACL bool `json:"bypass_acl"`
+}
+
+type PublishResponse struct{}
+
+type RetainedRequest struct {
+	Topic string `json:"topic"`
+}
+
+type RetainedResponse struct {
+	Messages []Message `json:"messages"`
+}
+
+type SubscribeRequest struct {
+	Topic string `json:"topic"`
+	QoS   byte   `json:"qos"`
+}
+
+// ControlServer is the server side of the service.
+type ControlServer interface {
+	ListSessions(context.Context, *ListSessionsRequest) (*ListSessionsResponse, error)
+	Kick(context.Context, *KickRequest) (*KickResponse, error)
+	Publish(context.Context, *PublishRequest) (*PublishResponse, error)
+	Retained(context.Context, *RetainedRequest) (*RetainedResponse, error)
+	Subscribe(*SubscribeRequest, grpc.ServerStream) error
+}
+
+// Server implements ControlServer for a SurgeMQ server.
+type Server struct {
+	// ClientId is the client ID messages published over gRPC are published as, as
+	// seen by the pipeline stages and the bridges. If not set then default to
+	// "$grpc".
+	ClientId string
+
+	svr *service.Server
+}
+
+// NewServer returns the control service for the server.
+func NewServer(svr *service.Server) *Server {
+	return &Server{svr: svr}
+}
+
+// Register registers the control service for the server with a gRPC server.
+func Register(s grpc.ServiceRegistrar, svr *service.Server) *Server {
+	this := NewServer(svr)
+	s.RegisterService(&ServiceDesc, this)
+	return this
+}
+
+func (this *Server) ListSessions(ctx context.Context, req *ListSessionsRequest) (*ListSessionsResponse, error) {
+	return &ListSessionsResponse{Sessions: this.svr.Clients()}, nil
+}
+
+func (this *Server) Kick(ctx context.Context, req *KickRequest) (*KickResponse, error) {
+	if err := this.svr.Disconnect(req.ClientId); err == service.ErrClientNotFound {
+		return nil, status.Errorf(codes.NotFound, "%v", err)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
+	return &KickResponse{}, nil
+}
+
+func (this *Server) Publish(ctx context.Context, req *PublishRequest) (*PublishResponse, error) {
+	msg := message.NewPublishMessage()
+
+	if err := msg.SetTopic([]byte(req.Topic)); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	if err := msg.SetQoS(req.QoS); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	msg.SetRetain(req.Retain)
+	msg.SetPayload(req.Payload)
+
+	opts := &service.PublishOptions{
+		ClientId:  this.clientId(),
+		BypassACL: req.BypassACL,
+	}
+
+	if _, err := this.svr.Publish(msg, opts); err == service.ErrPacketTooLarge {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+
+	return &PublishResponse{}, nil
+}
+
+func (this *Server) Retained(ctx context.Context, req *RetainedRequest) (*RetainedResponse, error) {
+	rmsgs, err := this.svr.Retained([]byte(req.Topic))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	resp := &RetainedResponse{Messages: make([]Message, 0, len(rmsgs))}
+
+	for _, rm := range rmsgs {
+		resp.Messages = append(resp.Messages, newMessage(rm))
+	}
+
+	return resp, nil
+}
+
+// Subscribe streams the messages published on the topics matching the filter
+// until the client cancels the call. Retained messages are not sent, they can be
+// fetched with Retained.
+func (this *Server) Subscribe(req *SubscribeRequest, stream grpc.ServerStream) error {
+	msgs := make(chan Message, streamQueueSize)
+
+	// The message can be reused once onPublish returns, so it's copied right away
+	var onPublish service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		select {
+		case msgs <- newMessage(msg):
+		default:
+		}
+
+		return nil
+	}
+
+	if rqos, err := this.svr.Subscribe([]byte(req.Topic), req.QoS, &onPublish); err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	} else if rqos == message.QosFailure {
+		return status.Errorf(codes.InvalidArgument, "control/Subscribe: Subscription to %q failed", req.Topic)
+	}
+
+	defer this.svr.Unsubscribe([]byte(req.Topic), &onPublish)
+
+	for {
+		select {
+		case m := <-msgs:
+			if err := stream.SendMsg(&m); err != nil {
+				return err
+			}
+
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (this *Server) clientId() string {
+	if this.ClientId == "" {
+		return DefaultClientId
+	}
+
+	return this.ClientId
+}
+
+func newMessage(msg *message.PublishMessage) Message {
+	return Message{
+		Topic:   string(msg.Topic()),
+		QoS:     msg.QoS(),
+		Retain:  msg.Retain(),
+		Payload: append([]byte(nil), msg.Payload()...),
+	}
+}
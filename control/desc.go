@@ -0,0 +1,107 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build grpc
+// +build grpc
+
+package control
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+const serviceName = "surgemq.control.Control"
+
+// ServiceDesc describes the service to gRPC. It's written out by hand as there's
+// no protocol buffer definition to generate it from.
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*ControlServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListSessions",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(ListSessionsRequest)
+				return unary(srv, ctx, dec, interceptor, "ListSessions", req, func(ctx context.Context) (interface{}, error) {
+					return srv.(ControlServer).ListSessions(ctx, req)
+				})
+			},
+		},
+		{
+			MethodName: "Kick",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(KickRequest)
+				return unary(srv, ctx, dec, interceptor, "Kick", req, func(ctx context.Context) (interface{}, error) {
+					return srv.(ControlServer).Kick(ctx, req)
+				})
+			},
+		},
+		{
+			MethodName: "Publish",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(PublishRequest)
+				return unary(srv, ctx, dec, interceptor, "Publish", req, func(ctx context.Context) (interface{}, error) {
+					return srv.(ControlServer).Publish(ctx, req)
+				})
+			},
+		},
+		{
+			MethodName: "Retained",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				req := new(RetainedRequest)
+				return unary(srv, ctx, dec, interceptor, "Retained", req, func(ctx context.Context) (interface{}, error) {
+					return srv.(ControlServer).Retained(ctx, req)
+				})
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				req := new(SubscribeRequest)
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(ControlServer).Subscribe(req, stream)
+			},
+		},
+	},
+}
+
+// unary decodes the request into req and calls the method, through the
+// interceptor if there's one.
+func unary(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor,
+	method string, req interface{}, call func(context.Context) (interface{}, error)) (interface{}, error) {
+
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+
+	if interceptor == nil {
+		return call(ctx)
+	}
+
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/" + serviceName + "/" + method,
+	}
+
+	return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return call(ctx)
+	})
+}
@@ -73,7 +73,6 @@
 //   func main() {
 //       // Create a new server
 //       svr := &service.Server{
-//           KeepAlive:        300,               // seconds
 //           ConnectTimeout:   2,                 // seconds
 //           SessionsProvider: "mem",             // keeps sessions in memory
 //           Authenticator:    "mockSuccess",     // always succeed
@@ -199,7 +199,6 @@ func pinger() {
 func server(cmd *cobra.Command, args []string) {
 	// Create a new server
 	s = &service.Server{
-		KeepAlive:        300,           // seconds
 		ConnectTimeout:   2,             // seconds
 		SessionsProvider: "mem",         // keeps sessions in memory
 		Authenticator:    "mockSuccess", // always succeed
@@ -17,11 +17,15 @@ package main
 import (
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"syscall"
+	"time"
 
 	"github.com/surge/glog"
+	"github.com/surgemq/surgemq/admin"
 	"github.com/surgemq/surgemq/service"
 )
 
@@ -33,7 +37,23 @@ var (
 	authenticator    string
 	sessionsProvider string
 	topicsProvider   string
+	maxPacketSize    int
+	maxTopicLevels   int
+	maxTopicLevelLen int
+	proxyProtocol    bool
+	maxConns         int
+	maxConnsPerIP    int
+	bufferSize       int
+	flushInterval    time.Duration
+	disableRetained  bool
+	maxRetained      int
+	maxRetainedPerID int
+	maxGoroutines    int
+	adviseKeepAlive  bool
+	lowMemory        bool
+	strict           bool
 	cpuprofile       string
+	adminAddr        string // HTTP API address, eg. :8082
 	wsAddr           string // HTTPS websocket address eg. :8080
 	wssAddr          string // HTTPS websocket address, eg. :8081
 	wssCertPath      string // path to HTTPS public key
@@ -41,14 +61,30 @@ var (
 )
 
 func init() {
-	flag.IntVar(&keepAlive, "keepalive", service.DefaultKeepAlive, "Keepalive (sec)")
+	flag.IntVar(&keepAlive, "keepalive", 0, "Deprecated, has no effect: the keepalive is the one each client sends, see -advisekeepalive")
 	flag.IntVar(&connectTimeout, "connecttimeout", service.DefaultConnectTimeout, "Connect Timeout (sec)")
 	flag.IntVar(&ackTimeout, "acktimeout", service.DefaultAckTimeout, "Ack Timeout (sec)")
 	flag.IntVar(&timeoutRetries, "retries", service.DefaultTimeoutRetries, "Timeout Retries")
 	flag.StringVar(&authenticator, "auth", service.DefaultAuthenticator, "Authenticator Type")
 	flag.StringVar(&sessionsProvider, "sessions", service.DefaultSessionsProvider, "Session Provider Type")
 	flag.StringVar(&topicsProvider, "topics", service.DefaultTopicsProvider, "Topics Provider Type")
+	flag.IntVar(&maxPacketSize, "maxpacketsize", service.DefaultMaxPacketSize, "Maximum packet size (bytes)")
+	flag.IntVar(&maxTopicLevels, "maxtopiclevels", 0, "Maximum number of levels in a topic, 0 for no limit")
+	flag.IntVar(&maxTopicLevelLen, "maxtopiclevellen", 0, "Maximum length of a topic level (bytes), 0 for no limit")
+	flag.BoolVar(&proxyProtocol, "proxyprotocol", false, "Expect a PROXY protocol header on every connection")
+	flag.IntVar(&maxConns, "maxconns", 0, "Maximum number of connections, 0 for no limit")
+	flag.IntVar(&maxConnsPerIP, "maxconnsperip", 0, "Maximum number of connections per source IP, 0 for no limit")
+	flag.IntVar(&bufferSize, "buffersize", 0, "Size of each connection's incoming and outgoing buffers (bytes), 0 for the default")
+	flag.DurationVar(&flushInterval, "flushinterval", 0, "How long to wait for more packets to write together, 0 to write them right away")
+	flag.BoolVar(&disableRetained, "noretain", false, "Don't keep retained messages")
+	flag.IntVar(&maxRetained, "maxretained", 0, "Maximum number of retained messages sent for each topic filter subscribed to, 0 for no limit")
+	flag.IntVar(&maxRetainedPerID, "maxretainedperclient", 0, "Maximum number of retained messages each client ID can set, 0 for no limit")
+	flag.IntVar(&maxGoroutines, "maxgoroutines", 0, "Maximum number of goroutines for client connections, 0 for no limit")
+	flag.BoolVar(&adviseKeepAlive, "advisekeepalive", false, "Suggest shorter keepalives for clients whose connections keep getting dropped, see /keepalive on the admin API")
+	flag.BoolVar(&lowMemory, "lowmem", false, "Use the low memory profile, for small gateways")
+	flag.BoolVar(&strict, "strict", false, "Disconnect clients that don't quite follow the spec")
 	flag.StringVar(&cpuprofile, "cpuprofile", "", "CPU Profile Filename")
+	flag.StringVar(&adminAddr, "adminaddr", "", "HTTP API address, eg. ':8082'")
 	flag.StringVar(&wsAddr, "wsaddr", "", "HTTP websocket address, eg. ':8080'")
 	flag.StringVar(&wssAddr, "wssaddr", "", "HTTPS websocket address, eg. ':8081'")
 	flag.StringVar(&wssCertPath, "wsscertpath", "", "HTTPS server public key file")
@@ -58,12 +94,33 @@ func init() {
 
 func main() {
 	svr := &service.Server{
-		KeepAlive:        keepAlive,
-		ConnectTimeout:   connectTimeout,
-		AckTimeout:       ackTimeout,
-		TimeoutRetries:   timeoutRetries,
-		SessionsProvider: sessionsProvider,
-		TopicsProvider:   topicsProvider,
+		KeepAlive:               keepAlive,
+		ConnectTimeout:          connectTimeout,
+		AckTimeout:              ackTimeout,
+		TimeoutRetries:          timeoutRetries,
+		SessionsProvider:        sessionsProvider,
+		TopicsProvider:          topicsProvider,
+		MaxPacketSize:           maxPacketSize,
+		MaxTopicLevels:          maxTopicLevels,
+		MaxTopicLevelLength:     maxTopicLevelLen,
+		ProxyProtocol:           proxyProtocol,
+		MaxConnections:          maxConns,
+		MaxConnectionsPerIP:     maxConnsPerIP,
+		BufferSize:              bufferSize,
+		FlushInterval:           flushInterval,
+		DisableRetained:         disableRetained,
+		MaxRetainedPerSubscribe: maxRetained,
+		MaxRetainedPerClient:    maxRetainedPerID,
+		MaxGoroutines:           maxGoroutines,
+		AdviseKeepAlive:         adviseKeepAlive,
+	}
+
+	if lowMemory {
+		svr.UseLowMemoryProfile()
+	}
+
+	if strict {
+		svr.Compliance = service.Strict
 	}
 
 	var f *os.File
@@ -78,6 +135,29 @@ func main() {
 		pprof.StartCPUProfile(f)
 	}
 
+	// SIGHUP hands the listener over to a new copy of the server, e.g., after the
+	// binary has been replaced with a new version
+	hupchan := make(chan os.Signal, 1)
+	signal.Notify(hupchan, syscall.SIGHUP)
+	go func() {
+		for range hupchan {
+			if _, err := svr.Upgrade(os.Args[0], os.Args[1:]...); err != nil {
+				glog.Errorf("surgemq/main: Error upgrading: %v", err)
+			}
+		}
+	}()
+
+	// SIGUSR2 does the same, and hands over the connected clients as well
+	usr2chan := make(chan os.Signal, 1)
+	signal.Notify(usr2chan, syscall.SIGUSR2)
+	go func() {
+		for range usr2chan {
+			if _, err := svr.UpgradeWithHandoff(os.Args[0], os.Args[1:]...); err != nil {
+				glog.Errorf("surgemq/main: Error upgrading: %v", err)
+			}
+		}
+	}()
+
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, os.Interrupt, os.Kill)
 	go func() {
@@ -110,9 +190,41 @@ func main() {
 		}
 	}
 
-	/* create plain MQTT listener */
-	err = svr.ListenAndServe(mqttaddr)
+	if len(adminAddr) > 0 {
+		go func() {
+			if err := http.ListenAndServe(adminAddr, admin.NewHandler(svr)); err != nil {
+				glog.Errorf("surgemq/main: %v", err)
+			}
+		}()
+	}
+
+	// Use the listener from systemd or from the server being upgraded if there's
+	// one, otherwise create plain MQTT listener
+	lns, err := service.Listeners()
+	if err != nil {
+		glog.Errorf("surgemq/main: %v", err)
+	}
+
+	// Pick up the clients handed over by the server being upgraded, if any
+	go func() {
+		if n, err := svr.ResumeHandoff(); err != nil {
+			glog.Errorf("surgemq/main: %v", err)
+		} else if n > 0 {
+			glog.Infof("surgemq/main: Resumed %d connections", n)
+		}
+	}()
+
+	if len(lns) > 0 {
+		err = svr.Serve(lns[0])
+	} else {
+		err = svr.ListenAndServe(mqttaddr)
+	}
+
 	if err != nil {
 		glog.Errorf("surgemq/main: %v", err)
 	}
+
+	// Serve returns once the listener has been handed over, the connected clients
+	// that haven't been handed over reconnect to the new server
+	svr.Close()
 }
@@ -0,0 +1,172 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging is the leveled, structured logging interface the SurgeMQ
+// server and client log through. Each message comes with fields, i.e. key/value
+// pairs, rather than being formatted into a string, and a Logger can carry fields
+// of its own that it adds to everything it logs, which is how each connection's
+// messages carry its client ID and remote address.
+//
+// By default everything is logged with glog, the same as before the interface
+// was added. Adapters for log/slog are in this package, and for zap and logrus in
+// the zaplog and logruslog packages, so the dependencies are only pulled in by
+// those who use them:
+//
+//	svr := &service.Server{
+//		Logger: logging.NewSlog(slog.Default()),
+//	}
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/surge/glog"
+)
+
+// Field is a key/value pair logged along with a message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F returns a field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err returns the field for an error, keyed "error".
+func Err(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+// Logger logs messages at four levels. It must be safe to use from multiple
+// goroutines.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+
+	// With returns a Logger that adds the fields to everything it logs, after
+	// any fields this Logger adds already.
+	With(fields ...Field) Logger
+}
+
+// Glog returns the Logger that logs with glog. The fields are appended to the
+// message as key=value.
+func Glog() Logger {
+	return glogger{}
+}
+
+type glogger struct {
+	fields []Field
+}
+
+func (this glogger) Debug(msg string, fields ...Field) {
+	glog.Debugf("%s", this.format(msg, fields))
+}
+
+func (this glogger) Info(msg string, fields ...Field) {
+	glog.Infof("%s", this.format(msg, fields))
+}
+
+func (this glogger) Warn(msg string, fields ...Field) {
+	glog.Warningf("%s", this.format(msg, fields))
+}
+
+func (this glogger) Error(msg string, fields ...Field) {
+	glog.Errorf("%s", this.format(msg, fields))
+}
+
+func (this glogger) With(fields ...Field) Logger {
+	return glogger{fields: join(this.fields, fields)}
+}
+
+func (this glogger) format(msg string, fields []Field) string {
+	if len(this.fields) == 0 && len(fields) == 0 {
+		return msg
+	}
+
+	var b strings.Builder
+	b.WriteString(msg)
+
+	for _, fs := range [][]Field{this.fields, fields} {
+		for _, f := range fs {
+			fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+		}
+	}
+
+	return b.String()
+}
+
+// Nop returns a Logger that doesn't log anything.
+func Nop() Logger {
+	return nop{}
+}
+
+type nop struct{}
+
+func (nop) Debug(msg string, fields ...Field) {}
+func (nop) Info(msg string, fields ...Field)  {}
+func (nop) Warn(msg string, fields ...Field)  {}
+func (nop) Error(msg string, fields ...Field) {}
+func (nop) With(fields ...Field) Logger       { return nop{} }
+
+// NewSlog returns a Logger that logs with l.
+func NewSlog(l *slog.Logger) Logger {
+	return slogger{l: l}
+}
+
+type slogger struct {
+	l *slog.Logger
+}
+
+func (this slogger) Debug(msg string, fields ...Field) {
+	this.l.Debug(msg, slogArgs(fields)...)
+}
+
+func (this slogger) Info(msg string, fields ...Field) {
+	this.l.Info(msg, slogArgs(fields)...)
+}
+
+func (this slogger) Warn(msg string, fields ...Field) {
+	this.l.Warn(msg, slogArgs(fields)...)
+}
+
+func (this slogger) Error(msg string, fields ...Field) {
+	this.l.Error(msg, slogArgs(fields)...)
+}
+
+func (this slogger) With(fields ...Field) Logger {
+	return slogger{l: this.l.With(slogArgs(fields)...)}
+}
+
+func slogArgs(fields []Field) []interface{} {
+	args := make([]interface{}, len(fields))
+	for i, f := range fields {
+		args[i] = slog.Any(f.Key, f.Value)
+	}
+
+	return args
+}
+
+// join returns a new slice with b after a, so a Logger's fields are never
+// appended to in place by two goroutines at once.
+func join(a, b []Field) []Field {
+	fields := make([]Field, 0, len(a)+len(b))
+	fields = append(fields, a...)
+	return append(fields, b...)
+}
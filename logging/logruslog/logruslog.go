@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logruslog adapts a logrus logger to the logging.Logger interface.
+package logruslog
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// New returns a Logger that logs with l, which is either a *logrus.Logger or a
+// *logrus.Entry with fields of its own.
+func New(l logrus.FieldLogger) logging.Logger {
+	return &logger{l: l}
+}
+
+type logger struct {
+	l logrus.FieldLogger
+}
+
+func (this *logger) Debug(msg string, fields ...logging.Field) {
+	this.entry(fields).Debug(msg)
+}
+
+func (this *logger) Info(msg string, fields ...logging.Field) {
+	this.entry(fields).Info(msg)
+}
+
+func (this *logger) Warn(msg string, fields ...logging.Field) {
+	this.entry(fields).Warn(msg)
+}
+
+func (this *logger) Error(msg string, fields ...logging.Field) {
+	this.entry(fields).Error(msg)
+}
+
+func (this *logger) With(fields ...logging.Field) logging.Logger {
+	return &logger{l: this.entry(fields)}
+}
+
+func (this *logger) entry(fields []logging.Field) logrus.FieldLogger {
+	if len(fields) == 0 {
+		return this.l
+	}
+
+	lfs := make(logrus.Fields, len(fields))
+	for _, f := range fields {
+		lfs[f.Key] = f.Value
+	}
+
+	return this.l.WithFields(lfs)
+}
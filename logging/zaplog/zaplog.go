@@ -0,0 +1,71 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package zaplog adapts a zap.Logger to the logging.Logger interface.
+package zaplog
+
+import (
+	"github.com/surgemq/surgemq/logging"
+	"go.uber.org/zap"
+)
+
+// New returns a Logger that logs with l.
+func New(l *zap.Logger) logging.Logger {
+	return &logger{l: l}
+}
+
+type logger struct {
+	l *zap.Logger
+}
+
+func (this *logger) Debug(msg string, fields ...logging.Field) {
+	if ce := this.l.Check(zap.DebugLevel, msg); ce != nil {
+		ce.Write(zapFields(fields)...)
+	}
+}
+
+func (this *logger) Info(msg string, fields ...logging.Field) {
+	if ce := this.l.Check(zap.InfoLevel, msg); ce != nil {
+		ce.Write(zapFields(fields)...)
+	}
+}
+
+func (this *logger) Warn(msg string, fields ...logging.Field) {
+	if ce := this.l.Check(zap.WarnLevel, msg); ce != nil {
+		ce.Write(zapFields(fields)...)
+	}
+}
+
+func (this *logger) Error(msg string, fields ...logging.Field) {
+	if ce := this.l.Check(zap.ErrorLevel, msg); ce != nil {
+		ce.Write(zapFields(fields)...)
+	}
+}
+
+func (this *logger) With(fields ...logging.Field) logging.Logger {
+	return &logger{l: this.l.With(zapFields(fields)...)}
+}
+
+func zapFields(fields []logging.Field) []zap.Field {
+	zfs := make([]zap.Field, len(fields))
+	for i, f := range fields {
+		if err, ok := f.Value.(error); ok && f.Key == "error" {
+			zfs[i] = zap.Error(err)
+		} else {
+			zfs[i] = zap.Any(f.Key, f.Value)
+		}
+	}
+
+	return zfs
+}
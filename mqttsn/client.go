@@ -0,0 +1,214 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+// client is the gateway's state for one connected MQTT-SN client.
+type client struct {
+	gw   *Gateway
+	addr net.Addr
+	id   string
+
+	// How long the client can go quiet for before it's disconnected. If 0 then
+	// it's never disconnected.
+	duration time.Duration
+
+	mu sync.Mutex
+
+	// The last time a message was received from the client
+	last time.Time
+
+	// Topic IDs registered with the client, in both directions
+	names map[uint16]string
+	ids   map[string]uint16
+	next  uint16
+
+	// The message ID of the next REGISTER sent to the client
+	msgid uint16
+
+	// QoS 2 messages received but not yet released, by message ID
+	pending map[uint16]*message.PublishMessage
+
+	// The topics subscribed to, using onpub
+	subs  map[string]bool
+	onpub service.OnPublishFunc
+}
+
+func newClient(gw *Gateway, addr net.Addr, id string, duration uint16) *client {
+	c := &client{
+		gw:       gw,
+		addr:     addr,
+		id:       id,
+		duration: time.Duration(duration) * time.Second,
+		last:     time.Now(),
+		names:    make(map[uint16]string),
+		ids:      make(map[string]uint16),
+		pending:  make(map[uint16]*message.PublishMessage),
+		subs:     make(map[string]bool),
+	}
+
+	c.onpub = func(msg *message.PublishMessage) error {
+		c.deliver(msg)
+		return nil
+	}
+
+	return c
+}
+
+func (this *client) touch() {
+	this.mu.Lock()
+	this.last = time.Now()
+	this.mu.Unlock()
+}
+
+func (this *client) expired(now time.Time) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.duration > 0 && now.Sub(this.last) > this.duration+this.duration/2
+}
+
+// register returns the ID of topic, allocating one if it doesn't have one yet. The
+// new ID is sent to the client, if it's not already aware of it, by the caller
+// sending a REGACK or SUBACK, or by deliver sending a REGISTER.
+func (this *client) register(topic string) uint16 {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	id, _ := this.registerLocked(topic)
+	return id
+}
+
+func (this *client) registerLocked(topic string) (uint16, bool) {
+	if id, ok := this.ids[topic]; ok {
+		return id, false
+	}
+
+	// 0x0000 and 0xffff are reserved
+	this.next++
+	if this.next == 0xffff {
+		this.next = 1
+	}
+
+	id := this.next
+
+	if old, ok := this.names[id]; ok {
+		delete(this.ids, old)
+	}
+
+	this.names[id] = topic
+	this.ids[topic] = id
+
+	return id, true
+}
+
+func (this *client) topic(id uint16) (string, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	topic, ok := this.names[id]
+	return topic, ok
+}
+
+func (this *client) received(msgid uint16, msg *message.PublishMessage) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.pending[msgid] = msg
+}
+
+func (this *client) released(msgid uint16) *message.PublishMessage {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	msg := this.pending[msgid]
+	delete(this.pending, msgid)
+
+	return msg
+}
+
+func (this *client) subscribe(topic string) error {
+	if _, err := this.gw.Server.Subscribe([]byte(topic), message.QosAtMostOnce, &this.onpub); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	this.subs[topic] = true
+	this.mu.Unlock()
+
+	return nil
+}
+
+func (this *client) unsubscribe(topic string) {
+	this.mu.Lock()
+	delete(this.subs, topic)
+	this.mu.Unlock()
+
+	if err := this.gw.Server.Unsubscribe([]byte(topic), &this.onpub); err != nil {
+		glog.Errorf("mqttsn/unsubscribe: Error unsubscribing %q from %q: %v", this.id, topic, err)
+	}
+}
+
+// close removes all the client's subscriptions.
+func (this *client) close() {
+	this.mu.Lock()
+	subs := this.subs
+	this.subs = make(map[string]bool)
+	this.mu.Unlock()
+
+	for topic := range subs {
+		if err := this.gw.Server.Unsubscribe([]byte(topic), &this.onpub); err != nil {
+			glog.Errorf("mqttsn/close: Error unsubscribing %q from %q: %v", this.id, topic, err)
+		}
+	}
+}
+
+// deliver sends a message published on the server to the client, at QoS 0. Two
+// character topics are sent as short topic names, and other topics are sent by ID,
+// REGISTERing them with the client first if needed.
+func (this *client) deliver(msg *message.PublishMessage) {
+	topic := string(msg.Topic())
+
+	p := &packet{Type: PUBLISH, Data: msg.Payload()}
+	if msg.Retain() {
+		p.Flags |= flagRetain
+	}
+
+	if len(topic) == 2 {
+		p.Flags |= TopicIdShort
+		p.Topic = []byte(topic)
+	} else {
+		this.mu.Lock()
+		id, isnew := this.registerLocked(topic)
+		if isnew {
+			this.msgid++
+			this.gw.send(this.addr, &packet{Type: REGISTER, TopicId: id, MsgId: this.msgid, Topic: []byte(topic)})
+		}
+		this.mu.Unlock()
+
+		p.TopicId = id
+	}
+
+	this.gw.send(this.addr, p)
+}
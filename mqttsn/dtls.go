@@ -0,0 +1,193 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build dtls
+// +build dtls
+
+package mqttsn
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/surge/glog"
+	"github.com/surgemq/surgemq/service"
+)
+
+// ListenAndServeDTLS is the same as ListenAndServe, but over DTLS 1.2, and only
+// built with the "dtls" build tag. The URI is of the form "dtls://host:port".
+// The handshake is protected by a cookie exchange, and sessions can be resumed,
+// see service.ListenDTLS.
+func (this *Gateway) ListenAndServeDTLS(uri string, cfg *dtls.Config) error {
+	ln, err := service.ListenDTLS(uri, cfg)
+	if err != nil {
+		return err
+	}
+
+	return this.Serve(newDTLSPacketConn(ln))
+}
+
+type dtlsDatagram struct {
+	b    []byte
+	addr net.Addr
+}
+
+// dtlsPacketConn turns a DTLS listener into a net.PacketConn, so the gateway can
+// serve it like plain UDP. Every DTLS connection is read separately, and its
+// records are handed to ReadFrom along with the client's address. WriteTo sends
+// back over the connection for the address.
+type dtlsPacketConn struct {
+	ln net.Listener
+
+	mu    sync.Mutex
+	conns map[string]net.Conn
+
+	in   chan dtlsDatagram
+	errs chan error
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newDTLSPacketConn(ln net.Listener) *dtlsPacketConn {
+	this := &dtlsPacketConn{
+		ln:    ln,
+		conns: make(map[string]net.Conn),
+		in:    make(chan dtlsDatagram),
+		errs:  make(chan error, 1),
+		done:  make(chan struct{}),
+	}
+
+	go this.run()
+
+	return this
+}
+
+func (this *dtlsPacketConn) run() {
+	for {
+		conn, err := this.ln.Accept()
+		if err != nil {
+			this.errs <- err
+			return
+		}
+
+		addr := conn.RemoteAddr().String()
+
+		this.mu.Lock()
+		if old, ok := this.conns[addr]; ok {
+			// The client lost its association and started a new one from the same
+			// address, so the old one is no use anymore
+			old.Close()
+		}
+		this.conns[addr] = conn
+		this.mu.Unlock()
+
+		go this.read(conn)
+	}
+}
+
+func (this *dtlsPacketConn) read(conn net.Conn) {
+	defer this.remove(conn)
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			glog.Debugf("mqttsn/dtlsPacketConn: Connection from %s closed: %v", conn.RemoteAddr(), err)
+			return
+		}
+
+		b := make([]byte, n)
+		copy(b, buf[:n])
+
+		select {
+		case this.in <- dtlsDatagram{b: b, addr: conn.RemoteAddr()}:
+
+		case <-this.done:
+			return
+		}
+	}
+}
+
+func (this *dtlsPacketConn) remove(conn net.Conn) {
+	conn.Close()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	addr := conn.RemoteAddr().String()
+	if this.conns[addr] == conn {
+		delete(this.conns, addr)
+	}
+}
+
+func (this *dtlsPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-this.in:
+		return copy(b, d.b), d.addr, nil
+
+	case err := <-this.errs:
+		return 0, nil, err
+
+	case <-this.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (this *dtlsPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	this.mu.Lock()
+	conn, ok := this.conns[addr.String()]
+	this.mu.Unlock()
+
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "dtls", Addr: addr, Err: net.ErrClosed}
+	}
+
+	return conn.Write(b)
+}
+
+func (this *dtlsPacketConn) Close() error {
+	this.once.Do(func() {
+		close(this.done)
+
+		this.mu.Lock()
+		for _, conn := range this.conns {
+			conn.Close()
+		}
+		this.mu.Unlock()
+	})
+
+	return this.ln.Close()
+}
+
+func (this *dtlsPacketConn) LocalAddr() net.Addr {
+	return this.ln.Addr()
+}
+
+// Deadlines apply to each DTLS connection separately, and the gateway doesn't
+// use them, so they're not supported here.
+func (this *dtlsPacketConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (this *dtlsPacketConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (this *dtlsPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
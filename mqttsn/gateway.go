@@ -0,0 +1,444 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mqttsn is an MQTT-SN 1.2 gateway for the SurgeMQ server. MQTT-SN is the
+// UDP flavour of MQTT meant for sensor networks, where devices are too small, or
+// the links too lossy, for TCP. The gateway translates the MQTT-SN clients'
+// REGISTER, PUBLISH and SUBSCRIBE messages into publishes and subscriptions on
+// the server, so they share the same topic tree as the MQTT clients.
+//
+//	svr := &service.Server{}
+//	gw := &mqttsn.Gateway{Server: svr}
+//
+//	go gw.ListenAndServe("udp://:1884")
+//	svr.ListenAndServe("tcp://:1883")
+//
+// Built with the "dtls" build tag, the gateway can serve DTLS 1.2 as well, with
+// ListenAndServeDTLS("dtls://:8884", cfg).
+//
+// What's supported:
+//
+//   - SEARCHGW, CONNECT, REGISTER, PUBLISH, SUBSCRIBE, UNSUBSCRIBE, PINGREQ and
+//     DISCONNECT from the clients
+//   - Normal, predefined and short topic IDs
+//   - QoS -1 (publishing without connecting), 0, 1 and 2 from the clients
+//   - Wildcard subscriptions, with topics being REGISTERed with the client as
+//     messages arrive
+//
+// What's not: wills, sleeping clients, and retries. Messages are delivered to
+// the clients at QoS 0, and sessions only last as long as the client is
+// connected.
+package mqttsn
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+// Gateway is an MQTT-SN gateway that connects MQTT-SN clients to a Server.
+type Gateway struct {
+	// Server is the server the messages are published to and subscribed from.
+	Server *service.Server
+
+	// GatewayId is the ID sent back in GWINFO when a client searches for a
+	// gateway. If not set then default to 0.
+	GatewayId byte
+
+	// Predefined topics, keyed by topic ID. Clients can publish and subscribe to
+	// them without REGISTERing first, and even publish at QoS -1 without
+	// connecting.
+	Predefined map[uint16]string
+
+	pc net.PacketConn
+
+	// The connected clients, keyed by their network address
+	mu      sync.Mutex
+	clients map[string]*client
+
+	quit chan struct{}
+}
+
+// ListenAndServe listens for MQTT-SN datagrams on the URI, which is of the form
+// "udp://host:port", and serves them until Close is called.
+func (this *Gateway) ListenAndServe(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	pc, err := net.ListenPacket(u.Scheme, u.Host)
+	if err != nil {
+		return err
+	}
+
+	return this.Serve(pc)
+}
+
+// Serve serves MQTT-SN datagrams received on pc until Close is called. pc is
+// closed when Serve returns.
+func (this *Gateway) Serve(pc net.PacketConn) error {
+	defer pc.Close()
+
+	if this.Server == nil {
+		return fmt.Errorf("mqttsn/Serve: Server is not set")
+	}
+
+	this.mu.Lock()
+	this.pc = pc
+	this.clients = make(map[string]*client)
+	this.quit = make(chan struct{})
+	this.mu.Unlock()
+
+	go this.expire()
+
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-this.quit:
+				return nil
+
+			default:
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+
+		p, err := decodePacket(buf[:n])
+		if err != nil {
+			glog.Errorf("mqttsn/Serve: Error decoding message from %s: %v", addr, err)
+			continue
+		}
+
+		this.handle(addr, p)
+	}
+}
+
+// Close stops the gateway and disconnects all the clients.
+func (this *Gateway) Close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.quit == nil {
+		return nil
+	}
+
+	close(this.quit)
+
+	for _, c := range this.clients {
+		c.close()
+	}
+	this.clients = nil
+
+	return this.pc.Close()
+}
+
+func (this *Gateway) send(addr net.Addr, p *packet) {
+	if _, err := this.pc.WriteTo(p.encode(), addr); err != nil {
+		glog.Errorf("mqttsn/send: Error sending to %s: %v", addr, err)
+	}
+}
+
+func (this *Gateway) client(addr net.Addr) *client {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.clients[addr.String()]
+}
+
+func (this *Gateway) handle(addr net.Addr, p *packet) {
+	switch p.Type {
+	case SEARCHGW:
+		this.send(addr, &packet{Type: GWINFO, GwId: this.GatewayId})
+		return
+
+	case CONNECT:
+		this.connect(addr, p)
+		return
+
+	case PUBLISH:
+		// QoS -1 messages don't need a connection
+		if p.QoS() == 3 {
+			this.publish(nil, addr, p)
+			return
+		}
+	}
+
+	c := this.client(addr)
+	if c == nil {
+		glog.Debugf("mqttsn/handle: Message type %#x from %s, which is not connected", p.Type, addr)
+
+		if p.Type == PINGREQ || p.Type == DISCONNECT {
+			this.send(addr, &packet{Type: DISCONNECT})
+		}
+		return
+	}
+
+	c.touch()
+
+	switch p.Type {
+	case REGISTER:
+		this.send(addr, &packet{Type: REGACK, TopicId: c.register(string(p.Topic)), MsgId: p.MsgId, Code: Accepted})
+
+	case REGACK:
+		// Acks for the REGISTERs we sent, nothing to do
+
+	case PUBLISH:
+		this.publish(c, addr, p)
+
+	case PUBREL:
+		if msg := c.released(p.MsgId); msg != nil {
+			this.publishAs(c, msg)
+		}
+		this.send(addr, &packet{Type: PUBCOMP, MsgId: p.MsgId})
+
+	case PUBACK:
+		// Only QoS 0 messages are sent, nothing to do
+
+	case SUBSCRIBE:
+		this.subscribe(c, addr, p)
+
+	case UNSUBSCRIBE:
+		if topic, ok := this.topicName(c, p); ok {
+			c.unsubscribe(topic)
+		}
+		this.send(addr, &packet{Type: UNSUBACK, MsgId: p.MsgId})
+
+	case PINGREQ:
+		this.send(addr, &packet{Type: PINGRESP})
+
+	case DISCONNECT:
+		this.disconnect(c)
+		this.send(addr, &packet{Type: DISCONNECT})
+
+	default:
+		glog.Errorf("mqttsn/handle: Unexpected message type %#x from %s", p.Type, addr)
+	}
+}
+
+func (this *Gateway) connect(addr net.Addr, p *packet) {
+	if p.Flags&flagWill != 0 {
+		this.send(addr, &packet{Type: CONNACK, Code: RejectedNotSupp})
+		return
+	}
+
+	c := newClient(this, addr, string(p.Data), p.Duration)
+
+	this.mu.Lock()
+	if this.clients == nil {
+		this.mu.Unlock()
+		return
+	}
+
+	// There's only ever one client for an address and for a client ID
+	var old []*client
+	for k, o := range this.clients {
+		if k == addr.String() || o.id == c.id {
+			old = append(old, o)
+			delete(this.clients, k)
+		}
+	}
+	this.clients[addr.String()] = c
+	this.mu.Unlock()
+
+	for _, o := range old {
+		o.close()
+	}
+
+	glog.Infof("mqttsn/connect: Client %q connected from %s", c.id, addr)
+
+	this.send(addr, &packet{Type: CONNACK, Code: Accepted})
+}
+
+func (this *Gateway) disconnect(c *client) {
+	this.mu.Lock()
+	if this.clients[c.addr.String()] == c {
+		delete(this.clients, c.addr.String())
+	}
+	this.mu.Unlock()
+
+	c.close()
+
+	glog.Infof("mqttsn/disconnect: Client %q disconnected", c.id)
+}
+
+// expire disconnects the clients that haven't been heard from in one and a half
+// times the duration they asked for when they connected.
+func (this *Gateway) expire() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.quit:
+			return
+
+		case now := <-ticker.C:
+			var expired []*client
+
+			this.mu.Lock()
+			for _, c := range this.clients {
+				if c.expired(now) {
+					expired = append(expired, c)
+				}
+			}
+			this.mu.Unlock()
+
+			for _, c := range expired {
+				glog.Infof("mqttsn/expire: Client %q timed out", c.id)
+				this.disconnect(c)
+			}
+		}
+	}
+}
+
+// topicName returns the topic name a PUBLISH, SUBSCRIBE or UNSUBSCRIBE is for,
+// depending on its topic ID type. c may be nil, in which case only predefined and
+// short topics are found.
+func (this *Gateway) topicName(c *client, p *packet) (string, bool) {
+	switch p.TopicIdType() {
+	case TopicIdPredefined:
+		topic, ok := this.Predefined[p.TopicId]
+		return topic, ok
+
+	case TopicIdShort:
+		return string(p.Topic), len(p.Topic) > 0
+
+	case TopicIdNormal:
+		// SUBSCRIBE and UNSUBSCRIBE have the topic name itself
+		if p.Type != PUBLISH {
+			return string(p.Topic), len(p.Topic) > 0
+		}
+
+		if c != nil {
+			return c.topic(p.TopicId)
+		}
+	}
+
+	return "", false
+}
+
+func (this *Gateway) publish(c *client, addr net.Addr, p *packet) {
+	qos := p.QoS()
+
+	topic, ok := this.topicName(c, p)
+	if !ok {
+		if qos != 3 {
+			this.send(addr, &packet{Type: PUBACK, TopicId: p.TopicId, MsgId: p.MsgId, Code: RejectedTopicId})
+		}
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		glog.Errorf("mqttsn/publish: Invalid topic %q from %s: %v", topic, addr, err)
+		if qos != 3 {
+			this.send(addr, &packet{Type: PUBACK, TopicId: p.TopicId, MsgId: p.MsgId, Code: RejectedTopicId})
+		}
+		return
+	}
+
+	msg.SetPayload(append([]byte(nil), p.Data...))
+	msg.SetRetain(p.Flags&flagRetain != 0)
+
+	switch qos {
+	case 0, 3:
+		this.publishAs(c, msg)
+
+	case 1:
+		msg.SetQoS(message.QosAtLeastOnce)
+		code := Accepted
+		if err := this.publishAs(c, msg); err != nil {
+			code = RejectedCongested
+		}
+		this.send(addr, &packet{Type: PUBACK, TopicId: p.TopicId, MsgId: p.MsgId, Code: code})
+
+	case 2:
+		// Hold on to it until it's released, so it's only published once no matter
+		// how many times the client sends it.
+		msg.SetQoS(message.QosExactlyOnce)
+		c.received(p.MsgId, msg)
+		this.send(addr, &packet{Type: PUBREC, MsgId: p.MsgId})
+	}
+}
+
+// publishAs publishes the message on behalf of the client, so it goes through
+// the server's pipeline and bridges like any other client's. QoS -1 messages
+// don't have a client, and are published as is.
+func (this *Gateway) publishAs(c *client, msg *message.PublishMessage) error {
+	var opts *service.PublishOptions
+	if c != nil {
+		opts = &service.PublishOptions{ClientId: c.id}
+	}
+
+	if _, err := this.Server.Publish(msg, opts); err != nil {
+		glog.Errorf("mqttsn/publish: Error publishing message to topic %q: %v", msg.Topic(), err)
+		return err
+	}
+
+	return nil
+}
+
+func (this *Gateway) subscribe(c *client, addr net.Addr, p *packet) {
+	topic, ok := this.topicName(c, p)
+	if !ok {
+		this.send(addr, &packet{Type: SUBACK, MsgId: p.MsgId, Code: RejectedTopicId})
+		return
+	}
+
+	// Topics with wildcards don't get an ID, the matching topics are registered
+	// as messages arrive instead.
+	var id uint16
+
+	switch p.TopicIdType() {
+	case TopicIdPredefined:
+		id = p.TopicId
+
+	case TopicIdNormal:
+		if !bytes.ContainsAny([]byte(topic), "+#") {
+			id = c.register(topic)
+		}
+	}
+
+	if err := c.subscribe(topic); err != nil {
+		glog.Errorf("mqttsn/subscribe: Error subscribing %q to %q: %v", c.id, topic, err)
+		this.send(addr, &packet{Type: SUBACK, MsgId: p.MsgId, Code: RejectedNotSupp})
+		return
+	}
+
+	// Everything is delivered at QoS 0
+	this.send(addr, &packet{Type: SUBACK, TopicId: id, MsgId: p.MsgId, Code: Accepted})
+
+	rmsgs, err := this.Server.Retained([]byte(topic))
+	if err != nil {
+		glog.Errorf("mqttsn/subscribe: Error retrieving retained messages for %q: %v", topic, err)
+	}
+
+	for _, msg := range rmsgs {
+		c.deliver(msg)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+type testClient struct {
+	t    *testing.T
+	pc   net.PacketConn
+	addr net.Addr
+}
+
+func newTestClient(t *testing.T, gw net.Addr) *testClient {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	return &testClient{t: t, pc: pc, addr: gw}
+}
+
+func (this *testClient) send(p *packet) {
+	_, err := this.pc.WriteTo(p.encode(), this.addr)
+	require.NoError(this.t, err)
+}
+
+func (this *testClient) recv() *packet {
+	buf := make([]byte, 65536)
+
+	this.pc.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := this.pc.ReadFrom(buf)
+	require.NoError(this.t, err)
+
+	p, err := decodePacket(buf[:n])
+	require.NoError(this.t, err)
+
+	return p
+}
+
+func (this *testClient) expect(mtype byte) *packet {
+	p := this.recv()
+	require.Equal(this.t, mtype, p.Type, "%s", p)
+	return p
+}
+
+func startGateway(t *testing.T) (*service.Server, *Gateway, net.Addr) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	svr := &service.Server{}
+	gw := &Gateway{
+		Server:     svr,
+		GatewayId:  7,
+		Predefined: map[uint16]string{10: "sensors/predefined"},
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go gw.Serve(pc)
+
+	return svr, gw, pc.LocalAddr()
+}
+
+func subscribeServer(t *testing.T, svr *service.Server, topic string) (chan *message.PublishMessage, *service.OnPublishFunc) {
+	ch := make(chan *message.PublishMessage, 10)
+
+	var onpub service.OnPublishFunc = func(msg *message.PublishMessage) error {
+		ch <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte(topic), message.QosExactlyOnce, &onpub)
+	require.NoError(t, err)
+
+	return ch, &onpub
+}
+
+func receive(t *testing.T, ch chan *message.PublishMessage) *message.PublishMessage {
+	select {
+	case msg := <-ch:
+		return msg
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message")
+	}
+
+	return nil
+}
+
+func publishServer(t *testing.T, svr *service.Server, topic, payload string, retain bool) {
+	msg := message.NewPublishMessage()
+	require.NoError(t, msg.SetTopic([]byte(topic)))
+	msg.SetPayload([]byte(payload))
+	msg.SetRetain(retain)
+
+	_, err := svr.Publish(msg, nil)
+	require.NoError(t, err)
+}
+
+func TestGatewaySearchAndConnect(t *testing.T) {
+	svr, gw, addr := startGateway(t)
+	defer svr.Close()
+	defer gw.Close()
+
+	c := newTestClient(t, addr)
+	defer c.pc.Close()
+
+	c.send(&packet{Type: SEARCHGW})
+	require.Equal(t, byte(7), c.expect(GWINFO).GwId)
+
+	// Not connected yet
+	c.send(&packet{Type: PINGREQ})
+	c.expect(DISCONNECT)
+
+	c.send(&packet{Type: CONNECT, Flags: flagWill | flagCleanSession, Duration: 30, Data: []byte("sn1")})
+	require.Equal(t, RejectedNotSupp, c.expect(CONNACK).Code)
+
+	c.send(&packet{Type: CONNECT, Flags: flagCleanSession, Duration: 30, Data: []byte("sn1")})
+	require.Equal(t, Accepted, c.expect(CONNACK).Code)
+
+	c.send(&packet{Type: PINGREQ})
+	c.expect(PINGRESP)
+
+	c.send(&packet{Type: DISCONNECT})
+	c.expect(DISCONNECT)
+
+	c.send(&packet{Type: PINGREQ})
+	c.expect(DISCONNECT)
+}
+
+func TestGatewayPublish(t *testing.T) {
+	svr, gw, addr := startGateway(t)
+	defer svr.Close()
+	defer gw.Close()
+
+	ch, onpub := subscribeServer(t, svr, "sensors/#")
+	defer svr.Unsubscribe([]byte("sensors/#"), onpub)
+
+	c := newTestClient(t, addr)
+	defer c.pc.Close()
+
+	c.send(&packet{Type: CONNECT, Flags: flagCleanSession, Data: []byte("sn1")})
+	c.expect(CONNACK)
+
+	c.send(&packet{Type: REGISTER, MsgId: 1, Topic: []byte("sensors/1/temp")})
+	regack := c.expect(REGACK)
+	require.Equal(t, Accepted, regack.Code)
+	require.Equal(t, uint16(1), regack.MsgId)
+	require.NotEqual(t, uint16(0), regack.TopicId)
+
+	// QoS 1
+	c.send(&packet{Type: PUBLISH, Flags: 0x20, TopicId: regack.TopicId, MsgId: 2, Data: []byte("21.5")})
+	puback := c.expect(PUBACK)
+	require.Equal(t, Accepted, puback.Code)
+	require.Equal(t, uint16(2), puback.MsgId)
+
+	msg := receive(t, ch)
+	require.Equal(t, "sensors/1/temp", string(msg.Topic()))
+	require.Equal(t, "21.5", string(msg.Payload()))
+
+	// QoS 2 is only published once it's released, however many times it's sent
+	c.send(&packet{Type: PUBLISH, Flags: 0x40, TopicId: regack.TopicId, MsgId: 3, Data: []byte("22")})
+	c.expect(PUBREC)
+	c.send(&packet{Type: PUBLISH, Flags: 0x40 | flagDup, TopicId: regack.TopicId, MsgId: 3, Data: []byte("22")})
+	c.expect(PUBREC)
+	c.send(&packet{Type: PUBREL, MsgId: 3})
+	c.expect(PUBCOMP)
+
+	msg = receive(t, ch)
+	require.Equal(t, "22", string(msg.Payload()))
+
+	// Unknown topic ID
+	c.send(&packet{Type: PUBLISH, Flags: 0x20, TopicId: 999, MsgId: 4, Data: []byte("x")})
+	require.Equal(t, RejectedTopicId, c.expect(PUBACK).Code)
+
+	select {
+	case msg := <-ch:
+		require.FailNow(t, "Unexpected message", "%s", msg)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestGatewayPublishQoSMinusOne(t *testing.T) {
+	svr, gw, addr := startGateway(t)
+	defer svr.Close()
+	defer gw.Close()
+
+	ch, onpub := subscribeServer(t, svr, "sensors/predefined")
+	defer svr.Unsubscribe([]byte("sensors/predefined"), onpub)
+
+	// Never connects
+	c := newTestClient(t, addr)
+	defer c.pc.Close()
+
+	c.send(&packet{Type: PUBLISH, Flags: 0x60 | TopicIdPredefined, TopicId: 10, Data: []byte("hello")})
+
+	msg := receive(t, ch)
+	require.Equal(t, "sensors/predefined", string(msg.Topic()))
+	require.Equal(t, "hello", string(msg.Payload()))
+}
+
+func TestGatewaySubscribe(t *testing.T) {
+	svr, gw, addr := startGateway(t)
+	defer svr.Close()
+	defer gw.Close()
+
+	publishServer(t, svr, "rt", "retained", true)
+
+	c := newTestClient(t, addr)
+	defer c.pc.Close()
+
+	c.send(&packet{Type: CONNECT, Flags: flagCleanSession, Data: []byte("sn1")})
+	c.expect(CONNACK)
+
+	// Wildcards don't get a topic ID
+	c.send(&packet{Type: SUBSCRIBE, MsgId: 1, Topic: []byte("sensors/+/temp")})
+	suback := c.expect(SUBACK)
+	require.Equal(t, Accepted, suback.Code)
+	require.Equal(t, uint16(0), suback.TopicId)
+
+	// So the topic is registered before the message is sent
+	publishServer(t, svr, "sensors/2/temp", "19", false)
+
+	register := c.expect(REGISTER)
+	require.Equal(t, "sensors/2/temp", string(register.Topic))
+
+	pub := c.expect(PUBLISH)
+	require.Equal(t, register.TopicId, pub.TopicId)
+	require.Equal(t, "19", string(pub.Data))
+
+	// And only the first time
+	publishServer(t, svr, "sensors/2/temp", "20", false)
+
+	pub = c.expect(PUBLISH)
+	require.Equal(t, register.TopicId, pub.TopicId)
+	require.Equal(t, "20", string(pub.Data))
+
+	// Two character topics use the short form, and retained messages come after
+	// the SUBACK
+	c.send(&packet{Type: SUBSCRIBE, MsgId: 2, Flags: TopicIdShort, Topic: []byte("rt")})
+	c.expect(SUBACK)
+
+	pub = c.expect(PUBLISH)
+	require.Equal(t, TopicIdShort, pub.TopicIdType())
+	require.Equal(t, "rt", string(pub.Topic))
+	require.Equal(t, "retained", string(pub.Data))
+	require.NotEqual(t, byte(0), pub.Flags&flagRetain)
+
+	c.send(&packet{Type: UNSUBSCRIBE, MsgId: 3, Topic: []byte("sensors/+/temp")})
+	require.Equal(t, uint16(3), c.expect(UNSUBACK).MsgId)
+
+	publishServer(t, svr, "sensors/2/temp", "21", false)
+
+	c.pc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := c.pc.ReadFrom(make([]byte, 100))
+	require.Error(t, err)
+}
@@ -0,0 +1,321 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The MQTT-SN 1.2 message types the gateway understands
+const (
+	ADVERTISE   byte = 0x00
+	SEARCHGW    byte = 0x01
+	GWINFO      byte = 0x02
+	CONNECT     byte = 0x04
+	CONNACK     byte = 0x05
+	REGISTER    byte = 0x0a
+	REGACK      byte = 0x0b
+	PUBLISH     byte = 0x0c
+	PUBACK      byte = 0x0d
+	PUBCOMP     byte = 0x0e
+	PUBREC      byte = 0x0f
+	PUBREL      byte = 0x10
+	SUBSCRIBE   byte = 0x12
+	SUBACK      byte = 0x13
+	UNSUBSCRIBE byte = 0x14
+	UNSUBACK    byte = 0x15
+	PINGREQ     byte = 0x16
+	PINGRESP    byte = 0x17
+	DISCONNECT  byte = 0x18
+)
+
+// The MQTT-SN return codes
+const (
+	Accepted          byte = 0x00
+	RejectedCongested byte = 0x01
+	RejectedTopicId   byte = 0x02
+	RejectedNotSupp   byte = 0x03
+)
+
+// The topic ID types in the flags
+const (
+	TopicIdNormal     byte = 0x0
+	TopicIdPredefined byte = 0x1
+	TopicIdShort      byte = 0x2
+)
+
+// The bits of the flags field
+const (
+	flagDup          byte = 0x80
+	flagQoS          byte = 0x60
+	flagRetain       byte = 0x10
+	flagWill         byte = 0x08
+	flagCleanSession byte = 0x04
+	flagTopicIdType  byte = 0x03
+)
+
+// packet is a decoded MQTT-SN message. Only the fields that make sense for the
+// message type are set. Topic holds the topic name of REGISTER, SUBSCRIBE and
+// UNSUBSCRIBE, and the two bytes of a short topic name. Data holds the client ID
+// of CONNECT and PINGREQ, and the payload of PUBLISH.
+type packet struct {
+	Type     byte
+	Flags    byte
+	TopicId  uint16
+	MsgId    uint16
+	Code     byte
+	Duration uint16
+	GwId     byte
+	Topic    []byte
+	Data     []byte
+}
+
+// QoS returns the QoS in the flags. QoS -1, i.e. publishing without connecting,
+// is returned as 3.
+func (this *packet) QoS() byte {
+	return (this.Flags & flagQoS) >> 5
+}
+
+func (this *packet) TopicIdType() byte {
+	return this.Flags & flagTopicIdType
+}
+
+func (this *packet) String() string {
+	return fmt.Sprintf("type=%#x flags=%#x topicid=%d msgid=%d code=%d topic=%q", this.Type, this.Flags, this.TopicId, this.MsgId, this.Code, this.Topic)
+}
+
+// decodePacket decodes a single MQTT-SN message from a datagram.
+func decodePacket(b []byte) (*packet, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("mqttsn/decodePacket: Message too short (%d bytes)", len(b))
+	}
+
+	// The length is 1 byte, or 0x01 followed by 2 bytes for longer messages. It
+	// includes itself.
+	l, hl := int(b[0]), 1
+	if b[0] == 0x01 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("mqttsn/decodePacket: Message too short (%d bytes)", len(b))
+		}
+		l, hl = int(binary.BigEndian.Uint16(b[1:])), 3
+	}
+
+	if l < hl+1 || l > len(b) {
+		return nil, fmt.Errorf("mqttsn/decodePacket: Invalid length %d for %d bytes", l, len(b))
+	}
+
+	p := &packet{Type: b[hl]}
+	body := b[hl+1 : l]
+
+	need := func(n int) error {
+		if len(body) < n {
+			return fmt.Errorf("mqttsn/decodePacket: Message type %#x too short (%d bytes)", p.Type, len(body))
+		}
+		return nil
+	}
+
+	switch p.Type {
+	case SEARCHGW:
+		// radius, ignored
+
+	case CONNECT:
+		// Flags, ProtocolId, Duration, ClientId
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		p.Flags = body[0]
+		p.Duration = binary.BigEndian.Uint16(body[2:])
+		p.Data = body[4:]
+
+	case REGISTER, REGACK:
+		// TopicId, MsgId, TopicName (REGISTER) or ReturnCode (REGACK)
+		if err := need(4); err != nil {
+			return nil, err
+		}
+		p.TopicId = binary.BigEndian.Uint16(body[0:])
+		p.MsgId = binary.BigEndian.Uint16(body[2:])
+		if p.Type == REGISTER {
+			p.Topic = body[4:]
+		} else if err := need(5); err != nil {
+			return nil, err
+		} else {
+			p.Code = body[4]
+		}
+
+	case PUBLISH:
+		// Flags, TopicId, MsgId, Data
+		if err := need(5); err != nil {
+			return nil, err
+		}
+		p.Flags = body[0]
+		p.TopicId = binary.BigEndian.Uint16(body[1:])
+		if p.TopicIdType() == TopicIdShort {
+			p.Topic = body[1:3]
+		}
+		p.MsgId = binary.BigEndian.Uint16(body[3:])
+		p.Data = body[5:]
+
+	case PUBACK:
+		// TopicId, MsgId, ReturnCode
+		if err := need(5); err != nil {
+			return nil, err
+		}
+		p.TopicId = binary.BigEndian.Uint16(body[0:])
+		p.MsgId = binary.BigEndian.Uint16(body[2:])
+		p.Code = body[4]
+
+	case PUBREC, PUBREL, PUBCOMP, UNSUBACK:
+		// MsgId
+		if err := need(2); err != nil {
+			return nil, err
+		}
+		p.MsgId = binary.BigEndian.Uint16(body[0:])
+
+	case SUBSCRIBE, UNSUBSCRIBE:
+		// Flags, MsgId, TopicName or TopicId
+		if err := need(3); err != nil {
+			return nil, err
+		}
+		p.Flags = body[0]
+		p.MsgId = binary.BigEndian.Uint16(body[1:])
+		if p.TopicIdType() == TopicIdPredefined {
+			if err := need(5); err != nil {
+				return nil, err
+			}
+			p.TopicId = binary.BigEndian.Uint16(body[3:])
+		} else {
+			p.Topic = body[3:]
+		}
+
+	case SUBACK:
+		// Flags, TopicId, MsgId, ReturnCode
+		if err := need(6); err != nil {
+			return nil, err
+		}
+		p.Flags = body[0]
+		p.TopicId = binary.BigEndian.Uint16(body[1:])
+		p.MsgId = binary.BigEndian.Uint16(body[3:])
+		p.Code = body[5]
+
+	case CONNACK:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		p.Code = body[0]
+
+	case GWINFO, ADVERTISE:
+		if err := need(1); err != nil {
+			return nil, err
+		}
+		p.GwId = body[0]
+
+	case PINGREQ:
+		// Optional ClientId
+		p.Data = body
+
+	case DISCONNECT:
+		// Optional Duration
+		if len(body) >= 2 {
+			p.Duration = binary.BigEndian.Uint16(body)
+		}
+
+	case PINGRESP:
+
+	default:
+		return nil, fmt.Errorf("mqttsn/decodePacket: Unsupported message type %#x", p.Type)
+	}
+
+	return p, nil
+}
+
+// encode returns the packet as a datagram.
+func (this *packet) encode() []byte {
+	var body []byte
+
+	u16 := func(v uint16) {
+		body = append(body, byte(v>>8), byte(v))
+	}
+
+	switch this.Type {
+	case CONNECT:
+		body = append(body, this.Flags, 0x01)
+		u16(this.Duration)
+		body = append(body, this.Data...)
+
+	case REGISTER:
+		u16(this.TopicId)
+		u16(this.MsgId)
+		body = append(body, this.Topic...)
+
+	case REGACK, PUBACK:
+		u16(this.TopicId)
+		u16(this.MsgId)
+		body = append(body, this.Code)
+
+	case PUBLISH:
+		body = append(body, this.Flags)
+		if this.TopicIdType() == TopicIdShort {
+			body = append(body, this.Topic[0], this.Topic[1])
+		} else {
+			u16(this.TopicId)
+		}
+		u16(this.MsgId)
+		body = append(body, this.Data...)
+
+	case PUBREC, PUBREL, PUBCOMP, UNSUBACK:
+		u16(this.MsgId)
+
+	case SUBSCRIBE, UNSUBSCRIBE:
+		body = append(body, this.Flags)
+		u16(this.MsgId)
+		if this.TopicIdType() == TopicIdPredefined {
+			u16(this.TopicId)
+		} else {
+			body = append(body, this.Topic...)
+		}
+
+	case SUBACK:
+		body = append(body, this.Flags)
+		u16(this.TopicId)
+		u16(this.MsgId)
+		body = append(body, this.Code)
+
+	case CONNACK:
+		body = append(body, this.Code)
+
+	case GWINFO, ADVERTISE:
+		body = append(body, this.GwId)
+		if this.Type == ADVERTISE {
+			u16(this.Duration)
+		}
+
+	case PINGREQ:
+		body = append(body, this.Data...)
+
+	case DISCONNECT:
+		if this.Duration != 0 {
+			u16(this.Duration)
+		}
+	}
+
+	l := len(body) + 2
+	if l <= 255 {
+		return append([]byte{byte(l), this.Type}, body...)
+	}
+
+	l += 2
+	return append([]byte{0x01, byte(l >> 8), byte(l), this.Type}, body...)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqttsn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	packets := []*packet{
+		{Type: CONNECT, Flags: flagCleanSession, Duration: 30, Data: []byte("sensor1")},
+		{Type: REGISTER, TopicId: 1, MsgId: 2, Topic: []byte("sensors/1/temp")},
+		{Type: REGACK, TopicId: 1, MsgId: 2, Code: Accepted},
+		{Type: PUBLISH, Flags: 0x20, TopicId: 1, MsgId: 3, Data: []byte("21.5")},
+		{Type: PUBLISH, Flags: TopicIdShort, TopicId: 0x7468, Topic: []byte("th"), Data: []byte("on")},
+		{Type: PUBACK, TopicId: 1, MsgId: 3, Code: RejectedTopicId},
+		{Type: PUBREL, MsgId: 4},
+		{Type: SUBSCRIBE, MsgId: 5, Topic: []byte("sensors/#")},
+		{Type: SUBSCRIBE, Flags: TopicIdPredefined, MsgId: 6, TopicId: 10},
+		{Type: SUBACK, TopicId: 7, MsgId: 5, Code: Accepted},
+		{Type: CONNACK, Code: RejectedNotSupp},
+		{Type: GWINFO, GwId: 3},
+		{Type: PINGREQ, Data: []byte("sensor1")},
+		{Type: DISCONNECT, Duration: 60},
+	}
+
+	for _, p := range packets {
+		d, err := decodePacket(p.encode())
+		require.NoError(t, err, "%s", p)
+
+		// Empty and nil byte slices are the same on the wire
+		if len(p.Topic) == 0 {
+			p.Topic = d.Topic
+		}
+		if len(p.Data) == 0 {
+			p.Data = d.Data
+		}
+
+		require.Equal(t, p, d)
+	}
+}
+
+func TestPacketLongLength(t *testing.T) {
+	p := &packet{Type: PUBLISH, TopicId: 1, Data: bytes.Repeat([]byte("x"), 300)}
+
+	b := p.encode()
+	require.Equal(t, byte(0x01), b[0])
+	require.Equal(t, 309, int(b[1])<<8|int(b[2]))
+
+	d, err := decodePacket(b)
+	require.NoError(t, err)
+	require.Equal(t, p.Data, d.Data)
+}
+
+func TestPacketQoSMinusOne(t *testing.T) {
+	p := &packet{Type: PUBLISH, Flags: 0x60 | TopicIdPredefined}
+	require.Equal(t, byte(3), p.QoS())
+	require.Equal(t, TopicIdPredefined, p.TopicIdType())
+}
+
+func TestDecodePacketErrors(t *testing.T) {
+	_, err := decodePacket([]byte{0x01})
+	require.Error(t, err)
+
+	// Length larger than the datagram
+	_, err = decodePacket([]byte{0x10, PINGREQ})
+	require.Error(t, err)
+
+	// PUBLISH without the topic ID and message ID
+	_, err = decodePacket([]byte{0x04, PUBLISH, 0x00, 0x01})
+	require.Error(t, err)
+
+	_, err = decodePacket([]byte{0x02, 0xfe})
+	require.Error(t, err)
+}
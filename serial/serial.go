@@ -0,0 +1,431 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package serial carries MQTT over a serial line, e.g., a UART between a gateway
+// and a microcontroller that has no TCP/IP stack. Each MQTT packet is sent as a
+// SLIP frame (RFC 1055) with a CRC-16 after it, so the two ends can find where
+// packets start again after line noise, and a corrupted packet is dropped rather
+// than passed on.
+//
+// The package doesn't open or configure serial ports itself, the port can come
+// from any serial library, as long as it reads and writes the raw line:
+//
+//	// port is the io.ReadWriteCloser from the serial library
+//	conn := serial.NewConn(port, "/dev/ttyUSB0")
+//
+//	c := &service.Client{}
+//	err := c.ConnectConn(conn, msg)
+//
+// A dropped packet is lost, the same as on any lossy link, so use QoS 1 or 2 for
+// messages that need to get there.
+package serial
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surge/glog"
+	"github.com/surgemq/surgemq/codec"
+)
+
+// SLIP special characters
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+const (
+	// The largest MQTT packet, fixed header included, plus the CRC
+	maxFrameSize = 268435455 + 5 + 2
+
+	// How much is read from the port at a time
+	readSize = 512
+)
+
+var (
+	// ErrBadCRC is recorded when a frame's CRC doesn't match its contents.
+	ErrBadCRC = errors.New("serial: Frame CRC mismatch")
+
+	// ErrFrameTooLarge is recorded when a frame is larger than any MQTT packet.
+	ErrFrameTooLarge = errors.New("serial: Frame exceeds the maximum packet size")
+)
+
+// Addr is the address of a serial line, i.e. the name it was given.
+type Addr string
+
+func (this Addr) Network() string {
+	return "serial"
+}
+
+func (this Addr) String() string {
+	return string(this)
+}
+
+// Conn is an MQTT connection over a serial line. It's a net.Conn, so it can be
+// used by the service package like any other connection. Writes must be whole
+// MQTT packets or parts of them in order, as they are framed one packet at a
+// time.
+type Conn struct {
+	port io.ReadWriteCloser
+	addr Addr
+
+	// Packets received, and the frames dropped because they were corrupted
+	frames  chan []byte
+	dropped int64
+
+	// The rest of the packet being read
+	rbuf []byte
+
+	rmu      sync.Mutex
+	deadline time.Time
+
+	// The bytes written that don't make up a whole packet yet
+	wmu  sync.Mutex
+	wbuf []byte
+
+	// Closed when the port can't be read anymore, rerr says why
+	eof  chan struct{}
+	rerr error
+
+	done chan struct{}
+	once sync.Once
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// NewConn returns a connection over the serial port. name is only used as the
+// address of both ends.
+func NewConn(port io.ReadWriteCloser, name string) *Conn {
+	this := &Conn{
+		port:   port,
+		addr:   Addr(name),
+		frames: make(chan []byte, 16),
+		eof:    make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go this.receive()
+
+	return this
+}
+
+// Dropped returns the number of frames that were dropped because they were
+// corrupted on the line.
+func (this *Conn) Dropped() int64 {
+	return atomic.LoadInt64(&this.dropped)
+}
+
+// receive reads frames from the port until it fails or the connection is closed.
+func (this *Conn) receive() {
+	defer close(this.eof)
+
+	var (
+		buf   = make([]byte, readSize)
+		frame []byte
+		esc   bool
+
+		// Line noise before the first END, or after a frame that was too large, is
+		// ignored until the next END
+		skip = true
+	)
+
+	for {
+		n, err := this.port.Read(buf)
+
+		for _, c := range buf[:n] {
+			switch {
+			case c == slipEnd:
+				if len(frame) > 0 && !skip {
+					this.frame(frame)
+				}
+
+				frame, esc, skip = nil, false, false
+				continue
+
+			case skip:
+				continue
+
+			case esc:
+				switch c {
+				case slipEscEnd:
+					c = slipEnd
+
+				case slipEscEsc:
+					c = slipEsc
+				}
+				esc = false
+
+			case c == slipEsc:
+				esc = true
+				continue
+			}
+
+			if len(frame) == maxFrameSize {
+				this.drop(ErrFrameTooLarge)
+				frame, skip = nil, true
+				continue
+			}
+
+			frame = append(frame, c)
+		}
+
+		if err != nil {
+			this.rerr = err
+			return
+		}
+	}
+}
+
+// frame checks the CRC of a received frame and passes the packet on.
+func (this *Conn) frame(frame []byte) {
+	if len(frame) < 2 {
+		this.drop(ErrBadCRC)
+		return
+	}
+
+	p, sum := frame[:len(frame)-2], frame[len(frame)-2:]
+	if crc16(p) != binary.BigEndian.Uint16(sum) {
+		this.drop(ErrBadCRC)
+		return
+	}
+
+	select {
+	case this.frames <- p:
+
+	case <-this.done:
+	}
+}
+
+func (this *Conn) drop(err error) {
+	atomic.AddInt64(&this.dropped, 1)
+	glog.Errorf("serial/Conn: Dropping frame from %s: %v", this.addr, err)
+}
+
+// Read reads the packets received as a stream of bytes, the same as a TCP
+// connection would.
+func (this *Conn) Read(b []byte) (int, error) {
+	if len(this.rbuf) == 0 {
+		p, err := this.next()
+		if err != nil {
+			return 0, err
+		}
+
+		this.rbuf = p
+	}
+
+	n := copy(b, this.rbuf)
+	this.rbuf = this.rbuf[n:]
+
+	return n, nil
+}
+
+// next waits for the next packet, until the read deadline if there's one.
+func (this *Conn) next() ([]byte, error) {
+	this.rmu.Lock()
+	deadline := this.deadline
+	this.rmu.Unlock()
+
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, os.ErrDeadlineExceeded
+		}
+
+		t := time.NewTimer(d)
+		defer t.Stop()
+
+		timeout = t.C
+	}
+
+	select {
+	case p := <-this.frames:
+		return p, nil
+
+	case <-this.done:
+		return nil, net.ErrClosed
+
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+
+	case <-this.eof:
+		// Anything received before the port failed is still read first
+		select {
+		case p := <-this.frames:
+			return p, nil
+
+		default:
+		}
+
+		if this.rerr == nil {
+			return nil, io.EOF
+		}
+		return nil, this.rerr
+	}
+}
+
+// Write frames each complete MQTT packet in b, along with any part of a packet
+// left over from previous writes, and sends it. What's left of an incomplete
+// packet at the end of b is kept until the rest of it is written.
+func (this *Conn) Write(b []byte) (int, error) {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	select {
+	case <-this.done:
+		return 0, net.ErrClosed
+
+	default:
+	}
+
+	this.wbuf = append(this.wbuf, b...)
+
+	for {
+		n, err := packetLen(this.wbuf)
+		if err != nil {
+			this.wbuf = this.wbuf[:0]
+			return 0, err
+		}
+
+		if n == 0 || len(this.wbuf) < n {
+			break
+		}
+
+		if _, err := this.port.Write(encodeFrame(this.wbuf[:n])); err != nil {
+			return 0, err
+		}
+
+		this.wbuf = this.wbuf[n:]
+	}
+
+	// Don't hold on to a large backing array once it's all been sent
+	if len(this.wbuf) == 0 {
+		this.wbuf = nil
+	}
+
+	return len(b), nil
+}
+
+// Close closes the serial port.
+func (this *Conn) Close() error {
+	var err error
+
+	this.once.Do(func() {
+		close(this.done)
+		err = this.port.Close()
+	})
+
+	return err
+}
+
+func (this *Conn) LocalAddr() net.Addr {
+	return this.addr
+}
+
+func (this *Conn) RemoteAddr() net.Addr {
+	return this.addr
+}
+
+func (this *Conn) SetDeadline(t time.Time) error {
+	return this.SetReadDeadline(t)
+}
+
+func (this *Conn) SetReadDeadline(t time.Time) error {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	this.deadline = t
+
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes to a serial port don't wait for the
+// other end, only for the bits to go out.
+func (this *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// packetLen returns the size of the MQTT packet at the start of b, fixed header
+// included, or 0 if b doesn't have the whole fixed header yet.
+func packetLen(b []byte) (int, error) {
+	for i := 1; i < len(b) && i < 5; i++ {
+		if b[i] < 0x80 {
+			remlen, m := binary.Uvarint(b[1 : i+1])
+			return int(remlen) + 1 + m, nil
+		}
+	}
+
+	if len(b) >= 5 {
+		return 0, codec.ErrMalformedLength
+	}
+
+	return 0, nil
+}
+
+// encodeFrame returns the SLIP frame for the packet, with the CRC after it. The
+// frame starts with an END as well, which flushes out any line noise received
+// since the last frame.
+func encodeFrame(p []byte) []byte {
+	var sum [2]byte
+	binary.BigEndian.PutUint16(sum[:], crc16(p))
+
+	frame := make([]byte, 0, len(p)+len(p)/16+6)
+	frame = append(frame, slipEnd)
+
+	for _, b := range [][]byte{p, sum[:]} {
+		for _, c := range b {
+			switch c {
+			case slipEnd:
+				frame = append(frame, slipEsc, slipEscEnd)
+
+			case slipEsc:
+				frame = append(frame, slipEsc, slipEscEsc)
+
+			default:
+				frame = append(frame, c)
+			}
+		}
+	}
+
+	return append(frame, slipEnd)
+}
+
+// crc16 is CRC-16/CCITT-FALSE, i.e. polynomial 0x1021 starting from 0xFFFF,
+// which is what most microcontroller CRC peripherals and libraries compute.
+func crc16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package serial
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+)
+
+func newPublishPacket(t *testing.T, pktid uint16, payload []byte) []byte {
+	msg := message.NewPublishMessage()
+	msg.SetPacketId(pktid)
+	msg.SetTopic([]byte("serial/test"))
+	msg.SetQoS(1)
+	msg.SetPayload(payload)
+
+	b := make([]byte, msg.Len())
+	_, err := msg.Encode(b)
+	require.NoError(t, err)
+
+	return b
+}
+
+// readFrames reads n raw frames written to the other end of a pipe
+func readFrames(t *testing.T, r io.Reader, n int) [][]byte {
+	var (
+		frames [][]byte
+		frame  []byte
+		buf    = make([]byte, 1)
+	)
+
+	for len(frames) < n {
+		_, err := r.Read(buf)
+		require.NoError(t, err)
+
+		frame = append(frame, buf[0])
+		if buf[0] == slipEnd && len(frame) > 1 {
+			frames = append(frames, frame)
+			frame = nil
+		}
+	}
+
+	return frames
+}
+
+func TestCRC16(t *testing.T) {
+	// The check value of CRC-16/CCITT-FALSE
+	require.Equal(t, uint16(0x29B1), crc16([]byte("123456789")))
+}
+
+func TestConnRoundTrip(t *testing.T) {
+	a, b := net.Pipe()
+
+	ca := NewConn(a, "a")
+	cb := NewConn(b, "b")
+	defer ca.Close()
+	defer cb.Close()
+
+	// The payload has both special characters, so they need escaping
+	p := newPublishPacket(t, 1, []byte{1, slipEnd, 2, slipEsc, 3, slipEscEnd})
+
+	go func() {
+		// Split the packet across two writes, it's still sent as one frame
+		ca.Write(p[:5])
+		ca.Write(p[5:])
+	}()
+
+	buf := make([]byte, len(p))
+	_, err := io.ReadFull(cb, buf)
+	require.NoError(t, err)
+	require.Equal(t, p, buf)
+	require.Equal(t, int64(0), cb.Dropped())
+}
+
+func TestConnWritePackets(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	ca := NewConn(a, "a")
+	defer ca.Close()
+
+	p1 := newPublishPacket(t, 1, []byte("one"))
+	p2 := newPublishPacket(t, 2, []byte("two"))
+
+	go ca.Write(append(append([]byte{}, p1...), p2...))
+
+	frames := readFrames(t, b, 2)
+	require.Equal(t, encodeFrame(p1), frames[0])
+	require.Equal(t, encodeFrame(p2), frames[1])
+}
+
+func TestConnDropsCorrupted(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	cb := NewConn(b, "b")
+	defer cb.Close()
+
+	p1 := newPublishPacket(t, 1, []byte("corrupted"))
+	p2 := newPublishPacket(t, 2, []byte("fine"))
+
+	bad := encodeFrame(p1)
+	bad[len(bad)/2] ^= 0x01
+
+	go func() {
+		// Line noise before the first frame is ignored as well
+		a.Write([]byte{0x55, 0xAA})
+		a.Write(bad)
+		a.Write(encodeFrame(p2))
+	}()
+
+	buf := make([]byte, len(p2))
+	_, err := io.ReadFull(cb, buf)
+	require.NoError(t, err)
+	require.Equal(t, p2, buf)
+	require.Equal(t, int64(1), cb.Dropped())
+}
+
+func TestConnReadDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+
+	cb := NewConn(b, "b")
+	defer cb.Close()
+
+	cb.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+
+	_, err := cb.Read(make([]byte, 10))
+	require.Equal(t, os.ErrDeadlineExceeded, err)
+
+	ne, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, ne.Timeout())
+}
+
+func TestConnEOF(t *testing.T) {
+	a, b := net.Pipe()
+
+	cb := NewConn(b, "b")
+	defer cb.Close()
+
+	a.Close()
+
+	_, err := cb.Read(make([]byte, 10))
+	require.Equal(t, io.EOF, err)
+}
+
+// pipeListener hands out a single connection, and then waits to be closed.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (this *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (this *pipeListener) Close() error {
+	this.once.Do(func() {
+		close(this.done)
+	})
+
+	return nil
+}
+
+func (this *pipeListener) Addr() net.Addr {
+	return Addr("server")
+}
+
+func TestClientConnectConn(t *testing.T) {
+	a, b := net.Pipe()
+
+	ln := &pipeListener{
+		conns: make(chan net.Conn, 1),
+		done:  make(chan struct{}),
+	}
+	ln.conns <- NewConn(b, "uart")
+
+	svr := &service.Server{}
+	defer svr.Close()
+
+	go svr.Serve(ln)
+
+	msg := message.NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetCleanSession(true)
+	msg.SetClientId([]byte("serialclient"))
+	msg.SetKeepAlive(10)
+
+	c := &service.Client{}
+	require.NoError(t, c.ConnectConn(NewConn(a, "uart"), msg))
+	defer c.Disconnect()
+
+	done := make(chan struct{})
+
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("serial/test"))
+	pub.SetQoS(1)
+	pub.SetPayload([]byte("over the wire"))
+
+	require.NoError(t, c.Publish(pub, func(msg, ack message.Message, err error) error {
+		close(done)
+		return err
+	}))
+
+	select {
+	case <-done:
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("PUBACK not received")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// limitedListener is a listener that accepts connections no faster than the
+// AcceptRate of the server, and closes those accepted while MaxHandshakes
+// connections are already in their handshakes, before a goroutine is started
+// for them. The connections waiting to be accepted are left in the backlog of
+// the system, which deals with SYN floods with its own defences, such as SYN
+// cookies.
+type limitedListener struct {
+	net.Listener
+
+	server *Server
+	quit   chan struct{}
+
+	// The time the next connection is due under the AcceptRate, as in the
+	// generic cell rate algorithm. Only the accept loop uses it.
+	tat time.Time
+}
+
+// limited returns ln, limited by the AcceptRate and MaxHandshakes of the server
+// until quit is closed, or ln itself if neither is set.
+func (this *Server) limited(ln net.Listener, quit chan struct{}) net.Listener {
+	if this.AcceptRate <= 0 && this.MaxHandshakes <= 0 {
+		return ln
+	}
+
+	return &limitedListener{Listener: ln, server: this, quit: quit}
+}
+
+func (this *limitedListener) Accept() (net.Conn, error) {
+	for {
+		this.pace()
+
+		conn, err := this.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		// Checked again, exactly, once the connection starts its handshake
+		if max := this.server.MaxHandshakes; max > 0 && atomic.LoadInt64(&this.server.handshaking) >= int64(max) {
+			atomic.AddInt64(&this.server.handshakesRejected, 1)
+			conn.Close()
+			continue
+		}
+
+		return conn, nil
+	}
+}
+
+// pace waits until the next connection can be accepted under the AcceptRate,
+// allowing AcceptBurst of them at once, or until quit is closed.
+func (this *limitedListener) pace() {
+	rate := this.server.AcceptRate
+	if rate <= 0 {
+		return
+	}
+
+	interval := time.Duration(float64(time.Second) / rate)
+	burst := this.server.acceptBurst()
+
+	now := time.Now()
+	if this.tat.Before(now) {
+		this.tat = now
+	}
+
+	if wait := this.tat.Sub(now) - time.Duration(burst-1)*interval; wait > 0 {
+		atomic.AddInt64(&this.server.acceptsPaced, 1)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-this.quit:
+			t.Stop()
+		}
+	}
+
+	this.tat = this.tat.Add(interval)
+}
+
+// acceptBurst returns the AcceptBurst, or its default.
+func (this *Server) acceptBurst() int {
+	if this.AcceptBurst > 0 {
+		return this.AcceptBurst
+	}
+
+	return int(math.Max(1, math.Ceil(this.AcceptRate)))
+}
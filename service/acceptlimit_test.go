@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerMaxHandshakes(t *testing.T) {
+	svr := &Server{MaxHandshakes: 1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	// A connection that hasn't sent its CONNECT yet
+	slow, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer slow.Close()
+
+	require.True(t, waitFor(func() bool {
+		return svr.Stats().Handshaking == 1
+	}))
+
+	// The next one is closed without a CONNACK
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, int64(1), svr.Stats().HandshakesRejected)
+
+	// Once through, the slow one no longer counts
+	require.NoError(t, writeMessage(slow, newConnectMessage()))
+	resp, err := getConnackMessage(slow)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, resp.ReturnCode())
+
+	require.True(t, waitFor(func() bool {
+		return svr.Stats().Handshaking == 0
+	}))
+}
+
+func TestLimitedListenerPace(t *testing.T) {
+	svr := &Server{AcceptRate: 100, AcceptBurst: 2}
+	l := &limitedListener{server: svr, quit: make(chan struct{})}
+
+	// Two at once, then one every 10ms
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		l.pace()
+	}
+
+	require.True(t, time.Since(start) >= 15*time.Millisecond)
+	require.Equal(t, int64(2), svr.Stats().AcceptsPaced)
+
+	// Closing quit stops the wait
+	svr = &Server{AcceptRate: 0.1}
+	l = &limitedListener{server: svr, quit: make(chan struct{})}
+	l.pace()
+	close(l.quit)
+
+	start = time.Now()
+	l.pace()
+	require.True(t, time.Since(start) < time.Second)
+
+	require.Equal(t, 1, svr.acceptBurst())
+	require.Equal(t, 3, (&Server{AcceptRate: 2.5}).acceptBurst())
+}
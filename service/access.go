@@ -0,0 +1,139 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/surgemq/surgemq/auth"
+)
+
+var ErrAnonymousNotAllowed error = errors.New("service: Anonymous clients are not allowed")
+
+// AnonymousPolicy is what's done with the clients that connect without a
+// username.
+type AnonymousPolicy int
+
+const (
+	// AnonymousAuthenticate hands them to the authenticator, the same as any
+	// other client, which is what decides.
+	AnonymousAuthenticate AnonymousPolicy = iota
+
+	// AnonymousAllow lets them in without asking the authenticator, e.g. for a
+	// broker that only authenticates the clients that do send credentials.
+	AnonymousAllow
+
+	// AnonymousDeny refuses them with a CONNACK of ErrNotAuthorized, before
+	// they get to the authenticator.
+	AnonymousDeny
+)
+
+// ACLPolicy is what's done with the messages clients publish that none of the
+// PhaseAuth stages of the pipeline, which are the ACLs, let through.
+type ACLPolicy int
+
+const (
+	// ACLAllow delivers them, so the ACLs only have to drop what's not allowed.
+	ACLAllow ACLPolicy = iota
+
+	// ACLDeny drops them, so a message is only delivered if one of the ACLs
+	// matched it and let it through. They are still acknowledged, since MQTT
+	// 3.1.1 has no way of refusing a message.
+	ACLDeny
+)
+
+// checkAnonymous returns ErrAnonymousNotAllowed if the client connecting with
+// username is anonymous and those aren't allowed. Otherwise it returns whether
+// the client is let in without being authenticated.
+func (this *Server) checkAnonymous(username []byte) (bool, error) {
+	if len(username) > 0 {
+		return false, nil
+	}
+
+	switch this.Anonymous {
+	case AnonymousAllow:
+		return true, nil
+
+	case AnonymousDeny:
+		return false, ErrAnonymousNotAllowed
+	}
+
+	return false, nil
+}
+
+// newAuthManagers creates the authentication manager of the server, and those
+// of the listeners in ListenerAuthenticators.
+func (this *Server) newAuthManagers() (err error) {
+	if this.authMgr, err = auth.NewManager(this.Authenticator); err != nil {
+		return err
+	}
+
+	mgrs := make(map[string]*auth.Manager, len(this.ListenerAuthenticators))
+
+	for addr, name := range this.ListenerAuthenticators {
+		if mgrs[addr], err = auth.NewManager(name); err != nil {
+			return err
+		}
+	}
+
+	this.authMgrs = mgrs
+
+	return nil
+}
+
+// authManager returns the authentication manager for the clients connected
+// through l, or, for the listener of Serve, through the listener of conn. Those
+// are found by the local address of conn, or by its port alone for the
+// listeners on all the interfaces.
+func (this *Server) authManager(conn net.Conn, l *listener) *auth.Manager {
+	if l != nil {
+		if l.authMgr != nil {
+			return l.authMgr
+		}
+		return this.authMgr
+	}
+
+	if len(this.authMgrs) == 0 {
+		return this.authMgr
+	}
+
+	addr := conn.LocalAddr()
+	if addr == nil {
+		return this.authMgr
+	}
+
+	if m, ok := this.authMgrs[addr.String()]; ok {
+		return m
+	}
+
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		if m, ok := this.authMgrs[":"+strconv.Itoa(ta.Port)]; ok {
+			return m
+		}
+	}
+
+	return this.authMgr
+}
+
+// defaultACL is the DefaultACL of the server of the service, if it has one.
+func (this *service) defaultACL() ACLPolicy {
+	if this.server == nil {
+		return ACLAllow
+	}
+
+	return this.server.DefaultACL
+}
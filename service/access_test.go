@@ -0,0 +1,117 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func connectAnonymous(ln net.Listener) (*Client, error) {
+	msg := newConnectMessage()
+	msg.SetUsername(nil)
+	msg.SetPassword(nil)
+
+	c := &Client{}
+	err := c.Connect("tcp://"+ln.Addr().String(), msg)
+	if err == nil {
+		topics.Unregister(c.svc.sess.ID())
+	}
+
+	return c, err
+}
+
+func TestServerAnonymousDeny(t *testing.T) {
+	svr := &Server{Anonymous: AnonymousDeny}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	_, err := connectAnonymous(ln)
+	require.Equal(t, message.ErrNotAuthorized, err)
+
+	// Clients with a username are still authenticated
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	c.Disconnect()
+}
+
+func TestServerAnonymousAllow(t *testing.T) {
+	svr := &Server{
+		Authenticator: "mockFailure",
+		Anonymous:     AnonymousAllow,
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c, err := connectAnonymous(ln)
+	require.NoError(t, err)
+	c.Disconnect()
+
+	_, err = connectTestClient(t, ln)
+	require.Equal(t, message.ErrBadUsernameOrPassword, err)
+}
+
+func TestServerListenerAuthenticators(t *testing.T) {
+	svr := &Server{Authenticator: "mockFailure"}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	other := serveTestServer(t, svr)
+	defer other.Close()
+
+	svr.ListenerAuthenticators = map[string]string{
+		ln.Addr().String(): "mockSuccess",
+	}
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	c.Disconnect()
+
+	_, err = connectTestClient(t, other)
+	require.Equal(t, message.ErrBadUsernameOrPassword, err)
+}
+
+func TestPipelineDefaultACL(t *testing.T) {
+	p := &Pipeline{}
+
+	require.NoError(t, p.Add(appendStage("enrich", PhaseEnrichment)))
+
+	acl := appendStage("acl", PhaseAuth)
+	acl.Filter = "public/#"
+	require.NoError(t, p.Add(acl))
+
+	// Only the messages the ACL matched get through
+	require.Equal(t, "acl enrich ", string(p.process(logging.Nop(), "c1", newTestPublish("public/a"), false, ACLDeny, nil).Payload()))
+	require.Nil(t, p.process(logging.Nop(), "c1", newTestPublish("private/a"), false, ACLDeny, nil))
+	require.Equal(t, "acl enrich ", string(p.process(logging.Nop(), "c1", newTestPublish("public/a"), false, ACLAllow, nil).Payload()))
+	require.Equal(t, "enrich ", string(p.process(logging.Nop(), "c1", newTestPublish("private/a"), false, ACLAllow, nil).Payload()))
+
+	// Nothing is checked for the messages that bypass the ACLs
+	require.Equal(t, "enrich ", string(p.process(logging.Nop(), "c1", newTestPublish("private/a"), true, ACLDeny, nil).Payload()))
+
+	// The enrichment stage never saw the denied message
+	require.Equal(t, int64(4), p.Stats()[1].Processed)
+
+	var nilp *Pipeline
+	require.Nil(t, nilp.process(logging.Nop(), "c1", newTestPublish("a/b"), false, ACLDeny, nil))
+}
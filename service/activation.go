@@ -0,0 +1,176 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd, right after
+// stdin, stdout and stderr.
+const listenFdsStart = 3
+
+// handoffEnv is the environment variable with the file descriptor of the socket
+// the connections are handed over on by UpgradeWithHandoff.
+const handoffEnv = "SURGEMQ_HANDOFF_FD"
+
+var (
+	ErrNotListening        error = errors.New("service: Server is not listening")
+	ErrUpgradeNotSupported error = errors.New("service: Listener can't be handed over")
+)
+
+// filer is implemented by the listeners whose socket can be handed over to
+// another process, i.e. *net.TCPListener and *net.UnixListener.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Listeners returns the listeners passed to the process, either by systemd
+// socket activation or by the Upgrade of a previous server. Each of them can
+// be handed to Serve, wrapped in TLS first if need be. It returns no listeners
+// if none were passed, so the server can fall back to ListenAndServe. The
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES environment variables are unset, so
+// they aren't passed on to any child process.
+func Listeners() ([]net.Listener, error) {
+	n, err := listenFds()
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if err != nil || n == 0 {
+		return nil, err
+	}
+
+	lns := make([]net.Listener, 0, n)
+
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+
+		// FileListener works on a copy of the descriptor, which unlike the one
+		// passed in isn't inherited by child processes
+		ln, err := net.FileListener(f)
+		f.Close()
+
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("service/Listeners: Invalid listener on fd %d: %v", fd, err)
+		}
+
+		lns = append(lns, ln)
+	}
+
+	return lns, nil
+}
+
+// listenFds returns the number of listeners passed to the process. systemd sets
+// LISTEN_PID to the process the listeners are meant for, so the ones meant for a
+// parent process are ignored. Upgrade can't know the PID of the new process in
+// advance, so it doesn't set it.
+func listenFds() (int, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("service/Listeners: Invalid LISTEN_FDS %q", fds)
+	}
+
+	return n, nil
+}
+
+// Upgrade starts a new process, normally a newer version of the same binary, and
+// hands the server's listener over to it. The new process gets it from
+// Listeners. The listening socket stays open throughout, so connections waiting
+// to be accepted are accepted by the new process instead. Once the new process
+// has started, the server stops accepting connections and Serve returns, while
+// the connected clients stay connected until the server is closed.
+//
+// Only TCP and unix domain socket listeners can be handed over. For TLS, the
+// listener is handed over as it was before being wrapped in TLS.
+func (this *Server) Upgrade(name string, args ...string) (*os.Process, error) {
+	return this.upgrade(name, args, nil)
+}
+
+// upgrade starts the new process with the listener, and the handoff socket if
+// there's one.
+func (this *Server) upgrade(name string, args []string, handoff *os.File) (*os.Process, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.quit == nil || this.sock == nil {
+		return nil, ErrNotListening
+	}
+
+	select {
+	case <-this.quit:
+		return nil, ErrNotListening
+	default:
+	}
+
+	fl, ok := this.sock.(filer)
+	if !ok {
+		return nil, ErrUpgradeNotSupported
+	}
+
+	f, err := fl.File()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{f}
+
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_") && !strings.HasPrefix(kv, handoffEnv+"=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, "LISTEN_FDS=1")
+
+	if handoff != nil {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, handoff)
+		cmd.Env = append(cmd.Env, handoffEnv+"="+strconv.Itoa(listenFdsStart+1))
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	// The new process has its own copy of the socket now, so closing ours stops
+	// this server from accepting without closing the socket itself.
+	close(this.quit)
+	this.ln.Close()
+
+	return cmd.Process, nil
+}
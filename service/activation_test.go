@@ -0,0 +1,151 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestListenFds(t *testing.T) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	n, err := listenFds()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	os.Setenv("LISTEN_FDS", "2")
+
+	n, err = listenFds()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	n, err = listenFds()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// Meant for another process
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+
+	n, err = listenFds()
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	os.Unsetenv("LISTEN_PID")
+	os.Setenv("LISTEN_FDS", "x")
+
+	_, err = listenFds()
+	require.Error(t, err)
+
+	// Listeners doesn't pass them on
+	_, err = Listeners()
+	require.Error(t, err)
+	require.Equal(t, "", os.Getenv("LISTEN_FDS"))
+}
+
+// TestUpgradeHelper is the new process started by TestServerUpgrade. It accepts
+// a single connection on the listener it's been handed.
+func TestUpgradeHelper(t *testing.T) {
+	if os.Getenv("SURGEMQ_UPGRADE_HELPER") != "1" {
+		return
+	}
+
+	lns, err := Listeners()
+	if err != nil || len(lns) != 1 {
+		os.Exit(1)
+	}
+
+	conn, err := lns[0].Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	conn.Write([]byte("upgraded"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestServerUpgrade(t *testing.T) {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	svr := &Server{}
+
+	_, err := svr.Upgrade(os.Args[0])
+	require.Equal(t, ErrNotListening, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := ln.Addr().String()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- svr.Serve(ln)
+	}()
+
+	os.Setenv("SURGEMQ_UPGRADE_HELPER", "1")
+	defer os.Unsetenv("SURGEMQ_UPGRADE_HELPER")
+
+	// Wait for the server to start listening
+	var p *os.Process
+	for i := 0; i < 100; i++ {
+		if p, err = svr.Upgrade(os.Args[0], "-test.run=TestUpgradeHelper"); err != ErrNotListening {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+
+	select {
+	case err := <-errc:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after the upgrade")
+	}
+
+	// The socket is still listening, in the new process
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "upgraded", string(b))
+
+	state, err := p.Wait()
+	require.NoError(t, err)
+	require.True(t, state.Success())
+
+	require.NoError(t, svr.Close())
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// AutoSubscription subscribes the clients it matches to a topic filter as soon
+// as they connect, as if they had subscribed to it themselves, so devices get
+// new command channels without a firmware update:
+//
+//	svr.AutoSubscribe = []service.AutoSubscription{
+//		{Filter: "commands/%c", QoS: message.QosAtLeastOnce},
+//		{Filter: "firmware/#", ClientId: regexp.MustCompile(`^sensor-`)},
+//	}
+//
+// The clients get the retained messages of the filter as they would for their
+// own subscriptions, and can unsubscribe from it, until they connect again.
+type AutoSubscription struct {
+	// Filter is the topic filter subscribed to, with %c and %u for the client ID
+	// and the username. It's rewritten by TopicRewrite and put under the tenant
+	// of the client like the ones the client subscribes to.
+	Filter string
+
+	// QoS is the maximum QoS of the subscription.
+	QoS byte
+
+	// ClientId and Username are matched against the client ID and the username
+	// of the client. If not set then they match any.
+	ClientId *regexp.Regexp
+	Username *regexp.Regexp
+}
+
+// matches is whether the subscription is for the client cid with username.
+func (this AutoSubscription) matches(cid, username string) bool {
+	if this.ClientId != nil && !this.ClientId.MatchString(cid) {
+		return false
+	}
+
+	if this.Username != nil && !this.Username.MatchString(username) {
+		return false
+	}
+
+	return true
+}
+
+// autoSubscribe subscribes the client of the service to the AutoSubscribe
+// filters it matches, and sends it their retained messages.
+func (this *service) autoSubscribe() {
+	if this.server == nil || len(this.server.AutoSubscribe) == 0 {
+		return
+	}
+
+	cid := this.sess.ID()
+	username := string(this.sess.Cmsg.Username())
+
+	var rmsgs []*message.PublishMessage
+
+	for _, as := range this.server.AutoSubscribe {
+		if !as.matches(cid, username) {
+			continue
+		}
+
+		t := bytes.ReplaceAll([]byte(as.Filter), []byte("%c"), []byte(cid))
+		t = bytes.ReplaceAll(t, []byte("%u"), []byte(username))
+		t = this.rewrite(RewriteSubscribe, t)
+
+		if err := this.checkTopic(t); err != nil {
+			this.logger().Error("service/autoSubscribe: Rejecting subscription", logging.F("topic", string(t)), logging.Err(err))
+			continue
+		}
+
+		// A session that's been recovered already has it
+		if _, existed := this.sess.Topic(string(t)); existed {
+			continue
+		}
+
+		if _, err := this.topicsMgr.Subscribe(t, as.QoS, &this.onpub); err != nil {
+			this.logger().Error("service/autoSubscribe: Error subscribing", logging.F("topic", string(t)), logging.Err(err))
+			continue
+		}
+		this.sess.AddTopic(string(t), as.QoS)
+
+		this.topicsMgr.RetainedLimit(t, this.maxRetained, &rmsgs)
+		this.logger().Debug("service/autoSubscribe: Subscribed", logging.F("topic", string(t)), logging.F("retained", len(rmsgs)))
+	}
+
+	for _, rm := range rmsgs {
+		msg := message.NewPublishMessage()
+		msg.SetTopic(rm.Topic())
+		msg.SetPayload(rm.Payload())
+		msg.SetQoS(rm.QoS())
+		msg.SetPacketId(rm.PacketId())
+		msg.SetRetain(true)
+
+		if err := this.publish(msg, nil); err != nil {
+			this.logger().Error("service/autoSubscribe: Error publishing retained message", logging.Err(err))
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestServerAutoSubscribe(t *testing.T) {
+	svr := &Server{
+		AutoSubscribe: []AutoSubscription{
+			{Filter: "commands/%c", QoS: message.QosAtLeastOnce},
+			{Filter: "users/%u/#", Username: regexp.MustCompile(`^surgemq$`)},
+			{Filter: "firmware/#", ClientId: regexp.MustCompile(`^sensor-`)},
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	retained := newTestPublish("commands/dev1")
+	retained.SetPayload([]byte("reboot"))
+	retained.SetRetain(true)
+	_, err := svr.Publish(retained, nil)
+	require.NoError(t, err)
+
+	got := make(chan *message.PublishMessage, 10)
+
+	c := &Client{Router: &Router{}}
+	c.Router.HandleDefault(func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	})
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("dev1"))
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), cmsg))
+	topics.Unregister(c.svc.sess.ID())
+	defer c.Disconnect()
+
+	svr.mu.Lock()
+	svc := svr.clients["dev1"]
+	svr.mu.Unlock()
+
+	qos, ok := svc.sess.Topic("commands/dev1")
+	require.True(t, ok)
+	require.Equal(t, message.QosAtLeastOnce, qos)
+
+	_, ok = svc.sess.Topic("users/surgemq/#")
+	require.True(t, ok)
+
+	_, ok = svc.sess.Topic("firmware/#")
+	require.False(t, ok)
+
+	// The retained message is sent along with the subscription
+	select {
+	case msg := <-got:
+		require.Equal(t, "commands/dev1", string(msg.Topic()))
+		require.True(t, msg.Retain())
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the retained message")
+	}
+
+	_, err = svr.Publish(newTestPublish("users/surgemq/inbox"), nil)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-got:
+		require.Equal(t, "users/surgemq/inbox", string(msg.Topic()))
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message")
+	}
+}
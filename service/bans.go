@@ -0,0 +1,322 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+var (
+	ErrClientBanned error = errors.New("service: Client is banned")
+	ErrBanNotFound  error = errors.New("service: Ban not found")
+	ErrInvalidBan   error = errors.New("service: Invalid ban")
+)
+
+// The actions of BanEvents.
+const (
+	BanAdded   = "ban"
+	BanRemoved = "unban"
+	BanRefused = "refuse"
+)
+
+// BanEvent is an audit event of the ban list, for OnBanEvent.
+type BanEvent struct {
+	// Action is BanAdded, BanRemoved, or BanRefused when a client is refused, or
+	// disconnected, because of the ban.
+	Action string
+
+	Ban sessions.Ban
+
+	// The client that was refused, or disconnected when the ban was added. They
+	// are empty for bans removed.
+	ClientId   string
+	RemoteAddr string
+
+	Time time.Time
+}
+
+type banKey struct {
+	kind  sessions.BanKind
+	value string
+}
+
+// Ban adds the ban, or replaces the one of the same kind and value, and
+// disconnects the clients it matches. It's persisted by the SessionsProvider if
+// it implements sessions.BanStore. Bans are checked before the clients are
+// authenticated, and refused clients get a CONNACK return code of 0x05 (not
+// authorized).
+func (this *Server) Ban(ban sessions.Ban) error {
+	if err := this.checkConfiguration(); err != nil {
+		return err
+	}
+
+	value, err := normalizeBan(ban.Kind, ban.Value)
+	if err != nil {
+		return err
+	}
+
+	ban.Value = value
+
+	if ban.Created.IsZero() {
+		ban.Created = time.Now()
+	}
+
+	if err := this.sessMgr.SaveBan(ban); err != nil {
+		return err
+	}
+
+	this.bmu.Lock()
+	if this.bans == nil {
+		this.bans = make(map[banKey]sessions.Ban)
+	}
+	this.bans[banKey{ban.Kind, ban.Value}] = ban
+	this.bmu.Unlock()
+
+	this.auditBan(BanEvent{Action: BanAdded, Ban: ban})
+
+	// Clients already connected are banned as well
+	this.mu.Lock()
+	var svcs []*service
+	for _, svc := range this.clients {
+		if svc.sess == nil || svc.sess.Cmsg == nil {
+			continue
+		}
+
+		if banMatches(ban, svc.sess.ID(), string(svc.sess.Cmsg.Username()), svc.remoteAddr, certFingerprint(svc.conn)) {
+			svcs = append(svcs, svc)
+		}
+	}
+	this.mu.Unlock()
+
+	for _, svc := range svcs {
+		this.auditBan(BanEvent{Action: BanRefused, Ban: ban, ClientId: svc.sess.ID(), RemoteAddr: svc.remoteAddr})
+		svc.stopWith(DisconnectKicked)
+	}
+
+	return nil
+}
+
+// Unban removes the ban of that kind and value, or returns ErrBanNotFound.
+func (this *Server) Unban(kind sessions.BanKind, value string) error {
+	if err := this.checkConfiguration(); err != nil {
+		return err
+	}
+
+	value, err := normalizeBan(kind, value)
+	if err != nil {
+		return err
+	}
+
+	this.bmu.Lock()
+	ban, ok := this.bans[banKey{kind, value}]
+	delete(this.bans, banKey{kind, value})
+	this.bmu.Unlock()
+
+	if !ok {
+		return ErrBanNotFound
+	}
+
+	if err := this.sessMgr.DeleteBan(kind, value); err != nil {
+		return err
+	}
+
+	this.auditBan(BanEvent{Action: BanRemoved, Ban: ban})
+
+	return nil
+}
+
+// Bans returns the bans in force, sorted by kind and value.
+func (this *Server) Bans() []sessions.Ban {
+	now := time.Now()
+
+	this.bmu.RLock()
+	bans := make([]sessions.Ban, 0, len(this.bans))
+	for _, b := range this.bans {
+		if !b.Expired(now) {
+			bans = append(bans, b)
+		}
+	}
+	this.bmu.RUnlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Kind != bans[j].Kind {
+			return bans[i].Kind < bans[j].Kind
+		}
+
+		return bans[i].Value < bans[j].Value
+	})
+
+	return bans
+}
+
+// loadBans reads the persisted bans back from the session store. The expired ones
+// are removed from the store.
+func (this *Server) loadBans() error {
+	bans, err := this.sessMgr.Bans()
+	if err != nil {
+		return fmt.Errorf("server/loadBans: Error reading bans: %v", err)
+	}
+
+	now := time.Now()
+
+	this.bmu.Lock()
+	defer this.bmu.Unlock()
+
+	this.bans = make(map[banKey]sessions.Ban, len(bans))
+
+	for _, b := range bans {
+		if b.Expired(now) {
+			if err := this.sessMgr.DeleteBan(b.Kind, b.Value); err != nil {
+				this.logger().Error("server/loadBans: Error removing expired ban", logging.F("kind", b.Kind), logging.F("value", b.Value), logging.Err(err))
+			}
+			continue
+		}
+
+		this.bans[banKey{b.Kind, b.Value}] = b
+	}
+
+	return nil
+}
+
+// banned returns the ban in force the client connecting on conn matches, if any.
+func (this *Server) banned(conn net.Conn, req *message.ConnectMessage) *sessions.Ban {
+	this.bmu.RLock()
+	defer this.bmu.RUnlock()
+
+	if len(this.bans) == 0 {
+		return nil
+	}
+
+	var (
+		now      = time.Now()
+		cid      = string(req.ClientId())
+		username = string(req.Username())
+		addr     = conn.RemoteAddr().String()
+		cert     = certFingerprint(conn)
+	)
+
+	for _, b := range this.bans {
+		if !b.Expired(now) && banMatches(b, cid, username, addr, cert) {
+			return &b
+		}
+	}
+
+	return nil
+}
+
+func (this *Server) auditBan(e BanEvent) {
+	e.Time = time.Now()
+
+	this.logger().Info("server/ban: "+e.Action, logging.F("kind", e.Ban.Kind), logging.F("value", e.Ban.Value),
+		logging.F("reason", e.Ban.Reason), logging.F("client_id", e.ClientId), logging.F("remote_addr", e.RemoteAddr))
+
+	if this.OnBanEvent != nil {
+		this.OnBanEvent(e)
+	}
+}
+
+// banMatches is whether the ban matches the client. addr is its remote address,
+// and cert the fingerprint of its certificate, which is empty without TLS.
+func banMatches(b sessions.Ban, cid, username, addr, cert string) bool {
+	switch b.Kind {
+	case sessions.BanClientId:
+		return cid != "" && b.Value == cid
+
+	case sessions.BanUsername:
+		return username != "" && b.Value == username
+
+	case sessions.BanCert:
+		return cert != "" && b.Value == cert
+
+	case sessions.BanIP:
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+
+		if _, ipnet, err := net.ParseCIDR(b.Value); err == nil {
+			return ipnet.Contains(ip)
+		}
+
+		return ip.Equal(net.ParseIP(b.Value))
+	}
+
+	return false
+}
+
+// normalizeBan checks the value is valid for the kind of ban, and returns it in
+// the form it's matched in.
+func normalizeBan(kind sessions.BanKind, value string) (string, error) {
+	if value == "" {
+		return "", ErrInvalidBan
+	}
+
+	switch kind {
+	case sessions.BanClientId, sessions.BanUsername:
+		return value, nil
+
+	case sessions.BanIP:
+		if _, _, err := net.ParseCIDR(value); err == nil {
+			return value, nil
+		}
+
+		if ip := net.ParseIP(value); ip != nil {
+			return ip.String(), nil
+		}
+
+	case sessions.BanCert:
+		// Fingerprints are often written with colons between the bytes
+		fp := strings.ToLower(strings.Replace(value, ":", "", -1))
+		if b, err := hex.DecodeString(fp); err == nil && len(b) == sha256.Size {
+			return fp, nil
+		}
+	}
+
+	return "", ErrInvalidBan
+}
+
+// certFingerprint returns the SHA-256 fingerprint of the certificate the client
+// presented on conn, in hex, or an empty string if there's none.
+func certFingerprint(conn interface{}) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(certs[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/sessions/storetest"
+)
+
+// banStore is a session store that keeps the bans, as a persistent one would.
+type banStore struct {
+	sessions.SessionsProvider
+
+	mu   sync.Mutex
+	bans map[string]sessions.Ban
+}
+
+func (this *banStore) SaveBan(ban sessions.Ban) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.bans[string(ban.Kind)+" "+ban.Value] = ban
+	return nil
+}
+
+func (this *banStore) DeleteBan(kind sessions.BanKind, value string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.bans, string(kind)+" "+value)
+	return nil
+}
+
+func (this *banStore) Bans() ([]sessions.Ban, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var bans []sessions.Ban
+	for _, b := range this.bans {
+		bans = append(bans, b)
+	}
+
+	return bans, nil
+}
+
+func TestBanStoreConformance(t *testing.T) {
+	storetest.TestProvider(t, func() sessions.SessionsProvider {
+		return &banStore{SessionsProvider: sessions.NewMemProvider(), bans: make(map[string]sessions.Ban)}
+	})
+}
+
+func TestServerBans(t *testing.T) {
+	store := &banStore{SessionsProvider: sessions.NewMemProvider(), bans: make(map[string]sessions.Ban)}
+
+	sessions.Unregister("bans")
+	sessions.Register("bans", store)
+	defer sessions.Unregister("bans")
+
+	events := make(chan BanEvent, 10)
+
+	svr := &Server{
+		SessionsProvider: "bans",
+		OnBanEvent: func(e BanEvent) {
+			events <- e
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.Equal(t, ErrInvalidBan, svr.Ban(sessions.Ban{Kind: sessions.BanIP, Value: "nowhere"}))
+	require.Equal(t, ErrInvalidBan, svr.Ban(sessions.Ban{Kind: "shoe_size", Value: "12"}))
+
+	require.NoError(t, svr.Ban(sessions.Ban{Kind: sessions.BanClientId, Value: "rogue", Reason: "flooding"}))
+	require.Equal(t, BanAdded, (<-events).Action)
+
+	// Banned before it gets to authenticate
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("rogue"))
+	require.NoError(t, writeMessage(conn, cmsg))
+
+	connack, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ErrNotAuthorized, connack.ReturnCode())
+
+	e := <-events
+	require.Equal(t, BanRefused, e.Action)
+	require.Equal(t, "rogue", e.ClientId)
+	require.Equal(t, "flooding", e.Ban.Reason)
+
+	// The ban is kept by the store, and read back by the next server using it
+	svr2 := &Server{SessionsProvider: "bans"}
+	require.NoError(t, svr2.checkConfiguration())
+	require.Len(t, svr2.Bans(), 1)
+
+	require.NoError(t, svr.Unban(sessions.BanClientId, "rogue"))
+	require.Equal(t, BanRemoved, (<-events).Action)
+	require.Equal(t, ErrBanNotFound, svr.Unban(sessions.BanClientId, "rogue"))
+	require.Len(t, store.bans, 0)
+}
+
+func TestServerBanConnected(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	// Clients already connected are disconnected once they are banned
+	require.NoError(t, svr.Ban(sessions.Ban{Kind: sessions.BanIP, Value: "127.0.0.0/8"}))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	require.Len(t, svr.Clients(), 0)
+}
+
+func TestBanMatches(t *testing.T) {
+	fp := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		ban     sessions.Ban
+		matches bool
+	}{
+		{sessions.Ban{Kind: sessions.BanClientId, Value: "c1"}, true},
+		{sessions.Ban{Kind: sessions.BanClientId, Value: "c2"}, false},
+		{sessions.Ban{Kind: sessions.BanUsername, Value: "alice"}, true},
+		{sessions.Ban{Kind: sessions.BanIP, Value: "10.1.2.3"}, true},
+		{sessions.Ban{Kind: sessions.BanIP, Value: "10.1.0.0/16"}, true},
+		{sessions.Ban{Kind: sessions.BanIP, Value: "10.2.0.0/16"}, false},
+		{sessions.Ban{Kind: sessions.BanCert, Value: fp}, true},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.matches, banMatches(test.ban, "c1", "alice", "10.1.2.3:5555", fp), "%v", test.ban)
+	}
+
+	// Expired bans aren't in force
+	ban := sessions.Ban{Expires: time.Now().Add(-time.Second)}
+	require.True(t, ban.Expired(time.Now()))
+
+	// Fingerprints can be written with colons
+	v, err := normalizeBan(sessions.BanCert, "AB:"+fp[2:])
+	require.NoError(t, err)
+	require.Equal(t, fp, v)
+}
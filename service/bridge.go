@@ -0,0 +1,144 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// Bridge forwards the messages published by clients to another system, such as
+// Kafka.
+type Bridge interface {
+	// Forward is called with every message published by a client, along with the
+	// ID of the client. msg is only valid for the duration of the call, so
+	// anything kept around must be copied.
+	//
+	// done must be called once the message has been accepted by the other system,
+	// or has failed to be. It can be called from any goroutine. For QoS 1
+	// messages, the PUBACK is held back until every bridge has called done. If
+	// any of them fails, the client is disconnected instead, as it only publishes
+	// the message again once it reconnects, and only if its session is
+	// persistent. By then the subscribers already have the message, and they get
+	// it again. Bridges that would rather not have the client disconnected over a
+	// passing failure should retry before calling done.
+	Forward(cid string, msg *message.PublishMessage, done func(error))
+}
+
+// IDBridge is a Bridge that's given the ID the server assigned to each message.
+// The IDs go up with every message, and keep going up across restarts of the
+// server as they start from the time it started, so they make idempotency keys
+// the other system can deduplicate the deliveries with, e.g. when a batch that
+// had in fact gone through is sent again. A message the client publishes again,
+// because it never got the PUBACK, is a new message with a new ID.
+//
+// The server calls ForwardID instead of Forward for the bridges that have it.
+type IDBridge interface {
+	Bridge
+
+	ForwardID(id uint64, cid string, msg *message.PublishMessage, done func(error))
+}
+
+// ContextBridge is a Bridge that's given the context of each message, on top of
+// its ID. When the server has a Tracer, the context carries the span of the
+// publish, for the bridge to propagate to the other system, e.g. in the headers
+// of the message, so what's done with the message there can be traced back to
+// the MQTT client that published it.
+//
+// The server calls ForwardContext instead of Forward or ForwardID for the
+// bridges that have it.
+type ContextBridge interface {
+	Bridge
+
+	ForwardContext(ctx context.Context, id uint64, cid string, msg *message.PublishMessage, done func(error))
+}
+
+// forward hands the message to the bridges, and calls ack once all of them have
+// accepted it. If any of them fails, ack is not called, and the client, which
+// would otherwise wait for it forever, is disconnected. ack can be nil.
+func (this *service) forward(ctx context.Context, msg *message.PublishMessage, ack func()) {
+	var id uint64
+	if this.server != nil {
+		id = this.server.nextMessageID()
+	}
+
+	forward(ctx, this.bridges, id, this.sess.ID(), msg, func(err error) {
+		if err != nil {
+			this.logger().Error("service/forward: Error forwarding message", logging.F("topic", string(msg.Topic())), logging.Err(err))
+
+			// done may be called by the processor, which stop waits for
+			if ack != nil {
+				go this.stopWith(DisconnectBridgeFailed)
+			}
+			return
+		}
+
+		if ack != nil {
+			ack()
+		}
+	})
+}
+
+// forward hands the message published by cid to the bridges, and calls done once
+// all of them are done with it, with the first error if any of them failed. id is
+// the ID of the message for the IDBridges, and ctx its context for the
+// ContextBridges.
+func forward(ctx context.Context, bridges []Bridge, id uint64, cid string, msg *message.PublishMessage, done func(error)) {
+	if len(bridges) == 0 {
+		done(nil)
+		return
+	}
+
+	var (
+		mu      sync.Mutex
+		pending = len(bridges)
+		first   error
+	)
+
+	bdone := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil && first == nil {
+			first = err
+		}
+
+		if pending--; pending == 0 {
+			done(first)
+		}
+	}
+
+	for _, b := range bridges {
+		switch b := b.(type) {
+		case ContextBridge:
+			b.ForwardContext(ctx, id, cid, msg, bdone)
+
+		case IDBridge:
+			b.ForwardID(id, cid, msg, bdone)
+
+		default:
+			b.Forward(cid, msg, bdone)
+		}
+	}
+}
+
+// nextMessageID returns the ID of the next message handed to the bridges.
+func (this *Server) nextMessageID() uint64 {
+	return atomic.AddUint64(&this.msgid, 1)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+type forwarded struct {
+	cid     string
+	topic   string
+	payload string
+	done    func(error)
+}
+
+type testBridge chan forwarded
+
+func (this testBridge) Forward(cid string, msg *message.PublishMessage, done func(error)) {
+	this <- forwarded{cid, string(msg.Topic()), string(msg.Payload()), done}
+}
+
+func (this testBridge) next(t *testing.T) forwarded {
+	select {
+	case f := <-this:
+		return f
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message to be forwarded")
+	}
+
+	return forwarded{}
+}
+
+func TestServerBridgeAck(t *testing.T) {
+	b1, b2 := make(testBridge, 10), make(testBridge, 10)
+	svr := &Server{Bridges: []Bridge{b1, b2}}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	connect := newConnectMessage()
+	require.NoError(t, writeMessage(conn, connect))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("a/b"))
+	pub.SetPayload([]byte("abc"))
+	pub.SetQoS(message.QosAtLeastOnce)
+	pub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, pub))
+
+	f1, f2 := b1.next(t), b2.next(t)
+	require.Equal(t, forwarded{string(connect.ClientId()), "a/b", "abc", nil}, forwarded{f1.cid, f1.topic, f1.payload, nil})
+
+	// No PUBACK until both bridges have the message
+	f1.done(nil)
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err))
+
+	f2.done(nil)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	puback := message.NewPubackMessage()
+	_, err = puback.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), puback.PacketId())
+
+	// If a bridge fails, the client is disconnected rather than left without a
+	// PUBACK, so it sends the message again once it reconnects
+	pub.SetPacketId(2)
+	require.NoError(t, writeMessage(conn, pub))
+
+	b1.next(t).done(errors.New("failed"))
+	b2.next(t).done(nil)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = getMessageBuffer(conn, 0)
+	require.Error(t, err)
+	require.False(t, isTimeout(err), "Timed out waiting for the client to be disconnected")
+}
+
+type testIDBridge struct {
+	testBridge
+	ids chan uint64
+}
+
+func (this testIDBridge) ForwardID(id uint64, cid string, msg *message.PublishMessage, done func(error)) {
+	this.ids <- id
+	this.Forward(cid, msg, done)
+}
+
+func TestServerBridgeID(t *testing.T) {
+	b1 := testIDBridge{make(testBridge, 10), make(chan uint64, 10)}
+	b2 := make(testBridge, 10)
+	svr := &Server{Bridges: []Bridge{b1, b2}}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.NoError(t, svr.checkConfiguration())
+
+	start := uint64(time.Now().Add(-time.Hour).UnixNano())
+
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("a/b"))
+	pub.SetPayload([]byte("abc"))
+
+	var ids []uint64
+
+	for i := 0; i < 2; i++ {
+		_, err := svr.Publish(pub, &PublishOptions{ClientId: "c1"})
+		require.NoError(t, err)
+
+		b1.next(t).done(nil)
+		b2.next(t).done(nil)
+
+		ids = append(ids, <-b1.ids)
+	}
+
+	// The IDs go on from the time the server started
+	require.True(t, ids[0] > start)
+	require.Equal(t, ids[0]+1, ids[1])
+}
@@ -16,14 +16,21 @@ package service
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/surgemq/codec"
 )
 
 var (
 	bufcnt int64
+
+	errWriteTimeout = errors.New("service: Timed out waiting for room in buffer")
 )
 
 const (
@@ -59,6 +66,10 @@ type buffer struct {
 	id int64
 
 	buf []byte
+
+	// The data that wraps around the end of buf, copied for the consumer until
+	// it's committed. It's from the codec buffer pool, so the buffers of idle
+	// connections don't hold on to it.
 	tmp []byte
 
 	size int64
@@ -74,6 +85,22 @@ type buffer struct {
 
 	cwait int64
 	pwait int64
+
+	// The timed write waiting for room, if any, and the last one that timed out,
+	// see WriteWaitTimeout
+	wseq     int64
+	wgen     int64
+	wexpired int64
+
+	// How long WriteTo waits for flushBytes to be buffered before writing what
+	// there is. If not set then it writes as soon as there's anything.
+	flushDelay time.Duration
+	flushBytes int
+
+	// The parts of the ring WriteTo is writing. They are kept here so writing
+	// them doesn't allocate.
+	segs  [2][]byte
+	wbufs net.Buffers
 }
 
 func newBuffer(size int64) (*buffer, error) {
@@ -131,6 +158,11 @@ func (this *buffer) Len() int {
 	return int(ppos - cpos)
 }
 
+// Free returns the number of bytes that can be written without waiting.
+func (this *buffer) Free() int {
+	return int(this.size) - this.Len()
+}
+
 func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
 	defer this.Close()
 
@@ -168,40 +200,97 @@ func (this *buffer) ReadFrom(r io.Reader) (int64, error) {
 	}
 }
 
+// WriteTo writes the data in the buffer to w as it comes in, until the buffer is
+// closed. Data that wraps around the end of the ring is written with a single
+// writev if w is a net.Conn, rather than copied first. If flushDelay is set,
+// then once there's some data, it waits up to flushDelay for flushBytes to be
+// buffered before writing, so a burst of small messages goes out in one write.
 func (this *buffer) WriteTo(w io.Writer) (int64, error) {
 	defer this.Close()
 
 	total := int64(0)
 
+	max := int64(defaultWriteBlockSize)
+	if int64(this.flushBytes) > max {
+		max = int64(this.flushBytes)
+	}
+
 	for {
 		if this.isDone() {
 			return total, io.EOF
 		}
 
-		p, err := this.ReadPeek(defaultWriteBlockSize)
+		m, err := this.waitData()
+		if err != nil {
+			return total, err
+		}
 
-		// There's some data, let's process it first
-		if len(p) > 0 {
-			n, err := w.Write(p)
-			total += int64(n)
-			//glog.Debugf("Wrote %d bytes, totaling %d bytes", n, total)
+		if m > max {
+			m = max
+		}
 
-			if err != nil {
-				return total, err
-			}
+		cindex := this.cseq.get() & this.mask
 
-			_, err = this.ReadCommit(n)
-			if err != nil {
+		if cindex+m > this.size {
+			this.segs[0], this.segs[1] = this.buf[cindex:], this.buf[:cindex+m-this.size]
+			this.wbufs = this.segs[:2]
+		} else {
+			this.segs[0] = this.buf[cindex : cindex+m]
+			this.wbufs = this.segs[:1]
+		}
+
+		n, err := this.wbufs.WriteTo(w)
+		total += n
+		//glog.Debugf("Wrote %d bytes, totaling %d bytes", n, total)
+
+		if n > 0 {
+			if _, err := this.ReadCommit(int(n)); err != nil {
 				return total, err
 			}
 		}
 
-		if err != ErrBufferInsufficientData && err != nil {
+		if err != nil {
 			return total, err
 		}
 	}
 }
 
+// waitData waits for there to be some data to read, then for flushBytes of it
+// for up to flushDelay if that's set. It returns the number of bytes there are.
+func (this *buffer) waitData() (int64, error) {
+	this.ccond.L.Lock()
+	defer this.ccond.L.Unlock()
+
+	for this.Len() == 0 {
+		if this.isDone() {
+			return 0, io.EOF
+		}
+
+		this.cwait++
+		this.ccond.Wait()
+	}
+
+	if this.flushDelay > 0 && this.Len() < this.flushBytes {
+		var expired int32
+
+		t := time.AfterFunc(this.flushDelay, func() {
+			atomic.StoreInt32(&expired, 1)
+
+			this.ccond.L.Lock()
+			this.ccond.Broadcast()
+			this.ccond.L.Unlock()
+		})
+
+		for this.Len() < this.flushBytes && atomic.LoadInt32(&expired) == 0 && !this.isDone() {
+			this.ccond.Wait()
+		}
+
+		t.Stop()
+	}
+
+	return int64(this.Len()), nil
+}
+
 func (this *buffer) Read(p []byte) (int, error) {
 	if this.isDone() && this.Len() == 0 {
 		//glog.Debugf("isDone and len = %d", this.Len())
@@ -351,12 +440,10 @@ func (this *buffer) ReadPeek(n int) ([]byte, error) {
 		// If cindex (index relative to buffer) + n is more than buffer size, that means
 		// the data wrapped
 		if cindex+m > this.size {
-			// reset the tmp buffer
-			this.tmp = this.tmp[0:0]
+			this.tmp = this.scratch(int(m))
 
-			l := len(this.buf[cindex:])
-			this.tmp = append(this.tmp, this.buf[cindex:]...)
-			this.tmp = append(this.tmp, this.buf[0:m-int64(l)]...)
+			l := copy(this.tmp, this.buf[cindex:])
+			copy(this.tmp[l:], this.buf[0:m-int64(l)])
 			return this.tmp, err
 		} else {
 			return this.buf[cindex : cindex+m], err
@@ -402,13 +489,11 @@ func (this *buffer) ReadWait(n int) ([]byte, error) {
 	// If cindex (index relative to buffer) + n is more than buffer size, that means
 	// the data wrapped
 	if cindex+int64(n) > this.size {
-		// reset the tmp buffer
-		this.tmp = this.tmp[0:0]
+		this.tmp = this.scratch(n)
 
-		l := len(this.buf[cindex:])
-		this.tmp = append(this.tmp, this.buf[cindex:]...)
-		this.tmp = append(this.tmp, this.buf[0:n-l]...)
-		return this.tmp[:n], nil
+		l := copy(this.tmp, this.buf[cindex:])
+		copy(this.tmp[l:], this.buf[0:n-l])
+		return this.tmp, nil
 	}
 
 	return this.buf[cindex : cindex+int64(n)], nil
@@ -444,12 +529,33 @@ func (this *buffer) ReadCommit(n int) (int, error) {
 		this.pcond.L.Lock()
 		this.pcond.Broadcast()
 		this.pcond.L.Unlock()
+
+		// Whatever was peeked has been consumed
+		if this.tmp != nil {
+			codec.PutBuffer(this.tmp)
+			this.tmp = nil
+		}
+
 		return n, nil
 	}
 
 	return 0, ErrBufferInsufficientData
 }
 
+// scratch returns n bytes to copy wrapped data into, reusing tmp if it's large
+// enough.
+func (this *buffer) scratch(n int) []byte {
+	if cap(this.tmp) >= n {
+		return this.tmp[:n]
+	}
+
+	if this.tmp != nil {
+		codec.PutBuffer(this.tmp)
+	}
+
+	return codec.GetBuffer(n)
+}
+
 // WaitWrite waits for n bytes to be available in the buffer and then returns
 // 1. the slice pointing to the location in the buffer to be filled
 // 2. a boolean indicating whether the bytes available wraps around the ring
@@ -468,6 +574,26 @@ func (this *buffer) WriteWait(n int) ([]byte, bool, error) {
 	return this.buf[pstart : pstart+int64(cnt)], false, nil
 }
 
+// WriteWaitTimeout is WriteWait, but gives up with errWriteTimeout if there's
+// still no room for n bytes after d. Only one writer may be waiting at a time,
+// which the services make sure of with their write mutex.
+func (this *buffer) WriteWaitTimeout(n int, d time.Duration) ([]byte, bool, error) {
+	gen := atomic.AddInt64(&this.wseq, 1)
+	atomic.StoreInt64(&this.wgen, gen)
+	defer atomic.StoreInt64(&this.wgen, 0)
+
+	t := time.AfterFunc(d, func() {
+		atomic.StoreInt64(&this.wexpired, gen)
+
+		this.pcond.L.Lock()
+		this.pcond.Broadcast()
+		this.pcond.L.Unlock()
+	})
+	defer t.Stop()
+
+	return this.WriteWait(n)
+}
+
 func (this *buffer) WriteCommit(n int) (int, error) {
 	start, cnt, err := this.waitForWriteSpace(n)
 	if err != nil {
@@ -546,6 +672,12 @@ func (this *buffer) waitForWriteSpace(n int) (int64, int, error) {
 				return 0, 0, io.EOF
 			}
 
+			// A stale timer can only have expired an earlier wait
+			if g := atomic.LoadInt64(&this.wgen); g != 0 && atomic.LoadInt64(&this.wexpired) == g {
+				this.pcond.L.Unlock()
+				return 0, 0, errWriteTimeout
+			}
+
 			this.pwait++
 			this.pcond.Wait()
 		}
@@ -583,6 +715,20 @@ func ringCopy(dst, src []byte, start int64) int {
 	return i
 }
 
+// bufferSize returns n rounded up to a size newBuffer takes, or 0, newBuffer's
+// default, if n is not positive.
+func bufferSize(n int) int {
+	if n <= 0 {
+		return 0
+	}
+
+	if n < 2*defaultReadBlockSize {
+		return 2 * defaultReadBlockSize
+	}
+
+	return int(roundUpPowerOfTwo64(int64(n)))
+}
+
 func powerOfTwo64(n int64) bool {
 	return n != 0 && (n&(n-1)) == 0
 }
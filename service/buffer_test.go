@@ -82,6 +82,116 @@ func TestBufferPeek(t *testing.T) {
 	peekBuffer(t, buf, 1000)
 }
 
+func TestBufferWaitWrapped(t *testing.T) {
+	buf, err := newBuffer(16384)
+	require.NoError(t, err)
+
+	p := make([]byte, 16000)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	_, err = buf.Write(p)
+	require.NoError(t, err)
+	_, err = buf.ReadCommit(15000)
+	require.NoError(t, err)
+
+	// The next 3000 bytes wrap around the end of the ring
+	_, err = buf.Write(p[:2000])
+	require.NoError(t, err)
+
+	b, err := buf.ReadWait(3000)
+	require.NoError(t, err)
+	require.Equal(t, append(append([]byte{}, p[15000:]...), p[:2000]...), b)
+	require.NotNil(t, buf.tmp)
+
+	// The copy goes back to the pool once it's been consumed
+	_, err = buf.ReadCommit(3000)
+	require.NoError(t, err)
+	require.Nil(t, buf.tmp)
+}
+
+// writeRecorder is a writer that records the size of every write.
+type writeRecorder struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (this *writeRecorder) Write(p []byte) (int, error) {
+	this.writes = append(this.writes, len(p))
+	return this.Buffer.Write(p)
+}
+
+func TestBufferWriteToFlush(t *testing.T) {
+	buf, err := newBuffer(16384)
+	require.NoError(t, err)
+
+	buf.flushDelay = 50 * time.Millisecond
+	buf.flushBytes = 100
+
+	w := &writeRecorder{}
+	done := make(chan struct{})
+
+	go func() {
+		buf.WriteTo(w)
+		close(done)
+	}()
+
+	// The small ones are held back until the flush delay is up, and go together
+	for i := 0; i < 10; i++ {
+		_, err := buf.Write([]byte("abcde"))
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Enough to write right away
+	_, err = buf.Write(make([]byte, 200))
+	require.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	buf.Close()
+	<-done
+
+	require.Equal(t, []int{50, 200}, w.writes)
+}
+
+func TestBufferWriteToWrapped(t *testing.T) {
+	buf, err := newBuffer(16384)
+	require.NoError(t, err)
+
+	p := make([]byte, 16000)
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	_, err = buf.Write(p)
+	require.NoError(t, err)
+	_, err = buf.ReadCommit(15000)
+	require.NoError(t, err)
+
+	// The next 3000 bytes wrap around the end of the ring, and are written in two
+	// parts rather than copied
+	_, err = buf.Write(p[:2000])
+	require.NoError(t, err)
+
+	w := &writeRecorder{}
+	done := make(chan struct{})
+
+	go func() {
+		buf.WriteTo(w)
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	buf.Close()
+	<-done
+
+	require.Equal(t, append(append([]byte{}, p[15000:]...), p[:2000]...), w.Bytes())
+	require.Equal(t, []int{1384, 1616}, w.writes)
+	require.Nil(t, buf.tmp)
+}
+
 func BenchmarkBufferConsumerProducerRead(b *testing.B) {
 	buf, _ := newBuffer(0)
 	benchmarkRead(b, buf)
@@ -15,27 +15,35 @@
 package service
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
-	"net/url"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
 	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
 )
 
 const (
 	minKeepAlive = 30
+
+	DefaultReconnectMinDelay = time.Second
+	DefaultReconnectMaxDelay = 2 * time.Minute
 )
 
 // Client is a library implementation of the MQTT client that, as best it can, complies
 // with the MQTT 3.1 and 3.1.1 specs.
 type Client struct {
-	// The number of seconds to keep the connection live if there's no data.
-	// If not set then default to 5 mins.
+	// The number of seconds to keep the connection live if there's no data, for
+	// the CONNECT messages that don't set a keepalive.
+	//
+	// Deprecated: Set the keepalive of the CONNECT message, e.g. with
+	// ConnectOptions.SetKeepAlive.
 	KeepAlive int
 
 	// The number of seconds to wait for the CONNACK message before disconnecting.
@@ -50,32 +58,126 @@ type Client struct {
 	// If no set then default to 3 retries.
 	TimeoutRetries int
 
-	svc *service
+	// BufferSize is the size, in bytes, of each of the incoming and outgoing
+	// ring buffers of the connection, which is also the largest packet the
+	// client can receive. It's rounded up to a power of two, and to at least
+	// 16KB. If not set then default to 256KB.
+	BufferSize int
+
+	// Logger is where the client logs to, with the client ID and the address of
+	// the server as fields. If not set then default to logging with glog.
+	Logger logging.Logger
+
+	// Router dispatches the messages received to handlers by topic filter. When
+	// it's set, the onPublish functions given to Subscribe aren't used, and can be
+	// nil. If not set then each message goes to the onPublish functions of the
+	// subscriptions it matches.
+	Router *Router
+
+	// AutoReconnect makes the client connect again whenever the connection to the
+	// server is lost, until Disconnect is called. Once connected, the messages
+	// still waiting for their acks are sent again, and if the server didn't keep
+	// the session, the topics are subscribed to again. It's only for connections
+	// opened by Connect and ConnectTLS, as the client can't open the ones given to
+	// ConnectConn again.
+	AutoReconnect bool
+
+	// ReconnectMinDelay is how long to wait before the first attempt to reconnect.
+	// The delay doubles after every failed attempt, up to ReconnectMaxDelay. If
+	// not set then default to 1 second and 2 minutes.
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+
+	// OnReconnect is called after every attempt to reconnect, with the error it
+	// failed with, or nil once it succeeded.
+	OnReconnect func(err error)
+
+	// OfflineQueue holds the messages published while the client is disconnected,
+	// e.g. while it's reconnecting, to be sent once it's connected again, before
+	// any published after. Publish returns once a message is queued, and its
+	// onComplete function isn't called. See NewMemQueue and NewFileQueue. If not
+	// set then publishing while disconnected fails.
+	OfflineQueue PublishQueue
+
+	// The service of the current connection, how to open another connection and
+	// the CONNECT message to send over it, and the channel Disconnect closes to
+	// stop reconnecting
+	mu   sync.RWMutex
+	svc  *service
+	dial func(context.Context) (net.Conn, error)
+	cmsg *message.ConnectMessage
+	quit chan struct{}
+
+	// The number of response topics handed out, and the last packet ID the client
+	// used for a message of its own, for Request
+	requests uint64
+	pktid    uint32
+
+	// The deprecated settings in use, logged once on the first connect
+	deprecated   sync.Once
+	deprecations []Deprecation
 }
 
 // Connect is for MQTT clients to open a connection to a remote server. It needs to
-// know the URI, e.g., "tcp://127.0.0.1:1883", so it knows where to connect to. It also
-// needs to be supplied with the MQTT CONNECT message.
+// know the URI, e.g., "tcp://127.0.0.1:1883" or "unix:///tmp/mqtt.sock", so it
+// knows where to connect to. It also needs to be supplied with the MQTT CONNECT
+// message.
 func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error) {
+	return this.ConnectContext(context.Background(), uri, msg)
+}
+
+func (this *Client) ConnectTLS(uri string, msg *message.ConnectMessage, cfg *tls.Config) (err error) {
+	return this.ConnectTLSContext(context.Background(), uri, msg, cfg)
+}
+
+// ConnectContext is the same as Connect, but gives up once ctx is done, whether
+// it's still opening the connection or waiting for the CONNACK.
+func (this *Client) ConnectContext(ctx context.Context, uri string, msg *message.ConnectMessage) error {
+	return this.connectURI(ctx, uri, msg, nil)
+}
+
+// ConnectTLSContext is the same as ConnectTLS, but gives up once ctx is done.
+func (this *Client) ConnectTLSContext(ctx context.Context, uri string, msg *message.ConnectMessage, cfg *tls.Config) error {
+	return this.connectURI(ctx, uri, msg, cfg)
+}
+
+// connectURI connects to the server at uri, over TLS if cfg is set.
+func (this *Client) connectURI(ctx context.Context, uri string, msg *message.ConnectMessage, cfg *tls.Config) error {
 	this.checkConfiguration()
 
 	if msg == nil {
 		return fmt.Errorf("msg is nil")
 	}
 
-	u, err := url.Parse(uri)
+	if err := validateConnect(msg); err != nil {
+		return err
+	}
+
+	network, address, err := parseURI(uri)
 	if err != nil {
 		return err
 	}
 
-	if u.Scheme != "tcp" {
+	if network != "tcp" && network != "unix" {
 		return ErrInvalidConnectionType
 	}
 
-	conn, err := net.Dial(u.Scheme, u.Host)
-	if err != nil {
-		return err
-	}
+	return this.connectDial(ctx, msg, func(ctx context.Context) (net.Conn, error) {
+		if cfg != nil {
+			d := &tls.Dialer{Config: cfg}
+			return d.DialContext(ctx, network, address)
+		}
+
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	})
+}
+
+// ConnectConn is the same as Connect, but over a connection that's already open,
+// e.g., a serial line from the serial package. The connection is closed if the
+// connection to the server can't be set up.
+func (this *Client) ConnectConn(conn net.Conn, msg *message.ConnectMessage) (err error) {
+	this.checkConfiguration()
 
 	defer func() {
 		if err != nil {
@@ -83,148 +185,288 @@ func (this *Client) Connect(uri string, msg *message.ConnectMessage) (err error)
 		}
 	}()
 
-	if msg.KeepAlive() < minKeepAlive {
-		msg.SetKeepAlive(minKeepAlive)
+	if msg == nil {
+		return fmt.Errorf("msg is nil")
 	}
 
-	if err = writeMessage(conn, msg); err != nil {
+	deps := applyShims(this.shims(msg))
+	this.deprecated.Do(func() {
+		warnDeprecations(this.logger(), deps)
+
+		this.mu.Lock()
+		this.deprecations = deps
+		this.mu.Unlock()
+	})
+
+	if err = validateConnect(msg); err != nil {
 		return err
 	}
 
-	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(this.ConnectTimeout)))
+	if msg.KeepAlive() < minKeepAlive {
+		msg.SetKeepAlive(minKeepAlive)
+	}
 
-	resp, err := getConnackMessage(conn)
+	svc, err := this.connect(conn, msg, nil)
 	if err != nil {
 		return err
 	}
 
-	if resp.ReturnCode() != message.ConnectionAccepted {
-		return resp.ReturnCode()
-	}
+	this.mu.Lock()
+	this.svc = svc
+	this.mu.Unlock()
 
-	this.svc = &service{
-		id:     atomic.AddUint64(&gsvcid, 1),
-		client: true,
-		conn:   conn,
+	this.flush(svc)
 
-		keepAlive:      int(msg.KeepAlive()),
-		connectTimeout: this.ConnectTimeout,
-		ackTimeout:     this.AckTimeout,
-		timeoutRetries: this.TimeoutRetries,
-	}
+	return nil
+}
 
-	err = this.getSession(this.svc, msg, resp)
+// connectDial connects over a connection opened with dial, which is kept to
+// reconnect with if AutoReconnect is set.
+func (this *Client) connectDial(ctx context.Context, msg *message.ConnectMessage, dial func(context.Context) (net.Conn, error)) error {
+	conn, err := dial(ctx)
 	if err != nil {
 		return err
 	}
 
-	p := topics.NewMemProvider()
-	topics.Register(this.svc.sess.ID(), p)
+	// Closing the connection is what stops the wait for the CONNACK
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+
+	err = this.ConnectConn(conn, msg)
+
+	if !stop() {
+		if err == nil {
+			this.current().stop()
+		}
+
+		return ctx.Err()
+	}
 
-	this.svc.topicsMgr, err = topics.NewManager(this.svc.sess.ID())
 	if err != nil {
 		return err
 	}
 
-	if err := this.svc.start(); err != nil {
-		this.svc.stop()
-		return err
+	if !this.AutoReconnect {
+		return nil
 	}
 
-	this.svc.inStat.increment(int64(msg.Len()))
-	this.svc.outStat.increment(int64(resp.Len()))
+	quit := make(chan struct{})
+
+	this.mu.Lock()
+	this.dial, this.cmsg, this.quit = dial, msg, quit
+	svc := this.svc
+	this.mu.Unlock()
+
+	go this.watch(svc, quit)
 
 	return nil
 }
 
-func (this *Client) ConnectTLS(uri string, msg *message.ConnectMessage, cfg *tls.Config) (err error) {
-	this.checkConfiguration()
-
-	if msg == nil {
-		return fmt.Errorf("msg is nil")
+// connect sets up the service for a connection to the server. prev is the service
+// of the connection that was lost, if this is a reconnect, and the new service
+// carries on with its session and subscriptions.
+func (this *Client) connect(conn net.Conn, msg *message.ConnectMessage, prev *service) (*service, error) {
+	if err := writeMessage(conn, msg); err != nil {
+		return nil, err
 	}
 
-	u, err := url.Parse(uri)
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(this.ConnectTimeout)))
+
+	resp, err := getConnackMessage(conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if u.Scheme != "tcp" {
-		return ErrInvalidConnectionType
+	if resp.ReturnCode() != message.ConnectionAccepted {
+		return nil, resp.ReturnCode()
 	}
 
-	conn, err := tls.Dial(u.Scheme, u.Host, cfg)
-	if err != nil {
-		return err
+	svc := &service{
+		id:      atomic.AddUint64(&gsvcid, 1),
+		client:  true,
+		conn:    conn,
+		stopped: make(chan struct{}),
+
+		keepAlive:      int(msg.KeepAlive()),
+		connectTimeout: this.ConnectTimeout,
+		ackTimeout:     this.AckTimeout,
+		timeoutRetries: this.TimeoutRetries,
+		bufferSize:     bufferSize(this.BufferSize),
+
+		compliance: Strict,
+
+		router: this.Router,
 	}
 
-	defer func() {
-		if err != nil {
-			conn.Close()
+	svc.log = this.logger().With(logging.F("client_id", string(msg.ClientId())), logging.F("remote_addr", conn.RemoteAddr().String()))
+
+	if prev != nil {
+		svc.sess, svc.topicsMgr = prev.sess, prev.topicsMgr
+	} else {
+		if err = this.getSession(svc, msg, resp); err != nil {
+			return nil, err
 		}
-	}()
 
-	if msg.KeepAlive() < minKeepAlive {
-		msg.SetKeepAlive(minKeepAlive)
+		p := topics.NewMemProvider()
+		topics.Register(svc.sess.ID(), p)
+
+		svc.topicsMgr, err = topics.NewManager(svc.sess.ID())
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	if err = writeMessage(conn, msg); err != nil {
-		return err
+	if err := svc.start(); err != nil {
+		svc.stop()
+		return nil, err
 	}
 
-	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(this.ConnectTimeout)))
+	svc.inStat.increment(int64(msg.Len()))
+	svc.outStat.increment(int64(resp.Len()))
 
-	resp, err := getConnackMessage(conn)
-	if err != nil {
-		return err
+	if prev != nil {
+		if err := svc.resume(resp.SessionPresent()); err != nil {
+			svc.stop()
+			return nil, err
+		}
 	}
 
-	if resp.ReturnCode() != message.ConnectionAccepted {
-		return resp.ReturnCode()
+	return svc, nil
+}
+
+// watch waits for the connection of svc to be lost, and reconnects, until quit is
+// closed by Disconnect.
+func (this *Client) watch(svc *service, quit chan struct{}) {
+	for svc != nil {
+		select {
+		case <-svc.stopped:
+			svc = this.reconnect(svc, quit)
+
+		case <-quit:
+			return
+		}
 	}
+}
 
-	this.svc = &service{
-		id:     atomic.AddUint64(&gsvcid, 1),
-		client: true,
-		conn:   conn,
+// reconnect connects to the server again in place of prev, doubling the delay
+// between the attempts. It returns the new service, or nil if Disconnect was
+// called first.
+func (this *Client) reconnect(prev *service, quit chan struct{}) *service {
+	delay := this.ReconnectMinDelay
 
-		keepAlive:      int(msg.KeepAlive()),
-		connectTimeout: this.ConnectTimeout,
-		ackTimeout:     this.AckTimeout,
-		timeoutRetries: this.TimeoutRetries,
+	for {
+		select {
+		case <-time.After(delay):
+
+		case <-quit:
+			return nil
+		}
+
+		svc, err := this.redial(prev)
+
+		if this.OnReconnect != nil {
+			this.OnReconnect(err)
+		}
+
+		if err == nil {
+			this.mu.Lock()
+
+			// Disconnect was called while connecting
+			select {
+			case <-quit:
+				this.mu.Unlock()
+				svc.stop()
+				return nil
+
+			default:
+			}
+
+			this.svc = svc
+			this.mu.Unlock()
+
+			this.flush(svc)
+			return svc
+		}
+
+		if delay *= 2; delay > this.ReconnectMaxDelay {
+			delay = this.ReconnectMaxDelay
+		}
+
+		prev.logger().Error("service/reconnect: Error reconnecting", logging.Err(err), logging.F("retry_in", delay))
 	}
+}
 
-	err = this.getSession(this.svc, msg, resp)
+func (this *Client) redial(prev *service) (*service, error) {
+	conn, err := this.dial(context.Background())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	p := topics.NewMemProvider()
-	topics.Register(this.svc.sess.ID(), p)
+	svc, err := this.connect(conn, this.cmsg, prev)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return svc, nil
+}
+
+// waitComplete calls send with an OnCompleteFunc, and waits for it to be called,
+// returning the error it's called with, or for ctx to be done.
+func waitComplete(ctx context.Context, send func(OnCompleteFunc) error) error {
+	done := make(chan error, 1)
 
-	this.svc.topicsMgr, err = topics.NewManager(this.svc.sess.ID())
+	err := send(func(msg, ack message.Message, err error) error {
+		done <- err
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	if err := this.svc.start(); err != nil {
-		this.svc.stop()
+	select {
+	case err := <-done:
 		return err
+
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	this.svc.inStat.increment(int64(msg.Len()))
-	this.svc.outStat.increment(int64(resp.Len()))
+// current returns the service of the current connection.
+func (this *Client) current() *service {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
 
-	return nil
+	return this.svc
 }
 
 // Publish sends a single MQTT PUBLISH message to the server. On completion, the
 // supplied OnCompleteFunc is called. For QOS 0 messages, onComplete is called
 // immediately after the message is sent to the outgoing buffer. For QOS 1 messages,
 // onComplete is called when PUBACK is received. For QOS 2 messages, onComplete is
-// called after the PUBCOMP message is received.
+// called after the PUBCOMP message is received. Topics the server would have to
+// reject, as topics.ValidateTopicName does, are refused without sending them.
 func (this *Client) Publish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
-	return this.svc.publish(msg, onComplete)
+	if err := topics.ValidateTopicName(msg.Topic()); err != nil {
+		return err
+	}
+
+	svc := this.current()
+
+	if this.OfflineQueue != nil && (svc == nil || svc.isClosed()) {
+		return this.OfflineQueue.Push(msg)
+	}
+
+	err := svc.publish(msg, onComplete)
+
+	// The connection was lost while publishing
+	if err != nil && this.OfflineQueue != nil && svc.isClosed() {
+		return this.OfflineQueue.Push(msg)
+	}
+
+	return err
 }
 
 // Subscribe sends a single SUBSCRIBE message to the server. The SUBSCRIBE message
@@ -235,9 +477,17 @@ func (this *Client) Publish(msg *message.PublishMessage, onComplete OnCompleteFu
 // When messages are sent to the client from the server that matches the topics the
 // client subscribed to, the onPublish function is called to handle those messages.
 // So in effect, the client can supply different onPublish functions for different
-// topics.
+// topics. If the client has a Router, the messages are dispatched to it instead.
+// Topic filters the server would have to reject, as topics.ValidateTopicFilter
+// does, are refused without sending them.
 func (this *Client) Subscribe(msg *message.SubscribeMessage, onComplete OnCompleteFunc, onPublish OnPublishFunc) error {
-	return this.svc.subscribe(msg, onComplete, onPublish)
+	for _, t := range msg.Topics() {
+		if err := topics.ValidateTopicFilter(t); err != nil {
+			return err
+		}
+	}
+
+	return this.current().subscribe(msg, onComplete, onPublish)
 }
 
 // Unsubscribe sends a single UNSUBSCRIBE message to the server. The UNSUBSCRIBE
@@ -246,21 +496,54 @@ func (this *Client) Subscribe(msg *message.SubscribeMessage, onComplete OnComple
 // the supplied onComplete function is called. The client will no longer handle
 // messages from the server for those unsubscribed topics.
 func (this *Client) Unsubscribe(msg *message.UnsubscribeMessage, onComplete OnCompleteFunc) error {
-	return this.svc.unsubscribe(msg, onComplete)
+	return this.current().unsubscribe(msg, onComplete)
 }
 
 // Ping sends a single PINGREQ message to the server. PINGREQ/PINGRESP messages are
 // mainly used by the client to keep a heartbeat to the server so the connection won't
 // be dropped.
 func (this *Client) Ping(onComplete OnCompleteFunc) error {
-	return this.svc.ping(onComplete)
+	return this.current().ping(onComplete)
+}
+
+// PublishContext is the same as Publish, but waits for the ack cycle of the
+// message to complete, i.e. right away for QoS 0 messages, or for ctx to be
+// done. If ctx is done first, the message may still be delivered.
+func (this *Client) PublishContext(ctx context.Context, msg *message.PublishMessage) error {
+	return waitComplete(ctx, func(onComplete OnCompleteFunc) error {
+		return this.Publish(msg, onComplete)
+	})
+}
+
+// SubscribeContext is the same as Subscribe, but waits for the SUBACK, or for ctx
+// to be done. It returns an error if any of the topics couldn't be subscribed to.
+func (this *Client) SubscribeContext(ctx context.Context, msg *message.SubscribeMessage, onPublish OnPublishFunc) error {
+	return waitComplete(ctx, func(onComplete OnCompleteFunc) error {
+		return this.Subscribe(msg, onComplete, onPublish)
+	})
+}
+
+// UnsubscribeContext is the same as Unsubscribe, but waits for the UNSUBACK, or
+// for ctx to be done.
+func (this *Client) UnsubscribeContext(ctx context.Context, msg *message.UnsubscribeMessage) error {
+	return waitComplete(ctx, func(onComplete OnCompleteFunc) error {
+		return this.Unsubscribe(msg, onComplete)
+	})
 }
 
 // Disconnect sends a single DISCONNECT message to the server. The client immediately
 // terminates after the sending of the DISCONNECT message.
 func (this *Client) Disconnect() {
 	//msg := message.NewDisconnectMessage()
-	this.svc.stop()
+	this.mu.Lock()
+	if this.quit != nil {
+		close(this.quit)
+		this.quit = nil
+	}
+	svc := this.svc
+	this.mu.Unlock()
+
+	svc.stop()
 }
 
 func (this *Client) getSession(svc *service, req *message.ConnectMessage, resp *message.ConnackMessage) error {
@@ -269,11 +552,16 @@ func (this *Client) getSession(svc *service, req *message.ConnectMessage, resp *
 	return svc.sess.Init(req)
 }
 
-func (this *Client) checkConfiguration() {
-	if this.KeepAlive == 0 {
-		this.KeepAlive = DefaultKeepAlive
+// logger returns the Logger, or the glog one if it's not set.
+func (this *Client) logger() logging.Logger {
+	if this.Logger == nil {
+		return logging.Glog()
 	}
 
+	return this.Logger
+}
+
+func (this *Client) checkConfiguration() {
 	if this.ConnectTimeout == 0 {
 		this.ConnectTimeout = DefaultConnectTimeout
 	}
@@ -285,4 +573,114 @@ func (this *Client) checkConfiguration() {
 	if this.TimeoutRetries == 0 {
 		this.TimeoutRetries = DefaultTimeoutRetries
 	}
+
+	if this.ReconnectMinDelay == 0 {
+		this.ReconnectMinDelay = DefaultReconnectMinDelay
+	}
+
+	if this.ReconnectMaxDelay == 0 {
+		this.ReconnectMaxDelay = DefaultReconnectMaxDelay
+	}
+}
+
+// resume picks up the session of a client that has reconnected. Unless the server
+// kept the session, the topics are subscribed to again, as the onPublish functions
+// are all still in the topics manager. The messages still waiting for their acks
+// are then sent again, or for QoS 2 messages the server has already received, the
+// PUBREL is.
+func (this *service) resume(present bool) error {
+	queues := []*sessions.Ackqueue{this.sess.Pub1ack, this.sess.Pub2out, this.sess.Suback, this.sess.Unsuback}
+
+	if !present {
+		if err := this.resubscribe(queues); err != nil {
+			return err
+		}
+	}
+
+	for _, q := range queues {
+		for _, am := range q.Unacked() {
+			if am.State == message.PUBREC {
+				msg := message.NewPubrelMessage()
+				msg.SetPacketId(am.Pktid)
+
+				if _, err := this.writeMessage(msg); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			msg, err := am.Mtype.New()
+			if err != nil {
+				return err
+			}
+
+			if _, err := msg.Decode(am.Msgbuf); err != nil {
+				return err
+			}
+
+			if pub, ok := msg.(*message.PublishMessage); ok {
+				pub.SetDup(true)
+			}
+
+			if _, err := this.writeMessage(msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// resubscribe subscribes to all the topics of the session again, with a packet ID
+// none of the messages waiting for their acks are using.
+func (this *service) resubscribe(queues []*sessions.Ackqueue) error {
+	topics, qos, err := this.sess.Topics()
+	if err != nil || len(topics) == 0 {
+		return err
+	}
+
+	used := make(map[uint16]bool)
+	for _, q := range queues {
+		for _, am := range q.Unacked() {
+			used[am.Pktid] = true
+		}
+	}
+
+	var pktid uint16 = 1
+	for used[pktid] {
+		pktid++
+	}
+
+	msg := message.NewSubscribeMessage()
+	msg.SetPacketId(pktid)
+
+	for i, t := range topics {
+		if err := msg.AddTopic([]byte(t), qos[i]); err != nil {
+			return err
+		}
+	}
+
+	if _, err := this.writeMessage(msg); err != nil {
+		return err
+	}
+
+	var onc OnCompleteFunc = func(msg, ack message.Message, err error) error {
+		if err != nil {
+			this.logger().Error("service/resubscribe: Error resubscribing", logging.Err(err))
+			return err
+		}
+
+		if suback, ok := ack.(*message.SubackMessage); ok {
+			for i, c := range suback.ReturnCodes() {
+				if c == message.QosFailure && i < len(topics) {
+					this.logger().Error("service/resubscribe: Failed to resubscribe", logging.F("topic", topics[i]))
+				}
+			}
+		}
+
+		return nil
+	}
+
+	return this.sess.Suback.Wait(msg, onc)
 }
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestClientAutoReconnect(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	reconnected := make(chan error, 10)
+
+	c := &Client{
+		AutoReconnect:     true,
+		ReconnectMinDelay: 10 * time.Millisecond,
+		ReconnectMaxDelay: 50 * time.Millisecond,
+		OnReconnect: func(err error) {
+			reconnected <- err
+		},
+	}
+
+	cmsg := newConnectMessage()
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), cmsg))
+	defer c.Disconnect()
+
+	subscribed := make(chan struct{})
+	received := make(chan *message.PublishMessage, 1)
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+
+	require.NoError(t, c.Subscribe(sub,
+		func(msg, ack message.Message, err error) error {
+			close(subscribed)
+			return err
+		},
+		func(msg *message.PublishMessage) error {
+			received <- msg
+			return nil
+		}))
+
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for SUBACK")
+	}
+
+	// Drop the connection from the server side, and the client should come back
+	// with its subscription, as the clean session wasn't kept by the server
+	require.NoError(t, svr.Disconnect(string(cmsg.ClientId())))
+
+	select {
+	case err := <-reconnected:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the client to reconnect")
+	}
+
+	require.Eventually(t, func() bool {
+		return len(svr.Clients()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Give the server the chance to process the SUBSCRIBE sent again
+	time.Sleep(100 * time.Millisecond)
+
+	_, err := svr.Publish(newPublishMessage(0, message.QosAtMostOnce), nil)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		require.Equal(t, []byte("abc"), msg.Topic())
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the message after reconnecting")
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	c := &Client{}
+	require.NoError(t, c.ConnectContext(ctx, "tcp://"+ln.Addr().String(), newConnectMessage()))
+	defer c.Disconnect()
+
+	received := make(chan *message.PublishMessage, 1)
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+
+	// The subscription is in place once SubscribeContext returns
+	require.NoError(t, c.SubscribeContext(ctx, sub, func(msg *message.PublishMessage) error {
+		received <- msg
+		return nil
+	}))
+
+	require.NoError(t, c.PublishContext(ctx, newPublishMessage(2, message.QosAtLeastOnce)))
+
+	select {
+	case msg := <-received:
+		require.Equal(t, []byte("abc"), msg.Topic())
+	case <-ctx.Done():
+		t.Fatal("Timed out waiting for the message")
+	}
+
+	unsub := newUnsubscribeMessage()
+	unsub.SetPacketId(3)
+	require.NoError(t, c.UnsubscribeContext(ctx, unsub))
+}
+
+func TestClientConnectContextTimeout(t *testing.T) {
+	// A server that never sends the CONNACK
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	c := &Client{}
+	require.Equal(t, context.DeadlineExceeded, c.ConnectContext(ctx, "tcp://"+ln.Addr().String(), newConnectMessage()))
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/surgemq/message"
+)
+
+var (
+	ErrClientIdRejected error = errors.New("service: Client ID not allowed")
+)
+
+// ClientIdCharsetSpec are the characters the MQTT spec says every server has to
+// accept in client IDs, for ClientIdCharset.
+const ClientIdCharsetSpec = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// DefaultAssignedClientIdPrefix is what the client IDs the server makes up start
+// with, followed by a number, see Server.AssignedClientIdPrefix.
+const DefaultAssignedClientIdPrefix = "internalclient"
+
+// checkClientId checks the client ID of req is within the limits of the server,
+// before the server assigns one to the clients that didn't send any. It returns
+// ErrClientIdRejected if it's not, which the client is told with the CONNACK
+// return code ErrIdentifierRejected.
+func (this *Server) checkClientId(req *message.ConnectMessage) error {
+	cid := req.ClientId()
+	if len(cid) == 0 {
+		return nil
+	}
+
+	if this.MinClientIdLength > 0 && len(cid) < this.MinClientIdLength {
+		return fmt.Errorf("%w: %d bytes, the minimum is %d", ErrClientIdRejected, len(cid), this.MinClientIdLength)
+	}
+
+	if this.MaxClientIdLength > 0 && len(cid) > this.MaxClientIdLength {
+		return fmt.Errorf("%w: %d bytes, the maximum is %d", ErrClientIdRejected, len(cid), this.MaxClientIdLength)
+	}
+
+	if this.ClientIdCharset != "" {
+		for i, w := 0, 0; i < len(cid); i += w {
+			r, n := utf8.DecodeRune(cid[i:])
+			w = n
+
+			if r == utf8.RuneError || !strings.ContainsRune(this.ClientIdCharset, r) {
+				return fmt.Errorf("%w: %q has %q", ErrClientIdRejected, cid, cid[i:i+w])
+			}
+		}
+	}
+
+	return nil
+}
+
+// assignClientId gives the client of svc, which connected with an empty client
+// ID, one of its own.
+func (this *Server) assignClientId(svc *service, req *message.ConnectMessage) {
+	var cid string
+
+	if this.AssignClientId != nil {
+		cid = this.AssignClientId(string(req.Username()))
+	}
+
+	if cid == "" {
+		cid = fmt.Sprintf("%s%d", this.clientIdPrefix(), svc.id)
+	}
+
+	req.SetClientId([]byte(cid))
+}
+
+// clientIdPrefix returns what the client IDs the server makes up start with.
+func (this *Server) clientIdPrefix() string {
+	if this.AssignedClientIdPrefix != "" {
+		return this.AssignedClientIdPrefix
+	}
+
+	return DefaultAssignedClientIdPrefix
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerCheckClientId(t *testing.T) {
+	svr := &Server{
+		MinClientIdLength: 4,
+		MaxClientIdLength: 8,
+		ClientIdCharset:   ClientIdCharsetSpec,
+	}
+
+	for cid, ok := range map[string]bool{
+		"":           true,
+		"abcd":       true,
+		"Ab12cd34":   true,
+		"abc":        false,
+		"abcdefghi":  false,
+		"ab-cd":      false,
+		"abcé":       false,
+		"abc\xffdef": false,
+	} {
+		msg := newConnectMessage()
+		msg.SetClientId([]byte(cid))
+
+		err := svr.checkClientId(msg)
+		if ok {
+			require.NoError(t, err, cid)
+		} else {
+			require.True(t, errors.Is(err, ErrClientIdRejected), cid)
+		}
+	}
+
+	// Without a charset, any UTF-8 goes
+	svr = &Server{}
+
+	msg := newConnectMessage()
+	msg.SetClientId([]byte("capteur/é/" + strings.Repeat("x", 100)))
+	require.NoError(t, svr.checkClientId(msg))
+}
+
+func TestServerClientIdRejected(t *testing.T) {
+	svr := &Server{MaxClientIdLength: 4}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := newConnectMessage()
+	msg.SetClientId([]byte("toolong"))
+	require.NoError(t, writeMessage(conn, msg))
+
+	resp, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ErrIdentifierRejected, resp.ReturnCode())
+}
+
+func TestServerAssignClientId(t *testing.T) {
+	var n int
+
+	svr := &Server{
+		// Not applied to the assigned ones
+		MaxClientIdLength: 4,
+		AssignClientId: func(username string) string {
+			n++
+			if n > 1 {
+				return ""
+			}
+			return username + "-first"
+		},
+		AssignedClientIdPrefix: "anon",
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		msg := newConnectMessage()
+		msg.SetClientId(nil)
+		require.NoError(t, writeMessage(conn, msg))
+
+		resp, err := getConnackMessage(conn)
+		require.NoError(t, err)
+		require.Equal(t, message.ConnectionAccepted, resp.ReturnCode())
+	}
+
+	require.True(t, waitFor(func() bool {
+		return len(svr.Clients()) == 2
+	}))
+
+	var assigned, generated int
+	for _, ci := range svr.Clients() {
+		if ci.ClientId == "surgemq-first" {
+			assigned++
+		} else if strings.HasPrefix(ci.ClientId, "anon") {
+			generated++
+		}
+	}
+
+	require.Equal(t, 1, assigned)
+	require.Equal(t, 1, generated)
+}
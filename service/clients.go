@@ -0,0 +1,118 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"github.com/surgemq/surgemq/topics"
+)
+
+var ErrClientNotFound error = errors.New("service: Client not found")
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	ClientId     string `json:"client_id"`
+	RemoteAddr   string `json:"remote_addr"`
+	Username     string `json:"username,omitempty"`
+	CleanSession bool   `json:"clean_session"`
+	KeepAlive    int    `json:"keep_alive"`
+
+	// Tenant is the tenant of the client, if Server.Tenancy is on
+	Tenant string `json:"tenant,omitempty"`
+
+	// Subscriptions is the QoS of each topic filter the client is subscribed to
+	Subscriptions map[string]byte `json:"subscriptions"`
+
+	// The number of bytes and messages received from and sent to the client
+	BytesIn  int64 `json:"bytes_in"`
+	MsgsIn   int64 `json:"msgs_in"`
+	BytesOut int64 `json:"bytes_out"`
+	MsgsOut  int64 `json:"msgs_out"`
+}
+
+// Clients returns the connected clients, sorted by client ID.
+func (this *Server) Clients() []ClientInfo {
+	this.mu.Lock()
+	svcs := make([]*service, 0, len(this.clients))
+	for _, svc := range this.clients {
+		svcs = append(svcs, svc)
+	}
+	this.mu.Unlock()
+
+	infos := make([]ClientInfo, 0, len(svcs))
+
+	for _, svc := range svcs {
+		// Ones that are still connecting don't have a session yet
+		select {
+		case <-svc.ready:
+		default:
+			continue
+		}
+
+		if svc.sess == nil {
+			continue
+		}
+
+		infos = append(infos, svc.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ClientId < infos[j].ClientId
+	})
+
+	return infos
+}
+
+// Disconnect closes the connection to the client and ends its session, the same
+// as if the client had gone away without disconnecting, so its will message is
+// published. A persistent session is kept for the client to reconnect to.
+func (this *Server) Disconnect(cid string) error {
+	svc, err := this.connected(cid)
+	if err != nil {
+		return err
+	}
+
+	svc.stopWith(DisconnectKicked)
+	<-svc.stopped
+
+	return nil
+}
+
+func (this *service) info() ClientInfo {
+	info := ClientInfo{
+		ClientId:      this.sess.ID(),
+		RemoteAddr:    this.remoteAddr,
+		Username:      string(this.sess.Cmsg.Username()),
+		CleanSession:  this.sess.Cmsg.CleanSession(),
+		KeepAlive:     this.keepAlive,
+		Tenant:        this.tenant,
+		Subscriptions: make(map[string]byte),
+		BytesIn:       atomic.LoadInt64(&this.inStat.bytes),
+		MsgsIn:        atomic.LoadInt64(&this.inStat.msgs),
+		BytesOut:      atomic.LoadInt64(&this.outStat.bytes),
+		MsgsOut:       atomic.LoadInt64(&this.outStat.msgs),
+	}
+
+	if tps, qoss, err := this.sess.Topics(); err == nil {
+		for i, t := range tps {
+			info.Subscriptions[t] = qoss[i] & topics.QosMask
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerClients(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.Len(t, svr.Clients(), 0)
+	require.Equal(t, ErrClientNotFound, svr.Disconnect("nobody"))
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("listed"))
+	cmsg.SetCleanSession(false)
+	require.NoError(t, writeMessage(conn, cmsg))
+
+	connack, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	// The client is listed once the server is done connecting it, which may be
+	// after it has answered the SUBSCRIBE
+	require.Eventually(t, func() bool {
+		return len(svr.Clients()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	clients := svr.Clients()
+	require.Equal(t, "listed", clients[0].ClientId)
+	require.Equal(t, conn.LocalAddr().String(), clients[0].RemoteAddr)
+	require.False(t, clients[0].CleanSession)
+	require.Equal(t, map[string]byte{"abc": message.QosAtLeastOnce}, clients[0].Subscriptions)
+	require.Equal(t, int64(2), clients[0].MsgsIn)
+
+	require.NoError(t, svr.Disconnect("listed"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	require.Len(t, svr.Clients(), 0)
+}
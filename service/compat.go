@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// Deprecation is a deprecated setting found in use, with what replaces it and
+// how to move to it. Deprecated settings keep working, mapped to their
+// replacements at runtime, until they are removed, and each one in use is logged
+// as a warning once.
+type Deprecation struct {
+	// Setting is the deprecated setting, e.g. "Client.KeepAlive", and
+	// Replacement what to use instead.
+	Setting     string `json:"setting"`
+	Replacement string `json:"replacement"`
+
+	// Hint is how to migrate.
+	Hint string `json:"hint"`
+}
+
+// shim is a deprecated setting, whether it's in use, and what's done at runtime
+// to keep it working, if anything.
+type shim struct {
+	Deprecation
+
+	used  func() bool
+	apply func()
+}
+
+// applyShims applies the shims in use, and returns their deprecations.
+func applyShims(shims []shim) []Deprecation {
+	var deps []Deprecation
+
+	for _, s := range shims {
+		if !s.used() {
+			continue
+		}
+
+		if s.apply != nil {
+			s.apply()
+		}
+
+		deps = append(deps, s.Deprecation)
+	}
+
+	return deps
+}
+
+// warnDeprecations logs a warning for each of the deprecations.
+func warnDeprecations(log logging.Logger, deps []Deprecation) {
+	for _, d := range deps {
+		log.Warn("Deprecated setting in use",
+			logging.F("setting", d.Setting), logging.F("replacement", d.Replacement), logging.F("hint", d.Hint))
+	}
+}
+
+// Deprecations returns the deprecated settings of the server in use when it
+// started, e.g. for an embedder's tests to fail on before upgrading.
+func (this *Server) Deprecations() []Deprecation {
+	return this.deprecations
+}
+
+// shims are the deprecated settings of the server. They are checked before the
+// defaults are filled in, so only the ones set by the embedder are found.
+func (this *Server) shims() []shim {
+	return []shim{
+		{
+			Deprecation: Deprecation{
+				Setting:     "Server.KeepAlive",
+				Replacement: "Server.AdviseKeepAlive",
+				Hint:        "The keepalive of each connection is the one in the client's CONNECT, so KeepAlive has no effect and can be dropped. To find the clients that need a shorter one, set AdviseKeepAlive.",
+			},
+			used: func() bool { return this.KeepAlive != 0 },
+		},
+	}
+}
+
+// Deprecations returns the deprecated settings of the client in use when it
+// first connected. They are only logged then.
+func (this *Client) Deprecations() []Deprecation {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	return this.deprecations
+}
+
+// shims are the deprecated settings of the client, mapped onto msg, the CONNECT
+// message it's about to send.
+func (this *Client) shims(msg *message.ConnectMessage) []shim {
+	return []shim{
+		{
+			Deprecation: Deprecation{
+				Setting:     "Client.KeepAlive",
+				Replacement: "ConnectOptions.SetKeepAlive",
+				Hint:        "The keepalive sent to the server is the one in the CONNECT message. Until KeepAlive is removed, it's used for the CONNECT messages that don't set one.",
+			},
+			used: func() bool { return this.KeepAlive != 0 },
+			apply: func() {
+				if msg.KeepAlive() == 0 {
+					msg.SetKeepAlive(uint16(this.KeepAlive))
+				}
+			},
+		},
+	}
+}
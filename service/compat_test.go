@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/logging"
+)
+
+func TestServerDeprecations(t *testing.T) {
+	var buf bytes.Buffer
+
+	svr := &Server{
+		KeepAlive: 60,
+		Logger:    logging.NewSlog(slog.New(slog.NewJSONHandler(&buf, nil))),
+	}
+
+	require.NoError(t, svr.checkConfiguration())
+
+	deps := svr.Deprecations()
+	require.Len(t, deps, 1)
+	require.Equal(t, "Server.KeepAlive", deps[0].Setting)
+	require.Equal(t, "Server.AdviseKeepAlive", deps[0].Replacement)
+
+	require.Contains(t, buf.String(), `"level":"WARN"`)
+	require.Contains(t, buf.String(), `"setting":"Server.KeepAlive"`)
+
+	// The defaults filled in aren't deprecations
+	svr = &Server{}
+	require.NoError(t, svr.checkConfiguration())
+	require.Len(t, svr.Deprecations(), 0)
+}
+
+func TestClientDeprecations(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var buf bytes.Buffer
+
+	c := &Client{
+		KeepAlive: 60,
+		Logger:    logging.NewSlog(slog.New(slog.NewJSONHandler(&buf, nil))),
+	}
+
+	// The keepalive goes into the CONNECT messages that don't have one
+	msg := newConnectMessage()
+	msg.SetKeepAlive(0)
+
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), msg))
+	c.Disconnect()
+
+	require.Equal(t, uint16(60), msg.KeepAlive())
+
+	deps := c.Deprecations()
+	require.Len(t, deps, 1)
+	require.Equal(t, "Client.KeepAlive", deps[0].Setting)
+
+	// It's only logged the first time
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), newConnectMessage()))
+	c.Disconnect()
+
+	require.Equal(t, 1, strings.Count(buf.String(), `"setting":"Client.KeepAlive"`))
+}
@@ -0,0 +1,312 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+// The names of the components the server has of its own, for other components to
+// depend on.
+const (
+	// ComponentAuth is the authenticator.
+	ComponentAuth = "auth"
+
+	// ComponentSessions is the session store.
+	ComponentSessions = "sessions"
+
+	// ComponentTopics is the topic store, with the subscriptions and retained
+	// messages.
+	ComponentTopics = "topics"
+
+	// ComponentRecovery reads the persisted retained messages back from the topic
+	// store, see RecoveryReport.
+	ComponentRecovery = "recovery"
+
+	// ComponentBans reads the persisted bans back from the session store, see
+	// Server.Ban.
+	ComponentBans = "bans"
+
+	// ComponentQuotas reads the persisted quota usage back from the session
+	// store, and saves it again when the server stops, see Server.Quota.
+	ComponentQuotas = "quotas"
+
+	// ComponentPresence reads the persisted presence of the clients back from
+	// the session store, see Server.Presence.
+	ComponentPresence = "presence"
+
+	// ComponentDelayed reads the persisted delayed messages back from the
+	// session store and schedules them, see DelayedPrefix.
+	ComponentDelayed = "delayed"
+
+	// ComponentOffline picks up the offline queues spilled to disk by the last
+	// run, see Server.OfflineQueueDir.
+	ComponentOffline = "offline"
+
+	// ComponentWAL publishes again what the write-ahead log has that wasn't
+	// handed to the subscribers before the server went down, and starts a new
+	// one, see Server.WAL.
+	ComponentWAL = "wal"
+
+	// ComponentFanout is the workers delivering the messages the clients
+	// publish, see Server.FanoutWorkers.
+	ComponentFanout = "fanout"
+
+	// ComponentEventLoop is the event loop idle connections are parked on, see
+	// Server.EventLoop.
+	ComponentEventLoop = "eventloop"
+)
+
+// ComponentState is where a component is in its lifecycle.
+type ComponentState int
+
+const (
+	ComponentStopped ComponentState = iota
+	ComponentRunning
+
+	// ComponentUnhealthy is a running component whose Health check fails.
+	ComponentUnhealthy
+
+	// ComponentFailed is a component that failed to start or stop.
+	ComponentFailed
+)
+
+func (this ComponentState) String() string {
+	switch this {
+	case ComponentStopped:
+		return "stopped"
+	case ComponentRunning:
+		return "running"
+	case ComponentUnhealthy:
+		return "unhealthy"
+	case ComponentFailed:
+		return "failed"
+	}
+
+	return fmt.Sprintf("state%d", int(this))
+}
+
+// Component is a subsystem started and stopped along with the server, such as
+// the connection of a bridge, a store, or an admin API. The components are
+// started in dependency order once the server starts, i.e. when it starts
+// listening or is first used, and stopped in the reverse order by Close.
+type Component struct {
+	// Name identifies the component, for others to depend on, and in the status.
+	Name string
+
+	// DependsOn are the names of the components that must be running before this
+	// one starts, and are only stopped after it. They can be the server's own,
+	// e.g. ComponentSessions.
+	DependsOn []string
+
+	// Start starts the component. If it fails, the components already started
+	// are stopped and the server doesn't start. It can be nil.
+	Start func() error
+
+	// Stop stops the component. It can be nil.
+	Stop func() error
+
+	// Health checks the component is working once it's running. If not set then a
+	// running component is healthy.
+	Health func() error
+}
+
+// ComponentStatus is the state of a component.
+type ComponentStatus struct {
+	Name  string
+	State ComponentState
+
+	// Err is the error the component failed with, or the one its Health check
+	// returned.
+	Err error
+}
+
+type component struct {
+	Component
+
+	state ComponentState
+	err   error
+}
+
+// components starts and stops the components of a server.
+type components struct {
+	mu   sync.Mutex
+	list []*component
+}
+
+func (this *components) add(c Component) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, old := range this.list {
+		if old.Name == c.Name {
+			return fmt.Errorf("service: Component %q already exists", c.Name)
+		}
+	}
+
+	this.list = append(this.list, &component{Component: c})
+	return nil
+}
+
+// start starts all the components, in dependency order. If any fails to start,
+// those already started are stopped again.
+func (this *components) start(log logging.Logger) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	list, err := this.sort()
+	if err != nil {
+		return err
+	}
+
+	// They are kept in the order they were started, to be stopped in reverse
+	this.list = list
+
+	for _, c := range list {
+		if c.Start != nil {
+			if err := c.Start(); err != nil {
+				c.state, c.err = ComponentFailed, err
+				this.stopLocked(log)
+				return fmt.Errorf("service: Component %q failed to start: %v", c.Name, err)
+			}
+		}
+
+		c.state = ComponentRunning
+		log.Debug("service/components: Started component", logging.F("component", c.Name))
+	}
+
+	return nil
+}
+
+// stop stops all the running components, in the reverse order they were started.
+func (this *components) stop(log logging.Logger) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.stopLocked(log)
+}
+
+func (this *components) stopLocked(log logging.Logger) {
+	for i := len(this.list) - 1; i >= 0; i-- {
+		c := this.list[i]
+		if c.state != ComponentRunning {
+			continue
+		}
+
+		c.state = ComponentStopped
+
+		if c.Stop != nil {
+			if err := c.Stop(); err != nil {
+				c.state, c.err = ComponentFailed, err
+				log.Error("service/components: Error stopping component", logging.F("component", c.Name), logging.Err(err))
+			}
+		}
+	}
+}
+
+// running is whether any of the components is running.
+func (this *components) running() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, c := range this.list {
+		if c.state == ComponentRunning {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *components) status() []ComponentStatus {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	status := make([]ComponentStatus, len(this.list))
+
+	for i, c := range this.list {
+		status[i] = ComponentStatus{Name: c.Name, State: c.state, Err: c.err}
+
+		if c.state == ComponentRunning && c.Health != nil {
+			if err := c.Health(); err != nil {
+				status[i].State, status[i].Err = ComponentUnhealthy, err
+			}
+		}
+	}
+
+	return status
+}
+
+// sort returns the components in the order they can be started in, each after
+// the components it depends on, and otherwise in the order they were added.
+func (this *components) sort() ([]*component, error) {
+	byName := make(map[string]*component, len(this.list))
+	for _, c := range this.list {
+		byName[c.Name] = c
+	}
+
+	var (
+		sorted = make([]*component, 0, len(this.list))
+		done   = make(map[string]bool, len(this.list))
+		visit  func(c *component, path []string) error
+	)
+
+	visit = func(c *component, path []string) error {
+		if done[c.Name] {
+			return nil
+		}
+
+		for _, p := range path {
+			if p == c.Name {
+				return fmt.Errorf("service: Component %q depends on itself through %v", c.Name, path)
+			}
+		}
+
+		path = append(path, c.Name)
+
+		for _, name := range c.DependsOn {
+			dep, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("service: Component %q depends on unknown component %q", c.Name, name)
+			}
+
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+
+		done[c.Name] = true
+		sorted = append(sorted, c)
+
+		return nil
+	}
+
+	for _, c := range this.list {
+		if err := visit(c, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+// Health returns the status of every component, the server's own included, in
+// the order they were started.
+func (this *Server) Health() []ComponentStatus {
+	return this.comps.status()
+}
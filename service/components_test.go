@@ -0,0 +1,123 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordComponent returns a component that records when it's started and
+// stopped.
+func recordComponent(name string, events *[]string, deps ...string) Component {
+	return Component{
+		Name:      name,
+		DependsOn: deps,
+		Start: func() error {
+			*events = append(*events, "start "+name)
+			return nil
+		},
+		Stop: func() error {
+			*events = append(*events, "stop "+name)
+			return nil
+		},
+	}
+}
+
+func TestServerComponents(t *testing.T) {
+	var events []string
+
+	unhealthy := errors.New("lagging")
+
+	admin := recordComponent("admin", &events, "bridge", ComponentTopics)
+	admin.Health = func() error {
+		return unhealthy
+	}
+
+	svr := &Server{
+		Components: []Component{
+			admin,
+			recordComponent("bridge", &events, "store"),
+			recordComponent("store", &events, ComponentSessions),
+		},
+		OnServerStart: func(*Server) error {
+			events = append(events, "started")
+			return nil
+		},
+		OnServerStop: func(*Server) {
+			events = append(events, "stopping")
+		},
+	}
+
+	require.NoError(t, svr.checkConfiguration())
+	require.Equal(t, []string{"start store", "start bridge", "start admin", "started"}, events)
+
+	var names []string
+	for _, s := range svr.Health() {
+		names = append(names, s.Name)
+
+		if s.Name == "admin" {
+			require.Equal(t, ComponentUnhealthy, s.State)
+			require.Equal(t, unhealthy, s.Err)
+		} else {
+			require.Equal(t, ComponentRunning, s.State)
+		}
+	}
+	require.Equal(t, []string{ComponentAuth, ComponentSessions, ComponentTopics, ComponentRecovery, ComponentBans, ComponentQuotas, ComponentPresence, ComponentDelayed, ComponentOffline, ComponentWAL, ComponentFanout, ComponentEventLoop, "store", "bridge", "admin"}, names)
+
+	events = nil
+	require.NoError(t, svr.Close())
+	require.Equal(t, []string{"stopping", "stop admin", "stop bridge", "stop store"}, events)
+
+	for _, s := range svr.Health() {
+		require.Equal(t, ComponentStopped, s.State)
+	}
+}
+
+func TestServerComponentsFailure(t *testing.T) {
+	var events []string
+
+	broken := recordComponent("broken", &events, "store")
+	broken.Start = func() error {
+		return errors.New("unreachable")
+	}
+
+	svr := &Server{
+		Components: []Component{
+			recordComponent("store", &events),
+			broken,
+		},
+	}
+
+	require.Error(t, svr.checkConfiguration())
+	require.Equal(t, []string{"start store", "stop store"}, events)
+
+	// Dependencies that don't exist, or go round in circles, stop the server from
+	// starting
+	svr = &Server{
+		Components: []Component{recordComponent("a", &events, "missing")},
+	}
+	require.Error(t, svr.checkConfiguration())
+
+	svr = &Server{
+		Components: []Component{
+			recordComponent("a", &events, "b"),
+			recordComponent("b", &events, "a"),
+		},
+	}
+	require.Error(t, svr.checkConfiguration())
+}
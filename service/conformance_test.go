@@ -0,0 +1,53 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/service/servicetest"
+)
+
+// The stage of the example in the servicetest docs, an ACL that only lets
+// clients publish under their own ID, and refuses empty messages.
+func TestStageConformance(t *testing.T) {
+	acl := service.Stage{
+		Name:   "acl",
+		Phase:  service.PhaseAuth,
+		Filter: "sensors/#",
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			if len(msg.Payload()) == 0 {
+				return nil, errors.New("empty message")
+			}
+
+			if !strings.HasPrefix(string(msg.Topic()), "sensors/"+cid+"/") {
+				return nil, nil
+			}
+
+			return msg, nil
+		},
+	}
+
+	servicetest.TestStage(t, acl, []servicetest.StageCase{
+		{ClientId: "sensor1", Topic: "sensors/sensor1/temp", Payload: []byte("21"), Want: servicetest.Kept},
+		{ClientId: "sensor1", Topic: "sensors/sensor2/temp", Payload: []byte("21"), Want: servicetest.Dropped},
+		{ClientId: "sensor1", Topic: "sensors/sensor1/temp", Want: servicetest.Failed},
+		{ClientId: "sensor1", Topic: "other/topic", Want: servicetest.Kept},
+	})
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+const (
+	// The protocol levels of MQTT 3.1 and 3.1.1
+	protocolV31  = 0x3
+	protocolV311 = 0x4
+
+	// MQTT 3.1 limits client IDs to 23 bytes
+	maxClientIdV31 = 23
+)
+
+// ComplianceMode is how strictly the server holds clients to the MQTT spec.
+type ComplianceMode int
+
+const (
+	// Permissive logs the violations that can be worked around, fixes them up as
+	// best it can, and carries on. It's for fleets of devices with firmware that
+	// doesn't quite follow the spec, and can't be fixed. It's the default, so
+	// servers that don't set a mode keep letting those devices in.
+	Permissive ComplianceMode = iota
+
+	// Strict disconnects clients on any violation of the spec the server detects,
+	// with the CONNACK return code the spec asks for if there's one.
+	Strict
+)
+
+func (this ComplianceMode) String() string {
+	switch this {
+	case Permissive:
+		return "permissive"
+	case Strict:
+		return "strict"
+	}
+
+	return fmt.Sprintf("ComplianceMode(%d)", int(this))
+}
+
+// ConnectError is a CONNECT message that breaks one of the rules of the MQTT
+// spec. Rule is the number of the normative statement broken, as numbered in the
+// MQTT 3.1.1 spec, e.g. "MQTT-3.1.2-13". Rules that are only in the MQTT 3.1 spec
+// are numbered "MQTT-3.1" plus the section.
+type ConnectError struct {
+	Rule   string
+	Reason string
+
+	// Code is the return code of the CONNACK to send back before closing the
+	// connection. For most rules the spec says to close the connection without
+	// a CONNACK, which is when Code is ConnectionAccepted.
+	Code message.ConnackCode
+}
+
+func (this *ConnectError) Error() string {
+	return fmt.Sprintf("service: Invalid CONNECT (%s): %s", this.Rule, this.Reason)
+}
+
+// validateConnect checks all the rules about how the fields of a CONNECT message
+// go together, and returns a *ConnectError for the first one broken.
+func validateConnect(msg *message.ConnectMessage) error {
+	version := msg.Version()
+
+	// [MQTT-3.1.2-2] The server MUST respond with CONNACK 0x01 and close the
+	// connection if the protocol level is not supported.
+	if version != protocolV31 && version != protocolV311 {
+		return &ConnectError{"MQTT-3.1.2-2", fmt.Sprintf("Unsupported protocol level %d", version), message.ErrInvalidProtocolVersion}
+	}
+
+	if !msg.WillFlag() {
+		// [MQTT-3.1.2-13] If the Will Flag is 0, the Will QoS MUST be 0.
+		if msg.WillQos() != message.QosAtMostOnce {
+			return &ConnectError{"MQTT-3.1.2-13", fmt.Sprintf("Will QoS is %d without a will", msg.WillQos()), message.ConnectionAccepted}
+		}
+
+		// [MQTT-3.1.2-15] If the Will Flag is 0, the Will Retain MUST be 0.
+		if msg.WillRetain() {
+			return &ConnectError{"MQTT-3.1.2-15", "Will Retain is set without a will", message.ConnectionAccepted}
+		}
+	} else {
+		// [MQTT-3.1.2-14] If the Will Flag is 1, the Will QoS MUST NOT be 3.
+		if msg.WillQos() > message.QosExactlyOnce {
+			return &ConnectError{"MQTT-3.1.2-14", fmt.Sprintf("Invalid Will QoS %d", msg.WillQos()), message.ConnectionAccepted}
+		}
+
+		// [MQTT-3.1.2-9] If the Will Flag is 1, the Will Topic MUST be present.
+		if len(msg.WillTopic()) == 0 {
+			return &ConnectError{"MQTT-3.1.2-9", "Will Topic is empty", message.ConnectionAccepted}
+		}
+
+		// [MQTT-3.3.2-2] The will is published as is, and the topic of a PUBLISH
+		// MUST NOT contain wildcards.
+		if bytes.ContainsAny(msg.WillTopic(), "+#") {
+			return &ConnectError{"MQTT-3.3.2-2", fmt.Sprintf("Will Topic %q contains wildcards", msg.WillTopic()), message.ConnectionAccepted}
+		}
+	}
+
+	// [MQTT-3.1.2-22] If the User Name Flag is 0, the Password Flag MUST be 0.
+	if !msg.UsernameFlag() && msg.PasswordFlag() {
+		return &ConnectError{"MQTT-3.1.2-22", "Password is set without a User Name", message.ConnectionAccepted}
+	}
+
+	cid := msg.ClientId()
+
+	if version == protocolV31 {
+		// [MQTT-3.1 3.1] The Client Identifier MUST be between 1 and 23 bytes long,
+		// the server responds with CONNACK 0x02 otherwise.
+		if len(cid) == 0 || len(cid) > maxClientIdV31 {
+			return &ConnectError{"MQTT-3.1 3.1", fmt.Sprintf("Client Identifier is %d bytes long", len(cid)), message.ErrIdentifierRejected}
+		}
+	} else if len(cid) == 0 && !msg.CleanSession() {
+		// [MQTT-3.1.3-8] A zero byte Client Identifier with CleanSession 0 MUST be
+		// answered with CONNACK 0x02.
+		return &ConnectError{"MQTT-3.1.3-8", "Empty Client Identifier without CleanSession", message.ErrIdentifierRejected}
+	}
+
+	return nil
+}
+
+// checkConnect validates the CONNECT message, and in the Permissive mode fixes up
+// whatever it can instead of failing.
+func checkConnect(msg *message.ConnectMessage, mode ComplianceMode, log logging.Logger) error {
+	for {
+		err := validateConnect(msg)
+		if err == nil || mode != Permissive {
+			return err
+		}
+
+		cerr, ok := err.(*ConnectError)
+		if !ok || !fixConnect(msg, cerr) {
+			return err
+		}
+
+		log.Info("service/checkConnect: Accepting CONNECT in permissive mode", logging.F("client_id", string(msg.ClientId())), logging.Err(err))
+	}
+}
+
+// fixConnect changes the CONNECT message so it no longer breaks the rule. It
+// returns false if there's no sensible way to carry on, such as with an
+// unsupported protocol level.
+func fixConnect(msg *message.ConnectMessage, cerr *ConnectError) bool {
+	switch cerr.Rule {
+	case "MQTT-3.1.2-13":
+		msg.SetWillQos(message.QosAtMostOnce)
+
+	case "MQTT-3.1.2-15":
+		msg.SetWillRetain(false)
+
+	case "MQTT-3.1.2-14":
+		msg.SetWillQos(message.QosExactlyOnce)
+
+	case "MQTT-3.1.2-9", "MQTT-3.3.2-2":
+		// There's nowhere to publish the will to, so there's no will
+		msg.SetWillFlag(false)
+		msg.SetWillQos(message.QosAtMostOnce)
+		msg.SetWillRetain(false)
+
+	case "MQTT-3.1.2-22":
+		msg.SetPasswordFlag(false)
+
+	case "MQTT-3.1.3-8":
+		// The server makes up a client ID, which only makes sense for a clean
+		// session
+		msg.SetCleanSession(true)
+
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+func TestValidateConnect(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(msg *message.ConnectMessage)
+		rule string
+		code message.ConnackCode
+	}{
+		{"valid", func(msg *message.ConnectMessage) {}, "", 0},
+		{"no will", func(msg *message.ConnectMessage) {
+			msg.SetWillFlag(false)
+			msg.SetWillQos(0)
+			msg.SetWillTopic(nil)
+			msg.SetWillMessage(nil)
+		}, "", 0},
+		{"will qos without will", func(msg *message.ConnectMessage) {
+			msg.SetWillFlag(false)
+			msg.SetWillQos(1)
+		}, "MQTT-3.1.2-13", message.ConnectionAccepted},
+		{"will retain without will", func(msg *message.ConnectMessage) {
+			msg.SetWillFlag(false)
+			msg.SetWillQos(0)
+			msg.SetWillRetain(true)
+		}, "MQTT-3.1.2-15", message.ConnectionAccepted},
+		{"will topic wildcard", func(msg *message.ConnectMessage) {
+			msg.SetWillTopic([]byte("will/#"))
+		}, "MQTT-3.3.2-2", message.ConnectionAccepted},
+		{"password without username", func(msg *message.ConnectMessage) {
+			msg.SetUsernameFlag(false)
+		}, "MQTT-3.1.2-22", message.ConnectionAccepted},
+		{"empty client id", func(msg *message.ConnectMessage) {
+			msg.SetClientId(nil)
+		}, "", 0},
+		{"empty client id without clean session", func(msg *message.ConnectMessage) {
+			msg.SetClientId(nil)
+			msg.SetCleanSession(false)
+		}, "MQTT-3.1.3-8", message.ErrIdentifierRejected},
+		{"3.1 client id too long", func(msg *message.ConnectMessage) {
+			msg.SetVersion(3)
+			msg.SetClientId([]byte(strings.Repeat("a", 24)))
+		}, "MQTT-3.1 3.1", message.ErrIdentifierRejected},
+		{"3.1 empty client id", func(msg *message.ConnectMessage) {
+			msg.SetVersion(3)
+			msg.SetClientId(nil)
+		}, "MQTT-3.1 3.1", message.ErrIdentifierRejected},
+	}
+
+	for _, test := range tests {
+		msg := newConnectMessage()
+		test.edit(msg)
+
+		err := validateConnect(msg)
+		if test.rule == "" {
+			require.NoError(t, err, test.name)
+			continue
+		}
+
+		cerr, ok := err.(*ConnectError)
+		require.True(t, ok, "%s: %v", test.name, err)
+		require.Equal(t, test.rule, cerr.Rule, test.name)
+		require.Equal(t, test.code, cerr.Code, test.name)
+	}
+}
+
+func TestServerRejectsInvalidConnect(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := newConnectMessage()
+	msg.SetClientId(nil)
+	msg.SetCleanSession(false)
+	require.NoError(t, writeMessage(conn, msg))
+
+	resp, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ErrIdentifierRejected, resp.ReturnCode())
+}
+
+func TestCheckConnectPermissive(t *testing.T) {
+	msg := newConnectMessage()
+	msg.SetWillTopic([]byte("will/#"))
+	msg.SetUsernameFlag(false)
+	msg.SetClientId(nil)
+	msg.SetCleanSession(false)
+
+	require.Error(t, checkConnect(msg, Strict, logging.Nop()))
+
+	require.NoError(t, checkConnect(msg, Permissive, logging.Nop()))
+	require.False(t, msg.WillFlag())
+	require.False(t, msg.PasswordFlag())
+	require.True(t, msg.CleanSession())
+
+	// Client IDs too long for MQTT 3.1 are still rejected, as the 3.1 spec asks
+	msg = newConnectMessage()
+	msg.SetVersion(3)
+	msg.SetClientId([]byte(strings.Repeat("a", 24)))
+
+	err := checkConnect(msg, Permissive, logging.Nop())
+	require.Error(t, err)
+	require.Equal(t, "MQTT-3.1 3.1", err.(*ConnectError).Rule)
+}
+
+func TestServerSecondConnect(t *testing.T) {
+	for _, mode := range []ComplianceMode{Strict, Permissive} {
+		svr := &Server{Compliance: mode}
+
+		ln := serveTestServer(t, svr)
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+		_, err = getConnackMessage(conn)
+		require.NoError(t, err)
+
+		// A second CONNECT is a protocol violation, so it's only tolerated in
+		// permissive mode
+		require.NoError(t, writeMessage(conn, newConnectMessage()))
+		require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = getMessageBuffer(conn, 0)
+
+		if mode == Strict {
+			require.Error(t, err, mode.String())
+			require.False(t, isTimeout(err), mode.String())
+		} else {
+			require.NoError(t, err, mode.String())
+		}
+
+		conn.Close()
+		ln.Close()
+	}
+}
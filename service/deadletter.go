@@ -0,0 +1,127 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// DeadLetterReason is why a message couldn't be delivered, see DeadLetter.
+type DeadLetterReason string
+
+const (
+	// DeadLetterOverflow is a message dropped because the outgoing buffer of the
+	// subscriber was full, see SlowConsumerPolicy, or evicted unacked by newer
+	// ones, see Server.MaxInflight.
+	DeadLetterOverflow DeadLetterReason = "overflow"
+
+	// DeadLetterExpired is a retained message cleared once it was past its TTL,
+	// see Server.MessageTTL.
+	DeadLetterExpired DeadLetterReason = "expired"
+
+	// DeadLetterDenied is a message an ACL didn't let through, i.e. one of the
+	// PhaseAuth stages of the pipeline, or the default ACL.
+	DeadLetterDenied DeadLetterReason = "denied"
+
+	// DeadLetterNoSubscribers is a message nobody was subscribed to, see
+	// Server.DeadLetterNoSubscribers.
+	DeadLetterNoSubscribers DeadLetterReason = "no_subscribers"
+)
+
+// DeadLetter is what's published to the dead letter topic for a message that
+// couldn't be delivered, as JSON, so the operators can tell what was lost and
+// why. MQTT 3.1.1 has no headers, so the message itself is in the envelope.
+type DeadLetter struct {
+	Reason DeadLetterReason `json:"reason"`
+
+	// The message that couldn't be delivered. The payload is base64 encoded.
+	Topic   string `json:"topic"`
+	Payload []byte `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+
+	// ClientId is the client that published the message, if it's known.
+	ClientId string `json:"client_id,omitempty"`
+
+	// Subscriber is the client the message couldn't be delivered to, for
+	// DeadLetterOverflow.
+	Subscriber string `json:"subscriber,omitempty"`
+
+	// Time is when the message was given up on.
+	Time time.Time `json:"time"`
+}
+
+// deadLetter publishes dl for msg to DeadLetterTopic, if it's set. The messages
+// on DeadLetterTopic itself are never dead lettered, so one that can't be
+// delivered doesn't loop.
+func (this *Server) deadLetter(dl DeadLetter, msg *message.PublishMessage) {
+	this.emit(Event{
+		Type:       EventMessageDropped,
+		ClientId:   dl.ClientId,
+		Reason:     string(dl.Reason),
+		Topic:      string(msg.Topic()),
+		QoS:        msg.QoS(),
+		Subscriber: dl.Subscriber,
+	})
+
+	if this.DeadLetterTopic == "" || string(msg.Topic()) == this.DeadLetterTopic {
+		return
+	}
+
+	dl.Topic = string(msg.Topic())
+	dl.Payload = msg.Payload()
+	dl.QoS = msg.QoS()
+	dl.Retain = msg.Retain()
+	dl.Time = time.Now()
+
+	payload, err := json.Marshal(dl)
+	if err != nil {
+		this.logger().Error("server/deadLetter: Error encoding dead letter", logging.Err(err))
+		return
+	}
+
+	dmsg := message.NewPublishMessage()
+	if err := dmsg.SetTopic([]byte(this.DeadLetterTopic)); err != nil {
+		this.logger().Error("server/deadLetter: Invalid dead letter topic", logging.F("topic", this.DeadLetterTopic), logging.Err(err))
+		return
+	}
+	dmsg.SetPayload(payload)
+	dmsg.SetQoS(message.QosAtLeastOnce)
+
+	if _, err := this.publish(dmsg, nil); err != nil {
+		this.logger().Error("server/deadLetter: Error publishing dead letter", logging.F("reason", dl.Reason), logging.Err(err))
+	}
+}
+
+// deadLetter is Server.deadLetter for a message the service couldn't deliver to
+// its client, or that its client published.
+func (this *service) deadLetter(reason DeadLetterReason, msg *message.PublishMessage) {
+	if this.client || this.server == nil {
+		return
+	}
+
+	dl := DeadLetter{Reason: reason}
+	if reason == DeadLetterOverflow {
+		dl.Subscriber = this.sess.ID()
+	} else {
+		dl.ClientId = this.sess.ID()
+	}
+
+	this.server.deadLetter(dl, msg)
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func subscribeDeadLetters(t *testing.T, svr *Server) chan DeadLetter {
+	got := make(chan DeadLetter, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		var dl DeadLetter
+		require.NoError(t, json.Unmarshal(msg.Payload(), &dl))
+		got <- dl
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte(svr.DeadLetterTopic), message.QosAtLeastOnce, &onpub)
+	require.NoError(t, err)
+
+	return got
+}
+
+func waitDeadLetter(t *testing.T, got chan DeadLetter) DeadLetter {
+	select {
+	case dl := <-got:
+		return dl
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the dead letter")
+	}
+
+	return DeadLetter{}
+}
+
+func TestServerDeadLetterDenied(t *testing.T) {
+	svr := &Server{DefaultACL: ACLDeny, DeadLetterTopic: "$dlq"}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := subscribeDeadLetters(t, svr)
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	msg := newTestPublish("a/b")
+	msg.SetPayload([]byte("secret"))
+	require.NoError(t, c.Publish(msg, nil))
+
+	dl := waitDeadLetter(t, got)
+	require.Equal(t, DeadLetterDenied, dl.Reason)
+	require.Equal(t, "a/b", dl.Topic)
+	require.Equal(t, "secret", string(dl.Payload))
+	require.Equal(t, c.svc.sess.ID(), dl.ClientId)
+}
+
+func TestServerDeadLetterNoSubscribers(t *testing.T) {
+	svr := &Server{DeadLetterTopic: "$dlq", DeadLetterNoSubscribers: true}
+	require.NoError(t, svr.checkConfiguration())
+
+	got := subscribeDeadLetters(t, svr)
+
+	_, err := svr.Publish(newTestPublish("nobody/home"), &PublishOptions{ClientId: "c1"})
+	require.NoError(t, err)
+
+	dl := waitDeadLetter(t, got)
+	require.Equal(t, DeadLetterNoSubscribers, dl.Reason)
+	require.Equal(t, "nobody/home", dl.Topic)
+	require.Equal(t, "c1", dl.ClientId)
+
+	// Retained messages aren't lost
+	retained := newTestPublish("nobody/home")
+	retained.SetRetain(true)
+	_, err = svr.Publish(retained, nil)
+	require.NoError(t, err)
+
+	select {
+	case dl := <-got:
+		require.FailNow(t, "Retained message dead lettered", dl.Topic)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServerDeadLetterExpired(t *testing.T) {
+	svr := &Server{
+		DeadLetterTopic: "$dlq",
+		MessageTTL:      []TTLPolicy{{Filter: "t/#", TTL: 100 * time.Millisecond}},
+	}
+	require.NoError(t, svr.checkConfiguration())
+
+	got := subscribeDeadLetters(t, svr)
+
+	retained := newTestPublish("t/1")
+	retained.SetPayload([]byte("stale"))
+	retained.SetRetain(true)
+	_, err := svr.Publish(retained, nil)
+	require.NoError(t, err)
+
+	dl := waitDeadLetter(t, got)
+	require.Equal(t, DeadLetterExpired, dl.Reason)
+	require.Equal(t, "t/1", dl.Topic)
+	require.Equal(t, "stale", string(dl.Payload))
+}
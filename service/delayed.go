@@ -0,0 +1,204 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+var ErrInvalidDelay error = errors.New("service: Invalid delayed publish topic")
+
+// DelayedPrefix is the prefix of the topics messages are published to with a
+// delay, as $delayed/{seconds}/{topic}. The server holds on to them for that
+// many seconds, then publishes them to the topic.
+const DelayedPrefix = "$delayed/"
+
+// DefaultMaxDelay is the longest a message can be delayed by, see
+// Server.MaxDelay.
+const DefaultMaxDelay = 4294967 * time.Second
+
+// delayOf takes DelayedPrefix and the delay off the topic of msg, published by
+// the client of the service, and returns the delay. It's 0 for the messages
+// that aren't delayed, and ErrInvalidDelay for the ones whose delay isn't a
+// number of seconds up to the server's MaxDelay, or that have no topic after it.
+func (this *service) delayOf(msg *message.PublishMessage) (time.Duration, error) {
+	if this.server == nil || !bytes.HasPrefix(msg.Topic(), []byte(DelayedPrefix)) {
+		return 0, nil
+	}
+
+	rest := msg.Topic()[len(DelayedPrefix):]
+
+	i := bytes.IndexByte(rest, '/')
+	if i < 0 || i == len(rest)-1 {
+		return 0, ErrInvalidDelay
+	}
+
+	secs, err := strconv.ParseUint(string(rest[:i]), 10, 32)
+	if err != nil {
+		return 0, ErrInvalidDelay
+	}
+
+	delay := time.Duration(secs) * time.Second
+	if delay > this.server.MaxDelay {
+		return 0, ErrInvalidDelay
+	}
+
+	if err := msg.SetTopic(rest[i+1:]); err != nil {
+		return 0, ErrInvalidDelay
+	}
+
+	return delay, nil
+}
+
+// delay holds msg, published by the client cid, for d before publishing it. It's
+// persisted by the SessionsProvider if it implements sessions.DelayedStore.
+func (this *Server) delay(cid string, msg *message.PublishMessage, d time.Duration) error {
+	dm := sessions.DelayedMessage{
+		ID:       fmt.Sprintf("%016x", this.nextMessageID()),
+		ClientId: cid,
+		Topic:    append([]byte(nil), msg.Topic()...),
+		Payload:  append([]byte(nil), msg.Payload()...),
+		QoS:      msg.QoS(),
+		Retain:   msg.Retain(),
+		Due:      time.Now().Add(d),
+	}
+
+	if err := this.sessMgr.SaveDelayed(dm); err != nil {
+		return err
+	}
+
+	this.scheduleDelayed(dm)
+
+	return nil
+}
+
+// scheduleDelayed sets the timer publishing dm once it's due, or right away if
+// it's overdue.
+func (this *Server) scheduleDelayed(dm sessions.DelayedMessage) {
+	this.dmu.Lock()
+	defer this.dmu.Unlock()
+
+	if this.delayed == nil {
+		this.delayed = make(map[string]*delayed)
+	}
+
+	// Publishing goes through the TopicsProvider, which may block, so it's not
+	// done on the wheel's goroutine.
+	this.delayed[dm.ID] = &delayed{
+		msg: dm,
+		t: this.timers.get(0).AfterFunc(time.Until(dm.Due), func() {
+			go this.publishDelayed(dm.ID)
+		}),
+	}
+}
+
+// delayed is a delayed message and the timer publishing it.
+type delayed struct {
+	msg sessions.DelayedMessage
+	t   *wheelTimer
+}
+
+// publishDelayed publishes the delayed message with that ID, if it's still held,
+// handing it to the bridges as published by the client that delayed it.
+func (this *Server) publishDelayed(id string) {
+	this.dmu.Lock()
+	d := this.delayed[id]
+	delete(this.delayed, id)
+	this.dmu.Unlock()
+
+	if d == nil {
+		return
+	}
+
+	if err := this.sessMgr.DeleteDelayed(id); err != nil {
+		this.logger().Error("server/publishDelayed: Error removing delayed message", logging.F("id", id), logging.Err(err))
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic(d.msg.Topic); err != nil {
+		this.logger().Error("server/publishDelayed: Invalid delayed message", logging.F("id", id), logging.Err(err))
+		return
+	}
+	msg.SetPayload(d.msg.Payload)
+	msg.SetQoS(d.msg.QoS)
+	msg.SetRetain(d.msg.Retain)
+
+	forward(context.Background(), this.Bridges, this.nextMessageID(), d.msg.ClientId, msg, func(err error) {
+		if err != nil {
+			this.logger().Error("server/publishDelayed: Error forwarding delayed message", logging.F("id", id), logging.Err(err))
+		}
+	})
+
+	if _, err := this.Publish(msg, nil); err != nil {
+		this.logger().Error("server/publishDelayed: Error publishing delayed message", logging.F("id", id), logging.Err(err))
+	}
+}
+
+// DelayedMessages returns the delayed messages held, the first due first.
+func (this *Server) DelayedMessages() []sessions.DelayedMessage {
+	this.dmu.Lock()
+	msgs := make([]sessions.DelayedMessage, 0, len(this.delayed))
+	for _, d := range this.delayed {
+		msgs = append(msgs, d.msg)
+	}
+	this.dmu.Unlock()
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Due.Before(msgs[j].Due)
+	})
+
+	return msgs
+}
+
+// loadDelayed reads the persisted delayed messages back from the session store
+// and schedules them. The ones that came due while the server was down are
+// published right away.
+func (this *Server) loadDelayed() error {
+	msgs, err := this.sessMgr.DelayedMessages()
+	if err != nil {
+		return fmt.Errorf("server/loadDelayed: Error reading delayed messages: %v", err)
+	}
+
+	for _, dm := range msgs {
+		this.scheduleDelayed(dm)
+	}
+
+	return nil
+}
+
+// stopDelayed stops the timers of the delayed messages. The persisted ones are
+// published once the server starts again.
+func (this *Server) stopDelayed() error {
+	this.dmu.Lock()
+	defer this.dmu.Unlock()
+
+	for _, d := range this.delayed {
+		d.t.Stop()
+	}
+
+	this.delayed = nil
+
+	return nil
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/sessions/storetest"
+)
+
+// delayedStore is a session store that keeps the delayed messages, as a
+// persistent one would.
+type delayedStore struct {
+	sessions.SessionsProvider
+
+	mu   sync.Mutex
+	msgs map[string]sessions.DelayedMessage
+}
+
+func (this *delayedStore) SaveDelayed(msg sessions.DelayedMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.msgs[msg.ID] = msg
+	return nil
+}
+
+func (this *delayedStore) DeleteDelayed(id string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.msgs, id)
+	return nil
+}
+
+func (this *delayedStore) DelayedMessages() ([]sessions.DelayedMessage, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var msgs []sessions.DelayedMessage
+	for _, m := range this.msgs {
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func (this *delayedStore) len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.msgs)
+}
+
+func TestDelayedStoreConformance(t *testing.T) {
+	storetest.TestProvider(t, func() sessions.SessionsProvider {
+		return &delayedStore{SessionsProvider: sessions.NewMemProvider(), msgs: make(map[string]sessions.DelayedMessage)}
+	})
+}
+
+func TestServerDelayedPublish(t *testing.T) {
+	store := &delayedStore{SessionsProvider: sessions.NewMemProvider(), msgs: make(map[string]sessions.DelayedMessage)}
+
+	sessions.Unregister("delayed")
+	sessions.Register("delayed", store)
+	defer sessions.Unregister("delayed")
+
+	svr := &Server{SessionsProvider: "delayed", MaxDelay: time.Minute}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("a/#"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	// Delays that aren't a number of seconds, are too long or have no topic
+	// after them are dropped
+	require.NoError(t, c.Publish(newTestPublish("$delayed/soon/a/b"), nil))
+	require.NoError(t, c.Publish(newTestPublish("$delayed/3600/a/b"), nil))
+	require.NoError(t, c.Publish(newTestPublish("$delayed/1/"), nil))
+
+	start := time.Now()
+	require.NoError(t, c.Publish(newTestPublish("$delayed/1/a/b"), nil))
+
+	require.True(t, waitFor(func() bool {
+		return len(svr.DelayedMessages()) == 1
+	}))
+	require.Equal(t, 1, store.len())
+	require.Equal(t, "a/b", string(svr.DelayedMessages()[0].Topic))
+
+	select {
+	case msg := <-got:
+		require.Equal(t, "a/b", string(msg.Topic()))
+		require.True(t, time.Since(start) >= 900*time.Millisecond)
+
+	case <-time.After(3 * time.Second):
+		require.FailNow(t, "Timed out waiting for the delayed message")
+	}
+
+	require.Empty(t, svr.DelayedMessages())
+	require.Equal(t, 0, store.len())
+
+	select {
+	case msg := <-got:
+		require.FailNow(t, "Invalid delayed message published", string(msg.Topic()))
+
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServerDelayedRecovered(t *testing.T) {
+	store := &delayedStore{SessionsProvider: sessions.NewMemProvider(), msgs: make(map[string]sessions.DelayedMessage)}
+	store.msgs["1"] = sessions.DelayedMessage{ID: "1", Topic: []byte("a/b"), Payload: []byte("late"), Due: time.Now().Add(-time.Minute)}
+	store.msgs["2"] = sessions.DelayedMessage{ID: "2", Topic: []byte("a/c"), Due: time.Now().Add(time.Hour)}
+
+	sessions.Unregister("delayed")
+	sessions.Register("delayed", store)
+	defer sessions.Unregister("delayed")
+
+	svr := &Server{SessionsProvider: "delayed"}
+	require.NoError(t, svr.checkConfiguration())
+	defer svr.Close()
+
+	// The one that came due while the server was down is published right away
+	require.True(t, waitFor(func() bool {
+		return store.len() == 1
+	}))
+
+	msgs := svr.DelayedMessages()
+	require.Len(t, msgs, 1)
+	require.Equal(t, "2", msgs[0].ID)
+}
@@ -0,0 +1,378 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build dtls
+// +build dtls
+
+package service
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/transport/v2/udp"
+	"github.com/surgemq/surgemq/logging"
+)
+
+const (
+	// How long a DTLS session can be resumed for after the handshake, if the
+	// configuration doesn't have a SessionStore already
+	dtlsSessionTTL = 24 * time.Hour
+
+	// The most DTLS sessions kept around for resumption
+	dtlsMaxSessions = 100000
+
+	// The largest DTLS record, and so the most a single read can return
+	dtlsMaxRecord = 16384
+
+	// The MTU assumed if the configuration doesn't set one. Comfortably under the
+	// path MTU of most networks, so datagrams aren't fragmented by IP.
+	dtlsDefaultMTU = 1200
+
+	// Room left in each datagram for the record header and the cipher's nonce and
+	// tag, so a record of application data still fits in the MTU
+	dtlsRecordOverhead = 64
+
+	// The record content type of handshake messages
+	dtlsContentTypeHandshake = 22
+)
+
+// ListenAndServeDTLS is the same as ListenAndServe, but with MQTT over DTLS 1.2,
+// for devices that can't keep up a TCP connection. It's experimental, and only
+// built with the "dtls" build tag. The URI is of the form "dtls://host:port".
+// Each DTLS association carries a single MQTT session, and everything else about
+// it works the same as a TCP connection.
+func (this *Server) ListenAndServeDTLS(uri string, cfg *dtls.Config) error {
+	ln, err := listenDTLS(uri, cfg, this.logger())
+	if err != nil {
+		return err
+	}
+
+	mtu := cfg.MTU
+	if mtu == 0 {
+		mtu = dtlsDefaultMTU
+	}
+
+	return this.Serve(&dtlsStreamListener{Listener: ln, mtu: mtu - dtlsRecordOverhead})
+}
+
+// ListenDTLS listens for DTLS 1.2 clients on the URI, which is of the form
+// "dtls://host:port". The listener returns each connection once its handshake
+// is done, and the handshakes are done separately for each client, so a slow or
+// broken one doesn't hold up everybody else. A read on one of the connections
+// returns a single record. The MQTT-SN gateway uses it as well.
+//
+// The server always answers a ClientHello with a HelloVerifyRequest cookie, so a
+// spoofed source address can't get the server to do any handshake work or send
+// it a flight of certificates. If cfg doesn't have a SessionStore, one that keeps
+// sessions in memory for a day is used, so clients that wake up and reconnect can
+// resume with an abbreviated handshake.
+func ListenDTLS(uri string, cfg *dtls.Config) (net.Listener, error) {
+	return listenDTLS(uri, cfg, logging.Glog())
+}
+
+// listenDTLS is ListenDTLS, logging the failed handshakes to log.
+func listenDTLS(uri string, cfg *dtls.Config, log logging.Logger) (net.Listener, error) {
+	_, address, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := &udp.ListenConfig{
+		// Only a handshake record starts a new association, anything else from an
+		// address we don't know is dropped before it costs anything
+		AcceptFilter: func(b []byte) bool {
+			return len(b) > 0 && b[0] == dtlsContentTypeHandshake
+		},
+	}
+
+	ln, err := lc.Listen("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDTLSListener(ln, dtlsConfig(cfg), log), nil
+}
+
+// dtlsConfig returns a copy of cfg with the cookie exchange turned on, and with
+// a SessionStore for resuming sessions if it doesn't have one.
+func dtlsConfig(cfg *dtls.Config) *dtls.Config {
+	c := *cfg
+
+	c.InsecureSkipVerifyHello = false
+
+	if c.SessionStore == nil {
+		c.SessionStore = NewDTLSSessionStore(dtlsSessionTTL, dtlsMaxSessions)
+	}
+
+	return &c
+}
+
+// dtlsListener does the DTLS handshake on the UDP associations accepted by ln.
+type dtlsListener struct {
+	ln  net.Listener
+	cfg *dtls.Config
+	log logging.Logger
+
+	conns chan net.Conn
+	errs  chan error
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newDTLSListener(ln net.Listener, cfg *dtls.Config, log logging.Logger) *dtlsListener {
+	this := &dtlsListener{
+		ln:    ln,
+		cfg:   cfg,
+		log:   log,
+		conns: make(chan net.Conn),
+		errs:  make(chan error, 1),
+		done:  make(chan struct{}),
+	}
+
+	go this.run()
+
+	return this
+}
+
+func (this *dtlsListener) run() {
+	for {
+		conn, err := this.ln.Accept()
+		if err != nil {
+			this.errs <- err
+			return
+		}
+
+		go this.handshake(conn)
+	}
+}
+
+func (this *dtlsListener) handshake(conn net.Conn) {
+	dc, err := dtls.Server(conn, this.cfg)
+	if err != nil {
+		this.log.Error("server/dtlsListener: Error in handshake", logging.F("remote_addr", conn.RemoteAddr().String()), logging.Err(err))
+		conn.Close()
+		return
+	}
+
+	select {
+	case this.conns <- dc:
+
+	case <-this.done:
+		dc.Close()
+	}
+}
+
+func (this *dtlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+
+	case err := <-this.errs:
+		return nil, err
+
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (this *dtlsListener) Close() error {
+	this.once.Do(func() {
+		close(this.done)
+	})
+
+	return this.ln.Close()
+}
+
+func (this *dtlsListener) Addr() net.Addr {
+	return this.ln.Addr()
+}
+
+// DTLSSessionStore keeps DTLS sessions in memory so clients can resume them. It
+// implements dtls.SessionStore.
+type DTLSSessionStore struct {
+	ttl time.Duration
+	max int
+
+	mu       sync.Mutex
+	sessions map[string]dtlsSession
+}
+
+type dtlsSession struct {
+	dtls.Session
+
+	expires time.Time
+}
+
+var _ dtls.SessionStore = (*DTLSSessionStore)(nil)
+
+// NewDTLSSessionStore returns a session store that keeps each session for ttl,
+// and at most max of them. When it's full, the session closest to expiring is
+// dropped to make room.
+func NewDTLSSessionStore(ttl time.Duration, max int) *DTLSSessionStore {
+	return &DTLSSessionStore{
+		ttl:      ttl,
+		max:      max,
+		sessions: make(map[string]dtlsSession),
+	}
+}
+
+func (this *DTLSSessionStore) Set(key []byte, s dtls.Session) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	now := time.Now()
+
+	if _, ok := this.sessions[string(key)]; !ok && len(this.sessions) >= this.max {
+		this.evict(now)
+	}
+
+	this.sessions[string(key)] = dtlsSession{
+		Session: dtls.Session{
+			ID:     append([]byte(nil), s.ID...),
+			Secret: append([]byte(nil), s.Secret...),
+		},
+		expires: now.Add(this.ttl),
+	}
+
+	return nil
+}
+
+// Get returns an empty session if there isn't one for the key, which is how the
+// dtls package expects a miss to look.
+func (this *DTLSSessionStore) Get(key []byte) (dtls.Session, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	s, ok := this.sessions[string(key)]
+	if !ok {
+		return dtls.Session{}, nil
+	}
+
+	if time.Now().After(s.expires) {
+		delete(this.sessions, string(key))
+		return dtls.Session{}, nil
+	}
+
+	return s.Session, nil
+}
+
+func (this *DTLSSessionStore) Del(key []byte) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.sessions, string(key))
+
+	return nil
+}
+
+// evict drops the expired sessions, and if that doesn't make room, the one
+// closest to expiring. The lock must be held.
+func (this *DTLSSessionStore) evict(now time.Time) {
+	var (
+		oldest  string
+		expires time.Time
+	)
+
+	for k, s := range this.sessions {
+		if now.After(s.expires) {
+			delete(this.sessions, k)
+		} else if oldest == "" || s.expires.Before(expires) {
+			oldest, expires = k, s.expires
+		}
+	}
+
+	if len(this.sessions) >= this.max {
+		delete(this.sessions, oldest)
+	}
+}
+
+// dtlsStreamListener wraps the DTLS connections it accepts so they read and
+// write like a stream, which is what the services expect.
+type dtlsStreamListener struct {
+	net.Listener
+
+	// The most application data written in a single record
+	mtu int
+}
+
+func (this *dtlsStreamListener) Accept() (net.Conn, error) {
+	conn, err := this.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &dtlsConn{Conn: conn, mtu: this.mtu}, nil
+}
+
+// dtlsConn turns the records of a DTLS connection into a byte stream. A read on
+// a DTLS connection returns one whole record, and fails if it doesn't fit, while
+// the services read into whatever room is left in their buffers. So records are
+// read into a buffer of their own first. Writes are split up into records no
+// larger than the MTU, since the services write as much as they have.
+type dtlsConn struct {
+	net.Conn
+
+	mtu int
+
+	rbuf []byte
+	rec  bytes.Reader
+}
+
+func (this *dtlsConn) Read(b []byte) (int, error) {
+	if this.rec.Len() == 0 {
+		if this.rbuf == nil {
+			this.rbuf = make([]byte, dtlsMaxRecord)
+		}
+
+		n, err := this.Conn.Read(this.rbuf)
+		if err != nil {
+			return 0, err
+		}
+
+		this.rec.Reset(this.rbuf[:n])
+	}
+
+	return this.rec.Read(b)
+}
+
+func (this *dtlsConn) Write(b []byte) (int, error) {
+	total := 0
+
+	for len(b) > 0 {
+		n := len(b)
+		if n > this.mtu {
+			n = this.mtu
+		}
+
+		m, err := this.Conn.Write(b[:n])
+		total += m
+		if err != nil {
+			return total, err
+		}
+
+		b = b[n:]
+	}
+
+	return total, nil
+}
@@ -0,0 +1,267 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+var ErrEventLoopNotSupported error = errors.New("service: Event loop is not supported on this platform")
+
+// errParked is what the receiver of a service reads once the service is parked.
+var errParked = errors.New("service: Connection parked")
+
+const (
+	// DefaultEventLoopIdle is how long a connection has to be idle before it's
+	// parked on the event loop, see Server.EventLoop.
+	DefaultEventLoopIdle = 30 * time.Second
+
+	// The number of events the event loop takes at a time, and how long it waits
+	// for them before checking whether it's closed
+	eventLoopEvents = 128
+	eventLoopWait   = 100 * time.Millisecond
+)
+
+// poller watches the connections of the parked services, and wakes each of them
+// once there's something to read from its connection.
+type poller interface {
+	// add watches fd, the file descriptor of the connection of svc.
+	add(svc *service, fd int) error
+
+	// remove stops watching fd, if it's still watched for svc.
+	remove(svc *service, fd int)
+
+	close() error
+}
+
+// startEventLoop starts the event loop, if the server has one.
+func (this *Server) startEventLoop() error {
+	if !this.EventLoop {
+		return nil
+	}
+
+	p, err := newPoller(this.logger())
+	if err == ErrEventLoopNotSupported {
+		this.logger().Warn("server/startEventLoop: Event loop not supported, connections stay on their goroutines")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	this.loop = p
+
+	return nil
+}
+
+// stopEventLoop stops the event loop, if it's running. The services parked on
+// it are stopped with the server.
+func (this *Server) stopEventLoop() error {
+	if this.loop == nil {
+		return nil
+	}
+
+	return this.loop.close()
+}
+
+// parkReader reads from conn with a read deadline of d, and parks the service
+// once a read times out. The keepalive is enforced by ir, which reads from conn,
+// or by the timer of the service while it's parked.
+type parkReader struct {
+	svc  *service
+	conn net.Conn
+	ir   *idleReader
+	d    time.Duration
+}
+
+func (this parkReader) Read(b []byte) (int, error) {
+	for {
+		if err := this.conn.SetReadDeadline(time.Now().Add(this.d)); err != nil {
+			return 0, err
+		}
+
+		n, err := this.ir.Read(b)
+
+		// Someone else set the deadline, to stop the receiver
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() || n > 0 || this.svc.isDone() || this.svc.handingOff() {
+			return n, err
+		}
+
+		if this.svc.park(time.Unix(0, atomic.LoadInt64(&this.ir.last))) {
+			return 0, errParked
+		}
+	}
+}
+
+// parkable is whether the service can be parked on the event loop, i.e. it's
+// on the server side and its connection has a file descriptor to watch.
+func (this *service) parkable() bool {
+	if this.client || this.server == nil || this.server.loop == nil || this.timers == nil {
+		return false
+	}
+
+	_, ok := connFd(this.conn)
+	return ok
+}
+
+func (this *service) isParked() bool {
+	return atomic.LoadInt32(&this.parked) == 1
+}
+
+// park parks the service on the event loop, if it has nothing left to process or
+// send. Its goroutines then stop, the last one letting go of the buffers, and
+// the event loop wakes it once there's something to read. last is when something
+// was last read from the connection. It returns whether the service is parked.
+func (this *service) park(last time.Time) bool {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	if this.isDone() || this.handingOff() || this.in.Len() > 0 || this.out.Len() > 0 {
+		return false
+	}
+
+	fd, ok := connFd(this.conn)
+	if !ok {
+		return false
+	}
+
+	atomic.StoreInt32(&this.parked, 1)
+
+	if err := this.server.loop.add(this, fd); err != nil {
+		this.logger().Error("service/park: Error adding connection to event loop", logging.Err(err))
+		atomic.StoreInt32(&this.parked, 0)
+		return false
+	}
+
+	this.pfd = fd
+	this.lastRead = last.UnixNano()
+	atomic.AddInt64(&this.server.parked, 1)
+
+	if this.keepAlive > 0 {
+		this.ptimer = this.timers.AfterFunc(this.keepAliveTimeout()-time.Since(last), func() {
+			go this.expireParked()
+		})
+	}
+
+	// The processor stops once the receiver has returned, and closed the
+	// incoming buffer
+	this.out.Close()
+
+	this.logger().Debug("service/park: Connection parked")
+
+	return true
+}
+
+// exited is called by each of the goroutines of the service as it stops, in
+// place of wgStopped.Done. The last one of a parked service lets go of the
+// buffers, so the connection only takes its file descriptor on the event loop.
+func (this *service) exited() {
+	last := atomic.AddInt32(&this.loops, -1) == 0
+
+	this.wgStopped.Done()
+
+	if !last || !this.isParked() {
+		return
+	}
+
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	// It may have been unparked in the meantime
+	if this.isParked() {
+		this.in, this.out = nil, nil
+		this.releaseBuffers()
+	}
+}
+
+// wake unparks the service once there's something to read from its connection.
+func (this *service) wake() {
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	if err := this.unpark(); err != nil && !this.isDone() {
+		this.logger().Error("service/wake: Error unparking connection", logging.Err(err))
+	}
+}
+
+// unpark takes the service off the event loop, and starts its goroutines again
+// with new buffers. It does nothing if the service isn't parked. The caller must
+// hold the write mutex.
+func (this *service) unpark() error {
+	if !this.isParked() {
+		return nil
+	}
+
+	if this.isDone() {
+		return io.EOF
+	}
+
+	// The goroutines may still be on their way out, and mustn't find the service
+	// unparked until they are gone
+	this.server.loop.remove(this, this.pfd)
+	this.wgStopped.Wait()
+	this.unloop()
+
+	// The keepalive may have run out in the meantime
+	if this.isDone() {
+		return io.EOF
+	}
+
+	if err := this.newBuffers(); err != nil {
+		return err
+	}
+
+	this.run()
+
+	this.logger().Debug("service/unpark: Connection unparked")
+
+	return nil
+}
+
+// unloop takes a parked service off the event loop. The caller must hold the
+// write mutex.
+func (this *service) unloop() {
+	if !this.isParked() {
+		return
+	}
+
+	this.server.loop.remove(this, this.pfd)
+
+	if this.ptimer != nil {
+		this.ptimer.Stop()
+		this.ptimer = nil
+	}
+
+	atomic.StoreInt32(&this.parked, 0)
+	atomic.AddInt64(&this.server.parked, -1)
+}
+
+// expireParked stops a parked service whose client has been silent for longer
+// than its keepalive.
+func (this *service) expireParked() {
+	if !this.isParked() {
+		return
+	}
+
+	this.logger().Error("service/expireParked: No data received, closing connection.")
+
+	atomic.StoreInt32(&this.dropped, 1)
+	this.stopWith(DisconnectKeepAlive)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+// epoll is the poller on Linux. Each connection is watched once, and is taken
+// off the epoll set as soon as it's readable, so it's only ever woken once.
+type epoll struct {
+	fd  int
+	log logging.Logger
+
+	mu   sync.Mutex
+	svcs map[int]*service
+
+	done int32
+}
+
+func newPoller(log logging.Logger) (poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &epoll{
+		fd:   fd,
+		log:  log,
+		svcs: make(map[int]*service),
+	}
+
+	go p.run()
+
+	return p, nil
+}
+
+func (this *epoll) add(svc *service, fd int) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	ev := syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT,
+		Fd:     int32(fd),
+	}
+
+	err := syscall.EpollCtl(this.fd, syscall.EPOLL_CTL_ADD, fd, &ev)
+	if err == syscall.EEXIST {
+		err = syscall.EpollCtl(this.fd, syscall.EPOLL_CTL_MOD, fd, &ev)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	this.svcs[fd] = svc
+
+	return nil
+}
+
+func (this *epoll) remove(svc *service, fd int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.svcs[fd] != svc {
+		return
+	}
+
+	delete(this.svcs, fd)
+	syscall.EpollCtl(this.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (this *epoll) close() error {
+	atomic.StoreInt32(&this.done, 1)
+	return nil
+}
+
+// run waits for the connections to become readable, and wakes their services,
+// until the poller is closed.
+func (this *epoll) run() {
+	defer syscall.Close(this.fd)
+
+	events := make([]syscall.EpollEvent, eventLoopEvents)
+
+	for atomic.LoadInt32(&this.done) == 0 {
+		n, err := syscall.EpollWait(this.fd, events, int(eventLoopWait.Milliseconds()))
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			this.log.Error("service/epoll: Error waiting for events", logging.Err(err))
+			return
+		}
+
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+
+			this.mu.Lock()
+			svc := this.svcs[fd]
+			delete(this.svcs, fd)
+			syscall.EpollCtl(this.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+			this.mu.Unlock()
+
+			if svc != nil {
+				go svc.wake()
+			}
+		}
+	}
+}
+
+// connFd returns the file descriptor of conn, if it has one the event loop can
+// watch. Connections that buffer what they read, such as TLS ones, don't.
+func connFd(conn io.Closer) (int, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	fd := -1
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return 0, false
+	}
+
+	return fd, fd >= 0
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package service
+
+import (
+	"io"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+// newPoller has no event loop to offer on this platform, so the connections stay
+// on their goroutines.
+func newPoller(log logging.Logger) (poller, error) {
+	return nil, ErrEventLoopNotSupported
+}
+
+func connFd(conn io.Closer) (int, bool) {
+	return 0, false
+}
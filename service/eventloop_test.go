@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerEventLoop(t *testing.T) {
+	svr := &Server{
+		EventLoop:     true,
+		EventLoopIdle: 100 * time.Millisecond,
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	received := make(chan *message.PublishMessage, 2)
+
+	sub := newSubscribeMessage(message.QosAtMostOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, c.Subscribe(sub, nil, func(msg *message.PublishMessage) error {
+		received <- msg
+		return nil
+	}))
+
+	svr.mu.Lock()
+	svc := svr.clients[c.svc.sess.ID()]
+	svr.mu.Unlock()
+
+	parked := func() bool {
+		svc.wmu.Lock()
+		defer svc.wmu.Unlock()
+
+		return svr.Stats().Parked == 1 && svc.in == nil && svc.out == nil
+	}
+
+	// It's parked once idle, without its buffers
+	require.True(t, waitFor(parked))
+
+	// A message to the client wakes it
+	msg := newTestPublish("abc")
+	msg.SetPayload([]byte("to"))
+	_, err = svr.Publish(msg, nil)
+	require.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		require.Equal(t, []byte("to"), msg.Payload())
+	case <-time.After(time.Second):
+		t.Fatal("message to parked client not delivered")
+	}
+
+	// and so does one from it
+	require.True(t, waitFor(parked))
+
+	msg = newTestPublish("abc")
+	msg.SetPayload([]byte("from"))
+	require.NoError(t, c.Publish(msg, nil))
+
+	select {
+	case msg := <-received:
+		require.Equal(t, []byte("from"), msg.Payload())
+	case <-time.After(time.Second):
+		t.Fatal("message from parked client not processed")
+	}
+
+	// A parked connection is stopped the usual way
+	require.True(t, waitFor(parked))
+
+	c.Disconnect()
+	require.True(t, waitFor(func() bool { return svr.Stats().Parked == 0 && svr.Stats().Connections == 0 }))
+}
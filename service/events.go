@@ -0,0 +1,203 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is what happened in the server, for an Event.
+type EventType int
+
+const (
+	// EventClientConnected is a client that's been sent its CONNACK.
+	EventClientConnected EventType = iota + 1
+
+	// EventClientDisconnected is a client whose connection is gone, with the
+	// DisconnectReason as the Reason of the event.
+	EventClientDisconnected
+
+	// EventSubscriptionAdded is a client that's subscribed to the Topic filter,
+	// and been granted QoS.
+	EventSubscriptionAdded
+
+	// EventMessageDropped is a message that couldn't be delivered, with the
+	// DeadLetterReason as the Reason of the event, whether or not the server
+	// has a DeadLetterTopic.
+	EventMessageDropped
+
+	// EventSessionExpired is the persistent session of a client removed after
+	// it was offline for longer than the SessionExpiry.
+	EventSessionExpired
+)
+
+func (this EventType) String() string {
+	switch this {
+	case EventClientConnected:
+		return "client_connected"
+	case EventClientDisconnected:
+		return "client_disconnected"
+	case EventSubscriptionAdded:
+		return "subscription_added"
+	case EventMessageDropped:
+		return "message_dropped"
+	case EventSessionExpired:
+		return "session_expired"
+	}
+
+	return "unknown"
+}
+
+// DefaultEventBuffer is the number of events held for a subscriber of Events
+// that's not keeping up, see Server.Events.
+const DefaultEventBuffer = 256
+
+// Event is something that happened in the server, for the applications that
+// embed it and want to act on it, see Server.Events. Only the fields that make
+// sense for its Type are set.
+type Event struct {
+	Type EventType
+
+	// ClientId is the client the event is about, or that published the dropped
+	// message, if it's known.
+	ClientId string
+
+	// Username and IP are those of the client, for the connection events.
+	Username string
+	IP       string
+
+	// Reason is why the client was disconnected, or the message dropped.
+	Reason string
+
+	// Topic is the topic filter subscribed to, or the topic of the dropped
+	// message, and QoS the QoS granted, or that of the dropped message.
+	Topic string
+	QoS   byte
+
+	// Subscriber is the client the dropped message couldn't be delivered to, if
+	// there's one.
+	Subscriber string
+
+	Time time.Time
+}
+
+// eventSub is a subscriber of Events.
+type eventSub struct {
+	ch    chan Event
+	types map[EventType]bool
+}
+
+// Events returns a channel the events of types are sent to, or all the events
+// if there are no types, and a function that stops sending them and closes the
+// channel. The events are sent as they happen, without waiting for the
+// subscriber, so the ones that don't fit in the buffer of size, or
+// DefaultEventBuffer if it's 0, are dropped, and counted in Stats.
+func (this *Server) Events(size int, types ...EventType) (<-chan Event, func()) {
+	if size <= 0 {
+		size = DefaultEventBuffer
+	}
+
+	s := &eventSub{ch: make(chan Event, size)}
+
+	if len(types) > 0 {
+		s.types = make(map[EventType]bool, len(types))
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+
+	this.emu.Lock()
+	if this.eventSubs == nil {
+		this.eventSubs = make(map[*eventSub]struct{})
+	}
+	this.eventSubs[s] = struct{}{}
+	atomic.StoreInt32(&this.eventSubCount, int32(len(this.eventSubs)))
+	this.emu.Unlock()
+
+	var once sync.Once
+
+	return s.ch, func() {
+		once.Do(func() {
+			this.emu.Lock()
+			delete(this.eventSubs, s)
+			atomic.StoreInt32(&this.eventSubCount, int32(len(this.eventSubs)))
+			close(s.ch)
+			this.emu.Unlock()
+		})
+	}
+}
+
+// HandleEvents calls fn with each of the events of types, or all the events if
+// there are no types, from a goroutine of its own, until the returned function
+// is called. It's Events with the default buffer, which fn has to keep up
+// with.
+func (this *Server) HandleEvents(fn func(Event), types ...EventType) func() {
+	ch, cancel := this.Events(0, types...)
+
+	go func() {
+		for ev := range ch {
+			fn(ev)
+		}
+	}()
+
+	return cancel
+}
+
+// emit sends ev to the subscribers of Events that want it. It costs next to
+// nothing if there are none.
+func (this *Server) emit(ev Event) {
+	if atomic.LoadInt32(&this.eventSubCount) == 0 {
+		return
+	}
+
+	ev.Time = time.Now()
+
+	this.emu.RLock()
+	defer this.emu.RUnlock()
+
+	for s := range this.eventSubs {
+		if s.types != nil && !s.types[ev.Type] {
+			continue
+		}
+
+		select {
+		case s.ch <- ev:
+		default:
+			atomic.AddInt64(&this.eventsDropped, 1)
+		}
+	}
+}
+
+// clientEvent emits the connection event typ of the client of svc.
+func (this *Server) clientEvent(svc *service, typ EventType) {
+	if atomic.LoadInt32(&this.eventSubCount) == 0 {
+		return
+	}
+
+	ev := Event{
+		Type:     typ,
+		ClientId: svc.sess.ID(),
+		Username: string(svc.sess.Cmsg.Username()),
+		IP:       addrIP(svc.remoteAddr),
+	}
+
+	if typ == EventClientDisconnected {
+		ev.Reason = svc.disconnectReason().String()
+	}
+
+	this.emit(ev)
+}
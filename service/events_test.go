@@ -0,0 +1,119 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// nextEvent returns the next event on ch, failing if there's none within a
+// second.
+func nextEvent(t *testing.T, ch <-chan Event) Event {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+
+	return Event{}
+}
+
+func TestServerEvents(t *testing.T) {
+	svr := &Server{DeadLetterNoSubscribers: true}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	ch, cancel := svr.Events(0)
+	defer cancel()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	require.NoError(t, writeMessage(conn, cmsg))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	ev := nextEvent(t, ch)
+	require.Equal(t, EventClientConnected, ev.Type)
+	require.Equal(t, string(cmsg.ClientId()), ev.ClientId)
+	require.Equal(t, "surgemq", ev.Username)
+	require.Equal(t, "127.0.0.1", ev.IP)
+	require.False(t, ev.Time.IsZero())
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	ev = nextEvent(t, ch)
+	require.Equal(t, EventSubscriptionAdded, ev.Type)
+	require.Equal(t, "abc", ev.Topic)
+	require.Equal(t, byte(message.QosAtLeastOnce), ev.QoS)
+
+	require.NoError(t, svr.PublishTopic("nobody/home", []byte("hello"), message.QosAtMostOnce, false))
+
+	ev = nextEvent(t, ch)
+	require.Equal(t, EventMessageDropped, ev.Type)
+	require.Equal(t, string(DeadLetterNoSubscribers), ev.Reason)
+	require.Equal(t, "nobody/home", ev.Topic)
+
+	require.NoError(t, writeMessage(conn, message.NewDisconnectMessage()))
+	conn.Close()
+
+	ev = nextEvent(t, ch)
+	require.Equal(t, EventClientDisconnected, ev.Type)
+	require.Equal(t, DisconnectNormal.String(), ev.Reason)
+
+	// Cancelling closes the channel
+	cancel()
+	_, ok := <-ch
+	require.False(t, ok)
+}
+
+func TestServerEventsFilterAndDrop(t *testing.T) {
+	svr := &Server{}
+
+	// Nothing to do without subscribers
+	svr.emit(Event{Type: EventSessionExpired})
+
+	ch, cancel := svr.Events(1, EventSessionExpired)
+	defer cancel()
+
+	svr.emit(Event{Type: EventClientConnected})
+	svr.emit(Event{Type: EventSessionExpired, ClientId: "a"})
+	svr.emit(Event{Type: EventSessionExpired, ClientId: "b"})
+
+	ev := nextEvent(t, ch)
+	require.Equal(t, "a", ev.ClientId)
+	require.Equal(t, int64(1), svr.Stats().EventsDropped)
+
+	got := make(chan Event, 1)
+	stop := svr.HandleEvents(func(ev Event) {
+		got <- ev
+	})
+
+	svr.emit(Event{Type: EventClientConnected, ClientId: "c"})
+	require.Equal(t, "c", nextEvent(t, got).ClientId)
+
+	stop()
+	stop()
+}
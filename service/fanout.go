@@ -0,0 +1,470 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/codec"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// FanoutOrder is the order the subscribers of a message are written to in.
+type FanoutOrder int
+
+const (
+	// FanoutInOrder writes to the subscribers in the order the TopicsProvider
+	// returns them.
+	FanoutInOrder FanoutOrder = iota
+
+	// FanoutLeastCongestedFirst writes to the clients with the least waiting in
+	// their outgoing buffers first. Writing to a client whose buffer is full
+	// blocks until there's room, holding up the clients after it, so putting the
+	// congested ones last keeps the healthy ones from waiting on them. The
+	// messages to each client still go out in the order they were published.
+	FanoutLeastCongestedFirst
+)
+
+// The DUP flag in the fixed header of a PUBLISH message. It's not passed on to
+// the subscribers, as it's only about the delivery from the publisher.
+const dupFlag = 0x08
+
+// The RETAIN flag in the fixed header of a PUBLISH message, which is cleared
+// unless the subscription has topics.RetainAsPublished.
+const retainFlag = 0x01
+
+// sharedPublish is a PUBLISH message encoded once for all the clients it's
+// delivered to. Each of them copies it straight into its outgoing buffer, and
+// only the fixed header is patched on the way.
+//
+// The buffers are pooled. Whoever holds on to one takes a reference, and the
+// buffer goes back to the pool once the last one is released.
+type sharedPublish struct {
+	buf  []byte
+	refs int32
+
+	// pidOff is where the packet ID is in buf, which each client gets one of its
+	// own in, or 0 for a QoS 0 message, which has none.
+	pidOff int
+}
+
+var sharedPool = sync.Pool{
+	New: func() interface{} {
+		return &sharedPublish{}
+	},
+}
+
+// newSharedPublish encodes the message, and returns it with one reference held
+// by the caller.
+func newSharedPublish(msg *message.PublishMessage) (*sharedPublish, error) {
+	sp := sharedPool.Get().(*sharedPublish)
+
+	l := msg.Len()
+	if l > cap(sp.buf) {
+		sp.buf = make([]byte, l)
+	} else {
+		sp.buf = sp.buf[0:l]
+	}
+
+	n, err := msg.Encode(sp.buf)
+	if err != nil {
+		sharedPool.Put(sp)
+		return nil, err
+	}
+
+	sp.buf = sp.buf[:n]
+	sp.refs = 1
+	sp.pidOff = 0
+
+	// The packet ID comes right after the topic, which comes right after the
+	// remaining length
+	if msg.QoS() != message.QosAtMostOnce {
+		i := 1
+		for sp.buf[i]&0x80 != 0 {
+			i++
+		}
+		sp.pidOff = i + 3 + len(msg.Topic())
+	}
+
+	return sp, nil
+}
+
+func (this *sharedPublish) retain() {
+	atomic.AddInt32(&this.refs, 1)
+}
+
+func (this *sharedPublish) release() {
+	if atomic.AddInt32(&this.refs, -1) == 0 {
+		sharedPool.Put(this)
+	}
+}
+
+// patch sets up the fixed header in dst, which is a copy of the shared message,
+// for one of the clients, with the RETAIN flag set if retain is true, and the
+// packet ID of the client, pktid, if the message has one.
+func (this *sharedPublish) patch(dst []byte, retain bool, pktid uint16) {
+	dst[0] &^= dupFlag
+
+	if retain {
+		dst[0] |= retainFlag
+	}
+
+	if this.pidOff > 0 {
+		binary.BigEndian.PutUint16(dst[this.pidOff:], pktid)
+	}
+}
+
+// fanout delivers a message to its subscribers. The services of this server get
+// the shared encoding, which is only made once the first of them shows up, and
+// anything else, such as a gateway or a bridge, gets the message as usual.
+//
+// The options of each subscription, which come along with the QoS in the qoss of
+// the TopicsProvider, are applied on the way: the client that published the
+// message, cid, is skipped if its subscription has topics.NoLocal, and the
+// subscriptions with topics.RetainAsPublished get the message with the RETAIN
+// flag it was published with, retained.
+type fanout struct {
+	server   *Server
+	msg      *message.PublishMessage
+	shared   *sharedPublish
+	cid      string
+	retained bool
+
+	// rmsg is the copy of msg with the RETAIN flag set, for the subscribers
+	// other than services that get it.
+	rmsg *message.PublishMessage
+
+	// smsg is msg as the services get it, which is a copy without the tenant
+	// prefix if it's published to the topics of a tenant.
+	smsg *message.PublishMessage
+}
+
+// serviceMsg returns the message the services get. The clients of a tenant
+// only ever subscribe under its prefix, so all the services that get a message
+// of a tenant are its clients, and they all get it without the prefix.
+func (this *fanout) serviceMsg() *message.PublishMessage {
+	if this.smsg == nil {
+		this.smsg = this.msg
+
+		if this.server.Tenancy != TenancyOff {
+			if t := untenantTopic(this.msg.Topic()); t != nil {
+				this.smsg = withTopic(this.msg, t)
+			}
+		}
+	}
+
+	return this.smsg
+}
+
+// service returns the service behind fn, if it's one of this server's and the
+// message can be shared with it.
+func (this *fanout) service(fn *OnPublishFunc) *service {
+	if this.server == nil {
+		return nil
+	}
+
+	this.server.smu.RLock()
+	svc := this.server.subscribers[fn]
+	this.server.smu.RUnlock()
+
+	if svc == nil {
+		return nil
+	}
+
+	if this.shared == nil {
+		sp, err := newSharedPublish(this.serviceMsg())
+		if err != nil {
+			this.server.logger().Error("service/fanout: Error encoding message", logging.Err(err))
+			return nil
+		}
+		this.shared = sp
+	}
+
+	return svc
+}
+
+// deliver sends the message to the subscriber behind fn, whose subscription has
+// the options opts.
+func (this *fanout) deliver(fn *OnPublishFunc, opts byte) {
+	if svc := this.service(fn); svc != nil {
+		this.publish(svc, opts)
+		return
+	}
+
+	this.call(fn, opts)
+}
+
+func (this *fanout) publish(svc *service, opts byte) {
+	if this.skip(svc, opts) {
+		return
+	}
+
+	// A subscription granted a lower QoS than the message's, see
+	// Server.QoSUpgrade, gets a copy at its QoS, as the encoding has the QoS
+	msg := this.serviceMsg()
+	if qos := opts & topics.QosMask; qos < msg.QoS() {
+		svc.onpub(withQoS(msg, qos, this.retain(opts)))
+		return
+	}
+
+	if err := svc.publishShared(msg, this.shared, this.retain(opts), nil); err != nil && err != ErrSlowConsumer {
+		svc.logger().Error("service/fanout: Error publishing message", logging.Err(err))
+	}
+}
+
+// call hands the message to a subscriber that's not a service.
+func (this *fanout) call(fn *OnPublishFunc, opts byte) {
+	if qos := opts & topics.QosMask; qos < this.msg.QoS() {
+		(*fn)(withQoS(this.msg, qos, this.retain(opts)))
+		return
+	}
+
+	if !this.retain(opts) {
+		(*fn)(this.msg)
+		return
+	}
+
+	if this.rmsg == nil {
+		this.rmsg = message.NewPublishMessage()
+		this.rmsg.SetTopic(this.msg.Topic())
+		this.rmsg.SetPayload(this.msg.Payload())
+		this.rmsg.SetQoS(this.msg.QoS())
+		this.rmsg.SetPacketId(this.msg.PacketId())
+		this.rmsg.SetRetain(true)
+	}
+
+	(*fn)(this.rmsg)
+}
+
+// skip returns whether the message isn't sent to svc, because it published the
+// message and its subscription has topics.NoLocal.
+func (this *fanout) skip(svc *service, opts byte) bool {
+	return opts&topics.NoLocal != 0 && this.cid != "" && svc.sess != nil && svc.sess.ID() == this.cid
+}
+
+// retain returns whether the subscription with the options opts gets the message
+// with the RETAIN flag set.
+func (this *fanout) retain(opts byte) bool {
+	return this.retained && opts&topics.RetainAsPublished != 0
+}
+
+// fanoutTarget is a subscriber in a fan-out that's ordered by congestion.
+type fanoutTarget struct {
+	fn      *OnPublishFunc
+	svc     *service
+	opts    byte
+	pending int
+}
+
+// deliverAll sends the message to the subscribers in subs, in the FanoutOrder of
+// the server. qoss are the QoS and the options of each of them, as returned by
+// the TopicsProvider along with subs.
+func (this *fanout) deliverAll(subs []interface{}, qoss []byte) error {
+	if this.server == nil || this.server.FanoutOrder != FanoutLeastCongestedFirst {
+		for i, s := range subs {
+			if s == nil {
+				continue
+			}
+
+			fn, ok := s.(*OnPublishFunc)
+			if !ok {
+				return ErrInvalidSubscriber
+			}
+
+			this.deliver(fn, qoss[i])
+		}
+
+		return nil
+	}
+
+	targets, err := this.order(subs, qoss)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range targets {
+		if t.svc != nil {
+			this.publish(t.svc, t.opts)
+		} else {
+			this.call(t.fn, t.opts)
+		}
+	}
+
+	return nil
+}
+
+// order returns the subscribers in subs, the ones with the least waiting in their
+// outgoing buffers first.
+func (this *fanout) order(subs []interface{}, qoss []byte) ([]fanoutTarget, error) {
+	targets := make([]fanoutTarget, 0, len(subs))
+
+	for i, s := range subs {
+		if s == nil {
+			continue
+		}
+
+		fn, ok := s.(*OnPublishFunc)
+		if !ok {
+			return nil, ErrInvalidSubscriber
+		}
+
+		t := fanoutTarget{fn: fn, svc: this.service(fn), opts: qoss[i]}
+		if t.svc != nil {
+			t.pending = t.svc.outPending()
+		}
+
+		targets = append(targets, t)
+	}
+
+	// Gateways and bridges don't have buffers, so they go first, in the order
+	// they subscribed in
+	sort.SliceStable(targets, func(i, j int) bool {
+		if (targets[i].svc == nil) != (targets[j].svc == nil) {
+			return targets[i].svc == nil
+		}
+
+		return targets[i].pending < targets[j].pending
+	})
+
+	return targets, nil
+}
+
+// outPending returns the number of bytes waiting in the outgoing buffer.
+func (this *service) outPending() int {
+	if out := this.out; out != nil {
+		return out.Len()
+	}
+
+	return 0
+}
+
+// done releases the shared encoding once all the subscribers have it.
+func (this *fanout) done() {
+	if this.shared != nil {
+		this.shared.release()
+		this.shared = nil
+	}
+}
+
+// publishShared is publish for a message that's already encoded in sp, sent with
+// the RETAIN flag set if retain is true.
+func (this *service) publishShared(msg *message.PublishMessage, sp *sharedPublish, retain bool, onComplete sessions.Completer) error {
+	if this.hold(msg, retain, onComplete) {
+		return nil
+	}
+
+	// The client is limited to a lower QoS than the message's
+	if qos := this.maxQos.apply(msg.QoS()); qos != msg.QoS() {
+		return this.publish(withQoS(msg, qos, retain), onComplete)
+	}
+
+	var pktid uint16
+
+	if msg.QoS() != message.QosAtMostOnce {
+		id, err := this.sess.NextPacketId()
+		if err != nil {
+			return fmt.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
+		}
+
+		pktid = id
+		msg = withPacketId(msg, pktid)
+	}
+
+	if _, err := this.writeShared(sp, retain, pktid); err == ErrSlowConsumer {
+		this.deadLetter(DeadLetterOverflow, msg)
+		return err
+	} else if err != nil {
+		return fmt.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
+	}
+
+	switch msg.QoS() {
+	case message.QosAtMostOnce:
+		if onComplete != nil {
+			return onComplete.Complete(msg, nil, nil)
+		}
+
+		return nil
+
+	case message.QosAtLeastOnce:
+		return this.wait(this.sess.Pub1ack, msg, onComplete)
+
+	case message.QosExactlyOnce:
+		return this.wait(this.sess.Pub2out, msg, onComplete)
+	}
+
+	return nil
+}
+
+// writeShared is writeMessage for a message that's already encoded in sp. It's
+// copied into the outgoing buffer, and the header and packet ID are patched
+// there.
+func (this *service) writeShared(sp *sharedPublish, retain bool, pktid uint16) (int, error) {
+	sp.retain()
+	defer sp.release()
+
+	l := len(sp.buf)
+
+	// See writeMessage
+	this.wmu.Lock()
+	defer this.wmu.Unlock()
+
+	if err := this.unpark(); err != nil {
+		return 0, err
+	}
+
+	if this.out == nil {
+		return 0, ErrBufferNotReady
+	}
+
+	// The QoS is in the fixed header
+	buf, wrap, err := this.reserve(l, sp.buf[0]>>1&0x03)
+	if err != nil {
+		return 0, err
+	}
+
+	var m int
+
+	if wrap {
+		tmp := codec.GetBuffer(l)
+		defer codec.PutBuffer(tmp)
+
+		copy(tmp, sp.buf)
+		sp.patch(tmp, retain, pktid)
+
+		m, err = this.out.Write(tmp)
+		if err != nil {
+			return m, err
+		}
+	} else {
+		copy(buf, sp.buf)
+		sp.patch(buf, retain, pktid)
+
+		m, err = this.out.WriteCommit(l)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	this.outStat.increment(int64(m))
+
+	return m, nil
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestServerPublishShared(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var conns []net.Conn
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, writeMessage(conn, newConnectMessage()))
+		_, err = getConnackMessage(conn)
+		require.NoError(t, err)
+
+		sub := newSubscribeMessage(message.QosAtMostOnce)
+		sub.SetPacketId(1)
+		require.NoError(t, writeMessage(conn, sub))
+
+		_, err = getMessageBuffer(conn, 0)
+		require.NoError(t, err)
+
+		conns = append(conns, conn)
+	}
+
+	// Something in the process gets the message itself
+	var got []*message.PublishMessage
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got = append(got, msg)
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("abc"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("abc"))
+	msg.SetPayload([]byte("shared"))
+	msg.SetDup(true)
+	msg.SetRetain(true)
+
+	_, err = svr.Publish(msg, nil)
+	require.NoError(t, err)
+
+	// Every client gets the same bytes, without the publisher's DUP and RETAIN
+	var first []byte
+
+	for _, conn := range conns {
+		buf, err := getMessageBuffer(conn, 0)
+		require.NoError(t, err)
+
+		pub := message.NewPublishMessage()
+		_, err = pub.Decode(buf)
+		require.NoError(t, err)
+		require.Equal(t, "shared", string(pub.Payload()))
+		require.False(t, pub.Dup())
+		require.False(t, pub.Retain())
+
+		if first == nil {
+			first = buf
+		}
+		require.Equal(t, first, buf)
+	}
+
+	require.Len(t, got, 1)
+	require.Equal(t, "shared", string(got[0].Payload()))
+	require.False(t, got[0].Retain())
+}
+
+func TestSharedPublishRelease(t *testing.T) {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("abc"))
+	msg.SetPayload([]byte("shared"))
+	msg.SetDup(true)
+
+	sp, err := newSharedPublish(msg)
+	require.NoError(t, err)
+	require.Equal(t, msg.Len(), len(sp.buf))
+
+	sp.retain()
+	sp.release()
+	require.Equal(t, int32(1), sp.refs)
+
+	// The patch is only applied to the copy
+	dst := make([]byte, len(sp.buf))
+	copy(dst, sp.buf)
+	sp.patch(dst, false, 0)
+
+	require.Equal(t, byte(dupFlag), sp.buf[0]&dupFlag)
+	require.Equal(t, byte(0), dst[0]&dupFlag)
+	require.Equal(t, sp.buf[1:], dst[1:])
+
+	copy(dst, sp.buf)
+	sp.patch(dst, true, 0)
+
+	require.Equal(t, byte(0), sp.buf[0]&retainFlag)
+	require.Equal(t, byte(retainFlag), dst[0]&retainFlag)
+
+	sp.release()
+	require.Equal(t, int32(0), sp.refs)
+}
+
+func TestSharedPublishPatchPacketId(t *testing.T) {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("abc"))
+	msg.SetPayload([]byte("shared"))
+	msg.SetQoS(message.QosAtLeastOnce)
+	msg.SetPacketId(7)
+
+	sp, err := newSharedPublish(msg)
+	require.NoError(t, err)
+	defer sp.release()
+
+	// Each client gets the message with a packet ID of its own
+	dst := make([]byte, len(sp.buf))
+	copy(dst, sp.buf)
+	sp.patch(dst, false, 42)
+
+	got := message.NewPublishMessage()
+	_, err = got.Decode(dst)
+	require.NoError(t, err)
+	require.Equal(t, uint16(42), got.PacketId())
+	require.Equal(t, "abc", string(got.Topic()))
+	require.Equal(t, "shared", string(got.Payload()))
+
+	// The shared message itself is left alone
+	orig := message.NewPublishMessage()
+	_, err = orig.Decode(sp.buf)
+	require.NoError(t, err)
+	require.Equal(t, uint16(7), orig.PacketId())
+}
+
+func TestFanoutLeastCongestedFirst(t *testing.T) {
+	svr := &Server{FanoutOrder: FanoutLeastCongestedFirst}
+
+	var subs []interface{}
+	svr.subscribers = make(map[*OnPublishFunc]*service)
+
+	// Clients with more and more waiting to be written, and a gateway
+	for _, pending := range []int{300, 0, 100} {
+		out, err := newBuffer(0)
+		require.NoError(t, err)
+
+		if pending > 0 {
+			_, err = out.Write(make([]byte, pending))
+			require.NoError(t, err)
+		}
+
+		svc := &service{out: out}
+		svr.subscribers[&svc.onpub] = svc
+		subs = append(subs, &svc.onpub)
+	}
+
+	var gateway OnPublishFunc = func(msg *message.PublishMessage) error {
+		return nil
+	}
+	subs = append(subs, &gateway)
+
+	f := &fanout{server: svr, msg: newTestPublish("abc")}
+	defer f.done()
+
+	targets, err := f.order(subs, make([]byte, len(subs)))
+	require.NoError(t, err)
+
+	var pending []int
+	for _, t := range targets {
+		pending = append(pending, t.pending)
+	}
+
+	require.Equal(t, []int{0, 0, 100, 300}, pending)
+	require.Nil(t, targets[0].svc)
+	require.Equal(t, &gateway, targets[0].fn)
+}
+
+func TestServerSubscriptionOptions(t *testing.T) {
+	svr := &Server{
+		SubscriptionOptions: func(cid string, topic []byte) byte {
+			return topics.NoLocal | topics.RetainAsPublished | topics.RetainSendNever
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	_, err := svr.Publish(newRetainedMessage("abc", "before"), nil)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	sub := newSubscribeMessage(message.QosAtMostOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	// RetainSendNever: the retained message isn't sent on subscribe
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err))
+
+	// NoLocal: what the client publishes isn't sent back to it
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("abc"))
+	pub.SetPayload([]byte("local"))
+	require.NoError(t, writeMessage(conn, pub))
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err))
+
+	// RetainAsPublished: the RETAIN flag is kept
+	_, err = svr.Publish(newRetainedMessage("abc", "after"), nil)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	_, err = msg.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte("after"), msg.Payload())
+	require.True(t, msg.Retain())
+
+	// The options aren't part of the QoS the client is shown with
+	clients := svr.Clients()
+	require.Equal(t, 1, len(clients))
+	require.Equal(t, byte(message.QosAtMostOnce), clients[0].Subscriptions["abc"])
+}
+
+func TestServerSubscribeRetainAsPublished(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var kept, cleared []bool
+
+	var onKept OnPublishFunc = func(msg *message.PublishMessage) error {
+		kept = append(kept, msg.Retain())
+		return nil
+	}
+	var onCleared OnPublishFunc = func(msg *message.PublishMessage) error {
+		cleared = append(cleared, msg.Retain())
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("abc"), message.QosAtMostOnce|topics.RetainAsPublished, &onKept)
+	require.NoError(t, err)
+
+	_, err = svr.Subscribe([]byte("abc"), message.QosAtMostOnce, &onCleared)
+	require.NoError(t, err)
+
+	_, err = svr.Publish(newRetainedMessage("abc", "retained"), nil)
+	require.NoError(t, err)
+
+	_, err = svr.Publish(newTestPublish("abc"), nil)
+	require.NoError(t, err)
+
+	require.Equal(t, []bool{true, false}, kept)
+	require.Equal(t, []bool{false, false}, cleared)
+}
+
+func TestServerSubscribeRetainSendIfNew(t *testing.T) {
+	svr := &Server{
+		SubscriptionOptions: func(cid string, topic []byte) byte {
+			return topics.RetainSendIfNew
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	_, err := svr.Publish(newRetainedMessage("abc", "retained"), nil)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	sub := newSubscribeMessage(message.QosAtMostOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	// The SUBACK, then the retained message
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		_, err = getMessageBuffer(conn, 0)
+		require.NoError(t, err)
+	}
+
+	// Subscribing again doesn't send it again
+	sub.SetPacketId(2)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err))
+}
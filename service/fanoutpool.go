@@ -0,0 +1,183 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// DefaultFanoutQueue is the number of messages each fan-out worker holds if
+// Server.FanoutQueue isn't set.
+const DefaultFanoutQueue = 1024
+
+// fanoutJob is a message waiting for a fan-out worker.
+type fanoutJob struct {
+	msg *message.PublishMessage
+
+	// The client that published the message, and whether it was retained
+	cid      string
+	retained bool
+
+	// The WAL record of the message, done with once it's delivered, if any
+	walId uint64
+}
+
+// fanoutPool is the workers the messages the clients publish are delivered to
+// the subscribers by, see Server.FanoutWorkers. Each client is pinned to one of
+// them by its client ID, so its messages are delivered in the order it
+// published them, even across reconnects.
+type fanoutPool struct {
+	server *Server
+	queues []chan *fanoutJob
+	wg     sync.WaitGroup
+
+	// Held for writing once the pool is stopped, after which the messages are
+	// delivered by whoever publishes them
+	mu     sync.RWMutex
+	closed bool
+}
+
+// startFanout starts the fan-out workers, if Server.FanoutWorkers is set.
+func (this *Server) startFanout() error {
+	if this.FanoutWorkers == 0 {
+		return nil
+	}
+
+	p := &fanoutPool{
+		server: this,
+		queues: make([]chan *fanoutJob, this.FanoutWorkers),
+	}
+
+	for i := range p.queues {
+		p.queues[i] = make(chan *fanoutJob, this.FanoutQueue)
+
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+
+	this.workers = p
+
+	return nil
+}
+
+// stopFanout stops the fan-out workers once they've delivered what they hold.
+func (this *Server) stopFanout() error {
+	p := this.workers
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	p.closed = true
+	for _, q := range p.queues {
+		close(q)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	return nil
+}
+
+// dispatch hands msg, published by client cid, to its fan-out worker. It blocks
+// while the worker's queue is full, holding up the client rather than the
+// other publishers. It returns false if the pool has stopped, for the message
+// to be delivered right away.
+func (this *fanoutPool) dispatch(cid string, msg *message.PublishMessage, walId uint64) bool {
+	// The message was decoded from the incoming buffer of the client, which is
+	// reused once it's processed
+	job := &fanoutJob{
+		msg:      copyPublish(msg),
+		cid:      cid,
+		retained: msg.Retain(),
+		walId:    walId,
+	}
+	job.msg.SetRetain(false)
+
+	h := fnv.New32a()
+	h.Write([]byte(cid))
+
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if this.closed {
+		return false
+	}
+
+	q := this.queues[h.Sum32()%uint32(len(this.queues))]
+
+	select {
+	case q <- job:
+	default:
+		atomic.AddInt64(&this.server.fanoutBlocked, 1)
+		q <- job
+	}
+
+	return true
+}
+
+func (this *fanoutPool) work(q chan *fanoutJob) {
+	defer this.wg.Done()
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	for job := range q {
+		this.server.deliver(job, &subs, &qoss)
+	}
+}
+
+// deliver delivers the message of job to its subscribers, with subs and qoss as
+// the scratch space for them.
+func (this *Server) deliver(job *fanoutJob, subs *[]interface{}, qoss *[]byte) {
+	defer func() {
+		if job.walId != 0 {
+			this.wal.mark(walDone, job.walId)
+		}
+	}()
+
+	msg := job.msg
+
+	if err := this.lookupSubscribers(this.topicsMgr, msg, subs, qoss); err != nil {
+		this.logger().Error("server/deliver: Error retrieving subscribers list", logging.F("client_id", job.cid), logging.Err(err))
+		return
+	}
+
+	if len(*subs) == 0 && !job.retained && this.DeadLetterNoSubscribers {
+		this.deadLetter(DeadLetter{Reason: DeadLetterNoSubscribers, ClientId: job.cid}, msg)
+	}
+
+	f := &fanout{server: this, msg: msg, cid: job.cid, retained: job.retained}
+	defer f.done()
+
+	if err := f.deliverAll(*subs, *qoss); err != nil {
+		this.logger().Error("server/deliver: Invalid onPublish Function", logging.F("client_id", job.cid))
+	}
+}
+
+// copyPublish returns a copy of msg that doesn't share its topic and payload.
+func copyPublish(msg *message.PublishMessage) *message.PublishMessage {
+	m := withTopic(msg, append([]byte(nil), msg.Topic()...))
+	m.SetPayload(append([]byte(nil), msg.Payload()...))
+
+	return m
+}
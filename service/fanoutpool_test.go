@@ -0,0 +1,164 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// blockedSubscriber is an in-process subscriber that holds up whoever delivers
+// to it until it's released.
+type blockedSubscriber struct {
+	mu      sync.Mutex
+	got     []string
+	release chan struct{}
+	onpub   OnPublishFunc
+}
+
+func newBlockedSubscriber() *blockedSubscriber {
+	this := &blockedSubscriber{release: make(chan struct{})}
+
+	this.onpub = func(msg *message.PublishMessage) error {
+		<-this.release
+
+		this.mu.Lock()
+		this.got = append(this.got, string(msg.Payload()))
+		this.mu.Unlock()
+		return nil
+	}
+
+	return this
+}
+
+func (this *blockedSubscriber) received() []string {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return append([]string(nil), this.got...)
+}
+
+func connectFanoutPublisher(t *testing.T, ln net.Listener) net.Conn {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	return conn
+}
+
+func publishPayloads(t *testing.T, conn net.Conn, n int) {
+	for i := 0; i < n; i++ {
+		msg := newPublishMessage(0, message.QosAtMostOnce)
+		msg.SetPayload([]byte(fmt.Sprint(i)))
+		require.NoError(t, writeMessage(conn, msg))
+	}
+}
+
+func ping(conn net.Conn, d time.Duration) error {
+	if err := writeMessage(conn, message.NewPingreqMessage()); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := getMessageBuffer(conn, 0)
+	return err
+}
+
+func TestServerFanoutWorkers(t *testing.T) {
+	svr := &Server{FanoutWorkers: 2}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	sub := newBlockedSubscriber()
+	_, err := svr.Subscribe([]byte("abc"), message.QosAtMostOnce, &sub.onpub)
+	require.NoError(t, err)
+
+	conn := connectFanoutPublisher(t, ln)
+	defer conn.Close()
+
+	publishPayloads(t, conn, 5)
+
+	// The publisher carries on while the subscriber is stuck
+	require.NoError(t, ping(conn, time.Second))
+	require.Empty(t, sub.received())
+
+	close(sub.release)
+
+	require.True(t, waitFor(func() bool {
+		return len(sub.received()) == 5
+	}))
+	require.Equal(t, []string{"0", "1", "2", "3", "4"}, sub.received())
+}
+
+func TestServerFanoutBackpressure(t *testing.T) {
+	svr := &Server{FanoutWorkers: 1, FanoutQueue: 1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	sub := newBlockedSubscriber()
+	_, err := svr.Subscribe([]byte("abc"), message.QosAtMostOnce, &sub.onpub)
+	require.NoError(t, err)
+
+	conn := connectFanoutPublisher(t, ln)
+	defer conn.Close()
+
+	// One with the worker, one in the queue, and one holding up the publisher
+	publishPayloads(t, conn, 3)
+
+	require.True(t, waitFor(func() bool {
+		return svr.Stats().FanoutBlocked == 1
+	}))
+	require.Equal(t, int64(1), svr.Stats().FanoutQueued)
+
+	require.True(t, isTimeout(ping(conn, 100*time.Millisecond)))
+
+	close(sub.release)
+
+	require.True(t, waitFor(func() bool {
+		return len(sub.received()) == 3
+	}))
+	require.Equal(t, []string{"0", "1", "2"}, sub.received())
+}
+
+func TestCopyPublish(t *testing.T) {
+	buf := []byte("abc")
+
+	msg := newTestPublish("abc")
+	msg.SetPayload(buf)
+	msg.SetQoS(message.QosAtLeastOnce)
+	msg.SetPacketId(7)
+	msg.SetRetain(true)
+
+	m := copyPublish(msg)
+	buf[0] = 'x'
+
+	require.Equal(t, "abc", string(m.Payload()))
+	require.Equal(t, "abc", string(m.Topic()))
+	require.Equal(t, uint16(7), m.PacketId())
+	require.True(t, m.Retain())
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"sync"
+)
+
+// Feature names a capability of the broker that's rolled out gradually, e.g. a
+// new payload validation stage, by turning it on for a few tenants first, then
+// for everyone. See Stage.Feature.
+type Feature string
+
+// Features are the feature flags of a server. A feature is on for a tenant if
+// it's been turned on for that tenant, or if it's on globally and hasn't been
+// turned off for that tenant. Features start off, and can be turned on and off
+// while the server is running, taking effect from the next message.
+//
+// The zero value has every feature off, and is ready to use.
+type Features struct {
+	mu      sync.RWMutex
+	global  map[Feature]bool
+	tenants map[string]map[Feature]bool
+}
+
+// FeatureFlag is how a feature is set, globally or for a tenant.
+type FeatureFlag struct {
+	Feature Feature
+
+	// Tenant is the tenant the flag is for, or empty for the global flag.
+	Tenant string
+
+	On bool
+}
+
+// Enable turns the feature on for all the tenants, except those it's been turned
+// off for.
+func (this *Features) Enable(f Feature) {
+	this.set("", f, true)
+}
+
+// Disable turns the feature off for all the tenants, except those it's been
+// turned on for.
+func (this *Features) Disable(f Feature) {
+	this.set("", f, false)
+}
+
+// EnableFor turns the feature on for tenant, whether it's on globally or not.
+func (this *Features) EnableFor(tenant string, f Feature) {
+	this.set(tenant, f, true)
+}
+
+// DisableFor turns the feature off for tenant, whether it's on globally or not.
+func (this *Features) DisableFor(tenant string, f Feature) {
+	this.set(tenant, f, false)
+}
+
+// Reset removes the flag tenant has for the feature, so it follows the global flag
+// again. An empty tenant removes the global flag, turning the feature off for the
+// tenants that don't have flags of their own.
+func (this *Features) Reset(tenant string, f Feature) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if tenant == "" {
+		delete(this.global, f)
+		return
+	}
+
+	if flags := this.tenants[tenant]; flags != nil {
+		delete(flags, f)
+
+		if len(flags) == 0 {
+			delete(this.tenants, tenant)
+		}
+	}
+}
+
+// Enabled is whether the feature is on for tenant. An empty tenant only has the
+// global flags.
+func (this *Features) Enabled(tenant string, f Feature) bool {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	if on, ok := this.tenants[tenant][f]; ok {
+		return on
+	}
+
+	return this.global[f]
+}
+
+// Flags returns all the flags that are set, the global ones first, then those of
+// each tenant, sorted by tenant and feature.
+func (this *Features) Flags() []FeatureFlag {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var flags []FeatureFlag
+
+	for f, on := range this.global {
+		flags = append(flags, FeatureFlag{Feature: f, On: on})
+	}
+
+	for t, fs := range this.tenants {
+		for f, on := range fs {
+			flags = append(flags, FeatureFlag{Feature: f, Tenant: t, On: on})
+		}
+	}
+
+	sort.Slice(flags, func(i, j int) bool {
+		if flags[i].Tenant != flags[j].Tenant {
+			return flags[i].Tenant < flags[j].Tenant
+		}
+
+		return flags[i].Feature < flags[j].Feature
+	})
+
+	return flags
+}
+
+func (this *Features) set(tenant string, f Feature, on bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if tenant == "" {
+		if this.global == nil {
+			this.global = make(map[Feature]bool)
+		}
+
+		this.global[f] = on
+		return
+	}
+
+	if this.tenants == nil {
+		this.tenants = make(map[string]map[Feature]bool)
+	}
+
+	flags := this.tenants[tenant]
+	if flags == nil {
+		flags = make(map[Feature]bool)
+		this.tenants[tenant] = flags
+	}
+
+	flags[f] = on
+}
+
+// FeatureEnabled is whether the feature is on for the tenant of the client cid,
+// for stages and bridges to check features of their own with.
+func (this *Server) FeatureEnabled(cid string, f Feature) bool {
+	tenant := ""
+	if this.Tenant != nil && cid != "" {
+		tenant = this.Tenant(cid)
+	}
+
+	return this.Features.Enabled(tenant, f)
+}
+
+// featureEnabled is whether the feature is on for the tenant of the client. It's
+// always off on the client side.
+func (this *service) featureEnabled(f Feature) bool {
+	if this.server == nil {
+		return false
+	}
+
+	return this.server.FeatureEnabled(this.sess.ID(), f)
+}
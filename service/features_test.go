@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/logging"
+)
+
+func TestFeatures(t *testing.T) {
+	var fs Features
+
+	require.False(t, fs.Enabled("", "validate"))
+	require.False(t, fs.Enabled("acme", "validate"))
+
+	fs.EnableFor("acme", "validate")
+	require.True(t, fs.Enabled("acme", "validate"))
+	require.False(t, fs.Enabled("globex", "validate"))
+	require.False(t, fs.Enabled("", "validate"))
+
+	fs.Enable("validate")
+	fs.DisableFor("globex", "validate")
+	require.True(t, fs.Enabled("", "validate"))
+	require.True(t, fs.Enabled("initech", "validate"))
+	require.False(t, fs.Enabled("globex", "validate"))
+
+	require.Equal(t, []FeatureFlag{
+		{Feature: "validate", On: true},
+		{Feature: "validate", Tenant: "acme", On: true},
+		{Feature: "validate", Tenant: "globex", On: false},
+	}, fs.Flags())
+
+	fs.Reset("globex", "validate")
+	require.True(t, fs.Enabled("globex", "validate"))
+
+	fs.Reset("", "validate")
+	require.False(t, fs.Enabled("globex", "validate"))
+	require.True(t, fs.Enabled("acme", "validate"))
+}
+
+func TestServerFeatureStage(t *testing.T) {
+	p := &Pipeline{}
+
+	s := appendStage("validate", PhaseValidation)
+	s.Feature = "validate"
+	require.NoError(t, p.Add(s))
+
+	svr := &Server{
+		Pipeline: p,
+		Tenant: func(cid string) string {
+			return strings.SplitN(cid, "-", 2)[0]
+		},
+	}
+
+	enabled := func(cid string) func(Feature) bool {
+		return func(f Feature) bool {
+			return svr.FeatureEnabled(cid, f)
+		}
+	}
+
+	require.Equal(t, "", string(p.process(logging.Nop(), "acme-1", newTestPublish("a/b"), false, ACLAllow, enabled("acme-1")).Payload()))
+
+	svr.Features.EnableFor("acme", "validate")
+	require.Equal(t, "validate ", string(p.process(logging.Nop(), "acme-1", newTestPublish("a/b"), false, ACLAllow, enabled("acme-1")).Payload()))
+	require.Equal(t, "", string(p.process(logging.Nop(), "globex-1", newTestPublish("a/b"), false, ACLAllow, enabled("globex-1")).Payload()))
+
+	// Not knowing the client, the stage is skipped
+	require.Equal(t, "", string(p.process(logging.Nop(), "acme-1", newTestPublish("a/b"), false, ACLAllow, nil).Payload()))
+
+	require.False(t, svr.FeatureEnabled("", "validate"))
+}
@@ -0,0 +1,477 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package service
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// handoffState is what's handed over with each connection, enough for the new
+// process to carry on with the session as if the client had just connected.
+type handoffState struct {
+	// The client's CONNECT message
+	Connect []byte `json:"connect"`
+
+	// The session's subscriptions
+	Topics []string `json:"topics"`
+	Qos    []byte   `json:"qos"`
+
+	// What's been read from the connection but not processed yet, i.e. the start
+	// of a packet that hasn't fully arrived
+	Pending []byte `json:"pending,omitempty"`
+
+	// The QoS 1 and 2 messages sent to the client and waiting for their acks, and
+	// the QoS 2 messages received from it and waiting for their PUBREL
+	Pub1ack []handoffMessage `json:"pub1ack,omitempty"`
+	Pub2out []handoffMessage `json:"pub2out,omitempty"`
+	Pub2in  []handoffMessage `json:"pub2in,omitempty"`
+}
+
+// handoffMessage is a PUBLISH waiting for its ack, and the last ack it got, if
+// any, i.e. the PUBREC of a QoS 2 message the client has received.
+type handoffMessage struct {
+	Msg []byte `json:"msg"`
+	Ack []byte `json:"ack,omitempty"`
+}
+
+// UpgradeWithHandoff is the same as Upgrade, except the connected clients are
+// handed over to the new process as well, so they stay connected. It's
+// experimental. The new process picks them up with ResumeHandoff.
+//
+// Each connection is quiesced before it's handed over: it's unsubscribed, what's
+// been read from it is processed, and what's been written to it is flushed.
+// The CONNECT message, the subscriptions and the QoS 1 and 2 messages waiting
+// for their acks go with it, so the client can ack them to the new process, but
+// messages published while the connection is handed over are not delivered to
+// it. Connections that can't be handed over, such as TLS and websocket ones,
+// stay with this server until it's closed.
+func (this *Server) UpgradeWithHandoff(name string, args ...string) (*os.Process, error) {
+	// The descriptors are only inherited by the new process as ExtraFiles
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	local := os.NewFile(uintptr(fds[0]), "handoff")
+	remote := os.NewFile(uintptr(fds[1]), "handoff")
+	defer remote.Close()
+
+	c, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	p, err := this.upgrade(name, args, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new process has its own copy, so it sees the end of the handoff once
+	// ours is closed
+	remote.Close()
+
+	this.handoffClients(c.(*net.UnixConn))
+
+	return p, nil
+}
+
+// ResumeHandoff picks up the connections handed over by the UpgradeWithHandoff
+// of the previous process, and returns the number of them. It returns once the
+// previous process is done handing them over, so it's normally run alongside
+// Serve. It does nothing if the process wasn't started by UpgradeWithHandoff.
+func (this *Server) ResumeHandoff() (int, error) {
+	env := os.Getenv(handoffEnv)
+	os.Unsetenv(handoffEnv)
+
+	if env == "" {
+		return 0, nil
+	}
+
+	fd, err := strconv.Atoi(env)
+	if err != nil {
+		return 0, fmt.Errorf("service/ResumeHandoff: Invalid %s %q", handoffEnv, env)
+	}
+
+	f := os.NewFile(uintptr(fd), "handoff")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return 0, ErrInvalidConnectionType
+	}
+
+	return this.resumeFrom(uc)
+}
+
+// handoffClients hands over all the connected clients it can on uc.
+func (this *Server) handoffClients(uc *net.UnixConn) int {
+	this.mu.Lock()
+	svcs := make([]*service, 0, len(this.clients))
+	for _, svc := range this.clients {
+		svcs = append(svcs, svc)
+	}
+	this.mu.Unlock()
+
+	n := 0
+
+	for _, svc := range svcs {
+		if err := this.handoff(svc, uc); err == ErrUpgradeNotSupported {
+			svc.logger().Info("server/UpgradeWithHandoff: Connection can't be handed over, staying connected.")
+		} else if err != nil {
+			svc.logger().Error("server/UpgradeWithHandoff: Error handing over connection", logging.Err(err))
+		} else {
+			n++
+		}
+	}
+
+	this.logger().Info("server/UpgradeWithHandoff: Handed over connections", logging.F("handed_over", n), logging.F("total", len(svcs)))
+
+	return n
+}
+
+// handoff quiesces the service, and hands its connection over on uc.
+func (this *Server) handoff(svc *service, uc *net.UnixConn) error {
+	<-svc.ready
+
+	if svc.sess == nil {
+		return ErrClientNotFound
+	}
+
+	nc, ok := svc.conn.(net.Conn)
+	if !ok {
+		return ErrUpgradeNotSupported
+	}
+
+	fl, ok := nc.(filer)
+	if !ok {
+		return ErrUpgradeNotSupported
+	}
+
+	f, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st := &handoffState{
+		Connect: make([]byte, svc.sess.Cmsg.Len()),
+	}
+
+	if _, err := svc.sess.Cmsg.Encode(st.Connect); err != nil {
+		return err
+	}
+
+	if st.Topics, st.Qos, err = svc.sess.Topics(); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&svc.handoff, 1)
+
+	// A parked connection needs its goroutines back to be quiesced
+	svc.wake()
+
+	for _, t := range st.Topics {
+		if err := this.topicsMgr.Unsubscribe([]byte(t), &svc.onpub); err != nil {
+			svc.logger().Error("server/UpgradeWithHandoff: Error unsubscribing topic", logging.F("topic", t), logging.Err(err))
+		}
+	}
+
+	// Stop reading from the connection. The processor then processes what's been
+	// read already, and stops the service. The read deadline is set again until
+	// then, as the receiver could be setting its own.
+	for i := 0; ; i++ {
+		nc.SetReadDeadline(time.Unix(1, 0))
+
+		select {
+		case <-svc.stopped:
+		case <-time.After(10 * time.Millisecond):
+			if i < 500 {
+				continue
+			}
+
+			// It's stuck, so the client is disconnected the usual way instead
+			atomic.StoreInt32(&svc.handoff, 0)
+			svc.stop()
+			return fmt.Errorf("server/UpgradeWithHandoff: Timed out quiescing connection")
+		}
+
+		break
+	}
+
+	st.Pending = svc.pending
+	st.Pub1ack = handoffInflight(svc.sess.Pub1ack)
+	st.Pub2out = handoffInflight(svc.sess.Pub2out)
+	st.Pub2in = handoffInflight(svc.sess.Pub2in)
+
+	return writeHandoff(uc, st, f)
+}
+
+// handoffInflight returns the messages in q still waiting for their acks.
+func handoffInflight(q *sessions.Ackqueue) []handoffMessage {
+	var msgs []handoffMessage
+
+	for _, am := range q.Unacked() {
+		hm := handoffMessage{Msg: am.Msgbuf}
+		if am.State != message.RESERVED {
+			hm.Ack = am.Ackbuf
+		}
+
+		msgs = append(msgs, hm)
+	}
+
+	return msgs
+}
+
+// resumeInflight puts the messages handed over by handoffInflight back in q, in
+// the state they were in.
+func resumeInflight(q *sessions.Ackqueue, msgs []handoffMessage) error {
+	for _, hm := range msgs {
+		msg := message.NewPublishMessage()
+		if _, err := msg.Decode(hm.Msg); err != nil {
+			return err
+		}
+
+		if err := q.Wait(msg, nil); err != nil {
+			return err
+		}
+
+		if hm.Ack == nil {
+			continue
+		}
+
+		ack := message.NewPubrecMessage()
+		if _, err := ack.Decode(hm.Ack); err != nil {
+			return err
+		}
+
+		if err := q.Ack(ack); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resumeFrom resumes the connections handed over on uc until it's closed.
+func (this *Server) resumeFrom(uc *net.UnixConn) (int, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	for {
+		st, f, err := readHandoff(uc)
+		if err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+
+		if err := this.resume(st, f); err != nil {
+			this.logger().Error("server/ResumeHandoff: Error resuming connection", logging.Err(err))
+		} else {
+			n++
+		}
+	}
+}
+
+// resume sets up a service for a connection that's been handed over, the same
+// way handleConnection does for a new one, except there's no CONNECT to read or
+// CONNACK to send.
+func (this *Server) resume(st *handoffState, f *os.File) (err error) {
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	req := message.NewConnectMessage()
+	if _, err = req.Decode(st.Connect); err != nil {
+		return err
+	}
+
+	if len(st.Topics) != len(st.Qos) {
+		return fmt.Errorf("server/ResumeHandoff: Invalid subscriptions")
+	}
+
+	release, err := this.acquireConn(conn)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	svc := this.newService(conn, req, release)
+	svc.pending = st.Pending
+
+	cid := string(req.ClientId())
+	svc.log = svc.log.With(logging.F("client_id", cid))
+	this.takeover(cid, svc)
+
+	defer func() {
+		if err != nil {
+			this.unregister(cid, svc)
+		}
+		close(svc.ready)
+	}()
+
+	if err = this.getSession(svc, req, message.NewConnackMessage()); err != nil {
+		return err
+	}
+
+	for i, t := range st.Topics {
+		if err = svc.sess.AddTopic(t, st.Qos[i]); err != nil {
+			return err
+		}
+	}
+
+	if err = resumeInflight(svc.sess.Pub1ack, st.Pub1ack); err != nil {
+		return err
+	}
+
+	if err = resumeInflight(svc.sess.Pub2out, st.Pub2out); err != nil {
+		return err
+	}
+
+	if err = resumeInflight(svc.sess.Pub2in, st.Pub2in); err != nil {
+		return err
+	}
+
+	if err = svc.start(); err != nil {
+		svc.stop()
+		return err
+	}
+
+	this.addSubscriber(svc)
+	atomic.AddInt64(&this.accepted, 1)
+
+	svc.logger().Info("server/ResumeHandoff: Connection resumed.")
+
+	return nil
+}
+
+// writeHandoff sends the connection's file descriptor along with the length of
+// the state, and then the state itself. The descriptor can only be received
+// with the bytes it's sent with, so the length goes on its own.
+func writeHandoff(uc *net.UnixConn, st *handoffState, f *os.File) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var rights []byte
+	rc.Control(func(fd uintptr) {
+		rights = syscall.UnixRights(int(fd))
+	})
+
+	hdr := make([]byte, 4)
+	binary.BigEndian.PutUint32(hdr, uint32(len(b)))
+
+	if _, _, err := uc.WriteMsgUnix(hdr, rights, nil); err != nil {
+		return err
+	}
+
+	_, err = uc.Write(b)
+	return err
+}
+
+// readHandoff receives a connection sent by writeHandoff. It returns io.EOF once
+// there are no more.
+func readHandoff(uc *net.UnixConn) (*handoffState, *os.File, error) {
+	hdr := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(4))
+
+	n, oobn, _, _, err := uc.ReadMsgUnix(hdr, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, nil, fmt.Errorf("server/ResumeHandoff: No connection received")
+	}
+
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return nil, nil, fmt.Errorf("server/ResumeHandoff: No connection received")
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "handoff")
+
+	if _, err := io.ReadFull(uc, hdr[n:]); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	b := make([]byte, binary.BigEndian.Uint32(hdr))
+	if _, err := io.ReadFull(uc, b); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	st := &handoffState{}
+	if err := json.Unmarshal(b, st); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return st, f, nil
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package service
+
+import "os"
+
+// UpgradeWithHandoff needs file descriptor passing, which isn't supported on
+// this platform. Use Upgrade instead.
+func (this *Server) UpgradeWithHandoff(name string, args ...string) (*os.Process, error) {
+	return nil, ErrUpgradeNotSupported
+}
+
+// ResumeHandoff does nothing on this platform, as there's never anything handed
+// over.
+func (this *Server) ResumeHandoff() (int, error) {
+	return 0, nil
+}
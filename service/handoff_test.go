@@ -0,0 +1,258 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package service
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerHandoff(t *testing.T) {
+	svr1 := &Server{}
+
+	ln := serveTestServer(t, svr1)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("handedover"))
+	require.NoError(t, writeMessage(conn, cmsg))
+
+	connack, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	sub := newSubscribeMessage(message.QosAtMostOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	// The second server stands in for the new process
+	svr2 := &Server{}
+	defer svr2.Close()
+
+	handoffTo(t, svr1, svr2)
+
+	clients := svr2.Clients()
+	require.Len(t, clients, 1)
+	require.Equal(t, "handedover", clients[0].ClientId)
+	require.Equal(t, map[string]byte{"abc": message.QosAtMostOnce}, clients[0].Subscriptions)
+
+	// The client is still on the same connection, now served by the new server
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("abc"))
+	msg.SetPayload([]byte("still here"))
+
+	_, err = svr2.Publish(msg, nil)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	pub := message.NewPublishMessage()
+	_, err = pub.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, "still here", string(pub.Payload()))
+
+	require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+
+	buf, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.PINGRESP, message.MessageType(buf[0]>>4))
+}
+
+func TestServerHandoffInflight(t *testing.T) {
+	svr1 := &Server{}
+
+	ln := serveTestServer(t, svr1)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("handedover"))
+	require.NoError(t, writeMessage(conn, cmsg))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	sub := newSubscribeMessage(message.QosExactlyOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	// A QoS 1 message that's not acked
+	_, err = svr1.Publish(newPublishMessage(0, message.QosAtLeastOnce), nil)
+	require.NoError(t, err)
+
+	pub1 := readHandoffPublish(t, conn)
+
+	// A QoS 2 message that's received, but not completed
+	_, err = svr1.Publish(newPublishMessage(0, message.QosExactlyOnce), nil)
+	require.NoError(t, err)
+
+	pub2 := readHandoffPublish(t, conn)
+
+	pubrec := message.NewPubrecMessage()
+	pubrec.SetPacketId(pub2.PacketId())
+	require.NoError(t, writeMessage(conn, pubrec))
+
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.PUBREL, message.MessageType(buf[0]>>4))
+
+	// A QoS 2 message from the client that's not released
+	pub3 := newPublishMessage(7, message.QosExactlyOnce)
+	pub3.SetTopic([]byte("def"))
+	require.NoError(t, writeMessage(conn, pub3))
+
+	buf, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.PUBREC, message.MessageType(buf[0]>>4))
+
+	svr2 := &Server{}
+	defer svr2.Close()
+
+	handoffTo(t, svr1, svr2)
+
+	svr2.mu.Lock()
+	svc := svr2.clients["handedover"]
+	svr2.mu.Unlock()
+
+	in1 := svc.sess.Pub1ack.Unacked()
+	require.Len(t, in1, 1)
+	require.Equal(t, pub1.PacketId(), in1[0].Pktid)
+	require.Equal(t, message.RESERVED, in1[0].State)
+
+	in2 := svc.sess.Pub2out.Unacked()
+	require.Len(t, in2, 1)
+	require.Equal(t, pub2.PacketId(), in2[0].Pktid)
+	require.Equal(t, message.PUBREC, in2[0].State)
+
+	// The client carries on acking them with the new server
+	puback := message.NewPubackMessage()
+	puback.SetPacketId(pub1.PacketId())
+	require.NoError(t, writeMessage(conn, puback))
+
+	pubcomp := message.NewPubcompMessage()
+	pubcomp.SetPacketId(pub2.PacketId())
+	require.NoError(t, writeMessage(conn, pubcomp))
+
+	// And the message it published is released to the subscribers
+	released := make(chan *message.PublishMessage, 1)
+	onpub := OnPublishFunc(func(msg *message.PublishMessage) error {
+		released <- msg
+		return nil
+	})
+
+	_, err = svr2.Subscribe([]byte("def"), message.QosExactlyOnce, &onpub)
+	require.NoError(t, err)
+
+	pubrel := message.NewPubrelMessage()
+	pubrel.SetPacketId(7)
+	require.NoError(t, writeMessage(conn, pubrel))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.PUBCOMP, message.MessageType(buf[0]>>4))
+
+	select {
+	case msg := <-released:
+		require.Equal(t, "def", string(msg.Topic()))
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the released message")
+	}
+
+	require.Empty(t, svc.sess.Pub1ack.Unacked())
+	require.Empty(t, svc.sess.Pub2out.Unacked())
+	require.Empty(t, svc.sess.Pub2in.Unacked())
+}
+
+// handoffTo hands the clients of svr1 over to svr2, the way UpgradeWithHandoff
+// and ResumeHandoff do from one process to the next.
+func handoffTo(t *testing.T, svr1, svr2 *Server) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+
+	uc1 := newUnixConn(t, fds[0])
+	uc2 := newUnixConn(t, fds[1])
+	defer uc2.Close()
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	resumed := make(chan result, 1)
+	go func() {
+		n, err := svr2.resumeFrom(uc2)
+		resumed <- result{n, err}
+	}()
+
+	require.Equal(t, 1, svr1.handoffClients(uc1))
+	uc1.Close()
+
+	select {
+	case r := <-resumed:
+		require.NoError(t, r.err)
+		require.Equal(t, 1, r.n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the connection to be resumed")
+	}
+
+	require.Len(t, svr1.Clients(), 0)
+}
+
+func readHandoffPublish(t *testing.T, conn net.Conn) *message.PublishMessage {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	pub := message.NewPublishMessage()
+	_, err = pub.Decode(buf)
+	require.NoError(t, err)
+
+	return pub
+}
+
+func newUnixConn(t *testing.T, fd int) *net.UnixConn {
+	f := os.NewFile(uintptr(fd), "handoff")
+	defer f.Close()
+
+	c, err := net.FileConn(f)
+	require.NoError(t, err)
+
+	return c.(*net.UnixConn)
+}
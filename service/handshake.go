@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+var (
+	ErrHandshakeTimeout  error = errors.New("service: Handshake timed out")
+	ErrTooManyHandshakes error = errors.New("service: Too many connections in handshake")
+)
+
+// DefaultHandshakeTimeout is how long a connection has from being accepted to
+// being sent its CONNACK, see Server.HandshakeTimeout.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// startHandshake closes conn unless its handshake is over within the
+// HandshakeTimeout. The returned function ends the handshake, and returns
+// ErrHandshakeTimeout if it's too late. It can be called more than once. It
+// returns ErrTooManyHandshakes if there are already MaxHandshakes connections
+// in their handshakes.
+func (this *Server) startHandshake(conn net.Conn) (func() error, error) {
+	if n := atomic.AddInt64(&this.handshaking, 1); this.MaxHandshakes > 0 && n > int64(this.MaxHandshakes) {
+		atomic.AddInt64(&this.handshaking, -1)
+		atomic.AddInt64(&this.handshakesRejected, 1)
+		return nil, ErrTooManyHandshakes
+	}
+
+	var once sync.Once
+
+	done := func() {
+		once.Do(func() {
+			atomic.AddInt64(&this.handshaking, -1)
+		})
+	}
+
+	if this.HandshakeTimeout < 0 {
+		return func() error {
+			done()
+			return nil
+		}, nil
+	}
+
+	var expired int32
+
+	t := time.AfterFunc(this.HandshakeTimeout, func() {
+		atomic.StoreInt32(&expired, 1)
+		atomic.AddInt64(&this.handshakeTimeouts, 1)
+
+		this.logger().Error("server/handleConnection: Handshake timed out, closing connection",
+			logging.F("remote_addr", conn.RemoteAddr().String()), logging.F("timeout", this.HandshakeTimeout))
+		conn.Close()
+	})
+
+	return func() error {
+		done()
+
+		if !t.Stop() && atomic.LoadInt32(&expired) == 1 {
+			return ErrHandshakeTimeout
+		}
+
+		return nil
+	}, nil
+}
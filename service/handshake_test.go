@@ -0,0 +1,64 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerHandshakeTimeout(t *testing.T) {
+	svr := &Server{HandshakeTimeout: 100 * time.Millisecond, ConnectTimeout: 10}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The start of a CONNECT, and then nothing, well within the connect timeout
+	cmsg := newConnectMessage()
+	buf := make([]byte, cmsg.Len())
+	_, err = cmsg.Encode(buf)
+	require.NoError(t, err)
+
+	_, err = conn.Write(buf[:4])
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 4))
+	require.Equal(t, io.EOF, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	require.True(t, waitFor(func() bool {
+		return svr.Stats().HandshakeTimeouts == 1
+	}), "Timed out waiting for the handshake timeout to be counted")
+
+	// Clients that get through in time aren't affected
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int64(1), svr.Stats().HandshakeTimeouts)
+	require.Equal(t, 1, svr.Stats().Connections)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// ReplayPrefix is put in front of a topic filter to subscribe to it and have the
+// history of its topics replayed first, as $replay/{filter}. See
+// Server.History. The subscription itself is to the filter, without the prefix.
+const ReplayPrefix = "$replay/"
+
+// HistoryPolicy keeps the last messages published on the topics matching Filter,
+// for the subscribers that ask for them to be replayed, going beyond the single
+// retained message of each topic. At least one of Messages and Age has to be
+// set for the policy to keep anything.
+type HistoryPolicy struct {
+	// Filter is the topic filter of the topics the policy is for. It can have
+	// wildcards.
+	Filter string
+
+	// Messages is the number of messages kept for each topic. If not set then
+	// there's no limit other than Age.
+	Messages int
+
+	// Age is how long the messages are kept for. If not set then there's no
+	// limit other than Messages.
+	Age time.Duration
+}
+
+// historyEntry is one of the messages kept in the history of a topic, in the
+// order they were published in across all the topics.
+type historyEntry struct {
+	msg *message.PublishMessage
+	at  time.Time
+	seq uint64
+}
+
+// historyPolicy returns the first of the History policies whose filter matches
+// topic, and false if there's none that keeps anything.
+func (this *Server) historyPolicy(topic []byte) (HistoryPolicy, bool) {
+	for _, p := range this.History {
+		if topics.Match([]byte(p.Filter), topic) {
+			return p, p.Messages > 0 || p.Age > 0
+		}
+	}
+
+	return HistoryPolicy{}, false
+}
+
+// record adds a copy of msg to the history of its topic, if a History policy
+// keeps it, dropping the ones past the limits of the policy.
+func (this *Server) record(msg *message.PublishMessage) {
+	if len(this.History) == 0 {
+		return
+	}
+
+	p, ok := this.historyPolicy(msg.Topic())
+	if !ok {
+		return
+	}
+
+	m := withTopic(msg, append([]byte(nil), msg.Topic()...))
+	m.SetPayload(append([]byte(nil), msg.Payload()...))
+	m.SetRetain(false)
+
+	now := time.Now()
+
+	this.hmu.Lock()
+	defer this.hmu.Unlock()
+
+	if this.history == nil {
+		this.history = make(map[string][]historyEntry)
+	}
+
+	this.hseq++
+
+	topic := string(msg.Topic())
+	entries := append(this.history[topic], historyEntry{msg: m, at: now, seq: this.hseq})
+
+	if p.Messages > 0 && len(entries) > p.Messages {
+		entries = append(entries[:0:0], entries[len(entries)-p.Messages:]...)
+	}
+
+	this.history[topic] = expireHistory(entries, p.Age, now)
+}
+
+// expireHistory drops the entries older than age from the front of entries.
+func expireHistory(entries []historyEntry, age time.Duration, now time.Time) []historyEntry {
+	if age <= 0 {
+		return entries
+	}
+
+	i := 0
+	for i < len(entries) && now.Sub(entries[i].at) > age {
+		i++
+	}
+
+	return entries[i:]
+}
+
+// MessageHistory returns the messages kept in the history of the topics that
+// match filter, in the order they were published in. The messages are shared,
+// so they mustn't be changed.
+func (this *Server) MessageHistory(filter []byte) []*message.PublishMessage {
+	now := time.Now()
+
+	var entries []historyEntry
+
+	this.hmu.Lock()
+	for topic, h := range this.history {
+		if !topics.Match(filter, []byte(topic)) {
+			continue
+		}
+
+		// Topics nobody publishes to any more only get their old messages dropped
+		// as they are read.
+		p, _ := this.historyPolicy([]byte(topic))
+		if h = expireHistory(h, p.Age, now); len(h) == 0 {
+			delete(this.history, topic)
+			continue
+		}
+		this.history[topic] = h
+
+		entries = append(entries, h...)
+	}
+	this.hmu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+
+	msgs := make([]*message.PublishMessage, 0, len(entries))
+	for _, e := range entries {
+		msgs = append(msgs, e.msg)
+	}
+
+	return msgs
+}
+
+// replayFilter takes ReplayPrefix off the topic filter, and returns whether it
+// had it.
+func replayFilter(filter []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(filter, []byte(ReplayPrefix)) || len(filter) == len(ReplayPrefix) {
+		return filter, false
+	}
+
+	return filter[len(ReplayPrefix):], true
+}
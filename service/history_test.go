@@ -0,0 +1,125 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func historyMessages(msgs []*message.PublishMessage) []string {
+	ts := make([]string, 0, len(msgs))
+	for _, m := range msgs {
+		ts = append(ts, string(m.Topic())+"="+string(m.Payload()))
+	}
+	return ts
+}
+
+func newHistoryPublish(topic, payload string) *message.PublishMessage {
+	msg := newTestPublish(topic)
+	msg.SetPayload([]byte(payload))
+	return msg
+}
+
+func TestServerHistory(t *testing.T) {
+	svr := &Server{
+		History: []HistoryPolicy{
+			{Filter: "a/#", Messages: 2},
+			{Filter: "b/#", Age: 50 * time.Millisecond},
+			{Filter: "c/#"},
+		},
+	}
+
+	svr.record(newHistoryPublish("a/1", "1"))
+	svr.record(newHistoryPublish("a/2", "2"))
+	svr.record(newHistoryPublish("a/1", "3"))
+	svr.record(newHistoryPublish("a/1", "4"))
+	svr.record(newHistoryPublish("b/1", "5"))
+	svr.record(newHistoryPublish("c/1", "6"))
+	svr.record(newHistoryPublish("d/1", "7"))
+
+	// The last two of each topic, in the order they were published in
+	require.Equal(t, []string{"a/2=2", "a/1=3", "a/1=4"}, historyMessages(svr.MessageHistory([]byte("a/#"))))
+	require.Equal(t, []string{"a/1=3", "a/1=4", "b/1=5"}, historyMessages(svr.MessageHistory([]byte("+/1"))))
+
+	// Policies that keep nothing, and topics without a policy, have no history
+	require.Empty(t, svr.MessageHistory([]byte("c/#")))
+	require.Empty(t, svr.MessageHistory([]byte("d/#")))
+
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, svr.MessageHistory([]byte("b/#")))
+}
+
+func TestServerHistoryReplay(t *testing.T) {
+	svr := &Server{
+		History: []HistoryPolicy{{Filter: "#", Messages: 10}},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	for _, p := range []string{"1", "2", "3"} {
+		_, err := svr.Publish(newHistoryPublish("a/"+p, p), nil)
+		require.NoError(t, err)
+	}
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	got := make(chan *message.PublishMessage, 10)
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte(ReplayPrefix+"a/#"), message.QosAtMostOnce)
+
+	subscribed := make(chan struct{})
+	require.NoError(t, c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(subscribed)
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}))
+	<-subscribed
+
+	svr.mu.Lock()
+	svc := svr.clients[c.svc.sess.ID()]
+	svr.mu.Unlock()
+
+	// The subscription is to the filter itself
+	_, ok := svc.sess.Topic("a/#")
+	require.True(t, ok)
+
+	for _, p := range []string{"1", "2", "3", "4"} {
+		// Then it goes on as usual
+		if p == "4" {
+			_, err = svr.Publish(newHistoryPublish("a/4", "4"), nil)
+			require.NoError(t, err)
+		}
+
+		select {
+		case msg := <-got:
+			require.Equal(t, "a/"+p, string(msg.Topic()))
+			require.Equal(t, p, string(msg.Payload()))
+
+		case <-time.After(time.Second):
+			require.FailNow(t, "Timed out waiting for the message", p)
+		}
+	}
+}
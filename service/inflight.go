@@ -0,0 +1,190 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// wait puts msg, just sent to the client, in q to wait for its ack, and reaps
+// the messages q dropped to make room for it.
+func (this *service) wait(q *sessions.Ackqueue, msg message.Message, onComplete sessions.Completer) error {
+	err := q.Wait(msg, onComplete)
+	this.reap(q)
+
+	return err
+}
+
+// reap expires the messages in q that have waited longer than InflightExpiry
+// for their acks, and tells the Completers of those q dropped, expired or
+// evicted for MaxInflight, that they won't be acked. The evicted ones are dead
+// lettered as DeadLetterOverflow.
+func (this *service) reap(q *sessions.Ackqueue) {
+	if !this.client && this.server != nil && this.server.InflightExpiry > 0 {
+		q.Expire(time.Now().Add(-this.server.InflightExpiry))
+	}
+
+	for _, am := range q.Dropped() {
+		msg, err := am.Mtype.New()
+		if err != nil {
+			continue
+		}
+
+		if _, err := msg.Decode(am.Msgbuf); err != nil {
+			this.logger().Error("service/reap: Unable to decode message", logging.F("type", am.Mtype), logging.Err(err))
+			continue
+		}
+
+		if this.server != nil {
+			switch am.Err {
+			case sessions.ErrAckExpired:
+				atomic.AddInt64(&this.server.inflightExpired, 1)
+			case sessions.ErrAckEvicted:
+				atomic.AddInt64(&this.server.inflightEvicted, 1)
+			}
+		}
+
+		if pmsg, ok := msg.(*message.PublishMessage); ok && am.Err == sessions.ErrAckEvicted {
+			this.deadLetter(DeadLetterOverflow, pmsg)
+		}
+
+		if am.OnComplete != nil {
+			if err := am.OnComplete.Complete(msg, nil, am.Err); err != nil {
+				this.logger().Error("service/reap: Error running onComplete()", logging.Err(err))
+			}
+		}
+	}
+}
+
+// InflightMessage is a QoS 1 or 2 message sent to a client that's waiting for
+// its ack, and how long it's been waiting, in seconds.
+type InflightMessage struct {
+	sessions.InflightMessage
+	Age float64 `json:"age"`
+}
+
+// Inflight returns the QoS 1 and 2 messages sent to client cid that are waiting
+// for their acks, oldest first. It's ErrClientNotFound if the client isn't
+// connected.
+func (this *Server) Inflight(cid string) ([]InflightMessage, error) {
+	svc, err := this.connected(cid)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	msgs := []InflightMessage{}
+
+	for _, q := range svc.inflightQueues() {
+		for _, im := range q.Inflight() {
+			msgs = append(msgs, InflightMessage{InflightMessage: im, Age: now.Sub(im.Sent).Seconds()})
+		}
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].Sent.Before(msgs[j].Sent)
+	})
+
+	return msgs, nil
+}
+
+// RetryInflight sends the message with packet ID pktid, waiting for its ack from
+// client cid, again, without waiting for the client to reconnect. With
+// OrderedDelivery, the ones sent after it on the same topic are sent again after
+// it. It's sessions.ErrAckNotFound if there's no such message.
+func (this *Server) RetryInflight(cid string, pktid uint16) error {
+	svc, err := this.connected(cid)
+	if err != nil {
+		return err
+	}
+
+	if this.OrderedDelivery {
+		return svc.resendInflight(pktid)
+	}
+
+	for _, q := range svc.inflightQueues() {
+		msg, err := q.Retry(pktid)
+		if err == sessions.ErrAckNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		svc.logger().Info("server/RetryInflight: Sending message again", logging.F("type", msg.Name()), logging.F("packet_id", pktid))
+
+		_, err = svc.writeMessage(msg)
+		return err
+	}
+
+	return sessions.ErrAckNotFound
+}
+
+// DiscardInflight gives up on the message with packet ID pktid waiting for its
+// ack from client cid, the same as if it had expired, without disconnecting the
+// client. It's sessions.ErrAckNotFound if there's no such message.
+func (this *Server) DiscardInflight(cid string, pktid uint16) error {
+	svc, err := this.connected(cid)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range svc.inflightQueues() {
+		err := q.Discard(pktid)
+		if err == sessions.ErrAckNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		svc.logger().Info("server/DiscardInflight: Discarding message", logging.F("packet_id", pktid))
+
+		svc.reap(q)
+		return nil
+	}
+
+	return sessions.ErrAckNotFound
+}
+
+// connected returns the service of client cid, once it's done connecting. It's
+// ErrClientNotFound if the client isn't connected.
+func (this *Server) connected(cid string) (*service, error) {
+	this.mu.Lock()
+	svc := this.clients[cid]
+	this.mu.Unlock()
+
+	if svc == nil {
+		return nil, ErrClientNotFound
+	}
+
+	<-svc.ready
+
+	if svc.sess == nil {
+		return nil, ErrClientNotFound
+	}
+
+	return svc, nil
+}
+
+// inflightQueues are the queues of the messages sent to the client that wait
+// for their acks.
+func (this *service) inflightQueues() []*sessions.Ackqueue {
+	return []*sessions.Ackqueue{this.sess.Pub1ack, this.sess.Pub2out}
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+func newInflightTestService(t *testing.T, svr *Server) *service {
+	out, err := newBuffer(defaultBufferSize)
+	require.NoError(t, err)
+
+	sess := &sessions.Session{}
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	if svr.MaxInflight > 0 {
+		sess.SetInflightLimit(svr.MaxInflight)
+	}
+
+	return &service{out: out, server: svr, sess: sess}
+}
+
+func TestServiceMaxInflight(t *testing.T) {
+	svr := &Server{MaxInflight: 2}
+	svc := newInflightTestService(t, svr)
+
+	errs := make(chan error, 3)
+	var onc OnCompleteFunc = func(msg, ack message.Message, err error) error {
+		errs <- err
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, svc.publish(newPublishMessage(0, message.QosAtLeastOnce), onc))
+	}
+
+	// The oldest is given up on to make room for the third
+	require.Equal(t, sessions.ErrAckEvicted, <-errs)
+	require.Len(t, errs, 0)
+
+	require.Equal(t, 2, svc.sess.Pub1ack.Stats().Len)
+	require.Equal(t, int64(1), svr.Stats().InflightEvicted)
+}
+
+func TestServiceInflightExpiry(t *testing.T) {
+	svr := &Server{InflightExpiry: 10 * time.Millisecond}
+	svc := newInflightTestService(t, svr)
+
+	errs := make(chan error, 2)
+	var onc OnCompleteFunc = func(msg, ack message.Message, err error) error {
+		errs <- err
+		return nil
+	}
+
+	require.NoError(t, svc.publish(newPublishMessage(0, message.QosAtLeastOnce), onc))
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, svc.publish(newPublishMessage(0, message.QosAtLeastOnce), onc))
+
+	require.Equal(t, sessions.ErrAckExpired, <-errs)
+	require.Len(t, errs, 0)
+	require.Equal(t, int64(1), svr.Stats().InflightExpired)
+}
+
+func TestServerRetryDiscardInflight(t *testing.T) {
+	svr := &Server{}
+	svc := newInflightTestService(t, svr)
+	svc.ready = make(chan struct{})
+	close(svc.ready)
+
+	cid := svc.sess.ID()
+	svr.clients = map[string]*service{cid: svc}
+
+	_, err := svr.Inflight("nobody")
+	require.Equal(t, ErrClientNotFound, err)
+
+	errs := make(chan error, 2)
+	var onc OnCompleteFunc = func(msg, ack message.Message, err error) error {
+		errs <- err
+		return nil
+	}
+
+	require.NoError(t, svc.publish(newPublishMessage(0, message.QosAtLeastOnce), onc))
+	require.NoError(t, svc.publish(newPublishMessage(0, message.QosExactlyOnce), onc))
+
+	msgs, err := svr.Inflight(cid)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, byte(message.QosAtLeastOnce), msgs[0].QoS)
+	require.Equal(t, byte(message.QosExactlyOnce), msgs[1].QoS)
+	require.True(t, msgs[0].Age >= 0)
+
+	// Sent again as is
+	sent := svc.out.Len()
+	require.NoError(t, svr.RetryInflight(cid, msgs[1].PacketId))
+	require.True(t, svc.out.Len() > sent)
+
+	msgs, err = svr.Inflight(cid)
+	require.NoError(t, err)
+	require.Equal(t, 1, msgs[1].Retries)
+
+	require.Equal(t, sessions.ErrAckNotFound, svr.RetryInflight(cid, 1000))
+
+	// Given up on, without counting as evicted or expired
+	require.NoError(t, svr.DiscardInflight(cid, msgs[0].PacketId))
+	require.Equal(t, sessions.ErrAckDiscarded, <-errs)
+	require.Equal(t, sessions.ErrAckNotFound, svr.DiscardInflight(cid, msgs[0].PacketId))
+
+	msgs, err = svr.Inflight(cid)
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, int64(0), svr.Stats().InflightEvicted)
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build interop
+// +build interop
+
+// The interop tests check that QoS flows, retained messages and wills behave the
+// same across implementations, by running our Client against other brokers, and
+// other clients against our Server. They need the brokers in
+// testdata/interop/docker-compose.yml to be up, and docker to run the mosquitto
+// command line clients, and are only built with the "interop" tag:
+//
+//	docker compose -f service/testdata/interop/docker-compose.yml up -d
+//	go test -tags interop -run Interop ./service/
+//
+// The broker addresses can be changed with the SURGEMQ_INTEROP_MOSQUITTO and
+// SURGEMQ_INTEROP_EMQX environment variables. Any broker that can't be reached
+// is skipped.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	MQTT "git.eclipse.org/gitroot/paho/org.eclipse.paho.mqtt.golang.git"
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+const (
+	interopTimeout = 10 * time.Second
+)
+
+var interopBrokers = []struct {
+	name, env, uri string
+}{
+	{"mosquitto", "SURGEMQ_INTEROP_MOSQUITTO", "tcp://127.0.0.1:21883"},
+	{"emqx", "SURGEMQ_INTEROP_EMQX", "tcp://127.0.0.1:21884"},
+}
+
+// forEachInteropBroker runs f against every external broker that's reachable.
+func forEachInteropBroker(t *testing.T, f func(t *testing.T, uri string)) {
+	for _, b := range interopBrokers {
+		uri := b.uri
+		if v := os.Getenv(b.env); v != "" {
+			uri = v
+		}
+
+		t.Run(b.name, func(t *testing.T) {
+			u, err := url.Parse(uri)
+			require.NoError(t, err)
+
+			conn, err := net.DialTimeout(u.Scheme, u.Host, time.Second)
+			if err != nil {
+				t.Skipf("%s is not reachable at %s: %v", b.name, uri, err)
+			}
+			conn.Close()
+
+			f(t, uri)
+		})
+	}
+}
+
+// interopTopic returns a topic that's unique to the test, so tests don't see
+// each other's retained messages on a shared broker.
+func interopTopic(t *testing.T, name string) string {
+	return fmt.Sprintf("surgemq/interop/%s/%s/%d", strings.Replace(t.Name(), "/", "-", -1), name, time.Now().UnixNano())
+}
+
+func connectInteropClient(t *testing.T, uri string, msg *message.ConnectMessage) *Client {
+	c := &Client{}
+	require.NoError(t, c.Connect(uri, msg))
+
+	// Each client registers a topics provider under its client ID, which we
+	// don't want to collide with the next client.
+	topics.Unregister(c.svc.sess.ID())
+
+	return c
+}
+
+// subscribeInterop subscribes c to topic and returns the channel every message
+// received on it is sent to.
+func subscribeInterop(t *testing.T, c *Client, topic string, qos byte) chan *message.PublishMessage {
+	msgs := make(chan *message.PublishMessage, 10)
+	done := make(chan struct{})
+
+	sub := message.NewSubscribeMessage()
+	sub.AddTopic([]byte(topic), qos)
+
+	err := c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(done)
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		msgs <- msg
+		return nil
+	})
+	require.NoError(t, err)
+
+	select {
+	case <-done:
+	case <-time.After(interopTimeout):
+		t.Fatalf("Timed out waiting for SUBACK")
+	}
+
+	return msgs
+}
+
+func publishInterop(t *testing.T, c *Client, topic, payload string, qos byte, retain bool) {
+	done := make(chan struct{})
+
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte(topic))
+	pub.SetPayload([]byte(payload))
+	pub.SetQoS(qos)
+	pub.SetRetain(retain)
+	pub.SetPacketId(uint16(time.Now().UnixNano()%65535) + 1)
+
+	require.NoError(t, c.Publish(pub, func(msg, ack message.Message, err error) error {
+		close(done)
+		return nil
+	}))
+
+	select {
+	case <-done:
+	case <-time.After(interopTimeout):
+		t.Fatalf("Timed out waiting for QoS %d publish to complete", qos)
+	}
+}
+
+func receiveInterop(t *testing.T, msgs chan *message.PublishMessage, payload string) *message.PublishMessage {
+	select {
+	case msg := <-msgs:
+		require.Equal(t, payload, string(msg.Payload()))
+		return msg
+
+	case <-time.After(interopTimeout):
+		t.Fatalf("Timed out waiting for message %q", payload)
+	}
+
+	return nil
+}
+
+func TestInteropClientQoS(t *testing.T) {
+	forEachInteropBroker(t, func(t *testing.T, uri string) {
+		c := connectInteropClient(t, uri, newConnectMessage())
+		defer c.Disconnect()
+
+		for qos := byte(0); qos <= 2; qos++ {
+			topic := interopTopic(t, "qos"+strconv.Itoa(int(qos)))
+			msgs := subscribeInterop(t, c, topic, qos)
+
+			payload := fmt.Sprintf("qos %d", qos)
+			publishInterop(t, c, topic, payload, qos, false)
+
+			msg := receiveInterop(t, msgs, payload)
+			require.Equal(t, qos, msg.QoS())
+		}
+	})
+}
+
+func TestInteropClientRetained(t *testing.T) {
+	forEachInteropBroker(t, func(t *testing.T, uri string) {
+		topic := interopTopic(t, "retained")
+
+		c1 := connectInteropClient(t, uri, newConnectMessage())
+		publishInterop(t, c1, topic, "retained", 1, true)
+		c1.Disconnect()
+
+		c2 := connectInteropClient(t, uri, newConnectMessage())
+		defer c2.Disconnect()
+
+		msg := receiveInterop(t, subscribeInterop(t, c2, topic, 1), "retained")
+		require.True(t, msg.Retain())
+
+		// Clear the retained message so it doesn't pile up on the broker
+		publishInterop(t, c2, topic, "", 1, true)
+	})
+}
+
+func TestInteropClientWill(t *testing.T) {
+	forEachInteropBroker(t, func(t *testing.T, uri string) {
+		topic := interopTopic(t, "will")
+
+		c1 := connectInteropClient(t, uri, newConnectMessage())
+		defer c1.Disconnect()
+
+		msgs := subscribeInterop(t, c1, topic, 1)
+
+		will := newConnectMessage()
+		will.SetWillFlag(true)
+		will.SetWillTopic([]byte(topic))
+		will.SetWillMessage([]byte("gone"))
+		will.SetWillQos(1)
+
+		// Drop the connection without a DISCONNECT, the broker should send the will
+		c2 := connectInteropClient(t, uri, will)
+		c2.svc.conn.Close()
+
+		receiveInterop(t, msgs, "gone")
+	})
+}
+
+// serveInteropServer starts a Server for other clients to connect to, and returns
+// it with the host and port it's listening on.
+func serveInteropServer(t *testing.T) (*Server, net.Listener, string, string) {
+	svr := &Server{}
+	ln := serveTestServer(t, svr)
+
+	host, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+
+	return svr, ln, host, port
+}
+
+func connectPaho(t *testing.T, ln net.Listener, id string, will string) *MQTT.Client {
+	opts := MQTT.NewClientOptions().AddBroker("tcp://" + ln.Addr().String()).SetClientID(id)
+	if will != "" {
+		opts.SetWill(will, "gone", 1, false)
+	}
+
+	c := MQTT.NewClient(opts)
+
+	token := c.Connect()
+	require.True(t, token.WaitTimeout(interopTimeout), "Timed out connecting")
+	require.NoError(t, token.Error())
+
+	return c
+}
+
+func subscribePaho(t *testing.T, c *MQTT.Client, topic string, qos byte) chan MQTT.Message {
+	msgs := make(chan MQTT.Message, 10)
+
+	token := c.Subscribe(topic, qos, func(client *MQTT.Client, msg MQTT.Message) {
+		msgs <- msg
+	})
+	require.True(t, token.WaitTimeout(interopTimeout), "Timed out subscribing")
+	require.NoError(t, token.Error())
+
+	return msgs
+}
+
+func publishPaho(t *testing.T, c *MQTT.Client, topic, payload string, qos byte, retain bool) {
+	token := c.Publish(topic, qos, retain, []byte(payload))
+	require.True(t, token.WaitTimeout(interopTimeout), "Timed out publishing")
+	require.NoError(t, token.Error())
+}
+
+func receivePaho(t *testing.T, msgs chan MQTT.Message, payload string) MQTT.Message {
+	select {
+	case msg := <-msgs:
+		require.Equal(t, payload, string(msg.Payload()))
+		return msg
+
+	case <-time.After(interopTimeout):
+		t.Fatalf("Timed out waiting for message %q", payload)
+	}
+
+	return nil
+}
+
+func TestInteropPahoQoS(t *testing.T) {
+	_, ln, _, _ := serveInteropServer(t)
+	defer ln.Close()
+
+	c := connectPaho(t, ln, "paho-qos", "")
+	defer c.Disconnect(250)
+
+	for qos := byte(0); qos <= 2; qos++ {
+		topic := interopTopic(t, "qos"+strconv.Itoa(int(qos)))
+		msgs := subscribePaho(t, c, topic, qos)
+
+		payload := fmt.Sprintf("qos %d", qos)
+		publishPaho(t, c, topic, payload, qos, false)
+
+		msg := receivePaho(t, msgs, payload)
+		require.Equal(t, qos, msg.Qos())
+	}
+}
+
+func TestInteropPahoRetained(t *testing.T) {
+	_, ln, _, _ := serveInteropServer(t)
+	defer ln.Close()
+
+	topic := interopTopic(t, "retained")
+
+	c1 := connectPaho(t, ln, "paho-retained-1", "")
+	publishPaho(t, c1, topic, "retained", 1, true)
+	c1.Disconnect(250)
+
+	c2 := connectPaho(t, ln, "paho-retained-2", "")
+	defer c2.Disconnect(250)
+
+	msg := receivePaho(t, subscribePaho(t, c2, topic, 1), "retained")
+	require.True(t, msg.Retained())
+}
+
+func TestInteropPahoWill(t *testing.T) {
+	svr, ln, _, _ := serveInteropServer(t)
+	defer ln.Close()
+
+	topic := interopTopic(t, "will")
+
+	c1 := connectPaho(t, ln, "paho-will-1", "")
+	defer c1.Disconnect(250)
+
+	msgs := subscribePaho(t, c1, topic, 1)
+
+	connectPaho(t, ln, "paho-will-2", topic)
+
+	// Cut the second client off on the server side, without a DISCONNECT
+	svr.mu.Lock()
+	svc := svr.clients["paho-will-2"]
+	svr.mu.Unlock()
+
+	require.NotNil(t, svc)
+	svc.conn.Close()
+
+	receivePaho(t, msgs, "gone")
+}
+
+// mosquittoCmd runs one of the mosquitto command line clients in a container,
+// against the server on host and port.
+func mosquittoCmd(t *testing.T, tool, host, port string, args ...string) *exec.Cmd {
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skipf("docker is not installed: %v", err)
+	}
+
+	args = append([]string{"run", "--rm", "--network", "host", "eclipse-mosquitto:2", tool, "-h", host, "-p", port}, args...)
+	return exec.Command("docker", args...)
+}
+
+func TestInteropMosquittoClients(t *testing.T) {
+	_, ln, host, port := serveInteropServer(t)
+	defer ln.Close()
+
+	timeout := strconv.Itoa(int(interopTimeout / time.Second))
+
+	for qos := 0; qos <= 2; qos++ {
+		topic := interopTopic(t, "qos"+strconv.Itoa(qos))
+		payload := fmt.Sprintf("qos %d", qos)
+		q := strconv.Itoa(qos)
+
+		// Retain the message so it doesn't matter whether the subscriber is up first
+		pub := mosquittoCmd(t, "mosquitto_pub", host, port, "-t", topic, "-q", q, "-r", "-m", payload)
+		out, err := pub.CombinedOutput()
+		require.NoError(t, err, string(out))
+
+		sub := mosquittoCmd(t, "mosquitto_sub", host, port, "-t", topic, "-q", q, "-C", "1", "-W", timeout, "-F", "%q %r %p")
+		out, err = sub.CombinedOutput()
+		require.NoError(t, err, string(out))
+		require.Equal(t, fmt.Sprintf("%d 1 %s", qos, payload), strings.TrimSpace(string(out)))
+	}
+}
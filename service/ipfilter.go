@@ -0,0 +1,147 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// ipFilter is the allow and deny lists of a listener, see ListenerConfig.Allow.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newIPFilter parses the allow and deny lists, of CIDRs or single IPs. It
+// returns nil if both are empty.
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	var (
+		f   ipFilter
+		err error
+	)
+
+	if f.allow, err = parseNets(allow); err != nil {
+		return nil, err
+	}
+
+	if f.deny, err = parseNets(deny); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+// parseNets parses CIDRs, with single IPs taken as the network of just them.
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("service: Invalid IP %q", c)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("service: Invalid CIDR %q", c)
+		}
+
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+// allowed returns whether the connections from addr are let through. The deny
+// list wins over the allow list, and the addresses without an IP, such as those
+// of unix sockets, are always let through.
+func (this *ipFilter) allowed(addr net.Addr) bool {
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return true
+	}
+
+	for _, n := range this.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(this.allow) == 0 {
+		return true
+	}
+
+	for _, n := range this.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterListener is a listener that closes the connections its filter doesn't
+// let through as they are accepted, before anything is read from them, not
+// even a TLS handshake. They are counted by both the listener and the server.
+type filterListener struct {
+	net.Listener
+
+	filter         *ipFilter
+	dropped, total *int64
+}
+
+func (this *filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := this.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if this.filter.allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+
+		atomic.AddInt64(this.dropped, 1)
+		atomic.AddInt64(this.total, 1)
+		conn.Close()
+	}
+}
+
+// filtered returns ln, the listener of l, with the connections the allow and
+// deny lists of l don't let through dropped.
+func (this *Server) filtered(l *listener, ln net.Listener) net.Listener {
+	if l.filter == nil {
+		return ln
+	}
+
+	return &filterListener{Listener: ln, filter: l.filter, dropped: &l.dropped, total: &this.ipDropped}
+}
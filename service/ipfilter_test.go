@@ -0,0 +1,79 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	f, err := newIPFilter([]string{"10.0.0.0/8", "192.168.1.7", "2001:db8::/32"}, []string{"10.1.0.0/16"})
+	require.NoError(t, err)
+
+	for addr, ok := range map[string]bool{
+		"10.2.3.4:1883":        true,
+		"10.1.2.3:1883":        false,
+		"192.168.1.7:1883":     true,
+		"192.168.1.8:1883":     false,
+		"[2001:db8::1]:1883":   true,
+		"[2001:db9::1]:1883":   false,
+		"[::ffff:10.2.3.4]:80": true,
+	} {
+		tcp, err := net.ResolveTCPAddr("tcp", addr)
+		require.NoError(t, err)
+		require.Equal(t, ok, f.allowed(tcp), addr)
+	}
+
+	// Unix sockets have no IP to check
+	require.True(t, f.allowed(&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}))
+
+	f, err = newIPFilter(nil, nil)
+	require.NoError(t, err)
+	require.Nil(t, f)
+
+	_, err = newIPFilter([]string{"10.0.0.0/33"}, nil)
+	require.Error(t, err)
+
+	_, err = newIPFilter(nil, []string{"localhost"})
+	require.Error(t, err)
+}
+
+func TestServerListenerDeny(t *testing.T) {
+	svr := newListenerTestServer()
+	defer svr.Close()
+
+	require.NoError(t, svr.AddListener(ListenerConfig{Name: "denied", URI: "tcp://127.0.0.1:0", Deny: []string{"127.0.0.0/8"}}))
+	require.NoError(t, svr.AddListener(ListenerConfig{Name: "allowed", URI: "tcp://127.0.0.1:0", Allow: []string{"127.0.0.1"}}))
+	require.Error(t, svr.AddListener(ListenerConfig{Name: "invalid", URI: "tcp://127.0.0.1:0", Allow: []string{"nowhere"}}))
+
+	_, err := connectListener(t, svr, "denied")
+	require.Error(t, err)
+
+	c, err := connectListener(t, svr, "allowed")
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	infos := svr.Listeners()
+	require.Equal(t, "allowed", infos[0].Name)
+	require.Equal(t, int64(0), infos[0].Dropped)
+	require.Equal(t, "denied", infos[1].Name)
+	require.Equal(t, int64(1), infos[1].Dropped)
+	require.Equal(t, int64(0), infos[1].Accepted)
+
+	require.Equal(t, int64(1), svr.Stats().IPDropped)
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// The number of connections dropped while idle before a shorter keepalive is
+	// suggested, and the share of the connections they must be
+	keepAliveDrops = 3
+
+	// The shortest keepalive ever suggested, in seconds
+	minSuggestedKeepAlive = 10
+
+	// The suggested keepalive is at least this many round trips
+	keepAliveRTTs = 4
+
+	// The number of client IDs tracked. The one seen the longest ago is dropped
+	// to make room for a new one.
+	maxKeepAliveReports = 10000
+
+	// The weight of a new round trip time sample in the smoothed RTT, as in TCP
+	rttAlpha = 0.125
+)
+
+// KeepAliveReport is what the server has seen of the connections of a client ID
+// since it last changed its keepalive, and the keepalive it suggests instead if
+// the connections keep getting dropped while idle. That's typically a NAT or a
+// firewall on the way timing the connection out sooner than the client pings.
+type KeepAliveReport struct {
+	ClientId string `json:"client_id"`
+
+	// The keepalive the client connects with, in seconds
+	KeepAlive int `json:"keep_alive"`
+
+	// The number of connections that have ended, and how many of them were
+	// dropped rather than closed by the client or the server. A connection is
+	// dropped when it times out, fails, or is taken over by a new connection
+	// from the same client while the server still thinks it's open.
+	Connections int `json:"connections"`
+	Dropped     int `json:"dropped"`
+
+	// The number of the dropped connections that had been idle for longer than
+	// the keepalive, i.e. the client's PINGREQs stopped getting through, and the
+	// shortest time any of them had been idle, in seconds
+	IdleDrops int     `json:"idle_drops"`
+	MinIdle   float64 `json:"min_idle,omitempty"`
+
+	// The smoothed round trip time of the QoS 1 messages sent to the client, from
+	// the PUBLISH to the PUBACK, in milliseconds
+	RTT float64 `json:"rtt_ms,omitempty"`
+
+	// The keepalive suggested for the client, in seconds, if it should change
+	Suggested int    `json:"suggested_keep_alive,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+
+	// When the client last connected or disconnected
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// trackKeepAlive returns whether the service's connection is watched for
+// KeepAliveReports.
+func (this *service) trackKeepAlive() bool {
+	return this.server != nil && this.server.AdviseKeepAlive
+}
+
+// received records that a message was received from the client.
+func (this *service) received() {
+	if this.trackKeepAlive() {
+		atomic.StoreInt64(&this.lastRecv, time.Now().UnixNano())
+	}
+}
+
+// observeRTT records the time it took the client to acknowledge a message sent
+// to it.
+func (this *service) observeRTT(sent time.Time) {
+	if !this.trackKeepAlive() || sent.IsZero() {
+		return
+	}
+
+	this.server.keepAliveRTT(this.sess.ID(), time.Since(sent))
+}
+
+// keepAliveConnected starts tracking the connection of the service. The counts
+// start again if the client has changed its keepalive, as they are about the old
+// one.
+func (this *Server) keepAliveConnected(svc *service) {
+	if !this.AdviseKeepAlive {
+		return
+	}
+
+	atomic.StoreInt64(&svc.lastRecv, time.Now().UnixNano())
+
+	this.kmu.Lock()
+	defer this.kmu.Unlock()
+
+	r := this.keepAliveReport(svc.sess.ID())
+
+	if r.KeepAlive != svc.keepAlive {
+		*r = KeepAliveReport{
+			ClientId: r.ClientId,
+			RTT:      r.RTT,
+		}
+		r.KeepAlive = svc.keepAlive
+	}
+
+	r.LastSeen = time.Now()
+}
+
+// keepAliveDisconnected records how the connection of the service ended.
+func (this *Server) keepAliveDisconnected(svc *service) {
+	if !this.AdviseKeepAlive {
+		return
+	}
+
+	now := time.Now()
+	idle := now.Sub(time.Unix(0, atomic.LoadInt64(&svc.lastRecv)))
+
+	this.kmu.Lock()
+	defer this.kmu.Unlock()
+
+	r := this.keepAliveReport(svc.sess.ID())
+	r.Connections++
+	r.LastSeen = now
+
+	if atomic.LoadInt32(&svc.dropped) == 1 {
+		r.Dropped++
+
+		if idle >= time.Duration(svc.keepAlive)*time.Second {
+			r.IdleDrops++
+
+			if s := idle.Seconds(); r.MinIdle == 0 || s < r.MinIdle {
+				r.MinIdle = s
+			}
+		}
+	}
+
+	r.Suggested, r.Reason = suggestKeepAlive(r)
+}
+
+// keepAliveRTT adds a round trip time sample for cid.
+func (this *Server) keepAliveRTT(cid string, rtt time.Duration) {
+	ms := rtt.Seconds() * 1000
+
+	this.kmu.Lock()
+	defer this.kmu.Unlock()
+
+	r := this.keepAliveReport(cid)
+
+	if r.RTT == 0 {
+		r.RTT = ms
+	} else {
+		r.RTT += rttAlpha * (ms - r.RTT)
+	}
+
+	r.Suggested, r.Reason = suggestKeepAlive(r)
+}
+
+// keepAliveReport returns the report for cid, adding one if there's none yet.
+// kmu must be held.
+func (this *Server) keepAliveReport(cid string) *KeepAliveReport {
+	if this.kareports == nil {
+		this.kareports = make(map[string]*KeepAliveReport)
+	}
+
+	if r, ok := this.kareports[cid]; ok {
+		return r
+	}
+
+	if len(this.kareports) >= maxKeepAliveReports {
+		var oldest *KeepAliveReport
+
+		for _, r := range this.kareports {
+			if oldest == nil || r.LastSeen.Before(oldest.LastSeen) {
+				oldest = r
+			}
+		}
+
+		delete(this.kareports, oldest.ClientId)
+	}
+
+	r := &KeepAliveReport{ClientId: cid, LastSeen: time.Now()}
+	this.kareports[cid] = r
+
+	return r
+}
+
+// suggestKeepAlive returns the keepalive suggested for the client, or 0 if there
+// isn't enough to go on. The idle timeout of whatever is dropping the
+// connections isn't known, only that it's shorter than the time the connections
+// were idle for, so the keepalive is halved each time until the drops stop. It's
+// never shorter than a few round trips.
+func suggestKeepAlive(r *KeepAliveReport) (int, string) {
+	if r.IdleDrops < keepAliveDrops || r.IdleDrops*2 < r.Connections {
+		return 0, ""
+	}
+
+	suggested := r.KeepAlive / 2
+
+	floor := minSuggestedKeepAlive
+	if rtts := int(r.RTT*keepAliveRTTs/1000) + 1; rtts > floor {
+		floor = rtts
+	}
+
+	if suggested < floor {
+		suggested = floor
+	}
+
+	if suggested >= r.KeepAlive {
+		return 0, ""
+	}
+
+	return suggested, "connections dropped while idle"
+}
+
+// KeepAliveReports returns the reports of the client IDs that have a shorter
+// keepalive suggested, the ones with the most idle drops first. MQTT 3.1.1 has no
+// way for the server to tell a client its keepalive should change, so it's up to
+// the operator, or whatever manages the clients, to act on them. Reports are only
+// kept if AdviseKeepAlive is set.
+func (this *Server) KeepAliveReports() []KeepAliveReport {
+	this.kmu.Lock()
+	defer this.kmu.Unlock()
+
+	reports := make([]KeepAliveReport, 0)
+
+	for _, r := range this.kareports {
+		if r.Suggested > 0 {
+			reports = append(reports, *r)
+		}
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].IdleDrops != reports[j].IdleDrops {
+			return reports[i].IdleDrops > reports[j].IdleDrops
+		}
+
+		return reports[i].ClientId < reports[j].ClientId
+	})
+
+	return reports
+}
+
+// KeepAliveReport returns the report of the client ID, whether there's a keepalive
+// suggested for it or not. It returns ErrClientNotFound if the client ID hasn't
+// been seen.
+func (this *Server) KeepAliveReport(cid string) (*KeepAliveReport, error) {
+	this.kmu.Lock()
+	defer this.kmu.Unlock()
+
+	r, ok := this.kareports[cid]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+
+	report := *r
+
+	return &report, nil
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+func TestSuggestKeepAlive(t *testing.T) {
+	tests := []struct {
+		r    KeepAliveReport
+		want int
+	}{
+		// Not enough drops yet
+		{KeepAliveReport{KeepAlive: 60, Connections: 2, IdleDrops: 2}, 0},
+
+		// Most connections end fine
+		{KeepAliveReport{KeepAlive: 60, Connections: 10, IdleDrops: 3}, 0},
+
+		{KeepAliveReport{KeepAlive: 60, Connections: 4, IdleDrops: 3}, 30},
+		{KeepAliveReport{KeepAlive: 300, Connections: 3, IdleDrops: 3}, 150},
+
+		// Never below the minimum, or a few round trips
+		{KeepAliveReport{KeepAlive: 15, Connections: 3, IdleDrops: 3}, 10},
+		{KeepAliveReport{KeepAlive: 60, Connections: 3, IdleDrops: 3, RTT: 10000}, 41},
+
+		// Already as short as it gets
+		{KeepAliveReport{KeepAlive: 10, Connections: 3, IdleDrops: 3}, 0},
+	}
+
+	for i, test := range tests {
+		got, _ := suggestKeepAlive(&test.r)
+		require.Equal(t, test.want, got, "test %d", i)
+	}
+}
+
+func TestServerKeepAliveReports(t *testing.T) {
+	svr := &Server{AdviseKeepAlive: true}
+
+	connect := func(cid string, keepAlive int, idle time.Duration, dropped bool) {
+		msg := newConnectMessage()
+		msg.SetClientId([]byte(cid))
+
+		sess := &sessions.Session{}
+		require.NoError(t, sess.Init(msg))
+
+		svc := &service{server: svr, sess: sess, keepAlive: keepAlive}
+		svr.keepAliveConnected(svc)
+
+		svc.lastRecv = time.Now().Add(-idle).UnixNano()
+		if dropped {
+			svc.dropped = 1
+		}
+
+		svr.keepAliveDisconnected(svc)
+	}
+
+	// Behind a NAT that drops idle connections before the keepalive is up
+	for i := 0; i < 3; i++ {
+		connect("nat1", 60, 70*time.Second, true)
+	}
+	connect("nat1", 60, 5*time.Second, false)
+
+	// Dropped while busy, which a shorter keepalive wouldn't help with
+	for i := 0; i < 3; i++ {
+		connect("busy1", 60, time.Second, true)
+	}
+
+	reports := svr.KeepAliveReports()
+	require.Equal(t, 1, len(reports))
+	require.Equal(t, "nat1", reports[0].ClientId)
+	require.Equal(t, 4, reports[0].Connections)
+	require.Equal(t, 3, reports[0].Dropped)
+	require.Equal(t, 3, reports[0].IdleDrops)
+	require.Equal(t, 30, reports[0].Suggested)
+
+	report, err := svr.KeepAliveReport("busy1")
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Dropped)
+	require.Equal(t, 0, report.IdleDrops)
+	require.Equal(t, 0, report.Suggested)
+
+	// A slow link makes for a longer keepalive
+	svr.keepAliveRTT("nat1", 10*time.Second)
+
+	report, err = svr.KeepAliveReport("nat1")
+	require.NoError(t, err)
+	require.Equal(t, float64(10000), report.RTT)
+	require.Equal(t, 41, report.Suggested)
+
+	// Taking the advice starts the counts again
+	connect("nat1", 30, time.Second, false)
+
+	report, err = svr.KeepAliveReport("nat1")
+	require.NoError(t, err)
+	require.Equal(t, 30, report.KeepAlive)
+	require.Equal(t, 1, report.Connections)
+	require.Equal(t, 0, report.Suggested)
+	require.Equal(t, float64(10000), report.RTT)
+
+	_, err = svr.KeepAliveReport("nobody")
+	require.Equal(t, ErrClientNotFound, err)
+}
+
+func TestServerKeepAliveTakeover(t *testing.T) {
+	svr := &Server{AdviseKeepAlive: true}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	connect := func() net.Conn {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		msg := newConnectMessage()
+		msg.SetClientId([]byte("keepalive"))
+		msg.SetKeepAlive(1)
+		require.NoError(t, writeMessage(conn, msg))
+
+		connack, err := getConnackMessage(conn)
+		require.NoError(t, err)
+		require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+		return conn
+	}
+
+	// The first connection goes quiet for longer than the keepalive, as if its
+	// PINGREQs were lost, and the client connects again
+	conn1 := connect()
+	defer conn1.Close()
+
+	time.Sleep(1100 * time.Millisecond)
+
+	conn2 := connect()
+	defer conn2.Close()
+
+	report, err := svr.KeepAliveReport("keepalive")
+	require.NoError(t, err)
+	require.Equal(t, 1, report.KeepAlive)
+	require.Equal(t, 1, report.Connections)
+	require.Equal(t, 1, report.Dropped)
+	require.Equal(t, 1, report.IdleDrops)
+}
+
+func TestServiceKeepAliveTimeout(t *testing.T) {
+	// The client side, and the server before checkConfiguration, get the grace
+	// of the spec
+	require.Equal(t, 15*time.Second, (&service{keepAlive: 10}).keepAliveTimeout())
+	require.Equal(t, 25*time.Second, (&service{keepAlive: 10, keepAliveGrace: 2.5}).keepAliveTimeout())
+}
+
+func TestServerKeepAliveGrace(t *testing.T) {
+	require.Error(t, (&Server{KeepAliveGrace: 0.9}).checkConfiguration())
+
+	svr := &Server{}
+	require.NoError(t, svr.checkConfiguration())
+	require.Equal(t, DefaultKeepAliveGrace, svr.KeepAliveGrace)
+}
+
+func TestServerMaxKeepAlive(t *testing.T) {
+	svr := &Server{MaxKeepAlive: 1, KeepAliveGrace: 1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	msg := newConnectMessage()
+	msg.SetKeepAlive(600)
+	require.NoError(t, writeMessage(conn, msg))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	// The client is added once the CONNACK has been sent
+	require.Eventually(t, func() bool {
+		return len(svr.Clients()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 1, svr.Clients()[0].KeepAlive)
+
+	// Silent for longer than the server's keepalive, if not the client's
+	start := time.Now()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.False(t, isTimeout(err))
+	require.True(t, time.Since(start) < 3*time.Second)
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+var ErrLeaseNotFound error = errors.New("service: Subscription lease not found")
+
+// lease is what's kept for each subscriber with leased subscriptions.
+type lease struct {
+	ttl    time.Duration
+	topics map[string]struct{}
+	t      *wheelTimer
+}
+
+// SubscribeLease is Subscribe with a lease, for subscribers that live outside the
+// server's control, such as backend services consuming over an API. Unless
+// RenewLease is called for onPublish within ttl, e.g. from the heartbeat of the
+// service, every subscription of onPublish made with SubscribeLease is
+// unsubscribed, so the ones left behind by a service that crashed don't pile up
+// in the topic tree. Subscribing again renews the lease, with the new ttl.
+func (this *Server) SubscribeLease(topic []byte, qos byte, onPublish *OnPublishFunc, ttl time.Duration) (byte, error) {
+	if ttl <= 0 {
+		return message.QosFailure, errors.New("service: Subscription lease must be positive")
+	}
+
+	rqos, err := this.Subscribe(topic, qos, onPublish)
+	if err != nil {
+		return rqos, err
+	}
+
+	this.lmu.Lock()
+	defer this.lmu.Unlock()
+
+	if this.leases == nil {
+		this.leases = make(map[*OnPublishFunc]*lease)
+	}
+
+	l := this.leases[onPublish]
+	if l == nil {
+		l = &lease{topics: make(map[string]struct{})}
+		this.leases[onPublish] = l
+
+		// Unsubscribing goes through the TopicsProvider, which may block, so it's
+		// not done on the wheel's goroutine.
+		l.t = this.timers.get(0).AfterFunc(ttl, func() {
+			go this.expireLease(onPublish, l)
+		})
+	} else {
+		l.t.Reset(ttl)
+	}
+
+	l.ttl = ttl
+	l.topics[string(topic)] = struct{}{}
+
+	return rqos, nil
+}
+
+// RenewLease extends the lease of the subscriptions of onPublish by its ttl from
+// now. It returns ErrLeaseNotFound if onPublish has none, e.g. because the lease
+// has already expired, in which case the subscriptions have to be made again.
+func (this *Server) RenewLease(onPublish *OnPublishFunc) error {
+	this.lmu.Lock()
+	defer this.lmu.Unlock()
+
+	l := this.leases[onPublish]
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+
+	l.t.Reset(l.ttl)
+
+	return nil
+}
+
+// unlease removes topic from the lease of onPublish, once it's unsubscribed from
+// it, and drops the lease once it has no topics left.
+func (this *Server) unlease(topic []byte, onPublish *OnPublishFunc) {
+	this.lmu.Lock()
+	defer this.lmu.Unlock()
+
+	l := this.leases[onPublish]
+	if l == nil {
+		return
+	}
+
+	delete(l.topics, string(topic))
+
+	if len(l.topics) == 0 {
+		l.t.Stop()
+		delete(this.leases, onPublish)
+	}
+}
+
+// expireLease unsubscribes onPublish from the topics of l, if l is still its
+// lease, i.e. it hasn't been renewed and dropped in the meantime.
+func (this *Server) expireLease(onPublish *OnPublishFunc, l *lease) {
+	this.lmu.Lock()
+	if this.leases[onPublish] != l {
+		this.lmu.Unlock()
+		return
+	}
+
+	delete(this.leases, onPublish)
+	this.lmu.Unlock()
+
+	for topic := range l.topics {
+		if err := this.topicsMgr.Unsubscribe([]byte(topic), onPublish); err != nil {
+			this.logger().Error("server/expireLease: Error unsubscribing", logging.F("topic", topic), logging.Err(err))
+		}
+	}
+
+	this.logger().Info("server/expireLease: Subscription lease expired", logging.F("topics", len(l.topics)))
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerSubscribeLease(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := svr.SubscribeLease([]byte("a/+"), message.QosAtMostOnce, &onpub, 200*time.Millisecond)
+	require.NoError(t, err)
+	_, err = svr.SubscribeLease([]byte("b/+"), message.QosAtMostOnce, &onpub, 200*time.Millisecond)
+	require.NoError(t, err)
+
+	// Renewed by the heartbeat, it outlives its ttl
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		require.NoError(t, svr.RenewLease(&onpub))
+	}
+
+	msg := newPublishMessage(0, message.QosAtMostOnce)
+	msg.SetTopic([]byte("a/1"))
+	_, err = svr.Publish(msg, nil)
+	require.NoError(t, err)
+
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the message")
+	}
+
+	// Once the heartbeat stops, every leased subscription goes. Asking with
+	// RenewLease would keep it going.
+	require.True(t, waitFor(func() bool {
+		var (
+			subs []interface{}
+			qoss []byte
+		)
+
+		for _, topic := range []string{"a/1", "b/1"} {
+			if err := svr.topicsMgr.Subscribers([]byte(topic), message.QosAtMostOnce, &subs, &qoss); err != nil || len(subs) > 0 {
+				return false
+			}
+		}
+
+		return true
+	}), "Timed out waiting for the lease to expire")
+	require.Equal(t, ErrLeaseNotFound, svr.RenewLease(&onpub))
+
+	for _, topic := range []string{"a/1", "b/1"} {
+		msg.SetTopic([]byte(topic))
+		_, err = svr.Publish(msg, nil)
+		require.NoError(t, err)
+	}
+
+	require.Len(t, got, 0)
+}
+
+func TestServerUnsubscribeLease(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		return nil
+	}
+
+	_, err := svr.SubscribeLease([]byte("a"), message.QosAtMostOnce, &onpub, time.Minute)
+	require.NoError(t, err)
+
+	// The lease goes with the last of its subscriptions
+	require.NoError(t, svr.Unsubscribe([]byte("a"), &onpub))
+	require.Equal(t, ErrLeaseNotFound, svr.RenewLease(&onpub))
+
+	_, err = svr.SubscribeLease([]byte("a"), message.QosAtMostOnce, &onpub, 0)
+	require.Error(t, err)
+}
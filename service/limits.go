@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+// RejectedConnections returns the number of connections rejected so far because
+// the MaxConnections and the MaxConnectionsPerIP limits were reached.
+func (this *Server) RejectedConnections() (max, perIP int64) {
+	return atomic.LoadInt64(&this.rejectedMax), atomic.LoadInt64(&this.rejectedIP)
+}
+
+// acquireConn reserves a connection slot for conn against the server-wide and
+// the per-IP connection limits. The returned function gives the slot back, and
+// it's safe to call it more than once.
+func (this *Server) acquireConn(conn net.Conn) (func(), error) {
+	ip := remoteIP(conn.RemoteAddr())
+
+	this.cmu.Lock()
+	defer this.cmu.Unlock()
+
+	if (this.MaxConnections > 0 && this.conns >= this.MaxConnections) ||
+		(this.MaxGoroutines > 0 && (this.conns+1)*goroutinesPerConn > this.MaxGoroutines) {
+		atomic.AddInt64(&this.rejectedMax, 1)
+		return nil, ErrTooManyConnections
+	}
+
+	if this.MaxConnectionsPerIP > 0 && this.ipconns[ip] >= this.MaxConnectionsPerIP {
+		atomic.AddInt64(&this.rejectedIP, 1)
+		return nil, ErrTooManyConnectionsIP
+	}
+
+	if err := this.connectionBudget(); err != nil {
+		return nil, err
+	}
+
+	if this.ipconns == nil {
+		this.ipconns = make(map[string]int)
+	}
+
+	this.conns++
+	this.ipconns[ip]++
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			this.releaseConn(ip)
+		})
+	}, nil
+}
+
+func (this *Server) releaseConn(ip string) {
+	this.cmu.Lock()
+	defer this.cmu.Unlock()
+
+	this.conns--
+
+	if this.ipconns[ip]--; this.ipconns[ip] <= 0 {
+		delete(this.ipconns, ip)
+	}
+}
+
+// rejectConnection reads the CONNECT message from the client so it can be answered
+// with a CONNACK carrying the supplied return code. The caller closes the connection.
+func (this *Server) rejectConnection(conn net.Conn, code message.ConnackCode) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(this.ConnectTimeout)))
+
+	if _, err := getConnectMessage(conn, this.MaxPacketSize); err != nil {
+		return
+	}
+
+	resp := message.NewConnackMessage()
+	resp.SetReturnCode(code)
+	resp.SetSessionPresent(false)
+	writeMessage(conn, resp)
+}
+
+// remoteIP returns the IP part of addr. Addresses without a port, such as unix
+// sockets, are returned as is.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// serveTestServer accepts connections on a random local port and hands them to
+// svr until the returned listener is closed.
+func serveTestServer(t testing.TB, svr *Server) net.Listener {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go svr.handleConnection(conn)
+		}
+	}()
+
+	return ln
+}
+
+func connectTestClient(t testing.TB, ln net.Listener) (*Client, error) {
+	c := &Client{}
+
+	err := c.Connect("tcp://"+ln.Addr().String(), newConnectMessage())
+	if err == nil {
+		topics.Unregister(c.svc.sess.ID())
+	}
+
+	return c, err
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	svr := &Server{MaxConnections: 1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c1, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+
+	_, err = connectTestClient(t, ln)
+	require.Equal(t, message.ErrServerUnavailable, err)
+
+	max, perIP := svr.RejectedConnections()
+	require.Equal(t, int64(1), max)
+	require.Equal(t, int64(0), perIP)
+
+	// Once the first client is gone, its slot should be given back
+	c1.Disconnect()
+
+	require.True(t, waitFor(func() bool {
+		svr.cmu.Lock()
+		defer svr.cmu.Unlock()
+		return svr.conns == 0
+	}), "Timed out waiting for the connection slot to be released")
+
+	c2, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	c2.Disconnect()
+}
+
+func TestServerMaxConnectionsPerIP(t *testing.T) {
+	svr := &Server{MaxConnectionsPerIP: 2}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c1, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c1.Disconnect()
+
+	c2, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c2.Disconnect()
+
+	_, err = connectTestClient(t, ln)
+	require.Equal(t, message.ErrServerUnavailable, err)
+
+	max, perIP := svr.RejectedConnections()
+	require.Equal(t, int64(0), max)
+	require.Equal(t, int64(1), perIP)
+}
+
+func TestServerMaxGoroutines(t *testing.T) {
+	svr := &Server{MaxGoroutines: 2*goroutinesPerConn - 1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c1, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c1.Disconnect()
+
+	_, err = connectTestClient(t, ln)
+	require.Equal(t, message.ErrServerUnavailable, err)
+
+	max, _ := svr.RejectedConnections()
+	require.Equal(t, int64(1), max)
+}
+
+func TestServerBufferSizes(t *testing.T) {
+	svr := &Server{
+		BufferSize:    64 * 1024,
+		OutBufferSize: 32 * 1024,
+		BufferSizes: func(req *message.ConnectMessage) (int, int) {
+			if string(req.ClientId()) == "gateway" {
+				return 20 * 1024, 1024 * 1024
+			}
+			return 0, 0
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c1, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c1.Disconnect()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("gateway"))
+
+	c2 := &Client{BufferSize: 100 * 1024}
+	require.NoError(t, c2.Connect("tcp://"+ln.Addr().String(), cmsg))
+	defer c2.Disconnect()
+
+	require.Equal(t, int64(128*1024), c2.svc.in.size)
+	require.Equal(t, int64(128*1024), c2.svc.out.size)
+
+	svr.mu.Lock()
+	svc1 := svr.clients[c1.svc.sess.ID()]
+	svc2 := svr.clients["gateway"]
+	svr.mu.Unlock()
+
+	require.Equal(t, int64(64*1024), svc1.in.size)
+	require.Equal(t, int64(32*1024), svc1.out.size)
+	require.Equal(t, 64*1024, svc1.maxPacketSize)
+
+	// Rounded up to a power of two, with packets capped at the incoming buffer
+	require.Equal(t, int64(32*1024), svc2.in.size)
+	require.Equal(t, int64(1024*1024), svc2.out.size)
+	require.Equal(t, 32*1024, svc2.maxPacketSize)
+}
+
+func TestServerLowMemoryProfile(t *testing.T) {
+	svr := &Server{}
+	svr.UseLowMemoryProfile()
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.NoError(t, svr.checkConfiguration())
+	require.Equal(t, LowMemoryBufferSize, svr.MaxPacketSize)
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	svr.mu.Lock()
+	svc := svr.clients[c.svc.sess.ID()]
+	svr.mu.Unlock()
+
+	require.Equal(t, int64(LowMemoryBufferSize), svc.in.size)
+	require.Equal(t, int64(LowMemoryBufferSize), svc.out.size)
+
+	// Retained messages are delivered, but not kept
+	var got []*message.PublishMessage
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got = append(got, msg)
+		return nil
+	}
+
+	_, err = svr.Subscribe([]byte("a/b"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("a/b"))
+	msg.SetPayload([]byte("abc"))
+	msg.SetRetain(true)
+	_, err = svr.Publish(msg, nil)
+	require.NoError(t, err)
+
+	require.Len(t, got, 1)
+
+	rmsgs, err := svr.Retained([]byte("a/b"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 0)
+}
+
+func TestServerMaxRetainedPerSubscribe(t *testing.T) {
+	svr := &Server{MaxRetainedPerSubscribe: 2}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	for _, topic := range []string{"a/1", "a/2", "a/3", "b"} {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetPayload([]byte("retained"))
+		msg.SetRetain(true)
+		_, err := svr.Publish(msg, nil)
+		require.NoError(t, err)
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	// The limit is for each topic filter
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("a/+"), message.QosAtMostOnce)
+	sub.AddTopic([]byte("b"), message.QosAtMostOnce)
+	require.NoError(t, writeMessage(conn, sub))
+
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, message.SUBACK, message.MessageType(buf[0]>>4))
+
+	for i := 0; i < 3; i++ {
+		buf, err = getMessageBuffer(conn, 0)
+		require.NoError(t, err)
+		require.Equal(t, message.PUBLISH, message.MessageType(buf[0]>>4))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err), "Expected no more retained messages, got %v", err)
+
+	// All of them are still there for anything else
+	rmsgs, err := svr.Retained([]byte("a/+"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 3)
+}
+
+func TestRemoteIP(t *testing.T) {
+	require.Equal(t, "10.0.0.1", remoteIP(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1883}))
+	require.Equal(t, "/tmp/mqtt.sock", remoteIP(&net.UnixAddr{Name: "/tmp/mqtt.sock", Net: "unix"}))
+	require.Equal(t, "", remoteIP(nil))
+}
+
+// waitFor polls cond until it's true or a second has passed.
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
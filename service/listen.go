@@ -0,0 +1,91 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+// parseURI returns the network and the address, as used by net.Listen and
+// net.Dial, for an URI such as "tcp://127.0.0.1:1883" or "unix:///tmp/mqtt.sock".
+func parseURI(uri string) (network, address string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		// Both unix:///abs/path and unix://rel/path are accepted
+		return u.Scheme, u.Host + u.Path, nil
+
+	case "":
+		return "", "", ErrInvalidConnectionType
+	}
+
+	return u.Scheme, u.Host, nil
+}
+
+// listen opens a listener for the URI. For unix domain sockets, a stale socket
+// file left behind by a server that didn't shut down cleanly is removed first,
+// and the mode of the new socket file is set to UnixSocketMode.
+func (this *Server) listen(uri string) (net.Listener, error) {
+	network, address, err := parseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if network != "unix" {
+		return net.Listen(network, address)
+	}
+
+	removeStaleSocket(address, this.logger())
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if this.UnixSocketMode != 0 {
+		if err := os.Chmod(address, this.UnixSocketMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path if nothing is listening on it.
+// Anything that's not a socket is left alone, and net.Listen will fail on it.
+func removeStaleSocket(path string, log logging.Logger) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+
+	log.Info("server/listen: Removing stale socket", logging.F("path", path))
+	os.Remove(path)
+}
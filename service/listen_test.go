@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestParseURI(t *testing.T) {
+	network, address, err := parseURI("tcp://127.0.0.1:1883")
+	require.NoError(t, err)
+	require.Equal(t, "tcp", network)
+	require.Equal(t, "127.0.0.1:1883", address)
+
+	network, address, err = parseURI("unix:///var/run/surgemq.sock")
+	require.NoError(t, err)
+	require.Equal(t, "unix", network)
+	require.Equal(t, "/var/run/surgemq.sock", address)
+
+	network, address, err = parseURI("unix://surgemq.sock")
+	require.NoError(t, err)
+	require.Equal(t, "unix", network)
+	require.Equal(t, "surgemq.sock", address)
+
+	_, _, err = parseURI("127.0.0.1:1883")
+	require.Error(t, err)
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "surgemq")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mqtt.sock")
+
+	// Leave a stale socket behind, as if a previous server had crashed
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	svr := &Server{UnixSocketMode: 0600}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- svr.ListenAndServe("unix://" + path)
+	}()
+
+	require.True(t, waitFor(func() bool {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}), "Timed out waiting for the server to listen")
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	c := &Client{}
+	require.NoError(t, c.Connect("unix://"+path, newConnectMessage()))
+	topics.Unregister(c.svc.sess.ID())
+	c.Disconnect()
+
+	svr.Close()
+	require.NoError(t, <-done)
+
+	// The socket file is removed when the server closes
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestServerServe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	svr := &Server{}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- svr.Serve(ln)
+	}()
+
+	c := &Client{}
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), newConnectMessage()))
+	topics.Unregister(c.svc.sess.ID())
+	c.Disconnect()
+
+	// Only one listener at a time
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.Error(t, svr.Serve(ln2))
+
+	svr.Close()
+	require.NoError(t, <-done)
+
+	// Closing again does nothing
+	require.NoError(t, svr.Close())
+}
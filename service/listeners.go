@@ -0,0 +1,402 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/logging"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	ErrListenerExists   error = errors.New("service: Listener already exists")
+	ErrListenerNotFound error = errors.New("service: Listener not found")
+	ErrListenerTLS      error = errors.New("service: Listener needs a TLS configuration")
+)
+
+// DefaultWebsocketPath is the path the websocket listeners serve MQTT on, if
+// their URI has none.
+const DefaultWebsocketPath = "/mqtt"
+
+// ListenerConfig is a listener of the server with settings of its own, see
+// AddListener.
+type ListenerConfig struct {
+	// Name identifies the listener in the registry. If not set then default to
+	// the URI.
+	Name string
+
+	// URI is where the listener listens, e.g. "tcp://0.0.0.0:1883",
+	// "tls://0.0.0.0:8883", "ws://0.0.0.0:8080/mqtt", "wss://0.0.0.0:8443/mqtt"
+	// or "unix:///var/run/mqtt.sock". The websocket listeners serve MQTT on
+	// the path of the URI, or DefaultWebsocketPath.
+	URI string
+
+	// TLS is the configuration of the tls and wss listeners.
+	TLS *tls.Config
+
+	// Authenticator is the authenticator of the clients connecting through the
+	// listener. If not set then default to the Authenticator of the server.
+	Authenticator string
+
+	// MaxConnections is the maximum number of concurrent client connections
+	// through the listener, on top of the server's own MaxConnections. If not
+	// set then there's no limit of the listener's own.
+	MaxConnections int
+
+	// MaxQoS is the highest QoS granted to the subscriptions of the clients
+	// connecting through the listener. If not set then default to the MaxQoS of
+	// the server.
+	MaxQoS QoSLimit
+
+	// Allow and Deny are the CIDRs, or single IPs, of the networks the clients
+	// can and can't connect through the listener from. The connections from
+	// the others are closed as soon as they are accepted, before the MQTT, or
+	// even the TLS, handshake, and counted in ListenerInfo.Dropped. Deny wins
+	// over Allow. It's the address the connection comes from that's checked,
+	// not the one of a PROXY protocol header. If not set then the clients can
+	// connect from anywhere.
+	Allow []string
+	Deny  []string
+}
+
+// ListenerInfo is what's known about one of the listeners of the registry.
+type ListenerInfo struct {
+	Name string `json:"name"`
+	URI  string `json:"uri"`
+
+	// Addr is the address the listener is actually listening on, e.g. with the
+	// port picked by the system for port 0.
+	Addr string `json:"addr"`
+
+	// Connections is the number of clients connected through the listener, and
+	// Accepted the number accepted since it started.
+	Connections int64 `json:"connections"`
+	Accepted    int64 `json:"accepted"`
+
+	// Dropped is the number of connections closed since it started for coming
+	// from outside ListenerConfig.Allow, or from inside Deny.
+	Dropped int64 `json:"dropped"`
+}
+
+// listener is a running listener of the registry.
+type listener struct {
+	ListenerConfig
+
+	ln      net.Listener
+	hs      *http.Server
+	authMgr *auth.Manager
+	filter  *ipFilter
+
+	conns    int64
+	accepted int64
+	dropped  int64
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// acquireConn reserves a connection slot for a client connecting through the
+// listener. The returned function gives the slot back, and it's safe to call it
+// more than once.
+func (this *listener) acquireConn() (func(), error) {
+	if n := atomic.AddInt64(&this.conns, 1); this.MaxConnections > 0 && n > int64(this.MaxConnections) {
+		atomic.AddInt64(&this.conns, -1)
+		return nil, ErrTooManyConnections
+	}
+
+	atomic.AddInt64(&this.accepted, 1)
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			atomic.AddInt64(&this.conns, -1)
+		})
+	}, nil
+}
+
+// AddListener starts a listener with the settings of cfg, next to the one of
+// Serve, if any, and to the other listeners added. The server can run with only
+// the listeners added here, and each of them can be stopped on its own with
+// RemoveListener. They are all stopped when the server is closed.
+func (this *Server) AddListener(cfg ListenerConfig) error {
+	if cfg.Name == "" {
+		cfg.Name = cfg.URI
+	}
+
+	u, err := url.Parse(cfg.URI)
+	if err != nil {
+		return err
+	}
+
+	if err := this.checkConfiguration(); err != nil {
+		return err
+	}
+
+	if cfg.MaxQoS > MaxQoS2 {
+		return fmt.Errorf("service: Invalid maximum QoS %d", cfg.MaxQoS)
+	}
+
+	l := &listener{
+		ListenerConfig: cfg,
+		quit:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+
+	if l.filter, err = newIPFilter(cfg.Allow, cfg.Deny); err != nil {
+		return err
+	}
+
+	if cfg.Authenticator != "" {
+		if l.authMgr, err = auth.NewManager(cfg.Authenticator); err != nil {
+			return err
+		}
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if _, ok := this.listeners[cfg.Name]; ok {
+		return ErrListenerExists
+	}
+
+	switch u.Scheme {
+	case "tcp", "tcp4", "tcp6", "unix":
+		if l.ln, err = this.listen(cfg.URI); err == nil {
+			l.ln = this.filtered(l, l.ln)
+		}
+
+	case "tls", "ssl":
+		if cfg.TLS == nil {
+			return ErrListenerTLS
+		}
+
+		if l.ln, err = net.Listen("tcp", u.Host); err == nil {
+			l.ln = tls.NewListener(this.filtered(l, l.ln), cfg.TLS)
+		}
+
+	case "ws", "wss":
+		if u.Scheme == "wss" && cfg.TLS == nil {
+			return ErrListenerTLS
+		}
+
+		if l.ln, err = net.Listen("tcp", u.Host); err == nil {
+			l.ln = this.filtered(l, l.ln)
+
+			if u.Scheme == "wss" {
+				l.ln = tls.NewListener(l.ln, cfg.TLS)
+			}
+		}
+
+	default:
+		return fmt.Errorf("%w: %s", ErrInvalidConnectionType, u.Scheme)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if this.listeners == nil {
+		this.listeners = make(map[string]*listener)
+	}
+	this.listeners[cfg.Name] = l
+
+	if u.Scheme == "ws" || u.Scheme == "wss" {
+		path := u.Path
+		if path == "" {
+			path = DefaultWebsocketPath
+		}
+
+		l.hs = this.websocketServer(l, path)
+
+		go this.serveWebsocket(l)
+	} else {
+		go this.serveListener(l)
+	}
+
+	this.logger().Info("server/AddListener: Listener started", logging.F("listener", cfg.Name), logging.F("addr", l.ln.Addr().String()))
+
+	return nil
+}
+
+// RemoveListener stops the listener name from accepting connections, and waits
+// for it to stop. The clients already connected through it stay connected.
+func (this *Server) RemoveListener(name string) error {
+	this.mu.Lock()
+	l, ok := this.listeners[name]
+	if ok {
+		delete(this.listeners, name)
+	}
+	this.mu.Unlock()
+
+	if !ok {
+		return ErrListenerNotFound
+	}
+
+	this.stopListener(l)
+
+	return nil
+}
+
+// Listeners returns the listeners of the registry, sorted by name.
+func (this *Server) Listeners() []ListenerInfo {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	infos := make([]ListenerInfo, 0, len(this.listeners))
+
+	for _, l := range this.listeners {
+		infos = append(infos, ListenerInfo{
+			Name:        l.Name,
+			URI:         l.URI,
+			Addr:        l.ln.Addr().String(),
+			Connections: atomic.LoadInt64(&l.conns),
+			Accepted:    atomic.LoadInt64(&l.accepted),
+			Dropped:     atomic.LoadInt64(&l.dropped),
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// stopListeners stops all the listeners of the registry, for Close.
+func (this *Server) stopListeners() {
+	this.mu.Lock()
+	ls := this.listeners
+	this.listeners = nil
+	this.mu.Unlock()
+
+	for _, l := range ls {
+		this.stopListener(l)
+	}
+}
+
+func (this *Server) stopListener(l *listener) {
+	close(l.quit)
+
+	if l.hs != nil {
+		// The websocket connections are hijacked, so they are left alone
+		l.hs.Close()
+	} else {
+		l.ln.Close()
+	}
+
+	<-l.done
+
+	this.logger().Info("server/RemoveListener: Listener stopped", logging.F("listener", l.Name))
+}
+
+// serveListener accepts MQTT connections on l.
+func (this *Server) serveListener(l *listener) {
+	defer close(l.done)
+
+	err := this.acceptLoop(l.ln, l.quit, func(conn net.Conn) {
+		go this.serveConn(conn, l)
+	})
+	if err != nil {
+		this.logger().Error("server/serveListener: Listener stopped accepting", logging.F("listener", l.Name), logging.Err(err))
+	}
+}
+
+// websocketServer returns the HTTP server of l, which serves MQTT over
+// websockets on path. Each websocket carries the MQTT packets in binary frames.
+func (this *Server) websocketServer(l *listener, path string) *http.Server {
+	ws := websocket.Server{
+		// Browsers connect from pages of any origin, and MQTT has its own
+		// authentication
+		Handshake: func(cfg *websocket.Config, req *http.Request) error {
+			for _, p := range cfg.Protocol {
+				if p == "mqtt" {
+					cfg.Protocol = []string{p}
+					return nil
+				}
+			}
+
+			cfg.Protocol = nil
+			return nil
+		},
+
+		Handler: func(conn *websocket.Conn) {
+			conn.PayloadType = websocket.BinaryFrame
+
+			svc, err := this.serveConn(newWebsocketConn(conn), l)
+			if err != nil || svc == nil {
+				return
+			}
+
+			// The connection is closed once the handler returns
+			<-svc.done
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, ws)
+
+	return &http.Server{Handler: mux}
+}
+
+// serveWebsocket accepts websocket connections on l.
+func (this *Server) serveWebsocket(l *listener) {
+	defer close(l.done)
+
+	err := l.hs.Serve(this.limited(l.ln, l.quit))
+
+	select {
+	case <-l.quit:
+	default:
+		this.logger().Error("server/serveWebsocket: Listener stopped accepting", logging.F("listener", l.Name), logging.Err(err))
+	}
+}
+
+// websocketConn is a websocket with the address of the client as its remote
+// address, rather than the origin of the page it was opened from, for the
+// connection limits and the logs.
+type websocketConn struct {
+	*websocket.Conn
+
+	remote net.Addr
+}
+
+func newWebsocketConn(conn *websocket.Conn) net.Conn {
+	req := conn.Request()
+	if req == nil {
+		return conn
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	if err != nil {
+		return conn
+	}
+
+	return &websocketConn{Conn: conn, remote: addr}
+}
+
+func (this *websocketConn) RemoteAddr() net.Addr {
+	return this.remote
+}
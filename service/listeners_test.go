@@ -0,0 +1,109 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+	"golang.org/x/net/websocket"
+)
+
+func newListenerTestServer() *Server {
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	return &Server{}
+}
+
+func connectListener(t *testing.T, svr *Server, name string) (*Client, error) {
+	for _, info := range svr.Listeners() {
+		if info.Name == name {
+			c := &Client{}
+			err := c.Connect("tcp://"+info.Addr, newConnectMessage())
+			if err == nil {
+				topics.Unregister(c.svc.sess.ID())
+			}
+			return c, err
+		}
+	}
+
+	t.Fatalf("listener %s not found", name)
+	return nil, nil
+}
+
+func TestServerListeners(t *testing.T) {
+	svr := newListenerTestServer()
+	defer svr.Close()
+
+	require.NoError(t, svr.AddListener(ListenerConfig{Name: "public", URI: "tcp://127.0.0.1:0", MaxConnections: 1}))
+	require.NoError(t, svr.AddListener(ListenerConfig{Name: "locked", URI: "tcp://127.0.0.1:0", Authenticator: "mockFailure"}))
+	require.Equal(t, ErrListenerExists, svr.AddListener(ListenerConfig{Name: "public", URI: "tcp://127.0.0.1:0"}))
+	require.Equal(t, ErrListenerTLS, svr.AddListener(ListenerConfig{Name: "secure", URI: "tls://127.0.0.1:0"}))
+
+	c1, err := connectListener(t, svr, "public")
+	require.NoError(t, err)
+
+	// The listener is full, while the server isn't
+	_, err = connectListener(t, svr, "public")
+	require.Equal(t, message.ErrServerUnavailable, err)
+
+	_, err = connectListener(t, svr, "locked")
+	require.Equal(t, message.ErrBadUsernameOrPassword, err)
+
+	infos := svr.Listeners()
+	require.Len(t, infos, 2)
+	require.Equal(t, "locked", infos[0].Name)
+	require.Equal(t, "public", infos[1].Name)
+	require.Equal(t, int64(1), infos[1].Connections)
+
+	// Removing the listener leaves its clients connected
+	addr := infos[1].Addr
+	require.NoError(t, svr.RemoveListener("public"))
+	require.Equal(t, ErrListenerNotFound, svr.RemoveListener("public"))
+	require.Len(t, svr.Listeners(), 1)
+
+	require.Error(t, (&Client{}).Connect("tcp://"+addr, newConnectMessage()))
+	require.NoError(t, c1.Ping(nil))
+
+	c1.Disconnect()
+}
+
+func TestServerWebsocketListener(t *testing.T) {
+	svr := newListenerTestServer()
+	defer svr.Close()
+
+	require.NoError(t, svr.AddListener(ListenerConfig{Name: "ws", URI: "ws://127.0.0.1:0"}))
+
+	ws, err := websocket.Dial("ws://"+svr.Listeners()[0].Addr+DefaultWebsocketPath, "mqtt", "http://localhost/")
+	require.NoError(t, err)
+	ws.PayloadType = websocket.BinaryFrame
+
+	c := &Client{}
+	require.NoError(t, c.ConnectConn(ws, newConnectMessage()))
+	defer c.Disconnect()
+
+	topics.Unregister(c.svc.sess.ID())
+
+	require.True(t, waitFor(func() bool {
+		return svr.Listeners()[0].Connections == 1
+	}))
+}
@@ -0,0 +1,169 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+var ErrMemoryBudgetExceeded error = errors.New("service: Memory budget exceeded")
+
+// How often a client held up by MemoryPause checks whether the server is back
+// under its MemoryBudget
+const memoryPauseCheck = 50 * time.Millisecond
+
+// MemoryPolicy is what's done with the messages clients publish while the server
+// is over its MemoryBudget.
+type MemoryPolicy int
+
+const (
+	// MemoryPause holds up each client publishing until the server is back under
+	// the budget. The client's incoming buffer then fills up, and the server
+	// stops reading from its connection, so TCP pushes back on it.
+	MemoryPause MemoryPolicy = iota
+
+	// MemoryReject drops the messages. They are still acknowledged, as with
+	// QuotaReject.
+	MemoryReject
+)
+
+// MemoryStats is what the server holds in memory against its MemoryBudget.
+type MemoryStats struct {
+	// Budget is the MemoryBudget, 0 if there's none.
+	Budget int64 `json:"budget"`
+
+	// Buffers is the size of the incoming and outgoing buffers of the
+	// connections, and Retained the size of the payloads of the retained
+	// messages, in bytes.
+	Buffers  int64 `json:"buffers"`
+	Retained int64 `json:"retained"`
+
+	// The number of connections refused, messages held up and messages dropped
+	// because the server was over the budget. The retained messages not kept
+	// are counted by RetainedStats.
+	Refused int64 `json:"refused"`
+	Paused  int64 `json:"paused"`
+	Dropped int64 `json:"dropped"`
+}
+
+// MemoryStats returns what the server holds in memory, and what it has done to
+// stay within its MemoryBudget.
+func (this *Server) MemoryStats() MemoryStats {
+	return MemoryStats{
+		Budget:   this.MemoryBudget,
+		Buffers:  atomic.LoadInt64(&this.membuf),
+		Retained: atomic.LoadInt64(&this.rbytes),
+		Refused:  atomic.LoadInt64(&this.memRefused),
+		Paused:   atomic.LoadInt64(&this.memPaused),
+		Dropped:  atomic.LoadInt64(&this.memDropped),
+	}
+}
+
+// overBudget returns whether the server would be over its MemoryBudget with n
+// more bytes.
+func (this *Server) overBudget(n int64) bool {
+	if this.MemoryBudget <= 0 {
+		return false
+	}
+
+	return atomic.LoadInt64(&this.membuf)+atomic.LoadInt64(&this.rbytes)+n > this.MemoryBudget
+}
+
+// connectionBudget checks there's room in the MemoryBudget for the buffers of
+// another connection.
+func (this *Server) connectionBudget() error {
+	size := this.OutBufferSize
+	if size == 0 {
+		size = this.BufferSize
+	}
+
+	if this.overBudget(int64(this.BufferSize + size)) {
+		atomic.AddInt64(&this.memRefused, 1)
+		return ErrMemoryBudgetExceeded
+	}
+
+	return nil
+}
+
+// retainedBudget checks there's room in the MemoryBudget for a retained message
+// of size bytes on topic, on top of the one it replaces. rmu must be held.
+func (this *Server) retainedBudget(topic string, size int) error {
+	n := int64(size)
+	if e := this.rindex[topic]; e != nil {
+		n -= int64(e.Value.(*retainedEntry).size)
+	}
+
+	if n > 0 && this.overBudget(n) {
+		this.rrejected++
+		return ErrMemoryBudgetExceeded
+	}
+
+	return nil
+}
+
+// addBuffers counts the buffers of the service against the server's
+// MemoryBudget.
+func (this *service) addBuffers() {
+	if this.server == nil {
+		return
+	}
+
+	n := this.in.size + this.out.size
+	atomic.AddInt64(&this.bufBytes, n)
+	atomic.AddInt64(&this.server.membuf, n)
+}
+
+// releaseBuffers stops counting the buffers of the service, once they are let
+// go of.
+func (this *service) releaseBuffers() {
+	if n := atomic.SwapInt64(&this.bufBytes, 0); n > 0 && this.server != nil {
+		atomic.AddInt64(&this.server.membuf, -n)
+	}
+}
+
+// overMemory returns whether msg is dropped because the server is over its
+// MemoryBudget. With MemoryPause, the client is held up instead until the server
+// is back under it.
+func (this *service) overMemory(msg *message.PublishMessage) bool {
+	if this.server == nil || !this.server.overBudget(0) {
+		return false
+	}
+
+	if this.server.MemoryPolicy == MemoryReject {
+		atomic.AddInt64(&this.server.memDropped, 1)
+		this.logger().Debug("service/overMemory: Dropping message over memory budget", logging.F("topic", string(msg.Topic())))
+		return true
+	}
+
+	atomic.AddInt64(&this.server.memPaused, 1)
+
+	t := time.NewTicker(memoryPauseCheck)
+	defer t.Stop()
+
+	for this.server.overBudget(0) {
+		select {
+		case <-t.C:
+		case <-this.done:
+			return false
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+func TestServerMemoryBudgetConnections(t *testing.T) {
+	svr := &Server{
+		BufferSize:   LowMemoryBufferSize,
+		MemoryBudget: 2*LowMemoryBufferSize + 1000,
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c1, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c1.Disconnect()
+
+	require.Equal(t, int64(2*LowMemoryBufferSize), svr.MemoryStats().Buffers)
+
+	// There's no room for the buffers of another one
+	_, err = connectTestClient(t, ln)
+	require.Equal(t, message.ErrServerUnavailable, err)
+	require.Equal(t, int64(1), svr.MemoryStats().Refused)
+
+	// Retained messages don't fit either
+	msg := newRetainedMessage("a/b", string(make([]byte, 2000)))
+	_, err = svr.Publish(msg, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, int64(1), svr.RetainedStats().Rejected)
+	require.Equal(t, int64(0), svr.MemoryStats().Retained)
+
+	// The buffers are given back once the client goes
+	c1.Disconnect()
+	require.True(t, waitFor(func() bool { return svr.MemoryStats().Buffers == 0 }))
+
+	c2, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c2.Disconnect()
+}
+
+func newMemoryTestService(t *testing.T, svr *Server) *service {
+	sess := &sessions.Session{}
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	return &service{server: svr, sess: sess, done: make(chan struct{})}
+}
+
+func TestServerMemoryBudgetReject(t *testing.T) {
+	svr := &Server{
+		MemoryBudget: 1024,
+		MemoryPolicy: MemoryReject,
+	}
+
+	svc := newMemoryTestService(t, svr)
+	msg := newTestPublish("abc")
+
+	require.False(t, svc.overMemory(msg))
+
+	atomic.StoreInt64(&svr.membuf, 2048)
+	require.True(t, svc.overMemory(msg))
+	require.Equal(t, int64(1), svr.MemoryStats().Dropped)
+}
+
+func TestServerMemoryBudgetPause(t *testing.T) {
+	svr := &Server{MemoryBudget: 1024}
+
+	svc := newMemoryTestService(t, svr)
+	atomic.StoreInt64(&svr.membuf, 2048)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt64(&svr.membuf, 0)
+	}()
+
+	// The client is held up until the server is back under the budget
+	start := time.Now()
+	require.False(t, svc.overMemory(newTestPublish("abc")))
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+	require.Equal(t, int64(1), svr.MemoryStats().Paused)
+}
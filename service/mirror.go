@@ -0,0 +1,235 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+// DefaultMirrorBatchDelay is how long a batch of a Mirror waits to fill up if
+// BatchDelay isn't set.
+const DefaultMirrorBatchDelay = 10 * time.Millisecond
+
+// Mirror is a Bridge that publishes the messages to another server over MQTT,
+// e.g. a read-only replica serving dashboards and analytics consumers, so their
+// wildcard subscriptions don't weigh on this server. The client ID of Client must
+// be one of the Feeders of the replica.
+//
+// The messages keep their topic, QoS and RETAIN flag. For QoS 1 and 2 messages,
+// the PUBACK to the publisher is held back until the replica has acknowledged the
+// message, the same as with any bridge.
+//
+// With BatchSize or Compressor set, the messages are sent in batches to
+// MirrorBatchTopic instead, at the highest QoS of the messages in them, which
+// the replica unpacks. See Stats for the bandwidth they take.
+type Mirror struct {
+	// Client is connected to the replica.
+	Client *Client
+
+	// BatchSize is the most messages sent together in one PUBLISH. If not set
+	// then each message is sent on its own.
+	BatchSize int
+
+	// BatchDelay is how long a batch waits to fill up before it's sent anyway.
+	// If not set then default to 10ms.
+	BatchDelay time.Duration
+
+	// Compressor compresses the batches. It must be registered with the replica
+	// as well. If not set then they aren't compressed.
+	Compressor Compressor
+
+	pktid uint32
+
+	// The batch being filled up, the done functions of its messages, and the
+	// timer sending it once BatchDelay is up
+	mu    sync.Mutex
+	batch []*message.PublishMessage
+	dones []func(error)
+	timer *time.Timer
+
+	stats MirrorStats
+}
+
+var _ Bridge = (*Mirror)(nil)
+
+func (this *Mirror) Forward(cid string, msg *message.PublishMessage, done func(error)) {
+	pub := message.NewPublishMessage()
+	pub.SetTopic(append([]byte(nil), msg.Topic()...))
+	pub.SetPayload(append([]byte(nil), msg.Payload()...))
+	pub.SetQoS(msg.QoS())
+	pub.SetRetain(msg.Retain())
+
+	if this.BatchSize > 0 || this.Compressor != nil {
+		this.add(pub, done)
+		return
+	}
+
+	atomic.AddInt64(&this.stats.Messages, 1)
+	atomic.AddInt64(&this.stats.BytesIn, int64(len(pub.Payload())))
+
+	this.publish(pub, []func(error){done})
+}
+
+// Stats returns the counters of the messages forwarded so far.
+func (this *Mirror) Stats() MirrorStats {
+	return MirrorStats{
+		Messages: atomic.LoadInt64(&this.stats.Messages),
+		Batches:  atomic.LoadInt64(&this.stats.Batches),
+		BytesIn:  atomic.LoadInt64(&this.stats.BytesIn),
+		BytesOut: atomic.LoadInt64(&this.stats.BytesOut),
+	}
+}
+
+// add adds msg to the batch, and sends the batch if it's full.
+func (this *Mirror) add(msg *message.PublishMessage, done func(error)) {
+	this.mu.Lock()
+
+	this.batch = append(this.batch, msg)
+	this.dones = append(this.dones, done)
+
+	if len(this.batch) < this.BatchSize {
+		if this.timer == nil {
+			delay := this.BatchDelay
+			if delay == 0 {
+				delay = DefaultMirrorBatchDelay
+			}
+
+			this.timer = time.AfterFunc(delay, this.flush)
+		}
+
+		this.mu.Unlock()
+		return
+	}
+
+	batch, dones := this.take()
+	this.mu.Unlock()
+
+	this.send(batch, dones)
+}
+
+// flush sends the batch, however full it is.
+func (this *Mirror) flush() {
+	this.mu.Lock()
+	batch, dones := this.take()
+	this.mu.Unlock()
+
+	if len(batch) > 0 {
+		this.send(batch, dones)
+	}
+}
+
+// take empties the batch and returns what was in it. The lock must be held.
+func (this *Mirror) take() ([]*message.PublishMessage, []func(error)) {
+	if this.timer != nil {
+		this.timer.Stop()
+		this.timer = nil
+	}
+
+	batch, dones := this.batch, this.dones
+	this.batch, this.dones = nil, nil
+
+	return batch, dones
+}
+
+// send publishes batch as a single message to MirrorBatchTopic.
+func (this *Mirror) send(batch []*message.PublishMessage, dones []func(error)) {
+	buf, raw, err := encodeMirrorBatch(batch, this.Compressor)
+	if err != nil {
+		for _, done := range dones {
+			done(err)
+		}
+		return
+	}
+
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte(MirrorBatchTopic))
+	pub.SetPayload(buf)
+
+	for _, msg := range batch {
+		if msg.QoS() > pub.QoS() {
+			pub.SetQoS(msg.QoS())
+		}
+	}
+
+	atomic.AddInt64(&this.stats.Messages, int64(len(batch)))
+	atomic.AddInt64(&this.stats.BytesIn, int64(raw))
+
+	this.publish(pub, dones)
+}
+
+// publish sends pub to the replica, and calls the done functions of the
+// messages in it once it's acknowledged.
+func (this *Mirror) publish(pub *message.PublishMessage, dones []func(error)) {
+	atomic.AddInt64(&this.stats.Batches, 1)
+	atomic.AddInt64(&this.stats.BytesOut, int64(len(pub.Payload())))
+
+	if pub.QoS() != message.QosAtMostOnce {
+		pub.SetPacketId(this.nextPacketID())
+	}
+
+	done := func(err error) {
+		for _, d := range dones {
+			d(err)
+		}
+	}
+
+	err := this.Client.Publish(pub, func(msg, ack message.Message, err error) error {
+		done(err)
+		return nil
+	})
+
+	if err != nil {
+		done(err)
+	}
+}
+
+// nextPacketID returns the packet ID of the next message, skipping 0.
+func (this *Mirror) nextPacketID() uint16 {
+	for {
+		if id := uint16(atomic.AddUint32(&this.pktid, 1)); id != 0 {
+			return id
+		}
+	}
+}
+
+// readOnly is whether the messages published by the client are dropped, because
+// the server is a read-only replica and the client isn't one of its feeders.
+func (this *service) readOnly() bool {
+	if this.server == nil || !this.server.ReadOnly {
+		return false
+	}
+
+	return !this.feeder()
+}
+
+// feeder is whether the client is one of the Feeders of the server.
+func (this *service) feeder() bool {
+	if this.server == nil {
+		return false
+	}
+
+	cid := this.sess.ID()
+	for _, f := range this.server.Feeders {
+		if f == cid {
+			return true
+		}
+	}
+
+	return false
+}
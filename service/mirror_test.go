@@ -0,0 +1,227 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerReadOnlyMirror(t *testing.T) {
+	replica := &Server{ReadOnly: true, Feeders: []string{"mirror"}}
+
+	ln := serveTestServer(t, replica)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := replica.Subscribe([]byte("#"), message.QosAtLeastOnce, &onpub)
+	require.NoError(t, err)
+
+	// A dashboard publishing to the replica gets its PUBACK, but the message goes
+	// nowhere
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	pub := newPublishMessage(1, message.QosAtLeastOnce)
+	require.NoError(t, writeMessage(conn, pub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	// The primary's messages come through its Mirror bridge
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("mirror"))
+
+	c := &Client{}
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), cmsg))
+	defer c.Disconnect()
+
+	m := &Mirror{Client: c}
+
+	done := make(chan error, 1)
+	m.Forward("sensor1", newPublishMessage(7, message.QosAtLeastOnce), func(err error) {
+		done <- err
+	})
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the replica to acknowledge the message")
+	}
+
+	select {
+	case msg := <-got:
+		require.Equal(t, "abc", string(msg.Topic()))
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the mirrored message")
+	}
+
+	require.Len(t, got, 0)
+}
+
+func TestMirrorBatchCompressed(t *testing.T) {
+	replica := &Server{ReadOnly: true, Feeders: []string{"mirror"}}
+
+	ln := serveTestServer(t, replica)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := replica.Subscribe([]byte("#"), message.QosAtLeastOnce, &onpub)
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("mirror"))
+
+	c := &Client{}
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), cmsg))
+	defer c.Disconnect()
+
+	m := &Mirror{Client: c, BatchSize: 3, Compressor: FlateCompressor{Level: 9}}
+
+	done := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		msg := newPublishMessage(uint16(i+1), message.QosAtLeastOnce)
+		msg.SetTopic([]byte(fmt.Sprintf("sensors/%d", i)))
+		msg.SetPayload([]byte("the same reading, over and over again, over and over again"))
+
+		m.Forward("sensor1", msg, func(err error) {
+			done <- err
+		})
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-done:
+			require.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the replica to acknowledge the batch")
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-got:
+			require.Equal(t, fmt.Sprintf("sensors/%d", i), string(msg.Topic()))
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for the mirrored messages")
+		}
+	}
+
+	st := m.Stats()
+	require.Equal(t, int64(3), st.Messages)
+	require.Equal(t, int64(1), st.Batches)
+	require.True(t, st.BytesOut < st.BytesIn, "The batch should have been compressed")
+}
+
+func TestMirrorBatchDelay(t *testing.T) {
+	replica := &Server{Feeders: []string{"mirror"}}
+
+	ln := serveTestServer(t, replica)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := replica.Subscribe([]byte("abc"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("mirror"))
+
+	c := &Client{}
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), cmsg))
+	defer c.Disconnect()
+
+	// The batch is never full, so it's sent once the delay is up
+	m := &Mirror{Client: c, BatchSize: 100, BatchDelay: 20 * time.Millisecond}
+	m.Forward("sensor1", newPublishMessage(0, message.QosAtMostOnce), func(err error) {})
+
+	select {
+	case msg := <-got:
+		require.Equal(t, "abc", string(msg.Topic()))
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the mirrored message")
+	}
+}
+
+func TestMirrorBatchEncoding(t *testing.T) {
+	a := newPublishMessage(1, message.QosExactlyOnce)
+	a.SetRetain(true)
+
+	b := newPublishMessage(2, message.QosAtMostOnce)
+	b.SetTopic([]byte("a/b/c"))
+	b.SetPayload(nil)
+
+	buf, raw, err := encodeMirrorBatch([]*message.PublishMessage{a, b}, FlateCompressor{})
+	require.NoError(t, err)
+	require.True(t, raw > 0)
+
+	msgs, err := decodeMirrorBatch(buf)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+
+	require.Equal(t, []byte("abc"), msgs[0].Topic())
+	require.Equal(t, []byte("abc"), msgs[0].Payload())
+	require.Equal(t, message.QosExactlyOnce, msgs[0].QoS())
+	require.True(t, msgs[0].Retain())
+
+	require.Equal(t, []byte("a/b/c"), msgs[1].Topic())
+	require.Len(t, msgs[1].Payload(), 0)
+	require.Equal(t, message.QosAtMostOnce, msgs[1].QoS())
+	require.False(t, msgs[1].Retain())
+
+	// Truncated
+	_, err = decodeMirrorBatch(buf[:len(buf)/2])
+	require.Error(t, err)
+
+	// Compressed with something the server doesn't know
+	buf, _, err = encodeMirrorBatch([]*message.PublishMessage{a}, unknownCompressor{})
+	require.NoError(t, err)
+
+	_, err = decodeMirrorBatch(buf)
+	require.True(t, errors.Is(err, ErrUnknownCompressor))
+}
+
+type unknownCompressor struct{}
+
+func (unknownCompressor) Name() string                          { return "unknown" }
+func (unknownCompressor) Compress(src []byte) ([]byte, error)   { return src, nil }
+func (unknownCompressor) Decompress(src []byte) ([]byte, error) { return src, nil }
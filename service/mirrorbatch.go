@@ -0,0 +1,279 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+var (
+	ErrInvalidMirrorBatch error = errors.New("service: Invalid mirror batch")
+	ErrUnknownCompressor  error = errors.New("service: Unknown compressor")
+)
+
+// MirrorBatchTopic is the topic the batches of a Mirror are published to. The
+// server only unpacks the batches published by its Feeders.
+const MirrorBatchTopic = "$mirror/batch"
+
+// The version of the batch frame, which is its first byte
+const mirrorBatchVersion = 1
+
+// Compressor compresses the batches a Mirror sends, e.g. to cut down on the
+// traffic between availability zones. The server receiving the batches must
+// have the same Compressor registered, as they are decompressed by the Name
+// they were compressed with. Only deflate comes built in; others, such as snappy
+// or zstd, can be registered with RegisterCompressor.
+type Compressor interface {
+	// Name is what the compressor is known by in the batches, at most 255 bytes.
+	Name() string
+
+	Compress(src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+var (
+	compmu      sync.RWMutex
+	compressors = map[string]Compressor{}
+)
+
+func init() {
+	RegisterCompressor(FlateCompressor{Level: flate.DefaultCompression})
+}
+
+// RegisterCompressor makes c available for decompressing the batches compressed
+// with it, replacing any registered under the same name.
+func RegisterCompressor(c Compressor) {
+	if c == nil {
+		panic("service: Register compressor is nil")
+	}
+
+	compmu.Lock()
+	defer compmu.Unlock()
+
+	compressors[c.Name()] = c
+}
+
+// FlateCompressor is the deflate Compressor of the standard library, with the
+// given compression level.
+type FlateCompressor struct {
+	Level int
+}
+
+var _ Compressor = FlateCompressor{}
+
+func (this FlateCompressor) Name() string {
+	return "deflate"
+}
+
+func (this FlateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, this.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (this FlateCompressor) Decompress(src []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(src)))
+}
+
+// MirrorStats are the counters of a Mirror, for the bandwidth it takes.
+type MirrorStats struct {
+	// Messages is the number of messages forwarded, and Batches the number of
+	// PUBLISH messages they were sent in.
+	Messages int64 `json:"messages"`
+	Batches  int64 `json:"batches"`
+
+	// BytesIn is the size of the batches before they are compressed, and
+	// BytesOut after, both without the MQTT headers.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// encodeMirrorBatch encodes msgs into the payload of a batch, compressed with c
+// if it's not nil. The payload is the version, the name of the compressor,
+// prefixed by its length, and then the messages, each as a byte of flags,
+// the QoS in the lowest 2 bits and RETAIN in the next, and the topic and the
+// payload, both prefixed by their length as a uvarint. It returns the size of
+// the messages before they were compressed as well.
+func encodeMirrorBatch(msgs []*message.PublishMessage, c Compressor) ([]byte, int, error) {
+	var (
+		body bytes.Buffer
+		n    [binary.MaxVarintLen64]byte
+	)
+
+	for _, msg := range msgs {
+		flags := msg.QoS()
+		if msg.Retain() {
+			flags |= 1 << 2
+		}
+		body.WriteByte(flags)
+
+		body.Write(n[:binary.PutUvarint(n[:], uint64(len(msg.Topic())))])
+		body.Write(msg.Topic())
+
+		body.Write(n[:binary.PutUvarint(n[:], uint64(len(msg.Payload())))])
+		body.Write(msg.Payload())
+	}
+
+	raw := body.Len()
+	b := body.Bytes()
+
+	var name string
+	if c != nil {
+		name = c.Name()
+		if len(name) > 255 {
+			return nil, 0, fmt.Errorf("service: Compressor name %q is too long", name)
+		}
+
+		var err error
+		if b, err = c.Compress(b); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	buf := make([]byte, 0, 2+len(name)+len(b))
+	buf = append(buf, mirrorBatchVersion, byte(len(name)))
+	buf = append(buf, name...)
+	buf = append(buf, b...)
+
+	return buf, raw, nil
+}
+
+// decodeMirrorBatch returns the messages in the payload of a batch.
+func decodeMirrorBatch(buf []byte) ([]*message.PublishMessage, error) {
+	if len(buf) < 2 || buf[0] != mirrorBatchVersion || len(buf) < 2+int(buf[1]) {
+		return nil, ErrInvalidMirrorBatch
+	}
+
+	name := string(buf[2 : 2+buf[1]])
+	b := buf[2+len(name):]
+
+	if name != "" {
+		compmu.RLock()
+		c, ok := compressors[name]
+		compmu.RUnlock()
+
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCompressor, name)
+		}
+
+		var err error
+		if b, err = c.Decompress(b); err != nil {
+			return nil, err
+		}
+	}
+
+	var msgs []*message.PublishMessage
+
+	for len(b) > 0 {
+		flags := b[0]
+		b = b[1:]
+
+		topic, rest, ok := readMirrorField(b)
+		if !ok {
+			return nil, ErrInvalidMirrorBatch
+		}
+
+		payload, rest, ok := readMirrorField(rest)
+		if !ok {
+			return nil, ErrInvalidMirrorBatch
+		}
+
+		b = rest
+
+		msg := message.NewPublishMessage()
+		if err := msg.SetTopic(topic); err != nil {
+			return nil, err
+		}
+		if err := msg.SetQoS(flags & 3); err != nil {
+			return nil, err
+		}
+		msg.SetRetain(flags&(1<<2) != 0)
+		msg.SetPayload(payload)
+
+		msgs = append(msgs, msg)
+	}
+
+	return msgs, nil
+}
+
+// readMirrorField returns the field at the start of b, prefixed by its length,
+// and what comes after it.
+func readMirrorField(b []byte) ([]byte, []byte, bool) {
+	n, l := binary.Uvarint(b)
+	if l <= 0 || n > uint64(len(b)-l) {
+		return nil, nil, false
+	}
+
+	return b[l : l+int(n)], b[l+int(n):], true
+}
+
+// acceptBatch accepts each of the messages in the batch msg published by a
+// feeder, the same as if they had been published on their own. ack is called
+// once all of them are accepted.
+func (this *service) acceptBatch(msg *message.PublishMessage, ack func()) error {
+	msgs, err := decodeMirrorBatch(msg.Payload())
+	if err != nil {
+		this.logger().Error("service/acceptBatch: Error decoding mirror batch", logging.Err(err))
+		return err
+	}
+
+	if len(msgs) == 0 {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+
+	var mack func()
+	if ack != nil {
+		pending := int32(len(msgs))
+		mack = func() {
+			if atomic.AddInt32(&pending, -1) == 0 {
+				ack()
+			}
+		}
+	}
+
+	for _, m := range msgs {
+		if err := this.accept(m, mack); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -15,30 +15,27 @@
 package service
 
 import (
-	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
 
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/codec"
 )
 
-func getConnectMessage(conn io.Closer) (*message.ConnectMessage, error) {
-	buf, err := getMessageBuffer(conn)
-	if err != nil {
-		//glog.Debugf("Receive error: %v", err)
-		return nil, err
+func getConnectMessage(conn io.Closer, max int) (*message.ConnectMessage, error) {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return nil, ErrInvalidConnectionType
 	}
 
-	msg := message.NewConnectMessage()
+	r := codec.NewReader(c)
+	r.MaxSize = max
 
-	_, err = msg.Decode(buf)
-	//glog.Debugf("Received: %s", msg)
-	return msg, err
+	return r.ReadConnect()
 }
 
 func getConnackMessage(conn io.Closer) (*message.ConnackMessage, error) {
-	buf, err := getMessageBuffer(conn)
+	buf, err := getMessageBuffer(conn, 0)
 	if err != nil {
 		//glog.Debugf("Receive error: %v", err)
 		return nil, err
@@ -52,93 +49,35 @@ func getConnackMessage(conn io.Closer) (*message.ConnackMessage, error) {
 }
 
 func writeMessage(conn io.Closer, msg message.Message) error {
-	buf := make([]byte, msg.Len())
-	_, err := msg.Encode(buf)
-	if err != nil {
-		//glog.Debugf("Write error: %v", err)
-		return err
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return ErrInvalidConnectionType
 	}
-	//glog.Debugf("Writing: %s", msg)
 
-	return writeMessageBuffer(conn, buf)
+	return codec.NewWriter(c).WriteMessage(msg)
 }
 
-func getMessageBuffer(c io.Closer) ([]byte, error) {
-	if c == nil {
-		return nil, ErrInvalidConnectionType
-	}
-
+// getMessageBuffer reads a single message from the connection. If max is greater
+// than 0, messages larger than max bytes are rejected before they are read.
+func getMessageBuffer(c io.Closer, max int) ([]byte, error) {
 	conn, ok := c.(net.Conn)
 	if !ok {
 		return nil, ErrInvalidConnectionType
 	}
 
-	var (
-		// the message buffer
-		buf []byte
-
-		// tmp buffer to read a single byte
-		b []byte = make([]byte, 1)
-
-		// total bytes read
-		l int = 0
-	)
-
-	// Let's read enough bytes to get the message header (msg type, remaining length)
-	for {
-		// If we have read 5 bytes and still not done, then there's a problem.
-		if l > 5 {
-			return nil, fmt.Errorf("connect/getMessage: 4th byte of remaining length has continuation bit set")
-		}
-
-		n, err := conn.Read(b[0:])
-		if err != nil {
-			//glog.Debugf("Read error: %v", err)
-			return nil, err
-		}
-
-		// Technically i don't think we will ever get here
-		if n == 0 {
-			continue
-		}
-
-		buf = append(buf, b...)
-		l += n
-
-		// Check the remlen byte (1+) to see if the continuation bit is set. If so,
-		// increment cnt and continue reading. Otherwise break.
-		if l > 1 && b[0] < 0x80 {
-			break
-		}
-	}
-
-	// Get the remaining length of the message
-	remlen, _ := binary.Uvarint(buf[1:])
-	buf = append(buf, make([]byte, remlen)...)
+	r := codec.NewReader(conn)
+	r.MaxSize = max
 
-	for l < len(buf) {
-		n, err := conn.Read(buf[l:])
-		if err != nil {
-			return nil, err
-		}
-		l += n
-	}
-
-	return buf, nil
+	return r.ReadPacket()
 }
 
 func writeMessageBuffer(c io.Closer, b []byte) error {
-	if c == nil {
-		return ErrInvalidConnectionType
-	}
-
 	conn, ok := c.(net.Conn)
 	if !ok {
 		return ErrInvalidConnectionType
 	}
 
-	_, err := conn.Write(b)
-	return err
+	return codec.NewWriter(conn).WritePacket(b)
 }
 
 // Copied from http://golang.org/src/pkg/net/timeout_test.go
@@ -0,0 +1,580 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+var ErrOfflineQueueFull error = errors.New("service: Offline queue is full")
+
+const (
+	// The size a segment file of an offline queue grows to before the next one
+	// is started
+	offlineSegmentSize = 1 << 20
+
+	// The extension of the segment files
+	offlineSegmentExt = ".seg"
+
+	// The file the client ID is kept in, in the directory of its queue
+	offlineClientIdFile = "client_id"
+)
+
+// offlineQueue holds the QoS 1 and 2 messages published to the topics a client
+// with a persistent session is subscribed to, while it's disconnected, and sends
+// them once it connects again. The first OfflineQueue of them are kept in
+// memory, and the rest spill to segment files in a directory of the client's
+// under OfflineQueueDir, named after a hash of the client ID, which may be too
+// long for a file name. Once one has spilled, the ones after it do as well, so
+// they are sent in the order they were published.
+type offlineQueue struct {
+	server *Server
+	cid    string
+
+	// The directory of the segment files, or empty if there's no
+	// OfflineQueueDir
+	dir string
+
+	// The topic filters onpub is subscribed to
+	topics [][]byte
+	onpub  OnPublishFunc
+
+	// expiry expires the session once it's been disconnected for SessionExpiry
+	expiry *time.Timer
+
+	mu sync.Mutex
+
+	// The encoded messages kept in memory
+	mem [][]byte
+
+	// The sequence numbers of the segment files, oldest first, the next one, the
+	// last one while it's being written to and its size, and the size of all of
+	// them
+	segs []uint64
+	next uint64
+	f    *os.File
+	size int64
+	disk int64
+
+	// Set once the queue has been sent or expired, after which nothing more is
+	// added to it
+	closed bool
+}
+
+// offlineQueueing is whether the messages to disconnected clients with
+// persistent sessions are queued.
+func (this *Server) offlineQueueing() bool {
+	return this.OfflineQueue > 0 || this.OfflineQueueDir != ""
+}
+
+// goOffline starts queueing the messages to the client of svc, which has just
+// disconnected, and the clock on its session expiring.
+func (this *Server) goOffline(svc *service) {
+	if !this.offlineQueueing() && this.SessionExpiry == 0 {
+		return
+	}
+
+	// A session taken over is still in use
+	if svc.sess.Cmsg.CleanSession() || svc.disconnectReason() == DisconnectTakeover {
+		return
+	}
+
+	cid := svc.sess.ID()
+
+	// Nor is one another connection of the client has started using
+	this.mu.Lock()
+	other := this.clients[cid]
+	this.mu.Unlock()
+
+	if other != nil && other != svc {
+		return
+	}
+
+	this.omu.Lock()
+	if this.offline == nil {
+		this.offline = make(map[string]*offlineQueue)
+	}
+
+	q := this.offline[cid]
+	if q == nil {
+		q = this.newOfflineQueue(cid)
+		this.offline[cid] = q
+	}
+	this.omu.Unlock()
+
+	if this.offlineQueueing() {
+		q.subscribe(svc.sess)
+	}
+
+	q.startExpiry()
+}
+
+// goOnline sends the client of svc, which has just connected, the messages
+// queued while it was disconnected, if it picked up its session. They are
+// dropped otherwise. Messages published between the client subscribing again
+// and the queue being unsubscribed may be sent twice, which QoS 1 and 2 allow.
+func (this *Server) goOnline(svc *service, present bool) {
+	cid := svc.sess.ID()
+
+	this.omu.Lock()
+	q := this.offline[cid]
+	delete(this.offline, cid)
+	this.omu.Unlock()
+
+	if q == nil {
+		return
+	}
+
+	q.stopExpiry()
+	q.unsubscribe()
+
+	if present && !svc.sess.Cmsg.CleanSession() {
+		q.drain(svc)
+	}
+
+	q.remove()
+}
+
+// expireSession deletes the session of client cid, which has been disconnected
+// for SessionExpiry, along with the messages queued for it. The session is left
+// alone if the client has connected again in the meantime.
+func (this *Server) expireSession(cid string, q *offlineQueue) {
+	this.omu.Lock()
+	if this.offline[cid] != q {
+		this.omu.Unlock()
+		return
+	}
+	delete(this.offline, cid)
+	this.omu.Unlock()
+
+	q.unsubscribe()
+	q.remove()
+
+	this.mu.Lock()
+	_, connected := this.clients[cid]
+	this.mu.Unlock()
+
+	if connected {
+		return
+	}
+
+	this.sessMgr.Del(cid)
+	atomic.AddInt64(&this.sessionsExpired, 1)
+	this.emit(Event{Type: EventSessionExpired, ClientId: cid})
+
+	this.logger().Info("server/expireSession: Session expired", logging.F("client_id", cid), logging.F("expiry", this.SessionExpiry))
+}
+
+// loadOffline picks up the segment files left in OfflineQueueDir by the last
+// run, for the clients to get once they connect again, if their sessions were
+// persisted.
+func (this *Server) loadOffline() error {
+	if this.OfflineQueueDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(this.OfflineQueueDir, 0700); err != nil {
+		return fmt.Errorf("server/loadOffline: Error creating offline queue directory: %v", err)
+	}
+
+	entries, err := os.ReadDir(this.OfflineQueueDir)
+	if err != nil {
+		return fmt.Errorf("server/loadOffline: Error reading offline queue directory: %v", err)
+	}
+
+	this.omu.Lock()
+	defer this.omu.Unlock()
+
+	this.offline = make(map[string]*offlineQueue)
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		cid, err := os.ReadFile(filepath.Join(this.OfflineQueueDir, e.Name(), offlineClientIdFile))
+		if err != nil {
+			continue
+		}
+
+		q := this.newOfflineQueue(string(cid))
+		if err := q.load(); err != nil {
+			return fmt.Errorf("server/loadOffline: Error reading offline queue of %q: %v", q.cid, err)
+		}
+
+		// The queue goes on once its session is back, and goes otherwise
+		sess, err := this.sessMgr.Get(q.cid)
+		if err != nil || len(q.segs) == 0 {
+			q.remove()
+			continue
+		}
+
+		this.offline[q.cid] = q
+		q.subscribe(sess)
+		q.startExpiry()
+	}
+
+	return nil
+}
+
+// stopOffline stops the offline queues, leaving what's spilled to disk for the
+// next run.
+func (this *Server) stopOffline() error {
+	this.omu.Lock()
+	defer this.omu.Unlock()
+
+	for _, q := range this.offline {
+		q.stopExpiry()
+
+		q.mu.Lock()
+		q.closeSegment()
+		q.mu.Unlock()
+	}
+
+	return nil
+}
+
+// OfflineQueueLen returns the number of messages queued for client cid while
+// it's disconnected, in memory and on disk.
+func (this *Server) OfflineQueueLen(cid string) int {
+	this.omu.Lock()
+	q := this.offline[cid]
+	this.omu.Unlock()
+
+	if q == nil {
+		return 0
+	}
+
+	n := 0
+	q.each(func([]byte) error {
+		n++
+		return nil
+	})
+
+	return n
+}
+
+func (this *Server) newOfflineQueue(cid string) *offlineQueue {
+	q := &offlineQueue{server: this, cid: cid, next: 1}
+
+	if this.OfflineQueueDir != "" {
+		sum := sha256.Sum256([]byte(cid))
+		q.dir = filepath.Join(this.OfflineQueueDir, hex.EncodeToString(sum[:]))
+	}
+
+	q.onpub = func(msg *message.PublishMessage) error {
+		err := q.push(msg)
+		if err == ErrOfflineQueueFull {
+			atomic.AddInt64(&this.offlineDropped, 1)
+			this.deadLetter(DeadLetter{Reason: DeadLetterOverflow, Subscriber: cid}, msg)
+			return nil
+		}
+
+		if err != nil {
+			this.logger().Error("server/offlineQueue: Error queueing message", logging.F("client_id", cid), logging.Err(err))
+		}
+
+		return err
+	}
+
+	return q
+}
+
+// subscribe subscribes the queue to the topics of sess.
+func (this *offlineQueue) subscribe(sess *sessions.Session) {
+	topics, qoss, err := sess.Topics()
+	if err != nil {
+		this.server.logger().Error("server/offlineQueue: Error retrieving topics", logging.F("client_id", this.cid), logging.Err(err))
+		return
+	}
+
+	for i, t := range topics {
+		if _, err := this.server.topicsMgr.Subscribe([]byte(t), qoss[i], &this.onpub); err != nil {
+			this.server.logger().Error("server/offlineQueue: Error subscribing topic", logging.F("client_id", this.cid), logging.F("topic", t), logging.Err(err))
+			continue
+		}
+
+		this.topics = append(this.topics, []byte(t))
+	}
+}
+
+func (this *offlineQueue) unsubscribe() {
+	for _, t := range this.topics {
+		this.server.topicsMgr.Unsubscribe(t, &this.onpub)
+	}
+
+	this.topics = nil
+}
+
+func (this *offlineQueue) startExpiry() {
+	if this.server.SessionExpiry > 0 {
+		this.expiry = time.AfterFunc(this.server.SessionExpiry, func() {
+			this.server.expireSession(this.cid, this)
+		})
+	}
+}
+
+func (this *offlineQueue) stopExpiry() {
+	if this.expiry != nil {
+		this.expiry.Stop()
+	}
+}
+
+// push adds msg at the end of the queue, in memory if there's room and nothing
+// has spilled to disk yet, and on disk otherwise. It's ErrOfflineQueueFull if
+// there's no room on disk either. QoS 0 messages aren't queued.
+func (this *offlineQueue) push(msg *message.PublishMessage) error {
+	if msg.QoS() == message.QosAtMostOnce {
+		return nil
+	}
+
+	buf := make([]byte, msg.Len())
+	n, err := msg.Encode(buf)
+	if err != nil {
+		return err
+	}
+	buf = buf[:n]
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.closed {
+		return nil
+	}
+
+	if len(this.segs) == 0 && len(this.mem) < this.server.OfflineQueue {
+		this.mem = append(this.mem, buf)
+		return nil
+	}
+
+	if this.dir == "" {
+		return ErrOfflineQueueFull
+	}
+
+	if err := this.spill(buf); err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&this.server.offlineSpilled, 1)
+
+	return nil
+}
+
+// spill appends the message in buf to the last segment file, starting a new one
+// if it's full. The lock must be held.
+func (this *offlineQueue) spill(buf []byte) error {
+	n := int64(4 + len(buf))
+
+	// Reserve the room before writing, so the clients spilling at the same time
+	// can't go over the budget together
+	if budget := this.server.OfflineDiskBudget; atomic.AddInt64(&this.server.offlineBytes, n) > budget && budget > 0 {
+		atomic.AddInt64(&this.server.offlineBytes, -n)
+		return ErrOfflineQueueFull
+	}
+
+	if this.f == nil || this.size >= offlineSegmentSize {
+		if err := this.startSegment(); err != nil {
+			atomic.AddInt64(&this.server.offlineBytes, -n)
+			return err
+		}
+	}
+
+	rec := make([]byte, n)
+	binary.BigEndian.PutUint32(rec, uint32(len(buf)))
+	copy(rec[4:], buf)
+
+	if _, err := this.f.Write(rec); err != nil {
+		atomic.AddInt64(&this.server.offlineBytes, -n)
+		return err
+	}
+
+	this.size += n
+	this.disk += n
+
+	return nil
+}
+
+// startSegment closes the segment file being written to, if there's one, and
+// starts the next. The lock must be held.
+func (this *offlineQueue) startSegment() error {
+	this.closeSegment()
+
+	if len(this.segs) == 0 {
+		if err := os.MkdirAll(this.dir, 0700); err != nil {
+			return err
+		}
+
+		if err := os.WriteFile(filepath.Join(this.dir, offlineClientIdFile), []byte(this.cid), 0600); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(this.segment(this.next), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	this.segs = append(this.segs, this.next)
+	this.next++
+	this.f, this.size = f, 0
+
+	return nil
+}
+
+// closeSegment closes the segment file being written to. The lock must be held.
+func (this *offlineQueue) closeSegment() {
+	if this.f != nil {
+		this.f.Close()
+		this.f = nil
+	}
+}
+
+func (this *offlineQueue) segment(seq uint64) string {
+	return filepath.Join(this.dir, fmt.Sprintf("%020d%s", seq, offlineSegmentExt))
+}
+
+// load picks up the segment files in the directory of the queue. New messages go
+// in a segment of their own.
+func (this *offlineQueue) load() error {
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, offlineSegmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, offlineSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+
+		this.segs = append(this.segs, seq)
+		this.disk += info.Size()
+
+		if seq >= this.next {
+			this.next = seq + 1
+		}
+	}
+
+	sort.Slice(this.segs, func(i, j int) bool {
+		return this.segs[i] < this.segs[j]
+	})
+
+	atomic.AddInt64(&this.server.offlineBytes, this.disk)
+
+	return nil
+}
+
+// each calls fn with each of the encoded messages, in memory then on disk, in
+// the order they were queued. A message cut short on disk, by the server going
+// down as it was written, ends its segment.
+func (this *offlineQueue) each(fn func([]byte) error) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, buf := range this.mem {
+		if err := fn(buf); err != nil {
+			return err
+		}
+	}
+
+	for _, seq := range this.segs {
+		b, err := os.ReadFile(this.segment(seq))
+		if err != nil {
+			return err
+		}
+
+		for len(b) >= 4 {
+			n := int(binary.BigEndian.Uint32(b))
+			if len(b) < 4+n {
+				break
+			}
+
+			if err := fn(b[4 : 4+n]); err != nil {
+				return err
+			}
+
+			b = b[4+n:]
+		}
+	}
+
+	return nil
+}
+
+// drain sends the queued messages to the client of svc.
+func (this *offlineQueue) drain(svc *service) {
+	n := 0
+
+	err := this.each(func(buf []byte) error {
+		msg := message.NewPublishMessage()
+		if _, err := msg.Decode(buf); err != nil {
+			svc.logger().Error("server/goOnline: Dropping unreadable queued message", logging.Err(err))
+			return nil
+		}
+
+		n++
+		return svc.publish(msg, nil)
+	})
+
+	if err != nil {
+		svc.logger().Error("server/goOnline: Error sending queued messages", logging.Err(err))
+	}
+
+	svc.logger().Debug("server/goOnline: Sent queued messages", logging.F("messages", n))
+}
+
+// remove closes the queue and deletes its segment files.
+func (this *offlineQueue) remove() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.closed = true
+	this.mem = nil
+	this.closeSegment()
+
+	if this.dir != "" && len(this.segs) > 0 {
+		if err := os.RemoveAll(this.dir); err != nil {
+			this.server.logger().Error("server/offlineQueue: Error removing segment files", logging.F("client_id", this.cid), logging.Err(err))
+		}
+	}
+
+	atomic.AddInt64(&this.server.offlineBytes, -this.disk)
+	this.segs, this.disk = nil, 0
+}
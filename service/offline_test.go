@@ -0,0 +1,250 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// connectPersistent connects client cid with a persistent session, subscribed to
+// "abc" with QoS 1, and returns the connection and whether the session was
+// there already.
+func connectPersistent(t *testing.T, ln net.Listener, cid string) (net.Conn, bool) {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte(cid))
+	cmsg.SetCleanSession(false)
+	cmsg.SetWillFlag(false)
+	cmsg.SetWillQos(message.QosAtMostOnce)
+
+	require.NoError(t, writeMessage(conn, cmsg))
+	ack, err := getConnackMessage(conn)
+	require.NoError(t, err)
+
+	if ack.SessionPresent() {
+		return conn, true
+	}
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	return conn, false
+}
+
+// waitOffline waits for the server to be done with the connection of client cid.
+// Clients would do, but it leaves out the clients still connecting, which one
+// that hangs up straight after its SUBACK can still be.
+func waitOffline(t *testing.T, svr *Server, cid string) {
+	require.True(t, waitFor(func() bool {
+		svr.mu.Lock()
+		defer svr.mu.Unlock()
+
+		_, ok := svr.clients[cid]
+		return !ok
+	}), "Timed out waiting for the client to disconnect")
+}
+
+func newOfflinePublish(payload string) *message.PublishMessage {
+	msg := newTestPublish("abc")
+	msg.SetPayload([]byte(payload))
+	msg.SetQoS(message.QosAtLeastOnce)
+	return msg
+}
+
+func TestServerOfflineQueueSpill(t *testing.T) {
+	dir := t.TempDir()
+	svr := &Server{OfflineQueue: 2, OfflineQueueDir: dir}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, present := connectPersistent(t, ln, "offline1")
+	require.False(t, present)
+	conn.Close()
+
+	waitOffline(t, svr, "offline1")
+
+	for i := 0; i < 5; i++ {
+		_, err := svr.Publish(newOfflinePublish(fmt.Sprint(i)), nil)
+		require.NoError(t, err)
+	}
+
+	// Two in memory, the rest on disk
+	require.Equal(t, 5, svr.OfflineQueueLen("offline1"))
+
+	st := svr.Stats()
+	require.Equal(t, int64(3), st.OfflineSpilled)
+	require.True(t, st.OfflineDiskBytes > 0)
+
+	segs, err := filepath.Glob(filepath.Join(svr.newOfflineQueue("offline1").dir, "*"+offlineSegmentExt))
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+
+	conn, present = connectPersistent(t, ln, "offline1")
+	defer conn.Close()
+	require.True(t, present)
+
+	// They arrive in the order they were published
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 5; i++ {
+		buf, err := getMessageBuffer(conn, 0)
+		require.NoError(t, err)
+
+		msg := message.NewPublishMessage()
+		_, err = msg.Decode(buf)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(i), string(msg.Payload()))
+		require.Equal(t, byte(message.QosAtLeastOnce), msg.QoS())
+	}
+
+	require.Equal(t, 0, svr.OfflineQueueLen("offline1"))
+
+	// The queue is removed once the last of them is sent
+	require.True(t, waitFor(func() bool {
+		return svr.Stats().OfflineDiskBytes == 0
+	}))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestServerOfflineDiskBudget(t *testing.T) {
+	// Room for two of the records on disk
+	rec := int64(4 + newOfflinePublish("x").Len())
+
+	svr := &Server{OfflineQueueDir: t.TempDir(), OfflineDiskBudget: 2*rec + 1, DeadLetterTopic: "dlq"}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var dropped []*message.PublishMessage
+	var ondl OnPublishFunc = func(msg *message.PublishMessage) error {
+		dropped = append(dropped, msg)
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("dlq"), message.QosAtLeastOnce, &ondl)
+	require.NoError(t, err)
+
+	conn, _ := connectPersistent(t, ln, "offline2")
+	conn.Close()
+
+	waitOffline(t, svr, "offline2")
+
+	for i := 0; i < 3; i++ {
+		_, err := svr.Publish(newOfflinePublish("x"), nil)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 2, svr.OfflineQueueLen("offline2"))
+
+	st := svr.Stats()
+	require.Equal(t, int64(2), st.OfflineSpilled)
+	require.Equal(t, int64(1), st.OfflineDropped)
+	require.Equal(t, 2*rec, st.OfflineDiskBytes)
+
+	require.Len(t, dropped, 1)
+	require.Contains(t, string(dropped[0].Payload()), `"subscriber":"offline2"`)
+}
+
+func TestServerSessionExpiry(t *testing.T) {
+	svr := &Server{OfflineQueue: 10, SessionExpiry: 100 * time.Millisecond}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, _ := connectPersistent(t, ln, "offline3")
+	conn.Close()
+
+	waitOffline(t, svr, "offline3")
+
+	_, err := svr.Publish(newOfflinePublish("x"), nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, svr.OfflineQueueLen("offline3"))
+
+	require.True(t, waitFor(func() bool {
+		return svr.Stats().SessionsExpired == 1
+	}))
+	require.Equal(t, 0, svr.OfflineQueueLen("offline3"))
+
+	// The client starts afresh
+	conn, present := connectPersistent(t, ln, "offline3")
+	defer conn.Close()
+	require.False(t, present)
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err))
+}
+
+// keptSessions is a sessions provider that outlives the server, as if it
+// persisted the sessions.
+type keptSessions struct {
+	sessions.SessionsProvider
+}
+
+func (this keptSessions) Close() error {
+	return nil
+}
+
+func TestServerOfflineQueueLongClientId(t *testing.T) {
+	sessions.Register("kept", keptSessions{sessions.NewMemProvider()})
+	defer sessions.Unregister("kept")
+
+	// Too long to name a file after
+	cid := strings.Repeat("c", 300)
+	dir := t.TempDir()
+
+	svr := &Server{SessionsProvider: "kept", OfflineQueueDir: dir}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, _ := connectPersistent(t, ln, cid)
+	conn.Close()
+	waitOffline(t, svr, cid)
+
+	for i := 0; i < 2; i++ {
+		_, err := svr.Publish(newOfflinePublish(fmt.Sprint(i)), nil)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 2, svr.OfflineQueueLen(cid))
+	require.Equal(t, int64(0), svr.Stats().OfflineDropped)
+	require.NoError(t, svr.Close())
+
+	// The next run finds the queue, and whose it is
+	svr = &Server{SessionsProvider: "kept", OfflineQueueDir: dir}
+	require.NoError(t, svr.checkConfiguration())
+	require.Equal(t, 2, svr.OfflineQueueLen(cid))
+	require.NoError(t, svr.Close())
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/surgemq/message"
+)
+
+// ConnectOptions build the CONNECT message a client connects with, along with the
+// TLS config, rather than setting up the message by hand.
+//
+//	opts := service.NewConnectOptions("sensor1").
+//		SetKeepAlive(60).
+//		SetCredentials("sensor1", "secret").
+//		SetWill("sensors/sensor1/status", []byte("offline"), message.QosAtLeastOnce, true)
+//
+//	err := c.ConnectWith("tcp://127.0.0.1:1883", opts)
+//
+// The setters return the options so the calls can be chained. The first invalid
+// value is reported by Message, and by ConnectWith.
+type ConnectOptions struct {
+	msg *message.ConnectMessage
+	tls *tls.Config
+	err error
+}
+
+// NewConnectOptions returns the options for connecting as the client cid, with
+// MQTT 3.1.1, a clean session and the minimum keepalive of 30 seconds. An empty
+// cid asks the server to assign one.
+func NewConnectOptions(cid string) *ConnectOptions {
+	this := &ConnectOptions{msg: message.NewConnectMessage()}
+
+	this.msg.SetCleanSession(true)
+	this.msg.SetKeepAlive(minKeepAlive)
+	this.check(this.msg.SetVersion(protocolV311))
+	this.check(this.msg.SetClientId([]byte(cid)))
+
+	return this
+}
+
+// SetVersion sets the protocol level, 3 for MQTT 3.1 or 4 for MQTT 3.1.1.
+func (this *ConnectOptions) SetVersion(v byte) *ConnectOptions {
+	this.check(this.msg.SetVersion(v))
+	return this
+}
+
+// SetKeepAlive sets the keepalive, in seconds. It's raised to 30 seconds if it's
+// lower.
+func (this *ConnectOptions) SetKeepAlive(seconds uint16) *ConnectOptions {
+	this.msg.SetKeepAlive(seconds)
+	return this
+}
+
+// SetCleanSession sets whether the server starts a new session, rather than
+// resuming the one it has for the client.
+func (this *ConnectOptions) SetCleanSession(clean bool) *ConnectOptions {
+	this.msg.SetCleanSession(clean)
+	return this
+}
+
+// SetCredentials sets the username and password. An empty password is left out.
+func (this *ConnectOptions) SetCredentials(username, password string) *ConnectOptions {
+	this.msg.SetUsername([]byte(username))
+	this.msg.SetUsernameFlag(true)
+
+	if password != "" {
+		this.msg.SetPassword([]byte(password))
+		this.msg.SetPasswordFlag(true)
+	}
+
+	return this
+}
+
+// SetWill sets the message the server publishes if the client goes away without
+// disconnecting.
+func (this *ConnectOptions) SetWill(topic string, payload []byte, qos byte, retain bool) *ConnectOptions {
+	this.msg.SetWillFlag(true)
+	this.msg.SetWillTopic([]byte(topic))
+	this.msg.SetWillMessage(payload)
+	this.msg.SetWillRetain(retain)
+	this.check(this.msg.SetWillQos(qos))
+
+	return this
+}
+
+// SetTLSConfig makes ConnectWith connect over TLS with cfg.
+func (this *ConnectOptions) SetTLSConfig(cfg *tls.Config) *ConnectOptions {
+	this.tls = cfg
+	return this
+}
+
+// Message returns the CONNECT message, or the first invalid value set, or the
+// first rule of the spec the message breaks.
+func (this *ConnectOptions) Message() (*message.ConnectMessage, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+
+	if err := validateConnect(this.msg); err != nil {
+		return nil, err
+	}
+
+	return this.msg, nil
+}
+
+func (this *ConnectOptions) check(err error) {
+	if err != nil && this.err == nil {
+		this.err = err
+	}
+}
+
+// ConnectWith is the same as Connect, or ConnectTLS if the options have a TLS
+// config, but with the CONNECT message built by opts.
+func (this *Client) ConnectWith(uri string, opts *ConnectOptions) error {
+	return this.ConnectWithContext(context.Background(), uri, opts)
+}
+
+// ConnectWithContext is the same as ConnectWith, but gives up once ctx is done.
+func (this *Client) ConnectWithContext(ctx context.Context, uri string, opts *ConnectOptions) error {
+	msg, err := opts.Message()
+	if err != nil {
+		return err
+	}
+
+	return this.connectURI(ctx, uri, msg, opts.tls)
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestConnectOptions(t *testing.T) {
+	msg, err := NewConnectOptions("sensor1").
+		SetKeepAlive(60).
+		SetCleanSession(false).
+		SetCredentials("user", "secret").
+		SetWill("sensors/sensor1/status", []byte("offline"), message.QosAtLeastOnce, true).
+		Message()
+	require.NoError(t, err)
+
+	require.Equal(t, "sensor1", string(msg.ClientId()))
+	require.Equal(t, byte(protocolV311), msg.Version())
+	require.Equal(t, uint16(60), msg.KeepAlive())
+	require.False(t, msg.CleanSession())
+	require.Equal(t, "user", string(msg.Username()))
+	require.Equal(t, "secret", string(msg.Password()))
+	require.True(t, msg.WillFlag())
+	require.Equal(t, "sensors/sensor1/status", string(msg.WillTopic()))
+	require.Equal(t, "offline", string(msg.WillMessage()))
+	require.Equal(t, message.QosAtLeastOnce, msg.WillQos())
+	require.True(t, msg.WillRetain())
+
+	_, err = NewConnectOptions("sensor1").SetWill("status", nil, 3, false).Message()
+	require.Error(t, err)
+
+	_, err = NewConnectOptions("sensor1").SetVersion(5).Message()
+	require.Error(t, err)
+
+	// A persistent session needs a client ID
+	_, err = NewConnectOptions("").SetCleanSession(false).Message()
+	require.Error(t, err)
+}
+
+func TestClientConnectWith(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c := &Client{}
+	require.NoError(t, c.ConnectWith("tcp://"+ln.Addr().String(), NewConnectOptions("options").SetWill("will", []byte("gone"), 0, false)))
+	defer c.Disconnect()
+
+	// The client is added once the CONNACK has been sent
+	require.Eventually(t, func() bool {
+		return len(svr.Clients()) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, "options", svr.Clients()[0].ClientId)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// heldPublish is a message to a client held back while it resumes its session,
+// see Server.OrderedDelivery.
+type heldPublish struct {
+	msg        *message.PublishMessage
+	onComplete sessions.Completer
+}
+
+// inflightPublish is a message waiting for its ack, in the order of the messages
+// sent to a client.
+type inflightPublish struct {
+	q     *sessions.Ackqueue
+	pktid uint16
+	topic string
+	sent  time.Time
+}
+
+// resumeSession sends the client of svc, which has just connected, what it
+// missed, if it picked up its session: with OrderedDelivery, the messages it
+// hadn't acked before it disconnected, in the order they were first sent, then
+// its offline queue, then the messages published in the meantime.
+func (this *Server) resumeSession(svc *service, present bool) {
+	if this.OrderedDelivery && present {
+		if err := svc.resendInflight(0); err != nil {
+			svc.logger().Error("server/resumeSession: Error sending unacked messages again", logging.Err(err))
+		}
+	}
+
+	this.goOnline(svc, present)
+
+	svc.releaseHeld()
+}
+
+// hold holds back msg, sent with the RETAIN flag set if retain is true, while
+// the client is resuming its session. It returns false if the client isn't,
+// for the message to be sent right away.
+func (this *service) hold(msg *message.PublishMessage, retain bool, onComplete sessions.Completer) bool {
+	this.hmu.Lock()
+	defer this.hmu.Unlock()
+
+	if !this.holding {
+		return false
+	}
+
+	// The message may be shared with the other subscribers, or be in the
+	// incoming buffer of its publisher
+	m := copyPublish(msg)
+	m.SetRetain(retain)
+
+	this.held = append(this.held, heldPublish{m, onComplete})
+
+	return true
+}
+
+// releaseHeld sends the messages held back while the client was resuming its
+// session, in the order they were published, and stops holding them.
+func (this *service) releaseHeld() {
+	for {
+		this.hmu.Lock()
+		held := this.held
+		this.held = nil
+		if len(held) == 0 {
+			this.holding = false
+		}
+		this.hmu.Unlock()
+
+		if len(held) == 0 {
+			return
+		}
+
+		for _, hp := range held {
+			if err := this.publish(hp.msg, hp.onComplete); err != nil {
+				this.logger().Error("service/releaseHeld: Error publishing message", logging.Err(err))
+			}
+		}
+	}
+}
+
+// resendInflight sends the messages waiting for their acks again, in the order
+// they were first sent, from the one with the packet ID pktid on, and only those
+// on the same topic as it, or all of them if pktid is 0. The QoS 2 messages the
+// client has received are resent as their PUBREL.
+func (this *service) resendInflight(pktid uint16) error {
+	var (
+		msgs  []inflightPublish
+		from  = -1
+		topic string
+	)
+
+	for _, q := range this.inflightQueues() {
+		for _, am := range q.Unacked() {
+			ip := inflightPublish{q: q, pktid: am.Pktid, sent: am.Sent}
+
+			pub := message.NewPublishMessage()
+			if _, err := pub.Decode(am.Msgbuf); err == nil {
+				ip.topic = string(pub.Topic())
+			}
+
+			msgs = append(msgs, ip)
+		}
+	}
+
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return msgs[i].sent.Before(msgs[j].sent)
+	})
+
+	if pktid == 0 {
+		from = 0
+	} else {
+		for i, ip := range msgs {
+			if ip.pktid == pktid {
+				from, topic = i, ip.topic
+				break
+			}
+		}
+	}
+
+	if from < 0 {
+		return sessions.ErrAckNotFound
+	}
+
+	for _, ip := range msgs[from:] {
+		if pktid != 0 && ip.topic != topic {
+			continue
+		}
+
+		msg, err := ip.q.Retry(ip.pktid)
+		if err == sessions.ErrAckNotFound {
+			// Acked in the meantime
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := this.writeMessage(msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func readPublish(t *testing.T, conn net.Conn) *message.PublishMessage {
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	_, err = msg.Decode(buf)
+	require.NoError(t, err)
+
+	return msg
+}
+
+func TestServerOrderedRetry(t *testing.T) {
+	svr := &Server{OrderedDelivery: true}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, _ := connectPersistent(t, ln, "ordered1")
+	defer conn.Close()
+
+	var pktids []uint16
+
+	for i := 0; i < 3; i++ {
+		_, err := svr.Publish(newOfflinePublish(fmt.Sprint(i)), nil)
+		require.NoError(t, err)
+
+		pktids = append(pktids, readPublish(t, conn).PacketId())
+	}
+
+	// The second is acked, the others aren't
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(pktids[1])
+	require.NoError(t, writeMessage(conn, ack))
+
+	require.True(t, waitFor(func() bool {
+		msgs, err := svr.Inflight("ordered1")
+		return err == nil && len(msgs) == 2
+	}))
+
+	// Sending the first again sends the third after it
+	require.NoError(t, svr.RetryInflight("ordered1", pktids[0]))
+
+	for _, want := range []string{"0", "2"} {
+		msg := readPublish(t, conn)
+		require.Equal(t, want, string(msg.Payload()))
+		require.True(t, msg.Dup())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err))
+}
+
+func TestServerOrderedReconnect(t *testing.T) {
+	svr := &Server{OrderedDelivery: true, OfflineQueue: 100}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, _ := connectPersistent(t, ln, "ordered2")
+
+	// Sent and never acked
+	for i := 0; i < 2; i++ {
+		_, err := svr.Publish(newOfflinePublish(fmt.Sprint(i)), nil)
+		require.NoError(t, err)
+		readPublish(t, conn)
+	}
+
+	conn.Close()
+
+	require.True(t, waitFor(func() bool {
+		return len(svr.Clients()) == 0
+	}))
+
+	// Queued while the client is away
+	for i := 2; i < 4; i++ {
+		_, err := svr.Publish(newOfflinePublish(fmt.Sprint(i)), nil)
+		require.NoError(t, err)
+	}
+
+	// And published all through the client coming back
+	const n = 50
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 4; i < n; i++ {
+			svr.Publish(newOfflinePublish(fmt.Sprint(i)), nil)
+			time.Sleep(200 * time.Microsecond)
+		}
+	}()
+
+	conn, present := connectPersistent(t, ln, "ordered2")
+	defer conn.Close()
+	require.True(t, present)
+
+	<-done
+
+	// Duplicates are fine, but no message overtakes one published before it
+	var first []string
+	seen := make(map[string]bool)
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(first) < n {
+		msg := readPublish(t, conn)
+
+		if p := string(msg.Payload()); !seen[p] {
+			seen[p] = true
+			first = append(first, p)
+		}
+	}
+
+	for i, p := range first {
+		require.Equal(t, fmt.Sprint(i), p)
+	}
+}
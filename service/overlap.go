@@ -0,0 +1,110 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/surgemq/surgemq/topics"
+)
+
+// OverlapPolicy is how a message is delivered to a client with more than one
+// subscription matching its topic, e.g. "a/#" and "a/b" for "a/b".
+type OverlapPolicy int
+
+const (
+	// OverlapDeliverOnce delivers the message once, respecting the highest QoS
+	// of the matching subscriptions, as the MQTT spec says [MQTT-3.3.5-1]. The
+	// subscriptions' options are combined: it's only kept from the client that
+	// published it if all of them have topics.NoLocal, and keeps its RETAIN
+	// flag if any of them has topics.RetainAsPublished.
+	OverlapDeliverOnce OverlapPolicy = iota
+
+	// OverlapDeliverEach delivers the message once for each matching
+	// subscription, with the options of each, as MQTT 5 allows.
+	OverlapDeliverEach
+)
+
+func (this OverlapPolicy) String() string {
+	switch this {
+	case OverlapDeliverOnce:
+		return "once"
+	case OverlapDeliverEach:
+		return "each"
+	}
+
+	return "unknown"
+}
+
+// The number of subscribers above which duplicates are found with a map, rather
+// than by comparing each with the ones before it
+const overlapScanMax = 16
+
+// dedupeSubscribers removes the subscribers that appear more than once in subs,
+// for more than one matching subscription, with OverlapDeliverOnce. qoss are
+// the QoS and the options of each, as returned by the TopicsProvider, and the
+// options of the duplicates are combined into the one that's kept.
+func (this *Server) dedupeSubscribers(subs *[]interface{}, qoss *[]byte) {
+	if this == nil || this.OverlappingSubscriptions != OverlapDeliverOnce || len(*subs) < 2 {
+		return
+	}
+
+	s, q := *subs, *qoss
+
+	var index map[interface{}]int
+	if len(s) > overlapScanMax {
+		index = make(map[interface{}]int, len(s))
+	}
+
+	n := 0
+
+	for i, sub := range s {
+		j := -1
+
+		if index != nil {
+			if k, ok := index[sub]; ok {
+				j = k
+			} else {
+				index[sub] = n
+			}
+		} else {
+			for k := 0; k < n; k++ {
+				if s[k] == sub {
+					j = k
+					break
+				}
+			}
+		}
+
+		if j >= 0 {
+			q[j] = mergeOptions(q[j], q[i])
+			continue
+		}
+
+		s[n], q[n] = sub, q[i]
+		n++
+	}
+
+	*subs, *qoss = s[:n], q[:n]
+}
+
+// mergeOptions combines the QoS and options of two subscriptions of the same
+// client matching a message.
+func mergeOptions(a, b byte) byte {
+	qos := a & topics.QosMask
+	if b&topics.QosMask > qos {
+		qos = b & topics.QosMask
+	}
+
+	return qos | a&b&topics.NoLocal | (a|b)&topics.RetainAsPublished
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestServerOverlappingSubscriptions(t *testing.T) {
+	for _, policy := range []OverlapPolicy{OverlapDeliverOnce, OverlapDeliverEach} {
+		t.Run(policy.String(), func(t *testing.T) {
+			svr := &Server{OverlappingSubscriptions: policy}
+
+			ln := serveTestServer(t, svr)
+			defer ln.Close()
+
+			var got int
+			var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+				got++
+				return nil
+			}
+
+			for _, filter := range []string{"a/#", "a/b", "+/b"} {
+				_, err := svr.Subscribe([]byte(filter), message.QosAtLeastOnce, &onpub)
+				require.NoError(t, err)
+			}
+
+			_, err := svr.Publish(newTestPublish("a/b"), nil)
+			require.NoError(t, err)
+
+			if policy == OverlapDeliverOnce {
+				require.Equal(t, 1, got)
+			} else {
+				require.Equal(t, 3, got)
+			}
+		})
+	}
+}
+
+func TestServerOverlappingClientSubscriptions(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtMostOnce)
+	sub.AddTopic([]byte("a/b"), message.QosAtLeastOnce)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	_, err = svr.Publish(newTestPublish("a/b"), nil)
+	require.NoError(t, err)
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(conn, 0)
+	require.True(t, isTimeout(err))
+}
+
+func TestMergeOptions(t *testing.T) {
+	// The highest QoS, NoLocal only if both have it, RetainAsPublished if either
+	require.Equal(t, byte(1)|topics.RetainAsPublished, mergeOptions(0|topics.NoLocal, 1|topics.RetainAsPublished))
+	require.Equal(t, byte(2)|topics.NoLocal, mergeOptions(2|topics.NoLocal, 0|topics.NoLocal))
+}
+
+func TestDedupeSubscribersMap(t *testing.T) {
+	svr := &Server{}
+
+	var fns [overlapScanMax]OnPublishFunc
+
+	var subs []interface{}
+	var qoss []byte
+
+	// Each of them twice, the second time with RetainAsPublished
+	for _, opts := range []byte{0, topics.RetainAsPublished} {
+		for i := range fns {
+			subs = append(subs, &fns[i])
+			qoss = append(qoss, opts)
+		}
+	}
+
+	svr.dedupeSubscribers(&subs, &qoss)
+
+	require.Len(t, subs, overlapScanMax)
+	for i := range fns {
+		require.Equal(t, &fns[i], subs[i])
+		require.Equal(t, topics.RetainAsPublished, qoss[i])
+	}
+}
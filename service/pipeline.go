@@ -0,0 +1,308 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/topics"
+)
+
+var (
+	ErrStageExists   error = errors.New("service: Pipeline stage already exists")
+	ErrStageNotFound error = errors.New("service: Pipeline stage not found")
+)
+
+// Phase is where in the pipeline a stage runs. The phases always run in order,
+// and the stages within a phase run in the order they were added.
+type Phase int
+
+const (
+	// PhaseAuth stages decide whether the client is allowed to publish the
+	// message at all.
+	PhaseAuth Phase = iota
+
+	// PhaseValidation stages check the message is well formed.
+	PhaseValidation
+
+	// PhaseEnrichment stages add to, or transform, the message.
+	PhaseEnrichment
+
+	// PhaseRouting stages decide where the message goes, e.g., by rewriting its
+	// topic.
+	PhaseRouting
+)
+
+func (this Phase) String() string {
+	switch this {
+	case PhaseAuth:
+		return "auth"
+	case PhaseValidation:
+		return "validation"
+	case PhaseEnrichment:
+		return "enrichment"
+	case PhaseRouting:
+		return "routing"
+	}
+
+	return fmt.Sprintf("phase%d", int(this))
+}
+
+// StageFunc processes a message published by the client cid. It returns the
+// message to carry on with, which can be msg itself, changed or not, or a new
+// message. If it returns nil then the message is dropped. If it returns an error
+// then the message is dropped and the error logged.
+type StageFunc func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error)
+
+// Stage is a named step of the pipeline.
+type Stage struct {
+	// Name identifies the stage in the pipeline and in the stats.
+	Name string
+
+	// Phase is where in the pipeline the stage runs.
+	Phase Phase
+
+	// Filter limits the stage to the topics that match the topic filter, so
+	// different classes of topics can be processed differently. If not set then
+	// the stage processes all the messages.
+	Filter string
+
+	// Feature limits the stage to the clients of the tenants the feature is on
+	// for, see Server.Features, so a new stage can be rolled out gradually. If
+	// not set then the stage processes the messages of all the clients.
+	Feature Feature
+
+	// Process is called for every message that goes through the stage.
+	Process StageFunc
+}
+
+// StageStats are the counters of a pipeline stage.
+type StageStats struct {
+	Name  string
+	Phase Phase
+
+	// Processed is the number of messages the stage was called for, Dropped the
+	// number it dropped, and Errors the number it failed on.
+	Processed int64
+	Dropped   int64
+	Errors    int64
+
+	// Time is the total time spent in the stage.
+	Time time.Duration
+}
+
+type stage struct {
+	Stage
+
+	processed int64
+	dropped   int64
+	errors    int64
+	nanos     int64
+}
+
+// Pipeline is an ordered list of stages the messages published by clients go
+// through before they are delivered to the subscribers and the bridges. Stages
+// can be added while the server is running.
+type Pipeline struct {
+	mu     sync.RWMutex
+	stages []*stage
+}
+
+// Add adds the stage after all the other stages of the same phase.
+func (this *Pipeline) Add(s Stage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.find(s.Name) >= 0 {
+		return ErrStageExists
+	}
+
+	i := len(this.stages)
+	for i > 0 && this.stages[i-1].Phase > s.Phase {
+		i--
+	}
+
+	this.insert(i, s)
+	return nil
+}
+
+// InsertBefore adds the stage right before the stage named name, in the same
+// phase as that stage.
+func (this *Pipeline) InsertBefore(name string, s Stage) error {
+	return this.insertAt(name, 0, s)
+}
+
+// InsertAfter adds the stage right after the stage named name, in the same phase
+// as that stage.
+func (this *Pipeline) InsertAfter(name string, s Stage) error {
+	return this.insertAt(name, 1, s)
+}
+
+// Remove removes the stage named name.
+func (this *Pipeline) Remove(name string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	i := this.find(name)
+	if i < 0 {
+		return ErrStageNotFound
+	}
+
+	stages := make([]*stage, 0, len(this.stages)-1)
+	stages = append(stages, this.stages[:i]...)
+	this.stages = append(stages, this.stages[i+1:]...)
+
+	return nil
+}
+
+// Stats returns the counters of every stage, in pipeline order.
+func (this *Pipeline) Stats() []StageStats {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	stats := make([]StageStats, len(this.stages))
+
+	for i, s := range this.stages {
+		stats[i] = StageStats{
+			Name:      s.Name,
+			Phase:     s.Phase,
+			Processed: atomic.LoadInt64(&s.processed),
+			Dropped:   atomic.LoadInt64(&s.dropped),
+			Errors:    atomic.LoadInt64(&s.errors),
+			Time:      time.Duration(atomic.LoadInt64(&s.nanos)),
+		}
+	}
+
+	return stats
+}
+
+func (this *Pipeline) insertAt(name string, offset int, s Stage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.find(s.Name) >= 0 {
+		return ErrStageExists
+	}
+
+	i := this.find(name)
+	if i < 0 {
+		return ErrStageNotFound
+	}
+
+	s.Phase = this.stages[i].Phase
+	this.insert(i+offset, s)
+
+	return nil
+}
+
+// insert puts the stage at index i. The stages slice is never changed in place,
+// so process can carry on with the old one while stages are being added.
+func (this *Pipeline) insert(i int, s Stage) {
+	stages := make([]*stage, 0, len(this.stages)+1)
+	stages = append(stages, this.stages[:i]...)
+	stages = append(stages, &stage{Stage: s})
+	this.stages = append(stages, this.stages[i:]...)
+}
+
+func (this *Pipeline) find(name string) int {
+	for i, s := range this.stages {
+		if s.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// process runs the message through all the stages, except the PhaseAuth ones if
+// bypassAuth is set, and those of features that aren't enabled for the client.
+// It returns nil if one of the stages dropped it, or if acl is ACLDeny and none
+// of the PhaseAuth stages let it through. A nil pipeline has no stages.
+func (this *Pipeline) process(log logging.Logger, cid string, msg *message.PublishMessage, bypassAuth bool, acl ACLPolicy, enabled func(Feature) bool) *message.PublishMessage {
+	msg, _ = this.processACL(log, cid, msg, bypassAuth, acl, enabled)
+	return msg
+}
+
+// processACL is process, also returning whether the message was dropped by an
+// ACL, i.e. by one of the PhaseAuth stages or by acl.
+func (this *Pipeline) processACL(log logging.Logger, cid string, msg *message.PublishMessage, bypassAuth bool, acl ACLPolicy, enabled func(Feature) bool) (*message.PublishMessage, bool) {
+	// Unless an ACL lets it through, the message is only allowed by default
+	authorized := bypassAuth || acl != ACLDeny
+
+	if this == nil {
+		if !authorized {
+			return nil, true
+		}
+		return msg, false
+	}
+
+	this.mu.RLock()
+	stages := this.stages
+	this.mu.RUnlock()
+
+	for _, s := range stages {
+		if s.Phase == PhaseAuth && bypassAuth {
+			continue
+		}
+
+		if s.Phase != PhaseAuth && !authorized {
+			log.Debug("service/pipeline: Denied by default ACL", logging.F("topic", string(msg.Topic())))
+			return nil, true
+		}
+
+		if s.Filter != "" && !topics.Match([]byte(s.Filter), msg.Topic()) {
+			continue
+		}
+
+		if s.Feature != "" && (enabled == nil || !enabled(s.Feature)) {
+			continue
+		}
+
+		start := time.Now()
+		out, err := s.Process(cid, msg)
+		atomic.AddInt64(&s.nanos, int64(time.Since(start)))
+		atomic.AddInt64(&s.processed, 1)
+
+		if err != nil {
+			atomic.AddInt64(&s.errors, 1)
+			log.Error("service/pipeline: Stage failed", logging.F("stage", s.Name), logging.F("topic", string(msg.Topic())), logging.Err(err))
+			return nil, false
+		}
+
+		if out == nil {
+			atomic.AddInt64(&s.dropped, 1)
+			return nil, s.Phase == PhaseAuth
+		}
+
+		msg = out
+
+		if s.Phase == PhaseAuth {
+			authorized = true
+		}
+	}
+
+	if !authorized {
+		log.Debug("service/pipeline: Denied by default ACL", logging.F("topic", string(msg.Topic())))
+		return nil, true
+	}
+
+	return msg, false
+}
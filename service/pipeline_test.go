@@ -0,0 +1,192 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// appendStage appends its name to the payload, so the payload shows the order the
+// stages ran in.
+func appendStage(name string, phase Phase) Stage {
+	return Stage{
+		Name:  name,
+		Phase: phase,
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			msg.SetPayload(append(msg.Payload(), []byte(name+" ")...))
+			return msg, nil
+		},
+	}
+}
+
+func newTestPublish(topic string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	return msg
+}
+
+func TestPipelineOrder(t *testing.T) {
+	p := &Pipeline{}
+
+	require.NoError(t, p.Add(appendStage("route", PhaseRouting)))
+	require.NoError(t, p.Add(appendStage("auth", PhaseAuth)))
+	require.NoError(t, p.Add(appendStage("enrich1", PhaseEnrichment)))
+	require.NoError(t, p.Add(appendStage("validate", PhaseValidation)))
+	require.NoError(t, p.Add(appendStage("enrich2", PhaseEnrichment)))
+	require.NoError(t, p.InsertBefore("enrich1", appendStage("user1", PhaseRouting)))
+	require.NoError(t, p.InsertAfter("enrich2", appendStage("user2", PhaseAuth)))
+
+	require.Equal(t, ErrStageExists, p.Add(appendStage("auth", PhaseAuth)))
+	require.Equal(t, ErrStageNotFound, p.InsertAfter("missing", appendStage("user3", PhaseAuth)))
+
+	msg := p.process(logging.Nop(), "c1", newTestPublish("a/b"), false, ACLAllow, nil)
+	require.Equal(t, "auth validate user1 enrich1 enrich2 user2 route ", string(msg.Payload()))
+
+	// Inserted stages take the phase of the stage they were inserted next to
+	stats := p.Stats()
+	require.Equal(t, "user1", stats[2].Name)
+	require.Equal(t, PhaseEnrichment, stats[2].Phase)
+
+	require.NoError(t, p.Remove("user1"))
+	require.Equal(t, ErrStageNotFound, p.Remove("user1"))
+
+	msg = p.process(logging.Nop(), "c1", newTestPublish("a/b"), false, ACLAllow, nil)
+	require.Equal(t, "auth validate enrich1 enrich2 user2 route ", string(msg.Payload()))
+}
+
+func TestPipelineDropAndFilter(t *testing.T) {
+	p := &Pipeline{}
+
+	// Only alarms are enriched
+	alarms := appendStage("alarms", PhaseEnrichment)
+	alarms.Filter = "alarms/#"
+	require.NoError(t, p.Add(alarms))
+
+	require.NoError(t, p.Add(Stage{
+		Name:  "acl",
+		Phase: PhaseAuth,
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			if cid != "c1" {
+				return nil, nil
+			}
+			return msg, nil
+		},
+	}))
+
+	require.NoError(t, p.Add(Stage{
+		Name:  "size",
+		Phase: PhaseValidation,
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			if string(msg.Topic()) == "bad" {
+				return nil, errors.New("bad message")
+			}
+			return msg, nil
+		},
+	}))
+
+	require.Equal(t, "alarms ", string(p.process(logging.Nop(), "c1", newTestPublish("alarms/fire"), false, ACLAllow, nil).Payload()))
+	require.Equal(t, "", string(p.process(logging.Nop(), "c1", newTestPublish("sensors/1"), false, ACLAllow, nil).Payload()))
+	require.Nil(t, p.process(logging.Nop(), "c2", newTestPublish("alarms/fire"), false, ACLAllow, nil))
+	require.Nil(t, p.process(logging.Nop(), "c1", newTestPublish("bad"), false, ACLAllow, nil))
+
+	stats := p.Stats()
+	require.Equal(t, []string{"acl", "size", "alarms"}, []string{stats[0].Name, stats[1].Name, stats[2].Name})
+
+	require.Equal(t, int64(4), stats[0].Processed)
+	require.Equal(t, int64(1), stats[0].Dropped)
+	require.Equal(t, int64(3), stats[1].Processed)
+	require.Equal(t, int64(1), stats[1].Errors)
+	require.Equal(t, int64(1), stats[2].Processed)
+
+	var nilp *Pipeline
+	msg := newTestPublish("a/b")
+	require.Equal(t, msg, nilp.process(logging.Nop(), "c1", msg, false, ACLAllow, nil))
+}
+
+func TestServerPipeline(t *testing.T) {
+	p := &Pipeline{}
+	require.NoError(t, p.Add(Stage{
+		Name:  "prefix",
+		Phase: PhaseRouting,
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			if string(msg.Payload()) == "drop" {
+				return nil, nil
+			}
+
+			out := message.NewPublishMessage()
+			out.SetTopic(append([]byte(cid+"/"), msg.Topic()...))
+			out.SetPayload(msg.Payload())
+			out.SetQoS(msg.QoS())
+			return out, nil
+		},
+	}))
+
+	svr := &Server{Pipeline: p}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("#"), message.QosAtLeastOnce, &onpub)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	connect := newConnectMessage()
+	require.NoError(t, writeMessage(conn, connect))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	// Dropped messages are still acknowledged
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("a/b"))
+	pub.SetPayload([]byte("drop"))
+	pub.SetQoS(message.QosAtLeastOnce)
+	pub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, pub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	pub.SetPayload([]byte("abc"))
+	pub.SetPacketId(2)
+	require.NoError(t, writeMessage(conn, pub))
+
+	select {
+	case msg := <-got:
+		require.Equal(t, string(connect.ClientId())+"/a/b", string(msg.Topic()))
+		require.Equal(t, "abc", string(msg.Payload()))
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message")
+	}
+
+	require.Len(t, got, 0)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// Presence returns when client cid was last seen: since when it's been
+// connected, or when and why it disconnected. It's ErrClientNotFound for a
+// client that has never connected. The presence of the clients is persisted by
+// the SessionsProvider if it implements sessions.PresenceStore.
+func (this *Server) Presence(cid string) (sessions.Presence, error) {
+	this.pmu.Lock()
+	defer this.pmu.Unlock()
+
+	p := this.presence[cid]
+	if p == nil {
+		return sessions.Presence{}, ErrClientNotFound
+	}
+
+	return *p, nil
+}
+
+// Presences returns the presence of every client that has connected, sorted by
+// client ID.
+func (this *Server) Presences() []sessions.Presence {
+	this.pmu.Lock()
+	ps := make([]sessions.Presence, 0, len(this.presence))
+	for _, p := range this.presence {
+		ps = append(ps, *p)
+	}
+	this.pmu.Unlock()
+
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].ClientId < ps[j].ClientId
+	})
+
+	return ps
+}
+
+// presenceConnected records the client of svc has connected.
+func (this *Server) presenceConnected(svc *service) {
+	this.savePresence(svc, func(p *sessions.Presence) {
+		*p = sessions.Presence{
+			ClientId:       p.ClientId,
+			Username:       string(svc.sess.Cmsg.Username()),
+			RemoteAddr:     svc.remoteAddr,
+			Connected:      true,
+			ConnectedSince: time.Now().UTC(),
+		}
+	})
+}
+
+// presenceDisconnected records the client of svc has disconnected, and why.
+func (this *Server) presenceDisconnected(svc *service) {
+	this.savePresence(svc, func(p *sessions.Presence) {
+		p.Connected = false
+		p.DisconnectedAt = time.Now().UTC()
+		p.DisconnectReason = svc.disconnectReason().String()
+	})
+}
+
+// savePresence updates the presence of the client of svc with update, and
+// persists it.
+func (this *Server) savePresence(svc *service, update func(*sessions.Presence)) {
+	cid := svc.sess.ID()
+
+	this.pmu.Lock()
+	if this.presence == nil {
+		this.presence = make(map[string]*sessions.Presence)
+	}
+
+	p := this.presence[cid]
+	if p == nil {
+		p = &sessions.Presence{ClientId: cid}
+		this.presence[cid] = p
+	}
+
+	update(p)
+	saved := *p
+	this.pmu.Unlock()
+
+	if err := this.sessMgr.SavePresence(saved); err != nil {
+		svc.logger().Error("server/savePresence: Error saving presence", logging.Err(err))
+	}
+}
+
+// loadPresence reads the persisted presence of the clients back from the session
+// store. The clients that were still connected when the server last stopped
+// weren't seen disconnecting, so they are recorded as having lost their
+// connections, at an unknown time.
+func (this *Server) loadPresence() error {
+	ps, err := this.sessMgr.Presences()
+	if err != nil {
+		return fmt.Errorf("server/loadPresence: Error reading presence: %v", err)
+	}
+
+	this.pmu.Lock()
+	defer this.pmu.Unlock()
+
+	this.presence = make(map[string]*sessions.Presence, len(ps))
+
+	for _, p := range ps {
+		p := p
+
+		if p.Connected {
+			p.Connected = false
+			p.DisconnectReason = DisconnectConnectionLost.String()
+		}
+
+		this.presence[p.ClientId] = &p
+	}
+
+	return nil
+}
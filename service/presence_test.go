@@ -0,0 +1,136 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// presenceStore is a session store that keeps the presence of the clients, as a
+// persistent one would.
+type presenceStore struct {
+	sessions.SessionsProvider
+
+	mu sync.Mutex
+	ps map[string]sessions.Presence
+}
+
+func (this *presenceStore) SavePresence(p sessions.Presence) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.ps[p.ClientId] = p
+	return nil
+}
+
+func (this *presenceStore) Presences() ([]sessions.Presence, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	ps := make([]sessions.Presence, 0, len(this.ps))
+	for _, p := range this.ps {
+		ps = append(ps, p)
+	}
+
+	return ps, nil
+}
+
+func TestServerPresence(t *testing.T) {
+	store := &presenceStore{SessionsProvider: sessions.NewMemProvider(), ps: make(map[string]sessions.Presence)}
+
+	sessions.Unregister("presence")
+	sessions.Register("presence", store)
+	defer sessions.Unregister("presence")
+
+	svr := &Server{SessionsProvider: "presence"}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	_, err := svr.Presence("nobody")
+	require.Equal(t, ErrClientNotFound, err)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cid := string(cmsg.ClientId())
+
+	require.NoError(t, writeMessage(conn, cmsg))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	require.True(t, waitFor(func() bool {
+		p, err := svr.Presence(cid)
+		return err == nil && p.Connected
+	}))
+
+	p, err := svr.Presence(cid)
+	require.NoError(t, err)
+	require.Equal(t, "surgemq", p.Username)
+	require.False(t, p.ConnectedSince.IsZero())
+	require.True(t, p.DisconnectedAt.IsZero())
+
+	require.NoError(t, writeMessage(conn, message.NewDisconnectMessage()))
+	conn.Close()
+
+	require.True(t, waitFor(func() bool {
+		p, err := svr.Presence(cid)
+		return err == nil && !p.Connected
+	}))
+
+	p, err = svr.Presence(cid)
+	require.NoError(t, err)
+	require.Equal(t, DisconnectNormal.String(), p.DisconnectReason)
+	require.False(t, p.DisconnectedAt.Before(p.ConnectedSince))
+	require.Equal(t, []sessions.Presence{p}, svr.Presences())
+
+	// Persisted, and read back by the next server using the store
+	ps, err := store.Presences()
+	require.NoError(t, err)
+	require.Equal(t, []sessions.Presence{p}, ps)
+
+	svr2 := &Server{SessionsProvider: "presence"}
+	require.NoError(t, svr2.checkConfiguration())
+
+	p2, err := svr2.Presence(cid)
+	require.NoError(t, err)
+	require.Equal(t, p, p2)
+}
+
+func TestServerPresenceLoadConnected(t *testing.T) {
+	store := &presenceStore{SessionsProvider: sessions.NewMemProvider(), ps: make(map[string]sessions.Presence)}
+	store.ps["gone"] = sessions.Presence{ClientId: "gone", Connected: true}
+
+	sessions.Unregister("presence")
+	sessions.Register("presence", store)
+	defer sessions.Unregister("presence")
+
+	// A client that was connected when the server went down didn't disconnect
+	// the usual way
+	svr := &Server{SessionsProvider: "presence"}
+	require.NoError(t, svr.checkConfiguration())
+
+	p, err := svr.Presence("gone")
+	require.NoError(t, err)
+	require.False(t, p.Connected)
+	require.Equal(t, DisconnectConnectionLost.String(), p.DisconnectReason)
+}
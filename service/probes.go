@@ -0,0 +1,97 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+)
+
+var (
+	ErrProbe error = errors.New("service: Connection is a health check probe")
+)
+
+// Probes returns the number of connections closed so far as load balancer
+// health check probes. See DetectProbes.
+func (this *Server) Probes() int64 {
+	return atomic.LoadInt64(&this.probes)
+}
+
+// probeConn wraps a connection while waiting for the first packet, to tell the
+// health check probes of load balancers, which hang up without sending
+// anything or send something other than MQTT, from clients.
+type probeConn struct {
+	net.Conn
+
+	// The number of bytes read so far, and the first of them
+	n     int
+	first byte
+
+	// The read deadline to move to once the first byte arrives, if the grace
+	// for it is shorter than the connect timeout
+	deadline time.Time
+}
+
+// newProbeConn wraps conn, giving the other end until grace to send anything,
+// and then until deadline for the rest. A grace of 0 waits until deadline.
+func newProbeConn(conn net.Conn, grace time.Duration, deadline time.Time) *probeConn {
+	p := &probeConn{Conn: conn}
+
+	if grace > 0 && time.Now().Add(grace).Before(deadline) {
+		p.deadline = deadline
+		deadline = time.Now().Add(grace)
+	}
+
+	conn.SetReadDeadline(deadline)
+
+	return p
+}
+
+func (this *probeConn) Read(b []byte) (int, error) {
+	n, err := this.Conn.Read(b)
+	if n > 0 && this.n == 0 {
+		this.first = b[0]
+
+		if !this.deadline.IsZero() {
+			this.Conn.SetReadDeadline(this.deadline)
+		}
+	}
+
+	this.n += n
+
+	return n, err
+}
+
+// probe returns whether the connection looks like a health check, i.e. nothing
+// was received, or what was received isn't a CONNECT.
+func (this *probeConn) probe() bool {
+	return this.n == 0 || message.MessageType(this.first>>4) != message.CONNECT
+}
+
+// isProbe returns whether the connection read through p, which failed with err
+// while waiting for the first packet, is to be treated as a probe.
+func (this *Server) isProbe(p *probeConn, err error) bool {
+	if !this.DetectProbes || err == nil || !p.probe() {
+		return false
+	}
+
+	atomic.AddInt64(&this.probes, 1)
+
+	return true
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerDetectProbes(t *testing.T) {
+	svr := &Server{DetectProbes: true}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	// One that hangs up straight away, and one that sends an HTTP health check
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /health HTTP/1.1\r\n\r\n"))
+	require.NoError(t, err)
+
+	// Probes are closed without a CONNACK, and without waiting for the rest of
+	// what they send, which may reset the connection rather than end it
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(make([]byte, 4))
+	require.Equal(t, 0, n)
+	require.Error(t, err)
+
+	ne, ok := err.(net.Error)
+	require.False(t, ok && ne.Timeout(), "Timed out waiting for the probe to be closed")
+
+	require.True(t, waitFor(func() bool {
+		return svr.Probes() == 2
+	}), "Timed out waiting for the probes to be counted")
+
+	// Clients are still let in, and aren't counted as probes
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	c.Disconnect()
+
+	st := svr.Stats()
+	require.Equal(t, int64(2), st.Probes)
+	require.Equal(t, int64(1), st.Accepted)
+}
+
+func TestServerProbeGrace(t *testing.T) {
+	svr := &Server{DetectProbes: true, ProbeGrace: 50 * time.Millisecond, ConnectTimeout: 10}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Closed well before the connect timeout for not sending anything
+	start := time.Now()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 4))
+	require.Equal(t, io.EOF, err)
+	require.True(t, time.Since(start) < 5*time.Second)
+
+	require.True(t, waitFor(func() bool {
+		return svr.Probes() == 1
+	}), "Timed out waiting for the probe to be counted")
+}
+
+func TestServerProbesNotDetected(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	c.Disconnect()
+
+	require.Equal(t, int64(0), svr.Probes())
+}
@@ -18,11 +18,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"reflect"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
 	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
@@ -37,13 +38,19 @@ func (this *service) processor() {
 			//glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
 		}
 
-		this.wgStopped.Done()
-		this.stop()
+		// A parked service is only stopping its goroutines
+		parked := this.isParked()
+
+		this.exited()
+
+		if !parked {
+			this.stop()
+		}
 
 		//glog.Debugf("(%s) Stopping processor", this.cid())
 	}()
 
-	glog.Debugf("(%s) Starting processor", this.cid())
+	this.logger().Debug("service/processor: Starting processor")
 
 	this.wgStarted.Done()
 
@@ -51,30 +58,35 @@ func (this *service) processor() {
 		// 1. Find out what message is next and the size of the message
 		mtype, total, err := this.peekMessageSize()
 		if err != nil {
-			//if err != io.EOF {
-			glog.Errorf("(%s) Error peeking next message size: %v", this.cid(), err)
-			//}
+			if !this.isParked() {
+				this.logger().Error("service/processor: Error peeking next message size", logging.Err(err))
+			}
 			return
 		}
 
 		msg, n, err := this.peekMessage(mtype, total)
 		if err != nil {
 			//if err != io.EOF {
-			glog.Errorf("(%s) Error peeking next message: %v", this.cid(), err)
+			this.logger().Error("service/processor: Error peeking next message", logging.Err(err))
 			//}
+			if err != io.EOF {
+				this.setReason(DisconnectProtocolError)
+			}
 			return
 		}
 
 		//glog.Debugf("(%s) Received: %s", this.cid(), msg)
 
 		this.inStat.increment(int64(n))
+		this.received()
 
 		// 5. Process the read message
 		err = this.processIncoming(msg)
 		if err != nil {
 			if err != errDisconnect {
-				glog.Errorf("(%s) Error processing %s: %v", this.cid(), msg.Name(), err)
+				this.logger().Error("service/processor: Error processing message", logging.F("type", msg.Name()), logging.Err(err))
 			} else {
+				this.setReason(DisconnectProtocolError)
 				return
 			}
 		}
@@ -83,7 +95,7 @@ func (this *service) processor() {
 		_, err = this.in.ReadCommit(total)
 		if err != nil {
 			if err != io.EOF {
-				glog.Errorf("(%s) Error committing %d read bytes: %v", this.cid(), total, err)
+				this.logger().Error("service/processor: Error committing read bytes", logging.F("bytes", total), logging.Err(err))
 			}
 			return
 		}
@@ -102,6 +114,12 @@ func (this *service) processor() {
 func (this *service) processIncoming(msg message.Message) error {
 	var err error = nil
 
+	// [MQTT-4.8.0-1] The connection is closed on any protocol violation
+	if err = checkPacket(msg, this.compliance, this.logger()); err != nil {
+		this.logger().Error("service/processIncoming: Disconnecting on invalid packet", logging.F("type", msg.Name()), logging.Err(err))
+		return errDisconnect
+	}
+
 	switch msg := msg.(type) {
 	case *message.PublishMessage:
 		// For PUBLISH message, we should figure out what QoS it is and process accordingly
@@ -175,14 +193,22 @@ func (this *service) processIncoming(msg message.Message) error {
 	case *message.DisconnectMessage:
 		// For DISCONNECT message, we should quit
 		this.sess.Cmsg.SetWillFlag(false)
+		this.setReason(DisconnectNormal)
 		return errDisconnect
 
 	default:
+		// [MQTT-3.1.0-2] A second CONNECT MUST be treated as a protocol violation,
+		// and so must packets only ever sent the other way.
+		if this.compliance == Strict {
+			this.logger().Error("service/processIncoming: Disconnecting on unexpected message", logging.F("type", msg.Name()))
+			return errDisconnect
+		}
+
 		return fmt.Errorf("(%s) invalid message type %s.", this.cid(), msg.Name())
 	}
 
 	if err != nil {
-		glog.Debugf("(%s) Error processing acked message: %v", this.cid(), err)
+		this.logger().Debug("service/processIncoming: Error processing acked message", logging.Err(err))
 	}
 
 	return err
@@ -193,23 +219,23 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 		// Let's get the messages from the saved message byte slices.
 		msg, err := ackmsg.Mtype.New()
 		if err != nil {
-			glog.Errorf("process/processAcked: Unable to creating new %s message: %v", ackmsg.Mtype, err)
+			this.logger().Error("service/processAcked: Unable to create message", logging.F("type", ackmsg.Mtype), logging.Err(err))
 			continue
 		}
 
 		if _, err := msg.Decode(ackmsg.Msgbuf); err != nil {
-			glog.Errorf("process/processAcked: Unable to decode %s message: %v", ackmsg.Mtype, err)
+			this.logger().Error("service/processAcked: Unable to decode message", logging.F("type", ackmsg.Mtype), logging.Err(err))
 			continue
 		}
 
 		ack, err := ackmsg.State.New()
 		if err != nil {
-			glog.Errorf("process/processAcked: Unable to creating new %s message: %v", ackmsg.State, err)
+			this.logger().Error("service/processAcked: Unable to create message", logging.F("type", ackmsg.State), logging.Err(err))
 			continue
 		}
 
 		if _, err := ack.Decode(ackmsg.Ackbuf); err != nil {
-			glog.Errorf("process/processAcked: Unable to decode %s message: %v", ackmsg.State, err)
+			this.logger().Error("service/processAcked: Unable to decode message", logging.F("type", ackmsg.State), logging.Err(err))
 			continue
 		}
 
@@ -224,12 +250,18 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 		case message.PUBREL:
 			// If ack is PUBREL, that means the QoS 2 message sent by a remote client is
 			// releassed, so let's publish it to other subscribers.
-			if err = this.onPublish(msg.(*message.PublishMessage)); err != nil {
-				glog.Errorf("(%s) Error processing ack'ed %s message: %v", this.cid(), ackmsg.Mtype, err)
+			pmsg := msg.(*message.PublishMessage)
+
+			id := this.walIds[pmsg.PacketId()]
+			delete(this.walIds, pmsg.PacketId())
+			this.logRelease(id)
+
+			if err = this.acceptLogged(pmsg, nil, id); err != nil {
+				this.logger().Error("service/processAcked: Error processing ack'ed message", logging.F("type", ackmsg.Mtype), logging.Err(err))
 			}
 
 		case message.PUBACK, message.PUBCOMP, message.SUBACK, message.UNSUBACK, message.PINGRESP:
-			glog.Debugf("process/processAcked: %s", ack)
+			this.logger().Debug("service/processAcked: Received ack", logging.F("ack", ack))
 			// If ack is PUBACK, that means the QoS 1 message sent by this service got
 			// ack'ed. There's nothing to do other than calling onComplete() below.
 
@@ -245,25 +277,28 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 			// If ack is PINGRESP, that means the PINGREQ message sent by this service
 			// got ack'ed. There's nothing to do other than calling onComplete() below.
 
+			if ackmsg.State == message.PUBACK {
+				this.observeRTT(ackmsg.Sent)
+			}
+
+			this.traceAck(ackmsg.Mtype, ackmsg.State, ackmsg.Sent)
+
 			err = nil
 
 		default:
-			glog.Errorf("(%s) Invalid ack message type %s.", this.cid(), ackmsg.State)
+			this.logger().Error("service/processAcked: Invalid ack message type", logging.F("type", ackmsg.State))
 			continue
 		}
 
 		// Call the registered onComplete function
 		if ackmsg.OnComplete != nil {
-			onComplete, ok := ackmsg.OnComplete.(OnCompleteFunc)
-			if !ok {
-				glog.Errorf("process/processAcked: Error type asserting onComplete function: %v", reflect.TypeOf(ackmsg.OnComplete))
-			} else if onComplete != nil {
-				if err := onComplete(msg, ack, nil); err != nil {
-					glog.Errorf("process/processAcked: Error running onComplete(): %v", err)
-				}
+			if err := ackmsg.OnComplete.Complete(msg, ack, nil); err != nil {
+				this.logger().Error("service/processAcked: Error running onComplete()", logging.Err(err))
 			}
 		}
 	}
+
+	this.reap(ackq)
 }
 
 // For PUBLISH message, we should figure out what QoS it is and process accordingly
@@ -271,28 +306,66 @@ func (this *service) processAcked(ackq *sessions.Ackqueue) {
 // If QoS == 1, we should send back PUBACK, then take the next step
 // If QoS == 2, we need to put it in the ack queue, send back PUBREC
 func (this *service) processPublish(msg *message.PublishMessage) error {
+	// There's no way to tell the client its topic isn't acceptable, so just
+	// hang up on it.
+	if err := this.checkTopic(msg.Topic()); err != nil {
+		this.logger().Error("service/processPublish: Rejecting PUBLISH", logging.F("topic", string(msg.Topic())), logging.Err(err))
+		return errDisconnect
+	}
+
 	switch msg.QoS() {
 	case message.QosExactlyOnce:
+		id, err := this.logPublish(msg)
+		if err != nil {
+			return err
+		}
+
+		// A PUBLISH sent again before its PUBREL replaces the first
+		if id != 0 {
+			if this.walIds == nil {
+				this.walIds = make(map[uint16]uint64)
+			}
+			this.logDone(this.walIds[msg.PacketId()])
+			this.walIds[msg.PacketId()] = id
+		}
+
 		this.sess.Pub2in.Wait(msg, nil)
 
 		resp := message.NewPubrecMessage()
 		resp.SetPacketId(msg.PacketId())
 
-		_, err := this.writeMessage(resp)
+		_, err = this.writeMessage(resp)
 		return err
 
 	case message.QosAtLeastOnce:
+		// The message is acked once it's logged
+		id, err := this.logPublish(msg)
+		if err != nil {
+			return err
+		}
+
 		resp := message.NewPubackMessage()
 		resp.SetPacketId(msg.PacketId())
 
-		if _, err := this.writeMessage(resp); err != nil {
-			return err
+		if len(this.bridges) == 0 {
+			if _, err := this.writeMessage(resp); err != nil {
+				this.logDone(id)
+				return err
+			}
+
+			return this.acceptLogged(msg, nil, id)
 		}
 
-		return this.onPublish(msg)
+		// The message isn't acknowledged until the bridges have it as well, so
+		// the client keeps it around until then.
+		return this.acceptLogged(msg, func() {
+			if _, err := this.writeMessage(resp); err != nil {
+				this.logger().Error("service/processPublish: Error sending PUBACK", logging.F("packet_id", resp.PacketId()), logging.Err(err))
+			}
+		}, id)
 
 	case message.QosAtMostOnce:
-		return this.onPublish(msg)
+		return this.accept(msg, nil)
 	}
 
 	return fmt.Errorf("(%s) invalid message QoS %d.", this.cid(), msg.QoS())
@@ -306,24 +379,63 @@ func (this *service) processSubscribe(msg *message.SubscribeMessage) error {
 	// Subscribe to the different topics
 	var retcodes []byte
 
-	topics := msg.Topics()
+	filters := msg.Topics()
 	qos := msg.Qos()
 
 	this.rmsgs = this.rmsgs[0:0]
 
-	for i, t := range topics {
-		rqos, err := this.topicsMgr.Subscribe(t, qos[i], &this.onpub)
+	var replays []*message.PublishMessage
+
+	for i, t := range filters {
+		t, replay := replayFilter(t)
+		t = this.rewrite(RewriteSubscribe, t)
+
+		if err := this.checkTopic(t); err != nil {
+			this.logger().Error("service/processSubscribe: Rejecting subscription", logging.F("topic", string(t)), logging.Err(err))
+			retcodes = append(retcodes, message.QosFailure)
+			continue
+		}
+
+		opts := qos[i]
+		if this.server != nil && this.server.SubscriptionOptions != nil {
+			opts |= this.server.SubscriptionOptions(this.sess.ID(), t) &^ topics.QosMask
+		}
+
+		_, existed := this.sess.Topic(string(t))
+
+		if err := this.checkSubscription(t, existed); err != nil {
+			retcodes = append(retcodes, message.QosFailure)
+			continue
+		}
+
+		rqos, err := this.topicsMgr.Subscribe(t, opts, &this.onpub)
 		if err != nil {
 			return err
 		}
-		this.sess.AddTopic(string(t), qos[i])
+		this.sess.AddTopic(string(t), opts)
+
+		if this.server != nil {
+			this.server.emit(Event{Type: EventSubscriptionAdded, ClientId: this.sess.ID(), Topic: string(t), QoS: this.maxQos.apply(rqos)})
+		}
+
+		// The subscription keeps the QoS asked for, so it gets the messages of
+		// that QoS, which are sent at the one granted
+		retcodes = append(retcodes, this.maxQos.apply(rqos))
+
+		if replay && this.server != nil {
+			replays = append(replays, this.server.MessageHistory(t)...)
+		}
 
-		retcodes = append(retcodes, rqos)
+		// The retain handling of the subscription decides whether it gets the
+		// retained messages at all.
+		if rh := opts & topics.RetainHandlingMask; rh == topics.RetainSendNever || (rh == topics.RetainSendIfNew && existed) {
+			continue
+		}
 
 		// yeah I am not checking errors here. If there's an error we don't want the
 		// subscription to stop, just let it go.
-		this.topicsMgr.Retained(t, &this.rmsgs)
-		glog.Debugf("(%s) topic = %s, retained count = %d", this.cid(), string(t), len(this.rmsgs))
+		this.topicsMgr.RetainedLimit(t, this.maxRetained, &this.rmsgs)
+		this.logger().Debug("service/processSubscribe: Subscribed", logging.F("topic", string(t)), logging.F("retained", len(this.rmsgs)))
 	}
 
 	if err := resp.AddReturnCodes(retcodes); err != nil {
@@ -335,8 +447,26 @@ func (this *service) processSubscribe(msg *message.SubscribeMessage) error {
 	}
 
 	for _, rm := range this.rmsgs {
-		if err := this.publish(rm, nil); err != nil {
-			glog.Errorf("service/processSubscribe: Error publishing retained message: %v", err)
+		// The retained messages are shared by all the subscribers, and the RETAIN
+		// flag was cleared when they were first published, so send a copy with the
+		// flag set.
+		msg := message.NewPublishMessage()
+		msg.SetTopic(rm.Topic())
+		msg.SetPayload(rm.Payload())
+		msg.SetQoS(rm.QoS())
+		msg.SetPacketId(rm.PacketId())
+		msg.SetRetain(true)
+
+		if err := this.publish(msg, nil); err != nil {
+			this.logger().Error("service/processSubscribe: Error publishing retained message", logging.Err(err))
+			return err
+		}
+	}
+
+	// The history is shared as well, and goes out after the retained messages
+	for _, hm := range replays {
+		if err := this.publish(withTopic(hm, hm.Topic()), nil); err != nil {
+			this.logger().Error("service/processSubscribe: Error replaying message", logging.Err(err))
 			return err
 		}
 	}
@@ -349,6 +479,9 @@ func (this *service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
 	topics := msg.Topics()
 
 	for _, t := range topics {
+		t, _ = replayFilter(t)
+		t = this.rewrite(RewriteSubscribe, t)
+
 		this.topicsMgr.Unsubscribe(t, &this.onpub)
 		this.sess.RemoveTopic(string(t))
 	}
@@ -364,31 +497,176 @@ func (this *service) processUnsubscribe(msg *message.UnsubscribeMessage) error {
 // the ack cycle. This method will get the list of subscribers based on the publish
 // topic, and publishes the message to the list of subscribers.
 func (this *service) onPublish(msg *message.PublishMessage) error {
-	if msg.Retain() {
-		if err := this.topicsMgr.Retain(msg); err != nil {
-			glog.Errorf("(%s) Error retaining message: %v", this.cid(), err)
+	// Only the server keeps retained messages. On the client side, the RETAIN flag
+	// tells the subscriber the message was retained, so it's left alone.
+	if !this.client && msg.Retain() && !this.noRetain {
+		if this.server != nil {
+			this.server.retainAs(this.sess.ID(), msg)
+		} else if err := this.topicsMgr.Retain(msg); err != nil {
+			this.logger().Error("service/onPublish: Error retaining message", logging.Err(err))
+		}
+	}
+
+	if !this.client && this.server != nil {
+		this.server.record(msg)
+	}
+
+	if this.router != nil {
+		return this.router.Dispatch(msg)
+	}
+
+	// The fan-out workers deliver it, and are done with its WAL record after
+	if !this.client && this.server != nil && this.server.workers != nil {
+		if this.server.workers.dispatch(this.sess.ID(), msg, this.walId) {
+			this.walId = 0
+			return nil
 		}
 	}
 
-	err := this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &this.subs, &this.qoss)
+	err := this.server.lookupSubscribers(this.topicsMgr, msg, &this.subs, &this.qoss)
 	if err != nil {
-		glog.Errorf("(%s) Error retrieving subscribers list: %v", this.cid(), err)
+		this.logger().Error("service/onPublish: Error retrieving subscribers list", logging.Err(err))
 		return err
 	}
 
-	msg.SetRetain(false)
+	if len(this.subs) == 0 && !msg.Retain() && this.server != nil && this.server.DeadLetterNoSubscribers {
+		this.deadLetter(DeadLetterNoSubscribers, msg)
+	}
+
+	f := &fanout{server: this.server, msg: msg}
+	defer f.done()
+
+	if !this.client {
+		f.cid, f.retained = this.sess.ID(), msg.Retain()
+		msg.SetRetain(false)
+	}
 
 	//glog.Debugf("(%s) Publishing to topic %q and %d subscribers", this.cid(), string(msg.Topic()), len(this.subs))
-	for _, s := range this.subs {
-		if s != nil {
-			fn, ok := s.(*OnPublishFunc)
-			if !ok {
-				glog.Errorf("Invalid onPublish Function")
-				return fmt.Errorf("Invalid onPublish Function")
-			} else {
-				(*fn)(msg)
-			}
+	if err := f.deliverAll(this.subs, this.qoss); err != nil {
+		this.logger().Error("service/onPublish: Invalid onPublish Function")
+		return fmt.Errorf("Invalid onPublish Function")
+	}
+
+	return nil
+}
+
+// acceptLogged is accept for a message with the WAL record id, which is done
+// with once the message has been handed to the subscribers, by the fan-out
+// workers if there are any.
+func (this *service) acceptLogged(msg *message.PublishMessage, ack func(), id uint64) error {
+	this.walId = id
+	err := this.accept(msg, ack)
+
+	this.logDone(this.walId)
+	this.walId = 0
+
+	return err
+}
+
+// accept runs a message published by the client through the pipeline, then hands
+// it to the bridges and delivers it to the subscribers. ack is called once the
+// bridges have the message, or right away if the pipeline drops it.
+func (this *service) accept(msg *message.PublishMessage, ack func()) (err error) {
+	ctx, span := this.startPublish(msg)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if string(msg.Topic()) == MirrorBatchTopic && this.feeder() {
+		return this.acceptBatch(msg, ack)
+	}
+
+	if this.readOnly() {
+		this.logger().Debug("service/accept: Dropping message published to read-only server", logging.F("topic", string(msg.Topic())))
+
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+
+	delay, err := this.delayOf(msg)
+	if err != nil {
+		this.logger().Debug("service/accept: Dropping delayed message", logging.F("topic", string(msg.Topic())), logging.Err(err))
+
+		if ack != nil {
+			ack()
 		}
+		return nil
+	}
+
+	if !this.rewritePublish(msg) || this.overQuota(msg) || this.overMemory(msg) {
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+
+	out, denied := this.pipeline.processACL(this.logger(), this.sess.ID(), msg, false, this.defaultACL(), this.featureEnabled)
+	if out == nil {
+		if denied {
+			this.deadLetter(DeadLetterDenied, msg)
+		}
+
+		if ack != nil {
+			ack()
+		}
+		return nil
+	}
+	msg = out
+
+	this.upgradeQoS(msg)
+
+	// Delayed messages go to the bridges and the subscribers once they are due
+	if delay > 0 {
+		if err = this.server.delay(this.sess.ID(), msg, delay); err != nil {
+			this.logger().Error("service/accept: Error delaying message", logging.Err(err))
+		}
+
+		if ack != nil {
+			ack()
+		}
+		return err
+	}
+
+	this.forward(ctx, msg, ack)
+
+	_, fspan := this.tracer().Start(ctx, spanFanout)
+	err = this.onPublish(msg)
+	fspan.SetAttributes(attribute.Int("mqtt.subscribers", len(this.subs)))
+	endSpan(fspan, err)
+
+	return err
+}
+
+// checkTopic makes sure the topic, or topic filter, is within the topic limits
+// configured for this service.
+func (this *service) checkTopic(topic []byte) error {
+	if this.maxTopicLevels == 0 && this.maxTopicLevelLength == 0 {
+		return nil
+	}
+
+	levels, start := 1, 0
+
+	for i, c := range topic {
+		if c != '/' {
+			continue
+		}
+
+		if this.maxTopicLevelLength > 0 && i-start > this.maxTopicLevelLength {
+			return ErrTopicLevelTooLong
+		}
+
+		levels++
+		start = i + 1
+
+		if this.maxTopicLevels > 0 && levels > this.maxTopicLevels {
+			return ErrTopicTooManyLevels
+		}
+	}
+
+	if this.maxTopicLevelLength > 0 && len(topic)-start > this.maxTopicLevelLength {
+		return ErrTopicLevelTooLong
 	}
 
 	return nil
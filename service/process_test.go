@@ -0,0 +1,85 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestCheckTopic(t *testing.T) {
+	svc := &service{}
+	require.NoError(t, svc.checkTopic([]byte(strings.Repeat("a/", 10000))))
+
+	svc = &service{maxTopicLevels: 3, maxTopicLevelLength: 4}
+
+	require.NoError(t, svc.checkTopic([]byte("abcd")))
+	require.NoError(t, svc.checkTopic([]byte("a/b/c")))
+	require.NoError(t, svc.checkTopic([]byte("abcd//+")))
+	require.NoError(t, svc.checkTopic([]byte("/abcd/#")))
+	require.Equal(t, ErrTopicTooManyLevels, svc.checkTopic([]byte("a/b/c/d")))
+	require.Equal(t, ErrTopicTooManyLevels, svc.checkTopic([]byte("a/b/c/")))
+	require.Equal(t, ErrTopicTooManyLevels, svc.checkTopic([]byte(strings.Repeat("a/", 10000))))
+	require.Equal(t, ErrTopicLevelTooLong, svc.checkTopic([]byte("abcde")))
+	require.Equal(t, ErrTopicLevelTooLong, svc.checkTopic([]byte("a/abcde/c")))
+	require.Equal(t, ErrTopicLevelTooLong, svc.checkTopic([]byte("a/b/abcde")))
+}
+
+func TestServerTopicLimits(t *testing.T) {
+	svr := &Server{MaxTopicLevels: 2}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	// Only the subscription that's over the limit should fail
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("a/b"), 1)
+	sub.AddTopic([]byte("a/b/c"), 1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	suback := message.NewSubackMessage()
+	_, err = suback.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{message.QosAtLeastOnce, message.QosFailure}, suback.ReturnCodes())
+
+	// Publishing over the limit should get the client disconnected
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("a/b/c"))
+	pub.SetPayload([]byte("abc"))
+	require.NoError(t, writeMessage(conn, pub))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = getMessageBuffer(conn, 0)
+	require.Error(t, err)
+	require.False(t, isTimeout(err))
+}
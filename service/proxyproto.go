@@ -0,0 +1,194 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The longest v1 header allowed by the spec, including the CRLF
+	proxyV1MaxLen = 107
+)
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyConn is a connection that started with a PROXY protocol header. It reports
+// the source address from the header as its remote address.
+type proxyConn struct {
+	net.Conn
+
+	// Any bytes read past the header while parsing it
+	r *bufio.Reader
+
+	remote net.Addr
+}
+
+func (this *proxyConn) Read(b []byte) (int, error) {
+	if this.r != nil {
+		if this.r.Buffered() > 0 {
+			return this.r.Read(b)
+		}
+
+		this.r = nil
+	}
+
+	return this.Conn.Read(b)
+}
+
+func (this *proxyConn) RemoteAddr() net.Addr {
+	return this.remote
+}
+
+// readProxyHeader reads a HAProxy PROXY protocol header, either version 1 or 2,
+// from the start of conn, and returns a connection whose RemoteAddr is the source
+// address of the original client. For LOCAL (v2) and UNKNOWN (v1) headers, which
+// a load balancer sends for its own health checks, the address of the load balancer
+// is kept. It's an error for the connection not to start with a header.
+func readProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReaderSize(conn, 256)
+
+	var (
+		remote net.Addr
+		err    error
+	)
+
+	if b, _ := r.Peek(len(proxyV2Sig)); bytes.Equal(b, proxyV2Sig) {
+		remote, err = readProxyV2(r)
+	} else if b, _ := r.Peek(len(proxyV1Prefix)); bytes.Equal(b, proxyV1Prefix) {
+		remote, err = readProxyV1(r)
+	} else {
+		err = ErrInvalidProxyHeader
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// readProxyV1 parses a header of the form
+//
+//	PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			return nil, ErrInvalidProxyHeader
+		}
+		return nil, err
+	}
+
+	if len(line) > proxyV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header, which is the 12 byte signature followed by
+// the version and command, the address family and protocol, the length of the
+// rest of the header, and then the addresses and any TLVs, which are ignored.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return nil, ErrInvalidProxyHeader
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0:
+		// LOCAL
+		return nil, nil
+
+	case 1:
+		// PROXY
+
+	default:
+		return nil, ErrInvalidProxyHeader
+	}
+
+	switch hdr[13] {
+	case 0x11:
+		// TCP over IPv4
+		if len(body) < 12 {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+
+	case 0x21:
+		// TCP over IPv6
+		if len(body) < 36 {
+			return nil, ErrInvalidProxyHeader
+		}
+
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+
+	// Any other family, such as UNSPEC or UNIX, we keep the address of the load
+	// balancer.
+	return nil, nil
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readTestProxyHeader writes hdr followed by "mqtt" to one end of a pipe and reads
+// the PROXY header from the other.
+func readTestProxyHeader(t *testing.T, hdr []byte) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+
+	go func() {
+		c2.Write(append(hdr, "mqtt"...))
+		c2.Close()
+	}()
+
+	conn, err := readProxyHeader(c1, time.Second)
+	if err != nil {
+		c1.Close()
+		return nil, err
+	}
+
+	// Whatever comes after the header must still be readable
+	b, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "mqtt", string(b))
+
+	return conn, nil
+}
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	conn, err := readTestProxyHeader(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+
+	conn, err = readTestProxyHeader(t, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1883\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+
+	conn, err = readTestProxyHeader(t, []byte("PROXY UNKNOWN\r\n"))
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().String())
+
+	for _, hdr := range []string{
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n",
+		"PROXY TCP4 2001:db8::1 192.168.0.11 56324 1883\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 99999 1883\r\n",
+		"PROXY UDP4 192.168.0.1 192.168.0.11 56324 1883\r\n",
+		"PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\n",
+	} {
+		_, err = readTestProxyHeader(t, []byte(hdr))
+		require.Equal(t, ErrInvalidProxyHeader, err, hdr)
+	}
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	hdr := append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, 0x21, 0x11, 0, 12)
+	hdr = append(hdr, 10, 0, 0, 1, 10, 0, 0, 2, 0xdc, 0x04, 0x07, 0x5b)
+
+	conn, err := readTestProxyHeader(t, hdr)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:56324", conn.RemoteAddr().String())
+
+	// LOCAL, with a TLV that should be skipped
+	hdr = append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, 0x20, 0x00, 0, 4, 0x01, 0, 1, 'x')
+
+	conn, err = readTestProxyHeader(t, hdr)
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().String())
+
+	// Wrong version
+	hdr = append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, 0x11, 0x11, 0, 0)
+
+	_, err = readTestProxyHeader(t, hdr)
+	require.Equal(t, ErrInvalidProxyHeader, err)
+}
+
+func TestReadProxyHeaderMissing(t *testing.T) {
+	_, err := readTestProxyHeader(t, newConnectMessageBytes(t))
+	require.Equal(t, ErrInvalidProxyHeader, err)
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	svr := &Server{ProxyProtocol: true, MaxConnectionsPerIP: 1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 1883\r\n"))
+	require.NoError(t, err)
+
+	msg := newConnectMessage()
+	require.NoError(t, writeMessage(conn, msg))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	svr.mu.Lock()
+	svc := svr.clients[string(msg.ClientId())]
+	svr.mu.Unlock()
+
+	require.NotNil(t, svc)
+	require.Equal(t, "192.168.0.1:56324", svc.conn.(net.Conn).RemoteAddr().String())
+
+	// The per-IP limit should count the client's address, not ours
+	svr.cmu.Lock()
+	n := svr.ipconns["192.168.0.1"]
+	svr.cmu.Unlock()
+
+	require.Equal(t, 1, n)
+}
+
+func newConnectMessageBytes(t *testing.T) []byte {
+	msg := newConnectMessage()
+
+	b := make([]byte, msg.Len())
+	_, err := msg.Encode(b)
+	require.NoError(t, err)
+
+	return b
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+// PublishOptions are the options of Server.Publish.
+type PublishOptions struct {
+	// ClientId is the client the message is published as, as seen by the pipeline
+	// stages and the bridges. If not set then the message skips them, and is just
+	// retained and delivered.
+	ClientId string
+
+	// BypassACL skips the PhaseAuth stages of the pipeline, for messages the
+	// application trusts.
+	BypassACL bool
+
+	// Context is the context the message is published in. Its span, if any, is
+	// the parent of the span of the publish when the server has a Tracer.
+	Context context.Context
+}
+
+// Completion tracks the delivery of a message published with Server.Publish to
+// the clients with persistent sessions. It completes once all of them have
+// acknowledged the message, with a PUBACK for QoS 1 or a PUBCOMP for QoS 2.
+// Clients that never acknowledge it, e.g., because they disconnect first, keep
+// it from completing, so Done should be used with a timeout.
+type Completion struct {
+	mu      sync.Mutex
+	pending int
+	err     error
+	done    chan struct{}
+}
+
+func newCompletion() *Completion {
+	// Publish holds on to it until all the deliveries are started, so it can't
+	// complete in between
+	return &Completion{
+		pending: 1,
+		done:    make(chan struct{}),
+	}
+}
+
+// Done returns a channel that's closed once the delivery is complete.
+func (this *Completion) Done() <-chan struct{} {
+	return this.done
+}
+
+// Wait waits for the delivery to complete, and returns the first error from
+// delivering to any of the clients.
+func (this *Completion) Wait() error {
+	<-this.done
+	return this.Err()
+}
+
+// Err returns the first error from delivering to any of the clients so far.
+func (this *Completion) Err() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.err
+}
+
+// Pending returns the number of clients that haven't acknowledged the message
+// yet.
+func (this *Completion) Pending() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.pending
+}
+
+func (this *Completion) add() {
+	this.mu.Lock()
+	this.pending++
+	this.mu.Unlock()
+}
+
+func (this *Completion) complete(err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err != nil && this.err == nil {
+		this.err = err
+	}
+
+	if this.pending--; this.pending == 0 {
+		close(this.done)
+	}
+}
+
+// Complete records the delivery to one of the clients. It's what makes a
+// Completion a sessions.Completer, so it can wait in each client's ack queue
+// without a closure being made for every delivery.
+func (this *Completion) Complete(msg, ack message.Message, err error) error {
+	this.complete(err)
+	return nil
+}
+
+// addSubscriber lets Publish find the service behind its onpub, so it can track
+// the deliveries to the service.
+func (this *Server) addSubscriber(svc *service) {
+	this.smu.Lock()
+	defer this.smu.Unlock()
+
+	if this.subscribers == nil {
+		this.subscribers = make(map[*OnPublishFunc]*service)
+	}
+
+	this.subscribers[&svc.onpub] = svc
+}
+
+func (this *Server) removeSubscriber(svc *service) {
+	this.smu.Lock()
+	defer this.smu.Unlock()
+
+	delete(this.subscribers, &svc.onpub)
+}
+
+// persistent returns the service behind fn if the message should be tracked for
+// it, i.e. it's a QoS 1 or 2 message and the service has a persistent session.
+func (this *Server) persistent(fn *OnPublishFunc, msg *message.PublishMessage) *service {
+	if msg.QoS() == message.QosAtMostOnce {
+		return nil
+	}
+
+	this.smu.RLock()
+	svc := this.subscribers[fn]
+	this.smu.RUnlock()
+
+	if svc == nil || svc.sess == nil || svc.sess.Cmsg.CleanSession() {
+		return nil
+	}
+
+	return svc
+}
+
+// withoutRetain returns a copy of msg without the RETAIN flag.
+func withoutRetain(msg *message.PublishMessage) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	m.SetTopic(msg.Topic())
+	m.SetPayload(msg.Payload())
+	m.SetQoS(msg.QoS())
+	m.SetPacketId(msg.PacketId())
+
+	return m
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerPublishCompletion(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("persistent"))
+	cmsg.SetCleanSession(false)
+	require.NoError(t, writeMessage(conn, cmsg))
+
+	connack, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("abc"))
+	msg.SetQoS(message.QosAtLeastOnce)
+	msg.SetPayload([]byte("hello"))
+
+	c, err := svr.Publish(msg, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, c.Pending())
+
+	select {
+	case <-c.Done():
+		t.Fatal("Completion done before the PUBACK")
+	default:
+	}
+
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	pub := message.NewPublishMessage()
+	_, err = pub.Decode(buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(pub.Payload()))
+
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(pub.PacketId())
+	require.NoError(t, writeMessage(conn, ack))
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Completion not done after the PUBACK")
+	}
+
+	require.NoError(t, c.Wait())
+	require.Equal(t, 0, c.Pending())
+}
+
+func TestServerPublishNoPersistentSessions(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var got []string
+	onpub := OnPublishFunc(func(msg *message.PublishMessage) error {
+		got = append(got, string(msg.Payload()))
+		return nil
+	})
+
+	_, err := svr.Subscribe([]byte("a/b"), message.QosExactlyOnce, &onpub)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("a/b"))
+	msg.SetQoS(message.QosExactlyOnce)
+	msg.SetPayload([]byte("abc"))
+
+	// In process subscribers don't acknowledge anything, so there's nothing to
+	// wait for
+	c, err := svr.Publish(msg, nil)
+	require.NoError(t, err)
+	require.NoError(t, c.Wait())
+	require.Equal(t, []string{"abc"}, got)
+}
+
+func TestServerPublishBypassACL(t *testing.T) {
+	p := &Pipeline{}
+	require.NoError(t, p.Add(Stage{
+		Name:  "acl",
+		Phase: PhaseAuth,
+		Process: func(cid string, msg *message.PublishMessage) (*message.PublishMessage, error) {
+			return nil, errors.New("not allowed")
+		},
+	}))
+
+	svr := &Server{Pipeline: p}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var got []string
+	onpub := OnPublishFunc(func(msg *message.PublishMessage) error {
+		got = append(got, string(msg.Payload()))
+		return nil
+	})
+
+	_, err := svr.Subscribe([]byte("a/b"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	publish := func(payload string, opts *PublishOptions) {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte("a/b"))
+		msg.SetPayload([]byte(payload))
+
+		c, err := svr.Publish(msg, opts)
+		require.NoError(t, err)
+		require.NoError(t, c.Wait())
+	}
+
+	publish("denied", &PublishOptions{ClientId: "app"})
+	publish("bypassed", &PublishOptions{ClientId: "app", BypassACL: true})
+	publish("as is", nil)
+
+	require.Equal(t, []string{"bypassed", "as is"}, got)
+	require.Equal(t, int64(1), p.Stats()[0].Errors)
+}
+
+func TestServerPublishRetainedCopy(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var got []bool
+	onpub := OnPublishFunc(func(msg *message.PublishMessage) error {
+		got = append(got, msg.Retain())
+		return nil
+	})
+
+	_, err := svr.Subscribe([]byte("a/b"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("a/b"))
+	msg.SetPayload([]byte("abc"))
+	msg.SetRetain(true)
+
+	c, err := svr.Publish(msg, nil)
+	require.NoError(t, err)
+	require.NoError(t, c.Wait())
+
+	// The subscriber gets it without the flag, and the caller's message keeps it
+	require.Equal(t, []bool{false}, got)
+	require.True(t, msg.Retain())
+}
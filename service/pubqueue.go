@@ -0,0 +1,277 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+var ErrPublishQueueFull error = errors.New("service: Publish queue is full")
+
+// PublishQueue holds the messages a client publishes while it's disconnected, to
+// be sent once it's connected again. See Client.OfflineQueue. The methods can be
+// called from any goroutine.
+type PublishQueue interface {
+	// Push adds the message at the end of the queue, or returns
+	// ErrPublishQueueFull.
+	Push(msg *message.PublishMessage) error
+
+	// Peek returns the message at the front of the queue, or nil if it's empty.
+	Peek() (*message.PublishMessage, error)
+
+	// Remove removes the message at the front of the queue, once it's been sent.
+	Remove() error
+
+	// Len returns the number of messages in the queue.
+	Len() int
+}
+
+type memQueue struct {
+	mu   sync.Mutex
+	max  int
+	msgs []*message.PublishMessage
+}
+
+var _ PublishQueue = (*memQueue)(nil)
+
+// NewMemQueue returns a PublishQueue that keeps up to max messages in memory, so
+// they are lost if the process exits. If max is 0 then there's no limit.
+func NewMemQueue(max int) PublishQueue {
+	return &memQueue{max: max}
+}
+
+func (this *memQueue) Push(msg *message.PublishMessage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.max > 0 && len(this.msgs) >= this.max {
+		return ErrPublishQueueFull
+	}
+
+	this.msgs = append(this.msgs, msg)
+	return nil
+}
+
+func (this *memQueue) Peek() (*message.PublishMessage, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(this.msgs) == 0 {
+		return nil, nil
+	}
+
+	return this.msgs[0], nil
+}
+
+func (this *memQueue) Remove() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(this.msgs) > 0 {
+		this.msgs[0] = nil
+		this.msgs = this.msgs[1:]
+	}
+
+	return nil
+}
+
+func (this *memQueue) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.msgs)
+}
+
+// The extension of the files of a fileQueue.
+const queueFileExt = ".msg"
+
+type fileQueue struct {
+	mu   sync.Mutex
+	dir  string
+	max  int
+	seqs []uint64
+	next uint64
+}
+
+var _ PublishQueue = (*fileQueue)(nil)
+
+// NewFileQueue returns a PublishQueue that keeps up to max messages as files in
+// dir, one per message, so they survive the process exiting, e.g. on an edge
+// device that's restarted before its link comes back. The messages already in
+// dir are picked up. If max is 0 then there's no limit.
+func NewFileQueue(dir string, max int) (PublishQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	this := &fileQueue{dir: dir, max: max, next: 1}
+
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, queueFileExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		this.seqs = append(this.seqs, seq)
+
+		if seq >= this.next {
+			this.next = seq + 1
+		}
+	}
+
+	sort.Slice(this.seqs, func(i, j int) bool {
+		return this.seqs[i] < this.seqs[j]
+	})
+
+	return this, nil
+}
+
+func (this *fileQueue) Push(msg *message.PublishMessage) error {
+	buf := make([]byte, msg.Len())
+
+	n, err := msg.Encode(buf)
+	if err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.max > 0 && len(this.seqs) >= this.max {
+		return ErrPublishQueueFull
+	}
+
+	// The message only shows up once it's all been written
+	path := this.path(this.next)
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, buf[:n], 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	this.seqs = append(this.seqs, this.next)
+	this.next++
+
+	return nil
+}
+
+func (this *fileQueue) Peek() (*message.PublishMessage, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(this.seqs) == 0 {
+		return nil, nil
+	}
+
+	buf, err := os.ReadFile(this.path(this.seqs[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(buf); err != nil {
+		return nil, fmt.Errorf("service: Error decoding queued message %d: %v", this.seqs[0], err)
+	}
+
+	return msg, nil
+}
+
+func (this *fileQueue) Remove() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if len(this.seqs) == 0 {
+		return nil
+	}
+
+	if err := os.Remove(this.path(this.seqs[0])); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	this.seqs = this.seqs[1:]
+	return nil
+}
+
+func (this *fileQueue) Len() int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return len(this.seqs)
+}
+
+func (this *fileQueue) path(seq uint64) string {
+	return filepath.Join(this.dir, fmt.Sprintf("%020d%s", seq, queueFileExt))
+}
+
+// flush sends the messages queued while the client was disconnected. It stops at
+// the first one that can't be sent, leaving it at the front of the queue.
+func (this *Client) flush(svc *service) {
+	q := this.OfflineQueue
+	if q == nil {
+		return
+	}
+
+	for q.Len() > 0 {
+		msg, err := q.Peek()
+		if err != nil {
+			// A message that can't be read back is dropped, so it doesn't hold up
+			// the rest
+			svc.logger().Error("service/flush: Dropping unreadable queued message", logging.Err(err))
+			if err := q.Remove(); err != nil {
+				return
+			}
+			continue
+		}
+
+		if msg == nil {
+			return
+		}
+
+		if err := svc.publish(msg, nil); err != nil {
+			svc.logger().Error("service/flush: Error sending queued message", logging.F("topic", string(msg.Topic())), logging.Err(err))
+			return
+		}
+
+		if err := q.Remove(); err != nil {
+			svc.logger().Error("service/flush: Error removing queued message", logging.Err(err))
+			return
+		}
+	}
+}
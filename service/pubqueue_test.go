@@ -0,0 +1,113 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func testPublishQueue(t *testing.T, q PublishQueue) {
+	msg, err := q.Peek()
+	require.NoError(t, err)
+	require.Nil(t, msg)
+
+	for _, topic := range []string{"a", "b"} {
+		require.NoError(t, q.Push(newTestPublish(topic)))
+	}
+
+	require.Equal(t, ErrPublishQueueFull, q.Push(newTestPublish("c")))
+	require.Equal(t, 2, q.Len())
+
+	msg, err = q.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "a", string(msg.Topic()))
+
+	require.NoError(t, q.Remove())
+	require.Equal(t, 1, q.Len())
+
+	msg, err = q.Peek()
+	require.NoError(t, err)
+	require.Equal(t, "b", string(msg.Topic()))
+}
+
+func TestMemQueue(t *testing.T) {
+	testPublishQueue(t, NewMemQueue(2))
+}
+
+func TestFileQueue(t *testing.T) {
+	dir := t.TempDir()
+
+	q, err := NewFileQueue(dir, 2)
+	require.NoError(t, err)
+
+	testPublishQueue(t, q)
+
+	// What's left is picked up again, and new messages go after it
+	q, err = NewFileQueue(dir, 2)
+	require.NoError(t, err)
+	require.Equal(t, 1, q.Len())
+
+	require.NoError(t, q.Push(newTestPublish("c")))
+
+	for _, topic := range []string{"b", "c"} {
+		msg, err := q.Peek()
+		require.NoError(t, err)
+		require.Equal(t, topic, string(msg.Topic()))
+		require.NoError(t, q.Remove())
+	}
+
+	require.Equal(t, 0, q.Len())
+}
+
+func TestClientOfflineQueue(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("#"), message.QosAtLeastOnce, &onpub)
+	require.NoError(t, err)
+
+	// Left over from before the client was last disconnected
+	q := NewMemQueue(0)
+	require.NoError(t, q.Push(newTestPublish("queued")))
+
+	c := &Client{OfflineQueue: q}
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), newConnectMessage()))
+
+	select {
+	case msg := <-got:
+		require.Equal(t, "queued", string(msg.Topic()))
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the queued message")
+	}
+
+	require.Equal(t, 0, q.Len())
+
+	// Once disconnected, messages are queued again
+	c.Disconnect()
+	require.NoError(t, c.Publish(newTestPublish("offline"), nil))
+	require.Equal(t, 1, q.Len())
+}
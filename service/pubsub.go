@@ -0,0 +1,90 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"github.com/surgemq/message"
+)
+
+// MessageHandler is called with the topic and the payload of every message
+// published on a topic matching the filter of SubscribeFunc. The payload may be
+// shared with the other subscribers, and reused once the handler returns, so it
+// must be copied to be kept.
+type MessageHandler func(topic string, payload []byte)
+
+// PublishTopic publishes payload to topic, with qos, and retained if retain is
+// set, for the applications embedding the server, without a connection of
+// their own. It's Publish without any PublishOptions, with the topic checked
+// the way the topics of the clients are.
+func (this *Server) PublishTopic(topic string, payload []byte, qos byte, retain bool) error {
+	if err := validatePublishTopic([]byte(topic)); err != nil {
+		return err
+	}
+
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		return err
+	}
+	if err := msg.SetQoS(qos); err != nil {
+		return err
+	}
+	msg.SetPayload(payload)
+	msg.SetRetain(retain)
+
+	_, err := this.Publish(msg, nil)
+	return err
+}
+
+// SubscribeFunc subscribes handler to the topic filter with qos, for the
+// applications embedding the server, without a connection of their own. It's
+// Subscribe with the OnPublishFunc made for it, which the returned function
+// unsubscribes. Like Subscribe, it doesn't deliver the retained messages.
+func (this *Server) SubscribeFunc(filter string, qos byte, handler MessageHandler) (func() error, error) {
+	if err := validateSubscribeFilter([]byte(filter)); err != nil {
+		return nil, err
+	}
+
+	var onPublish OnPublishFunc = func(msg *message.PublishMessage) error {
+		handler(string(msg.Topic()), msg.Payload())
+		return nil
+	}
+
+	if _, err := this.Subscribe([]byte(filter), qos, &onPublish); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return this.Unsubscribe([]byte(filter), &onPublish)
+	}, nil
+}
+
+// validatePublishTopic checks a topic name, encoding and all, as it's checked
+// for the clients in the Strict mode.
+func validatePublishTopic(topic []byte) error {
+	if err := validateTopicName(topic); err != nil {
+		return err
+	}
+
+	return validateString(topic)
+}
+
+// validateSubscribeFilter is validatePublishTopic for topic filters.
+func validateSubscribeFilter(filter []byte) error {
+	if err := validateTopicFilter(filter); err != nil {
+		return err
+	}
+
+	return validateString(filter)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerPublishTopic(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	require.NoError(t, svr.PublishTopic("abc", []byte("hello"), message.QosAtLeastOnce, false))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg := readPublish(t, conn)
+	require.Equal(t, "abc", string(msg.Topic()))
+	require.Equal(t, "hello", string(msg.Payload()))
+	require.Equal(t, byte(message.QosAtLeastOnce), msg.QoS())
+
+	require.Error(t, svr.PublishTopic("abc/#", nil, message.QosAtMostOnce, false))
+	require.Error(t, svr.PublishTopic("", nil, message.QosAtMostOnce, false))
+	require.Error(t, svr.PublishTopic("abc", nil, 3, false))
+}
+
+func TestServerSubscribeFunc(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var got []string
+
+	unsubscribe, err := svr.SubscribeFunc("sensors/+/temp", message.QosAtMostOnce, func(topic string, payload []byte) {
+		got = append(got, topic+"="+string(payload))
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, svr.PublishTopic("sensors/1/temp", []byte("20"), message.QosAtMostOnce, false))
+	require.NoError(t, svr.PublishTopic("sensors/1/humidity", []byte("40"), message.QosAtMostOnce, false))
+
+	require.NoError(t, unsubscribe())
+	require.NoError(t, svr.PublishTopic("sensors/2/temp", []byte("21"), message.QosAtMostOnce, false))
+
+	require.Equal(t, []string{"sensors/1/temp=20"}, got)
+
+	_, err = svr.SubscribeFunc("sensors/#/temp", message.QosAtMostOnce, func(string, []byte) {})
+	require.Error(t, err)
+}
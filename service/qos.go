@@ -0,0 +1,185 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// QoSLimit is the highest QoS granted to the subscriptions of a client, see
+// Server.MaxQoS. The zero value is no limit.
+type QoSLimit byte
+
+const (
+	QoSUnlimited QoSLimit = iota
+
+	// MaxQoS0 grants QoS 0 at most.
+	MaxQoS0
+
+	// MaxQoS1 grants QoS 1 at most.
+	MaxQoS1
+
+	// MaxQoS2 grants QoS 2 at most, which is no lower than the spec allows, for
+	// lifting the limit of the server for a listener or a user.
+	MaxQoS2
+)
+
+func (this QoSLimit) String() string {
+	switch this {
+	case QoSUnlimited:
+		return "unlimited"
+	case MaxQoS0:
+		return "0"
+	case MaxQoS1:
+		return "1"
+	case MaxQoS2:
+		return "2"
+	}
+
+	return "unknown"
+}
+
+// apply returns qos, lowered to the limit if it's above it.
+func (this QoSLimit) apply(qos byte) byte {
+	if this != QoSUnlimited && qos > byte(this)-1 {
+		return byte(this) - 1
+	}
+
+	return qos
+}
+
+// override returns the limit that, if set, replaces this one.
+func (this QoSLimit) override(that QoSLimit) QoSLimit {
+	if that != QoSUnlimited {
+		return that
+	}
+
+	return this
+}
+
+// maxQoSOf returns the QoS limit of the client connecting through l, which is
+// nil for the listeners passed to ListenAndServe and Serve, with username. The
+// limit of the user wins over that of the listener, which wins over that of the
+// server.
+func (this *Server) maxQoSOf(l *listener, username string) QoSLimit {
+	max := this.MaxQoS
+
+	if l != nil {
+		max = max.override(l.MaxQoS)
+	}
+
+	if this.UserMaxQoS != nil {
+		max = max.override(this.UserMaxQoS(username))
+	}
+
+	return max
+}
+
+// upgradesQoS returns whether the QoS 0 messages published to topic are upgraded
+// to QoS 1, see Server.QoSUpgrade.
+func (this *Server) upgradesQoS(topic []byte) bool {
+	if this == nil {
+		return false
+	}
+
+	for _, prefix := range this.QoSUpgrade {
+		if bytes.HasPrefix(topic, []byte(prefix)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upgradeQoS upgrades msg, published by the client, to QoS 1 if it's a QoS 0
+// message to one of the topics of Server.QoSUpgrade. The message is decoded from
+// the incoming buffer and isn't sent back to the client, so it's changed in
+// place.
+func (this *service) upgradeQoS(msg *message.PublishMessage) {
+	if msg.QoS() == message.QosAtMostOnce && this.server.upgradesQoS(msg.Topic()) {
+		msg.SetQoS(message.QosAtLeastOnce)
+	}
+}
+
+// lookupSubscribers looks up the subscribers of msg in mgr, as the
+// TopicsProvider does, and dedupes them. The TopicsProvider leaves out the
+// subscriptions granted a lower QoS than the message's, so for the topics of
+// QoSUpgrade the ones granted QoS 0 are looked up as well, and get the message
+// at QoS 0, which is the QoS in their qoss.
+func (this *Server) lookupSubscribers(mgr *topics.Manager, msg *message.PublishMessage, subs *[]interface{}, qoss *[]byte) error {
+	if err := mgr.Subscribers(msg.Topic(), msg.QoS(), subs, qoss); err != nil {
+		return err
+	}
+
+	if msg.QoS() != message.QosAtMostOnce && this.upgradesQoS(msg.Topic()) {
+		var (
+			all  []interface{}
+			alls []byte
+		)
+
+		if err := mgr.Subscribers(msg.Topic(), message.QosAtMostOnce, &all, &alls); err != nil {
+			return err
+		}
+
+		found := make(map[interface{}]int, len(*subs))
+		for _, s := range *subs {
+			found[s]++
+		}
+
+		// A subscriber with more than one subscription is in both lists for
+		// each of them that has the QoS
+		for i, s := range all {
+			if found[s] > 0 {
+				found[s]--
+				continue
+			}
+
+			*subs = append(*subs, s)
+			*qoss = append(*qoss, alls[i])
+		}
+	}
+
+	this.dedupeSubscribers(subs, qoss)
+
+	return nil
+}
+
+// capQoS returns msg at the QoS the client is limited to, copied if that's lower
+// than the message's, as the message is shared with the other subscribers.
+func (this *service) capQoS(msg *message.PublishMessage) *message.PublishMessage {
+	qos := this.maxQos.apply(msg.QoS())
+	if qos == msg.QoS() {
+		return msg
+	}
+
+	return withQoS(msg, qos, msg.Retain())
+}
+
+// withQoS returns a copy of msg with the QoS qos, and the RETAIN flag set if
+// retain is true.
+func withQoS(msg *message.PublishMessage, qos byte, retain bool) *message.PublishMessage {
+	m := withTopic(msg, msg.Topic())
+	m.SetQoS(qos)
+	m.SetRetain(retain)
+
+	if qos == message.QosAtMostOnce {
+		m.SetPacketId(0)
+	}
+
+	return m
+}
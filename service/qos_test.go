@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// subscribeAt connects a client to ln and subscribes it to "abc" with qos,
+// returning the connection and the QoS granted.
+func subscribeAt(t *testing.T, ln net.Listener, qos byte) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	sub := newSubscribeMessage(qos)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	suback := message.NewSubackMessage()
+	_, err = suback.Decode(buf)
+	require.NoError(t, err)
+	require.Len(t, suback.ReturnCodes(), 1)
+
+	return conn, suback.ReturnCodes()[0]
+}
+
+func TestServerMaxQoS(t *testing.T) {
+	svr := &Server{MaxQoS: MaxQoS1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, granted := subscribeAt(t, ln, message.QosExactlyOnce)
+	defer conn.Close()
+	require.Equal(t, byte(message.QosAtLeastOnce), granted)
+
+	// The QoS 2 messages are sent at QoS 1
+	_, err := svr.Publish(newPublishMessage(0, message.QosExactlyOnce), nil)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg := readPublish(t, conn)
+	require.Equal(t, byte(message.QosAtLeastOnce), msg.QoS())
+	require.NotEqual(t, uint16(0), msg.PacketId())
+
+	// The lower ones as they are
+	_, err = svr.Publish(newPublishMessage(0, message.QosAtMostOnce), nil)
+	require.NoError(t, err)
+
+	msg = readPublish(t, conn)
+	require.Equal(t, byte(message.QosAtMostOnce), msg.QoS())
+}
+
+func TestServerMaxQoSOf(t *testing.T) {
+	svr := &Server{
+		MaxQoS: MaxQoS1,
+		UserMaxQoS: func(username string) QoSLimit {
+			if username == "admin" {
+				return MaxQoS2
+			}
+			return QoSUnlimited
+		},
+	}
+
+	l := &listener{ListenerConfig: ListenerConfig{MaxQoS: MaxQoS0}}
+
+	require.Equal(t, MaxQoS1, svr.maxQoSOf(nil, "surgemq"))
+	require.Equal(t, MaxQoS0, svr.maxQoSOf(l, "surgemq"))
+	require.Equal(t, MaxQoS2, svr.maxQoSOf(l, "admin"))
+
+	require.Equal(t, byte(0), MaxQoS0.apply(2))
+	require.Equal(t, byte(1), MaxQoS2.apply(1))
+	require.Equal(t, byte(2), QoSUnlimited.apply(2))
+}
+
+func TestServerQoSUpgrade(t *testing.T) {
+	svr := &Server{QoSUpgrade: []string{"abc"}}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	durable, _ := subscribeAt(t, ln, message.QosAtLeastOnce)
+	defer durable.Close()
+
+	casual, _ := subscribeAt(t, ln, message.QosAtMostOnce)
+	defer casual.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	require.NoError(t, writeMessage(conn, newPublishMessage(0, message.QosAtMostOnce)))
+
+	// The subscription of QoS 1 gets it at QoS 1, the one of QoS 0 still gets it
+	durable.SetReadDeadline(time.Now().Add(time.Second))
+	msg := readPublish(t, durable)
+	require.Equal(t, byte(message.QosAtLeastOnce), msg.QoS())
+	require.NotEqual(t, uint16(0), msg.PacketId())
+
+	casual.SetReadDeadline(time.Now().Add(time.Second))
+	msg = readPublish(t, casual)
+	require.Equal(t, byte(message.QosAtMostOnce), msg.QoS())
+
+	// Once
+	casual.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = getMessageBuffer(casual, 0)
+	require.True(t, isTimeout(err))
+
+	// Topics without the prefix are left alone
+	pub := newTestPublish("xyz")
+	require.False(t, svr.upgradesQoS(pub.Topic()))
+}
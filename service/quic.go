@@ -0,0 +1,179 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build quic
+// +build quic
+
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/surgemq/surgemq/logging"
+)
+
+// The ALPN protocol negotiated for MQTT over QUIC, if the TLS configuration
+// doesn't have one already.
+const quicALPN = "mqtt"
+
+// ListenAndServeQUIC is the same as ListenAndServe, but over QUIC. It's
+// experimental, and only built with the "quic" build tag. Each QUIC connection
+// carries a single MQTT session on the first bidirectional stream the client
+// opens, and everything else about it works the same as a TCP connection.
+//
+// The URI is of the form "quic://host:port". 0-RTT is enabled, so clients that
+// have connected before can send their CONNECT without waiting for the handshake.
+// 0-RTT data can be replayed by an attacker, which for MQTT means the CONNECT,
+// so don't use it with authentication that's not safe to replay.
+func (this *Server) ListenAndServeQUIC(uri string, cfg *tls.Config) error {
+	_, address, err := parseURI(uri)
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.NextProtos) == 0 {
+		cfg = cfg.Clone()
+		cfg.NextProtos = []string{quicALPN}
+	}
+
+	ln, err := quic.ListenAddrEarly(address, cfg, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Second * time.Duration(this.ConnectTimeout)
+	if timeout == 0 {
+		timeout = time.Second * time.Duration(DefaultConnectTimeout)
+	}
+
+	return this.Serve(newQUICListener(ln, timeout, this.logger()))
+}
+
+// quicListener turns a QUIC listener into a net.Listener that returns the first
+// stream of each QUIC connection.
+type quicListener struct {
+	ln *quic.EarlyListener
+
+	// How long to wait for the client to open its stream
+	timeout time.Duration
+
+	// Where the connections that never open a stream are logged
+	log logging.Logger
+
+	conns chan net.Conn
+	errs  chan error
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newQUICListener(ln *quic.EarlyListener, timeout time.Duration, log logging.Logger) *quicListener {
+	this := &quicListener{
+		ln:      ln,
+		timeout: timeout,
+		log:     log,
+		conns:   make(chan net.Conn),
+		errs:    make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+
+	go this.run()
+
+	return this
+}
+
+func (this *quicListener) run() {
+	for {
+		qc, err := this.ln.Accept(context.Background())
+		if err != nil {
+			this.errs <- err
+			return
+		}
+
+		// Waiting for the stream is done separately for each connection, so a slow
+		// client doesn't hold up everybody else.
+		go this.accept(qc)
+	}
+}
+
+func (this *quicListener) accept(qc quic.EarlyConnection) {
+	ctx, cancel := context.WithTimeout(context.Background(), this.timeout)
+	defer cancel()
+
+	stream, err := qc.AcceptStream(ctx)
+	if err != nil {
+		this.log.Error("server/quicListener: Error accepting stream", logging.F("remote_addr", qc.RemoteAddr().String()), logging.Err(err))
+		qc.CloseWithError(0, "")
+		return
+	}
+
+	select {
+	case this.conns <- &quicConn{Stream: stream, qc: qc}:
+
+	case <-this.done:
+		qc.CloseWithError(0, "")
+	}
+}
+
+func (this *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-this.conns:
+		return conn, nil
+
+	case err := <-this.errs:
+		return nil, err
+
+	case <-this.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (this *quicListener) Close() error {
+	this.once.Do(func() {
+		close(this.done)
+	})
+
+	return this.ln.Close()
+}
+
+func (this *quicListener) Addr() net.Addr {
+	return this.ln.Addr()
+}
+
+// quicConn is a QUIC stream that looks like a net.Conn, so the services can use
+// it like any other connection.
+type quicConn struct {
+	quic.Stream
+
+	qc quic.EarlyConnection
+}
+
+func (this *quicConn) LocalAddr() net.Addr {
+	return this.qc.LocalAddr()
+}
+
+func (this *quicConn) RemoteAddr() net.Addr {
+	return this.qc.RemoteAddr()
+}
+
+// Close closes the whole QUIC connection, not just our side of the stream.
+func (this *quicConn) Close() error {
+	this.Stream.Close()
+	return this.qc.CloseWithError(0, "")
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+var ErrQuotaExceeded error = errors.New("service: Publish quota exceeded")
+
+const DefaultQuotaThrottleDelay = time.Second
+
+// Quota is what a client may publish per hour and per day, in messages and in
+// payload bytes. The limits that are 0 aren't enforced.
+type Quota struct {
+	HourlyMessages int64 `json:"hourly_messages,omitempty"`
+	HourlyBytes    int64 `json:"hourly_bytes,omitempty"`
+	DailyMessages  int64 `json:"daily_messages,omitempty"`
+	DailyBytes     int64 `json:"daily_bytes,omitempty"`
+}
+
+// QuotaPolicy is what's done with the messages a client publishes over its Quota.
+type QuotaPolicy int
+
+const (
+	// QuotaReject drops the messages. They are still acknowledged, since MQTT
+	// 3.1.1 has no way of refusing a message, and the client isn't disconnected,
+	// so it doesn't just publish them again.
+	QuotaReject QuotaPolicy = iota
+
+	// QuotaThrottle delivers the messages, but only after holding up the client
+	// for the QuotaThrottleDelay, so it can't publish more than one of them per
+	// delay.
+	QuotaThrottle
+)
+
+// QuotaStatus is the quota of a client and what's left of it.
+type QuotaStatus struct {
+	ClientId string              `json:"client_id"`
+	Quota    Quota               `json:"quota"`
+	Usage    sessions.QuotaUsage `json:"usage"`
+
+	// Remaining is what's left of each of the limits of the Quota for the
+	// current hour and day, or -1 for the limits that aren't enforced.
+	Remaining Quota `json:"remaining"`
+}
+
+// QuotaStatus returns the quota of client cid, and what it has used of it in the
+// current hour and day.
+func (this *Server) QuotaStatus(cid string) QuotaStatus {
+	now := time.Now()
+
+	this.qmu.Lock()
+	var usage sessions.QuotaUsage
+	if u := this.quotas[cid]; u != nil {
+		usage = *u
+	}
+	this.qmu.Unlock()
+
+	usage.Roll(now)
+
+	st := QuotaStatus{ClientId: cid, Usage: usage}
+	if this.Quota != nil {
+		st.Quota = this.Quota(cid)
+	}
+
+	st.Remaining = Quota{
+		HourlyMessages: remaining(st.Quota.HourlyMessages, usage.HourMessages),
+		HourlyBytes:    remaining(st.Quota.HourlyBytes, usage.HourBytes),
+		DailyMessages:  remaining(st.Quota.DailyMessages, usage.DayMessages),
+		DailyBytes:     remaining(st.Quota.DailyBytes, usage.DayBytes),
+	}
+
+	return st
+}
+
+// QuotaStatuses returns the QuotaStatus of every client that has published since
+// the start of the day, sorted by client ID.
+func (this *Server) QuotaStatuses() []QuotaStatus {
+	this.qmu.Lock()
+	cids := make([]string, 0, len(this.quotas))
+	for cid := range this.quotas {
+		cids = append(cids, cid)
+	}
+	this.qmu.Unlock()
+
+	sort.Strings(cids)
+
+	sts := make([]QuotaStatus, 0, len(cids))
+	for _, cid := range cids {
+		sts = append(sts, this.QuotaStatus(cid))
+	}
+
+	return sts
+}
+
+// QuotaExceeded returns the number of messages published over quota so far,
+// whether they were dropped or throttled.
+func (this *Server) QuotaExceeded() int64 {
+	return atomic.LoadInt64(&this.qexceeded)
+}
+
+func remaining(limit, used int64) int64 {
+	if limit <= 0 {
+		return -1
+	}
+
+	if used >= limit {
+		return 0
+	}
+
+	return limit - used
+}
+
+// chargeQuota counts a message of size bytes against the quota of client cid,
+// and returns ErrQuotaExceeded if it's over. Messages over quota only count if
+// they are delivered anyway, i.e. with QuotaThrottle.
+func (this *Server) chargeQuota(cid string, size int) error {
+	q := this.Quota(cid)
+	n := int64(size)
+
+	this.qmu.Lock()
+	defer this.qmu.Unlock()
+
+	if this.quotas == nil {
+		this.quotas = make(map[string]*sessions.QuotaUsage)
+	}
+
+	u := this.quotas[cid]
+	if u == nil {
+		u = &sessions.QuotaUsage{}
+		this.quotas[cid] = u
+	}
+
+	u.Roll(time.Now())
+
+	var err error
+	if (q.HourlyMessages > 0 && u.HourMessages+1 > q.HourlyMessages) ||
+		(q.HourlyBytes > 0 && u.HourBytes+n > q.HourlyBytes) ||
+		(q.DailyMessages > 0 && u.DayMessages+1 > q.DailyMessages) ||
+		(q.DailyBytes > 0 && u.DayBytes+n > q.DailyBytes) {
+		atomic.AddInt64(&this.qexceeded, 1)
+		err = ErrQuotaExceeded
+
+		if this.QuotaPolicy != QuotaThrottle {
+			return err
+		}
+	}
+
+	u.HourMessages++
+	u.HourBytes += n
+	u.DayMessages++
+	u.DayBytes += n
+
+	return err
+}
+
+// loadQuotas reads the persisted quota usage back from the session store.
+func (this *Server) loadQuotas() error {
+	usage, err := this.sessMgr.QuotaUsage()
+	if err != nil {
+		return fmt.Errorf("server/loadQuotas: Error reading quota usage: %v", err)
+	}
+
+	this.qmu.Lock()
+	defer this.qmu.Unlock()
+
+	this.quotas = make(map[string]*sessions.QuotaUsage, len(usage))
+
+	for cid, u := range usage {
+		u := u
+		this.quotas[cid] = &u
+	}
+
+	return nil
+}
+
+// saveQuotas persists the quota usage of all the clients.
+func (this *Server) saveQuotas() error {
+	this.qmu.Lock()
+	defer this.qmu.Unlock()
+
+	for cid, u := range this.quotas {
+		if err := this.sessMgr.SaveQuotaUsage(cid, *u); err != nil {
+			return fmt.Errorf("server/saveQuotas: Error saving quota usage of %q: %v", cid, err)
+		}
+	}
+
+	return nil
+}
+
+// saveQuota persists the quota usage of client cid, once it disconnects.
+func (this *Server) saveQuota(cid string) {
+	this.qmu.Lock()
+	u := this.quotas[cid]
+	if u == nil {
+		this.qmu.Unlock()
+		return
+	}
+	usage := *u
+	this.qmu.Unlock()
+
+	if err := this.sessMgr.SaveQuotaUsage(cid, usage); err != nil {
+		this.logger().Error("server/saveQuota: Error saving quota usage", logging.F("client_id", cid), logging.Err(err))
+	}
+}
+
+// overQuota charges msg to the quota of the client, and returns whether it's
+// dropped for being over it. With QuotaThrottle, the client is held up instead.
+func (this *service) overQuota(msg *message.PublishMessage) bool {
+	if this.server == nil || this.server.Quota == nil {
+		return false
+	}
+
+	if err := this.server.chargeQuota(this.sess.ID(), len(msg.Payload())); err == nil {
+		return false
+	}
+
+	if this.server.QuotaPolicy == QuotaThrottle {
+		t := time.NewTimer(this.server.QuotaThrottleDelay)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-this.done:
+		}
+
+		return false
+	}
+
+	this.logger().Debug("service/overQuota: Dropping message over quota", logging.F("topic", string(msg.Topic())))
+
+	return true
+}
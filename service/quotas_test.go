@@ -0,0 +1,183 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// quotaStore is a session store that keeps the quota usage, as a persistent one
+// would.
+type quotaStore struct {
+	sessions.SessionsProvider
+
+	mu    sync.Mutex
+	usage map[string]sessions.QuotaUsage
+}
+
+func (this *quotaStore) SaveQuotaUsage(cid string, usage sessions.QuotaUsage) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.usage[cid] = usage
+	return nil
+}
+
+func (this *quotaStore) QuotaUsage() (map[string]sessions.QuotaUsage, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	usage := make(map[string]sessions.QuotaUsage, len(this.usage))
+	for cid, u := range this.usage {
+		usage[cid] = u
+	}
+
+	return usage, nil
+}
+
+// publishQuotaTest connects to ln as client cid and publishes n QoS 0 messages
+// of a few bytes to "abc", then returns the connection.
+func publishQuotaTest(t *testing.T, ln net.Listener, cid string, n int) net.Conn {
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte(cid))
+
+	require.NoError(t, writeMessage(conn, cmsg))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	for i := 0; i < n; i++ {
+		msg := newTestPublish("abc")
+		msg.SetPayload([]byte("quota"))
+		require.NoError(t, writeMessage(conn, msg))
+	}
+
+	return conn
+}
+
+func TestServerQuotaReject(t *testing.T) {
+	svr := &Server{
+		Quota: func(cid string) Quota {
+			return Quota{HourlyMessages: 2}
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("abc"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	conn := publishQuotaTest(t, ln, "quota1", 3)
+	defer conn.Close()
+
+	require.True(t, waitFor(func() bool { return svr.QuotaExceeded() == 1 }))
+	require.Len(t, got, 2)
+
+	st := svr.QuotaStatus("quota1")
+	require.Equal(t, int64(2), st.Usage.HourMessages)
+	require.Equal(t, int64(0), st.Remaining.HourlyMessages)
+	require.Equal(t, int64(-1), st.Remaining.DailyBytes)
+
+	require.Len(t, svr.QuotaStatuses(), 1)
+}
+
+func TestServerQuotaThrottle(t *testing.T) {
+	svr := &Server{
+		Quota: func(cid string) Quota {
+			return Quota{DailyBytes: 1}
+		},
+		QuotaPolicy:        QuotaThrottle,
+		QuotaThrottleDelay: 100 * time.Millisecond,
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan time.Time, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- time.Now()
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("abc"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	conn := publishQuotaTest(t, ln, "quota1", 2)
+	defer conn.Close()
+
+	// Every message is over the quota, so both are held up, but delivered
+	for i := 0; i < 2; i++ {
+		select {
+		case at := <-got:
+			require.True(t, at.Sub(start) >= time.Duration(i+1)*100*time.Millisecond)
+		case <-time.After(time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+
+	require.Equal(t, int64(2), svr.QuotaExceeded())
+}
+
+func TestServerQuotaPersisted(t *testing.T) {
+	store := &quotaStore{SessionsProvider: sessions.NewMemProvider(), usage: make(map[string]sessions.QuotaUsage)}
+
+	sessions.Unregister("quotas")
+	sessions.Register("quotas", store)
+	defer sessions.Unregister("quotas")
+
+	quota := func(cid string) Quota {
+		return Quota{DailyMessages: 5}
+	}
+
+	svr := &Server{SessionsProvider: "quotas", Quota: quota}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	cid := "quota1"
+
+	conn := publishQuotaTest(t, ln, cid, 3)
+	require.True(t, waitFor(func() bool { return svr.QuotaStatus(cid).Usage.DayMessages == 3 }))
+
+	// Saved once the client disconnects
+	conn.Close()
+	require.True(t, waitFor(func() bool {
+		u, _ := store.QuotaUsage()
+		return u[cid].DayMessages == 3
+	}))
+
+	// and read back by the next server using the store
+	svr2 := &Server{SessionsProvider: "quotas", Quota: quota}
+	require.NoError(t, svr2.checkConfiguration())
+	require.Equal(t, int64(2), svr2.QuotaStatus(cid).Remaining.DailyMessages)
+}
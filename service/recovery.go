@@ -0,0 +1,70 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// RecoveryReport summarizes what the server loaded from the topics provider on
+// startup.
+type RecoveryReport struct {
+	// The number of retained messages restored
+	Retained int
+
+	// The retained message records that could not be read and were set aside.
+	// Only set in SafeMode.
+	BadRetained []topics.BadRecord
+}
+
+// RecoveryReport returns what the server recovered on startup, or nil if the
+// server hasn't started yet.
+func (this *Server) RecoveryReport() *RecoveryReport {
+	return this.report
+}
+
+// recover asks the topics provider to load the retained messages it has
+// persisted, and keeps the result in the server's RecoveryReport.
+func (this *Server) recover() error {
+	var (
+		report = &RecoveryReport{}
+		err    error
+	)
+
+	report.Retained, report.BadRetained, err = this.topicsMgr.Recover(this.SafeMode)
+	if err != nil {
+		return fmt.Errorf("server/recover: Error recovering retained messages: %v", err)
+	}
+
+	if report.Retained > 0 {
+		if err = this.adoptRetained(); err != nil {
+			return fmt.Errorf("server/recover: Error reading recovered retained messages: %v", err)
+		}
+	}
+
+	for _, r := range report.BadRetained {
+		this.logger().Error("server/recover: Quarantined retained message", logging.F("key", r.Key), logging.Err(r.Err))
+	}
+
+	this.logger().Info("server/recover: Restored retained messages",
+		logging.F("retained", report.Retained), logging.F("bad_retained", len(report.BadRetained)))
+
+	this.report = report
+
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/topics"
+)
+
+var errCorrupted = errors.New("corrupted record")
+
+// recoveringTopics pretends to have persisted 3 good retained messages and 1
+// bad one.
+type recoveringTopics struct {
+	topics.TopicsProvider
+}
+
+func (this *recoveringTopics) Recover(safe bool) (int, []topics.BadRecord, error) {
+	if !safe {
+		return 0, nil, errCorrupted
+	}
+
+	return 3, []topics.BadRecord{{Key: "bad", Err: errCorrupted}}, nil
+}
+
+func registerRecoveringProvider() func() {
+	topics.Register("recovering", &recoveringTopics{topics.NewMemProvider()})
+
+	return func() {
+		topics.Unregister("recovering")
+	}
+}
+
+func TestServerRecoverySafeMode(t *testing.T) {
+	defer registerRecoveringProvider()()
+
+	svr := &Server{
+		TopicsProvider: "recovering",
+		SafeMode:       true,
+	}
+
+	require.Nil(t, svr.RecoveryReport())
+	require.NoError(t, svr.checkConfiguration())
+
+	report := svr.RecoveryReport()
+	require.NotNil(t, report)
+	require.Equal(t, 3, report.Retained)
+	require.Equal(t, 1, len(report.BadRetained))
+	require.Equal(t, "bad", report.BadRetained[0].Key)
+}
+
+func TestServerRecoveryFailure(t *testing.T) {
+	defer registerRecoveringProvider()()
+
+	svr := &Server{
+		TopicsProvider: "recovering",
+	}
+
+	require.Error(t, svr.checkConfiguration())
+	require.Nil(t, svr.RecoveryReport())
+}
+
+func TestServerRecoveryNotSupported(t *testing.T) {
+	svr := &Server{}
+
+	require.NoError(t, svr.checkConfiguration())
+
+	report := svr.RecoveryReport()
+	require.NotNil(t, report)
+	require.Equal(t, 0, report.Retained)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+)
+
+var (
+	ErrNotConnected error = errors.New("service: Client is not connected")
+)
+
+// ResponseTopicPrefix is the first level of the topics returned by
+// NewResponseTopic.
+const ResponseTopicPrefix = "_response"
+
+// NewResponseTopic returns a topic for the reply to a request, which no other
+// request of this client uses, of the form "_response/<client id>/<n>". MQTT
+// 3.1.1 has no response topic property, so it's up to the request to carry it
+// to the responder, e.g. in its payload or its topic.
+func (this *Client) NewResponseTopic() (string, error) {
+	svc := this.current()
+	if svc == nil || svc.sess == nil {
+		return "", ErrNotConnected
+	}
+
+	return fmt.Sprintf("%s/%s/%d", ResponseTopicPrefix, svc.sess.ID(), atomic.AddUint64(&this.requests, 1)), nil
+}
+
+// Request publishes req, and returns the first message received on the topic
+// respTopic, where the responder is expected to publish its reply, or fails once
+// ctx is done. It subscribes to respTopic, at the QoS of req, before publishing,
+// so the reply can't be missed, and unsubscribes again before returning. When
+// the Router is set, the reply is taken by a route for respTopic for as long as
+// the request lasts.
+//
+// The SUBSCRIBE and UNSUBSCRIBE messages take their packet IDs counting down from
+// 65535, to keep clear of the ones of the application, which usually count up.
+func (this *Client) Request(ctx context.Context, req *message.PublishMessage, respTopic string) (*message.PublishMessage, error) {
+	replies := make(chan *message.PublishMessage, 1)
+
+	var onPublish OnPublishFunc = func(msg *message.PublishMessage) error {
+		select {
+		case replies <- msg:
+		default:
+		}
+		return nil
+	}
+
+	if this.Router != nil {
+		if err := this.Router.Handle(respTopic, onPublish); err != nil {
+			return nil, err
+		}
+		defer this.Router.Remove(respTopic)
+	}
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(this.nextPacketID())
+	if err := sub.AddTopic([]byte(respTopic), req.QoS()); err != nil {
+		return nil, err
+	}
+
+	if err := this.SubscribeContext(ctx, sub, onPublish); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		unsub := message.NewUnsubscribeMessage()
+		unsub.SetPacketId(this.nextPacketID())
+		unsub.AddTopic([]byte(respTopic))
+		this.Unsubscribe(unsub, nil)
+	}()
+
+	if err := this.PublishContext(ctx, req); err != nil {
+		return nil, err
+	}
+
+	select {
+	case msg := <-replies:
+		return msg, nil
+
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// nextPacketID returns the packet ID of the next message the client sends of its
+// own, counting down from 65535 and skipping 0.
+func (this *Client) nextPacketID() uint16 {
+	return uint16(0xffff - atomic.AddUint32(&this.pktid, 1)%0xffff)
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestClientRequest(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The responder replies to the topic in the payload of each request. It
+	// subscribes at the QoS of the requests, as a subscription granted a lower
+	// QoS doesn't get them.
+	responder, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer responder.Disconnect()
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("requests"), message.QosAtLeastOnce)
+
+	require.NoError(t, responder.SubscribeContext(ctx, sub, func(msg *message.PublishMessage) error {
+		reply := message.NewPublishMessage()
+		reply.SetTopic(msg.Payload())
+		reply.SetPayload([]byte("pong"))
+		return responder.Publish(reply, nil)
+	}))
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	respTopic, err := c.NewResponseTopic()
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(respTopic, ResponseTopicPrefix+"/"))
+
+	next, err := c.NewResponseTopic()
+	require.NoError(t, err)
+	require.NotEqual(t, respTopic, next)
+
+	req := message.NewPublishMessage()
+	req.SetPacketId(1)
+	req.SetTopic([]byte("requests"))
+	req.SetQoS(message.QosAtLeastOnce)
+	req.SetPayload([]byte(respTopic))
+
+	reply, err := c.Request(ctx, req, respTopic)
+	require.NoError(t, err)
+	require.Equal(t, []byte(respTopic), reply.Topic())
+	require.Equal(t, []byte("pong"), reply.Payload())
+}
+
+func TestClientRequestTimeout(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Nobody answers
+	_, err = c.Request(ctx, newPublishMessage(1, message.QosAtLeastOnce), "nobody/home")
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestClientNewResponseTopicNotConnected(t *testing.T) {
+	c := &Client{}
+
+	_, err := c.NewResponseTopic()
+	require.Equal(t, ErrNotConnected, err)
+}
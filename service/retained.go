@@ -0,0 +1,374 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+var (
+	ErrRetainedQuotaExceeded error = errors.New("service: Retained message quota exceeded")
+	ErrRetainedLimitExceeded error = errors.New("service: Retained message limit exceeded")
+)
+
+// RetainedOverflow is what's done with a retained message that would go over the
+// MaxRetained or MaxRetainedBytes of the server.
+type RetainedOverflow int
+
+const (
+	// RetainedReject delivers the message as usual, but doesn't retain it.
+	RetainedReject RetainedOverflow = iota
+
+	// RetainedEvictLRU makes room for the message by clearing the retained
+	// messages that were set the longest ago.
+	RetainedEvictLRU
+)
+
+// RetainedStats are the counters of the retained messages of a server.
+type RetainedStats struct {
+	// The number of retained messages, and the total size of their payloads
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+
+	// The number of retained messages cleared to make room for others, and the
+	// number not retained, because of MaxRetained and MaxRetainedBytes
+	Evicted  int64 `json:"evicted"`
+	Rejected int64 `json:"rejected"`
+}
+
+// retainedEntry is a retained message in the LRU list of the server.
+type retainedEntry struct {
+	topic string
+	size  int
+}
+
+// RetainedOwner is how many of the retained messages were set by a client.
+type RetainedOwner struct {
+	ClientId string `json:"client_id"`
+
+	// The number of retained messages the client set last
+	Retained int `json:"retained"`
+
+	// The number of retained messages that weren't kept because the client was
+	// over MaxRetainedPerClient
+	Rejected int64 `json:"rejected"`
+
+	// The topics of the retained messages. Only set by RetainedOwner.
+	Topics []string `json:"topics,omitempty"`
+}
+
+// retainedOwner is what's kept for each client that has set retained messages.
+type retainedOwner struct {
+	topics   map[string]struct{}
+	rejected int64
+}
+
+// retain keeps the retained message on behalf of the client, unless it's over its
+// MaxRetainedPerClient. The owner of a retained message is whoever set it last,
+// and an empty message clears it whoever the owner is. The messages published by
+// the server without a client ID don't count against any quota.
+//
+// The owners are only kept in memory. The retained messages recovered from a
+// persistent TopicsProvider on startup don't have one until they are set again.
+func (this *Server) retain(cid string, msg *message.PublishMessage) error {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	return this.retainLocked(cid, msg)
+}
+
+// retainLocked is retain with rmu held.
+func (this *Server) retainLocked(cid string, msg *message.PublishMessage) error {
+	topic := string(msg.Topic())
+	clear := len(msg.Payload()) == 0
+
+	this.initRetained()
+
+	prev, owned := this.retainedBy[topic]
+
+	o := this.owners[cid]
+	if o == nil {
+		o = &retainedOwner{topics: make(map[string]struct{})}
+	}
+
+	// Replacing one of its own doesn't take up any more of the quota
+	if !clear && cid != "" && this.MaxRetainedPerClient > 0 && (!owned || prev != cid) && len(o.topics) >= this.MaxRetainedPerClient {
+		o.rejected++
+		this.owners[cid] = o
+		return ErrRetainedQuotaExceeded
+	}
+
+	if !clear {
+		if err := this.makeRoom(topic, len(msg.Payload())); err != nil {
+			return err
+		}
+
+		if err := this.retainedBudget(topic, len(msg.Payload())); err != nil {
+			return err
+		}
+	}
+
+	if err := this.topicsMgr.Retain(msg); err != nil {
+		return err
+	}
+
+	this.scheduleExpiry(topic, clear)
+	this.touchRetained(topic, len(msg.Payload()), clear)
+
+	if owned {
+		if po := this.owners[prev]; po != nil {
+			delete(po.topics, topic)
+
+			if len(po.topics) == 0 && po.rejected == 0 {
+				delete(this.owners, prev)
+			}
+		}
+	}
+
+	if clear {
+		delete(this.retainedBy, topic)
+		return nil
+	}
+
+	this.retainedBy[topic] = cid
+	o.topics[topic] = struct{}{}
+	this.owners[cid] = o
+
+	return nil
+}
+
+// initRetained makes the maps keeping track of the retained messages, if they
+// haven't been made yet. rmu must be held.
+func (this *Server) initRetained() {
+	if this.retainedBy == nil {
+		this.retainedBy = make(map[string]string)
+		this.owners = make(map[string]*retainedOwner)
+		this.rlru = list.New()
+		this.rindex = make(map[string]*list.Element)
+	}
+}
+
+// adoptRetained starts keeping track of the retained messages recovered from a
+// persistent TopicsProvider, so they count against MaxRetained and
+// MaxRetainedBytes, and expire by MessageTTL. Since when they were set isn't
+// known, they are treated as having just been set, and they are kept for up to
+// their TTL on top of however long they were already kept. They don't have an
+// owner until they are set again.
+func (this *Server) adoptRetained() error {
+	var rmsgs []*message.PublishMessage
+
+	if err := this.topicsMgr.Retained([]byte("#"), &rmsgs); err != nil {
+		return err
+	}
+
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	this.initRetained()
+
+	for _, rm := range rmsgs {
+		topic := string(rm.Topic())
+
+		this.scheduleExpiry(topic, false)
+		this.touchRetained(topic, len(rm.Payload()), false)
+	}
+
+	return nil
+}
+
+// makeRoom checks a retained message of size bytes on topic against MaxRetained
+// and MaxRetainedBytes. With RetainedEvictLRU, it clears the retained messages
+// set the longest ago until there's room for it. rmu must be held.
+func (this *Server) makeRoom(topic string, size int) error {
+	if this.MaxRetained <= 0 && this.MaxRetainedBytes <= 0 {
+		return nil
+	}
+
+	for {
+		count, bytes := this.rlru.Len()+1, this.rbytes+int64(size)
+		if e := this.rindex[topic]; e != nil {
+			count--
+			bytes -= int64(e.Value.(*retainedEntry).size)
+		}
+
+		if (this.MaxRetained <= 0 || count <= this.MaxRetained) &&
+			(this.MaxRetainedBytes <= 0 || bytes <= this.MaxRetainedBytes) {
+			return nil
+		}
+
+		// The message being replaced doesn't make room for its replacement
+		oldest := this.rlru.Front()
+		if oldest != nil && oldest.Value.(*retainedEntry).topic == topic {
+			oldest = oldest.Next()
+		}
+
+		if this.RetainedOverflow != RetainedEvictLRU || oldest == nil {
+			this.rrejected++
+			return ErrRetainedLimitExceeded
+		}
+
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(oldest.Value.(*retainedEntry).topic))
+		msg.SetRetain(true)
+
+		if err := this.retainLocked("", msg); err != nil {
+			return err
+		}
+
+		this.revicted++
+	}
+}
+
+// touchRetained records that the retained message on topic was just set, with a
+// payload of size bytes, or cleared. rmu must be held.
+func (this *Server) touchRetained(topic string, size int, clear bool) {
+	e := this.rindex[topic]
+
+	if e != nil {
+		atomic.AddInt64(&this.rbytes, -int64(e.Value.(*retainedEntry).size))
+		this.rlru.Remove(e)
+		delete(this.rindex, topic)
+	}
+
+	if clear {
+		return
+	}
+
+	this.rindex[topic] = this.rlru.PushBack(&retainedEntry{topic: topic, size: size})
+	atomic.AddInt64(&this.rbytes, int64(size))
+}
+
+// RetainedStats returns the counters of the retained messages.
+func (this *Server) RetainedStats() RetainedStats {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	st := RetainedStats{
+		Bytes:    this.rbytes,
+		Evicted:  this.revicted,
+		Rejected: this.rrejected,
+	}
+
+	if this.rlru != nil {
+		st.Count = this.rlru.Len()
+	}
+
+	return st
+}
+
+// DeleteRetained clears the retained messages matching the topic filter, and
+// returns how many were cleared.
+func (this *Server) DeleteRetained(filter []byte) (int, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return 0, err
+	}
+
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	var rmsgs []*message.PublishMessage
+
+	if err := this.topicsMgr.Retained(filter, &rmsgs); err != nil {
+		return 0, err
+	}
+
+	// The messages found are the provider's own, which clearing them changes
+	names := make([]string, 0, len(rmsgs))
+	for _, rm := range rmsgs {
+		names = append(names, string(rm.Topic()))
+	}
+
+	for i, topic := range names {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetRetain(true)
+
+		if err := this.retainLocked("", msg); err != nil {
+			return i, err
+		}
+	}
+
+	return len(names), nil
+}
+
+// retainAs is retain for the services and Publish, which log the errors rather
+// than return them, as the message is still delivered.
+func (this *Server) retainAs(cid string, msg *message.PublishMessage) {
+	if err := this.retain(cid, msg); err == ErrRetainedQuotaExceeded || err == ErrRetainedLimitExceeded || err == ErrMemoryBudgetExceeded {
+		this.logger().Error("server/retain: Not retaining message", logging.F("client_id", cid), logging.F("topic", string(msg.Topic())), logging.Err(err))
+	} else if err != nil {
+		this.logger().Error("server/retain: Error retaining message", logging.F("client_id", cid), logging.Err(err))
+	}
+}
+
+// RetainedOwners returns the clients that have set retained messages, or had
+// them rejected, the ones with the most retained messages first. Those set
+// without a client ID, by the server itself, are under an empty client ID.
+func (this *Server) RetainedOwners() []RetainedOwner {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	owners := make([]RetainedOwner, 0, len(this.owners))
+
+	for cid, o := range this.owners {
+		owners = append(owners, RetainedOwner{
+			ClientId: cid,
+			Retained: len(o.topics),
+			Rejected: o.rejected,
+		})
+	}
+
+	sort.Slice(owners, func(i, j int) bool {
+		if owners[i].Retained != owners[j].Retained {
+			return owners[i].Retained > owners[j].Retained
+		}
+		return owners[i].ClientId < owners[j].ClientId
+	})
+
+	return owners
+}
+
+// RetainedOwner returns the retained messages set by the client, with their
+// topics sorted. It returns ErrClientNotFound if the client hasn't set any.
+func (this *Server) RetainedOwner(cid string) (*RetainedOwner, error) {
+	this.rmu.Lock()
+	defer this.rmu.Unlock()
+
+	o, ok := this.owners[cid]
+	if !ok {
+		return nil, ErrClientNotFound
+	}
+
+	ro := &RetainedOwner{
+		ClientId: cid,
+		Retained: len(o.topics),
+		Rejected: o.rejected,
+		Topics:   make([]string, 0, len(o.topics)),
+	}
+
+	for t := range o.topics {
+		ro.Topics = append(ro.Topics, t)
+	}
+
+	sort.Strings(ro.Topics)
+
+	return ro, nil
+}
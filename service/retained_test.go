@@ -0,0 +1,192 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func newRetainedMessage(topic, payload string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+	msg.SetRetain(true)
+	return msg
+}
+
+func TestServerRetainedQuota(t *testing.T) {
+	svr := &Server{MaxRetainedPerClient: 2}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.NoError(t, svr.checkConfiguration())
+
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/1", "x")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/2", "x")))
+
+	// Over the quota, but replacing its own is fine
+	require.Equal(t, ErrRetainedQuotaExceeded, svr.retain("c1", newRetainedMessage("a/3", "x")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/2", "y")))
+
+	// Taking over someone else's counts against the new owner only
+	require.NoError(t, svr.retain("c2", newRetainedMessage("a/1", "z")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/3", "x")))
+
+	// Clearing one frees up the quota of the owner, whoever clears it
+	require.NoError(t, svr.retain("c2", newRetainedMessage("a/3", "")))
+
+	// The server itself has no quota
+	for _, topic := range []string{"s/1", "s/2", "s/3"} {
+		require.NoError(t, svr.retain("", newRetainedMessage(topic, "x")))
+	}
+
+	require.Equal(t, []RetainedOwner{
+		{ClientId: "", Retained: 3},
+		{ClientId: "c1", Retained: 1, Rejected: 1},
+		{ClientId: "c2", Retained: 1},
+	}, svr.RetainedOwners())
+
+	o, err := svr.RetainedOwner("c1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/2"}, o.Topics)
+
+	_, err = svr.RetainedOwner("nobody")
+	require.Equal(t, ErrClientNotFound, err)
+
+	rmsgs, err := svr.Retained([]byte("a/+"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 2)
+}
+
+func TestServerRetainedQuotaPublish(t *testing.T) {
+	svr := &Server{MaxRetainedPerClient: 1}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	var got []string
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got = append(got, string(msg.Topic()))
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("#"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	opts := &PublishOptions{ClientId: "$http"}
+
+	_, err = svr.Publish(newRetainedMessage("a", "x"), opts)
+	require.NoError(t, err)
+	_, err = svr.Publish(newRetainedMessage("b", "x"), opts)
+	require.NoError(t, err)
+
+	// Both are delivered, only the first is retained
+	require.Equal(t, []string{"a", "b"}, got)
+
+	rmsgs, err := svr.Retained([]byte("#"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 1)
+	require.Equal(t, "a", string(rmsgs[0].Topic()))
+
+	require.Equal(t, []RetainedOwner{{ClientId: "$http", Retained: 1, Rejected: 1}}, svr.RetainedOwners())
+}
+
+func TestServerMaxRetainedReject(t *testing.T) {
+	svr := &Server{MaxRetained: 2, MaxRetainedBytes: 5}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.NoError(t, svr.checkConfiguration())
+
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/1", "xx")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/2", "xx")))
+
+	// Over the count, but replacing one is fine as long as it fits
+	require.Equal(t, ErrRetainedLimitExceeded, svr.retain("c1", newRetainedMessage("a/3", "x")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/2", "xxx")))
+	require.Equal(t, ErrRetainedLimitExceeded, svr.retain("c1", newRetainedMessage("a/2", "xxxx")))
+
+	require.Equal(t, RetainedStats{Count: 2, Bytes: 5, Rejected: 2}, svr.RetainedStats())
+
+	// Clearing one makes room
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/1", "")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/3", "x")))
+
+	require.Equal(t, RetainedStats{Count: 2, Bytes: 4, Rejected: 2}, svr.RetainedStats())
+}
+
+func TestServerMaxRetainedEvictLRU(t *testing.T) {
+	svr := &Server{MaxRetained: 2, RetainedOverflow: RetainedEvictLRU}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.NoError(t, svr.checkConfiguration())
+
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/1", "x")))
+	require.NoError(t, svr.retain("c2", newRetainedMessage("a/2", "x")))
+
+	// Setting a/1 again makes a/2 the least recently set
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/1", "y")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("a/3", "x")))
+
+	rmsgs, err := svr.Retained([]byte("a/+"))
+	require.NoError(t, err)
+
+	var topics []string
+	for _, msg := range rmsgs {
+		topics = append(topics, string(msg.Topic()))
+	}
+	require.ElementsMatch(t, []string{"a/1", "a/3"}, topics)
+
+	// The owner of the evicted message no longer has it
+	_, err = svr.RetainedOwner("c2")
+	require.Equal(t, ErrClientNotFound, err)
+
+	require.Equal(t, RetainedStats{Count: 2, Bytes: 2, Evicted: 1}, svr.RetainedStats())
+}
+
+func TestServerDeleteRetained(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.NoError(t, svr.checkConfiguration())
+
+	for _, topic := range []string{"a/1", "a/2", "b/1"} {
+		require.NoError(t, svr.retain("c1", newRetainedMessage(topic, "x")))
+	}
+
+	n, err := svr.DeleteRetained([]byte("a/#"))
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	rmsgs, err := svr.Retained([]byte("#"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 1)
+	require.Equal(t, []byte("b/1"), rmsgs[0].Topic())
+
+	o, err := svr.RetainedOwner("c1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b/1"}, o.Topics)
+
+	require.Equal(t, RetainedStats{Count: 1, Bytes: 1}, svr.RetainedStats())
+}
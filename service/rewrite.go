@@ -0,0 +1,138 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// RewriteAction is what a RewriteRule rewrites the topics of.
+type RewriteAction int
+
+const (
+	// RewriteAll rewrites the topics of both the PUBLISH and the SUBSCRIBE
+	// messages, and of the UNSUBSCRIBE messages with them.
+	RewriteAll RewriteAction = iota
+
+	// RewritePublish only rewrites the topics of the PUBLISH messages.
+	RewritePublish
+
+	// RewriteSubscribe only rewrites the topic filters of the SUBSCRIBE and
+	// UNSUBSCRIBE messages.
+	RewriteSubscribe
+)
+
+// RewriteRule rewrites the topics clients publish and subscribe to that match
+// Filter, e.g. to move clients that can't be updated onto a new topic namespace,
+// or to put each of them under a prefix of its own:
+//
+//	svr.TopicRewrite = []service.RewriteRule{
+//		{Filter: "v1/#", Regexp: regexp.MustCompile(`^v1/(.*)$`), Template: "v2/$1"},
+//		{Filter: "devices/#", Template: "tenants/%u/$0"},
+//	}
+//
+// Only the topics coming in are rewritten, so the messages are delivered with
+// their rewritten topics, which the subscribers' own filters were rewritten to
+// match. Clients that dispatch the messages they receive by their own filters,
+// as Client does, don't find a handler for them, so subscriptions are only
+// worth rewriting for clients that don't.
+type RewriteRule struct {
+	// Filter is the topic filter of the topics the rule is for. For SUBSCRIBE
+	// messages, it's matched against the topic filter subscribed to as if that
+	// were a topic. If not set then the rule is for all the topics.
+	Filter string
+
+	// Regexp is matched against the topic, for Template to refer to its
+	// submatches. If not set then the whole topic is $0.
+	Regexp *regexp.Regexp
+
+	// Template is the new topic, with $1 or ${name} for the submatches of
+	// Regexp, as in regexp.Expand, and %c and %u for the client ID and the
+	// username.
+	Template string
+
+	// Action is what the rule rewrites the topics of.
+	Action RewriteAction
+}
+
+// rewrite returns topic rewritten by the first of the TopicRewrite rules that
+// matches it and is for action, or topic itself if none does.
+func (this *Server) rewrite(action RewriteAction, cid, username string, topic []byte) []byte {
+	for _, r := range this.TopicRewrite {
+		if r.Action != RewriteAll && r.Action != action {
+			continue
+		}
+
+		if r.Filter != "" && !topics.Match([]byte(r.Filter), topic) {
+			continue
+		}
+
+		re := r.Regexp
+		if re == nil {
+			re = wholeTopic
+		}
+
+		m := re.FindSubmatchIndex(topic)
+		if m == nil {
+			continue
+		}
+
+		tmpl := bytes.ReplaceAll([]byte(r.Template), []byte("%c"), []byte(cid))
+		tmpl = bytes.ReplaceAll(tmpl, []byte("%u"), []byte(username))
+
+		return re.Expand(nil, tmpl, topic, m)
+	}
+
+	return topic
+}
+
+var wholeTopic = regexp.MustCompile(`^.*$`)
+
+// rewrite returns the topic of a message the client of the service publishes,
+// or the topic filter it subscribes to, rewritten for action and put under the
+// tenant of the client.
+func (this *service) rewrite(action RewriteAction, topic []byte) []byte {
+	if this.server != nil && len(this.server.TopicRewrite) > 0 {
+		var username string
+		if this.sess.Cmsg != nil {
+			username = string(this.sess.Cmsg.Username())
+		}
+
+		topic = this.server.rewrite(action, this.sess.ID(), username, topic)
+	}
+
+	return this.tenantTopic(topic)
+}
+
+// rewritePublish rewrites the topic of msg, published by the client of the
+// service. It returns false if the new topic isn't a valid one to publish to.
+func (this *service) rewritePublish(msg *message.PublishMessage) bool {
+	topic := this.rewrite(RewritePublish, msg.Topic())
+	if bytes.Equal(topic, msg.Topic()) {
+		return true
+	}
+
+	if err := msg.SetTopic(topic); err != nil {
+		this.logger().Error("service/rewritePublish: Invalid rewritten topic", logging.F("topic", string(topic)), logging.Err(err))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerRewrite(t *testing.T) {
+	svr := &Server{
+		TopicRewrite: []RewriteRule{
+			{Filter: "v1/#", Regexp: regexp.MustCompile(`^v1/(.*)$`), Template: "v2/$1"},
+			{Filter: "devices/#", Template: "tenants/%u/$0", Action: RewritePublish},
+			{Filter: "x/+", Regexp: regexp.MustCompile(`^x/(?P<id>\d+)$`), Template: "y/${id}/%c"},
+		},
+	}
+
+	require.Equal(t, "v2/a/b", string(svr.rewrite(RewritePublish, "c1", "u1", []byte("v1/a/b"))))
+	require.Equal(t, "v2/+/b", string(svr.rewrite(RewriteSubscribe, "c1", "u1", []byte("v1/+/b"))))
+	require.Equal(t, "tenants/u1/devices/1", string(svr.rewrite(RewritePublish, "c1", "u1", []byte("devices/1"))))
+	require.Equal(t, "y/42/c1", string(svr.rewrite(RewritePublish, "c1", "u1", []byte("x/42"))))
+
+	// Rules only apply to their action, and when their regexp matches
+	require.Equal(t, "devices/1", string(svr.rewrite(RewriteSubscribe, "c1", "u1", []byte("devices/1"))))
+	require.Equal(t, "x/abc", string(svr.rewrite(RewritePublish, "c1", "u1", []byte("x/abc"))))
+	require.Equal(t, "other", string(svr.rewrite(RewritePublish, "c1", "u1", []byte("other"))))
+}
+
+func TestServerRewriteClients(t *testing.T) {
+	svr := &Server{
+		TopicRewrite: []RewriteRule{
+			{Filter: "v1/#", Regexp: regexp.MustCompile(`^v1/(.*)$`), Template: "v2/$1"},
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("v2/#"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	// The old subscription is moved onto the new namespace as well
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("v1/#"), message.QosAtMostOnce)
+
+	subscribed := make(chan struct{})
+	require.NoError(t, c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(subscribed)
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		return nil
+	}))
+	<-subscribed
+
+	svr.mu.Lock()
+	svc := svr.clients[c.svc.sess.ID()]
+	svr.mu.Unlock()
+
+	_, ok := svc.sess.Topic("v2/#")
+	require.True(t, ok)
+
+	require.NoError(t, c.Publish(newTestPublish("v1/a"), nil))
+
+	select {
+	case msg := <-got:
+		require.Equal(t, "v2/a", string(msg.Topic()))
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message")
+	}
+}
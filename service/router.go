@@ -0,0 +1,216 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+var (
+	ErrInvalidTopicFilter error = errors.New("service: Invalid topic filter")
+	ErrRouteNotFound      error = errors.New("service: Route not found")
+)
+
+// DispatchOrder is which of the handlers whose topic filters match a message the
+// Router calls.
+type DispatchOrder int
+
+const (
+	// DispatchAll calls all the matching handlers, in the order they were added.
+	DispatchAll DispatchOrder = iota
+
+	// DispatchFirst calls only the first of the matching handlers to be added.
+	DispatchFirst
+
+	// DispatchMostSpecific calls only the matching handler with the most specific
+	// topic filter, i.e., the one with the most levels before any wildcard, so
+	// "a/b/+" wins over "a/+/c", which wins over "a/#". Filters just as specific
+	// go in the order they were added.
+	DispatchMostSpecific
+)
+
+// Router dispatches the messages a client receives to handlers by topic filter,
+// rather than to the onPublish function of the subscription they came in on.
+// Set it as Client.Router, add the handlers, then subscribe. Handlers can be
+// added and removed while the client is connected.
+type Router struct {
+	// Order is which of the matching handlers are called. If not set then
+	// default to DispatchAll.
+	Order DispatchOrder
+
+	mu     sync.RWMutex
+	routes []*route
+	def    OnPublishFunc
+}
+
+type route struct {
+	filter  string
+	handler OnPublishFunc
+
+	// The number of levels before the first wildcard, and in all
+	specific int
+	levels   int
+}
+
+// Handle sets the handler of the messages on the topics matching filter, which
+// can have wildcards. If filter already has a handler, it's replaced, keeping
+// its place in the order.
+func (this *Router) Handle(filter string, handler OnPublishFunc) error {
+	if handler == nil {
+		return ErrInvalidSubscriber
+	}
+
+	if !validFilter(filter) {
+		return ErrInvalidTopicFilter
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	r := &route{filter: filter, handler: handler}
+
+	levels := strings.Split(filter, topics.SEP)
+	r.levels = len(levels)
+
+	for _, l := range levels {
+		if l == topics.MWC || l == topics.SWC {
+			break
+		}
+		r.specific++
+	}
+
+	// The routes slice is never changed in place, so Dispatch can carry on with
+	// the old one
+	routes := make([]*route, 0, len(this.routes)+1)
+
+	replaced := false
+	for _, old := range this.routes {
+		if old.filter == filter {
+			old = r
+			replaced = true
+		}
+		routes = append(routes, old)
+	}
+
+	if !replaced {
+		routes = append(routes, r)
+	}
+
+	this.routes = routes
+	return nil
+}
+
+// HandleDefault sets the handler of the messages that no other handler's filter
+// matches. If not set then those messages are dropped.
+func (this *Router) HandleDefault(handler OnPublishFunc) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.def = handler
+}
+
+// Remove removes the handler of filter.
+func (this *Router) Remove(filter string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	routes := make([]*route, 0, len(this.routes))
+	for _, r := range this.routes {
+		if r.filter != filter {
+			routes = append(routes, r)
+		}
+	}
+
+	if len(routes) == len(this.routes) {
+		return ErrRouteNotFound
+	}
+
+	this.routes = routes
+	return nil
+}
+
+// Dispatch calls the handlers of the message. If any of them fails, the rest are
+// still called, and the first error is returned.
+func (this *Router) Dispatch(msg *message.PublishMessage) error {
+	this.mu.RLock()
+	routes, def := this.routes, this.def
+	this.mu.RUnlock()
+
+	var (
+		best    *route
+		matched bool
+		err     error
+	)
+
+	for _, r := range routes {
+		if !topics.Match([]byte(r.filter), msg.Topic()) {
+			continue
+		}
+
+		matched = true
+
+		switch this.Order {
+		case DispatchFirst:
+			return r.handler(msg)
+
+		case DispatchMostSpecific:
+			if best == nil || r.specific > best.specific || (r.specific == best.specific && r.levels > best.levels) {
+				best = r
+			}
+
+		default:
+			if err2 := r.handler(msg); err2 != nil && err == nil {
+				err = err2
+			}
+		}
+	}
+
+	if best != nil {
+		return best.handler(msg)
+	}
+
+	if !matched && def != nil {
+		return def(msg)
+	}
+
+	return err
+}
+
+// validFilter is whether filter is a valid topic filter, i.e. it's not empty,
+// and the wildcards take up whole levels, with "#" only as the last.
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, topics.SEP)
+
+	for i, l := range levels {
+		if l == topics.MWC && i == len(levels)-1 || l == topics.SWC {
+			continue
+		}
+
+		if strings.ContainsAny(l, "#+") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+// recordRoutes sets up the handlers of the router to record which of them were
+// called.
+func recordRoutes(t *testing.T, r *Router, got *[]string, filters ...string) {
+	for _, f := range filters {
+		f := f
+		require.NoError(t, r.Handle(f, func(msg *message.PublishMessage) error {
+			*got = append(*got, f)
+			return nil
+		}))
+	}
+
+	r.HandleDefault(func(msg *message.PublishMessage) error {
+		*got = append(*got, "default")
+		return nil
+	})
+}
+
+func TestRouterDispatch(t *testing.T) {
+	var got []string
+
+	r := &Router{}
+	recordRoutes(t, r, &got, "a/#", "a/+/c", "a/b/+", "x/y")
+
+	require.NoError(t, r.Dispatch(newTestPublish("a/b/c")))
+	require.Equal(t, []string{"a/#", "a/+/c", "a/b/+"}, got)
+
+	got = nil
+	require.NoError(t, r.Dispatch(newTestPublish("z")))
+	require.Equal(t, []string{"default"}, got)
+
+	r.Order = DispatchFirst
+	got = nil
+	require.NoError(t, r.Dispatch(newTestPublish("a/b/c")))
+	require.Equal(t, []string{"a/#"}, got)
+
+	r.Order = DispatchMostSpecific
+	got = nil
+	require.NoError(t, r.Dispatch(newTestPublish("a/b/c")))
+	require.NoError(t, r.Dispatch(newTestPublish("a/q/c")))
+	require.Equal(t, []string{"a/b/+", "a/+/c"}, got)
+
+	require.NoError(t, r.Remove("a/b/+"))
+	require.Equal(t, ErrRouteNotFound, r.Remove("a/b/+"))
+
+	got = nil
+	require.NoError(t, r.Dispatch(newTestPublish("a/b/c")))
+	require.Equal(t, []string{"a/+/c"}, got)
+}
+
+func TestRouterHandle(t *testing.T) {
+	r := &Router{}
+
+	for _, f := range []string{"", "a/#/b", "a/b#", "a+/b"} {
+		require.Equal(t, ErrInvalidTopicFilter, r.Handle(f, func(msg *message.PublishMessage) error { return nil }), f)
+	}
+
+	require.Equal(t, ErrInvalidSubscriber, r.Handle("a", nil))
+
+	// Replacing a handler keeps its place, and every handler is still called
+	// when one of them fails
+	var got []string
+	recordRoutes(t, r, &got, "a/#", "a")
+
+	require.NoError(t, r.Handle("a/#", func(msg *message.PublishMessage) error {
+		got = append(got, "replaced")
+		return errors.New("failed")
+	}))
+
+	require.EqualError(t, r.Dispatch(newTestPublish("a")), "failed")
+	require.Equal(t, []string{"replaced", "a"}, got)
+}
+
+func TestClientRouter(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	got := make(chan string, 10)
+
+	r := &Router{}
+	require.NoError(t, r.Handle("a/#", func(msg *message.PublishMessage) error {
+		got <- "a/#"
+		return nil
+	}))
+
+	c := &Client{Router: r}
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), newConnectMessage()))
+	defer c.Disconnect()
+
+	subscribed := make(chan struct{})
+
+	// The subscription doesn't need an onPublish function of its own
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("a/#"), message.QosAtMostOnce)
+
+	require.NoError(t, c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(subscribed)
+		return err
+	}, nil))
+
+	select {
+	case <-subscribed:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for SUBACK")
+	}
+
+	_, err := svr.Publish(newTestPublish("a/b"), nil)
+	require.NoError(t, err)
+
+	select {
+	case f := <-got:
+		require.Equal(t, "a/#", f)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the message")
+	}
+}
@@ -19,10 +19,12 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/codec"
+	"github.com/surgemq/surgemq/logging"
 )
 
 type netReader interface {
@@ -47,33 +49,64 @@ func (this *service) receiver() {
 	defer func() {
 		// Let's recover from panic
 		if r := recover(); r != nil {
-			glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+			this.logger().Error("service/receiver: Recovering from panic", logging.F("panic", r))
 		}
 
-		this.wgStopped.Done()
+		this.exited()
 
-		glog.Debugf("(%s) Stopping receiver", this.cid())
+		this.logger().Debug("service/receiver: Stopping receiver")
 	}()
 
-	glog.Debugf("(%s) Starting receiver", this.cid())
+	this.logger().Debug("service/receiver: Starting receiver")
 
 	this.wgStarted.Done()
 
 	switch conn := this.conn.(type) {
 	case net.Conn:
 		//glog.Debugf("server/handleConnection: Setting read deadline to %d", time.Second*time.Duration(this.keepAlive))
-		keepAlive := time.Second * time.Duration(this.keepAlive)
-		r := timeoutReader{
-			d:    keepAlive + (keepAlive / 2),
+		timeout := this.keepAliveTimeout()
+
+		var r io.Reader = timeoutReader{
+			d:    timeout,
 			conn: conn,
 		}
 
+		var ir *idleReader
+
+		if this.timers != nil {
+			ir = newIdleReader(this.timers, conn, timeout, this.logger())
+			defer ir.Stop()
+			r = ir
+
+			// The client has been silent since before the connection was parked
+			if this.lastRead != 0 {
+				atomic.StoreInt64(&ir.last, this.lastRead)
+			}
+
+			if this.parkable() {
+				r = parkReader{svc: this, conn: conn, ir: ir, d: this.server.EventLoopIdle}
+			}
+		}
+
 		for {
 			_, err := this.in.ReadFrom(r)
 
+			if err == errParked {
+				return
+			}
+
 			if err != nil {
-				if err != io.EOF {
-					glog.Errorf("(%s) error reading from connection: %v", this.cid(), err)
+				if err != io.EOF && !this.handingOff() {
+					this.logger().Error("service/receiver: Error reading from connection", logging.Err(err))
+
+					// Nobody asked for the connection to be closed
+					if !this.isDone() {
+						atomic.StoreInt32(&this.dropped, 1)
+
+						if isTimeout(err) || (ir != nil && atomic.LoadInt32(&ir.expired) == 1) {
+							this.setReason(DisconnectKeepAlive)
+						}
+					}
 				}
 				return
 			}
@@ -83,7 +116,7 @@ func (this *service) receiver() {
 	//	glog.Errorf("(%s) Websocket: %v", this.cid(), ErrInvalidConnectionType)
 
 	default:
-		glog.Errorf("(%s) %v", this.cid(), ErrInvalidConnectionType)
+		this.logger().Error("service/receiver: Invalid connection type")
 	}
 }
 
@@ -92,15 +125,15 @@ func (this *service) sender() {
 	defer func() {
 		// Let's recover from panic
 		if r := recover(); r != nil {
-			glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+			this.logger().Error("service/sender: Recovering from panic", logging.F("panic", r))
 		}
 
-		this.wgStopped.Done()
+		this.exited()
 
-		glog.Debugf("(%s) Stopping sender", this.cid())
+		this.logger().Debug("service/sender: Stopping sender")
 	}()
 
-	glog.Debugf("(%s) Starting sender", this.cid())
+	this.logger().Debug("service/sender: Starting sender")
 
 	this.wgStarted.Done()
 
@@ -111,7 +144,7 @@ func (this *service) sender() {
 
 			if err != nil {
 				if err != io.EOF {
-					glog.Errorf("(%s) error writing data: %v", this.cid(), err)
+					this.logger().Error("service/sender: Error writing data", logging.Err(err))
 				}
 				return
 			}
@@ -121,7 +154,7 @@ func (this *service) sender() {
 	//	glog.Errorf("(%s) Websocket not supported", this.cid())
 
 	default:
-		glog.Errorf("(%s) Invalid connection type", this.cid())
+		this.logger().Error("service/sender: Invalid connection type")
 	}
 }
 
@@ -172,6 +205,11 @@ func (this *service) peekMessageSize() (message.MessageType, int, error) {
 	// Total message length is remlen + 1 (msg type) + m (remlen bytes)
 	total := int(remlen) + 1 + m
 
+	// Reject the message before it's buffered if it's larger than allowed
+	if this.maxPacketSize > 0 && total > this.maxPacketSize {
+		return 0, 0, ErrPacketTooLarge
+	}
+
 	mtype := message.MessageType(b[0] >> 4)
 
 	return mtype, total, err
@@ -205,12 +243,13 @@ func (this *service) peekMessage(mtype message.MessageType, total int) (message.
 		}
 	}
 
-	msg, err = mtype.New()
-	if err != nil {
+	if err = checkFlags(b, this.compliance, this.logger()); err != nil {
 		return nil, 0, err
 	}
 
-	n, err = msg.Decode(b)
+	// The decoder doesn't check the lengths inside the packet against the
+	// remaining length, so it's given only the packet
+	msg, n, err = codec.Decode(b[:total])
 	return msg, n, err
 }
 
@@ -238,7 +277,7 @@ func (this *service) readMessage(mtype message.MessageType, total int) (message.
 	for l < total {
 		n, err = this.in.Read(this.intmp[l:])
 		l += n
-		glog.Debugf("read %d bytes, total %d", n, l)
+		this.logger().Debug("service/peekMessage: Read bytes", logging.F("bytes", n), logging.F("total", l))
 		if err != nil {
 			return nil, 0, err
 		}
@@ -246,12 +285,7 @@ func (this *service) readMessage(mtype message.MessageType, total int) (message.
 
 	b = this.intmp[:total]
 
-	msg, err = mtype.New()
-	if err != nil {
-		return msg, 0, err
-	}
-
-	n, err = msg.Decode(b)
+	msg, n, err = codec.Decode(b)
 	return msg, n, err
 }
 
@@ -265,10 +299,6 @@ func (this *service) writeMessage(msg message.Message) (int, error) {
 		wrap bool
 	)
 
-	if this.out == nil {
-		return 0, ErrBufferNotReady
-	}
-
 	// This is to serialize writes to the underlying buffer. Multiple goroutines could
 	// potentially get here because of calling Publish() or Subscribe() or other
 	// functions that will send messages. For example, if a message is received in
@@ -284,22 +314,32 @@ func (this *service) writeMessage(msg message.Message) (int, error) {
 	this.wmu.Lock()
 	defer this.wmu.Unlock()
 
+	// A parked connection gets its buffers back first
+	if err = this.unpark(); err != nil {
+		return 0, err
+	}
+
+	if this.out == nil {
+		return 0, ErrBufferNotReady
+	}
+
 	buf, wrap, err = this.out.WriteWait(l)
 	if err != nil {
 		return 0, err
 	}
 
 	if wrap {
-		if len(this.outtmp) < l {
-			this.outtmp = make([]byte, l)
-		}
+		// It doesn't fit before the end of the ring, so it's encoded elsewhere
+		// first and then copied in two parts
+		tmp := codec.GetBuffer(l)
+		defer codec.PutBuffer(tmp)
 
-		n, err = msg.Encode(this.outtmp[0:])
+		n, err = msg.Encode(tmp)
 		if err != nil {
 			return 0, err
 		}
 
-		m, err = this.out.Write(this.outtmp[0:n])
+		m, err = this.out.Write(tmp[0:n])
 		if err != nil {
 			return m, err
 		}
@@ -17,7 +17,9 @@ package service
 import (
 	"bytes"
 	"io"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surgemq/message"
@@ -198,6 +200,68 @@ func TestWriteMessage(t *testing.T) {
 	require.Equal(t, msgBytes, dst, "error decoding message.")
 }
 
+func TestPeekMessageSizeTooLarge(t *testing.T) {
+	msg := newPublishMessageLarge(1, 1)
+	buf := make([]byte, msg.Len())
+	_, err := msg.Encode(buf)
+	require.NoError(t, err)
+
+	svc := newTestBuffer(t, buf)
+
+	svc.maxPacketSize = len(buf)
+	mtype, total, err := svc.peekMessageSize()
+	require.NoError(t, err)
+	require.Equal(t, message.PUBLISH, mtype)
+	require.Equal(t, len(buf), total)
+
+	svc.maxPacketSize = len(buf) - 1
+	_, _, err = svc.peekMessageSize()
+	require.Equal(t, ErrPacketTooLarge, err)
+}
+
+func TestGetConnectMessageTooLarge(t *testing.T) {
+	msg := newConnectMessage()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		writeMessage(client, msg)
+		client.Close()
+	}()
+
+	_, err := getConnectMessage(server, msg.Len()-1)
+	require.Equal(t, ErrPacketTooLarge, err)
+}
+
+func TestServerFlushInterval(t *testing.T) {
+	svr := &Server{FlushInterval: 20 * time.Millisecond}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, DefaultFlushBytes, svr.FlushBytes)
+
+	// The PINGRESPs are written together, but still each get there
+	for i := 0; i < 5; i++ {
+		require.NoError(t, writeMessage(conn, message.NewPingreqMessage()))
+	}
+
+	for i := 0; i < 5; i++ {
+		b, err := getMessageBuffer(conn, 0)
+		require.NoError(t, err)
+		require.Equal(t, byte(message.PINGRESP<<4), b[0])
+	}
+}
+
 func newTestBuffer(t *testing.T, msgBytes []byte) *service {
 	buf := bytes.NewBuffer(msgBytes)
 	svc := &service{}
@@ -15,21 +15,28 @@
 package service
 
 import (
+	"container/list"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"net/url"
+	"os"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
 	"github.com/surgemq/surgemq/auth"
+	"github.com/surgemq/surgemq/codec"
+	"github.com/surgemq/surgemq/logging"
 	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -37,6 +44,12 @@ var (
 	ErrInvalidSubscriber      error = errors.New("service: Invalid subscriber")
 	ErrBufferNotReady         error = errors.New("service: buffer is not ready")
 	ErrBufferInsufficientData error = errors.New("service: buffer has insufficient data.")
+	ErrTooManyConnections     error = errors.New("service: Too many connections")
+	ErrTooManyConnectionsIP   error = errors.New("service: Too many connections from the same IP")
+	ErrPacketTooLarge         error = codec.ErrPacketTooLarge
+	ErrTopicTooManyLevels     error = errors.New("service: Topic exceeds the maximum number of levels")
+	ErrTopicLevelTooLong      error = errors.New("service: Topic level exceeds the maximum length")
+	ErrInvalidProxyHeader     error = errors.New("service: Invalid PROXY protocol header")
 )
 
 const (
@@ -47,19 +60,62 @@ const (
 	DefaultSessionsProvider = "mem"
 	DefaultAuthenticator    = "mockSuccess"
 	DefaultTopicsProvider   = "mem"
+	DefaultMaxPacketSize    = defaultBufferSize
+	DefaultBufferSize       = defaultBufferSize
+	DefaultFlushBytes       = 4096
+	DefaultKeepAliveGrace   = 1.5
 )
 
+// The settings of the low memory profile. See UseLowMemoryProfile.
+const (
+	LowMemoryBufferSize    = 2 * defaultReadBlockSize
+	LowMemoryMaxGoroutines = 1500
+)
+
+// goroutinesPerConn is the number of goroutines each connection takes once it's
+// fully set up: the processor, the receiver and the sender.
+const goroutinesPerConn = 3
+
 // Server is a library implementation of the MQTT server that, as best it can, complies
 // with the MQTT 3.1 and 3.1.1 specs.
 type Server struct {
-	// The number of seconds to keep the connection live if there's no data.
-	// If not set then default to 5 mins.
+	// KeepAlive has no effect, the keepalive of each connection is the one in
+	// the client's CONNECT.
+	//
+	// Deprecated: Drop it. See AdviseKeepAlive for finding the clients that need
+	// a shorter keepalive.
 	KeepAlive int
 
 	// The number of seconds to wait for the CONNECT message before disconnecting.
 	// If not set then default to 2 seconds.
 	ConnectTimeout int
 
+	// HandshakeTimeout is how long a connection has from being accepted to being
+	// sent its CONNACK, including the PROXY protocol header, the TLS handshake,
+	// the CONNECT and authentication, however slowly the client trickles them
+	// in. Connections that aren't through by then are closed, and counted in
+	// Stats. If not set then default to DefaultHandshakeTimeout. A negative one
+	// leaves only ConnectTimeout.
+	HandshakeTimeout time.Duration
+
+	// MaxHandshakes is the maximum number of connections in their handshakes,
+	// from being accepted to being sent their CONNACK, at a time, so a flood of
+	// connections that never authenticate can't use up the file descriptors and
+	// goroutines of the server. The connections over it are closed as soon as
+	// they are accepted, without a CONNACK, and counted in Stats. If not set
+	// then there's no limit.
+	MaxHandshakes int
+
+	// AcceptRate is the maximum number of connections each listener accepts a
+	// second, with AcceptBurst of them at once. The others wait in the backlog
+	// of the system until they can be accepted. If not set then there's no
+	// limit.
+	AcceptRate float64
+
+	// AcceptBurst is the number of connections a listener can accept at once,
+	// over AcceptRate. If not set then default to AcceptRate, rounded up.
+	AcceptBurst int
+
 	// The number of seconds to wait for any ACK messages before failing.
 	// If not set then default to 20 seconds.
 	AckTimeout int
@@ -72,6 +128,20 @@ type Server struct {
 	// in the CONNECT message. If not set then default to "mockSuccess".
 	Authenticator string
 
+	// ListenerAuthenticators are the authenticators of the listeners that don't
+	// use Authenticator, by the address of the listener, e.g. "127.0.0.1:8883",
+	// ":8883" for a port on all the interfaces, or the path of a unix socket.
+	ListenerAuthenticators map[string]string
+
+	// Anonymous is what's done with the clients that connect without a
+	// username. If not set then they are authenticated like any other.
+	Anonymous AnonymousPolicy
+
+	// DefaultACL is what's done with the messages clients publish that no ACL,
+	// i.e. no PhaseAuth stage of the Pipeline, let through. If not set then they
+	// are delivered.
+	DefaultACL ACLPolicy
+
 	// SessionsProvider is the session store that keeps all the Session objects.
 	// This is the store to check if CleanSession is set to 0 in the CONNECT message.
 	// If not set then default to "mem".
@@ -81,10 +151,512 @@ type Server struct {
 	// If not set then default to "mem".
 	TopicsProvider string
 
+	// SafeMode makes the server start even if some of the persisted retained
+	// messages can't be read back. The TopicsProvider sets those records aside
+	// instead, and they are listed in the RecoveryReport. If not set then any
+	// unreadable record stops the server from starting.
+	SafeMode bool
+
+	// MaxPacketSize is the maximum size, in bytes, of any MQTT packet the server
+	// accepts. The size is checked against the fixed header before the packet is
+	// buffered, and the connection is closed if it's over the limit, since MQTT
+	// 3.1.1 has no way of telling the client why. If not set then default to the
+	// size of the incoming buffer, which is the largest packet the server can
+	// process anyway.
+	MaxPacketSize int
+
+	// Compliance is how strictly clients are held to the MQTT spec. In Strict mode,
+	// any violation the server detects gets the client disconnected, with the
+	// return code the spec asks for if there's one. That includes topics that
+	// aren't valid UTF-8, reserved flags set in the fixed header, QoS 3 and
+	// wildcards in PUBLISH topics. In Permissive mode, violations that can be
+	// worked around, such as a Will QoS without a will, a second CONNECT or
+	// reserved flags, are logged and fixed up or ignored, and the client carries
+	// on. If not set then default to Permissive.
+	Compliance ComplianceMode
+
+	// BufferSize is the size, in bytes, of each of the incoming and outgoing ring
+	// buffers every connection has. It must be a power of two, and at least 16KB.
+	// It's also the largest packet the server can process. If not set then
+	// default to 256KB.
+	//
+	// The buffers are most of the memory a connection uses. Roughly, each
+	// connection takes 2*BufferSize for the buffers, about 24KB of goroutine
+	// stacks, plus the session and its ack queues, which is a few KB until there
+	// are messages in flight. Packets that wrap around the end of a buffer are
+	// copied into scratch space from a pool shared by all the connections, see
+	// codec.BufferPoolStats.
+	BufferSize int
+
+	// OutBufferSize is the size, in bytes, of the outgoing ring buffer of every
+	// connection, if it's to be different from BufferSize, e.g. smaller when the
+	// clients are mostly publishers and get little sent to them. It must be a
+	// power of two, and at least 16KB. If not set then default to BufferSize.
+	OutBufferSize int
+
+	// BufferSizes returns the sizes of the incoming and outgoing buffers for the
+	// connection of the client connecting with req, in place of BufferSize and
+	// OutBufferSize, e.g. larger ones for the gateways fanning out to many
+	// devices. A size of 0 keeps the server's. The sizes are rounded up to a
+	// power of two and to at least 16KB, and a connection with a smaller incoming
+	// buffer than MaxPacketSize can't receive packets any larger than it.
+	BufferSizes func(req *message.ConnectMessage) (in, out int)
+
+	// FlushInterval is how long the sender of each connection waits for more
+	// packets once there's one to write, so a burst of small ones, such as the
+	// PUBACKs and PINGRESPs of a chatty client, or small PUBLISHes, goes out in a
+	// single write rather than one each. It stops waiting as soon as there are
+	// FlushBytes to write. Each packet can be held back by up to FlushInterval,
+	// so it's a trade of latency for fewer syscalls, and should be well under a
+	// millisecond or so for interactive clients. If not set then packets are
+	// written as soon as they are ready, along with any others that are ready by
+	// then.
+	FlushInterval time.Duration
+
+	// FlushBytes is the number of bytes the sender stops waiting for more packets
+	// at. It's only used with FlushInterval. If not set then default to 4KB.
+	FlushBytes int
+
+	// DisableRetained stops the server from keeping retained messages. Messages
+	// published with the RETAIN flag are delivered as usual, but never stored, so
+	// new subscribers don't get any. If not set then retained messages are kept by
+	// the TopicsProvider.
+	DisableRetained bool
+
+	// MaxRetainedPerSubscribe is the maximum number of retained messages sent to a
+	// client for each topic filter it subscribes to. It keeps a wildcard filter
+	// such as "#" from sending the client the whole store. Which of the matching
+	// messages are sent is up to the TopicsProvider. If not set then there's no
+	// limit.
+	MaxRetainedPerSubscribe int
+
+	// MaxRetainedPerClient is the maximum number of retained messages any one
+	// client ID can have set at a time. Once a client is at the limit, its
+	// messages to new retained topics are delivered as usual but not retained,
+	// until some of its retained messages are cleared or replaced by others.
+	// Messages published by the server itself, with no client ID, aren't
+	// counted. If not set then there's no limit.
+	MaxRetainedPerClient int
+
+	// MaxRetained and MaxRetainedBytes cap the number of retained messages, and
+	// the total size of their payloads, across all clients. A message that would
+	// go over either of them is dealt with as RetainedOverflow says. If not set
+	// then there's no limit.
+	MaxRetained      int
+	MaxRetainedBytes int64
+
+	// RetainedOverflow is what's done with the retained messages over MaxRetained
+	// or MaxRetainedBytes. If not set then default to RetainedReject.
+	RetainedOverflow RetainedOverflow
+
+	// MessageTTL is how long the messages published on each topic filter are
+	// kept for clients that aren't there to receive them. The first policy with
+	// a matching filter applies. Since MQTT 3.1.1 publishers can't set an expiry
+	// of their own, it applies to every message on the matching topics. It's the
+	// retained messages that are kept, not the offline queues, and they are
+	// cleared once they are older than the TTL. If not set then messages
+	// are kept until they are replaced or cleared.
+	MessageTTL []TTLPolicy
+
+	// MinClientIdLength and MaxClientIdLength are the shortest and longest
+	// client IDs, in bytes, the clients can connect with, other than the empty
+	// one the server assigns one to. The clients outside them are refused with
+	// the CONNACK return code ErrIdentifierRejected. If not set then there's no
+	// limit other than the spec's.
+	MinClientIdLength int
+	MaxClientIdLength int
+
+	// ClientIdCharset are the characters the client IDs can have, such as
+	// ClientIdCharsetSpec, with the clients whose IDs have any other refused
+	// like those outside MaxClientIdLength. If not set then any UTF-8 is.
+	ClientIdCharset string
+
+	// AssignClientId returns the client ID of a client connecting with username
+	// and an empty one, which the spec only allows with a clean session. It must
+	// be unique, as a client connecting with the ID of another takes over its
+	// connection. MQTT 3.1.1 has no way of telling the client its ID. If not set,
+	// or it returns "", then default to AssignedClientIdPrefix followed by a
+	// number.
+	AssignClientId func(username string) string
+
+	// AssignedClientIdPrefix is what the client IDs the server assigns start
+	// with. If not set then default to DefaultAssignedClientIdPrefix.
+	AssignedClientIdPrefix string
+
+	// TopicRewrite are the rules rewriting the topics clients publish and
+	// subscribe to. The first rule that matches a topic rewrites it. If not set
+	// then the topics are left as they are.
+	TopicRewrite []RewriteRule
+
+	// Tenancy is where the tenant of each client comes from. The topics the
+	// clients publish and subscribe to are put under TenantPrefix and their
+	// tenant, after TopicRewrite, so the tenants can't see each other's topics,
+	// even with wildcards, and the prefix is taken off again on the way out. The
+	// clients without a tenant are refused. Client IDs are still shared by all the
+	// tenants. If not set then default to TenancyOff.
+	Tenancy TenancyMode
+
+	// AutoSubscribe are the topic filters the clients are subscribed to as soon
+	// as they connect. If not set then the clients are only subscribed to what
+	// they subscribe to themselves.
+	AutoSubscribe []AutoSubscription
+
+	// History are the policies keeping the last messages published on each
+	// topic, for the subscribers to have replayed when they subscribe with
+	// ReplayPrefix. The first policy whose filter matches a topic is the one
+	// for it. If not set then no history is kept.
+	History []HistoryPolicy
+
+	// DeadLetterTopic is the topic the messages that couldn't be delivered are
+	// published to, wrapped in a DeadLetter, so the operators can audit what was
+	// lost: those dropped for slow consumers, the retained ones that expired and
+	// those an ACL denied. If not set then they are just dropped.
+	DeadLetterTopic string
+
+	// DeadLetterNoSubscribers dead letters the messages nobody is subscribed to
+	// as well, unless they are retained.
+	DeadLetterNoSubscribers bool
+
+	// MaxDelay is the longest a message published to DelayedPrefix can be delayed
+	// by. Those delayed by more are dropped. If not set then default to
+	// DefaultMaxDelay.
+	MaxDelay time.Duration
+
+	// MaxTopicLevels is the maximum number of levels, i.e. the number of "/"
+	// separated segments, in any topic or topic filter a client publishes or
+	// subscribes to. Subscriptions over the limit get a SUBACK return code of
+	// 0x80 (failure), and clients publishing over the limit are disconnected. If
+	// not set then there's no limit.
+	MaxTopicLevels int
+
+	// MaxTopicLevelLength is the maximum length, in bytes, of any single level in
+	// a topic or topic filter. It's enforced the same way as MaxTopicLevels. If
+	// not set then there's no limit.
+	MaxTopicLevelLength int
+
+	// ReadOnly makes the server a replica, serving subscribe-only clients such as
+	// dashboards and analytics consumers with the messages mirrored from another
+	// server, see Mirror, or published with Publish. The messages the clients
+	// publish are acknowledged, so they aren't sent again, but dropped, and their
+	// wills aren't published. The clients in Feeders are exempt.
+	ReadOnly bool
+
+	// Feeders are the client IDs allowed to publish to a ReadOnly server, i.e. the
+	// clients of the Mirror bridges of the servers it's a replica of. The batches
+	// sent by Mirror bridges are only unpacked when they come from Feeders.
+	Feeders []string
+
+	// ProxyProtocol makes the server expect every connection to start with a
+	// HAProxy PROXY protocol header, version 1 or 2, as sent by a TCP load
+	// balancer. The client address from the header is then used in place of the
+	// address of the load balancer for the connection limits, authentication and
+	// logging. Connections without a valid header are closed. If not set then
+	// connections are used as is.
+	ProxyProtocol bool
+
+	// UnixSocketMode is the file mode of the socket created when listening on a
+	// "unix://" URI. Only users that can write to the socket can connect, so it
+	// can be used to control access to the server. If not set then the mode is
+	// whatever the process umask gives.
+	UnixSocketMode os.FileMode
+
+	// MaxConnections is the maximum number of concurrent client connections the
+	// server accepts. Any connection over the limit is answered with a CONNACK
+	// of ErrServerUnavailable and closed. If not set then there's no limit.
+	MaxConnections int
+
+	// MaxConnectionsPerIP is the maximum number of concurrent client connections
+	// accepted from a single source IP. Any connection over the limit is answered
+	// with a CONNACK of ErrServerUnavailable and closed. If not set then there's
+	// no limit.
+	MaxConnectionsPerIP int
+
+	// Pipeline is the stages the messages published by clients go through before
+	// they are delivered to the subscribers and the bridges. If not set then the
+	// messages are delivered as they are published.
+	Pipeline *Pipeline
+
+	// Bridges forward the messages published by clients to other systems, after
+	// they are delivered to the subscribers. QoS 1 messages are only acknowledged
+	// once every bridge has accepted them. If not set then messages are only
+	// delivered to the subscribers.
+	Bridges []Bridge
+
+	// MaxGoroutines caps the number of goroutines the server runs for client
+	// connections, which is three for each connection. Connections that would go
+	// over it are refused the same way as over MaxConnections. The server's own
+	// goroutines, such as the listener and the timer wheels, aren't counted. If not
+	// set then there's no limit.
+	MaxGoroutines int
+
+	// AdviseKeepAlive makes the server watch how the connections of each client
+	// ID end, and how long the client takes to acknowledge QoS 1 messages, to
+	// suggest a shorter keepalive for the clients whose connections keep getting
+	// dropped while idle. See KeepAliveReports. If not set then nothing is
+	// tracked.
+	AdviseKeepAlive bool
+
+	// KeepAliveGrace is how many times its keepalive a client can stay silent
+	// for before it's disconnected. It can't be less than 1. If not set then
+	// default to DefaultKeepAliveGrace, the one and a half times of the MQTT
+	// spec.
+	KeepAliveGrace float64
+
+	// MaxKeepAlive is the longest keepalive, in seconds, the clients are held to.
+	// The clients that connect with a longer one, or none, are disconnected once
+	// they have been silent for longer than this one instead, the same as the
+	// Server Keep Alive of MQTT 5. MQTT 3.1.1 has no way of telling the clients
+	// in the CONNACK, so they have to be configured to ping at least as often.
+	// If not set then the clients keep their keepalives.
+	MaxKeepAlive int
+
+	// Tracer starts the OpenTelemetry spans of the server: one for handling each
+	// CONNECT, one for each message published, covering the pipeline and the
+	// hand-off to the bridges, with a child for the fan-out to the subscribers,
+	// and one for each ack cycle, from when the message was sent until it was
+	// acknowledged. The context of the publish span is passed on to the bridges
+	// that implement ContextBridge. If not set then nothing is traced.
+	Tracer trace.Tracer
+
+	// Features are the feature flags, turned on and off globally or for each
+	// tenant while the server is running, e.g. to roll out a new pipeline stage
+	// to a subset of the devices first. See Stage.Feature.
+	Features Features
+
+	// Tenant returns the tenant of the client cid, which the feature flags can be
+	// set for, e.g. from a prefix of the client ID. If not set then every client
+	// only follows the global flags.
+	Tenant func(cid string) string
+
+	// Components are started along with the server, after its own components and
+	// in dependency order, and stopped in the reverse order by Close. See Health
+	// for their status.
+	Components []Component
+
+	// OnServerStart is called once all the components are running, before the
+	// server takes any connection. If it fails, the components are stopped again,
+	// and the server doesn't start.
+	OnServerStart func(*Server) error
+
+	// OnServerStop is called by Close, once the clients are disconnected, before
+	// the components are stopped.
+	OnServerStop func(*Server)
+
+	// OnBanEvent is called with the audit events of the ban list: bans added and
+	// removed, and the clients refused because of them. See Ban. They are
+	// logged as well.
+	OnBanEvent func(BanEvent)
+
+	// FanoutOrder is the order the subscribers of each message are written to in.
+	// With FanoutLeastCongestedFirst, the clients that are keeping up get the
+	// popular topics first, and the congested ones last. If not set then default
+	// to FanoutInOrder.
+	FanoutOrder FanoutOrder
+
+	// FanoutWorkers is the number of workers delivering the messages the clients
+	// publish to the subscribers, so a slow subscriber doesn't hold up the
+	// publisher. Each client's messages go to one of the workers, picked by its
+	// client ID, and are delivered in order. If not set then the messages are
+	// delivered by the connection of the client that published them, before it
+	// reads the next one. Messages published with Publish are always delivered
+	// by the caller.
+	FanoutWorkers int
+
+	// FanoutQueue is the number of messages each fan-out worker holds. A client
+	// publishing to a worker whose queue is full is held up until there's room.
+	// If not set then default to DefaultFanoutQueue.
+	FanoutQueue int
+
+	// OrderedDelivery keeps the QoS 1 and 2 messages to each client in the order
+	// they were published on each topic through resends and reconnects. A
+	// client resuming its session gets the messages it hadn't acked sent again
+	// first, in the order they were first sent, then its offline queue, and only
+	// then what's been published since it connected, which is held back until
+	// then. Sending one of its messages again with RetryInflight sends the ones
+	// sent after it on the same topic again too. If not set then the messages
+	// it hadn't acked aren't sent again, and new messages may overtake the
+	// offline queue.
+	OrderedDelivery bool
+
+	// OverlappingSubscriptions is how a message is delivered to a client with
+	// more than one subscription matching it. If not set then default to
+	// OverlapDeliverOnce, as the MQTT spec says.
+	OverlappingSubscriptions OverlapPolicy
+
+	// MaxQoS is the highest QoS granted to the subscriptions of the clients,
+	// which are told so in the SUBACK, and sent the messages of a higher QoS at
+	// that one instead. The MaxQoS of the listener a client connects through,
+	// then UserMaxQoS, override it. If not set then there's no limit.
+	MaxQoS QoSLimit
+
+	// UserMaxQoS returns the MaxQoS of the clients connecting with username, or
+	// QoSUnlimited for that of their listener or the server.
+	UserMaxQoS func(username string) QoSLimit
+
+	// QoSUpgrade are the topic prefixes the QoS 0 messages published by the
+	// clients to are upgraded to QoS 1, so the subscribers ack them and they
+	// are kept for the offline sessions, for the messages that need to get
+	// there. The subscriptions granted QoS 0 still get them, at QoS 0.
+	QoSUpgrade []string
+
+	// SubscriptionOptions returns the MQTT 5 subscription options, such as
+	// topics.NoLocal, for the subscription of client cid to topic. MQTT 3.1.1
+	// clients can't ask for them in their SUBSCRIBE, so they are given here, e.g.
+	// NoLocal for the clients of another broker bridging to this one, so the
+	// messages they forward aren't sent back to them. If not set then the
+	// subscriptions of clients have no options.
+	SubscriptionOptions func(cid string, topic []byte) byte
+
+	// SubscriptionLimits returns the limits on what client cid, with username,
+	// can subscribe to, e.g. none for the admins and no root wildcards for
+	// everybody else. They aren't applied to AutoSubscribe. If not set then the
+	// clients can subscribe to anything.
+	SubscriptionLimits func(cid, username string) SubscriptionLimits
+
+	// OnSubscriptionRejected is called for each topic filter a client was
+	// refused because of its SubscriptionLimits.
+	OnSubscriptionRejected func(SubscriptionRejectedEvent)
+
+	// MaxInflight is the most QoS 1 and 2 messages sent to a client, each, that
+	// can wait for their acks. Once a client has that many, the oldest is
+	// evicted for each new one, and dead lettered. If not set then there's no
+	// limit, and the memory of a client that doesn't ack grows without bound.
+	MaxInflight int
+
+	// InflightExpiry is how long a message sent to a client waits for its ack
+	// before it's given up on. If not set then it waits as long as the session
+	// lasts.
+	InflightExpiry time.Duration
+
+	// Quota returns the publish quota of client cid, e.g. from its plan. It's
+	// called for every message the client publishes, so it has to be quick. The
+	// usage is counted per client ID, starting afresh at the top of every hour
+	// and day in UTC, and persisted when the client disconnects and the server
+	// stops if the SessionsProvider implements sessions.QuotaStore. If not set
+	// then the clients have no quotas.
+	Quota func(cid string) Quota
+
+	// QuotaPolicy is what's done with the messages over quota. If not set then
+	// default to QuotaReject.
+	QuotaPolicy QuotaPolicy
+
+	// QuotaThrottleDelay is how long a client is held up for each message over
+	// quota with QuotaThrottle. If not set then default to
+	// DefaultQuotaThrottleDelay.
+	QuotaThrottleDelay time.Duration
+
+	// SlowConsumerPolicy is what's done with the messages to a client whose
+	// outgoing buffer has had no room for them for SlowConsumerDelay, until it
+	// has room again. If not set then default to SlowConsumerBlock.
+	SlowConsumerPolicy SlowConsumerPolicy
+
+	// SlowConsumerDelay is how long a client's outgoing buffer has to stay full
+	// for it to be a slow consumer. If not set then default to
+	// DefaultSlowConsumerDelay.
+	SlowConsumerDelay time.Duration
+
+	// ConnectionEvents publishes a ConnectionEvent to ConnectedTopic when a client
+	// connects, and to DisconnectedTopic when it disconnects, so other systems
+	// can keep track of which clients are online without polling. They aren't
+	// retained, and are published for the clients of all the tenants. If not set
+	// then there are no connection events.
+	ConnectionEvents bool
+
+	// OfflineQueue is the number of QoS 1 and 2 messages kept in memory for
+	// each disconnected client with a persistent session, which it gets once it
+	// connects again. The ones after them spill to disk, if OfflineQueueDir is
+	// set, and are dropped otherwise. If neither is set then there are no
+	// offline queues, and the clients only get what's retained.
+	OfflineQueue int
+
+	// OfflineQueueDir is the directory the offline queues spill to, in segment
+	// files under a directory for each client. What's left in it when the server
+	// stops is picked up again when it starts. If not set then nothing spills.
+	OfflineQueueDir string
+
+	// OfflineDiskBudget is the most bytes the offline queues can take up on disk
+	// between them. The messages that would go over it are dropped, and dead
+	// lettered. If not set then there's no limit.
+	OfflineDiskBudget int64
+
+	// SessionExpiry is how long the persistent session of a client is kept once
+	// it disconnects. It's deleted if the client hasn't connected again by then,
+	// along with its offline queue. If not set then sessions never expire.
+	SessionExpiry time.Duration
+
+	// WAL is the directory of the write-ahead log of the QoS 1 and 2 messages the
+	// clients publish. Each is written to it before it's acked with a PUBACK or
+	// PUBREC, and the ones acked but not yet handed to the subscribers when the
+	// server goes down are published again when it starts. If not set then
+	// there's no WAL, and the messages are acked as soon as they arrive.
+	WAL string
+
+	// WALSync is when the WAL is synced to disk, and so how durable the acked
+	// messages are. If not set then default to WALSyncGroup.
+	WALSync WALSyncPolicy
+
+	// WALGroupCommit is how long the records of a group commit wait for others
+	// to join them with WALSyncGroup. If not set then default to
+	// DefaultWALGroupCommit.
+	WALGroupCommit time.Duration
+
+	// OnSlowConsumer is called when a client becomes a slow consumer, and when
+	// it catches up again. It's called while publishing to the client, so it has
+	// to return quickly.
+	OnSlowConsumer func(SlowConsumerEvent)
+
+	// EventLoop parks the connections that have been idle for EventLoopIdle: their
+	// goroutines stop and their buffers are let go of, and a single event loop
+	// watches all of them instead, until there's something to read from or
+	// write to one of them. It lets a server hold many more mostly idle
+	// connections, such as those of sensors that publish every few minutes.
+	// Only plain TCP and Unix socket connections are parked. It's only
+	// supported on Linux, with epoll. Elsewhere the connections stay on their
+	// goroutines, as they are if not set.
+	EventLoop bool
+
+	// EventLoopIdle is how long a connection has to be idle before it's parked on
+	// the event loop. If not set then default to DefaultEventLoopIdle.
+	EventLoopIdle time.Duration
+
+	// MemoryBudget is how many bytes the server may hold in the buffers of the
+	// connections and the payloads of the retained messages, in total. Once it's
+	// over the budget, new connections are refused with ErrServerUnavailable,
+	// new retained messages are delivered but not kept, and the messages
+	// clients publish are dealt with as MemoryPolicy says, until it's back
+	// under. See MemoryStats for where it stands. If not set then there's no
+	// budget.
+	MemoryBudget int64
+
+	// MemoryPolicy is what's done with the messages clients publish while the
+	// server is over its MemoryBudget. If not set then default to MemoryPause.
+	MemoryPolicy MemoryPolicy
+
+	// DetectProbes makes the server tell the health check probes of load
+	// balancers, which connect and hang up without sending anything, or send
+	// something other than a CONNECT, from clients. Probes are closed without a
+	// CONNACK, logging or an error on the connect span, and are counted by Probes
+	// rather than as accepted connections. If not set then they are handled like
+	// any other connection that fails to connect.
+	DetectProbes bool
+
+	// ProbeGrace is how long a new connection has to send its first byte before
+	// it's closed as a probe, if shorter than ConnectTimeout. Only used with
+	// DetectProbes. If not set then connections have the whole ConnectTimeout.
+	ProbeGrace time.Duration
+
+	// Logger is where the server logs to. What each connection logs carries its
+	// client ID and remote address as fields. If not set then default to logging
+	// with glog, see the logging package for adapters to other loggers.
+	Logger logging.Logger
+
 	// authMgr is the authentication manager that we are going to use for authenticating
 	// incoming connections
 	authMgr *auth.Manager
 
+	// authMgrs are the authentication managers of the ListenerAuthenticators
+	authMgrs map[string]*auth.Manager
+
 	// sessMgr is the sessions manager for keeping track of the sessions
 	sessMgr *sessions.Manager
 
@@ -97,59 +669,267 @@ type Server struct {
 
 	ln net.Listener
 
+	// The listener's socket, before it's wrapped in TLS, for Upgrade to hand over
+	sock net.Listener
+
+	// The listeners added with AddListener, by name
+	listeners map[string]*listener
+
 	// A list of services created by the server. We keep track of them so we can
 	// gracefully shut them down if they are still alive when the server goes down.
 	svcs []*service
 
-	// Mutex for updating svcs
+	// Mutex for updating svcs, clients, and the quit channel and listeners
 	mu sync.Mutex
 
+	// The services of all the connected clients, keyed by client ID. It's used to
+	// take over the session when a client connects again with the same ID.
+	clients map[string]*service
+
 	// A indicator on whether this server is running
 	running int32
 
 	// A indicator on whether this server has already checked configuration
 	configOnce sync.Once
 
-	subs []interface{}
-	qoss []byte
+	// The components started along with the server, its own and the Components
+	comps components
+
+	// The bans in force, and the mutex for them
+	bmu  sync.RWMutex
+	bans map[banKey]sessions.Ban
+
+	// The timer wheels shared by all the client connections, for the keepalive
+	timers timerWheels
+
+	// What was recovered from the providers when the configuration was checked
+	report *RecoveryReport
+
+	// Mutex for updating the connection counters below
+	cmu sync.Mutex
+
+	// The number of connections currently open, in total and per source IP
+	conns   int
+	ipconns map[string]int
+
+	// The number of connections rejected because of MaxConnections and
+	// MaxConnectionsPerIP respectively
+	rejectedMax int64
+	rejectedIP  int64
+
+	// The subscribers of Events, how many there are, and the number of events
+	// dropped for them not keeping up
+	emu           sync.RWMutex
+	eventSubs     map[*eventSub]struct{}
+	eventSubCount int32
+	eventsDropped int64
+
+	// The number of connections the listeners dropped for their allow and deny
+	// lists, see ListenerConfig.Allow
+	ipDropped int64
+
+	// The number of connections accepted, and what the ones that have since
+	// closed received and sent, for Stats
+	accepted  int64
+	closedIn  stat
+	closedOut stat
+
+	// The number of connections closed as load balancer probes, and of those
+	// that timed out before they were through the handshake
+	probes            int64
+	handshakeTimeouts int64
+
+	// The number of connections in their handshakes now, of those closed for
+	// MaxHandshakes, and of the times an accept loop waited for AcceptRate
+	handshaking        int64
+	handshakesRejected int64
+	acceptsPaced       int64
+
+	// The number of times clients became slow consumers, and of the messages
+	// dropped for them
+	slowConsumers int64
+	slowDropped   int64
+
+	// The number of messages sent to clients given up on before they were acked,
+	// for MaxInflight and InflightExpiry
+	inflightEvicted int64
+	inflightExpired int64
+
+	// The event loop idle connections are parked on, if EventLoop is set, and
+	// the number of them parked on it
+	loop   poller
+	parked int64
+
+	// The size of the buffers of the connections, and the number of connections
+	// refused, and messages held up and dropped, for being over MemoryBudget
+	membuf     int64
+	memRefused int64
+	memPaused  int64
+	memDropped int64
+
+	// The services behind their onPublish functions, for Publish to track the
+	// deliveries to them
+	smu         sync.RWMutex
+	subscribers map[*OnPublishFunc]*service
+
+	// Who set each retained message last, keyed by topic, and what each of them
+	// has set
+	rmu        sync.Mutex
+	retainedBy map[string]string
+	owners     map[string]*retainedOwner
+
+	// The timers clearing the retained messages with a TTL, keyed by topic
+	expiries map[string]*expiry
+
+	// The retained messages, the least recently set first, their entries keyed
+	// by topic, and the total size of their payloads, for MaxRetained and
+	// MaxRetainedBytes, along with the number of messages evicted and rejected
+	rlru      *list.List
+	rindex    map[string]*list.Element
+	rbytes    int64
+	revicted  int64
+	rrejected int64
+
+	// The deprecated settings in use when the server started
+	deprecations []Deprecation
+
+	// The quota usage of the clients, keyed by client ID, and the number of
+	// messages published over quota
+	qmu       sync.Mutex
+	quotas    map[string]*sessions.QuotaUsage
+	qexceeded int64
+
+	// When the clients were last seen, keyed by client ID
+	pmu      sync.Mutex
+	presence map[string]*sessions.Presence
+
+	// The leases of the subscribers subscribed with SubscribeLease
+	lmu    sync.Mutex
+	leases map[*OnPublishFunc]*lease
+
+	// The history of the topics with a History policy, keyed by topic, and the
+	// number of messages recorded
+	hmu     sync.Mutex
+	history map[string][]historyEntry
+	hseq    uint64
+
+	// The delayed messages held, keyed by ID
+	dmu     sync.Mutex
+	delayed map[string]*delayed
+
+	// The queues of the disconnected clients with persistent sessions, keyed by
+	// client ID, the bytes they take up on disk, the number of messages spilled
+	// to disk and dropped for being over OfflineDiskBudget, and the number of
+	// sessions expired
+	omu             sync.Mutex
+	offline         map[string]*offlineQueue
+	offlineBytes    int64
+	offlineSpilled  int64
+	offlineDropped  int64
+	sessionsExpired int64
+
+	// The write-ahead log, if WAL is set, and the number of messages published
+	// again from it when the server started
+	wal         *wal
+	walReplayed int64
+
+	// The fan-out workers, if FanoutWorkers is set, and the number of times a
+	// client was held up by a full queue
+	workers       *fanoutPool
+	fanoutBlocked int64
+
+	// The ID of the last message handed to the bridges. It starts from the time
+	// the server started, so the IDs keep going up across restarts.
+	msgid uint64
+
+	// What's been seen of the connections of each client ID, for AdviseKeepAlive
+	kmu       sync.Mutex
+	kareports map[string]*KeepAliveReport
 }
 
 // ListenAndServe listents to connections on the URI requested, and handles any
 // incoming MQTT client sessions. It should not return until Close() is called
 // or if there's some critical error that stops the server from running. The URI
 // supplied should be of the form "protocol://host:port" that can be parsed by
-// url.Parse(). For example, an URI could be "tcp://0.0.0.0:1883".
+// url.Parse(). For example, an URI could be "tcp://0.0.0.0:1883". Unix domain
+// sockets are of the form "unix:///path/to/socket".
 func (this *Server) ListenAndServe(uri string) error {
+	return this.listenAndServe(uri, nil)
+}
+
+// ListenAndServeTLS is the same as ListenAndServe, but every connection is
+// wrapped in TLS using the supplied configuration.
+func (this *Server) ListenAndServeTLS(uri string, cfg *tls.Config) error {
+	return this.listenAndServe(uri, cfg)
+}
+
+func (this *Server) listenAndServe(uri string, cfg *tls.Config) error {
+	ln, err := this.listen(uri)
+	if err != nil {
+		return err
+	}
+
+	if cfg != nil {
+		return this.serve(tls.NewListener(ln, cfg), ln)
+	}
+
+	return this.serve(ln, ln)
+}
+
+// Serve accepts connections on the supplied listener and handles any incoming
+// MQTT client sessions, the same way ListenAndServe does. It's for listeners the
+// server can't create itself, such as other transports or listeners handed over
+// by a process manager. The listener is closed when Serve returns.
+func (this *Server) Serve(ln net.Listener) error {
+	return this.serve(ln, ln)
+}
+
+// serve accepts connections on ln. sock is the listener's socket before it was
+// wrapped, e.g., in TLS, which is what's handed over by Upgrade.
+func (this *Server) serve(ln, sock net.Listener) error {
+	defer ln.Close()
+
 	defer atomic.CompareAndSwapInt32(&this.running, 1, 0)
 
 	if !atomic.CompareAndSwapInt32(&this.running, 0, 1) {
 		return fmt.Errorf("server/ListenAndServe: Server is already running")
 	}
 
-	this.quit = make(chan struct{})
+	quit := make(chan struct{})
 
-	u, err := url.Parse(uri)
-	if err != nil {
-		return err
-	}
+	this.mu.Lock()
+	this.quit = quit
+	this.ln = ln
+	this.sock = sock
+	this.mu.Unlock()
 
-	this.ln, err = net.Listen(u.Scheme, u.Host)
-	if err != nil {
+	// Check the configuration now, rather than on the first connection, so that
+	// any problem with the providers stops the server from starting.
+	if err := this.checkConfiguration(); err != nil {
 		return err
 	}
-	defer this.ln.Close()
 
-	glog.Infof("server/ListenAndServe: server is ready...")
+	this.logger().Info("server/ListenAndServe: server is ready...")
 
+	return this.acceptLoop(ln, quit, func(conn net.Conn) {
+		go this.handleConnection(conn)
+	})
+}
+
+// acceptLoop accepts connections on ln and hands them to handle, until quit is
+// closed, or there's an error accepting that isn't temporary.
+func (this *Server) acceptLoop(ln net.Listener, quit chan struct{}, handle func(net.Conn)) error {
 	var tempDelay time.Duration // how long to sleep on accept failure
 
+	ln = this.limited(ln, quit)
+
 	for {
-		conn, err := this.ln.Accept()
+		conn, err := ln.Accept()
 
 		if err != nil {
 			// http://zhen.org/blog/graceful-shutdown-of-go-net-dot-listeners/
 			select {
-			case <-this.quit:
+			case <-quit:
 				return nil
 
 			default:
@@ -165,141 +945,383 @@ func (this *Server) ListenAndServe(uri string) error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				glog.Errorf("server/ListenAndServe: Accept error: %v; retrying in %v", err, tempDelay)
+				this.logger().Error("server/ListenAndServe: Accept error, retrying", logging.Err(err), logging.F("delay", tempDelay))
 				time.Sleep(tempDelay)
 				continue
 			}
 			return err
 		}
 
-		go this.handleConnection(conn)
+		handle(conn)
 	}
 }
 
-func (this *Server) ListenAndServeTLS(uri string, cfg *tls.Config) error {
-	defer atomic.CompareAndSwapInt32(&this.running, 1, 0)
-
-	if !atomic.CompareAndSwapInt32(&this.running, 0, 1) {
-		return fmt.Errorf("server/ListenAndServe: Server is already running")
+// Publish publishes a message from inside the process, such as from an embedding
+// application, a gateway or a bridge. It's retained if the RETAIN flag is set and
+// delivered to all the matching subscribers.
+//
+// If opts has a ClientId, the message is published as if that client had
+// published it: it goes through the Pipeline, and is handed to the Bridges, and
+// for QoS 1 and 2 messages Publish returns the error of the first bridge that
+// failed. Messages larger than MaxPacketSize are then rejected with
+// ErrPacketTooLarge, the same as they would be from a client. Otherwise the
+// message is delivered as is, which is what bridges bringing messages in from
+// other systems want, so they don't go back out again.
+//
+// The returned Completion tracks the delivery of QoS 1 and 2 messages to the
+// clients with persistent sessions, which is done once they have all
+// acknowledged the message.
+func (this *Server) Publish(msg *message.PublishMessage, opts *PublishOptions) (*Completion, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return nil, err
 	}
 
-	this.quit = make(chan struct{})
+	return this.publish(msg, opts)
+}
 
-	u, err := url.Parse(uri)
-	if err != nil {
-		return err
+// publish is Publish once the configuration has been checked, for the
+// components publishing as they start.
+func (this *Server) publish(msg *message.PublishMessage, opts *PublishOptions) (*Completion, error) {
+	if opts == nil {
+		opts = &PublishOptions{}
 	}
 
-	this.ln, err = tls.Listen(u.Scheme, u.Host, cfg)
-	if err != nil {
-		fmt.Println(err)
-		return err
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
 	}
-	defer this.ln.Close()
 
-	glog.Infof("server/ListenAndServe: server is ready...")
+	ctx, span := this.tracer().Start(ctx, spanPublish, publishAttributes(opts.ClientId, msg))
+	defer span.End()
 
-	var tempDelay time.Duration // how long to sleep on accept failure
+	c := newCompletion()
+	defer c.complete(nil)
 
-	for {
-		conn, err := this.ln.Accept()
+	var errc chan error
 
-		if err != nil {
-			// http://zhen.org/blog/graceful-shutdown-of-go-net-dot-listeners/
-			select {
-			case <-this.quit:
-				return nil
+	if opts.ClientId != "" {
+		if msg.Len() > this.MaxPacketSize {
+			return nil, ErrPacketTooLarge
+		}
 
-			default:
+		out, denied := this.Pipeline.processACL(this.logger(), opts.ClientId, msg, opts.BypassACL, this.DefaultACL, func(f Feature) bool {
+			return this.FeatureEnabled(opts.ClientId, f)
+		})
+		if out == nil {
+			if denied {
+				this.deadLetter(DeadLetter{Reason: DeadLetterDenied, ClientId: opts.ClientId}, msg)
 			}
+			return c, nil
+		}
+		msg = out
 
-			// Borrowed from go1.3.3/src/pkg/net/http/server.go:1699
-			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
+		errc = make(chan error, 1)
+		forward(ctx, this.Bridges, this.nextMessageID(), opts.ClientId, msg, func(err error) {
+			errc <- err
+		})
+	}
+
+	if msg.Retain() && !this.DisableRetained {
+		this.retainAs(opts.ClientId, msg)
+	}
+
+	this.record(msg)
+
+	// Publish can be called from any goroutine, e.g., by a gateway and a bridge at
+	// the same time, so unlike the services it can't reuse the subscribers list.
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	if err := this.lookupSubscribers(this.topicsMgr, msg, &subs, &qoss); err != nil {
+		return nil, err
+	}
+
+	if len(subs) == 0 && !msg.Retain() && this.DeadLetterNoSubscribers {
+		this.deadLetter(DeadLetter{Reason: DeadLetterNoSubscribers, ClientId: opts.ClientId}, msg)
+	}
+
+	// The subscribers get the message without the RETAIN flag. It's the caller's
+	// message, so they get a copy.
+	retained := msg.Retain()
+	if retained {
+		msg = withoutRetain(msg)
+	}
+
+	f := &fanout{server: this, msg: msg, cid: opts.ClientId, retained: retained}
+	defer f.done()
+
+	_, fspan := this.tracer().Start(ctx, spanFanout, trace.WithAttributes(attribute.Int("mqtt.subscribers", len(subs))))
+
+	//glog.Debugf("(server) Publishing to topic %q and %d subscribers", string(msg.Topic()), len(subs))
+	for i, s := range subs {
+		if s != nil {
+			fn, ok := s.(*OnPublishFunc)
+			if !ok {
+				this.logger().Error("server/Publish: Invalid onPublish Function")
+			} else if svc := this.persistent(fn, msg); svc != nil && f.service(fn) != nil {
+				if f.skip(svc, qoss[i]) {
+					continue
 				}
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
+
+				c.add()
+				if err := svc.publishShared(f.serviceMsg(), f.shared, f.retain(qoss[i]), c); err != nil {
+					if err != ErrSlowConsumer {
+						svc.logger().Error("server/Publish: Error publishing message", logging.Err(err))
+					}
+					c.complete(err)
 				}
-				glog.Errorf("server/ListenAndServe: Accept error: %v; retrying in %v", err, tempDelay)
-				time.Sleep(tempDelay)
-				continue
+			} else {
+				f.deliver(fn, qoss[i])
 			}
-			return err
 		}
+	}
 
-		go this.handleConnection(conn)
+	fspan.End()
+
+	if errc != nil && msg.QoS() != message.QosAtMostOnce {
+		if err := <-errc; err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return c, err
+		}
 	}
+
+	return c, nil
 }
 
-// Publish sends a single MQTT PUBLISH message to the server. On completion, the
-// supplied OnCompleteFunc is called. For QOS 0 messages, onComplete is called
-// immediately after the message is sent to the outgoing buffer. For QOS 1 messages,
-// onComplete is called when PUBACK is received. For QOS 2 messages, onComplete is
-// called after the PUBCOMP message is received.
-func (this *Server) Publish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
+// Subscribe subscribes onPublish, on behalf of something inside the process such
+// as a gateway or a bridge, to the topic filter. onPublish is called for every
+// message published on a matching topic, and the same pointer must be used to
+// Unsubscribe. It returns the QoS granted. Retained messages are not delivered,
+// they can be fetched with Retained once the subscriber is ready for them. qos
+// can carry subscription options, such as topics.RetainAsPublished.
+func (this *Server) Subscribe(topic []byte, qos byte, onPublish *OnPublishFunc) (byte, error) {
 	if err := this.checkConfiguration(); err != nil {
-		return err
+		return message.QosFailure, err
 	}
 
-	if msg.Retain() {
-		if err := this.topicsMgr.Retain(msg); err != nil {
-			glog.Errorf("Error retaining message: %v", err)
-		}
+	return this.topicsMgr.Subscribe(topic, qos, onPublish)
+}
+
+// Retained returns the retained messages matching the topic filter. The messages
+// are copies with the RETAIN flag set, as they would be sent to a new subscriber.
+func (this *Server) Retained(topic []byte) ([]*message.PublishMessage, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return nil, err
+	}
+
+	var rmsgs []*message.PublishMessage
+
+	if err := this.topicsMgr.Retained(topic, &rmsgs); err != nil {
+		return nil, err
+	}
+
+	msgs := make([]*message.PublishMessage, 0, len(rmsgs))
+
+	for _, rm := range rmsgs {
+		msg := message.NewPublishMessage()
+		msg.SetTopic(rm.Topic())
+		msg.SetPayload(rm.Payload())
+		msg.SetQoS(rm.QoS())
+		msg.SetRetain(true)
+
+		msgs = append(msgs, msg)
 	}
 
-	if err := this.topicsMgr.Subscribers(msg.Topic(), msg.QoS(), &this.subs, &this.qoss); err != nil {
+	return msgs, nil
+}
+
+// Unsubscribe removes a subscription made with Subscribe or SubscribeLease.
+func (this *Server) Unsubscribe(topic []byte, onPublish *OnPublishFunc) error {
+	if err := this.checkConfiguration(); err != nil {
 		return err
 	}
 
-	msg.SetRetain(false)
+	this.unlease(topic, onPublish)
 
-	//glog.Debugf("(server) Publishing to topic %q and %d subscribers", string(msg.Topic()), len(this.subs))
-	for _, s := range this.subs {
-		if s != nil {
-			fn, ok := s.(*OnPublishFunc)
-			if !ok {
-				glog.Errorf("Invalid onPublish Function")
-			} else {
-				(*fn)(msg)
-			}
-		}
+	return this.topicsMgr.Unsubscribe(topic, onPublish)
+}
+
+// TopicStats returns the shape of the subscription tree, with up to widest of the
+// nodes with the most next levels. It returns topics.ErrInspectNotSupported if
+// the topics provider can't report it.
+func (this *Server) TopicStats(widest int) (*topics.TreeStats, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return nil, err
 	}
 
-	return nil
+	return this.topicsMgr.Stats(widest)
+}
+
+// TopicTree renders the subscription subtree under the topic filter prefix, up to
+// depth levels deep and width next levels per node. An empty prefix is the whole
+// tree.
+func (this *Server) TopicTree(prefix string, depth, width int) (*topics.TreeNode, error) {
+	if err := this.checkConfiguration(); err != nil {
+		return nil, err
+	}
+
+	return this.topicsMgr.Tree(prefix, depth, width)
+}
+
+// UseLowMemoryProfile sets the server up to run in 64-128MB alongside other
+// workloads, e.g., on an ARM gateway. Connections get the smallest buffers, which
+// also limits packets to 16KB, no retained messages are kept, and there's a cap of
+// 500 connections. At roughly 80KB a connection, that keeps the server well
+// under 64MB. BufferSize and MaxGoroutines are only changed if they are not set
+// already, so they can still be tuned.
+func (this *Server) UseLowMemoryProfile() {
+	if this.BufferSize == 0 {
+		this.BufferSize = LowMemoryBufferSize
+	}
+
+	if this.MaxGoroutines == 0 {
+		this.MaxGoroutines = LowMemoryMaxGoroutines
+	}
+
+	this.DisableRetained = true
 }
 
 // Close terminates the server by shutting down all the client connections and closing
 // the listener. It will, as best it can, clean up after itself.
 func (this *Server) Close() error {
-	// By closing the quit channel, we are telling the server to stop accepting new
-	// connection.
-	close(this.quit)
+	// A server that's only used in process, e.g., by a gateway, never listens.
+	// One that's been upgraded has already stopped listening.
+	this.mu.Lock()
+	if this.quit != nil {
+		select {
+		case <-this.quit:
+		default:
+			// By closing the quit channel, we are telling the server to stop accepting new
+			// connection.
+			close(this.quit)
+
+			// We then close the net.Listener, which will force Accept() to return if it's
+			// blocked waiting for new connections.
+			this.ln.Close()
+		}
+	}
+	this.mu.Unlock()
 
-	// We then close the net.Listener, which will force Accept() to return if it's
-	// blocked waiting for new connections.
-	this.ln.Close()
+	this.stopListeners()
 
-	for _, svc := range this.svcs {
-		glog.Infof("Stopping service %d", svc.id)
-		svc.stop()
+	this.mu.Lock()
+	svcs := make([]*service, 0, len(this.clients))
+	for _, svc := range this.clients {
+		svcs = append(svcs, svc)
 	}
+	this.mu.Unlock()
 
-	if this.sessMgr != nil {
-		this.sessMgr.Close()
+	for _, svc := range svcs {
+		svc.logger().Info("server/Close: Stopping service")
+		svc.stopWith(DisconnectServerShutdown)
 	}
 
-	if this.topicsMgr != nil {
-		this.topicsMgr.Close()
+	if this.timers != nil {
+		this.timers.Stop()
+	}
+
+	if this.comps.running() {
+		if this.OnServerStop != nil {
+			this.OnServerStop(this)
+		}
+
+		this.comps.stop(this.logger())
 	}
 
 	return nil
 }
 
+// builtinComponents are the components the server has of its own.
+func (this *Server) builtinComponents() []Component {
+	return []Component{
+		{
+			Name:  ComponentAuth,
+			Start: this.newAuthManagers,
+		},
+		{
+			Name: ComponentSessions,
+			Start: func() (err error) {
+				this.sessMgr, err = sessions.NewManager(this.SessionsProvider)
+				return err
+			},
+			Stop: func() error {
+				return this.sessMgr.Close()
+			},
+		},
+		{
+			Name: ComponentTopics,
+			Start: func() (err error) {
+				this.topicsMgr, err = topics.NewManager(this.TopicsProvider)
+				return err
+			},
+			Stop: func() error {
+				return this.topicsMgr.Close()
+			},
+		},
+		{
+			Name:      ComponentRecovery,
+			DependsOn: []string{ComponentSessions, ComponentTopics},
+			Start:     this.recover,
+		},
+		{
+			Name:      ComponentBans,
+			DependsOn: []string{ComponentSessions},
+			Start:     this.loadBans,
+		},
+		{
+			Name:      ComponentQuotas,
+			DependsOn: []string{ComponentSessions},
+			Start:     this.loadQuotas,
+			Stop:      this.saveQuotas,
+		},
+		{
+			Name:      ComponentPresence,
+			DependsOn: []string{ComponentSessions},
+			Start:     this.loadPresence,
+		},
+		{
+			Name:      ComponentDelayed,
+			DependsOn: []string{ComponentSessions, ComponentTopics},
+			Start:     this.loadDelayed,
+			Stop:      this.stopDelayed,
+		},
+		{
+			Name:      ComponentOffline,
+			DependsOn: []string{ComponentRecovery},
+			Start:     this.loadOffline,
+			Stop:      this.stopOffline,
+		},
+		{
+			Name:      ComponentWAL,
+			DependsOn: []string{ComponentRecovery, ComponentOffline},
+			Start:     this.loadWAL,
+			Stop:      this.stopWAL,
+		},
+		{
+			Name:      ComponentFanout,
+			DependsOn: []string{ComponentTopics, ComponentWAL},
+			Start:     this.startFanout,
+			Stop:      this.stopFanout,
+		},
+		{
+			Name:  ComponentEventLoop,
+			Start: this.startEventLoop,
+			Stop:  this.stopEventLoop,
+		},
+	}
+}
+
 // HandleConnection is for the broker to handle an incoming connection from a client
-func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
+func (this *Server) handleConnection(c io.Closer) (*service, error) {
+	return this.serveConn(c, nil)
+}
+
+// serveConn handles an incoming connection from a client through l, one of the
+// listeners added with AddListener, or nil for the listener of Serve.
+func (this *Server) serveConn(c io.Closer, l *listener) (svc *service, err error) {
 	if c == nil {
 		return nil, ErrInvalidConnectionType
 	}
@@ -315,11 +1337,79 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		return nil, err
 	}
 
+	_, span := this.tracer().Start(context.Background(), spanConnect, trace.WithSpanKind(trace.SpanKindServer))
+	defer func() {
+		// Probes are part of normal operation, not failed connections
+		if err == ErrProbe {
+			span.SetAttributes(attribute.Bool("mqtt.probe", true))
+			endSpan(span, nil)
+			return
+		}
+
+		endSpan(span, err)
+	}()
+
 	conn, ok := c.(net.Conn)
 	if !ok {
 		return nil, ErrInvalidConnectionType
 	}
 
+	endHandshake, err := this.startHandshake(conn)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if herr := endHandshake(); herr != nil {
+			err = herr
+		}
+	}()
+
+	// The PROXY protocol header comes before anything else, and it tells us
+	// who the client really is.
+	if this.ProxyProtocol {
+		p := newProbeConn(conn, 0, time.Time{})
+
+		pconn, err := readProxyHeader(p, time.Second*time.Duration(this.ConnectTimeout))
+		if this.isProbe(p, err) {
+			return nil, ErrProbe
+		}
+		if err != nil {
+			this.logger().Error("server/handleConnection: Error reading PROXY protocol header", logging.F("remote_addr", conn.RemoteAddr().String()), logging.Err(err))
+			return nil, err
+		}
+
+		conn = pconn
+	}
+
+	// Make sure we are within the connection limits before doing any more work.
+	// If not, tell the client the server is unavailable and hang up.
+	release, err := this.acquireConn(conn)
+	if err != nil {
+		this.rejectConnection(conn, message.ErrServerUnavailable)
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			release()
+		}
+	}()
+
+	// The listener may have a limit of its own
+	if l != nil {
+		lrelease, lerr := l.acquireConn()
+		if lerr != nil {
+			this.rejectConnection(conn, message.ErrServerUnavailable)
+			return nil, lerr
+		}
+
+		srelease := release
+		release = func() {
+			srelease()
+			lrelease()
+		}
+	}
+
 	// To establish a connection, we must
 	// 1. Read and decode the message.ConnectMessage from the wire
 	// 2. If no decoding errors, then authenticate using username and password.
@@ -333,11 +1423,14 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 	// a CONNACK error. If it's CONNACK error, send the proper CONNACK error back
 	// to client. Exit regardless of error type.
 
-	conn.SetReadDeadline(time.Now().Add(time.Second * time.Duration(this.ConnectTimeout)))
+	p := newProbeConn(conn, this.ProbeGrace, time.Now().Add(time.Second*time.Duration(this.ConnectTimeout)))
 
 	resp := message.NewConnackMessage()
 
-	req, err := getConnectMessage(conn)
+	req, err := getConnectMessage(p, this.MaxPacketSize)
+	if this.isProbe(p, err) {
+		return nil, ErrProbe
+	}
 	if err != nil {
 		if cerr, ok := err.(message.ConnackCode); ok {
 			//glog.Debugf("request   message: %s\nresponse message: %s\nerror           : %v", mreq, resp, err)
@@ -348,9 +1441,53 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		return nil, err
 	}
 
+	// Make sure the CONNECT follows the rules before doing anything with it
+	if err = checkConnect(req, this.Compliance, this.logger()); err != nil {
+		if cerr, ok := err.(*ConnectError); ok && cerr.Code != message.ConnectionAccepted {
+			resp.SetReturnCode(cerr.Code)
+			resp.SetSessionPresent(false)
+			writeMessage(conn, resp)
+		}
+		return nil, err
+	}
+
+	if err = this.checkClientId(req); err != nil {
+		resp.SetReturnCode(message.ErrIdentifierRejected)
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, err
+	}
+
+	// Banned clients are refused before they get anywhere near authenticating
+	if b := this.banned(conn, req); b != nil {
+		this.auditBan(BanEvent{Action: BanRefused, Ban: *b, ClientId: string(req.ClientId()), RemoteAddr: conn.RemoteAddr().String()})
+		resp.SetReturnCode(message.ErrNotAuthorized)
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, ErrClientBanned
+	}
+
+	anonymous, err := this.checkAnonymous(req.Username())
+	if err != nil {
+		resp.SetReturnCode(message.ErrNotAuthorized)
+		resp.SetSessionPresent(false)
+		writeMessage(conn, resp)
+		return nil, err
+	}
+
 	// Authenticate the user, if error, return error and exit
-	if err = this.authMgr.Authenticate(string(req.Username()), string(req.Password())); err != nil {
-		resp.SetReturnCode(message.ErrBadUsernameOrPassword)
+	if !anonymous {
+		if err = this.authManager(conn, l).AuthenticateAddr(string(req.Username()), string(req.Password()), conn.RemoteAddr()); err != nil {
+			resp.SetReturnCode(message.ErrBadUsernameOrPassword)
+			resp.SetSessionPresent(false)
+			writeMessage(conn, resp)
+			return nil, err
+		}
+	}
+
+	tenant, err := this.tenantOf(conn, l, req)
+	if err != nil {
+		resp.SetReturnCode(message.ErrNotAuthorized)
 		resp.SetSessionPresent(false)
 		writeMessage(conn, resp)
 		return nil, err
@@ -360,25 +1497,45 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		req.SetKeepAlive(minKeepAlive)
 	}
 
-	svc = &service{
-		id:     atomic.AddUint64(&gsvcid, 1),
-		client: false,
+	if this.MaxKeepAlive > 0 && int(req.KeepAlive()) > this.MaxKeepAlive {
+		req.SetKeepAlive(uint16(this.MaxKeepAlive))
+	}
 
-		keepAlive:      int(req.KeepAlive()),
-		connectTimeout: this.ConnectTimeout,
-		ackTimeout:     this.AckTimeout,
-		timeoutRetries: this.TimeoutRetries,
+	svc = this.newService(conn, req, release)
+	svc.tenant = tenant
+	svc.holding = this.OrderedDelivery
+	svc.maxQos = this.maxQoSOf(l, string(req.Username()))
 
-		conn:      conn,
-		sessMgr:   this.sessMgr,
-		topicsMgr: this.topicsMgr,
+	// Check to see if the client supplied an ID, if not, generate one. It's
+	// already been checked the client asked for a clean session.
+	if len(req.ClientId()) == 0 {
+		this.assignClientId(svc, req)
 	}
 
+	// If another connection is using the same client ID, disconnect it before
+	// touching the session, so the two services never share it.
+	cid := string(req.ClientId())
+	svc.log = svc.log.With(logging.F("client_id", cid))
+	span.SetAttributes(attribute.String("mqtt.client_id", cid), attribute.String("client.address", svc.remoteAddr))
+	this.takeover(cid, svc)
+
+	defer func() {
+		if err != nil {
+			this.unregister(cid, svc)
+		}
+		close(svc.ready)
+	}()
+
 	err = this.getSession(svc, req, resp)
 	if err != nil {
 		return nil, err
 	}
 
+	// The connection is the client's from here on, unless it took too long
+	if err = endHandshake(); err != nil {
+		return nil, err
+	}
+
 	resp.SetReturnCode(message.ConnectionAccepted)
 
 	if err = writeMessage(c, resp); err != nil {
@@ -393,28 +1550,121 @@ func (this *Server) handleConnection(c io.Closer) (svc *service, err error) {
 		return nil, err
 	}
 
+	this.resumeSession(svc, resp.SessionPresent())
+
+	this.addSubscriber(svc)
+	svc.autoSubscribe()
+	this.keepAliveConnected(svc)
+	this.presenceConnected(svc)
+	this.connectionEvent(svc, true)
+	this.clientEvent(svc, EventClientConnected)
+	atomic.AddInt64(&this.accepted, 1)
+
 	//this.mu.Lock()
 	//this.svcs = append(this.svcs, svc)
 	//this.mu.Unlock()
 
-	glog.Infof("(%s) server/handleConnection: Connection established.", svc.cid())
+	svc.logger().Info("server/handleConnection: Connection established.")
 	fmt.Print("New client is connecting, Id: ", string(req.ClientId()), "\t")
 	fmt.Println("Version: ", req.Version())
 	return svc, nil
 }
 
+// newService returns the service for a client connection, set up the way the
+// server is configured.
+func (this *Server) newService(conn net.Conn, req *message.ConnectMessage, release func()) *service {
+	svc := &service{
+		id:     atomic.AddUint64(&gsvcid, 1),
+		client: false,
+
+		keepAlive:      int(req.KeepAlive()),
+		keepAliveGrace: this.KeepAliveGrace,
+		connectTimeout: this.ConnectTimeout,
+		ackTimeout:     this.AckTimeout,
+		timeoutRetries: this.TimeoutRetries,
+		maxPacketSize:  this.MaxPacketSize,
+		bufferSize:     this.BufferSize,
+		outBufferSize:  this.OutBufferSize,
+		flushDelay:     this.FlushInterval,
+		flushBytes:     this.FlushBytes,
+		noRetain:       this.DisableRetained,
+		maxRetained:    this.MaxRetainedPerSubscribe,
+
+		maxTopicLevels:      this.MaxTopicLevels,
+		maxTopicLevelLength: this.MaxTopicLevelLength,
+
+		compliance: this.Compliance,
+
+		pipeline: this.Pipeline,
+		bridges:  this.Bridges,
+
+		conn:       conn,
+		remoteAddr: conn.RemoteAddr().String(),
+		log:        this.logger().With(logging.F("remote_addr", conn.RemoteAddr().String())),
+		tr:         this.Tracer,
+		server:     this,
+		ready:      make(chan struct{}),
+		stopped:    make(chan struct{}),
+		sessMgr:    this.sessMgr,
+		topicsMgr:  this.topicsMgr,
+		release:    release,
+	}
+
+	svc.timers = this.timers.get(svc.id)
+
+	if this.BufferSizes != nil {
+		in, out := this.BufferSizes(req)
+
+		if in > 0 {
+			svc.bufferSize = bufferSize(in)
+			if svc.maxPacketSize > svc.bufferSize {
+				svc.maxPacketSize = svc.bufferSize
+			}
+		}
+
+		if out > 0 {
+			svc.outBufferSize = bufferSize(out)
+		}
+	}
+
+	return svc
+}
+
+// logger returns the Logger, or the glog one if it's not set.
+func (this *Server) logger() logging.Logger {
+	if this.Logger == nil {
+		return logging.Glog()
+	}
+
+	return this.Logger
+}
+
 func (this *Server) checkConfiguration() error {
 	var err error
 
 	this.configOnce.Do(func() {
+		this.deprecations = applyShims(this.shims())
+		warnDeprecations(this.logger(), this.deprecations)
+
 		if this.KeepAlive == 0 {
 			this.KeepAlive = DefaultKeepAlive
 		}
 
+		if this.KeepAliveGrace == 0 {
+			this.KeepAliveGrace = DefaultKeepAliveGrace
+		} else if this.KeepAliveGrace < 1 {
+			err = errors.New("service: Keepalive grace can't be less than 1")
+			return
+		}
+
 		if this.ConnectTimeout == 0 {
 			this.ConnectTimeout = DefaultConnectTimeout
 		}
 
+		if this.HandshakeTimeout == 0 {
+			this.HandshakeTimeout = DefaultHandshakeTimeout
+		}
+
 		if this.AckTimeout == 0 {
 			this.AckTimeout = DefaultAckTimeout
 		}
@@ -423,31 +1673,108 @@ func (this *Server) checkConfiguration() error {
 			this.TimeoutRetries = DefaultTimeoutRetries
 		}
 
-		if this.Authenticator == "" {
-			this.Authenticator = "mockSuccess"
+		if this.BufferSize == 0 {
+			this.BufferSize = DefaultBufferSize
 		}
 
-		this.authMgr, err = auth.NewManager(this.Authenticator)
-		if err != nil {
+		if this.FlushInterval > 0 && this.FlushBytes == 0 {
+			this.FlushBytes = DefaultFlushBytes
+		}
+
+		if this.MaxPacketSize == 0 || this.MaxPacketSize > this.BufferSize {
+			this.MaxPacketSize = this.BufferSize
+		}
+
+		if this.QuotaThrottleDelay == 0 {
+			this.QuotaThrottleDelay = DefaultQuotaThrottleDelay
+		}
+
+		if this.SlowConsumerDelay == 0 {
+			this.SlowConsumerDelay = DefaultSlowConsumerDelay
+		}
+
+		if this.EventLoopIdle == 0 {
+			this.EventLoopIdle = DefaultEventLoopIdle
+		}
+
+		if this.MaxDelay == 0 {
+			this.MaxDelay = DefaultMaxDelay
+		}
+
+		if this.OfflineQueue < 0 || this.OfflineDiskBudget < 0 || this.SessionExpiry < 0 {
+			err = errors.New("service: Offline queue settings can't be negative")
 			return
 		}
 
-		if this.SessionsProvider == "" {
-			this.SessionsProvider = "mem"
+		if this.WALSync < WALSyncGroup || this.WALSync > WALSyncNever {
+			err = fmt.Errorf("service: Invalid WAL sync policy %d", this.WALSync)
+			return
 		}
 
-		this.sessMgr, err = sessions.NewManager(this.SessionsProvider)
-		if err != nil {
+		if this.WALGroupCommit == 0 {
+			this.WALGroupCommit = DefaultWALGroupCommit
+		}
+
+		if this.OverlappingSubscriptions < OverlapDeliverOnce || this.OverlappingSubscriptions > OverlapDeliverEach {
+			err = fmt.Errorf("service: Invalid overlapping subscriptions policy %d", this.OverlappingSubscriptions)
+			return
+		}
+
+		if this.MinClientIdLength < 0 || this.MaxClientIdLength < 0 || (this.MaxClientIdLength > 0 && this.MinClientIdLength > this.MaxClientIdLength) {
+			err = errors.New("service: Invalid client ID length limits")
+			return
+		}
+
+		if this.MaxHandshakes < 0 || this.AcceptRate < 0 || this.AcceptBurst < 0 {
+			err = errors.New("service: Invalid handshake or accept rate limits")
 			return
 		}
 
+		if this.MaxQoS > MaxQoS2 {
+			err = fmt.Errorf("service: Invalid maximum QoS %d", this.MaxQoS)
+			return
+		}
+
+		if this.FanoutWorkers < 0 || this.FanoutQueue < 0 {
+			err = errors.New("service: Fan-out workers and queue can't be negative")
+			return
+		}
+
+		if this.FanoutQueue == 0 {
+			this.FanoutQueue = DefaultFanoutQueue
+		}
+
+		this.timers = newTimerWheels(runtime.NumCPU(), wheelTick, wheelSlots)
+
+		this.msgid = uint64(time.Now().UnixNano())
+
+		if this.Authenticator == "" {
+			this.Authenticator = "mockSuccess"
+		}
+
+		if this.SessionsProvider == "" {
+			this.SessionsProvider = "mem"
+		}
+
 		if this.TopicsProvider == "" {
 			this.TopicsProvider = "mem"
 		}
 
-		this.topicsMgr, err = topics.NewManager(this.TopicsProvider)
+		for _, c := range append(this.builtinComponents(), this.Components...) {
+			if err = this.comps.add(c); err != nil {
+				return
+			}
+		}
+
+		if err = this.comps.start(this.logger()); err != nil {
+			return
+		}
 
-		return
+		if this.OnServerStart != nil {
+			if err = this.OnServerStart(this); err != nil {
+				this.comps.stop(this.logger())
+			}
+		}
 	})
 
 	return err
@@ -466,13 +1793,6 @@ func (this *Server) getSession(svc *service, req *message.ConnectMessage, resp *
 
 	var err error
 
-	// Check to see if the client supplied an ID, if not, generate one and set
-	// clean session.
-	if len(req.ClientId()) == 0 {
-		req.SetClientId([]byte(fmt.Sprintf("internalclient%d", svc.id)))
-		req.SetCleanSession(true)
-	}
-
 	cid := string(req.ClientId())
 
 	// If CleanSession is NOT set, check the session store for existing session.
@@ -500,5 +1820,9 @@ func (this *Server) getSession(svc *service, req *message.ConnectMessage, resp *
 		}
 	}
 
+	if this.MaxInflight > 0 {
+		svc.sess.SetInflightLimit(this.MaxInflight)
+	}
+
 	return nil
 }
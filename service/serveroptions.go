@@ -0,0 +1,322 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/surgemq/surgemq/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ServerOption configures a server created with NewServer.
+type ServerOption func(*Server) error
+
+// NewServer returns a server configured by opts, which are applied in order.
+// It's the same as setting the fields of a Server directly, but it carries on
+// compiling as settings are added, moved or deprecated, since the options keep
+// their meaning. Whatever isn't set keeps its default.
+//
+//	svr, err := service.NewServer(
+//		service.WithAuthenticator("ldap"),
+//		service.WithSessionStore("redis"),
+//		service.WithLogger(logging.NewSlog(slog.Default())),
+//		service.WithMaxConnections(10000, 100),
+//	)
+func NewServer(opts ...ServerOption) (*Server, error) {
+	this := &Server{}
+
+	for _, opt := range opts {
+		if err := opt(this); err != nil {
+			return nil, err
+		}
+	}
+
+	return this, nil
+}
+
+// Hooks are the callbacks of the server, see the fields of Server they are named
+// after. The ones left nil are left alone.
+type Hooks struct {
+	OnServerStart          func(*Server) error
+	OnServerStop           func(*Server)
+	OnBanEvent             func(BanEvent)
+	OnSlowConsumer         func(SlowConsumerEvent)
+	OnSubscriptionRejected func(SubscriptionRejectedEvent)
+}
+
+// WithHook sets the hooks of h that are set.
+func WithHook(h Hooks) ServerOption {
+	return func(this *Server) error {
+		if h.OnServerStart != nil {
+			this.OnServerStart = h.OnServerStart
+		}
+		if h.OnServerStop != nil {
+			this.OnServerStop = h.OnServerStop
+		}
+		if h.OnBanEvent != nil {
+			this.OnBanEvent = h.OnBanEvent
+		}
+		if h.OnSlowConsumer != nil {
+			this.OnSlowConsumer = h.OnSlowConsumer
+		}
+		if h.OnSubscriptionRejected != nil {
+			this.OnSubscriptionRejected = h.OnSubscriptionRejected
+		}
+		return nil
+	}
+}
+
+// WithAuthenticator sets the authenticator of the clients, by the name it was
+// registered with in the auth package.
+func WithAuthenticator(name string) ServerOption {
+	return func(this *Server) error {
+		this.Authenticator = name
+		return nil
+	}
+}
+
+// WithListenerAuthenticator sets the authenticator of the clients connecting
+// through the listener at addr, see Server.ListenerAuthenticators.
+func WithListenerAuthenticator(addr, name string) ServerOption {
+	return func(this *Server) error {
+		if this.ListenerAuthenticators == nil {
+			this.ListenerAuthenticators = make(map[string]string)
+		}
+		this.ListenerAuthenticators[addr] = name
+		return nil
+	}
+}
+
+// WithAnonymous sets what's done with the clients without a username.
+func WithAnonymous(p AnonymousPolicy) ServerOption {
+	return func(this *Server) error {
+		this.Anonymous = p
+		return nil
+	}
+}
+
+// WithDefaultACL sets what's done with the messages no ACL lets through.
+func WithDefaultACL(p ACLPolicy) ServerOption {
+	return func(this *Server) error {
+		this.DefaultACL = p
+		return nil
+	}
+}
+
+// WithSessionStore sets the session store, by the name it was registered with
+// in the sessions package.
+func WithSessionStore(name string) ServerOption {
+	return func(this *Server) error {
+		this.SessionsProvider = name
+		return nil
+	}
+}
+
+// WithTopicsProvider sets the topic store, by the name it was registered with in
+// the topics package.
+func WithTopicsProvider(name string) ServerOption {
+	return func(this *Server) error {
+		this.TopicsProvider = name
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the server.
+func WithLogger(l logging.Logger) ServerOption {
+	return func(this *Server) error {
+		this.Logger = l
+		return nil
+	}
+}
+
+// WithTracer sets the tracer of the server.
+func WithTracer(t trace.Tracer) ServerOption {
+	return func(this *Server) error {
+		this.Tracer = t
+		return nil
+	}
+}
+
+// WithComponent adds a component started and stopped with the server.
+func WithComponent(c Component) ServerOption {
+	return func(this *Server) error {
+		this.Components = append(this.Components, c)
+		return nil
+	}
+}
+
+// WithStage adds a stage to the pipeline of the server, creating the pipeline
+// if there's none yet.
+func WithStage(s Stage) ServerOption {
+	return func(this *Server) error {
+		if this.Pipeline == nil {
+			this.Pipeline = &Pipeline{}
+		}
+		return this.Pipeline.Add(s)
+	}
+}
+
+// WithBridge adds a bridge the published messages are forwarded to.
+func WithBridge(b Bridge) ServerOption {
+	return func(this *Server) error {
+		this.Bridges = append(this.Bridges, b)
+		return nil
+	}
+}
+
+// WithMaxConnections sets the maximum number of concurrent connections, in all
+// and from a single IP. A zero for either leaves it unlimited.
+func WithMaxConnections(total, perIP int) ServerOption {
+	return func(this *Server) error {
+		if total < 0 || perIP < 0 {
+			return errors.New("service: Maximum connections can't be negative")
+		}
+		this.MaxConnections, this.MaxConnectionsPerIP = total, perIP
+		return nil
+	}
+}
+
+// WithAcceptLimits sets how many connections a second each listener accepts,
+// and how many at once, and how many connections can be in their handshakes at
+// a time, see Server.AcceptRate and Server.MaxHandshakes. A zero leaves them
+// unlimited.
+func WithAcceptLimits(rate float64, burst, handshakes int) ServerOption {
+	return func(this *Server) error {
+		if rate < 0 || burst < 0 || handshakes < 0 {
+			return errors.New("service: Accept limits can't be negative")
+		}
+		this.AcceptRate, this.AcceptBurst, this.MaxHandshakes = rate, burst, handshakes
+		return nil
+	}
+}
+
+// WithMaxPacketSize sets the maximum size of the packets the server accepts.
+func WithMaxPacketSize(n int) ServerOption {
+	return func(this *Server) error {
+		if n <= 0 {
+			return errors.New("service: Maximum packet size must be positive")
+		}
+		this.MaxPacketSize = n
+		return nil
+	}
+}
+
+// WithConnectTimeout sets how long a client has to send its CONNECT, rounded up
+// to the second, and how long it has from connecting to being accepted.
+func WithConnectTimeout(connect, handshake time.Duration) ServerOption {
+	return func(this *Server) error {
+		if connect <= 0 {
+			return errors.New("service: Connect timeout must be positive")
+		}
+		this.ConnectTimeout = int((connect + time.Second - 1) / time.Second)
+		this.HandshakeTimeout = handshake
+		return nil
+	}
+}
+
+// WithKeepAlive sets how many times its keepalive a client can stay silent for,
+// and the longest keepalive the clients are held to, rounded up to the second. A
+// zero max leaves the clients their keepalives.
+func WithKeepAlive(grace float64, max time.Duration) ServerOption {
+	return func(this *Server) error {
+		if grace < 1 || max < 0 {
+			return errors.New("service: Invalid keepalive grace or maximum")
+		}
+		this.KeepAliveGrace = grace
+		this.MaxKeepAlive = int((max + time.Second - 1) / time.Second)
+		return nil
+	}
+}
+
+// WithAckTimeout sets how long to wait for each ack, rounded up to the second,
+// and how many times to send a message again before giving up.
+func WithAckTimeout(d time.Duration, retries int) ServerOption {
+	return func(this *Server) error {
+		if d <= 0 || retries < 0 {
+			return errors.New("service: Invalid ack timeout or retries")
+		}
+		this.AckTimeout = int((d + time.Second - 1) / time.Second)
+		this.TimeoutRetries = retries
+		return nil
+	}
+}
+
+// WithWAL logs the QoS 1 and 2 messages the clients publish to a write-ahead
+// log in dir before they are acked, synced as policy says, see Server.WAL. A
+// zero group is DefaultWALGroupCommit.
+func WithWAL(dir string, policy WALSyncPolicy, group time.Duration) ServerOption {
+	return func(this *Server) error {
+		if dir == "" || group < 0 {
+			return errors.New("service: Invalid WAL directory or group commit")
+		}
+		this.WAL, this.WALSync, this.WALGroupCommit = dir, policy, group
+		return nil
+	}
+}
+
+// WithFanoutWorkers delivers the messages the clients publish with n workers,
+// each holding up to queue of them, see Server.FanoutWorkers. A zero queue is
+// DefaultFanoutQueue.
+func WithFanoutWorkers(n, queue int) ServerOption {
+	return func(this *Server) error {
+		if n <= 0 || queue < 0 {
+			return errors.New("service: Invalid fan-out workers or queue")
+		}
+		this.FanoutWorkers, this.FanoutQueue = n, queue
+		return nil
+	}
+}
+
+// WithMaxQoS sets the highest QoS granted to the subscriptions of the clients,
+// and the topic prefixes the QoS 0 messages published to are upgraded to QoS 1,
+// see Server.MaxQoS and Server.QoSUpgrade.
+func WithMaxQoS(max QoSLimit, upgrade ...string) ServerOption {
+	return func(this *Server) error {
+		if max > MaxQoS2 {
+			return errors.New("service: Invalid maximum QoS")
+		}
+		this.MaxQoS, this.QoSUpgrade = max, upgrade
+		return nil
+	}
+}
+
+// WithMemoryBudget sets the memory budget of the server, and what's done once
+// it's over.
+func WithMemoryBudget(n int64, p MemoryPolicy) ServerOption {
+	return func(this *Server) error {
+		this.MemoryBudget, this.MemoryPolicy = n, p
+		return nil
+	}
+}
+
+// WithEventLoop parks the connections idle for longer than idle on an event
+// loop. A zero idle is DefaultEventLoopIdle.
+func WithEventLoop(idle time.Duration) ServerOption {
+	return func(this *Server) error {
+		this.EventLoop, this.EventLoopIdle = true, idle
+		return nil
+	}
+}
+
+// WithLowMemoryProfile applies the low memory profile, see
+// Server.UseLowMemoryProfile. Options after it can override its settings.
+func WithLowMemoryProfile() ServerOption {
+	return func(this *Server) error {
+		this.UseLowMemoryProfile()
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/logging"
+)
+
+func TestNewServer(t *testing.T) {
+	started := false
+
+	svr, err := NewServer(
+		WithAuthenticator("mockFailure"),
+		WithListenerAuthenticator(":8883", "mockSuccess"),
+		WithAnonymous(AnonymousDeny),
+		WithSessionStore("mem"),
+		WithTopicsProvider("mem"),
+		WithLogger(logging.Nop()),
+		WithMaxConnections(100, 10),
+		WithConnectTimeout(1500*time.Millisecond, 5*time.Second),
+		WithKeepAlive(2, 90*time.Second),
+		WithStage(appendStage("acl", PhaseAuth)),
+		WithStage(appendStage("route", PhaseRouting)),
+		WithHook(Hooks{OnServerStart: func(*Server) error {
+			started = true
+			return nil
+		}}),
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, "mockFailure", svr.Authenticator)
+	require.Equal(t, map[string]string{":8883": "mockSuccess"}, svr.ListenerAuthenticators)
+	require.Equal(t, AnonymousDeny, svr.Anonymous)
+	require.Equal(t, "mem", svr.SessionsProvider)
+	require.Equal(t, 100, svr.MaxConnections)
+	require.Equal(t, 10, svr.MaxConnectionsPerIP)
+	require.Equal(t, 2, svr.ConnectTimeout)
+	require.Equal(t, 5*time.Second, svr.HandshakeTimeout)
+	require.Equal(t, 2.0, svr.KeepAliveGrace)
+	require.Equal(t, 90, svr.MaxKeepAlive)
+	require.Len(t, svr.Pipeline.Stats(), 2)
+
+	require.NoError(t, svr.OnServerStart(svr))
+	require.True(t, started)
+}
+
+func TestNewServerInvalidOption(t *testing.T) {
+	_, err := NewServer(WithMaxPacketSize(0))
+	require.Error(t, err)
+
+	_, err = NewServer(WithKeepAlive(0.5, 0))
+	require.Error(t, err)
+
+	_, err = NewServer(WithStage(appendStage("acl", PhaseAuth)), WithStage(appendStage("acl", PhaseAuth)))
+	require.Equal(t, ErrStageExists, err)
+}
+
+func TestNewServerLowMemoryProfile(t *testing.T) {
+	// Options after the profile override it
+	svr, err := NewServer(WithLowMemoryProfile(), WithMaxConnections(0, 0))
+	require.NoError(t, err)
+	require.Equal(t, LowMemoryBufferSize, svr.BufferSize)
+	require.True(t, svr.DisableRetained)
+}
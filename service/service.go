@@ -19,11 +19,13 @@ import (
 	"io"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"github.com/surge/glog"
 	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
 	"github.com/surgemq/surgemq/sessions"
 	"github.com/surgemq/surgemq/topics"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
@@ -31,6 +33,16 @@ type (
 	OnPublishFunc  func(msg *message.PublishMessage) error
 )
 
+// Complete calls the function, so it can wait in the ack queues as a
+// sessions.Completer. A nil OnCompleteFunc does nothing.
+func (this OnCompleteFunc) Complete(msg, ack message.Message, err error) error {
+	if this == nil {
+		return nil
+	}
+
+	return this(msg, ack, err)
+}
+
 type stat struct {
 	bytes int64
 	msgs  int64
@@ -58,6 +70,10 @@ type service struct {
 	// If not set then default to 5 mins.
 	keepAlive int
 
+	// How many times the keepalive the client can stay silent for before it's
+	// disconnected. If not set then default to 1.5, as in the MQTT spec.
+	keepAliveGrace float64
+
 	// The number of seconds to wait for the CONNACK message before disconnecting.
 	// If not set then default to 2 seconds.
 	connectTimeout int
@@ -70,9 +86,120 @@ type service struct {
 	// If no set then default to 3 retries.
 	timeoutRetries int
 
+	// The maximum size of any packet received. If not set then there's no limit
+	// other than the size of the incoming buffer.
+	maxPacketSize int
+
+	// The size of the incoming and outgoing buffers. If not set then default to
+	// 256KB. The outgoing one is bufferSize as well unless outBufferSize is set.
+	bufferSize    int
+	outBufferSize int
+
+	// How long the sender waits for flushBytes to write before writing what there
+	// is. If not set then it writes as soon as there's anything.
+	flushDelay time.Duration
+	flushBytes int
+
+	// Whether retained messages are kept. It's only set on the server side.
+	noRetain bool
+
+	// The maximum number of retained messages sent for each topic filter
+	// subscribed to. If not set then there's no limit.
+	maxRetained int
+
+	// The maximum number of levels in a topic, and the maximum length of each
+	// level. If not set then there's no limit.
+	maxTopicLevels      int
+	maxTopicLevelLength int
+
+	// How strictly the other end is held to the spec. The client side is always
+	// strict.
+	compliance ComplianceMode
+
+	// The pipeline published messages go through, and the bridges they are then
+	// forwarded to. They are only set on the server side.
+	pipeline *Pipeline
+	bridges  []Bridge
+
+	// The router the messages received are dispatched to, instead of the
+	// onPublish functions of the subscriptions. It's only set on the client side.
+	router *Router
+
 	// Network connection for this service
 	conn io.Closer
 
+	// The address of the other end of the connection, kept as the connection is
+	// gone once the service stops. It's only set on the server side.
+	remoteAddr string
+
+	// The tenant of the client, whose topics are put under it. It's only set on
+	// the server side, when Server.Tenancy is on.
+	tenant string
+
+	// The highest QoS the client is granted, and sent its messages at. It's only
+	// set on the server side, see Server.MaxQoS.
+	maxQos QoSLimit
+
+	// Where this service logs to, with the client ID and remote address as
+	// fields. If not set then default to glog.
+	log logging.Logger
+
+	// What the spans of the messages published by the other end, and of the ack
+	// cycles, are started with. If not set then nothing is traced.
+	tr trace.Tracer
+
+	// Set while the connection is being handed over to another process by
+	// UpgradeWithHandoff. The service then stops without ending the session.
+	handoff int32
+
+	// The bytes read from the connection but not yet processed when it's handed
+	// over, either to another process or from a previous one.
+	pending []byte
+
+	// The UnixNano time the last message was received, and whether the connection
+	// was dropped rather than closed by either end. They are only kept if the
+	// server has AdviseKeepAlive set.
+	lastRecv int64
+	dropped  int32
+
+	// Why the service was stopped, a DisconnectReason, and whether the connected
+	// event of its client was published, see Server.ConnectionEvents.
+	reason    int32
+	announced int32
+
+	// The IDs of the WAL records of the QoS 2 messages the client has published
+	// and not yet released, keyed by packet ID, see Server.WAL. It's only used
+	// by the processor.
+	walIds map[uint16]uint64
+
+	// Whether the messages to the client are being held back while it resumes
+	// its session, and those that are, see Server.OrderedDelivery
+	hmu     sync.Mutex
+	holding bool
+	held    []heldPublish
+
+	// The WAL record of the message being accepted, which onPublish hands to the
+	// fan-out workers along with it, see acceptLogged.
+	walId uint64
+
+	// The timer wheel used for the keepalive. If not set then the keepalive is
+	// enforced with a read deadline instead. It's only set on the server side.
+	timers *timerWheel
+
+	// release gives back the connection slot this service holds against the
+	// server's connection limits. It's nil for the client side.
+	release func()
+
+	// server is the server that accepted the connection for this service. It's nil
+	// for the client side.
+	server *Server
+
+	// ready is closed once the server is done setting up this service, whether
+	// it's successful or not. stopped is closed once the service has completely
+	// stopped. They are only used on the server side, for session takeover.
+	ready   chan struct{}
+	stopped chan struct{}
+
 	// Session manager for tracking all the clients
 	sessMgr *sessions.Manager
 
@@ -90,6 +217,25 @@ type service struct {
 	// writeMessage mutex - serializes writes to the outgoing buffer.
 	wmu sync.Mutex
 
+	// Whether the client is a slow consumer, and the number of messages dropped
+	// for it since it became one, see SlowConsumerPolicy
+	slow        int32
+	slowDropped int64
+
+	// Whether the connection is parked on the server's event loop, the file
+	// descriptor it's watched by there, the timer enforcing the keepalive in the
+	// meantime, and the UnixNano time something was last read from it before it
+	// was parked, see Server.EventLoop. loops is the number of the service's
+	// goroutines still running.
+	parked   int32
+	pfd      int
+	ptimer   *wheelTimer
+	lastRead int64
+	loops    int32
+
+	// The size of the buffers counted against the server's MemoryBudget
+	bufBytes int64
+
 	// Whether this is service is closed or not.
 	closed int64
 
@@ -115,8 +261,7 @@ type service struct {
 	inStat  stat
 	outStat stat
 
-	intmp  []byte
-	outtmp []byte
+	intmp []byte
 
 	subs  []interface{}
 	qoss  []byte
@@ -124,26 +269,28 @@ type service struct {
 }
 
 func (this *service) start() error {
-	var err error
-
-	// Create the incoming ring buffer
-	this.in, err = newBuffer(defaultBufferSize)
-	if err != nil {
+	if err := this.newBuffers(); err != nil {
 		return err
 	}
 
-	// Create the outgoing ring buffer
-	this.out, err = newBuffer(defaultBufferSize)
-	if err != nil {
-		return err
+	// They come before anything else read from the connection
+	if len(this.pending) > 0 {
+		if _, err := this.in.Write(this.pending); err != nil {
+			return err
+		}
+		this.pending = nil
 	}
 
 	// If this is a server
 	if !this.client {
 		// Creat the onPublishFunc so it can be used for published messages
 		this.onpub = func(msg *message.PublishMessage) error {
+			if this.hold(msg, msg.Retain(), nil) {
+				return nil
+			}
+
 			if err := this.publish(msg, nil); err != nil {
-				glog.Errorf("service/onPublish: Error publishing message: %v", err)
+				this.logger().Error("service/onPublish: Error publishing message", logging.Err(err))
 				return err
 			}
 
@@ -161,6 +308,44 @@ func (this *service) start() error {
 		}
 	}
 
+	this.run()
+
+	return nil
+}
+
+// newBuffers creates the incoming and outgoing ring buffers.
+func (this *service) newBuffers() error {
+	var err error
+
+	// Create the incoming ring buffer
+	this.in, err = newBuffer(int64(this.bufferSize))
+	if err != nil {
+		return err
+	}
+
+	// Create the outgoing ring buffer
+	size := this.outBufferSize
+	if size == 0 {
+		size = this.bufferSize
+	}
+
+	this.out, err = newBuffer(int64(size))
+	if err != nil {
+		return err
+	}
+
+	this.out.flushDelay = this.flushDelay
+	this.out.flushBytes = this.flushBytes
+
+	this.addBuffers()
+
+	return nil
+}
+
+// run starts the processor, receiver and sender, and waits for them to start.
+func (this *service) run() {
+	atomic.StoreInt32(&this.loops, 3)
+
 	// Processor is responsible for reading messages out of the buffer and processing
 	// them accordingly.
 	this.wgStarted.Add(1)
@@ -180,8 +365,6 @@ func (this *service) start() error {
 
 	// Wait for all the goroutines to start before returning
 	this.wgStarted.Wait()
-
-	return nil
 }
 
 // FIXME: The order of closing here causes panic sometimes. For example, if receiver
@@ -190,7 +373,7 @@ func (this *service) stop() {
 	defer func() {
 		// Let's recover from panic
 		if r := recover(); r != nil {
-			glog.Errorf("(%s) Recovering from panic: %v", this.cid(), r)
+			this.logger().Error("service/stop: Recovering from panic", logging.F("panic", r))
 		}
 	}()
 
@@ -199,45 +382,83 @@ func (this *service) stop() {
 		return
 	}
 
+	if this.stopped != nil {
+		defer close(this.stopped)
+	}
+
 	// Close quit channel, effectively telling all the goroutines it's time to quit
 	if this.done != nil {
-		glog.Debugf("(%s) closing this.done", this.cid())
+		this.logger().Debug("service/stop: Closing this.done")
 		close(this.done)
 	}
 
+	// Take a parked connection off the event loop before it's closed, as its
+	// file descriptor can then be reused
+	this.wmu.Lock()
+	this.unloop()
+	this.wmu.Unlock()
+
+	// Let the sender finish writing what's already in the outgoing buffer, as the
+	// connection lives on in the other process
+	if this.handingOff() && this.out != nil {
+		for i := 0; this.out.Len() > 0 && i < 100; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
 	// Close the network connection
 	if this.conn != nil {
-		glog.Debugf("(%s) closing this.conn", this.cid())
+		this.logger().Debug("service/stop: Closing this.conn")
 		this.conn.Close()
 	}
 
-	this.in.Close()
-	this.out.Close()
+	// A parked connection has no buffers
+	if this.in != nil {
+		this.in.Close()
+		this.out.Close()
+	}
 
 	// Wait for all the goroutines to stop.
 	this.wgStopped.Wait()
 
-	glog.Debugf("(%s) Received %d bytes in %d messages.", this.cid(), this.inStat.bytes, this.inStat.msgs)
-	glog.Debugf("(%s) Sent %d bytes in %d messages.", this.cid(), this.outStat.bytes, this.outStat.msgs)
+	// Keep what's been read but not processed, i.e. the start of a message that
+	// hasn't fully arrived, so it can be handed over with the connection
+	if this.handingOff() && this.in != nil && this.in.Len() > 0 {
+		if b, _ := this.in.ReadPeek(this.in.Len()); len(b) > 0 {
+			this.pending = append([]byte(nil), b...)
+		}
+	}
+
+	this.logger().Debug("service/stop: Connection stats",
+		logging.F("bytes_in", this.inStat.bytes), logging.F("msgs_in", this.inStat.msgs),
+		logging.F("bytes_out", this.outStat.bytes), logging.F("msgs_out", this.outStat.msgs))
 
-	// Unsubscribe from all the topics for this client, only for the server side though
-	if !this.client && this.sess != nil {
+	// Unsubscribe from all the topics for this client, only for the server side though.
+	// A connection being handed over has already been unsubscribed.
+	if !this.client && this.sess != nil && !this.handingOff() {
 		topics, _, err := this.sess.Topics()
 		if err != nil {
-			glog.Errorf("(%s/%d): %v", this.cid(), this.id, err)
+			this.logger().Error("service/stop: Error retrieving topics", logging.Err(err))
 		} else {
 			for _, t := range topics {
 				if err := this.topicsMgr.Unsubscribe([]byte(t), &this.onpub); err != nil {
-					glog.Errorf("(%s): Error unsubscribing topic %q: %v", this.cid(), t, err)
+					this.logger().Error("service/stop: Error unsubscribing topic", logging.F("topic", t), logging.Err(err))
 				}
 			}
 		}
 	}
 
-	// Publish will message if WillFlag is set. Server side only.
-	if !this.client && this.sess.Cmsg.WillFlag() {
-		glog.Infof("(%s) service/stop: connection unexpectedly closed. Sending Will.", this.cid())
-		this.onPublish(this.sess.Will)
+	// Publish will message if WillFlag is set. Server side only. The client is
+	// still connected if the connection was handed over, and a read-only server
+	// doesn't publish the wills of its clients.
+	if !this.client && this.sess.Cmsg.WillFlag() && !this.handingOff() && !this.readOnly() {
+		this.logger().Info("service/stop: Connection unexpectedly closed. Sending Will.")
+		this.onPublish(this.willMessage())
+	}
+
+	// The QoS 2 messages that won't be released now are done with
+	for _, id := range this.walIds {
+		this.logDone(id)
 	}
 
 	// Remove the client topics manager
@@ -250,14 +471,73 @@ func (this *service) stop() {
 		this.sessMgr.Del(this.sess.ID())
 	}
 
+	// Remove the client from the server's list of connected clients, unless it
+	// has already been taken over by another connection
+	if this.server != nil {
+		if !this.handingOff() {
+			this.server.keepAliveDisconnected(this)
+		}
+
+		if !this.handingOff() {
+			this.server.presenceDisconnected(this)
+			this.server.connectionEvent(this, false)
+			this.server.clientEvent(this, EventClientDisconnected)
+			this.server.goOffline(this)
+		}
+
+		this.server.addClosedStats(this)
+
+		if this.server.Quota != nil {
+			this.server.saveQuota(this.sess.ID())
+		}
+		this.server.unregister(this.sess.ID(), this)
+		this.server.removeSubscriber(this)
+	}
+
+	if this.release != nil {
+		this.release()
+	}
+
 	this.conn = nil
 	this.in = nil
 	this.out = nil
+	this.releaseBuffers()
+}
+
+// keepAliveTimeout returns how long the client can stay silent for before it's
+// disconnected.
+func (this *service) keepAliveTimeout() time.Duration {
+	grace := this.keepAliveGrace
+	if grace == 0 {
+		grace = DefaultKeepAliveGrace
+	}
+
+	return time.Duration(float64(time.Duration(this.keepAlive)*time.Second) * grace)
+}
+
+func (this *service) handingOff() bool {
+	return atomic.LoadInt32(&this.handoff) == 1
 }
 
-func (this *service) publish(msg *message.PublishMessage, onComplete OnCompleteFunc) error {
+func (this *service) publish(msg *message.PublishMessage, onComplete sessions.Completer) error {
+	msg = this.capQoS(this.untenant(msg))
+
+	// The messages to a client are numbered by its session, not by whoever
+	// published them, and the message may be shared, so it gets a copy
+	if !this.client && msg.QoS() != message.QosAtMostOnce {
+		pktid, err := this.sess.NextPacketId()
+		if err != nil {
+			return fmt.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
+		}
+
+		msg = withPacketId(msg, pktid)
+	}
+
 	//glog.Debugf("service/publish: Publishing %s", msg)
 	_, err := this.writeMessage(msg)
+	if err == ErrSlowConsumer {
+		this.deadLetter(DeadLetterOverflow, msg)
+	}
 	if err != nil {
 		return fmt.Errorf("(%s) Error sending %s message: %v", this.cid(), msg.Name(), err)
 	}
@@ -265,23 +545,23 @@ func (this *service) publish(msg *message.PublishMessage, onComplete OnCompleteF
 	switch msg.QoS() {
 	case message.QosAtMostOnce:
 		if onComplete != nil {
-			return onComplete(msg, nil, nil)
+			return onComplete.Complete(msg, nil, nil)
 		}
 
 		return nil
 
 	case message.QosAtLeastOnce:
-		return this.sess.Pub1ack.Wait(msg, onComplete)
+		return this.wait(this.sess.Pub1ack, msg, onComplete)
 
 	case message.QosExactlyOnce:
-		return this.sess.Pub2out.Wait(msg, onComplete)
+		return this.wait(this.sess.Pub2out, msg, onComplete)
 	}
 
 	return nil
 }
 
 func (this *service) subscribe(msg *message.SubscribeMessage, onComplete OnCompleteFunc, onPublish OnPublishFunc) error {
-	if onPublish == nil {
+	if onPublish == nil && this.router == nil {
 		return fmt.Errorf("onPublish function is nil. No need to subscribe.")
 	}
 
@@ -339,6 +619,9 @@ func (this *service) subscribe(msg *message.SubscribeMessage, onComplete OnCompl
 		for i, t := range topics {
 			c := retcodes[i]
 
+			// The messages replayed come on the topics of the filter itself
+			t, _ = replayFilter(t)
+
 			if c == message.QosFailure {
 				err2 = fmt.Errorf("Failed to subscribe to '%s'\n%v", string(t), err2)
 			} else {
@@ -402,6 +685,8 @@ func (this *service) unsubscribe(msg *message.UnsubscribeMessage, onComplete OnC
 		var err2 error = nil
 
 		for _, tb := range unsub.Topics() {
+			tb, _ = replayFilter(tb)
+
 			// Remove all subscribers, which basically it's just this client, since
 			// each client has it's own topic tree.
 			err := this.topicsMgr.Unsubscribe(tb, nil)
@@ -444,6 +729,20 @@ func (this *service) isDone() bool {
 	return false
 }
 
+// isClosed reports whether stop was called. Unlike isDone, it doesn't need the
+// done channel, which the client side never makes.
+func (this *service) isClosed() bool {
+	return atomic.LoadInt64(&this.closed) != 0
+}
+
+func (this *service) logger() logging.Logger {
+	if this.log == nil {
+		return logging.Glog()
+	}
+
+	return this.log
+}
+
 func (this *service) cid() string {
 	return fmt.Sprintf("%d/%s", this.id, this.sess.ID())
 }
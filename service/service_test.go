@@ -197,6 +197,40 @@ func TestServiceSubRetain(t *testing.T) {
 	})
 }
 
+// A message retained by a client is sent to the clients that subscribe later
+// with the RETAIN flag set.
+func TestServicePubRetainSub(t *testing.T) {
+	runClientServerTests(t, func(c *Client) {
+		rmsg := newPublishMessage(0, 0)
+		rmsg.SetTopic([]byte("retain/abc"))
+		rmsg.SetRetain(true)
+
+		require.NoError(t, c.Publish(rmsg, nil))
+
+		defer func() {
+			rmsg.SetPayload(nil)
+			c.Publish(rmsg, nil)
+		}()
+
+		retained := make(chan bool, 1)
+
+		sub := message.NewSubscribeMessage()
+		sub.AddTopic([]byte("retain/#"), 0)
+
+		c.Subscribe(sub, nil, func(msg *message.PublishMessage) error {
+			retained <- msg.Retain()
+			return nil
+		})
+
+		select {
+		case r := <-retained:
+			require.True(t, r)
+		case <-time.After(time.Millisecond * 100):
+			require.FailNow(t, "Timed out waiting for retained message")
+		}
+	})
+}
+
 // Subscribe with QoS 0, publish with QoS 0. So the client should receive all the
 // messages as QoS 0.
 func TestServiceSub0Pub0(t *testing.T) {
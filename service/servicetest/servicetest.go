@@ -0,0 +1,283 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package servicetest checks that the extensions plugged into the server, the
+// pipeline stages and the bridges, behave the way the server expects them to.
+//
+// Pipeline stages, including the PhaseAuth stages used as ACLs, are called for
+// every message published, by as many goroutines as there are publishing
+// clients, and must give the same answer for the same message every time.
+// TestStage checks a stage keeps, drops or fails the messages it's given as
+// expected, including when called concurrently.
+//
+// Bridges are handed every message published, and the PUBACK of QoS 1 messages
+// waits for them, so a bridge that doesn't call done exactly once for each
+// message leaves clients waiting, and one that fails it gets them disconnected.
+// TestBridge checks that.
+//
+// To check a stage, call TestStage from one of its tests with the messages it
+// should keep and the ones it should not:
+//
+//	func TestConformance(t *testing.T) {
+//		servicetest.TestStage(t, newACLStage(rules), []servicetest.StageCase{
+//			{ClientId: "sensor1", Topic: "sensors/sensor1/temp", Want: servicetest.Kept},
+//			{ClientId: "sensor1", Topic: "sensors/sensor2/temp", Want: servicetest.Dropped},
+//		})
+//	}
+package servicetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/service"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// How long TestBridge waits for done to be called
+var BridgeTimeout = 5 * time.Second
+
+// Outcome is what a stage did with a message.
+type Outcome int
+
+const (
+	// Kept means the stage returned a message to carry on with. Stages that
+	// don't process the message because of their Filter keep it too.
+	Kept Outcome = iota
+
+	// Dropped means the stage returned nil.
+	Dropped
+
+	// Failed means the stage returned an error.
+	Failed
+)
+
+func (this Outcome) String() string {
+	switch this {
+	case Kept:
+		return "kept"
+	case Dropped:
+		return "dropped"
+	case Failed:
+		return "failed"
+	}
+
+	return fmt.Sprintf("outcome%d", int(this))
+}
+
+// StageCase is a message published by a client, and what the stage is expected
+// to do with it.
+type StageCase struct {
+	ClientId string
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Want     Outcome
+}
+
+func (this StageCase) String() string {
+	return fmt.Sprintf("%q publishing to %q", this.ClientId, this.Topic)
+}
+
+// TestStage runs the conformance tests against the stage s. It must do what each
+// of the cases want with their messages.
+func TestStage(t *testing.T, s service.Stage, cases []StageCase) {
+	t.Run("Valid", func(t *testing.T) {
+		require.NotEqual(t, "", s.Name, "stage has no name")
+		require.NotNil(t, s.Process, "stage has no Process")
+
+		p := &service.Pipeline{}
+		require.NoError(t, p.Add(s))
+	})
+
+	t.Run("Cases", func(t *testing.T) {
+		for _, c := range cases {
+			got, err := process(s, c)
+			require.NoError(t, err)
+			require.Equal(t, c.Want, got, "message from %s", c)
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const n = 10
+
+		var (
+			wg   sync.WaitGroup
+			errs = make(chan error, n*len(cases))
+		)
+
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+
+				for _, c := range cases {
+					got, err := process(s, c)
+					if err == nil && got != c.Want {
+						err = fmt.Errorf("message from %s %s, want %s", c, got, c.Want)
+					}
+					if err != nil {
+						errs <- err
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	})
+}
+
+// process runs the message of the case through the stage the way the pipeline
+// does. It only returns an error if the stage misbehaves.
+func process(s service.Stage, c StageCase) (outcome Outcome, err error) {
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic([]byte(c.Topic)); err != nil {
+		return Failed, err
+	}
+	msg.SetPayload(c.Payload)
+	if err := msg.SetQoS(c.QoS); err != nil {
+		return Failed, err
+	}
+
+	if s.Filter != "" && !topics.Match([]byte(s.Filter), msg.Topic()) {
+		return Kept, nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("stage panicked on message from %s: %v", c, r)
+		}
+	}()
+
+	out, err := s.Process(c.ClientId, msg)
+	switch {
+	case err != nil:
+		return Failed, nil
+	case out == nil:
+		return Dropped, nil
+	}
+
+	return Kept, nil
+}
+
+// TestBridge runs the conformance tests against the bridge b. Every message
+// published to one of the topics is forwarded to the bridge, which must accept
+// them all.
+func TestBridge(t *testing.T, b service.Bridge, names ...string) {
+	require.NotNil(t, b, "bridge is nil")
+	require.NotEmpty(t, names, "no topics to publish to")
+
+	t.Run("Forward", func(t *testing.T) {
+		for qos := byte(0); qos <= 1; qos++ {
+			for _, topic := range names {
+				require.NoError(t, forward(b, "servicetest", topic, qos), "topic %q", topic)
+			}
+		}
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		const n = 10
+
+		var (
+			wg   sync.WaitGroup
+			errs = make(chan error, n*len(names))
+		)
+
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+
+			go func(cid string) {
+				defer wg.Done()
+
+				for _, topic := range names {
+					if err := forward(b, cid, topic, 1); err != nil {
+						errs <- fmt.Errorf("topic %q: %v", topic, err)
+					}
+				}
+			}(fmt.Sprintf("servicetest%d", i))
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	})
+}
+
+// forward hands a message to the bridge the way the server does, and waits for
+// done to be called. Calling done more than once is an error, as is the message
+// being refused.
+func forward(b service.Bridge, cid, topic string, qos byte) error {
+	msg := message.NewPublishMessage()
+	if err := msg.SetTopic([]byte(topic)); err != nil {
+		return err
+	}
+	msg.SetPayload([]byte("servicetest"))
+	if err := msg.SetQoS(qos); err != nil {
+		return err
+	}
+
+	var (
+		mu    sync.Mutex
+		calls int
+		errs  = make(chan error, 1)
+	)
+
+	b.Forward(cid, msg, func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if calls++; calls == 1 {
+			errs <- err
+		}
+	})
+
+	// The message is only valid for the duration of the call, so it's changed to
+	// catch bridges that hold on to it
+	msg.SetPayload([]byte("reused"))
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			return fmt.Errorf("message refused: %v", err)
+		}
+
+	case <-time.After(BridgeTimeout):
+		return fmt.Errorf("done not called within %v", BridgeTimeout)
+	}
+
+	// Give a second call a chance to happen
+	time.Sleep(10 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if calls > 1 {
+		return fmt.Errorf("done called %d times", calls)
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+var ErrSlowConsumer error = errors.New("service: Message dropped for slow consumer")
+
+const DefaultSlowConsumerDelay = 5 * time.Second
+
+// SlowConsumerPolicy is what's done with a client whose outgoing buffer has had
+// no room for a message published to it for the SlowConsumerDelay, i.e. that
+// isn't reading the messages as fast as they are published.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerBlock waits for the client to make room, however long it
+	// takes, holding up the publishers of the messages to it.
+	SlowConsumerBlock SlowConsumerPolicy = iota
+
+	// SlowConsumerDropQos0 drops the QoS 0 messages to the client while it's
+	// slow, and still waits for room for the QoS 1 and 2 ones.
+	SlowConsumerDropQos0
+
+	// SlowConsumerDropNew drops all the messages to the client while it's slow,
+	// so it never gets them, whatever their QoS.
+	SlowConsumerDropNew
+
+	// SlowConsumerDisconnect disconnects the client.
+	SlowConsumerDisconnect
+)
+
+func (this SlowConsumerPolicy) String() string {
+	switch this {
+	case SlowConsumerBlock:
+		return "block"
+	case SlowConsumerDropQos0:
+		return "drop_qos0"
+	case SlowConsumerDropNew:
+		return "drop_new"
+	case SlowConsumerDisconnect:
+		return "disconnect"
+	}
+
+	return "unknown"
+}
+
+// SlowConsumerEvent is reported to OnSlowConsumer when a client is found to be
+// slow, and again once it has caught up.
+type SlowConsumerEvent struct {
+	ClientId string
+	Policy   SlowConsumerPolicy
+
+	// Recovered is whether the client has caught up, and Dropped the number of
+	// messages dropped for it while it was slow.
+	Recovered bool
+	Dropped   int64
+
+	// Pending is the number of bytes waiting in the client's outgoing buffer.
+	Pending int
+
+	Time time.Time
+}
+
+// reserve is WriteWait on the outgoing buffer for a PUBLISH message of n bytes
+// and QoS qos, with the SlowConsumerPolicy of the server applied if there's no
+// room for it. It returns ErrSlowConsumer if the message is dropped, and the
+// caller must hold the write mutex.
+func (this *service) reserve(n int, qos byte) ([]byte, bool, error) {
+	if this.client || this.server == nil || this.server.SlowConsumerPolicy == SlowConsumerBlock {
+		return this.out.WriteWait(n)
+	}
+
+	policy := this.server.SlowConsumerPolicy
+	slow := atomic.LoadInt32(&this.slow) == 1
+
+	if this.out.Free() >= n {
+		buf, wrap, err := this.out.WriteWait(n)
+		if err == nil && slow {
+			this.slowConsumer(true)
+		}
+		return buf, wrap, err
+	}
+
+	if !slow {
+		buf, wrap, err := this.out.WriteWaitTimeout(n, this.server.SlowConsumerDelay)
+		if err != errWriteTimeout {
+			return buf, wrap, err
+		}
+
+		this.slowConsumer(false)
+	}
+
+	switch policy {
+	case SlowConsumerDisconnect:
+		go this.stopWith(DisconnectSlowConsumer)
+
+	case SlowConsumerDropQos0:
+		if qos > 0 {
+			buf, wrap, err := this.out.WriteWait(n)
+			if err == nil {
+				this.slowConsumer(true)
+			}
+			return buf, wrap, err
+		}
+	}
+
+	atomic.AddInt64(&this.slowDropped, 1)
+	atomic.AddInt64(&this.server.slowDropped, 1)
+
+	return nil, false, ErrSlowConsumer
+}
+
+// slowConsumer marks the client as slow, or as caught up if recovered is true,
+// and reports it.
+func (this *service) slowConsumer(recovered bool) {
+	e := SlowConsumerEvent{
+		ClientId:  this.sess.ID(),
+		Policy:    this.server.SlowConsumerPolicy,
+		Recovered: recovered,
+		Pending:   this.out.Len(),
+		Time:      time.Now(),
+	}
+
+	if recovered {
+		atomic.StoreInt32(&this.slow, 0)
+		e.Dropped = atomic.SwapInt64(&this.slowDropped, 0)
+
+		this.logger().Info("service/slowConsumer: Slow consumer caught up", logging.F("dropped", e.Dropped))
+	} else {
+		atomic.StoreInt32(&this.slow, 1)
+		atomic.AddInt64(&this.server.slowConsumers, 1)
+
+		this.logger().Warn("service/slowConsumer: Slow consumer", logging.F("policy", e.Policy.String()), logging.F("pending", e.Pending))
+	}
+
+	if this.server.OnSlowConsumer != nil {
+		this.server.OnSlowConsumer(e)
+	}
+}
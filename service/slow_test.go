@@ -0,0 +1,141 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// newSlowTestService returns a service of svr whose outgoing buffer is full, and
+// nothing is sending it.
+func newSlowTestService(t *testing.T, svr *Server) *service {
+	out, err := newBuffer(2 * defaultReadBlockSize)
+	require.NoError(t, err)
+
+	_, err = out.Write(make([]byte, out.Free()-10))
+	require.NoError(t, err)
+
+	sess := &sessions.Session{}
+	require.NoError(t, sess.Init(newConnectMessage()))
+
+	return &service{out: out, server: svr, sess: sess}
+}
+
+func newSlowTestPublish(t *testing.T, qos byte) *sharedPublish {
+	msg := newTestPublish("abc")
+	msg.SetQoS(qos)
+	msg.SetPacketId(1)
+	msg.SetPayload(make([]byte, 100))
+
+	sp, err := newSharedPublish(msg)
+	require.NoError(t, err)
+
+	return sp
+}
+
+func TestSlowConsumerDropQos0(t *testing.T) {
+	var events []SlowConsumerEvent
+
+	svr := &Server{
+		SlowConsumerPolicy: SlowConsumerDropQos0,
+		SlowConsumerDelay:  50 * time.Millisecond,
+		OnSlowConsumer: func(e SlowConsumerEvent) {
+			events = append(events, e)
+		},
+	}
+
+	svc := newSlowTestService(t, svr)
+
+	sp := newSlowTestPublish(t, message.QosAtMostOnce)
+	defer sp.release()
+
+	// It takes the delay to find out the client is slow
+	start := time.Now()
+	_, err := svc.writeShared(sp, false, 0)
+	require.Equal(t, ErrSlowConsumer, err)
+	require.True(t, time.Since(start) >= 50*time.Millisecond)
+
+	require.Len(t, events, 1)
+	require.False(t, events[0].Recovered)
+	require.Equal(t, svc.sess.ID(), events[0].ClientId)
+
+	// and then the QoS 0 messages are dropped right away
+	start = time.Now()
+	_, err = svc.writeShared(sp, false, 0)
+	require.Equal(t, ErrSlowConsumer, err)
+	require.True(t, time.Since(start) < 50*time.Millisecond)
+
+	// while the QoS 1 ones wait for room
+	sp1 := newSlowTestPublish(t, message.QosAtLeastOnce)
+	defer sp1.release()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		svc.out.ReadCommit(svc.out.Len())
+	}()
+
+	_, err = svc.writeShared(sp1, false, 0)
+	require.NoError(t, err)
+
+	require.Len(t, events, 2)
+	require.True(t, events[1].Recovered)
+	require.Equal(t, int64(2), events[1].Dropped)
+
+	st := svr.Stats()
+	require.Equal(t, int64(1), st.SlowConsumers)
+	require.Equal(t, int64(2), st.SlowDropped)
+}
+
+func TestSlowConsumerBlock(t *testing.T) {
+	svr := &Server{SlowConsumerDelay: 10 * time.Millisecond}
+
+	svc := newSlowTestService(t, svr)
+
+	sp := newSlowTestPublish(t, message.QosAtMostOnce)
+	defer sp.release()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		svc.out.ReadCommit(svc.out.Len())
+	}()
+
+	// Nothing is dropped, however long it takes
+	_, err := svc.writeShared(sp, false, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), svr.Stats().SlowDropped)
+}
+
+func TestBufferWriteWaitTimeout(t *testing.T) {
+	out, err := newBuffer(2 * defaultReadBlockSize)
+	require.NoError(t, err)
+
+	_, err = out.Write(make([]byte, out.Free()))
+	require.NoError(t, err)
+
+	_, _, err = out.WriteWaitTimeout(10, 10*time.Millisecond)
+	require.Equal(t, errWriteTimeout, err)
+
+	// A timed out wait doesn't affect the next one
+	_, err = out.ReadCommit(100)
+	require.NoError(t, err)
+
+	_, _, err = out.WriteWait(10)
+	require.NoError(t, err)
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+)
+
+// ConnStats are the counters of a single connection.
+type ConnStats struct {
+	// The number of bytes and messages received from and sent to the other end
+	BytesIn  int64 `json:"bytes_in"`
+	MsgsIn   int64 `json:"msgs_in"`
+	BytesOut int64 `json:"bytes_out"`
+	MsgsOut  int64 `json:"msgs_out"`
+}
+
+func (this *ConnStats) add(st ConnStats) {
+	this.BytesIn += st.BytesIn
+	this.MsgsIn += st.MsgsIn
+	this.BytesOut += st.BytesOut
+	this.MsgsOut += st.MsgsOut
+}
+
+// Stats is a snapshot of the counters of a server, for exporting to a metrics
+// system. The counters only ever go up while the server is running, so they
+// can be exported as is and rates worked out from them.
+type Stats struct {
+	// Connections is the number of clients connected now, and Accepted the
+	// number of connections set up since the server started.
+	Connections int   `json:"connections"`
+	Accepted    int64 `json:"accepted"`
+
+	// The number of connections rejected because of MaxConnections, or
+	// MaxGoroutines, and MaxConnectionsPerIP respectively
+	RejectedMax int64 `json:"rejected_max"`
+	RejectedIP  int64 `json:"rejected_ip"`
+
+	// IPDropped is the number of connections the listeners dropped for coming
+	// from outside their allow lists, or from inside their deny lists, see
+	// ListenerConfig.Allow.
+	IPDropped int64 `json:"ip_dropped"`
+
+	// EventsDropped is the number of events the subscribers of Server.Events
+	// didn't keep up with.
+	EventsDropped int64 `json:"events_dropped"`
+
+	// Probes is the number of connections closed as load balancer health checks,
+	// see Server.DetectProbes.
+	Probes int64 `json:"probes"`
+
+	// HandshakeTimeouts is the number of connections closed for not getting
+	// through the handshake in time, see Server.HandshakeTimeout.
+	HandshakeTimeouts int64 `json:"handshake_timeouts"`
+
+	// Handshaking is the number of connections in their handshakes now, and
+	// HandshakesRejected the number closed for Server.MaxHandshakes.
+	// AcceptsPaced is the number of times a listener waited to accept a
+	// connection for Server.AcceptRate.
+	Handshaking        int64 `json:"handshaking"`
+	HandshakesRejected int64 `json:"handshakes_rejected"`
+	AcceptsPaced       int64 `json:"accepts_paced"`
+
+	// SlowConsumers is the number of times clients became slow consumers, and
+	// SlowDropped the number of messages dropped for them, see
+	// Server.SlowConsumerPolicy.
+	SlowConsumers int64 `json:"slow_consumers"`
+	SlowDropped   int64 `json:"slow_dropped"`
+
+	// InflightEvicted and InflightExpired are the number of messages sent to
+	// clients given up on before they were acked, see Server.MaxInflight and
+	// Server.InflightExpiry.
+	InflightEvicted int64 `json:"inflight_evicted"`
+	InflightExpired int64 `json:"inflight_expired"`
+
+	// OfflineSpilled is the number of messages the offline queues spilled to
+	// disk, and OfflineDropped the number dropped for having no room, see
+	// Server.OfflineQueue. OfflineDiskBytes is what they take up on disk now.
+	OfflineSpilled   int64 `json:"offline_spilled"`
+	OfflineDropped   int64 `json:"offline_dropped"`
+	OfflineDiskBytes int64 `json:"offline_disk_bytes"`
+
+	// SessionsExpired is the number of persistent sessions deleted for being
+	// disconnected for longer than Server.SessionExpiry.
+	SessionsExpired int64 `json:"sessions_expired"`
+
+	// WALSyncs is the number of times the write-ahead log was synced to disk,
+	// fewer than the messages written to it with group commits, and
+	// WALReplayed the number of messages published again from it when the
+	// server started, see Server.WAL.
+	WALSyncs    int64 `json:"wal_syncs"`
+	WALReplayed int64 `json:"wal_replayed"`
+
+	// FanoutQueued is the number of messages waiting for the fan-out workers
+	// now, and FanoutBlocked the number of times a client was held up by a full
+	// queue, see Server.FanoutWorkers.
+	FanoutQueued  int64 `json:"fanout_queued"`
+	FanoutBlocked int64 `json:"fanout_blocked"`
+
+	// Parked is the number of connections parked on the event loop now, see
+	// Server.EventLoop.
+	Parked int64 `json:"parked"`
+
+	// Total is what all the connections since the server started have
+	// received and sent, including the ones still open.
+	Total ConnStats `json:"total"`
+
+	// Clients are the counters of each connected client, keyed by client ID.
+	Clients map[string]ConnStats `json:"clients"`
+}
+
+// Stats returns a snapshot of the server's counters and those of each connected
+// client. The counters are read one at a time while the clients carry on, so
+// they may be a message or so apart from each other.
+func (this *Server) Stats() *Stats {
+	this.mu.Lock()
+	svcs := make([]*service, 0, len(this.clients))
+	for _, svc := range this.clients {
+		svcs = append(svcs, svc)
+	}
+	this.mu.Unlock()
+
+	st := &Stats{
+		Accepted:           atomic.LoadInt64(&this.accepted),
+		Probes:             atomic.LoadInt64(&this.probes),
+		HandshakeTimeouts:  atomic.LoadInt64(&this.handshakeTimeouts),
+		Handshaking:        atomic.LoadInt64(&this.handshaking),
+		HandshakesRejected: atomic.LoadInt64(&this.handshakesRejected),
+		AcceptsPaced:       atomic.LoadInt64(&this.acceptsPaced),
+		SlowConsumers:      atomic.LoadInt64(&this.slowConsumers),
+		SlowDropped:        atomic.LoadInt64(&this.slowDropped),
+		InflightEvicted:    atomic.LoadInt64(&this.inflightEvicted),
+		InflightExpired:    atomic.LoadInt64(&this.inflightExpired),
+		OfflineSpilled:     atomic.LoadInt64(&this.offlineSpilled),
+		OfflineDropped:     atomic.LoadInt64(&this.offlineDropped),
+		OfflineDiskBytes:   atomic.LoadInt64(&this.offlineBytes),
+		SessionsExpired:    atomic.LoadInt64(&this.sessionsExpired),
+		WALReplayed:        atomic.LoadInt64(&this.walReplayed),
+		FanoutBlocked:      atomic.LoadInt64(&this.fanoutBlocked),
+		Parked:             atomic.LoadInt64(&this.parked),
+		IPDropped:          atomic.LoadInt64(&this.ipDropped),
+		EventsDropped:      atomic.LoadInt64(&this.eventsDropped),
+		Clients:            make(map[string]ConnStats, len(svcs)),
+	}
+
+	st.RejectedMax, st.RejectedIP = this.RejectedConnections()
+
+	if this.wal != nil {
+		st.WALSyncs = atomic.LoadInt64(&this.wal.syncs)
+	}
+
+	if this.workers != nil {
+		for _, q := range this.workers.queues {
+			st.FanoutQueued += int64(len(q))
+		}
+	}
+
+	for _, svc := range svcs {
+		// Ones that are still connecting don't have a session yet
+		select {
+		case <-svc.ready:
+		default:
+			continue
+		}
+
+		if svc.sess == nil {
+			continue
+		}
+
+		cs := svc.stats()
+		st.Clients[svc.sess.ID()] = cs
+		st.Total.add(cs)
+	}
+
+	st.Connections = len(st.Clients)
+
+	// The ones that are gone are added last, so a client closing in the
+	// meantime is counted twice rather than not at all.
+	st.Total.add(ConnStats{
+		BytesIn:  atomic.LoadInt64(&this.closedIn.bytes),
+		MsgsIn:   atomic.LoadInt64(&this.closedIn.msgs),
+		BytesOut: atomic.LoadInt64(&this.closedOut.bytes),
+		MsgsOut:  atomic.LoadInt64(&this.closedOut.msgs),
+	})
+
+	return st
+}
+
+// Stats returns the counters of the client's connection to the server.
+func (this *Client) Stats() ConnStats {
+	if this.svc == nil {
+		return ConnStats{}
+	}
+
+	return this.svc.stats()
+}
+
+// addClosedStats adds the counters of svc, which has stopped, to the totals.
+func (this *Server) addClosedStats(svc *service) {
+	st := svc.stats()
+
+	atomic.AddInt64(&this.closedIn.bytes, st.BytesIn)
+	atomic.AddInt64(&this.closedIn.msgs, st.MsgsIn)
+	atomic.AddInt64(&this.closedOut.bytes, st.BytesOut)
+	atomic.AddInt64(&this.closedOut.msgs, st.MsgsOut)
+}
+
+func (this *service) stats() ConnStats {
+	return ConnStats{
+		BytesIn:  atomic.LoadInt64(&this.inStat.bytes),
+		MsgsIn:   atomic.LoadInt64(&this.inStat.msgs),
+		BytesOut: atomic.LoadInt64(&this.outStat.bytes),
+		MsgsOut:  atomic.LoadInt64(&this.outStat.msgs),
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerStats(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	st := svr.Stats()
+	require.Equal(t, 0, st.Connections)
+	require.Equal(t, ConnStats{}, st.Total)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	cmsg := newConnectMessage()
+	cmsg.SetClientId([]byte("counted"))
+	require.NoError(t, writeMessage(conn, cmsg))
+
+	connack, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	sub := newSubscribeMessage(message.QosAtLeastOnce)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	st = svr.Stats()
+	require.Equal(t, 1, st.Connections)
+	require.Equal(t, int64(1), st.Accepted)
+	require.Len(t, st.Clients, 1)
+
+	cs := st.Clients["counted"]
+	require.Equal(t, int64(2), cs.MsgsIn)
+	require.Equal(t, int64(cmsg.Len()+sub.Len()), cs.BytesIn)
+	require.Equal(t, int64(2), cs.MsgsOut)
+	require.Equal(t, cs, st.Total)
+
+	// What the client sent and received is still counted once it's gone
+	require.NoError(t, svr.Disconnect("counted"))
+
+	st = svr.Stats()
+	require.Equal(t, 0, st.Connections)
+	require.Len(t, st.Clients, 0)
+	require.Equal(t, int64(1), st.Accepted)
+	require.Equal(t, cs, st.Total)
+}
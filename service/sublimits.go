@@ -0,0 +1,124 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"time"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+var (
+	ErrTooManySubscriptions error = errors.New("service: Too many subscriptions")
+	ErrWildcardTooBroad     error = errors.New("service: Wildcard too broad")
+)
+
+// SubscriptionLimits are the limits on what a client can subscribe to. The
+// subscriptions over them get a SUBACK return code of 0x80 (failure).
+type SubscriptionLimits struct {
+	// MaxSubscriptions is the number of topic filters the client can be
+	// subscribed to at once. Subscribing to one it's already subscribed to
+	// doesn't count. If not set then there's no limit.
+	MaxSubscriptions int
+
+	// MinWildcardDepth is the number of levels a topic filter needs before its
+	// first wildcard, e.g. 1 refuses "#" and "+/status" but not "sensors/#", so
+	// a client can't subscribe to everything. If not set then there's no limit.
+	MinWildcardDepth int
+}
+
+// SubscriptionRejectedEvent is reported to OnSubscriptionRejected for each topic
+// filter a client was refused because of its SubscriptionLimits.
+type SubscriptionRejectedEvent struct {
+	ClientId string
+	Topic    string
+
+	// Err is ErrTooManySubscriptions or ErrWildcardTooBroad.
+	Err error
+
+	Time time.Time
+}
+
+// wildcardDepth returns the number of levels of filter before its first
+// wildcard, or -1 if it has none.
+func wildcardDepth(filter []byte) int {
+	depth := 0
+
+	for i, c := range filter {
+		switch c {
+		case '/':
+			depth++
+
+		case '+', '#':
+			// Only a whole level is a wildcard
+			if i == 0 || filter[i-1] == '/' {
+				return depth
+			}
+		}
+	}
+
+	return -1
+}
+
+// checkSubscription makes sure the client of the service can subscribe to
+// filter, within the limits the server has for it. existed is whether it's
+// already subscribed to it.
+func (this *service) checkSubscription(filter []byte, existed bool) error {
+	if this.server == nil || this.server.SubscriptionLimits == nil {
+		return nil
+	}
+
+	limits := this.server.SubscriptionLimits(this.sess.ID(), string(this.sess.Cmsg.Username()))
+
+	if limits.MinWildcardDepth > 0 {
+		// The levels of the tenant prefix are the server's, not the client's
+		own := filter
+		if this.tenant != "" {
+			if t := untenantTopic(filter); t != nil {
+				own = t
+			}
+		}
+
+		if d := wildcardDepth(own); d >= 0 && d < limits.MinWildcardDepth {
+			return this.rejectSubscription(filter, ErrWildcardTooBroad)
+		}
+	}
+
+	if limits.MaxSubscriptions > 0 && !existed {
+		if topics, _, err := this.sess.Topics(); err == nil && len(topics) >= limits.MaxSubscriptions {
+			return this.rejectSubscription(filter, ErrTooManySubscriptions)
+		}
+	}
+
+	return nil
+}
+
+// rejectSubscription reports the subscription to filter was refused with err,
+// and returns err.
+func (this *service) rejectSubscription(filter []byte, err error) error {
+	this.logger().Info("service/checkSubscription: Rejecting subscription", logging.F("topic", string(filter)), logging.Err(err))
+
+	if this.server.OnSubscriptionRejected != nil {
+		this.server.OnSubscriptionRejected(SubscriptionRejectedEvent{
+			ClientId: this.sess.ID(),
+			Topic:    string(filter),
+			Err:      err,
+			Time:     time.Now(),
+		})
+	}
+
+	return err
+}
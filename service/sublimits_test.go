@@ -0,0 +1,78 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestWildcardDepth(t *testing.T) {
+	require.Equal(t, 0, wildcardDepth([]byte("#")))
+	require.Equal(t, 0, wildcardDepth([]byte("+/status")))
+	require.Equal(t, 1, wildcardDepth([]byte("sensors/#")))
+	require.Equal(t, 2, wildcardDepth([]byte("a/b/+/c")))
+	require.Equal(t, -1, wildcardDepth([]byte("a/b")))
+}
+
+func TestServerSubscriptionLimits(t *testing.T) {
+	events := make(chan SubscriptionRejectedEvent, 10)
+
+	svr := &Server{
+		SubscriptionLimits: func(cid, username string) SubscriptionLimits {
+			if username == "admin" {
+				return SubscriptionLimits{}
+			}
+			return SubscriptionLimits{MaxSubscriptions: 2, MinWildcardDepth: 1}
+		},
+		OnSubscriptionRejected: func(e SubscriptionRejectedEvent) {
+			events <- e
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	c, err := connectTestClient(t, ln)
+	require.NoError(t, err)
+	defer c.Disconnect()
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("#"), message.QosAtMostOnce)
+	sub.AddTopic([]byte("a/#"), message.QosAtMostOnce)
+	sub.AddTopic([]byte("b/+"), message.QosAtMostOnce)
+	sub.AddTopic([]byte("c"), message.QosAtMostOnce)
+
+	retcodes := make(chan []byte, 1)
+	require.NoError(t, c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		retcodes <- ack.(*message.SubackMessage).ReturnCodes()
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		return nil
+	}))
+
+	require.Equal(t, []byte{message.QosFailure, message.QosAtMostOnce, message.QosAtMostOnce, message.QosFailure}, <-retcodes)
+
+	e := <-events
+	require.Equal(t, "#", e.Topic)
+	require.Equal(t, ErrWildcardTooBroad, e.Err)
+
+	e = <-events
+	require.Equal(t, "c", e.Topic)
+	require.Equal(t, ErrTooManySubscriptions, e.Err)
+}
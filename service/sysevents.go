@@ -0,0 +1,187 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+const (
+	// ConnectedTopic and DisconnectedTopic are the topics the connection events of
+	// a client are published to, with its client ID, see
+	// Server.ConnectionEvents.
+	ConnectedTopic    = "$SYS/brokers/clients/%s/connected"
+	DisconnectedTopic = "$SYS/brokers/clients/%s/disconnected"
+)
+
+// DisconnectReason is why a client was disconnected.
+type DisconnectReason int32
+
+const (
+	// DisconnectConnectionLost is a connection that was closed, or failed,
+	// without the client sending a DISCONNECT.
+	DisconnectConnectionLost DisconnectReason = iota
+
+	// DisconnectNormal is a client that sent a DISCONNECT.
+	DisconnectNormal
+
+	// DisconnectProtocolError is a client that sent a packet it shouldn't have,
+	// or one that couldn't be decoded.
+	DisconnectProtocolError
+
+	// DisconnectKeepAlive is a client that was silent for longer than its
+	// keepalive allows.
+	DisconnectKeepAlive
+
+	// DisconnectTakeover is a client that connected again with the same client
+	// ID, from another connection.
+	DisconnectTakeover
+
+	// DisconnectSlowConsumer is a client disconnected by the
+	// SlowConsumerDisconnect policy.
+	DisconnectSlowConsumer
+
+	// DisconnectKicked is a client disconnected by Server.Disconnect, or by a
+	// ban.
+	DisconnectKicked
+
+	// DisconnectServerShutdown is a client disconnected by the server closing.
+	DisconnectServerShutdown
+
+	// DisconnectBridgeFailed is a client disconnected because a bridge failed to
+	// take a QoS 1 message it published, see Bridge.
+	DisconnectBridgeFailed
+)
+
+func (this DisconnectReason) String() string {
+	switch this {
+	case DisconnectConnectionLost:
+		return "connection_lost"
+	case DisconnectNormal:
+		return "normal"
+	case DisconnectProtocolError:
+		return "protocol_error"
+	case DisconnectKeepAlive:
+		return "keepalive_timeout"
+	case DisconnectTakeover:
+		return "takeover"
+	case DisconnectSlowConsumer:
+		return "slow_consumer"
+	case DisconnectKicked:
+		return "kicked"
+	case DisconnectServerShutdown:
+		return "server_shutdown"
+	case DisconnectBridgeFailed:
+		return "bridge_failed"
+	}
+
+	return "unknown"
+}
+
+// ConnectionEvent is published as JSON to ConnectedTopic when a client connects,
+// and to DisconnectedTopic when it disconnects, with the Reason it did.
+type ConnectionEvent struct {
+	ClientId string    `json:"client_id"`
+	Username string    `json:"username,omitempty"`
+	IP       string    `json:"ip"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// setReason records why the service is being stopped. Only the first reason
+// counts, as whatever follows is a consequence of it, e.g. the receiver failing
+// once the connection of a client that's been taken over is closed.
+func (this *service) setReason(r DisconnectReason) {
+	atomic.CompareAndSwapInt32(&this.reason, 0, int32(r))
+}
+
+// disconnectReason returns why the service was stopped.
+func (this *service) disconnectReason() DisconnectReason {
+	return DisconnectReason(atomic.LoadInt32(&this.reason))
+}
+
+// stopWith stops the service for reason r.
+func (this *service) stopWith(r DisconnectReason) {
+	this.setReason(r)
+	this.stop()
+}
+
+// connectionEvent publishes the connected, or disconnected, event of the client
+// of svc if the server has ConnectionEvents on. The disconnected event is only
+// published for the clients whose connected event was.
+func (this *Server) connectionEvent(svc *service, connected bool) {
+	if !this.ConnectionEvents {
+		return
+	}
+
+	if connected {
+		atomic.StoreInt32(&svc.announced, 1)
+	} else if !atomic.CompareAndSwapInt32(&svc.announced, 1, 0) {
+		return
+	}
+
+	cid := svc.sess.ID()
+
+	// There's no topic for a client ID that can't be a topic level
+	if cid == "" || strings.ContainsAny(cid, "/+#") {
+		svc.logger().Debug("server/connectionEvent: No topic for client ID")
+		return
+	}
+
+	ev := ConnectionEvent{
+		ClientId: cid,
+		Username: string(svc.sess.Cmsg.Username()),
+		IP:       addrIP(svc.remoteAddr),
+		Time:     time.Now().UTC(),
+	}
+
+	topic := ConnectedTopic
+	if !connected {
+		topic = DisconnectedTopic
+		ev.Reason = svc.disconnectReason().String()
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		svc.logger().Error("server/connectionEvent: Error encoding event", logging.Err(err))
+		return
+	}
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(fmt.Sprintf(topic, cid)))
+	msg.SetPayload(payload)
+
+	if _, err := this.Publish(msg, nil); err != nil {
+		svc.logger().Error("server/connectionEvent: Error publishing event", logging.F("topic", string(msg.Topic())), logging.Err(err))
+	}
+}
+
+// addrIP is remoteIP for an address kept as a string.
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestServerConnectionEvents(t *testing.T) {
+	svr := &Server{ConnectionEvents: true}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	events := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		events <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("$SYS/brokers/clients/+/+"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	next := func(topic string) ConnectionEvent {
+		select {
+		case msg := <-events:
+			require.Equal(t, topic, string(msg.Topic()))
+
+			var ev ConnectionEvent
+			require.NoError(t, json.Unmarshal(msg.Payload(), &ev))
+			return ev
+
+		case <-time.After(time.Second):
+			t.Fatalf("No event on %s", topic)
+		}
+		return ConnectionEvent{}
+	}
+
+	for _, disconnect := range []bool{true, false} {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+
+		cmsg := newConnectMessage()
+		cid := string(cmsg.ClientId())
+
+		require.NoError(t, writeMessage(conn, cmsg))
+		_, err = getConnackMessage(conn)
+		require.NoError(t, err)
+
+		ev := next(fmt.Sprintf(ConnectedTopic, cid))
+		require.Equal(t, cid, ev.ClientId)
+		require.Equal(t, "surgemq", ev.Username)
+		require.Equal(t, "127.0.0.1", ev.IP)
+		require.Empty(t, ev.Reason)
+		require.False(t, ev.Time.IsZero())
+
+		reason := DisconnectConnectionLost
+		if disconnect {
+			reason = DisconnectNormal
+			require.NoError(t, writeMessage(conn, message.NewDisconnectMessage()))
+		}
+		conn.Close()
+
+		ev = next(fmt.Sprintf(DisconnectedTopic, cid))
+		require.Equal(t, cid, ev.ClientId)
+		require.Equal(t, reason.String(), ev.Reason)
+	}
+}
+
+func TestServerConnectionEventsTakeover(t *testing.T) {
+	svr := &Server{ConnectionEvents: true}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	reasons := make(chan string, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		var ev ConnectionEvent
+		if err := json.Unmarshal(msg.Payload(), &ev); err == nil {
+			reasons <- ev.Reason
+		}
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte("$SYS/brokers/clients/+/disconnected"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	cmsg := newConnectMessage()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, writeMessage(conn, cmsg))
+		_, err = getConnackMessage(conn)
+		require.NoError(t, err)
+	}
+
+	select {
+	case reason := <-reasons:
+		require.Equal(t, DisconnectTakeover.String(), reason)
+	case <-time.After(time.Second):
+		t.Fatal("No disconnected event")
+	}
+
+	// The connected event of the other comes after its CONNACK
+	require.True(t, waitFor(func() bool {
+		svr.mu.Lock()
+		defer svr.mu.Unlock()
+
+		svc := svr.clients[string(cmsg.ClientId())]
+		return svc != nil && atomic.LoadInt32(&svc.announced) == 1
+	}))
+
+	// The server closing disconnects the other
+	svr.Close()
+
+	select {
+	case reason := <-reasons:
+		require.Equal(t, DisconnectServerShutdown.String(), reason)
+	case <-time.After(time.Second):
+		t.Fatal("No disconnected event")
+	}
+}
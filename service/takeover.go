@@ -0,0 +1,69 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync/atomic"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+// takeover registers svc as the service for client ID cid. If another service is
+// already registered for the same client ID, it's disconnected, and takeover
+// doesn't return until it has completely stopped. By then the old service has
+// unsubscribed its topics and is no longer using the session's ack queues, so
+// the new service can safely pick up the session.
+func (this *Server) takeover(cid string, svc *service) {
+	this.mu.Lock()
+	if this.clients == nil {
+		this.clients = make(map[string]*service)
+	}
+	old := this.clients[cid]
+	this.clients[cid] = svc
+	this.mu.Unlock()
+
+	if old == nil {
+		return
+	}
+
+	// The old service may still be connecting, wait for it to finish first.
+	<-old.ready
+
+	// If it never got a session, then it was never started and there's nothing
+	// to stop.
+	if old.sess == nil {
+		return
+	}
+
+	svc.logger().Info("server/takeover: Client ID in use, disconnecting the other connection.", logging.F("old_remote_addr", old.remoteAddr))
+
+	// The client wouldn't have connected again if the old connection was still
+	// working for it
+	atomic.StoreInt32(&old.dropped, 1)
+
+	old.stopWith(DisconnectTakeover)
+	<-old.stopped
+}
+
+// unregister removes svc as the service for client ID cid, unless it has already
+// been replaced by another service.
+func (this *Server) unregister(cid string, svc *service) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.clients[cid] == svc {
+		delete(this.clients, cid)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestServerTakeover(t *testing.T) {
+	svr := &Server{}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	newTakeoverConnectMessage := func() *message.ConnectMessage {
+		msg := newConnectMessage()
+		msg.SetClientId([]byte("takeover"))
+		msg.SetCleanSession(false)
+		return msg
+	}
+
+	// The first client talks to the server directly, as a Client would register
+	// a topics provider under the same name as the second one.
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newTakeoverConnectMessage()))
+
+	connack, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, connack.ReturnCode())
+
+	sub := newSubscribeMessage(1)
+	sub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, sub))
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	c := &Client{}
+	require.NoError(t, c.Connect("tcp://"+ln.Addr().String(), newTakeoverConnectMessage()))
+	topics.Unregister(c.svc.sess.ID())
+	defer c.Disconnect()
+
+	// The first connection should be closed by the server
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	svr.mu.Lock()
+	svc := svr.clients["takeover"]
+	n := len(svr.clients)
+	svr.mu.Unlock()
+
+	require.Equal(t, 1, n)
+	require.NotNil(t, svc)
+	require.Equal(t, "takeover", svc.sess.ID())
+
+	// Only the new service should be subscribed to the session's topics
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	require.NoError(t, svr.topicsMgr.Subscribers([]byte("abc"), 1, &subs, &qoss))
+	require.Equal(t, 1, len(subs))
+	require.Equal(t, &svc.onpub, subs[0])
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/surgemq/message"
+)
+
+var (
+	ErrNoTenant error = errors.New("service: Client has no valid tenant")
+)
+
+// TenantPrefix is what the topics of each tenant are put under, followed by the
+// tenant and a "/". A client of tenant "acme" publishing to "sensors/1" publishes
+// to "$tenant/acme/sensors/1" as far as the server is concerned.
+const TenantPrefix = "$tenant/"
+
+// TenancyMode is where the tenant of a client comes from, see Server.Tenancy.
+type TenancyMode int
+
+const (
+	// TenancyOff puts all the clients in the same topic namespace.
+	TenancyOff TenancyMode = iota
+
+	// TenancyUsername makes the username of a client its tenant.
+	TenancyUsername
+
+	// TenancyCertificate makes the common name of the TLS certificate a client
+	// presents its tenant.
+	TenancyCertificate
+
+	// TenancyListener makes the name of the listener a client connects through
+	// its tenant, or the local address of the listener for the ones passed to
+	// ListenAndServe and Serve.
+	TenancyListener
+
+	// TenancyFunc makes the tenant of a client whatever Server.Tenant returns for
+	// its client ID.
+	TenancyFunc
+)
+
+// tenantOf returns the tenant of the client connecting on conn, through l, with
+// the CONNECT message req. It's empty if tenancy is off, and ErrNoTenant if the
+// client doesn't have a tenant, or has one that can't be a topic level.
+func (this *Server) tenantOf(conn net.Conn, l *listener, req *message.ConnectMessage) (string, error) {
+	var tenant string
+
+	switch this.Tenancy {
+	case TenancyOff:
+		return "", nil
+
+	case TenancyUsername:
+		tenant = string(req.Username())
+
+	case TenancyCertificate:
+		tenant = certCommonName(conn)
+
+	case TenancyListener:
+		if l != nil {
+			tenant = l.Name
+		} else if conn.LocalAddr() != nil {
+			tenant = conn.LocalAddr().String()
+		}
+
+	case TenancyFunc:
+		if this.Tenant != nil {
+			tenant = this.Tenant(string(req.ClientId()))
+		}
+	}
+
+	if tenant == "" || strings.ContainsAny(tenant, "/+#") {
+		return "", ErrNoTenant
+	}
+
+	return tenant, nil
+}
+
+// certCommonName returns the common name of the certificate the client on conn
+// presented, if it's a TLS connection and it presented one.
+func certCommonName(conn interface{}) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+
+	return certs[0].Subject.CommonName
+}
+
+// tenantTopic returns topic, or the topic filter, put under the tenant of the
+// client of the service.
+func (this *service) tenantTopic(topic []byte) []byte {
+	if this.tenant == "" {
+		return topic
+	}
+
+	t := make([]byte, 0, len(TenantPrefix)+len(this.tenant)+1+len(topic))
+	t = append(t, TenantPrefix...)
+	t = append(t, this.tenant...)
+	t = append(t, '/')
+
+	return append(t, topic...)
+}
+
+// untenant returns msg with the tenant prefix of the client of the service taken
+// off its topic, so the client gets the message on the topic it subscribed to.
+// The message is copied, as it's shared with the other subscribers.
+func (this *service) untenant(msg *message.PublishMessage) *message.PublishMessage {
+	if this.tenant == "" {
+		return msg
+	}
+
+	prefix := len(TenantPrefix) + len(this.tenant) + 1
+	topic := msg.Topic()
+
+	if len(topic) <= prefix || !bytes.HasPrefix(topic, []byte(TenantPrefix)) || string(topic[len(TenantPrefix):prefix-1]) != this.tenant {
+		return msg
+	}
+
+	return withTopic(msg, topic[prefix:])
+}
+
+// untenantTopic returns topic without the tenant prefix, or nil if it doesn't
+// have one.
+func untenantTopic(topic []byte) []byte {
+	if !bytes.HasPrefix(topic, []byte(TenantPrefix)) {
+		return nil
+	}
+
+	i := bytes.IndexByte(topic[len(TenantPrefix):], '/')
+	if i < 0 || len(TenantPrefix)+i+1 == len(topic) {
+		return nil
+	}
+
+	return topic[len(TenantPrefix)+i+1:]
+}
+
+// withTopic returns a copy of msg published to topic instead.
+func withTopic(msg *message.PublishMessage, topic []byte) *message.PublishMessage {
+	m := message.NewPublishMessage()
+	m.SetTopic(topic)
+	m.SetPayload(msg.Payload())
+	m.SetQoS(msg.QoS())
+	m.SetPacketId(msg.PacketId())
+	m.SetRetain(msg.Retain())
+
+	return m
+}
+
+// withPacketId returns a copy of msg with the packet ID pktid.
+func withPacketId(msg *message.PublishMessage, pktid uint16) *message.PublishMessage {
+	m := withTopic(msg, msg.Topic())
+	m.SetPacketId(pktid)
+
+	return m
+}
+
+// willMessage returns the will of the client of the service, with its topic
+// rewritten and put under the tenant of the client the way the topics it
+// publishes to are.
+func (this *service) willMessage() *message.PublishMessage {
+	will := this.sess.Will
+
+	topic := this.rewrite(RewritePublish, will.Topic())
+	if bytes.Equal(topic, will.Topic()) {
+		return will
+	}
+
+	return withTopic(will, topic)
+}
+
+// TenantInfo is what's going on in one of the tenants.
+type TenantInfo struct {
+	Tenant string `json:"tenant"`
+
+	// Clients are the IDs of the connected clients of the tenant, sorted.
+	Clients []string `json:"clients"`
+
+	// Subscriptions is the number of topic filters the clients are subscribed to.
+	Subscriptions int `json:"subscriptions"`
+}
+
+// Tenants returns the tenants with connected clients, sorted by tenant. The
+// topics of each tenant are under TenantPrefix, followed by the tenant, for
+// the admin API and the in-process subscribers, which see all of them.
+func (this *Server) Tenants() []TenantInfo {
+	byTenant := make(map[string]*TenantInfo)
+
+	for _, ci := range this.Clients() {
+		if ci.Tenant == "" {
+			continue
+		}
+
+		ti := byTenant[ci.Tenant]
+		if ti == nil {
+			ti = &TenantInfo{Tenant: ci.Tenant, Clients: []string{}}
+			byTenant[ci.Tenant] = ti
+		}
+
+		ti.Clients = append(ti.Clients, ci.ClientId)
+		ti.Subscriptions += len(ci.Subscriptions)
+	}
+
+	infos := make([]TenantInfo, 0, len(byTenant))
+	for _, ti := range byTenant {
+		sort.Strings(ti.Clients)
+		infos = append(infos, *ti)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Tenant < infos[j].Tenant
+	})
+
+	return infos
+}
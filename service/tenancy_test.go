@@ -0,0 +1,127 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func connectTenantClient(t *testing.T, addr, username string) (*Client, chan *message.PublishMessage) {
+	msg := newConnectMessage()
+	msg.SetUsername([]byte(username))
+
+	c := &Client{}
+	require.NoError(t, c.Connect("tcp://"+addr, msg))
+	topics.Unregister(c.svc.sess.ID())
+
+	got := make(chan *message.PublishMessage, 10)
+
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	sub.AddTopic([]byte("#"), message.QosAtMostOnce)
+
+	subscribed := make(chan struct{})
+	require.NoError(t, c.Subscribe(sub, func(msg, ack message.Message, err error) error {
+		close(subscribed)
+		return nil
+	}, func(msg *message.PublishMessage) error {
+		got <- msg
+		return nil
+	}))
+	<-subscribed
+
+	return c, got
+}
+
+func TestServerTenancy(t *testing.T) {
+	svr := &Server{Tenancy: TenancyUsername}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	all := make(chan *message.PublishMessage, 10)
+	var onpub OnPublishFunc = func(msg *message.PublishMessage) error {
+		all <- msg
+		return nil
+	}
+
+	_, err := svr.Subscribe([]byte(TenantPrefix+"acme/#"), message.QosAtMostOnce, &onpub)
+	require.NoError(t, err)
+
+	c1, got1 := connectTenantClient(t, ln.Addr().String(), "acme")
+	defer c1.Disconnect()
+
+	c2, got2 := connectTenantClient(t, ln.Addr().String(), "globex")
+	defer c2.Disconnect()
+
+	require.NoError(t, c1.Publish(newTestPublish("sensors/1"), nil))
+
+	// The publisher's tenant gets the message on the topic it was published to
+	select {
+	case msg := <-got1:
+		require.Equal(t, "sensors/1", string(msg.Topic()))
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message")
+	}
+
+	select {
+	case msg := <-all:
+		require.Equal(t, "$tenant/acme/sensors/1", string(msg.Topic()))
+
+	case <-time.After(time.Second):
+		require.FailNow(t, "Timed out waiting for the message")
+	}
+
+	// The other tenant doesn't, even though it's subscribed to everything
+	select {
+	case msg := <-got2:
+		require.FailNow(t, "Message leaked to another tenant", string(msg.Topic()))
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	infos := svr.Tenants()
+	require.Len(t, infos, 2)
+	require.Equal(t, "acme", infos[0].Tenant)
+	require.Equal(t, []string{c1.svc.sess.ID()}, infos[0].Clients)
+	require.Equal(t, 1, infos[0].Subscriptions)
+	require.Equal(t, "globex", infos[1].Tenant)
+}
+
+func TestServerTenancyRefused(t *testing.T) {
+	svr := &Server{Tenancy: TenancyUsername}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	msg := newConnectMessage()
+	msg.SetUsername([]byte("acme/#"))
+
+	c := &Client{}
+	require.Error(t, c.Connect("tcp://"+ln.Addr().String(), msg))
+}
+
+func TestUntenantTopic(t *testing.T) {
+	require.Equal(t, "a/b", string(untenantTopic([]byte("$tenant/acme/a/b"))))
+	require.Nil(t, untenantTopic([]byte("$tenant/acme/")))
+	require.Nil(t, untenantTopic([]byte("$tenant/acme")))
+	require.Nil(t, untenantTopic([]byte("a/b")))
+}
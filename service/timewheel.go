@@ -0,0 +1,310 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/surgemq/logging"
+)
+
+const (
+	// The resolution and number of slots of the server's timer wheels. One
+	// revolution of a wheel is a little over 51 seconds, timers longer than that
+	// just go around more than once.
+	wheelTick  = 100 * time.Millisecond
+	wheelSlots = 512
+)
+
+// timerWheel is a hashed timing wheel. Timers are put in one of a fixed number of
+// slots based on when they expire, and a single goroutine advances through the
+// slots once every tick, firing the timers that are due. Adding, resetting and
+// stopping a timer are all O(1), and there's only ever one runtime timer per
+// wheel no matter how many timers are scheduled, which matters when there are
+// hundreds of thousands of connections each with their own keepalive.
+//
+// The price is precision, timers fire on the first tick after they are due.
+type timerWheel struct {
+	mu    sync.Mutex
+	tick  time.Duration
+	slots []*wheelTimer
+	pos   int
+
+	// When the wheel started, and the number of ticks it has advanced by, which
+	// falls behind when its goroutine is held up
+	start time.Time
+	ticks int
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// wheelTimer is a single timer on a timerWheel. Timers in the same slot are kept
+// in a doubly linked list so they can be removed without searching.
+type wheelTimer struct {
+	w *timerWheel
+	f func()
+
+	// The slot the timer is in, and how many more times the wheel has to go
+	// around before it's due.
+	slot   int
+	rounds int
+
+	prev, next *wheelTimer
+
+	// Whether the timer is in a slot, and whether it has been stopped for good
+	scheduled bool
+	stopped   bool
+}
+
+func newTimerWheel(tick time.Duration, slots int) *timerWheel {
+	w := &timerWheel{
+		tick:  tick,
+		slots: make([]*wheelTimer, slots),
+		start: time.Now(),
+		done:  make(chan struct{}),
+	}
+
+	go w.run()
+
+	return w
+}
+
+// AfterFunc calls f, on the wheel's goroutine, once d has passed. f must not block
+// since it holds up all the other timers on the wheel.
+func (this *timerWheel) AfterFunc(d time.Duration, f func()) *wheelTimer {
+	t := &wheelTimer{w: this, f: f}
+
+	this.mu.Lock()
+	this.schedule(t, d)
+	this.mu.Unlock()
+
+	return t
+}
+
+// Stop stops the wheel. Any timers still scheduled never fire. It's safe to call
+// more than once.
+func (this *timerWheel) Stop() {
+	this.stopOnce.Do(func() {
+		close(this.done)
+	})
+}
+
+func (this *timerWheel) run() {
+	ticker := time.NewTicker(this.tick)
+	defer ticker.Stop()
+
+	var due []*wheelTimer
+
+	for {
+		select {
+		case <-this.done:
+			return
+
+		case <-ticker.C:
+		}
+
+		due = this.advance(due[:0])
+
+		for _, t := range due {
+			t.f()
+		}
+	}
+}
+
+// advance moves the wheel forward to the current tick, one slot at a time, and
+// appends the timers that are due to due. That's more than one tick if the
+// wheel's goroutine was held up and missed some.
+func (this *timerWheel) advance(due []*wheelTimer) []*wheelTimer {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for now := this.now(); this.ticks < now; this.ticks++ {
+		this.pos = (this.pos + 1) % len(this.slots)
+
+		for t := this.slots[this.pos]; t != nil; {
+			next := t.next
+
+			if t.rounds > 0 {
+				t.rounds--
+			} else {
+				this.remove(t)
+				due = append(due, t)
+			}
+
+			t = next
+		}
+	}
+
+	return due
+}
+
+// now returns the number of ticks since the wheel started.
+func (this *timerWheel) now() int {
+	return int(time.Since(this.start) / this.tick)
+}
+
+// schedule puts t in the slot that's d away from the current position. The wheel
+// must be locked.
+func (this *timerWheel) schedule(t *wheelTimer, d time.Duration) {
+	// The next tick is anywhere up to a tick away, so it doesn't count. Neither do
+	// the ticks that are already due, but that the wheel hasn't got to yet.
+	ticks := int((d+this.tick-1)/this.tick) + 1
+	if ticks < 2 {
+		ticks = 2
+	}
+	ticks += this.now() - this.ticks
+
+	t.slot = (this.pos + ticks) % len(this.slots)
+	t.rounds = (ticks - 1) / len(this.slots)
+	t.scheduled = true
+
+	t.prev = nil
+	t.next = this.slots[t.slot]
+	if t.next != nil {
+		t.next.prev = t
+	}
+	this.slots[t.slot] = t
+}
+
+// remove takes t out of its slot. The wheel must be locked.
+func (this *timerWheel) remove(t *wheelTimer) {
+	if !t.scheduled {
+		return
+	}
+
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		this.slots[t.slot] = t.next
+	}
+
+	if t.next != nil {
+		t.next.prev = t.prev
+	}
+
+	t.prev, t.next = nil, nil
+	t.scheduled = false
+}
+
+// Reset changes the timer to fire once d has passed, whether or not it has
+// already fired. It does nothing if the timer has been stopped.
+func (this *wheelTimer) Reset(d time.Duration) {
+	this.w.mu.Lock()
+	defer this.w.mu.Unlock()
+
+	if this.stopped {
+		return
+	}
+
+	this.w.remove(this)
+	this.w.schedule(this, d)
+}
+
+// Stop stops the timer for good, it won't fire again even if Reset is called.
+func (this *wheelTimer) Stop() {
+	this.w.mu.Lock()
+	defer this.w.mu.Unlock()
+
+	this.stopped = true
+	this.w.remove(this)
+}
+
+// timerWheels is a set of timer wheels shared by all the connections on the
+// server. Each connection uses one of the wheels, picked by its service ID, so
+// that they don't all contend for the same lock.
+type timerWheels []*timerWheel
+
+func newTimerWheels(n int, tick time.Duration, slots int) timerWheels {
+	if n < 1 {
+		n = 1
+	}
+
+	ws := make(timerWheels, n)
+	for i := range ws {
+		ws[i] = newTimerWheel(tick, slots)
+	}
+
+	return ws
+}
+
+func (this timerWheels) get(id uint64) *timerWheel {
+	return this[id%uint64(len(this))]
+}
+
+func (this timerWheels) Stop() {
+	for _, w := range this {
+		w.Stop()
+	}
+}
+
+// idleReader reads from conn, and closes it if nothing has been read in d. To
+// keep the cost of a read down, it doesn't touch the timer on every read. It
+// just records the time of the last read, and when the timer fires, it either
+// closes the connection or schedules itself again for the time that's left.
+type idleReader struct {
+	conn net.Conn
+	d    time.Duration
+	log  logging.Logger
+
+	// UnixNano time of the last successful read, and whether the connection was
+	// closed for being idle
+	last    int64
+	expired int32
+
+	t *wheelTimer
+}
+
+func newIdleReader(w *timerWheel, conn net.Conn, d time.Duration, log logging.Logger) *idleReader {
+	r := &idleReader{
+		conn: conn,
+		d:    d,
+		log:  log,
+		last: time.Now().UnixNano(),
+	}
+
+	r.t = w.AfterFunc(d, r.check)
+
+	return r
+}
+
+func (this *idleReader) Read(b []byte) (int, error) {
+	n, err := this.conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&this.last, time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// Stop stops watching the connection. It doesn't close it.
+func (this *idleReader) Stop() {
+	this.t.Stop()
+}
+
+func (this *idleReader) check() {
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&this.last)))
+	if idle < this.d {
+		this.t.Reset(this.d - idle)
+		return
+	}
+
+	this.log.Error("service/idleReader: No data received, closing connection.", logging.F("idle", idle))
+	atomic.StoreInt32(&this.expired, 1)
+	this.conn.Close()
+}
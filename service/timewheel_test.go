@@ -0,0 +1,163 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/logging"
+)
+
+func TestTimerWheelAfterFunc(t *testing.T) {
+	w := newTimerWheel(time.Millisecond, 8)
+	defer w.Stop()
+
+	// 50 ticks is several times around the wheel
+	start := time.Now()
+	fired := make(chan time.Duration, 1)
+
+	w.AfterFunc(50*time.Millisecond, func() {
+		fired <- time.Since(start)
+	})
+
+	select {
+	case d := <-fired:
+		require.True(t, d >= 50*time.Millisecond, "Timer fired early after %v", d)
+
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the timer to fire")
+	}
+}
+
+func TestTimerWheelNotEarly(t *testing.T) {
+	w := newTimerWheel(10*time.Millisecond, 8)
+	defer w.Stop()
+
+	// Scheduled just before a tick, a timer still waits its full duration
+	time.Sleep(9 * time.Millisecond)
+
+	start := time.Now()
+	fired := make(chan time.Duration, 1)
+
+	w.AfterFunc(20*time.Millisecond, func() {
+		fired <- time.Since(start)
+	})
+
+	select {
+	case d := <-fired:
+		require.True(t, d >= 20*time.Millisecond, "Timer fired early after %v", d)
+
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the timer to fire")
+	}
+}
+
+func TestTimerWheelHeldUp(t *testing.T) {
+	// Not running, as if its goroutine had been held up for three and a half ticks
+	w := &timerWheel{
+		tick:  time.Second,
+		slots: make([]*wheelTimer, 8),
+		start: time.Now().Add(-3500 * time.Millisecond),
+	}
+
+	w.AfterFunc(2*time.Second, func() {})
+
+	// It's due five and a half ticks in, so it doesn't fire as the wheel catches
+	// up with the ticks it missed, but on the sixth
+	require.Empty(t, w.advance(nil))
+
+	w.start = w.start.Add(-2 * time.Second)
+	require.Empty(t, w.advance(nil))
+
+	w.start = w.start.Add(-time.Second)
+	require.Len(t, w.advance(nil), 1)
+}
+
+func TestTimerWheelStop(t *testing.T) {
+	w := newTimerWheel(time.Millisecond, 8)
+	defer w.Stop()
+
+	var fired int32
+
+	tm := w.AfterFunc(10*time.Millisecond, func() {
+		atomic.StoreInt32(&fired, 1)
+	})
+	tm.Stop()
+	tm.Reset(10 * time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, int32(0), atomic.LoadInt32(&fired))
+
+	// Stopping the wheel more than once is fine
+	w.Stop()
+}
+
+func TestTimerWheelReset(t *testing.T) {
+	w := newTimerWheel(time.Millisecond, 8)
+	defer w.Stop()
+
+	var fired int32
+
+	tm := w.AfterFunc(100*time.Millisecond, func() {
+		atomic.AddInt32(&fired, 1)
+	})
+
+	// Keep pushing the timer out, it shouldn't fire until we stop
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		tm.Reset(100 * time.Millisecond)
+	}
+
+	require.Equal(t, int32(0), atomic.LoadInt32(&fired))
+	require.True(t, waitFor(func() bool {
+		return atomic.LoadInt32(&fired) == 1
+	}), "Timed out waiting for the timer to fire")
+}
+
+func TestIdleReader(t *testing.T) {
+	w := newTimerWheel(time.Millisecond, 8)
+	defer w.Stop()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	r := newIdleReader(w, c1, 30*time.Millisecond, logging.Nop())
+	defer r.Stop()
+
+	go func() {
+		// Keep the connection busy for a while, then go quiet
+		for i := 0; i < 5; i++ {
+			c2.Write([]byte{byte(i)})
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	b := make([]byte, 1)
+
+	for i := 0; i < 5; i++ {
+		_, err := r.Read(b)
+		require.NoError(t, err)
+		require.Equal(t, byte(i), b[0])
+	}
+
+	_, err := r.Read(b)
+	require.Error(t, err)
+	require.True(t, time.Since(start) >= 70*time.Millisecond)
+}
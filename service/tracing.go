@@ -0,0 +1,102 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/surgemq/message"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// The spans started for the Server.Tracer
+const (
+	spanConnect = "mqtt.connect"
+	spanPublish = "mqtt.publish"
+	spanFanout  = "mqtt.fanout"
+	spanAck     = "mqtt.ack"
+)
+
+var noopTracer trace.Tracer = noop.NewTracerProvider().Tracer("")
+
+// tracer returns the Tracer, or one that doesn't trace anything if it's not set.
+func (this *Server) tracer() trace.Tracer {
+	if this.Tracer == nil {
+		return noopTracer
+	}
+
+	return this.Tracer
+}
+
+func (this *service) tracer() trace.Tracer {
+	if this.tr == nil {
+		return noopTracer
+	}
+
+	return this.tr
+}
+
+// startPublish starts the span of a message published by the other end. It's on
+// the path of every message, so without a tracer it doesn't do any work.
+func (this *service) startPublish(msg *message.PublishMessage) (context.Context, trace.Span) {
+	ctx := context.Background()
+	if this.tr == nil {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	return this.tr.Start(ctx, spanPublish, trace.WithSpanKind(trace.SpanKindConsumer), publishAttributes(this.sess.ID(), msg))
+}
+
+// publishAttributes are the attributes of the spans of the message published by
+// cid.
+func publishAttributes(cid string, msg *message.PublishMessage) trace.SpanStartEventOption {
+	return trace.WithAttributes(
+		attribute.String("mqtt.client_id", cid),
+		attribute.String("mqtt.topic", string(msg.Topic())),
+		attribute.Int("mqtt.qos", int(msg.QoS())),
+	)
+}
+
+// endSpan ends the span, with err as its status if it's not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// traceAck records the ack cycle of a message sent at sent, of type mtype, that
+// has just completed with the state state, as a span from when it was sent.
+func (this *service) traceAck(mtype, state message.MessageType, sent time.Time) {
+	if this.tr == nil || sent.IsZero() {
+		return
+	}
+
+	_, span := this.tr.Start(context.Background(), spanAck,
+		trace.WithTimestamp(sent),
+		trace.WithAttributes(
+			attribute.String("mqtt.client_id", this.sess.ID()),
+			attribute.String("mqtt.type", mtype.Name()),
+			attribute.String("mqtt.ack", state.Name()),
+		))
+
+	span.End()
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type testContextBridge struct {
+	testBridge
+	ctxs chan context.Context
+}
+
+func (this testContextBridge) ForwardContext(ctx context.Context, id uint64, cid string, msg *message.PublishMessage, done func(error)) {
+	this.ctxs <- ctx
+	this.Forward(cid, msg, done)
+}
+
+func TestServerTracing(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+
+	b := testContextBridge{make(testBridge, 10), make(chan context.Context, 10)}
+	svr := &Server{Tracer: tp.Tracer("test"), Bridges: []Bridge{b}}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	connect := newConnectMessage()
+	require.NoError(t, writeMessage(conn, connect))
+
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	pub := message.NewPublishMessage()
+	pub.SetTopic([]byte("a/b"))
+	pub.SetPayload([]byte("abc"))
+	pub.SetQoS(message.QosAtLeastOnce)
+	pub.SetPacketId(1)
+	require.NoError(t, writeMessage(conn, pub))
+
+	b.next(t).done(nil)
+	ctx := <-b.ctxs
+
+	_, err = getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+
+	// The bridge gets the publish span, which the fan-out is a child of
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	require.Eventually(t, func() bool {
+		for _, s := range sr.Ended() {
+			spans[s.Name()] = s
+		}
+		return len(spans) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	require.Contains(t, spans, spanConnect)
+	require.Equal(t, trace.SpanContextFromContext(ctx), spans[spanPublish].SpanContext())
+	require.Equal(t, spans[spanPublish].SpanContext().SpanID(), spans[spanFanout].Parent().SpanID())
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// TTLPolicy is how long the messages published on the topics matching Filter
+// are kept, e.g. a few minutes for "sensors/+/telemetry", so readings nobody
+// picked up don't hang around long after they are stale.
+type TTLPolicy struct {
+	// Filter is the topic filter of the topics the policy is for. It can have
+	// wildcards.
+	Filter string
+
+	// TTL is how long the messages are kept for. A zero TTL keeps them until
+	// they are replaced or cleared, which can be used to exempt some topics from
+	// a wider policy that comes after it.
+	TTL time.Duration
+}
+
+// expiry is the timer clearing a retained message. It's what the timer's
+// function checks against, rather than the timer itself, which is only set once
+// the timer is scheduled.
+type expiry struct {
+	t *wheelTimer
+}
+
+// messageTTL returns the TTL of the messages published on topic, or 0 if they
+// don't expire.
+func (this *Server) messageTTL(topic []byte) time.Duration {
+	for _, p := range this.MessageTTL {
+		if topics.Match([]byte(p.Filter), topic) {
+			return p.TTL
+		}
+	}
+
+	return 0
+}
+
+// scheduleExpiry sets the timer clearing the retained message on topic once it's
+// past its TTL, replacing the timer of the message it replaced, if any. clear is
+// whether the message was cleared rather than set. rmu must be held.
+//
+// The expiries are only kept in memory. The ones of the retained messages
+// recovered from a persistent TopicsProvider on startup are scheduled again
+// from then, see adoptRetained.
+func (this *Server) scheduleExpiry(topic string, clear bool) {
+	if e := this.expiries[topic]; e != nil {
+		e.t.Stop()
+		delete(this.expiries, topic)
+	}
+
+	if clear {
+		return
+	}
+
+	ttl := this.messageTTL([]byte(topic))
+	if ttl <= 0 {
+		return
+	}
+
+	if this.expiries == nil {
+		this.expiries = make(map[string]*expiry)
+	}
+
+	// Clearing the message goes through the TopicsProvider, which may block, so
+	// it's not done on the wheel's goroutine.
+	e := &expiry{}
+	e.t = this.timers.get(0).AfterFunc(ttl, func() {
+		go this.expire(topic, e)
+	})
+
+	this.expiries[topic] = e
+}
+
+// expire clears the retained message on topic if e is still its expiry, i.e. it
+// hasn't been replaced or cleared since.
+func (this *Server) expire(topic string, e *expiry) {
+	this.rmu.Lock()
+
+	if this.expiries[topic] != e {
+		this.rmu.Unlock()
+		return
+	}
+
+	// The message is dead lettered once it's cleared
+	var expired []*message.PublishMessage
+	if this.DeadLetterTopic != "" {
+		if err := this.topicsMgr.Retained([]byte(topic), &expired); err != nil {
+			this.logger().Error("server/expire: Error reading expired retained message", logging.F("topic", topic), logging.Err(err))
+		}
+	}
+
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetRetain(true)
+
+	if err := this.retainLocked("", msg); err != nil {
+		this.logger().Error("server/expire: Error clearing expired retained message", logging.F("topic", topic), logging.Err(err))
+	}
+
+	this.rmu.Unlock()
+
+	for _, m := range expired {
+		this.deadLetter(DeadLetter{Reason: DeadLetterExpired}, m)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func TestServerMessageTTL(t *testing.T) {
+	svr := &Server{
+		MessageTTL: []TTLPolicy{
+			{Filter: "sensors/keep/#"},
+			{Filter: "sensors/#", TTL: 400 * time.Millisecond},
+		},
+	}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	require.NoError(t, svr.checkConfiguration())
+
+	require.Equal(t, time.Duration(0), svr.messageTTL([]byte("sensors/keep/1")))
+	require.Equal(t, 400*time.Millisecond, svr.messageTTL([]byte("sensors/1")))
+	require.Equal(t, time.Duration(0), svr.messageTTL([]byte("other")))
+
+	require.NoError(t, svr.retain("c1", newRetainedMessage("sensors/1", "x")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("sensors/2", "x")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("sensors/keep/1", "x")))
+	require.NoError(t, svr.retain("c1", newRetainedMessage("other", "x")))
+
+	// Replacing a message starts its TTL over
+	time.Sleep(300 * time.Millisecond)
+	require.NoError(t, svr.retain("c1", newRetainedMessage("sensors/2", "y")))
+
+	time.Sleep(250 * time.Millisecond)
+
+	rmsgs, err := svr.Retained([]byte("#"))
+	require.NoError(t, err)
+
+	var topics []string
+	for _, msg := range rmsgs {
+		topics = append(topics, string(msg.Topic()))
+	}
+	require.ElementsMatch(t, []string{"sensors/2", "sensors/keep/1", "other"}, topics)
+
+	// The owner no longer has the expired one
+	o, err := svr.RetainedOwner("c1")
+	require.NoError(t, err)
+	require.Equal(t, 3, o.Retained)
+
+	time.Sleep(400 * time.Millisecond)
+
+	rmsgs, err = svr.Retained([]byte("sensors/+"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 0)
+}
+
+// persistedTopics pretends to have persisted the retained messages it's given,
+// which it recovers on startup.
+type persistedTopics struct {
+	topics.TopicsProvider
+
+	topics []string
+}
+
+func (this *persistedTopics) Recover(safe bool) (int, []topics.BadRecord, error) {
+	for _, topic := range this.topics {
+		if err := this.Retain(newRetainedMessage(topic, "x")); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return len(this.topics), nil, nil
+}
+
+func TestServerMessageTTLRecovered(t *testing.T) {
+	topics.Register("persisted", &persistedTopics{topics.NewMemProvider(), []string{"sensors/1", "other"}})
+	defer topics.Unregister("persisted")
+
+	svr := &Server{
+		TopicsProvider: "persisted",
+		MessageTTL:     []TTLPolicy{{Filter: "sensors/#", TTL: 100 * time.Millisecond}},
+	}
+
+	require.NoError(t, svr.checkConfiguration())
+
+	// The recovered messages are counted as well
+	require.Equal(t, 2, svr.RetainedStats().Count)
+
+	require.True(t, waitFor(func() bool {
+		rmsgs, err := svr.Retained([]byte("sensors/+"))
+		return err == nil && len(rmsgs) == 0
+	}), "Timed out waiting for the recovered message to expire")
+
+	rmsgs, err := svr.Retained([]byte("#"))
+	require.NoError(t, err)
+	require.Len(t, rmsgs, 1)
+	require.Equal(t, []byte("other"), rmsgs[0].Topic())
+
+	require.Equal(t, 1, svr.RetainedStats().Count)
+}
@@ -0,0 +1,302 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// PacketError is a packet, other than CONNECT, that breaks one of the rules of
+// the MQTT spec, numbered as in ConnectError. The spec says to close the
+// connection for all of them.
+type PacketError struct {
+	Rule   string
+	Reason string
+}
+
+func (this *PacketError) Error() string {
+	return fmt.Sprintf("service: Invalid packet (%s): %s", this.Rule, this.Reason)
+}
+
+// validateFlags checks the flags in the first byte of the fixed header of a
+// packet, b.
+func validateFlags(b byte) error {
+	mtype, flags := message.MessageType(b>>4), b&0x0f
+
+	switch mtype {
+	case message.PUBLISH:
+		// [MQTT-3.3.1-4] A PUBLISH Packet MUST NOT have both QoS bits set to 1.
+		if (flags>>1)&0x3 == 0x3 {
+			return &PacketError{"MQTT-3.3.1-4", "PUBLISH has QoS 3"}
+		}
+
+	case message.PUBREL, message.SUBSCRIBE, message.UNSUBSCRIBE:
+		// [MQTT-3.6.1-1], [MQTT-3.8.1-1], [MQTT-3.10.1-1] The flags of PUBREL,
+		// SUBSCRIBE and UNSUBSCRIBE MUST be 0010.
+		if flags != 0x2 {
+			return &PacketError{"MQTT-2.2.2-2", fmt.Sprintf("%s has reserved flags %04b", mtype, flags)}
+		}
+
+	default:
+		// [MQTT-2.2.2-2] The reserved flags of the others MUST be 0.
+		if flags != 0 {
+			return &PacketError{"MQTT-2.2.2-2", fmt.Sprintf("%s has reserved flags %04b", mtype, flags)}
+		}
+	}
+
+	return nil
+}
+
+// topicRules are the rules of the MQTT spec broken by the topics the errors of
+// the topics validators are for.
+var topicRules = map[error]string{
+	// [MQTT-1.5.3-1] The character data MUST be well-formed UTF-8, and MUST NOT
+	// include encodings of code points between U+D800 and U+DFFF.
+	topics.ErrInvalidUTF8: "MQTT-1.5.3-1",
+
+	// [MQTT-1.5.3-2] A UTF-8 encoded string MUST NOT include U+0000.
+	topics.ErrNullCharacter: "MQTT-1.5.3-2",
+
+	// [MQTT-4.7.3-1] Topic Names and Topic Filters MUST be at least one
+	// character long.
+	topics.ErrTopicEmpty: "MQTT-4.7.3-1",
+
+	// [MQTT-4.7.3-3] Topic Names and Topic Filters are UTF-8 encoded strings,
+	// and they MUST NOT encode to more than 65535 bytes.
+	topics.ErrTopicTooLong: "MQTT-4.7.3-3",
+
+	// [MQTT-3.3.2-2] The Topic Name in the PUBLISH Packet MUST NOT contain
+	// wildcard characters.
+	topics.ErrWildcardInTopic: "MQTT-3.3.2-2",
+
+	// [MQTT-4.7.1-2], [MQTT-4.7.1-3] The wildcards MUST occupy an entire level
+	// of the filter, and '#' MUST be the last.
+	topics.ErrInvalidWildcard: "MQTT-4.7.1-2",
+}
+
+// topicError returns the *PacketError for err, returned by one of the topics
+// validators for topic.
+func topicError(err error, topic []byte) error {
+	if err == nil {
+		return nil
+	}
+
+	return &PacketError{topicRules[err], fmt.Sprintf("%q: %v", topic, err)}
+}
+
+// validateString checks a topic name or filter is a well-formed UTF-8 string,
+// which the MQTT spec says is a protocol violation otherwise.
+func validateString(s []byte) error {
+	return topicError(topics.Validator{}.String(s), s)
+}
+
+// validateTopicName checks the topic of a PUBLISH, other than its encoding,
+// which validateString checks.
+func validateTopicName(topic []byte) error {
+	if err := topics.ValidateTopicName(topic); !topics.IsEncodingError(err) {
+		return topicError(err, topic)
+	}
+
+	return nil
+}
+
+// validateTopicFilter is validateTopicName for the topic filters of SUBSCRIBE
+// and UNSUBSCRIBE.
+func validateTopicFilter(filter []byte) error {
+	if err := topics.ValidateTopicFilter(filter); !topics.IsEncodingError(err) {
+		return topicError(err, filter)
+	}
+
+	return nil
+}
+
+// validatePacket checks the rules about the fields of a packet the flags of
+// which have already been checked by validateFlags, and returns a *PacketError
+// for the first one broken.
+func validatePacket(msg message.Message) error {
+	if err := validateFields(msg); err != nil {
+		return err
+	}
+
+	return validateStrings(msg)
+}
+
+// validateFields is validatePacket for all but the encoding of the strings.
+func validateFields(msg message.Message) error {
+	switch msg := msg.(type) {
+	case *message.PublishMessage:
+		// [MQTT-3.3.1-4] validateFlags catches it in the fixed header, this is in
+		// case the decoder lets it through
+		if msg.QoS() > message.QosExactlyOnce {
+			return &PacketError{"MQTT-3.3.1-4", fmt.Sprintf("PUBLISH has QoS %d", msg.QoS())}
+		}
+
+		return validateTopicName(msg.Topic())
+
+	case *message.SubscribeMessage:
+		// [MQTT-3.8.3-3] The payload of a SUBSCRIBE packet MUST contain at least
+		// one Topic Filter / QoS pair.
+		if len(msg.Topics()) == 0 {
+			return &PacketError{"MQTT-3.8.3-3", "SUBSCRIBE has no Topic Filters"}
+		}
+
+		qos := msg.Qos()
+
+		for i, t := range msg.Topics() {
+			if err := validateTopicFilter(t); err != nil {
+				return err
+			}
+
+			// [MQTT-3-8.3-4] The requested QoS MUST NOT be 3.
+			if qos[i] > message.QosExactlyOnce {
+				return &PacketError{"MQTT-3-8.3-4", fmt.Sprintf("SUBSCRIBE to %q with QoS %d", t, qos[i])}
+			}
+		}
+
+	case *message.UnsubscribeMessage:
+		// [MQTT-3.10.3-2] The Payload of an UNSUBSCRIBE packet MUST contain at
+		// least one Topic Filter.
+		if len(msg.Topics()) == 0 {
+			return &PacketError{"MQTT-3.10.3-2", "UNSUBSCRIBE has no Topic Filters"}
+		}
+
+		for _, t := range msg.Topics() {
+			if err := validateTopicFilter(t); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateStrings is validatePacket for the encoding of the topic names and
+// filters.
+func validateStrings(msg message.Message) error {
+	var strs [][]byte
+
+	switch msg := msg.(type) {
+	case *message.PublishMessage:
+		strs = [][]byte{msg.Topic()}
+
+	case *message.SubscribeMessage:
+		strs = msg.Topics()
+
+	case *message.UnsubscribeMessage:
+		strs = msg.Topics()
+	}
+
+	for _, s := range strs {
+		if err := validateString(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkFlags validates the flags of the packet starting with b, and in the
+// Permissive mode resets them to what they should be instead of failing, so the
+// packet can still be decoded.
+func checkFlags(b []byte, mode ComplianceMode, log logging.Logger) error {
+	err := validateFlags(b[0])
+	if err == nil || mode != Permissive {
+		return err
+	}
+
+	switch mtype := message.MessageType(b[0] >> 4); mtype {
+	case message.PUBLISH:
+		// Down to QoS 2, keeping DUP and RETAIN
+		b[0] &^= 0x02
+
+	case message.PUBREL, message.SUBSCRIBE, message.UNSUBSCRIBE:
+		b[0] = byte(mtype)<<4 | 0x2
+
+	default:
+		b[0] = byte(mtype) << 4
+	}
+
+	log.Info("service/checkFlags: Accepting packet in permissive mode", logging.Err(err))
+
+	return nil
+}
+
+// checkPacket validates a packet, and in the Permissive mode lets through or
+// fixes up whatever it can instead of failing.
+func checkPacket(msg message.Message, mode ComplianceMode, log logging.Logger) error {
+	if mode != Permissive {
+		return validatePacket(msg)
+	}
+
+	// Topics are only ever compared byte by byte, so the clients that don't
+	// encode theirs properly get them as they sent them
+	if err := validateStrings(msg); err != nil {
+		log.Info("service/checkPacket: Accepting packet in permissive mode", logging.F("type", msg.Name()), logging.Err(err))
+	}
+
+	for {
+		err := validateFields(msg)
+		if err == nil {
+			return nil
+		}
+
+		perr, ok := err.(*PacketError)
+		if !ok {
+			return err
+		}
+
+		// Subscribing or unsubscribing to nothing does nothing, and it has
+		// nothing else to check
+		if perr.Rule == "MQTT-3.8.3-3" || perr.Rule == "MQTT-3.10.3-2" {
+			log.Info("service/checkPacket: Accepting packet in permissive mode", logging.F("type", msg.Name()), logging.Err(err))
+			return nil
+		}
+
+		if !fixPacket(msg, perr) {
+			return err
+		}
+
+		log.Info("service/checkPacket: Accepting packet in permissive mode", logging.F("type", msg.Name()), logging.Err(err))
+	}
+}
+
+// fixPacket changes the packet so it no longer breaks the rule. It returns false
+// if there's no sensible way to carry on, such as with a PUBLISH to a wildcard,
+// which can't be delivered.
+func fixPacket(msg message.Message, perr *PacketError) bool {
+	switch perr.Rule {
+	case "MQTT-3.3.1-4":
+		msg.(*message.PublishMessage).SetQoS(message.QosExactlyOnce)
+
+	case "MQTT-3-8.3-4":
+		sub := msg.(*message.SubscribeMessage)
+		qos := sub.Qos()
+
+		for i, t := range sub.Topics() {
+			if qos[i] > message.QosExactlyOnce {
+				sub.AddTopic(t, message.QosExactlyOnce)
+			}
+		}
+
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+func TestValidateFlags(t *testing.T) {
+	tests := []struct {
+		b    byte
+		rule string
+	}{
+		{0x30, ""},             // PUBLISH QoS 0
+		{0x3d, ""},             // PUBLISH QoS 2 with DUP and RETAIN
+		{0x36, "MQTT-3.3.1-4"}, // PUBLISH QoS 3
+		{0x62, ""},             // PUBREL
+		{0x60, "MQTT-2.2.2-2"}, // PUBREL without its flags
+		{0x82, ""},             // SUBSCRIBE
+		{0x80, "MQTT-2.2.2-2"}, // SUBSCRIBE without its flags
+		{0xa2, ""},             // UNSUBSCRIBE
+		{0x40, ""},             // PUBACK
+		{0x41, "MQTT-2.2.2-2"}, // PUBACK with a reserved flag set
+		{0xc8, "MQTT-2.2.2-2"}, // PINGREQ with a reserved flag set
+	}
+
+	for _, test := range tests {
+		err := validateFlags(test.b)
+		if test.rule == "" {
+			require.NoError(t, err, "%#x", test.b)
+			continue
+		}
+
+		perr, ok := err.(*PacketError)
+		require.True(t, ok, "%#x: %v", test.b, err)
+		require.Equal(t, test.rule, perr.Rule, "%#x", test.b)
+	}
+}
+
+func TestCheckFlagsPermissive(t *testing.T) {
+	b := []byte{0x3f}
+	require.Error(t, checkFlags(b, Strict, logging.Nop()))
+	require.Equal(t, byte(0x3f), b[0])
+
+	// QoS 3 goes down to 2, keeping DUP and RETAIN
+	require.NoError(t, checkFlags(b, Permissive, logging.Nop()))
+	require.Equal(t, byte(0x3d), b[0])
+
+	b = []byte{0x81}
+	require.NoError(t, checkFlags(b, Permissive, logging.Nop()))
+	require.Equal(t, byte(0x82), b[0])
+
+	b = []byte{0xc8}
+	require.NoError(t, checkFlags(b, Permissive, logging.Nop()))
+	require.Equal(t, byte(0xc0), b[0])
+}
+
+func TestValidateTopicStrings(t *testing.T) {
+	require.NoError(t, validateString([]byte("sensors/température")))
+
+	err := validateString([]byte("sensors/\xff"))
+	require.Equal(t, "MQTT-1.5.3-1", err.(*PacketError).Rule)
+
+	// A surrogate half encoded as UTF-8
+	err = validateString([]byte("sensors/\xed\xa0\x80"))
+	require.Equal(t, "MQTT-1.5.3-1", err.(*PacketError).Rule)
+
+	err = validateString([]byte("sensors/\x00"))
+	require.Equal(t, "MQTT-1.5.3-2", err.(*PacketError).Rule)
+
+	require.NoError(t, validateTopicName([]byte("a/b")))
+
+	err = validateTopicName([]byte("a/+"))
+	require.Equal(t, "MQTT-3.3.2-2", err.(*PacketError).Rule)
+
+	err = validateTopicName(nil)
+	require.Equal(t, "MQTT-4.7.3-1", err.(*PacketError).Rule)
+}
+
+func TestCheckPacket(t *testing.T) {
+	sub := message.NewSubscribeMessage()
+	sub.SetPacketId(1)
+	require.NoError(t, checkPacket(sub, Permissive, logging.Nop()))
+
+	err := checkPacket(sub, Strict, logging.Nop())
+	require.Equal(t, "MQTT-3.8.3-3", err.(*PacketError).Rule)
+
+	sub.AddTopic([]byte("a/#"), message.QosAtLeastOnce)
+	require.NoError(t, checkPacket(sub, Strict, logging.Nop()))
+
+	unsub := message.NewUnsubscribeMessage()
+	err = checkPacket(unsub, Strict, logging.Nop())
+	require.Equal(t, "MQTT-3.10.3-2", err.(*PacketError).Rule)
+
+	require.NoError(t, checkPacket(newPublishMessage(1, 1), Strict, logging.Nop()))
+}
+
+func TestServerDisconnectsInvalidPacket(t *testing.T) {
+	svr := &Server{Compliance: Strict}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+
+	resp, err := getConnackMessage(conn)
+	require.NoError(t, err)
+	require.Equal(t, message.ConnectionAccepted, resp.ReturnCode())
+
+	// A PUBACK with a reserved flag set
+	_, err = conn.Write([]byte{0x41, 0x02, 0x00, 0x01})
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
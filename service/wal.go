@@ -0,0 +1,549 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/logging"
+)
+
+var ErrWALClosed error = errors.New("service: Write-ahead log is closed")
+
+// DefaultWALGroupCommit is how long the records of a group commit wait for
+// others to join them if Server.WALGroupCommit isn't set.
+const DefaultWALGroupCommit = 2 * time.Millisecond
+
+const (
+	// The size a segment file of the WAL grows to before the next one is started
+	walSegmentSize = 4 << 20
+
+	// The extension of the segment files
+	walSegmentExt = ".wal"
+)
+
+// The types of the records in the WAL
+const (
+	// A message published by a client, followed by the length of its client ID,
+	// the client ID and the encoded PUBLISH
+	walPublish byte = iota + 1
+
+	// A QoS 2 message released by its PUBREL
+	walRelease
+
+	// A message that has been handed to the subscribers and the bridges
+	walDone
+)
+
+// WALSyncPolicy is when the records of the write-ahead log are synced to disk,
+// see Server.WAL.
+type WALSyncPolicy int
+
+const (
+	// WALSyncGroup syncs the records written within WALGroupCommit of each other
+	// together, holding up the acks of all of them until then. It trades a
+	// little latency for a lot less syncs under load.
+	WALSyncGroup WALSyncPolicy = iota
+
+	// WALSyncAlways syncs each record on its own before it's acked.
+	WALSyncAlways
+
+	// WALSyncNever acks each record once it's written, and leaves syncing to the
+	// OS. What's acked survives the server crashing, but not the machine.
+	WALSyncNever
+)
+
+func (this WALSyncPolicy) String() string {
+	switch this {
+	case WALSyncGroup:
+		return "group"
+	case WALSyncAlways:
+		return "always"
+	case WALSyncNever:
+		return "never"
+	}
+
+	return "unknown"
+}
+
+// wal is the write-ahead log of the QoS 1 and 2 messages the clients publish.
+// Each is written before it's acked, and marked done once it's been handed to
+// the subscribers, so the ones acked but not done when the server goes down
+// are published again when it starts. It's split into segment files, which are
+// removed, oldest first, once all the messages in them are done. A segment
+// can't go before the ones older than it, as it may have the done records of
+// their messages.
+type wal struct {
+	dir    string
+	policy WALSyncPolicy
+	delay  time.Duration
+
+	mu sync.Mutex
+
+	// The segment file being written to, its sequence number and its size, and
+	// the sequence number of the oldest one
+	f     *os.File
+	seq   uint64
+	size  int64
+	first uint64
+
+	// The ID of the last record, the segments of the messages not done yet, by
+	// ID, and the number of them in each segment
+	id     uint64
+	live   map[uint64]uint64
+	counts map[uint64]int
+
+	// The group commit the records written are waiting on, if any
+	group *walGroup
+
+	// The number of syncs
+	syncs int64
+}
+
+// walGroup is the records of a group commit, released by closing done once
+// they're synced.
+type walGroup struct {
+	done chan struct{}
+	err  error
+}
+
+// walEntry is a message read back from the WAL.
+type walEntry struct {
+	id       uint64
+	cid      string
+	msg      *message.PublishMessage
+	released bool
+}
+
+// loadWAL publishes again the messages the WAL has that were acked but not
+// handed to the subscribers before the server went down, and starts a new
+// one, if Server.WAL is set.
+func (this *Server) loadWAL() error {
+	if this.WAL == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(this.WAL, 0700); err != nil {
+		return fmt.Errorf("server/loadWAL: Error creating WAL directory: %v", err)
+	}
+
+	seqs, err := walSegments(this.WAL)
+	if err != nil {
+		return fmt.Errorf("server/loadWAL: Error reading WAL directory: %v", err)
+	}
+
+	w := &wal{
+		dir:    this.WAL,
+		policy: this.WALSync,
+		delay:  this.WALGroupCommit,
+		live:   make(map[uint64]uint64),
+		counts: make(map[uint64]int),
+	}
+
+	var entries []*walEntry
+	byId := make(map[uint64]*walEntry)
+
+	for _, seq := range seqs {
+		err := readWALSegment(w.segment(seq), func(typ byte, id uint64, b []byte) {
+			if id > w.id {
+				w.id = id
+			}
+
+			switch typ {
+			case walPublish:
+				e, err := decodeWALPublish(id, b)
+				if err != nil {
+					this.logger().Error("server/loadWAL: Skipping unreadable record", logging.F("id", id), logging.Err(err))
+					return
+				}
+				entries = append(entries, e)
+				byId[id] = e
+
+			case walRelease:
+				if e := byId[id]; e != nil {
+					e.released = true
+				}
+
+			case walDone:
+				delete(byId, id)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("server/loadWAL: Error reading WAL segment %d: %v", seq, err)
+		}
+
+		w.seq = seq
+	}
+
+	// The QoS 2 messages that weren't released haven't been acked as far as
+	// their publishers are concerned
+	for _, e := range entries {
+		if byId[e.id] == nil || e.msg.QoS() == message.QosExactlyOnce && !e.released {
+			continue
+		}
+
+		if _, err := this.publish(e.msg, &PublishOptions{ClientId: e.cid}); err != nil {
+			this.logger().Error("server/loadWAL: Error publishing logged message", logging.F("client_id", e.cid), logging.Err(err))
+			continue
+		}
+
+		atomic.AddInt64(&this.walReplayed, 1)
+	}
+
+	if n := atomic.LoadInt64(&this.walReplayed); n > 0 {
+		this.logger().Info("server/loadWAL: Published logged messages again", logging.F("messages", n))
+	}
+
+	// What's been published again is logged no more
+	for _, seq := range seqs {
+		if err := os.Remove(w.segment(seq)); err != nil {
+			return fmt.Errorf("server/loadWAL: Error removing WAL segment %d: %v", seq, err)
+		}
+	}
+
+	w.mu.Lock()
+	err = w.roll()
+	w.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("server/loadWAL: Error starting WAL segment: %v", err)
+	}
+
+	this.wal = w
+
+	return nil
+}
+
+// stopWAL syncs and closes the WAL.
+func (this *Server) stopWAL() error {
+	if this.wal == nil {
+		return nil
+	}
+
+	return this.wal.close()
+}
+
+// logPublish writes msg, published by the client of the service with QoS 1 or
+// 2, to the WAL, if there's one, and returns the ID of its record once it's as
+// durable as Server.WALSync makes it. The ID is 0 without a WAL.
+func (this *service) logPublish(msg *message.PublishMessage) (uint64, error) {
+	if this.server == nil || this.server.wal == nil {
+		return 0, nil
+	}
+
+	id, err := this.server.wal.logPublish(this.sess.ID(), msg)
+	if err != nil {
+		this.logger().Error("service/logPublish: Error writing to WAL", logging.Err(err))
+	}
+
+	return id, err
+}
+
+// logRelease marks the QoS 2 message with the record id released.
+func (this *service) logRelease(id uint64) {
+	if id != 0 {
+		this.server.wal.mark(walRelease, id)
+	}
+}
+
+// logDone marks the message with the record id handed to the subscribers.
+func (this *service) logDone(id uint64) {
+	if id != 0 {
+		this.server.wal.mark(walDone, id)
+	}
+}
+
+func (this *wal) logPublish(cid string, msg *message.PublishMessage) (uint64, error) {
+	b := make([]byte, 2+len(cid)+msg.Len())
+	binary.BigEndian.PutUint16(b, uint16(len(cid)))
+	copy(b[2:], cid)
+
+	n, err := msg.Encode(b[2+len(cid):])
+	if err != nil {
+		return 0, err
+	}
+	b = b[:2+len(cid)+n]
+
+	this.mu.Lock()
+
+	if this.f == nil {
+		this.mu.Unlock()
+		return 0, ErrWALClosed
+	}
+
+	this.id++
+	id := this.id
+
+	if err := this.write(walPublish, id, b); err != nil {
+		this.mu.Unlock()
+		return 0, err
+	}
+
+	this.live[id] = this.seq
+	this.counts[this.seq]++
+
+	switch this.policy {
+	case WALSyncAlways:
+		err = this.sync()
+		this.mu.Unlock()
+		return id, err
+
+	case WALSyncNever:
+		this.mu.Unlock()
+		return id, nil
+	}
+
+	g := this.group
+	if g == nil {
+		g = &walGroup{done: make(chan struct{})}
+		this.group = g
+
+		delay := this.delay
+		if delay == 0 {
+			delay = DefaultWALGroupCommit
+		}
+		time.AfterFunc(delay, func() {
+			this.mu.Lock()
+			this.commit(g)
+			this.mu.Unlock()
+		})
+	}
+
+	this.mu.Unlock()
+
+	<-g.done
+	return id, g.err
+}
+
+// mark writes a record of the type typ for the message with the record id. It
+// isn't synced, as losing it only means the message is published again.
+func (this *wal) mark(typ byte, id uint64) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.f == nil {
+		return
+	}
+
+	if err := this.write(typ, id, nil); err != nil {
+		return
+	}
+
+	if typ != walDone {
+		return
+	}
+
+	seq, ok := this.live[id]
+	if !ok {
+		return
+	}
+	delete(this.live, id)
+
+	this.counts[seq]--
+	this.trim()
+}
+
+// trim removes the oldest segments, before the one being written to, for as long
+// as all their messages are done. The lock must be held.
+func (this *wal) trim() {
+	for this.first < this.seq && this.counts[this.first] == 0 {
+		delete(this.counts, this.first)
+		os.Remove(this.segment(this.first))
+		this.first++
+	}
+}
+
+// write appends a record, starting a new segment if the one being written to is
+// full. The lock must be held.
+func (this *wal) write(typ byte, id uint64, b []byte) error {
+	if this.size >= walSegmentSize {
+		if err := this.roll(); err != nil {
+			return err
+		}
+	}
+
+	rec := make([]byte, 8+9+len(b))
+	binary.BigEndian.PutUint32(rec, uint32(9+len(b)))
+	rec[8] = typ
+	binary.BigEndian.PutUint64(rec[9:], id)
+	copy(rec[17:], b)
+	binary.BigEndian.PutUint32(rec[4:], crc32.ChecksumIEEE(rec[8:]))
+
+	if _, err := this.f.Write(rec); err != nil {
+		return err
+	}
+
+	this.size += int64(len(rec))
+
+	return nil
+}
+
+// roll syncs and closes the segment being written to, if any, and starts the
+// next. The lock must be held.
+func (this *wal) roll() error {
+	if this.f != nil {
+		if err := this.sync(); err != nil {
+			return err
+		}
+		this.f.Close()
+		this.f = nil
+	}
+
+	f, err := os.OpenFile(this.segment(this.seq+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	this.seq++
+	this.f, this.size = f, 0
+
+	if this.first == 0 {
+		this.first = this.seq
+	}
+	this.trim()
+
+	return nil
+}
+
+// sync syncs the segment being written to, which takes in the group commit
+// waiting, if any. The lock must be held.
+func (this *wal) sync() error {
+	err := this.f.Sync()
+	atomic.AddInt64(&this.syncs, 1)
+
+	if g := this.group; g != nil {
+		this.group = nil
+		g.err = err
+		close(g.done)
+	}
+
+	return err
+}
+
+// commit syncs the records of g, unless they've been synced already. The lock
+// must be held.
+func (this *wal) commit(g *walGroup) {
+	if this.group != g {
+		return
+	}
+
+	if this.f == nil {
+		this.group = nil
+		g.err = ErrWALClosed
+		close(g.done)
+		return
+	}
+
+	this.sync()
+}
+
+func (this *wal) close() error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.f == nil {
+		return nil
+	}
+
+	err := this.sync()
+	this.f.Close()
+	this.f = nil
+
+	return err
+}
+
+func (this *wal) segment(seq uint64) string {
+	return filepath.Join(this.dir, fmt.Sprintf("%020d%s", seq, walSegmentExt))
+}
+
+// walSegments returns the sequence numbers of the segment files in dir, in
+// order.
+func walSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool {
+		return seqs[i] < seqs[j]
+	})
+
+	return seqs, nil
+}
+
+// readWALSegment calls fn with each of the records in the segment file path. A
+// record cut short, or that doesn't match its checksum, is where the server
+// went down as it was writing, and ends the segment.
+func readWALSegment(path string, fn func(typ byte, id uint64, b []byte)) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	for len(b) >= 8 {
+		n := int(binary.BigEndian.Uint32(b))
+		if n < 9 || len(b) < 8+n || crc32.ChecksumIEEE(b[8:8+n]) != binary.BigEndian.Uint32(b[4:]) {
+			break
+		}
+
+		fn(b[8], binary.BigEndian.Uint64(b[9:]), b[17:8+n])
+		b = b[8+n:]
+	}
+
+	return nil
+}
+
+func decodeWALPublish(id uint64, b []byte) (*walEntry, error) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return nil, errors.New("record too short")
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(b[2+n:]); err != nil {
+		return nil, err
+	}
+
+	return &walEntry{id: id, cid: string(b[2 : 2+n]), msg: msg}, nil
+}
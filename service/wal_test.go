@@ -0,0 +1,192 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+	"github.com/surgemq/surgemq/topics"
+)
+
+func newTestWAL(t *testing.T, dir string, policy WALSyncPolicy) *wal {
+	w := &wal{
+		dir:    dir,
+		policy: policy,
+		delay:  20 * time.Millisecond,
+		live:   make(map[uint64]uint64),
+		counts: make(map[uint64]int),
+	}
+
+	w.mu.Lock()
+	require.NoError(t, w.roll())
+	w.mu.Unlock()
+
+	return w
+}
+
+func newWALPublish(topic string, qos byte) *message.PublishMessage {
+	msg := newRetainedMessage(topic, topic)
+	msg.SetQoS(qos)
+	msg.SetPacketId(1)
+	return msg
+}
+
+func TestServerWALReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	w := newTestWAL(t, dir, WALSyncAlways)
+
+	// Acked and not done, so published again
+	_, err := w.logPublish("c1", newWALPublish("a", message.QosAtLeastOnce))
+	require.NoError(t, err)
+
+	// Done already
+	id, err := w.logPublish("c1", newWALPublish("b", message.QosAtLeastOnce))
+	require.NoError(t, err)
+	w.mark(walDone, id)
+
+	// Released and not done
+	id, err = w.logPublish("c2", newWALPublish("c", message.QosExactlyOnce))
+	require.NoError(t, err)
+	w.mark(walRelease, id)
+
+	// Never released
+	_, err = w.logPublish("c2", newWALPublish("d", message.QosExactlyOnce))
+	require.NoError(t, err)
+
+	require.NoError(t, w.close())
+
+	topics.Unregister("mem")
+	topics.Register("mem", topics.NewMemProvider())
+
+	sessions.Unregister("mem")
+	sessions.Register("mem", sessions.NewMemProvider())
+
+	svr := &Server{WAL: dir}
+	defer svr.Close()
+
+	var got []string
+	for _, topic := range []string{"a", "b", "c", "d"} {
+		rmsgs, err := svr.Retained([]byte(topic))
+		require.NoError(t, err)
+
+		for _, m := range rmsgs {
+			got = append(got, string(m.Payload()))
+		}
+	}
+
+	require.Equal(t, []string{"a", "c"}, got)
+	require.Equal(t, int64(2), svr.Stats().WALReplayed)
+
+	// Only the new segment is left
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, svr.wal.segment(2), filepath.Join(dir, entries[0].Name()))
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	w := newTestWAL(t, t.TempDir(), WALSyncGroup)
+	defer w.close()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := w.logPublish("c1", newWALPublish("a", message.QosAtLeastOnce))
+			require.NoError(t, err)
+		}()
+	}
+
+	wg.Wait()
+
+	require.Len(t, w.live, 10)
+	require.True(t, w.syncs < 10)
+}
+
+func TestWALTrim(t *testing.T) {
+	dir := t.TempDir()
+
+	w := newTestWAL(t, dir, WALSyncNever)
+	defer w.close()
+
+	id1, err := w.logPublish("c1", newWALPublish("a", message.QosAtLeastOnce))
+	require.NoError(t, err)
+
+	w.mu.Lock()
+	require.NoError(t, w.roll())
+	w.mu.Unlock()
+
+	id2, err := w.logPublish("c1", newWALPublish("a", message.QosAtLeastOnce))
+	require.NoError(t, err)
+
+	w.mu.Lock()
+	require.NoError(t, w.roll())
+	w.mu.Unlock()
+
+	// The second segment has to wait for the first
+	w.mark(walDone, id2)
+
+	seqs, err := walSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, 3}, seqs)
+
+	w.mark(walDone, id1)
+
+	seqs, err = walSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3}, seqs)
+}
+
+func TestServerWALPublish(t *testing.T) {
+	svr := &Server{WAL: t.TempDir(), WALSync: WALSyncAlways}
+
+	ln := serveTestServer(t, svr)
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.NoError(t, writeMessage(conn, newConnectMessage()))
+	_, err = getConnackMessage(conn)
+	require.NoError(t, err)
+
+	require.NoError(t, writeMessage(conn, newPublishMessage(1, message.QosAtLeastOnce)))
+
+	buf, err := getMessageBuffer(conn, 0)
+	require.NoError(t, err)
+	require.Equal(t, byte(message.PUBACK), buf[0]>>4)
+
+	// Logged, synced and done with
+	require.True(t, waitFor(func() bool {
+		svr.wal.mu.Lock()
+		defer svr.wal.mu.Unlock()
+
+		return svr.wal.id == 1 && len(svr.wal.live) == 0
+	}))
+	require.Equal(t, int64(1), svr.Stats().WALSyncs)
+}
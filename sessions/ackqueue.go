@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"math"
 	"sync"
+	"time"
 
 	"github.com/surgemq/message"
 )
@@ -28,8 +29,43 @@ var (
 	errQueueEmpty  error = errors.New("queue empty")
 	errWaitMessage error = errors.New("Invalid message to wait for ack")
 	errAckMessage  error = errors.New("Invalid message for acking")
+
+	// ErrAckEvicted is what the Completer of a message is told when it's pushed
+	// out of a full Ackqueue by a newer one, see Ackqueue.SetLimit.
+	ErrAckEvicted error = errors.New("Session: Message evicted before it was acked")
+
+	// ErrAckExpired is what the Completer of a message is told when it waited
+	// too long for its ack, see Ackqueue.Expire.
+	ErrAckExpired error = errors.New("Session: Message expired before it was acked")
+
+	// ErrAckDiscarded is what the Completer of a message is told when it's taken
+	// out of the queue by Ackqueue.Discard.
+	ErrAckDiscarded error = errors.New("Session: Message discarded before it was acked")
+
+	// ErrAckNotFound is returned for a packet ID no message is waiting with.
+	ErrAckNotFound error = errors.New("Session: No message waiting for an ack with the packet ID")
 )
 
+// Completer is told when the ack cycle of a message waiting in an Ackqueue
+// completes. msg is the message that was waiting, and ack the message that
+// completed it. The Completer itself carries whatever the caller needs to handle
+// it, so nothing has to be looked up or type asserted when the ack arrives.
+type Completer interface {
+	Complete(msg, ack message.Message, err error) error
+}
+
+// CompleteFunc lets an ordinary function be used as a Completer. A nil
+// CompleteFunc does nothing.
+type CompleteFunc func(msg, ack message.Message, err error) error
+
+func (this CompleteFunc) Complete(msg, ack message.Message, err error) error {
+	if this == nil {
+		return nil
+	}
+
+	return this(msg, ack, err)
+}
+
 type ackmsg struct {
 	// Message type of the message waiting for ack
 	Mtype message.MessageType
@@ -47,26 +83,77 @@ type ackmsg struct {
 	// Slice containing the ack message bytes
 	Ackbuf []byte
 
-	// When ack cycle completes, call this function
-	OnComplete interface{}
+	// When ack cycle completes, call this
+	OnComplete Completer
+
+	// When the message was put in the queue, i.e. sent, and the number of times
+	// it's been sent again since by Retry
+	Sent    time.Time
+	Retries int
+
+	// Why the message was dropped before it was acked, for the ones returned by
+	// Dropped
+	Err error
+
+	// Whether the message was discarded while behind the head, to be skipped
+	// once it gets there
+	discarded bool
+}
+
+// InflightMessage describes a message waiting in an Ackqueue for its ack.
+type InflightMessage struct {
+	PacketId uint16 `json:"packet_id"`
+
+	// Type is the type of the message, e.g. PUBLISH, and State the last ack it
+	// got, or RESERVED if none yet.
+	Type  string `json:"type"`
+	State string `json:"state"`
+
+	// The topic and QoS of a PUBLISH
+	Topic string `json:"topic,omitempty"`
+	QoS   byte   `json:"qos,omitempty"`
+
+	Sent    time.Time `json:"sent"`
+	Retries int       `json:"retries"`
+}
+
+// AckqueueStats are the counters of an Ackqueue.
+type AckqueueStats struct {
+	// Len is the number of messages waiting for their acks, Cap the number the
+	// ring has room for without growing, and Limit the most it can grow to, or 0
+	// if it's unbounded.
+	Len   int `json:"len"`
+	Cap   int `json:"cap"`
+	Limit int `json:"limit"`
+
+	// The number of messages that completed their ack cycle, were evicted by
+	// newer ones, expired and were discarded, since the queue was created
+	Acked     int64 `json:"acked"`
+	Evicted   int64 `json:"evicted"`
+	Expired   int64 `json:"expired"`
+	Discarded int64 `json:"discarded"`
 }
 
 // Ackqueue is a growing queue implemented based on a ring buffer. As the buffer
-// gets full, it will auto-grow.
+// gets full, it will auto-grow, up to its limit if it has one, after which the
+// oldest message is evicted to make room. The messages are indexed by packet ID,
+// so acking one doesn't scan the queue, and the ones that complete at the head
+// are moved out as the acks come in, so collecting them with Acked doesn't
+// either.
 //
 // Ackqueue is used to store messages that are waiting for acks to come back. There
 // are a few scenarios in which acks are required.
-//   1. Client sends SUBSCRIBE message to server, waits for SUBACK.
-//   2. Client sends UNSUBSCRIBE message to server, waits for UNSUBACK.
-//   3. Client sends PUBLISH QoS 1 message to server, waits for PUBACK.
-//   4. Server sends PUBLISH QoS 1 message to client, waits for PUBACK.
-//   5. Client sends PUBLISH QoS 2 message to server, waits for PUBREC.
-//   6. Server sends PUBREC message to client, waits for PUBREL.
-//   7. Client sends PUBREL message to server, waits for PUBCOMP.
-//   8. Server sends PUBLISH QoS 2 message to client, waits for PUBREC.
-//   9. Client sends PUBREC message to server, waits for PUBREL.
-//   10. Server sends PUBREL message to client, waits for PUBCOMP.
-//   11. Client sends PINGREQ message to server, waits for PINGRESP.
+//  1. Client sends SUBSCRIBE message to server, waits for SUBACK.
+//  2. Client sends UNSUBSCRIBE message to server, waits for UNSUBACK.
+//  3. Client sends PUBLISH QoS 1 message to server, waits for PUBACK.
+//  4. Server sends PUBLISH QoS 1 message to client, waits for PUBACK.
+//  5. Client sends PUBLISH QoS 2 message to server, waits for PUBREC.
+//  6. Server sends PUBREC message to client, waits for PUBREL.
+//  7. Client sends PUBREL message to server, waits for PUBCOMP.
+//  8. Server sends PUBLISH QoS 2 message to client, waits for PUBREC.
+//  9. Client sends PUBREC message to server, waits for PUBREL.
+//  10. Server sends PUBREL message to client, waits for PUBCOMP.
+//  11. Client sends PINGREQ message to server, waits for PINGRESP.
 type Ackqueue struct {
 	size  int64
 	mask  int64
@@ -74,11 +161,26 @@ type Ackqueue struct {
 	head  int64
 	tail  int64
 
+	// limit is the most messages the queue holds, or 0 for no limit
+	limit int64
+
 	ping ackmsg
 	ring []ackmsg
 	emap map[uint16]int64
 
+	// ackdone are the completed messages for Acked to return, and spare the
+	// slice it returned last time, reused once it's called again
 	ackdone []ackmsg
+	spare   []ackmsg
+
+	// dropped are the messages evicted or expired before they were acked, for
+	// Dropped to return
+	dropped []ackmsg
+
+	acked     int64
+	evicted   int64
+	expired   int64
+	discarded int64
 
 	mu sync.Mutex
 }
@@ -101,9 +203,70 @@ func newAckqueue(n int) *Ackqueue {
 	}
 }
 
+// SetLimit sets the most messages the queue holds waiting for their acks. Once
+// it's reached, the oldest message is evicted for each new one, and returned by
+// Dropped with ErrAckEvicted. 0 leaves it unbounded, which is the default.
+func (this *Ackqueue) SetLimit(n int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.limit = int64(n)
+
+	for this.limit > 0 && this.count > this.limit {
+		this.drop(ErrAckEvicted)
+	}
+}
+
+// Expire drops the messages put in the queue before t that are still waiting
+// for their acks, which Dropped returns with ErrAckExpired. It returns how many
+// it dropped.
+func (this *Ackqueue) Expire(t time.Time) int {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	n := 0
+
+	// The messages are in the order they were sent, and the head is always
+	// still waiting for its ack
+	for !this.empty() && this.ring[this.head].Sent.Before(t) {
+		this.drop(ErrAckExpired)
+		n++
+	}
+
+	return n
+}
+
+// Dropped returns the messages evicted or expired since it was last called, for
+// their Completers to be told, with the reason in their Err.
+func (this *Ackqueue) Dropped() []ackmsg {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	msgs := this.dropped
+	this.dropped = nil
+
+	return msgs
+}
+
+// Stats returns the counters of the queue.
+func (this *Ackqueue) Stats() AckqueueStats {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return AckqueueStats{
+		Len:       int(this.count),
+		Cap:       int(this.size),
+		Limit:     int(this.limit),
+		Acked:     this.acked,
+		Evicted:   this.evicted,
+		Expired:   this.expired,
+		Discarded: this.discarded,
+	}
+}
+
 // Wait() copies the message into a waiting queue, and waits for the corresponding
 // ack message to be received.
-func (this *Ackqueue) Wait(msg message.Message, onComplete interface{}) error {
+func (this *Ackqueue) Wait(msg message.Message, onComplete Completer) error {
 	this.mu.Lock()
 	defer this.mu.Unlock()
 
@@ -157,6 +320,12 @@ func (this *Ackqueue) Ack(msg message.Message) error {
 			if err != nil {
 				return err
 			}
+
+			// The messages complete in order, so the ones behind the head wait
+			// for it, and go with it once it does
+			if i == this.head {
+				this.collect()
+			}
 			//glog.Debugf("Acked: %v", msg)
 			//} else {
 			//glog.Debugf("Cannot ack %s message with packet ID %d", msg.Type(), msg.PacketId())
@@ -174,39 +343,221 @@ func (this *Ackqueue) Ack(msg message.Message) error {
 	return nil
 }
 
-// Acked() returns the list of messages that have completed the ack cycle.
+// Acked() returns the list of messages that have completed the ack cycle. The
+// list is only good until the next call.
 func (this *Ackqueue) Acked() []ackmsg {
 	this.mu.Lock()
 	defer this.mu.Unlock()
 
-	this.ackdone = this.ackdone[0:0]
-
 	if this.ping.State == message.PINGRESP {
 		this.ackdone = append(this.ackdone, this.ping)
 		this.ping = ackmsg{}
 	}
 
-FORNOTEMPTY:
+	done := this.ackdone
+	this.ackdone, this.spare = this.spare[0:0], done
+
+	return done
+}
+
+// collect moves the messages at the head that have completed their ack cycle to
+// the ones Acked returns.
+// The discarded ones have already been returned by Dropped, and are just
+// removed.
+func (this *Ackqueue) collect() {
 	for !this.empty() {
-		switch this.ring[this.head].State {
-		case message.PUBACK, message.PUBREL, message.PUBCOMP, message.SUBACK, message.UNSUBACK:
-			this.ackdone = append(this.ackdone, this.ring[this.head])
+		am := &this.ring[this.head]
+
+		if am.discarded {
 			this.removeHead()
+			continue
+		}
 
-		default:
-			break FORNOTEMPTY
+		if !completed(am.State) {
+			return
 		}
+
+		this.ackdone = append(this.ackdone, *am)
+		this.acked++
+		this.removeHead()
+	}
+}
+
+// drop drops the message at the head, which is still waiting for its ack, for
+// err.
+func (this *Ackqueue) drop(err error) {
+	am := this.ring[this.head]
+	am.Err = err
+	this.dropped = append(this.dropped, am)
+
+	switch err {
+	case ErrAckExpired:
+		this.expired++
+	case ErrAckDiscarded:
+		this.discarded++
+	default:
+		this.evicted++
 	}
 
-	return this.ackdone
+	this.removeHead()
+	this.collect()
 }
 
-func (this *Ackqueue) insert(pktid uint16, msg message.Message, onComplete interface{}) error {
-	if this.full() {
-		this.grow()
+// completed is whether a message in the state has completed its ack cycle.
+func completed(state message.MessageType) bool {
+	switch state {
+	case message.PUBACK, message.PUBREL, message.PUBCOMP, message.SUBACK, message.UNSUBACK:
+		return true
 	}
 
+	return false
+}
+
+// Unacked returns the messages still waiting for their acks, oldest first, for
+// them to be sent again once the connection is re-established. A QoS 2 message
+// that has been received by the other end, but not yet completed, is in the
+// PUBREC state.
+func (this *Ackqueue) Unacked() []ackmsg {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	msgs := make([]ackmsg, 0, this.count)
+
+	for n, i := int64(0), this.head; n < this.count; n, i = n+1, this.increment(i) {
+		if this.ring[i].discarded {
+			continue
+		}
+
+		switch this.ring[i].State {
+		case message.RESERVED, message.PUBREC:
+			msgs = append(msgs, this.ring[i])
+		}
+	}
+
+	return msgs
+}
+
+// Inflight returns the messages waiting for their acks, oldest first.
+func (this *Ackqueue) Inflight() []InflightMessage {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	msgs := make([]InflightMessage, 0, this.count)
+
+	for n, i := int64(0), this.head; n < this.count; n, i = n+1, this.increment(i) {
+		am := &this.ring[i]
+		if am.discarded || completed(am.State) {
+			continue
+		}
+
+		im := InflightMessage{
+			PacketId: am.Pktid,
+			Type:     am.Mtype.Name(),
+			State:    am.State.Name(),
+			Sent:     am.Sent,
+			Retries:  am.Retries,
+		}
+
+		if am.Mtype == message.PUBLISH {
+			pub := message.NewPublishMessage()
+			if _, err := pub.Decode(am.Msgbuf); err == nil {
+				im.Topic, im.QoS = string(pub.Topic()), pub.QoS()
+			}
+		}
+
+		msgs = append(msgs, im)
+	}
+
+	return msgs
+}
+
+// Retry returns the message to send again for the one waiting with the packet
+// ID, and counts the retry. That's the message itself with the DUP flag set, or
+// for a QoS 2 message the other end has already received, the PUBREL.
+func (this *Ackqueue) Retry(pktid uint16) (message.Message, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	i, ok := this.emap[pktid]
+	if !ok || completed(this.ring[i].State) {
+		return nil, ErrAckNotFound
+	}
+
+	am := &this.ring[i]
+
+	if am.State == message.PUBREC {
+		msg := message.NewPubrelMessage()
+		msg.SetPacketId(am.Pktid)
+		am.Retries++
+
+		return msg, nil
+	}
+
+	msg, err := am.Mtype.New()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := msg.Decode(am.Msgbuf); err != nil {
+		return nil, err
+	}
+
+	if pub, ok := msg.(*message.PublishMessage); ok {
+		pub.SetDup(true)
+	}
+
+	am.Retries++
+
+	return msg, nil
+}
+
+// Discard gives up on the message waiting with the packet ID without waiting for
+// its ack, which Dropped then returns with ErrAckDiscarded. The packet ID is
+// free to be used again straight away.
+func (this *Ackqueue) Discard(pktid uint16) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	i, ok := this.emap[pktid]
+	if !ok || completed(this.ring[i].State) {
+		return ErrAckNotFound
+	}
+
+	if i == this.head {
+		this.drop(ErrAckDiscarded)
+		return nil
+	}
+
+	am := this.ring[i]
+	am.Err = ErrAckDiscarded
+	this.dropped = append(this.dropped, am)
+	this.discarded++
+
+	this.ring[i].discarded = true
+	delete(this.emap, pktid)
+
+	return nil
+}
+
+// Has returns whether a message with the packet ID is waiting for its ack.
+func (this *Ackqueue) Has(pktid uint16) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	_, ok := this.emap[pktid]
+	return ok
+}
+
+func (this *Ackqueue) insert(pktid uint16, msg message.Message, onComplete Completer) error {
 	if _, ok := this.emap[pktid]; !ok {
+		if this.limit > 0 && this.count >= this.limit {
+			this.drop(ErrAckEvicted)
+		}
+
+		if this.full() {
+			this.grow()
+		}
+
 		// message length
 		ml := msg.Len()
 
@@ -217,6 +568,7 @@ func (this *Ackqueue) insert(pktid uint16, msg message.Message, onComplete inter
 			Pktid:      msg.PacketId(),
 			Msgbuf:     make([]byte, ml),
 			OnComplete: onComplete,
+			Sent:       time.Now(),
 		}
 
 		if _, err := msg.Encode(am.Msgbuf); err != nil {
@@ -252,12 +604,16 @@ func (this *Ackqueue) removeHead() error {
 		return errQueueEmpty
 	}
 
-	it := this.ring[this.head]
+	h := this.head
+	it := this.ring[h]
 	// set this to empty ackmsg{} to ensure GC will collect the buffer
-	this.ring[this.head] = ackmsg{}
-	this.head = this.increment(this.head)
+	this.ring[h] = ackmsg{}
+	this.head = this.increment(h)
 	this.count--
-	delete(this.emap, it.Pktid)
+
+	if i, ok := this.emap[it.Pktid]; ok && i == h {
+		delete(this.emap, it.Pktid)
+	}
 
 	return nil
 }
@@ -287,7 +643,9 @@ func (this *Ackqueue) grow() {
 	this.emap = make(map[uint16]int64, this.size)
 
 	for i := int64(0); i < this.tail; i++ {
-		this.emap[this.ring[i].Pktid] = i
+		if !this.ring[i].discarded {
+			this.emap[this.ring[i].Pktid] = i
+		}
 	}
 }
 
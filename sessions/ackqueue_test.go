@@ -16,6 +16,7 @@ package sessions
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/surgemq/message"
@@ -48,3 +49,220 @@ func TestAckQueueOutOfOrder(t *testing.T) {
 
 	require.Equal(t, 2, len(acked))
 }
+
+type countCompleter struct {
+	n int
+}
+
+func (this *countCompleter) Complete(msg, ack message.Message, err error) error {
+	this.n++
+	return nil
+}
+
+func TestAckQueueCompleter(t *testing.T) {
+	q := newAckqueue(4)
+
+	c := &countCompleter{}
+	var f CompleteFunc
+
+	q.Wait(newPublishMessage(1, 1), c)
+	q.Wait(newPublishMessage(2, 1), f)
+
+	for i := 1; i <= 2; i++ {
+		ack := message.NewPubackMessage()
+		ack.SetPacketId(uint16(i))
+		q.Ack(ack)
+	}
+
+	acked := q.Acked()
+	require.Equal(t, 2, len(acked))
+
+	for _, am := range acked {
+		require.NoError(t, am.OnComplete.Complete(nil, nil, nil))
+	}
+
+	require.Equal(t, 1, c.n)
+}
+
+func TestAckQueueUnacked(t *testing.T) {
+	q := newAckqueue(4)
+
+	for i := 1; i <= 6; i++ {
+		q.Wait(newPublishMessage(uint16(i), 2), nil)
+	}
+
+	// Completed, but still in the queue behind the first one
+	comp := message.NewPubcompMessage()
+	comp.SetPacketId(2)
+	q.Ack(comp)
+
+	rec := message.NewPubrecMessage()
+	rec.SetPacketId(3)
+	q.Ack(rec)
+
+	var pktids []uint16
+	var states []message.MessageType
+	for _, am := range q.Unacked() {
+		pktids = append(pktids, am.Pktid)
+		states = append(states, am.State)
+	}
+
+	require.Equal(t, []uint16{1, 3, 4, 5, 6}, pktids)
+	require.Equal(t, []message.MessageType{message.RESERVED, message.PUBREC, message.RESERVED, message.RESERVED, message.RESERVED}, states)
+}
+
+func TestAckQueueLimit(t *testing.T) {
+	q := newAckqueue(2)
+	q.SetLimit(3)
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, q.Wait(newPublishMessage(uint16(i), 1), nil))
+	}
+
+	// The oldest two are evicted for the last two, and the ring doesn't grow
+	// past the limit
+	dropped := q.Dropped()
+	require.Len(t, dropped, 2)
+	require.Equal(t, uint16(1), dropped[0].Pktid)
+	require.Equal(t, ErrAckEvicted, dropped[0].Err)
+	require.False(t, q.Has(1))
+	require.Len(t, q.Dropped(), 0)
+
+	st := q.Stats()
+	require.Equal(t, 3, st.Len)
+	require.Equal(t, 4, st.Cap)
+	require.Equal(t, int64(2), st.Evicted)
+
+	// Those acked behind an evicted one go with it
+	ack := message.NewPubackMessage()
+	ack.SetPacketId(4)
+	require.NoError(t, q.Ack(ack))
+	require.Len(t, q.Acked(), 0)
+
+	require.NoError(t, q.Wait(newPublishMessage(6, 1), nil))
+	require.Len(t, q.Dropped(), 1)
+
+	acked := q.Acked()
+	require.Len(t, acked, 1)
+	require.Equal(t, uint16(4), acked[0].Pktid)
+	require.Equal(t, int64(1), q.Stats().Acked)
+}
+
+func TestAckQueueExpire(t *testing.T) {
+	q := newAckqueue(4)
+
+	require.NoError(t, q.Wait(newPublishMessage(1, 1), nil))
+	require.NoError(t, q.Wait(newPublishMessage(2, 1), nil))
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(time.Millisecond)
+	require.NoError(t, q.Wait(newPublishMessage(3, 1), nil))
+
+	require.Equal(t, 2, q.Expire(cutoff))
+
+	dropped := q.Dropped()
+	require.Len(t, dropped, 2)
+	require.Equal(t, ErrAckExpired, dropped[1].Err)
+	require.Equal(t, int64(2), q.Stats().Expired)
+	require.Equal(t, 1, q.len())
+}
+
+func TestAckQueueRetryDiscard(t *testing.T) {
+	q := newAckqueue(2)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, q.Wait(newPublishMessage(uint16(i), 2), nil))
+	}
+
+	inflight := q.Inflight()
+	require.Len(t, inflight, 3)
+	require.Equal(t, uint16(1), inflight[0].PacketId)
+	require.Equal(t, "PUBLISH", inflight[0].Type)
+	require.Equal(t, "RESERVED", inflight[0].State)
+	require.Equal(t, "abc", inflight[0].Topic)
+	require.Equal(t, byte(2), inflight[0].QoS)
+
+	// The message is sent again as a duplicate, and once received, the PUBREL
+	msg, err := q.Retry(2)
+	require.NoError(t, err)
+	require.True(t, msg.(*message.PublishMessage).Dup())
+
+	pubrec := message.NewPubrecMessage()
+	pubrec.SetPacketId(2)
+	require.NoError(t, q.Ack(pubrec))
+
+	msg, err = q.Retry(2)
+	require.NoError(t, err)
+	require.Equal(t, message.PUBREL, msg.Type())
+	require.Equal(t, 2, q.Inflight()[1].Retries)
+
+	_, err = q.Retry(9)
+	require.Equal(t, ErrAckNotFound, err)
+
+	// Discarded from behind the head, its packet ID is free straight away
+	require.NoError(t, q.Discard(2))
+	require.False(t, q.Has(2))
+	require.Equal(t, ErrAckNotFound, q.Discard(2))
+
+	dropped := q.Dropped()
+	require.Len(t, dropped, 1)
+	require.Equal(t, ErrAckDiscarded, dropped[0].Err)
+	require.Len(t, q.Inflight(), 2)
+	require.Len(t, q.Unacked(), 2)
+
+	require.NoError(t, q.Wait(newPublishMessage(2, 2), nil))
+	require.True(t, q.Has(2))
+
+	// and it's skipped once the head is acked
+	pubcomp := message.NewPubcompMessage()
+	pubcomp.SetPacketId(1)
+	require.NoError(t, q.Ack(pubcomp))
+	require.Len(t, q.Acked(), 1)
+
+	require.NoError(t, q.Discard(3))
+	require.Equal(t, uint16(2), q.Inflight()[0].PacketId)
+	require.Equal(t, int64(2), q.Stats().Discarded)
+	require.Equal(t, 1, q.len())
+}
+
+// BenchmarkAckQueueQos1 is a client with a window of 1000 QoS 1 messages in
+// flight, acked in order.
+func BenchmarkAckQueueQos1(b *testing.B) {
+	benchmarkAckQueueQos1(b, 1000, false)
+}
+
+// BenchmarkAckQueueQos1Reversed is BenchmarkAckQueueQos1 with each window
+// acked back to front, so they all wait for the first one.
+func BenchmarkAckQueueQos1Reversed(b *testing.B) {
+	benchmarkAckQueueQos1(b, 1000, true)
+}
+
+func benchmarkAckQueueQos1(b *testing.B, window int, reversed bool) {
+	q := newAckqueue(window)
+
+	msgs := make([]*message.PublishMessage, window)
+	acks := make([]*message.PubackMessage, window)
+	for i := range msgs {
+		msgs[i] = newPublishMessage(uint16(i+1), 1)
+		acks[i] = message.NewPubackMessage()
+		acks[i].SetPacketId(uint16(i + 1))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n += window {
+		for _, msg := range msgs {
+			q.Wait(msg, nil)
+		}
+
+		for i := range acks {
+			if reversed {
+				i = window - 1 - i
+			}
+
+			q.Ack(acks[i])
+			q.Acked()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"time"
+)
+
+// BanKind is what a ban matches the clients on.
+type BanKind string
+
+const (
+	BanClientId BanKind = "client_id"
+	BanUsername BanKind = "username"
+
+	// BanIP matches the IP address the client connects from, or the addresses in
+	// a CIDR range, e.g., "10.1.0.0/16".
+	BanIP BanKind = "ip"
+
+	// BanCert matches the SHA-256 fingerprint of the client's TLS certificate, in
+	// hex.
+	BanCert BanKind = "cert"
+)
+
+// Ban keeps the clients it matches from connecting.
+type Ban struct {
+	Kind  BanKind `json:"kind"`
+	Value string  `json:"value"`
+
+	// Reason is why the clients were banned, for the operators.
+	Reason string `json:"reason,omitempty"`
+
+	// Created is when the ban was added.
+	Created time.Time `json:"created"`
+
+	// Expires is when the ban is lifted. If not set then it's never lifted.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Expired is whether the ban has been lifted by now.
+func (this Ban) Expired(now time.Time) bool {
+	return !this.Expires.IsZero() && !now.Before(this.Expires)
+}
+
+// BanStore is implemented by SessionsProviders that persist bans along with the
+// sessions, so they are still in force after the server restarts.
+type BanStore interface {
+	// SaveBan adds the ban, or replaces the one of the same kind and value.
+	SaveBan(ban Ban) error
+
+	// DeleteBan removes the ban of that kind and value, if there's one.
+	DeleteBan(kind BanKind, value string) error
+
+	// Bans returns all the bans, expired or not.
+	Bans() ([]Ban, error)
+}
+
+// SaveBan persists the ban if the provider supports it. Providers that don't
+// persist anything keep nothing.
+func (this *Manager) SaveBan(ban Ban) error {
+	if s, ok := this.p.(BanStore); ok {
+		return s.SaveBan(ban)
+	}
+
+	return nil
+}
+
+// DeleteBan removes the persisted ban if the provider supports it.
+func (this *Manager) DeleteBan(kind BanKind, value string) error {
+	if s, ok := this.p.(BanStore); ok {
+		return s.DeleteBan(kind, value)
+	}
+
+	return nil
+}
+
+// Bans returns the persisted bans if the provider supports it.
+func (this *Manager) Bans() ([]Ban, error) {
+	if s, ok := this.p.(BanStore); ok {
+		return s.Bans()
+	}
+
+	return nil, nil
+}
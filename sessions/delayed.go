@@ -0,0 +1,80 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"time"
+)
+
+// DelayedMessage is a message published with a delay, held until it's due.
+type DelayedMessage struct {
+	// ID identifies the message among the ones held.
+	ID string `json:"id"`
+
+	// ClientId is the client that published the message.
+	ClientId string `json:"client_id,omitempty"`
+
+	Topic   []byte `json:"topic"`
+	Payload []byte `json:"payload"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+
+	// Due is when the message is published.
+	Due time.Time `json:"due"`
+}
+
+// DelayedStore is implemented by SessionsProviders that persist the delayed
+// messages along with the sessions, so they are still published after the
+// server restarts.
+type DelayedStore interface {
+	// SaveDelayed adds the message, or replaces the one with the same ID.
+	SaveDelayed(msg DelayedMessage) error
+
+	// DeleteDelayed removes the message with that ID, if there's one.
+	DeleteDelayed(id string) error
+
+	// DelayedMessages returns all the messages held, due or not.
+	DelayedMessages() ([]DelayedMessage, error)
+}
+
+// SaveDelayed persists the delayed message if the provider supports it.
+// Providers that don't persist anything keep nothing.
+func (this *Manager) SaveDelayed(msg DelayedMessage) error {
+	if s, ok := this.p.(DelayedStore); ok {
+		return s.SaveDelayed(msg)
+	}
+
+	return nil
+}
+
+// DeleteDelayed removes the persisted delayed message if the provider supports
+// it.
+func (this *Manager) DeleteDelayed(id string) error {
+	if s, ok := this.p.(DelayedStore); ok {
+		return s.DeleteDelayed(id)
+	}
+
+	return nil
+}
+
+// DelayedMessages returns the persisted delayed messages if the provider
+// supports it.
+func (this *Manager) DelayedMessages() ([]DelayedMessage, error) {
+	if s, ok := this.p.(DelayedStore); ok {
+		return s.DelayedMessages()
+	}
+
+	return nil, nil
+}
@@ -14,6 +14,13 @@
 
 package sessions
 
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
 /*
 func TestMemStore(t *testing.T) {
 	st := NewMemStore()
@@ -38,3 +45,32 @@ func TestMemStore(t *testing.T) {
 	require.Equal(t, 5, st.Len(), "Incorrect length.")
 }
 */
+
+func TestMemProviderConcurrentCount(t *testing.T) {
+	p := NewMemProvider()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 1000; i++ {
+			id := fmt.Sprintf("%d", i%10)
+			p.New(id)
+			p.Del(id)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			require.NoError(t, p.Close())
+			require.Equal(t, 0, p.Count())
+			return
+		default:
+		}
+
+		require.True(t, p.Count() <= 10)
+		require.NoError(t, p.Close())
+	}
+}
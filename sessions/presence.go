@@ -0,0 +1,62 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"time"
+)
+
+// Presence is when a client was last seen.
+type Presence struct {
+	ClientId   string `json:"client_id"`
+	Username   string `json:"username,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Connected is whether the client is connected, since ConnectedSince. Once it
+	// has disconnected, DisconnectedAt is when it did, and DisconnectReason why.
+	Connected        bool      `json:"connected"`
+	ConnectedSince   time.Time `json:"connected_since"`
+	DisconnectedAt   time.Time `json:"disconnected_at,omitempty"`
+	DisconnectReason string    `json:"disconnect_reason,omitempty"`
+}
+
+// PresenceStore is implemented by SessionsProviders that persist when the
+// clients were last seen along with the sessions, so it's still known after the
+// server restarts.
+type PresenceStore interface {
+	// SavePresence replaces the presence of the client p is for.
+	SavePresence(p Presence) error
+
+	// Presences returns the presence of all the clients.
+	Presences() ([]Presence, error)
+}
+
+// SavePresence persists the presence if the provider supports it.
+func (this *Manager) SavePresence(p Presence) error {
+	if s, ok := this.p.(PresenceStore); ok {
+		return s.SavePresence(p)
+	}
+
+	return nil
+}
+
+// Presences returns the persisted presences if the provider supports it.
+func (this *Manager) Presences() ([]Presence, error) {
+	if s, ok := this.p.(PresenceStore); ok {
+		return s.Presences()
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sessions
+
+import (
+	"time"
+)
+
+// QuotaUsage is what a client has published in the current hour and day, counted
+// against its quota.
+type QuotaUsage struct {
+	// Hour and Day are the starts of the hour and the day, in UTC, the counters
+	// are for.
+	Hour time.Time `json:"hour"`
+	Day  time.Time `json:"day"`
+
+	// The number of messages, and of payload bytes, published in the hour and
+	// in the day
+	HourMessages int64 `json:"hour_messages"`
+	HourBytes    int64 `json:"hour_bytes"`
+	DayMessages  int64 `json:"day_messages"`
+	DayBytes     int64 `json:"day_bytes"`
+}
+
+// Roll resets the counters of the periods that have ended by now.
+func (this *QuotaUsage) Roll(now time.Time) {
+	now = now.UTC()
+
+	if hour := now.Truncate(time.Hour); !hour.Equal(this.Hour) {
+		this.Hour, this.HourMessages, this.HourBytes = hour, 0, 0
+	}
+
+	if day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC); !day.Equal(this.Day) {
+		this.Day, this.DayMessages, this.DayBytes = day, 0, 0
+	}
+}
+
+// QuotaStore is implemented by SessionsProviders that persist the quota usage of
+// the clients along with the sessions, so restarting the server doesn't give
+// them their quotas back.
+type QuotaStore interface {
+	// SaveQuotaUsage replaces the usage of the client cid.
+	SaveQuotaUsage(cid string, usage QuotaUsage) error
+
+	// QuotaUsage returns the usage of all the clients, keyed by client ID.
+	QuotaUsage() (map[string]QuotaUsage, error)
+}
+
+// SaveQuotaUsage persists the usage if the provider supports it.
+func (this *Manager) SaveQuotaUsage(cid string, usage QuotaUsage) error {
+	if s, ok := this.p.(QuotaStore); ok {
+		return s.SaveQuotaUsage(cid, usage)
+	}
+
+	return nil
+}
+
+// QuotaUsage returns the persisted usage if the provider supports it.
+func (this *Manager) QuotaUsage() (map[string]QuotaUsage, error) {
+	if s, ok := this.p.(QuotaStore); ok {
+		return s.QuotaUsage()
+	}
+
+	return nil, nil
+}
@@ -66,6 +66,9 @@ type Session struct {
 	// Initialized?
 	initted bool
 
+	// pktid is the last packet ID handed out by NextPacketId
+	pktid uint16
+
 	// Serialize access to this session
 	mu sync.Mutex
 
@@ -115,6 +118,49 @@ func (this *Session) Init(msg *message.ConnectMessage) error {
 	return nil
 }
 
+// SetInflightLimit sets the most QoS 1 and 2 messages each, sent to the client,
+// that can wait for their acks, see Ackqueue.SetLimit.
+func (this *Session) SetInflightLimit(n int) {
+	this.Pub1ack.SetLimit(n)
+	this.Pub2out.SetLimit(n)
+}
+
+// NextPacketId returns the packet ID of the next QoS 1 or 2 message sent to the
+// client. The IDs go up from the last one handed out, wrapping around, and those
+// of the messages still waiting for their acks are skipped, so they never
+// collide with them. As the session outlives the connection, they carry on
+// where they left off when the client reconnects. It returns ErrNoPacketId if
+// all the IDs are waiting for acks.
+func (this *Session) NextPacketId() (uint16, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for i := 0; i < 65535; i++ {
+		this.pktid++
+		if this.pktid == 0 {
+			this.pktid = 1
+		}
+
+		if !this.inflight(this.pktid) {
+			return this.pktid, nil
+		}
+	}
+
+	return 0, ErrNoPacketId
+}
+
+// inflight is whether a message sent to the client with the packet ID is still
+// waiting for its ack.
+func (this *Session) inflight(pktid uint16) bool {
+	for _, q := range []*Ackqueue{this.Pub1ack, this.Pub2out, this.Suback, this.Unsuback} {
+		if q != nil && q.Has(pktid) {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (this *Session) Update(msg *message.ConnectMessage) error {
 	this.mu.Lock()
 	defer this.mu.Unlock()
@@ -177,6 +223,16 @@ func (this *Session) RemoveTopic(topic string) error {
 	return nil
 }
 
+// Topic returns the QoS, along with any subscription options, of the
+// subscription to topic, and whether there is one.
+func (this *Session) Topic(topic string) (byte, bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	qos, ok := this.topics[topic]
+	return qos, ok
+}
+
 func (this *Session) Topics() ([]string, []byte, error) {
 	this.mu.Lock()
 	defer this.mu.Unlock()
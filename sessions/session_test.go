@@ -82,6 +82,30 @@ func TestSessionPublishAckqueue(t *testing.T) {
 	require.Equal(t, 2, len(acked))
 }
 
+func TestSessionNextPacketId(t *testing.T) {
+	sess := &Session{}
+	err := sess.Init(newConnectMessage())
+	require.NoError(t, err)
+
+	// The IDs of the messages waiting for their acks are skipped
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, sess.Pub1ack.Wait(newPublishMessage(uint16(i), 1), nil))
+	}
+
+	pktid, err := sess.NextPacketId()
+	require.NoError(t, err)
+	require.Equal(t, uint16(4), pktid)
+	require.NoError(t, sess.Pub1ack.Wait(newPublishMessage(pktid, 1), nil))
+
+	// 0 isn't a packet ID, so they wrap around to 1, and on past the ones
+	// still in use
+	sess.pktid = 65535
+
+	pktid, err = sess.NextPacketId()
+	require.NoError(t, err)
+	require.Equal(t, uint16(5), pktid)
+}
+
 func newConnectMessage() *message.ConnectMessage {
 	msg := message.NewConnectMessage()
 	msg.SetWillQos(1)
@@ -25,6 +25,7 @@ import (
 var (
 	ErrSessionsProviderNotFound = errors.New("Session: Session provider not found")
 	ErrKeyNotAvailable          = errors.New("Session: not item found for key.")
+	ErrNoPacketId               = errors.New("Session: No packet ID left")
 
 	providers = make(map[string]SessionsProvider)
 )
@@ -0,0 +1,382 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package storetest checks that a sessions.SessionsProvider behaves the way the
+// server expects it to.
+//
+// The server only talks to the provider through the SessionsProvider interface,
+// but it relies on more than the method signatures: a session that was saved
+// can be found again until it's deleted, a missing session is an error rather
+// than a nil session, and every method can be called from many connections at
+// once. TestProvider checks all of that, so a provider that passes it can be
+// registered in place of the "mem" provider. Providers that keep the bans, the
+// delayed messages or the presence of the clients as well, by implementing
+// sessions.BanStore, sessions.DelayedStore or sessions.PresenceStore, have
+// those checked too.
+//
+// To check a provider, call TestProvider from one of its tests with a function
+// that returns a new, empty provider each time it's called:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.TestProvider(t, func() sessions.SessionsProvider {
+//			return newRedisProvider(testAddr)
+//		})
+//	}
+//
+// Each subtest closes the provider it was given once it's done.
+package storetest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/sessions"
+)
+
+// TestProvider runs the conformance tests against the providers returned by
+// newProvider.
+func TestProvider(t *testing.T, newProvider func() sessions.SessionsProvider) {
+	tests := []struct {
+		name string
+		f    func(*testing.T, sessions.SessionsProvider)
+	}{
+		{"New", testNew},
+		{"GetMissing", testGetMissing},
+		{"Save", testSave},
+		{"Replace", testReplace},
+		{"Del", testDel},
+		{"Count", testCount},
+		{"Concurrent", testConcurrent},
+		{"Bans", testBans},
+		{"Delayed", testDelayed},
+		{"Presence", testPresence},
+		{"Close", testClose},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			p := newProvider()
+			require.NotNil(t, p, "newProvider returned nil")
+
+			if test.name != "Close" {
+				defer p.Close()
+			}
+
+			test.f(t, p)
+		})
+	}
+}
+
+// testNew checks a new session can be initialized and found again.
+func testNew(t *testing.T, p sessions.SessionsProvider) {
+	sess := newSession(t, p, "storetest1")
+
+	got, err := p.Get("storetest1")
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.Equal(t, sess.ID(), got.ID())
+}
+
+// testGetMissing checks a session that was never created is an error, which is
+// how the server knows to start a new one.
+func testGetMissing(t *testing.T, p sessions.SessionsProvider) {
+	sess, err := p.Get("storetest-missing")
+	require.Error(t, err)
+	require.Nil(t, sess)
+}
+
+// testSave checks the changes made to a session are kept once it's saved.
+func testSave(t *testing.T, p sessions.SessionsProvider) {
+	sess := newSession(t, p, "storetest1")
+
+	require.NoError(t, sess.AddTopic("a/b", 1))
+	require.NoError(t, sess.AddTopic("a/+/c", 2))
+	require.NoError(t, p.Save("storetest1"))
+
+	got, err := p.Get("storetest1")
+	require.NoError(t, err)
+
+	topics, qoss, err := got.Topics()
+	require.NoError(t, err)
+	require.Equal(t, map[string]byte{"a/b": 1, "a/+/c": 2}, topicMap(topics, qoss))
+
+	require.NoError(t, got.RemoveTopic("a/b"))
+	require.NoError(t, p.Save("storetest1"))
+
+	got, err = p.Get("storetest1")
+	require.NoError(t, err)
+
+	topics, qoss, err = got.Topics()
+	require.NoError(t, err)
+	require.Equal(t, map[string]byte{"a/+/c": 2}, topicMap(topics, qoss))
+}
+
+// testReplace checks New replaces an existing session, which is what a client
+// connecting with CleanSession set expects.
+func testReplace(t *testing.T, p sessions.SessionsProvider) {
+	sess := newSession(t, p, "storetest1")
+	require.NoError(t, sess.AddTopic("a/b", 1))
+	require.NoError(t, p.Save("storetest1"))
+
+	newSession(t, p, "storetest1")
+	require.Equal(t, 1, p.Count())
+
+	got, err := p.Get("storetest1")
+	require.NoError(t, err)
+
+	topics, _, err := got.Topics()
+	require.NoError(t, err)
+	require.Empty(t, topics)
+}
+
+// testDel checks a deleted session is gone, and deleting one that doesn't exist
+// is harmless.
+func testDel(t *testing.T, p sessions.SessionsProvider) {
+	newSession(t, p, "storetest1")
+	newSession(t, p, "storetest2")
+
+	p.Del("storetest1")
+	p.Del("storetest-missing")
+
+	_, err := p.Get("storetest1")
+	require.Error(t, err)
+
+	_, err = p.Get("storetest2")
+	require.NoError(t, err)
+
+	require.Equal(t, 1, p.Count())
+}
+
+// testCount checks Count follows the sessions being created and deleted.
+func testCount(t *testing.T, p sessions.SessionsProvider) {
+	require.Equal(t, 0, p.Count())
+
+	for i := 0; i < 10; i++ {
+		newSession(t, p, fmt.Sprintf("storetest%d", i))
+	}
+
+	require.Equal(t, 10, p.Count())
+
+	for i := 0; i < 5; i++ {
+		p.Del(fmt.Sprintf("storetest%d", i))
+	}
+
+	require.Equal(t, 5, p.Count())
+}
+
+// testConcurrent checks the provider can be used by many connections at once.
+// It's most useful with the race detector on.
+func testConcurrent(t *testing.T, p sessions.SessionsProvider) {
+	const n = 20
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, n)
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(id string) {
+			defer wg.Done()
+
+			sess, err := p.New(id)
+			if err == nil {
+				err = sess.Init(newConnectMessage(id))
+			}
+			if err == nil {
+				err = p.Save(id)
+			}
+			if err == nil {
+				_, err = p.Get(id)
+			}
+
+			p.Count()
+			p.Del(id)
+
+			errs <- err
+		}(fmt.Sprintf("storetest%d", i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, 0, p.Count())
+}
+
+// testBans checks the bans are kept, replaced by kind and value, and removed,
+// with all their fields, if the provider is a sessions.BanStore.
+func testBans(t *testing.T, p sessions.SessionsProvider) {
+	s, ok := p.(sessions.BanStore)
+	if !ok {
+		t.Skip("provider doesn't keep bans")
+	}
+
+	created := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	ban := sessions.Ban{Kind: sessions.BanIP, Value: "10.0.0.0/8", Reason: "flooding", Created: created, Expires: created.Add(time.Hour)}
+	require.NoError(t, s.SaveBan(ban))
+	require.NoError(t, s.SaveBan(sessions.Ban{Kind: sessions.BanClientId, Value: "rogue", Created: created}))
+
+	ban.Reason = "still flooding"
+	require.NoError(t, s.SaveBan(ban))
+
+	bans, err := s.Bans()
+	require.NoError(t, err)
+	require.Len(t, bans, 2)
+
+	for _, b := range bans {
+		if b.Kind == sessions.BanIP {
+			require.Equal(t, ban.Value, b.Value)
+			require.Equal(t, ban.Reason, b.Reason)
+			require.True(t, ban.Created.Equal(b.Created))
+			require.True(t, ban.Expires.Equal(b.Expires))
+		}
+	}
+
+	require.NoError(t, s.DeleteBan(sessions.BanClientId, "rogue"))
+	require.NoError(t, s.DeleteBan(sessions.BanUsername, "nobody"))
+
+	bans, err = s.Bans()
+	require.NoError(t, err)
+	require.Len(t, bans, 1)
+	require.Equal(t, sessions.BanIP, bans[0].Kind)
+}
+
+// testDelayed checks the delayed messages are kept, replaced by ID, and removed,
+// with all their fields, if the provider is a sessions.DelayedStore.
+func testDelayed(t *testing.T, p sessions.SessionsProvider) {
+	s, ok := p.(sessions.DelayedStore)
+	if !ok {
+		t.Skip("provider doesn't keep delayed messages")
+	}
+
+	due := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	msg := sessions.DelayedMessage{ID: "1", ClientId: "storetest1", Topic: []byte("a/b"), Payload: []byte("hello"), QoS: 1, Retain: true, Due: due}
+	require.NoError(t, s.SaveDelayed(msg))
+	require.NoError(t, s.SaveDelayed(sessions.DelayedMessage{ID: "2", Topic: []byte("c"), Due: due}))
+
+	msg.Payload = []byte("hello again")
+	require.NoError(t, s.SaveDelayed(msg))
+
+	msgs, err := s.DelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+
+	for _, m := range msgs {
+		if m.ID == msg.ID {
+			require.Equal(t, msg.ClientId, m.ClientId)
+			require.Equal(t, msg.Topic, m.Topic)
+			require.Equal(t, msg.Payload, m.Payload)
+			require.Equal(t, msg.QoS, m.QoS)
+			require.Equal(t, msg.Retain, m.Retain)
+			require.True(t, msg.Due.Equal(m.Due))
+		}
+	}
+
+	require.NoError(t, s.DeleteDelayed("2"))
+	require.NoError(t, s.DeleteDelayed("3"))
+
+	msgs, err = s.DelayedMessages()
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, msg.ID, msgs[0].ID)
+}
+
+// testPresence checks the presences are kept and replaced by client ID, with all
+// their fields, if the provider is a sessions.PresenceStore.
+func testPresence(t *testing.T, p sessions.SessionsProvider) {
+	s, ok := p.(sessions.PresenceStore)
+	if !ok {
+		t.Skip("provider doesn't keep presence")
+	}
+
+	since := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	pr := sessions.Presence{ClientId: "storetest1", Username: "surgemq", RemoteAddr: "10.0.0.1:1883", Connected: true, ConnectedSince: since}
+	require.NoError(t, s.SavePresence(pr))
+	require.NoError(t, s.SavePresence(sessions.Presence{ClientId: "storetest2", ConnectedSince: since}))
+
+	pr.Connected = false
+	pr.DisconnectedAt = since.Add(time.Hour)
+	pr.DisconnectReason = "keepalive_timeout"
+	require.NoError(t, s.SavePresence(pr))
+
+	prs, err := s.Presences()
+	require.NoError(t, err)
+	require.Len(t, prs, 2)
+
+	for _, got := range prs {
+		if got.ClientId == pr.ClientId {
+			require.Equal(t, pr.Username, got.Username)
+			require.Equal(t, pr.RemoteAddr, got.RemoteAddr)
+			require.False(t, got.Connected)
+			require.True(t, pr.ConnectedSince.Equal(got.ConnectedSince))
+			require.True(t, pr.DisconnectedAt.Equal(got.DisconnectedAt))
+			require.Equal(t, pr.DisconnectReason, got.DisconnectReason)
+		}
+	}
+}
+
+// testClose checks a provider can be closed.
+func testClose(t *testing.T, p sessions.SessionsProvider) {
+	newSession(t, p, "storetest1")
+	require.NoError(t, p.Close())
+}
+
+// newSession creates and initializes the session the way the server does when a
+// client connects.
+func newSession(t *testing.T, p sessions.SessionsProvider, id string) *sessions.Session {
+	sess, err := p.New(id)
+	require.NoError(t, err)
+	require.NotNil(t, sess)
+
+	require.NoError(t, sess.Init(newConnectMessage(id)))
+	require.Equal(t, id, sess.ID())
+	require.NoError(t, p.Save(id))
+
+	return sess
+}
+
+func newConnectMessage(id string) *message.ConnectMessage {
+	msg := message.NewConnectMessage()
+	msg.SetVersion(4)
+	msg.SetClientId([]byte(id))
+	msg.SetKeepAlive(10)
+	msg.SetWillQos(1)
+	msg.SetWillTopic([]byte("will"))
+	msg.SetWillMessage([]byte("send me home"))
+
+	return msg
+}
+
+func topicMap(topics []string, qoss []byte) map[string]byte {
+	m := make(map[string]byte, len(topics))
+	for i, topic := range topics {
+		m[topic] = qoss[i]
+	}
+
+	return m
+}
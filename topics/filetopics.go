@@ -0,0 +1,196 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+// QuarantineDir is the directory, under the directory of a file provider, the
+// retained messages that could not be read back are moved to in safe mode.
+const QuarantineDir = "quarantine"
+
+var _ TopicsProvider = (*fileTopics)(nil)
+var _ Recoverer = (*fileTopics)(nil)
+
+// fileTopics keeps the subscriptions and retained messages in memory like
+// memTopics, and writes each retained message to a file of its own as well, so
+// they are still there after a restart. The files are named after a hash of the
+// topic, which may be too long for a file name, and the topic is read back from
+// the message in the file.
+type fileTopics struct {
+	*memTopics
+
+	dir string
+
+	// Keeps the files in the same order as the messages in memory
+	fmu sync.Mutex
+}
+
+// NewFileProvider returns a TopicsProvider that persists the retained messages
+// in dir, one file per topic, and reads them back when the server recovers on
+// startup. Subscriptions are not persisted. Register it under a name to use it:
+//
+//	p, err := topics.NewFileProvider("/var/lib/surgemq/retained")
+//	if err != nil {
+//		return err
+//	}
+//	topics.Register("file", p)
+//	svr := &service.Server{TopicsProvider: "file"}
+func NewFileProvider(dir string) (TopicsProvider, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileTopics{
+		memTopics: NewMemProvider(),
+		dir:       dir,
+	}, nil
+}
+
+func (this *fileTopics) Retain(msg *message.PublishMessage) error {
+	this.fmu.Lock()
+	defer this.fmu.Unlock()
+
+	path := this.path(msg.Topic())
+
+	if len(msg.Payload()) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return this.memTopics.Retain(msg)
+	}
+
+	buf := make([]byte, msg.Len())
+	n, err := msg.Encode(buf)
+	if err != nil {
+		return err
+	}
+
+	// Written aside first, so a crash never leaves half a message behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf[:n], 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return this.memTopics.Retain(msg)
+}
+
+// Recover reads the retained messages back from the directory. In safe mode the
+// ones that can't be read are moved to QuarantineDir.
+func (this *fileTopics) Recover(safe bool) (int, []BadRecord, error) {
+	this.fmu.Lock()
+	defer this.fmu.Unlock()
+
+	entries, err := os.ReadDir(this.dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		n   int
+		bad []BadRecord
+	)
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		// Left over by a crash while being written
+		if strings.HasSuffix(e.Name(), ".tmp") {
+			os.Remove(filepath.Join(this.dir, e.Name()))
+			continue
+		}
+
+		msg, err := this.read(e.Name())
+		if err == nil {
+			err = this.memTopics.Retain(msg)
+		}
+
+		if err == nil {
+			n++
+			continue
+		}
+
+		if !safe {
+			return 0, nil, fmt.Errorf("topics/Recover: Error reading %s: %v", e.Name(), err)
+		}
+
+		if err := this.quarantine(e.Name()); err != nil {
+			return 0, nil, err
+		}
+
+		bad = append(bad, BadRecord{Key: e.Name(), Err: err})
+	}
+
+	return n, bad, nil
+}
+
+// read decodes the retained message in the file name, which must be named after
+// the topic of the message.
+func (this *fileTopics) read(name string) (*message.PublishMessage, error) {
+	buf, err := os.ReadFile(filepath.Join(this.dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := message.NewPublishMessage()
+	if _, err := msg.Decode(buf); err != nil {
+		return nil, err
+	}
+
+	if fileName(msg.Topic()) != name {
+		return nil, fmt.Errorf("Message is for topic %q", msg.Topic())
+	}
+
+	return msg, nil
+}
+
+// quarantine moves the file name to QuarantineDir, out of the way of the next
+// recovery but still there to be looked at.
+func (this *fileTopics) quarantine(name string) error {
+	qdir := filepath.Join(this.dir, QuarantineDir)
+	if err := os.MkdirAll(qdir, 0700); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(this.dir, name), filepath.Join(qdir, name))
+}
+
+func (this *fileTopics) path(topic []byte) string {
+	return filepath.Join(this.dir, fileName(topic))
+}
+
+// fileName returns the name of the file the retained message of topic is kept
+// in.
+func fileName(topic []byte) string {
+	sum := sha256.Sum256(topic)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+)
+
+func TestFileTopicsRecover(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := NewFileProvider(dir)
+	require.NoError(t, err)
+
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("sport/tennis"), 1)))
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("sport/golf"), 0)))
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("news"), 1)))
+
+	// Cleared by an empty payload
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte("news"))
+	require.NoError(t, p.Retain(msg))
+
+	p, err = NewFileProvider(dir)
+	require.NoError(t, err)
+
+	n, bad, err := p.(Recoverer).Recover(false)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Empty(t, bad)
+
+	var msgs []*message.PublishMessage
+	require.NoError(t, p.Retained([]byte("#"), &msgs))
+	require.Len(t, msgs, 2)
+
+	msgs = msgs[0:0]
+	require.NoError(t, p.Retained([]byte("sport/tennis"), &msgs))
+	require.Len(t, msgs, 1)
+	require.Equal(t, byte(1), msgs[0].QoS())
+	require.Len(t, msgs[0].Payload(), 1024)
+}
+
+func TestFileTopicsRecoverSafeMode(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := NewFileProvider(dir)
+	require.NoError(t, err)
+	require.NoError(t, p.Retain(newPublishMessageLarge([]byte("sport/tennis"), 1)))
+
+	name := fileName([]byte("sport/golf"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte{0x30, 0xff}, 0600))
+
+	// Without safe mode, a bad record fails the recovery
+	p, err = NewFileProvider(dir)
+	require.NoError(t, err)
+
+	_, _, err = p.(Recoverer).Recover(false)
+	require.Error(t, err)
+
+	// With it, the record is moved out of the way
+	p, err = NewFileProvider(dir)
+	require.NoError(t, err)
+
+	n, bad, err := p.(Recoverer).Recover(true)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, bad, 1)
+	require.Equal(t, name, bad[0].Key)
+	require.Error(t, bad[0].Err)
+
+	_, err = os.Stat(filepath.Join(dir, QuarantineDir, name))
+	require.NoError(t, err)
+
+	// And isn't in the way of the next one
+	p, err = NewFileProvider(dir)
+	require.NoError(t, err)
+
+	n, bad, err = p.(Recoverer).Recover(false)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Empty(t, bad)
+}
+
+func TestFileTopicsLongTopic(t *testing.T) {
+	dir := t.TempDir()
+
+	p, err := NewFileProvider(dir)
+	require.NoError(t, err)
+
+	// Too long to name a file after
+	topic := []byte(strings.Repeat("a/", 200) + "b")
+	require.NoError(t, p.Retain(newPublishMessageLarge(topic, 1)))
+
+	p, err = NewFileProvider(dir)
+	require.NoError(t, err)
+
+	n, bad, err := p.(Recoverer).Recover(false)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Empty(t, bad)
+
+	var msgs []*message.PublishMessage
+	require.NoError(t, p.Retained(topic, &msgs))
+	require.Len(t, msgs, 1)
+	require.Equal(t, topic, msgs[0].Topic())
+}
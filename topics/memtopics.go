@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"reflect"
 	"sync"
+	"sync/atomic"
 
 	"github.com/surgemq/message"
 )
@@ -28,10 +29,12 @@ var (
 )
 
 var _ TopicsProvider = (*memTopics)(nil)
+var _ RetainedLimiter = (*memTopics)(nil)
 
 type memTopics struct {
-	// Sub/unsub mutex
-	smu sync.RWMutex
+	// Sub/unsub mutex. Subscribers doesn't need it, the subscription tree can be
+	// read while it's being changed.
+	smu sync.Mutex
 	// Subscription tree
 	sroot *snode
 
@@ -59,7 +62,7 @@ func NewMemProvider() *memTopics {
 }
 
 func (this *memTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte, error) {
-	if !message.ValidQos(qos) {
+	if !ValidOptions(qos) {
 		return message.QosFailure, fmt.Errorf("Invalid QoS %d", qos)
 	}
 
@@ -70,15 +73,15 @@ func (this *memTopics) Subscribe(topic []byte, qos byte, sub interface{}) (byte,
 	this.smu.Lock()
 	defer this.smu.Unlock()
 
-	if qos > MaxQosAllowed {
-		qos = MaxQosAllowed
+	if qos&QosMask > MaxQosAllowed {
+		qos = qos&^QosMask | MaxQosAllowed
 	}
 
 	if err := this.sroot.sinsert(topic, qos, sub); err != nil {
 		return message.QosFailure, err
 	}
 
-	return qos, nil
+	return qos & QosMask, nil
 }
 
 func (this *memTopics) Unsubscribe(topic []byte, sub interface{}) error {
@@ -88,18 +91,32 @@ func (this *memTopics) Unsubscribe(topic []byte, sub interface{}) error {
 	return this.sroot.sremove(topic, sub)
 }
 
-// Returned values will be invalidated by the next Subscribers call
+// Returned values will be invalidated by the next Subscribers call. It doesn't
+// take any locks, so any number of publishers can look up the subscribers at the
+// same time, even while others are subscribing and unsubscribing.
 func (this *memTopics) Subscribers(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
 	if !message.ValidQos(qos) {
 		return fmt.Errorf("Invalid QoS %d", qos)
 	}
 
-	this.smu.RLock()
-	defer this.smu.RUnlock()
-
 	*subs = (*subs)[0:0]
 	*qoss = (*qoss)[0:0]
 
+	// [MQTT-4.7.2-1] The topics starting with $ aren't matched by the filters
+	// starting with a wildcard, so only their own first level is looked up
+	if isSys(topic) {
+		ntl, rem, err := nextTopicLevel(topic)
+		if err != nil {
+			return err
+		}
+
+		if n, ok := this.sroot.child(string(ntl)); ok {
+			return n.smatch(rem, qos, subs, qoss)
+		}
+
+		return nil
+	}
+
 	return this.sroot.smatch(topic, qos, subs, qoss)
 }
 
@@ -111,39 +128,91 @@ func (this *memTopics) Retain(msg *message.PublishMessage) error {
 	// Testing, that a payload of 0 means delete the retain message.
 	// https://eclipse.org/paho/clients/testing/
 	if len(msg.Payload()) == 0 {
-		return this.rroot.rremove(msg.Topic())
+		_, err := this.rroot.rremove(msg.Topic())
+		return err
 	}
 
-	return this.rroot.rinsert(msg.Topic(), msg)
+	_, err := this.rroot.rinsert(msg.Topic(), msg)
+	return err
 }
 
 func (this *memTopics) Retained(topic []byte, msgs *[]*message.PublishMessage) error {
 	this.rmu.RLock()
 	defer this.rmu.RUnlock()
 
-	return this.rroot.rmatch(topic, msgs)
+	return this.rroot.rmatch(topic, 0, msgs)
+}
+
+func (this *memTopics) RetainedLimit(topic []byte, max int, msgs *[]*message.PublishMessage) error {
+	this.rmu.RLock()
+	defer this.rmu.RUnlock()
+
+	return this.rroot.rmatch(topic, max, msgs)
 }
 
 func (this *memTopics) Close() error {
-	this.sroot = nil
+	// Publishers may still be reading the subscription tree, so it's emptied
+	// rather than dropped
+	this.smu.Lock()
+	this.sroot.sreset()
+	this.smu.Unlock()
+
 	this.rroot = nil
 	return nil
 }
 
 // subscrition nodes
+//
+// The tree is changed in place by the writers, which are serialized by the
+// provider, while any number of readers go through it without locking. The
+// subscribers of a node are an immutable list that's replaced as a whole on
+// every change, and the next levels are kept in a sync.Map, which is built for
+// keys that are written once and read many times. Readers always see a
+// consistent list of subscribers for each node, though not necessarily a
+// snapshot of the whole tree.
 type snode struct {
-	// If this is the end of the topic string, then add subscribers here
+	// If this is the end of the topic string, then add subscribers here. It holds
+	// a *ssubs.
+	subs atomic.Value
+
+	// Otherwise add the next topic level here, keyed by the level
+	snodes sync.Map
+
+	// The number of next levels, only used by the writers
+	n int
+}
+
+// ssubs is the list of subscribers of a node, and their QoS. It's never changed
+// once it's stored in the node.
+type ssubs struct {
 	subs []interface{}
 	qos  []byte
-
-	// Otherwise add the next topic level here
-	snodes map[string]*snode
 }
 
 func newSNode() *snode {
-	return &snode{
-		snodes: make(map[string]*snode),
+	n := &snode{}
+	n.subs.Store(&ssubs{})
+	return n
+}
+
+// subscribers returns the current subscribers of the node.
+func (this *snode) subscribers() *ssubs {
+	return this.subs.Load().(*ssubs)
+}
+
+// child returns the next level node for the topic level.
+func (this *snode) child(level string) (*snode, bool) {
+	n, ok := this.snodes.Load(level)
+	if !ok {
+		return nil, false
 	}
+
+	return n.(*snode), true
+}
+
+// children returns the number of next levels.
+func (this *snode) children() int {
+	return this.n
 }
 
 func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
@@ -151,18 +220,29 @@ func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 	// to insert the subscriber. So let's see if there's such subscriber,
 	// if so, update it. Otherwise insert it.
 	if len(topic) == 0 {
+		old := this.subscribers()
+
+		ss := &ssubs{
+			subs: make([]interface{}, len(old.subs), len(old.subs)+1),
+			qos:  make([]byte, len(old.qos), len(old.qos)+1),
+		}
+		copy(ss.subs, old.subs)
+		copy(ss.qos, old.qos)
+
 		// Let's see if the subscriber is already on the list. If yes, update
 		// QoS and then return.
-		for i := range this.subs {
-			if equal(this.subs[i], sub) {
-				this.qos[i] = qos
+		for i := range ss.subs {
+			if equal(ss.subs[i], sub) {
+				ss.qos[i] = qos
+				this.subs.Store(ss)
 				return nil
 			}
 		}
 
 		// Otherwise add.
-		this.subs = append(this.subs, sub)
-		this.qos = append(this.qos, qos)
+		ss.subs = append(ss.subs, sub)
+		ss.qos = append(ss.qos, qos)
+		this.subs.Store(ss)
 
 		return nil
 	}
@@ -179,10 +259,11 @@ func (this *snode) sinsert(topic []byte, qos byte, sub interface{}) error {
 	level := string(ntl)
 
 	// Add snode if it doesn't already exist
-	n, ok := this.snodes[level]
+	n, ok := this.child(level)
 	if !ok {
 		n = newSNode()
-		this.snodes[level] = n
+		this.snodes.Store(level, n)
+		this.n++
 	}
 
 	return n.sinsert(rem, qos, sub)
@@ -196,17 +277,23 @@ func (this *snode) sremove(topic []byte, sub interface{}) error {
 	if len(topic) == 0 {
 		// If subscriber == nil, then it's signal to remove ALL subscribers
 		if sub == nil {
-			this.subs = this.subs[0:0]
-			this.qos = this.qos[0:0]
+			this.subs.Store(&ssubs{})
 			return nil
 		}
 
-		// If we find the subscriber then remove it from the list. Technically
-		// we just overwrite the slot by shifting all other items up by one.
-		for i := range this.subs {
-			if equal(this.subs[i], sub) {
-				this.subs = append(this.subs[:i], this.subs[i+1:]...)
-				this.qos = append(this.qos[:i], this.qos[i+1:]...)
+		// If we find the subscriber then remove it from the list, by making a new
+		// list without it.
+		old := this.subscribers()
+
+		for i := range old.subs {
+			if equal(old.subs[i], sub) {
+				ss := &ssubs{
+					subs: make([]interface{}, 0, len(old.subs)-1),
+					qos:  make([]byte, 0, len(old.qos)-1),
+				}
+				ss.subs = append(append(ss.subs, old.subs[:i]...), old.subs[i+1:]...)
+				ss.qos = append(append(ss.qos, old.qos[:i]...), old.qos[i+1:]...)
+				this.subs.Store(ss)
 				return nil
 			}
 		}
@@ -226,7 +313,7 @@ func (this *snode) sremove(topic []byte, sub interface{}) error {
 	level := string(ntl)
 
 	// Find the snode that matches the topic level
-	n, ok := this.snodes[level]
+	n, ok := this.child(level)
 	if !ok {
 		return fmt.Errorf("memtopics/remove: No topic found")
 	}
@@ -238,94 +325,46 @@ func (this *snode) sremove(topic []byte, sub interface{}) error {
 
 	// If there are no more subscribers and snodes to the next level we just visited
 	// let's remove it
-	if len(n.subs) == 0 && len(n.snodes) == 0 {
-		delete(this.snodes, level)
+	if len(n.subscribers().subs) == 0 && n.children() == 0 {
+		this.snodes.Delete(level)
+		this.n--
 	}
 
 	return nil
 }
 
+// sreset removes all the subscribers and the next levels.
+func (this *snode) sreset() {
+	this.subs.Store(&ssubs{})
+
+	this.snodes.Range(func(k, v interface{}) bool {
+		this.snodes.Delete(k)
+		return true
+	})
+
+	this.n = 0
+}
+
 // smatch() returns all the subscribers that are subscribed to the topic. Given a topic
 // with no wildcards (publish topic), it returns a list of subscribers that subscribes
 // to the topic. For each of the level names, it's a match
 // - if there are subscribers to '#', then all the subscribers are added to result set
+// - if there are subscribers to '+', then the next levels are matched under it
+// - if there are subscribers to the level name itself, the same
 func (this *snode) smatch(topic []byte, qos byte, subs *[]interface{}, qoss *[]byte) error {
 	// If the topic is empty, it means we are at the final matching snode. If so,
 	// let's find the subscribers that match the qos and append them to the list.
+	// "a/#" matches "a" too, so the subscribers to '#' under it are added as well.
 	if len(topic) == 0 {
 		this.matchQos(qos, subs, qoss)
-		return nil
-	}
 
-	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
-	if err != nil {
-		return err
-	}
-
-	level := string(ntl)
-
-	for k, n := range this.snodes {
-		// If the key is "#", then these subscribers are added to the result set
-		if k == MWC {
+		if n, ok := this.child(MWC); ok {
 			n.matchQos(qos, subs, qoss)
-		} else if k == SWC || k == level {
-			if err := n.smatch(rem, qos, subs, qoss); err != nil {
-				return err
-			}
-		}
-	}
-
-	return nil
-}
-
-// retained message nodes
-type rnode struct {
-	// If this is the end of the topic string, then add retained messages here
-	msg *message.PublishMessage
-	buf []byte
-
-	// Otherwise add the next topic level here
-	rnodes map[string]*rnode
-}
-
-func newRNode() *rnode {
-	return &rnode{
-		rnodes: make(map[string]*rnode),
-	}
-}
-
-func (this *rnode) rinsert(topic []byte, msg *message.PublishMessage) error {
-	// If there's no more topic levels, that means we are at the matching rnode.
-	if len(topic) == 0 {
-		l := msg.Len()
-
-		// Let's reuse the buffer if there's enough space
-		if l > cap(this.buf) {
-			this.buf = make([]byte, l)
-		} else {
-			this.buf = this.buf[0:l]
-		}
-
-		if _, err := msg.Encode(this.buf); err != nil {
-			return err
-		}
-
-		// Reuse the message if possible
-		if this.msg == nil {
-			this.msg = message.NewPublishMessage()
-		}
-
-		if _, err := this.msg.Decode(this.buf); err != nil {
-			return err
 		}
 
 		return nil
 	}
 
-	// Not the last level, so let's find or create the next level snode, and
-	// recursively call it's insert().
-
 	// ntl = next topic level
 	ntl, rem, err := nextTopicLevel(topic)
 	if err != nil {
@@ -334,91 +373,21 @@ func (this *rnode) rinsert(topic []byte, msg *message.PublishMessage) error {
 
 	level := string(ntl)
 
-	// Add snode if it doesn't already exist
-	n, ok := this.rnodes[level]
-	if !ok {
-		n = newRNode()
-		this.rnodes[level] = n
-	}
-
-	return n.rinsert(rem, msg)
-}
-
-// Remove the retained message for the supplied topic
-func (this *rnode) rremove(topic []byte) error {
-	// If the topic is empty, it means we are at the final matching rnode. If so,
-	// let's remove the buffer and message.
-	if len(topic) == 0 {
-		this.buf = nil
-		this.msg = nil
-		return nil
-	}
-
-	// Not the last level, so let's find the next level rnode, and recursively
-	// call it's remove().
-
-	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
-	if err != nil {
-		return err
-	}
-
-	level := string(ntl)
-
-	// Find the rnode that matches the topic level
-	n, ok := this.rnodes[level]
-	if !ok {
-		return fmt.Errorf("memtopics/rremove: No topic found")
-	}
-
-	// Remove the subscriber from the next level rnode
-	if err := n.rremove(rem); err != nil {
-		return err
+	// Only the nodes that could match are looked up, rather than going through
+	// every next level, which could be one per client
+	if n, ok := this.child(MWC); ok {
+		n.matchQos(qos, subs, qoss)
 	}
 
-	// If there are no more rnodes to the next level we just visited let's remove it
-	if len(n.rnodes) == 0 {
-		delete(this.rnodes, level)
-	}
-
-	return nil
-}
-
-// rmatch() finds the retained messages for the topic and qos provided. It's somewhat
-// of a reverse match compare to match() since the supplied topic can contain
-// wildcards, whereas the retained message topic is a full (no wildcard) topic.
-func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
-	// If the topic is empty, it means we are at the final matching rnode. If so,
-	// add the retained msg to the list.
-	if len(topic) == 0 {
-		if this.msg != nil {
-			*msgs = append(*msgs, this.msg)
+	if n, ok := this.child(SWC); ok {
+		if err := n.smatch(rem, qos, subs, qoss); err != nil {
+			return err
 		}
-		return nil
-	}
-
-	// ntl = next topic level
-	ntl, rem, err := nextTopicLevel(topic)
-	if err != nil {
-		return err
 	}
 
-	level := string(ntl)
-
-	if level == MWC {
-		// If '#', add all retained messages starting this node
-		this.allRetained(msgs)
-	} else if level == SWC {
-		// If '+', check all nodes at this level. Next levels must be matched.
-		for _, n := range this.rnodes {
-			if err := n.rmatch(rem, msgs); err != nil {
-				return err
-			}
-		}
-	} else {
-		// Otherwise, find the matching node, go to the next level
-		if n, ok := this.rnodes[level]; ok {
-			if err := n.rmatch(rem, msgs); err != nil {
+	if level != MWC && level != SWC {
+		if n, ok := this.child(level); ok {
+			if err := n.smatch(rem, qos, subs, qoss); err != nil {
 				return err
 			}
 		}
@@ -427,22 +396,11 @@ func (this *rnode) rmatch(topic []byte, msgs *[]*message.PublishMessage) error {
 	return nil
 }
 
-func (this *rnode) allRetained(msgs *[]*message.PublishMessage) {
-	if this.msg != nil {
-		*msgs = append(*msgs, this.msg)
-	}
-
-	for _, n := range this.rnodes {
-		n.allRetained(msgs)
-	}
-}
-
 const (
 	stateCHR byte = iota // Regular character
 	stateMWC             // Multi-level wildcard
 	stateSWC             // Single-level wildcard
 	stateSEP             // Topic level separator
-	stateSYS             // System level topic ($)
 )
 
 // Returns topic level, remaining topic levels and any errors
@@ -476,13 +434,6 @@ func nextTopicLevel(topic []byte) ([]byte, []byte, error) {
 
 			s = stateSWC
 
-		case '$':
-			if i == 0 {
-				return nil, nil, fmt.Errorf("memtopics/nextTopicLevel: Cannot publish to $ topics")
-			}
-
-			s = stateSYS
-
 		default:
 			if s == stateMWC || s == stateSWC {
 				return nil, nil, fmt.Errorf("memtopics/nextTopicLevel: Wildcard characters '#' and '+' must occupy entire topic level")
@@ -507,13 +458,17 @@ func nextTopicLevel(topic []byte) ([]byte, []byte, error) {
 // due to the QoS granted is lower than the published message QoS. For example,
 // if the client is granted only QoS 0, and the publish message is QoS 1, then this
 // client is not to be send the published message.
+//
+// The subscription options are passed on along with the QoS.
 func (this *snode) matchQos(qos byte, subs *[]interface{}, qoss *[]byte) {
-	for i, sub := range this.subs {
+	ss := this.subscribers()
+
+	for i, sub := range ss.subs {
 		// If the published QoS is higher than the subscriber QoS, then we skip the
 		// subscriber. Otherwise, add to the list.
-		if qos <= this.qos[i] {
+		if qos <= ss.qos[i]&QosMask {
 			*subs = append(*subs, sub)
-			*qoss = append(*qoss, qos)
+			*qoss = append(*qoss, qos|ss.qos[i]&^QosMask)
 		}
 	}
 }
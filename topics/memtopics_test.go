@@ -15,6 +15,7 @@
 package topics
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -99,33 +100,33 @@ func TestSNodeInsert1(t *testing.T) {
 	err := n.sinsert(topic, 1, "sub1")
 
 	require.NoError(t, err)
-	require.Equal(t, 1, len(n.snodes))
-	require.Equal(t, 0, len(n.subs))
+	require.Equal(t, 1, n.children())
+	require.Equal(t, 0, len(n.subscribers().subs))
 
-	n2, ok := n.snodes["sport"]
+	n2, ok := n.child("sport")
 
 	require.True(t, ok)
-	require.Equal(t, 1, len(n2.snodes))
-	require.Equal(t, 0, len(n2.subs))
+	require.Equal(t, 1, n2.children())
+	require.Equal(t, 0, len(n2.subscribers().subs))
 
-	n3, ok := n2.snodes["tennis"]
+	n3, ok := n2.child("tennis")
 
 	require.True(t, ok)
-	require.Equal(t, 1, len(n3.snodes))
-	require.Equal(t, 0, len(n3.subs))
+	require.Equal(t, 1, n3.children())
+	require.Equal(t, 0, len(n3.subscribers().subs))
 
-	n4, ok := n3.snodes["player1"]
+	n4, ok := n3.child("player1")
 
 	require.True(t, ok)
-	require.Equal(t, 1, len(n4.snodes))
-	require.Equal(t, 0, len(n4.subs))
+	require.Equal(t, 1, n4.children())
+	require.Equal(t, 0, len(n4.subscribers().subs))
 
-	n5, ok := n4.snodes["#"]
+	n5, ok := n4.child("#")
 
 	require.True(t, ok)
-	require.Equal(t, 0, len(n5.snodes))
-	require.Equal(t, 1, len(n5.subs))
-	require.Equal(t, "sub1", n5.subs[0].(string))
+	require.Equal(t, 0, n5.children())
+	require.Equal(t, 1, len(n5.subscribers().subs))
+	require.Equal(t, "sub1", n5.subscribers().subs[0].(string))
 }
 
 func TestSNodeInsert2(t *testing.T) {
@@ -135,15 +136,15 @@ func TestSNodeInsert2(t *testing.T) {
 	err := n.sinsert(topic, 1, "sub1")
 
 	require.NoError(t, err)
-	require.Equal(t, 1, len(n.snodes))
-	require.Equal(t, 0, len(n.subs))
+	require.Equal(t, 1, n.children())
+	require.Equal(t, 0, len(n.subscribers().subs))
 
-	n2, ok := n.snodes["#"]
+	n2, ok := n.child("#")
 
 	require.True(t, ok)
-	require.Equal(t, 0, len(n2.snodes))
-	require.Equal(t, 1, len(n2.subs))
-	require.Equal(t, "sub1", n2.subs[0].(string))
+	require.Equal(t, 0, n2.children())
+	require.Equal(t, 1, len(n2.subscribers().subs))
+	require.Equal(t, "sub1", n2.subscribers().subs[0].(string))
 }
 
 func TestSNodeInsert3(t *testing.T) {
@@ -153,27 +154,27 @@ func TestSNodeInsert3(t *testing.T) {
 	err := n.sinsert(topic, 1, "sub1")
 
 	require.NoError(t, err)
-	require.Equal(t, 1, len(n.snodes))
-	require.Equal(t, 0, len(n.subs))
+	require.Equal(t, 1, n.children())
+	require.Equal(t, 0, len(n.subscribers().subs))
 
-	n2, ok := n.snodes["+"]
+	n2, ok := n.child("+")
 
 	require.True(t, ok)
-	require.Equal(t, 1, len(n2.snodes))
-	require.Equal(t, 0, len(n2.subs))
+	require.Equal(t, 1, n2.children())
+	require.Equal(t, 0, len(n2.subscribers().subs))
 
-	n3, ok := n2.snodes["tennis"]
+	n3, ok := n2.child("tennis")
 
 	require.True(t, ok)
-	require.Equal(t, 1, len(n3.snodes))
-	require.Equal(t, 0, len(n3.subs))
+	require.Equal(t, 1, n3.children())
+	require.Equal(t, 0, len(n3.subscribers().subs))
 
-	n4, ok := n3.snodes["#"]
+	n4, ok := n3.child("#")
 
 	require.True(t, ok)
-	require.Equal(t, 0, len(n4.snodes))
-	require.Equal(t, 1, len(n4.subs))
-	require.Equal(t, "sub1", n4.subs[0].(string))
+	require.Equal(t, 0, n4.children())
+	require.Equal(t, 1, len(n4.subscribers().subs))
+	require.Equal(t, "sub1", n4.subscribers().subs[0].(string))
 }
 
 func TestSNodeInsert4(t *testing.T) {
@@ -183,21 +184,21 @@ func TestSNodeInsert4(t *testing.T) {
 	err := n.sinsert(topic, 1, "sub1")
 
 	require.NoError(t, err)
-	require.Equal(t, 1, len(n.snodes))
-	require.Equal(t, 0, len(n.subs))
+	require.Equal(t, 1, n.children())
+	require.Equal(t, 0, len(n.subscribers().subs))
 
-	n2, ok := n.snodes["+"]
+	n2, ok := n.child("+")
 
 	require.True(t, ok)
-	require.Equal(t, 1, len(n2.snodes))
-	require.Equal(t, 0, len(n2.subs))
+	require.Equal(t, 1, n2.children())
+	require.Equal(t, 0, len(n2.subscribers().subs))
 
-	n3, ok := n2.snodes["finance"]
+	n3, ok := n2.child("finance")
 
 	require.True(t, ok)
-	require.Equal(t, 0, len(n3.snodes))
-	require.Equal(t, 1, len(n3.subs))
-	require.Equal(t, "sub1", n3.subs[0].(string))
+	require.Equal(t, 0, n3.children())
+	require.Equal(t, 1, len(n3.subscribers().subs))
+	require.Equal(t, "sub1", n3.subscribers().subs[0].(string))
 }
 
 func TestSNodeInsertDup(t *testing.T) {
@@ -208,21 +209,21 @@ func TestSNodeInsertDup(t *testing.T) {
 	err = n.sinsert(topic, 1, "sub1")
 
 	require.NoError(t, err)
-	require.Equal(t, 1, len(n.snodes))
-	require.Equal(t, 0, len(n.subs))
+	require.Equal(t, 1, n.children())
+	require.Equal(t, 0, len(n.subscribers().subs))
 
-	n2, ok := n.snodes["+"]
+	n2, ok := n.child("+")
 
 	require.True(t, ok)
-	require.Equal(t, 1, len(n2.snodes))
-	require.Equal(t, 0, len(n2.subs))
+	require.Equal(t, 1, n2.children())
+	require.Equal(t, 0, len(n2.subscribers().subs))
 
-	n3, ok := n2.snodes["finance"]
+	n3, ok := n2.child("finance")
 
 	require.True(t, ok)
-	require.Equal(t, 0, len(n3.snodes))
-	require.Equal(t, 1, len(n3.subs))
-	require.Equal(t, "sub1", n3.subs[0].(string))
+	require.Equal(t, 0, n3.children())
+	require.Equal(t, 1, len(n3.subscribers().subs))
+	require.Equal(t, "sub1", n3.subscribers().subs[0].(string))
 }
 
 func TestSNodeRemove1(t *testing.T) {
@@ -233,8 +234,8 @@ func TestSNodeRemove1(t *testing.T) {
 	err := n.sremove([]byte("sport/tennis/player1/#"), "sub1")
 
 	require.NoError(t, err)
-	require.Equal(t, 0, len(n.snodes))
-	require.Equal(t, 0, len(n.subs))
+	require.Equal(t, 0, n.children())
+	require.Equal(t, 0, len(n.subscribers().subs))
 }
 
 func TestSNodeRemove2(t *testing.T) {
@@ -256,8 +257,8 @@ func TestSNodeRemove3(t *testing.T) {
 	err := n.sremove([]byte("sport/tennis/player1/#"), nil)
 
 	require.NoError(t, err)
-	require.Equal(t, 0, len(n.snodes))
-	require.Equal(t, 0, len(n.subs))
+	require.Equal(t, 0, n.children())
+	require.Equal(t, 0, len(n.subscribers().subs))
 }
 
 func TestSNodeMatch1(t *testing.T) {
@@ -387,6 +388,20 @@ func TestSNodeMatch9(t *testing.T) {
 	require.Equal(t, 0, len(subs))
 }
 
+func TestSNodeMatch10(t *testing.T) {
+	n := newSNode()
+	n.sinsert([]byte("sport/tennis/#"), 1, "sub1")
+
+	subs := make([]interface{}, 0, 5)
+	qoss := make([]byte, 0, 5)
+
+	// '#' matches the parent level as well
+	err := n.smatch([]byte("sport/tennis"), 1, &subs, &qoss)
+
+	require.NoError(t, err)
+	require.Equal(t, 1, len(subs))
+}
+
 func TestRNodeInsertRemove(t *testing.T) {
 	n := newRNode()
 
@@ -394,7 +409,7 @@ func TestRNodeInsertRemove(t *testing.T) {
 
 	msg := newPublishMessageLarge([]byte("sport/tennis/player1/ricardo"), 1)
 
-	err := n.rinsert(msg.Topic(), msg)
+	_, err := n.rinsert(msg.Topic(), msg)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n.rnodes))
@@ -431,7 +446,7 @@ func TestRNodeInsertRemove(t *testing.T) {
 
 	msg2 := newPublishMessageLarge([]byte("sport/tennis/player1/andre"), 1)
 
-	err = n.rinsert(msg2.Topic(), msg2)
+	_, err = n.rinsert(msg2.Topic(), msg2)
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(n4.rnodes))
@@ -446,7 +461,7 @@ func TestRNodeInsertRemove(t *testing.T) {
 
 	// --- Remove
 
-	err = n.rremove([]byte("sport/tennis/player1/andre"))
+	_, err = n.rremove([]byte("sport/tennis/player1/andre"))
 	require.NoError(t, err)
 	require.Equal(t, 1, len(n4.rnodes))
 }
@@ -455,22 +470,22 @@ func TestRNodeMatch(t *testing.T) {
 	n := newRNode()
 
 	msg1 := newPublishMessageLarge([]byte("sport/tennis/ricardo/stats"), 1)
-	err := n.rinsert(msg1.Topic(), msg1)
+	_, err := n.rinsert(msg1.Topic(), msg1)
 	require.NoError(t, err)
 
 	msg2 := newPublishMessageLarge([]byte("sport/tennis/andre/stats"), 1)
-	err = n.rinsert(msg2.Topic(), msg2)
+	_, err = n.rinsert(msg2.Topic(), msg2)
 	require.NoError(t, err)
 
 	msg3 := newPublishMessageLarge([]byte("sport/tennis/andre/bio"), 1)
-	err = n.rinsert(msg3.Topic(), msg3)
+	_, err = n.rinsert(msg3.Topic(), msg3)
 	require.NoError(t, err)
 
 	var msglist []*message.PublishMessage
 
 	// ---
 
-	err = n.rmatch(msg1.Topic(), &msglist)
+	err = n.rmatch(msg1.Topic(), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -478,7 +493,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch(msg2.Topic(), &msglist)
+	err = n.rmatch(msg2.Topic(), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -486,7 +501,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch(msg3.Topic(), &msglist)
+	err = n.rmatch(msg3.Topic(), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 1, len(msglist))
@@ -494,7 +509,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/andre/+"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/andre/+"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -502,7 +517,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/andre/#"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/andre/#"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -510,7 +525,7 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/+/stats"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/+/stats"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 2, len(msglist))
@@ -518,12 +533,108 @@ func TestRNodeMatch(t *testing.T) {
 	// ---
 
 	msglist = msglist[0:0]
-	err = n.rmatch([]byte("sport/tennis/#"), &msglist)
+	err = n.rmatch([]byte("sport/tennis/#"), 0, &msglist)
 
 	require.NoError(t, err)
 	require.Equal(t, 3, len(msglist))
 }
 
+func TestRNodeCount(t *testing.T) {
+	n := newRNode()
+
+	for _, topic := range []string{"a/b", "a/b/c", "a/d"} {
+		msg := newPublishMessageLarge([]byte(topic), 1)
+		added, err := n.rinsert(msg.Topic(), msg)
+		require.NoError(t, err)
+		require.True(t, added)
+	}
+
+	// Replacing a retained message doesn't add one
+	msg := newPublishMessageLarge([]byte("a/b"), 1)
+	added, err := n.rinsert(msg.Topic(), msg)
+	require.NoError(t, err)
+	require.False(t, added)
+
+	require.Equal(t, 3, n.count)
+	require.Equal(t, 3, n.rnodes["a"].count)
+	require.Equal(t, 2, n.rnodes["a"].rnodes["b"].count)
+
+	// The node of a/b still has its own message once a/b/c is gone
+	removed, err := n.rremove([]byte("a/b/c"))
+	require.NoError(t, err)
+	require.True(t, removed)
+	require.Equal(t, 2, n.count)
+
+	nb, ok := n.rnodes["a"].rnodes["b"]
+	require.True(t, ok)
+	require.NotNil(t, nb.msg)
+	require.Equal(t, 0, len(nb.rnodes))
+
+	var msglist []*message.PublishMessage
+
+	err = n.rmatch([]byte("a/b"), 0, &msglist)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(msglist))
+
+	// Once there's nothing retained under a node, it's gone
+	_, err = n.rremove([]byte("a/b"))
+	require.NoError(t, err)
+	_, err = n.rremove([]byte("a/d"))
+	require.NoError(t, err)
+
+	require.Equal(t, 0, n.count)
+	require.Equal(t, 0, len(n.rnodes))
+}
+
+func TestRNodeMatchLimit(t *testing.T) {
+	n := newRNode()
+
+	for i := 0; i < 10; i++ {
+		msg := newPublishMessageLarge([]byte(fmt.Sprintf("a/%d/c", i)), 1)
+		_, err := n.rinsert(msg.Topic(), msg)
+		require.NoError(t, err)
+	}
+
+	var msglist []*message.PublishMessage
+
+	for _, filter := range []string{"#", "a/#", "a/+/c", "+/+/+"} {
+		msglist = msglist[0:0]
+		require.NoError(t, n.rmatch([]byte(filter), 3, &msglist))
+		require.Equal(t, 3, len(msglist), filter)
+
+		msglist = msglist[0:0]
+		require.NoError(t, n.rmatch([]byte(filter), 0, &msglist))
+		require.Equal(t, 10, len(msglist), filter)
+	}
+
+	// The limit is on the messages added, not the ones already there
+	require.NoError(t, n.rmatch([]byte("a/1/c"), 3, &msglist))
+	require.Equal(t, 11, len(msglist))
+
+	require.Error(t, n.rmatch([]byte("a/#/c"), 0, &msglist))
+}
+
+func TestRNodeMatchAllocs(t *testing.T) {
+	n := newRNode()
+
+	for i := 0; i < 100; i++ {
+		msg := newPublishMessageLarge([]byte(fmt.Sprintf("a/%d/c", i)), 1)
+		_, err := n.rinsert(msg.Topic(), msg)
+		require.NoError(t, err)
+	}
+
+	msglist := make([]*message.PublishMessage, 0, 100)
+	filter := []byte("a/+/c")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		msglist = msglist[0:0]
+		n.rmatch(filter, 0, &msglist)
+	})
+
+	require.Equal(t, 100, len(msglist))
+	require.Equal(t, float64(0), allocs)
+}
+
 func TestMemTopicsSubscription(t *testing.T) {
 	Unregister("mem")
 	p := NewMemProvider()
@@ -531,7 +642,9 @@ func TestMemTopicsSubscription(t *testing.T) {
 
 	mgr, err := NewManager("mem")
 
+	defer func(max byte) { MaxQosAllowed = max }(MaxQosAllowed)
 	MaxQosAllowed = 1
+
 	qos, err := mgr.Subscribe([]byte("sports/tennis/+/stats"), 2, "sub1")
 
 	require.NoError(t, err)
@@ -560,6 +673,45 @@ func TestMemTopicsSubscription(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestMemTopicsSysTopics(t *testing.T) {
+	p := NewMemProvider()
+
+	for _, filter := range []string{"#", "+/uptime", "$SYS/#", "$SYS/uptime"} {
+		_, err := p.Subscribe([]byte(filter), 1, filter)
+		require.NoError(t, err)
+	}
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	// Filters starting with a wildcard don't match the topics starting with $
+	err := p.Subscribers([]byte("$SYS/uptime"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []interface{}{"$SYS/#", "$SYS/uptime"}, subs)
+
+	err = p.Subscribers([]byte("sys/uptime"), 1, &subs, &qoss)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []interface{}{"#", "+/uptime"}, subs)
+
+	for _, topic := range []string{"$SYS/uptime", "sys/uptime"} {
+		msg := message.NewPublishMessage()
+		msg.SetTopic([]byte(topic))
+		msg.SetPayload([]byte("42"))
+		msg.SetRetain(true)
+		require.NoError(t, p.Retain(msg))
+	}
+
+	var msgs []*message.PublishMessage
+
+	for filter, n := range map[string]int{"#": 1, "+/uptime": 1, "$SYS/#": 1, "$SYS/+": 1} {
+		require.NoError(t, p.Retained([]byte(filter), &msgs))
+		require.Len(t, msgs, n, filter)
+		msgs = msgs[0:0]
+	}
+}
+
 func TestMemTopicsRetained(t *testing.T) {
 	Unregister("mem")
 	p := NewMemProvider()
@@ -639,6 +791,41 @@ func TestMemTopicsRetained(t *testing.T) {
 	require.Equal(t, 3, len(msglist))
 }
 
+func TestMemTopicsConcurrentSubscribers(t *testing.T) {
+	p := NewMemProvider()
+
+	_, err := p.Subscribe([]byte("a/+/c"), 1, "always")
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 1000; i++ {
+			topic := []byte(fmt.Sprintf("a/%d/c", i%10))
+			p.Subscribe(topic, 1, "churn")
+			p.Unsubscribe(topic, "churn")
+		}
+	}()
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		require.NoError(t, p.Subscribers([]byte("a/1/c"), 1, &subs, &qoss))
+		require.Contains(t, subs, "always")
+	}
+}
+
 func newPublishMessageLarge(topic []byte, qos byte) *message.PublishMessage {
 	msg := message.NewPublishMessage()
 	msg.SetTopic(topic)
@@ -647,3 +834,128 @@ func newPublishMessageLarge(topic []byte, qos byte) *message.PublishMessage {
 
 	return msg
 }
+
+// newBenchmarkProvider returns a provider with a subscription tree shaped like a
+// fleet of devices, each subscribed to its own command topic, plus a few
+// wildcard subscribers such as loggers and rule engines.
+func newBenchmarkProvider(b *testing.B, devices int) *memTopics {
+	p := NewMemProvider()
+
+	for i := 0; i < devices; i++ {
+		if _, err := p.Subscribe([]byte(fmt.Sprintf("devices/%d/cmd", i)), 1, fmt.Sprintf("device%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		p.Subscribe([]byte("devices/+/cmd"), 1, fmt.Sprintf("rules%d", i))
+		p.Subscribe([]byte("#"), 0, fmt.Sprintf("logger%d", i))
+	}
+
+	return p
+}
+
+func benchmarkSubscribers(b *testing.B, p *memTopics, devices int) {
+	topicList := make([][]byte, devices)
+	for i := range topicList {
+		topicList[i] = []byte(fmt.Sprintf("devices/%d/cmd", i))
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		var (
+			subs []interface{}
+			qoss []byte
+			i    int
+		)
+
+		for pb.Next() {
+			if err := p.Subscribers(topicList[i%devices], 0, &subs, &qoss); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemTopicsSubscribers(b *testing.B) {
+	p := newBenchmarkProvider(b, 10000)
+	benchmarkSubscribers(b, p, 10000)
+}
+
+// Publishers looking up subscribers while clients keep subscribing and
+// unsubscribing
+func BenchmarkMemTopicsSubscribersChurn(b *testing.B) {
+	p := newBenchmarkProvider(b, 10000)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			topic := []byte(fmt.Sprintf("devices/%d/status", i%1000))
+			p.Subscribe(topic, 1, "churn")
+			p.Unsubscribe(topic, "churn")
+		}
+	}()
+
+	benchmarkSubscribers(b, p, 10000)
+}
+
+func BenchmarkMemTopicsSubscribe(b *testing.B) {
+	p := newBenchmarkProvider(b, 10000)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		topic := []byte(fmt.Sprintf("devices/%d/cmd", i%10000))
+		p.Subscribe(topic, 1, "bench")
+		p.Unsubscribe(topic, "bench")
+	}
+}
+
+// BenchmarkMemTopicsRetained is a new subscriber to a wildcard filter matching a
+// few of 10000 retained device states, and to one with a limit.
+func BenchmarkMemTopicsRetained(b *testing.B) {
+	p := NewMemProvider()
+
+	for i := 0; i < 10000; i++ {
+		msg := newPublishMessageLarge([]byte(fmt.Sprintf("devices/%d/state", i)), 1)
+		require.NoError(b, p.Retain(msg))
+	}
+
+	for i := 0; i < 10; i++ {
+		msg := newPublishMessageLarge([]byte(fmt.Sprintf("gateways/%d/state", i)), 1)
+		require.NoError(b, p.Retain(msg))
+	}
+
+	msgs := make([]*message.PublishMessage, 0, 10000)
+
+	b.Run("Exact", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			msgs = msgs[0:0]
+			p.Retained([]byte("devices/1234/state"), &msgs)
+		}
+	})
+
+	b.Run("Wildcard", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			msgs = msgs[0:0]
+			p.Retained([]byte("gateways/+/state"), &msgs)
+		}
+	})
+
+	b.Run("AllLimited", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			msgs = msgs[0:0]
+			p.RetainedLimit([]byte("#"), 100, &msgs)
+		}
+	})
+}
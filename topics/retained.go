@@ -0,0 +1,300 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/surgemq/message"
+)
+
+// retained message nodes
+//
+// The retained messages are kept in a tree of their own, one node per topic
+// level, apart from the subscriptions. Every node keeps count of the retained
+// messages under it, so wildcard matches skip the branches without any instead
+// of walking them, and can stop as soon as they have as many messages as they
+// were asked for.
+type rnode struct {
+	// If this is the end of the topic string, then add retained messages here
+	msg *message.PublishMessage
+	buf []byte
+
+	// Otherwise add the next topic level here
+	rnodes map[string]*rnode
+
+	// The number of retained messages in this node and under it
+	count int
+}
+
+// rframe is a node still to be matched, and the index of the filter level to
+// match it against. It's matchAll once a multi-level wildcard is reached, as
+// everything under the node matches.
+type rframe struct {
+	n *rnode
+	i int
+}
+
+const matchAll = -1
+
+// rscratch is what rmatch needs to match without allocating: the levels of the
+// filter and the stack of nodes still to be matched. They are pooled, as there
+// could be any number of matches at the same time.
+type rscratch struct {
+	levels [][]byte
+	stack  []rframe
+}
+
+var rscratchPool = sync.Pool{
+	New: func() interface{} {
+		return &rscratch{}
+	},
+}
+
+func newRNode() *rnode {
+	return &rnode{
+		rnodes: make(map[string]*rnode),
+	}
+}
+
+// rinsert returns whether a new retained message was added, rather than an
+// existing one being replaced.
+func (this *rnode) rinsert(topic []byte, msg *message.PublishMessage) (bool, error) {
+	// If there's no more topic levels, that means we are at the matching rnode.
+	if len(topic) == 0 {
+		l := msg.Len()
+
+		// Let's reuse the buffer if there's enough space
+		if l > cap(this.buf) {
+			this.buf = make([]byte, l)
+		} else {
+			this.buf = this.buf[0:l]
+		}
+
+		if _, err := msg.Encode(this.buf); err != nil {
+			return false, err
+		}
+
+		added := this.msg == nil
+
+		// Reuse the message if possible
+		if this.msg == nil {
+			this.msg = message.NewPublishMessage()
+		}
+
+		if _, err := this.msg.Decode(this.buf); err != nil {
+			return false, err
+		}
+
+		if added {
+			this.count++
+		}
+
+		return added, nil
+	}
+
+	// Not the last level, so let's find or create the next level snode, and
+	// recursively call it's insert().
+
+	// ntl = next topic level
+	ntl, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return false, err
+	}
+
+	level := string(ntl)
+
+	// Add snode if it doesn't already exist
+	n, ok := this.rnodes[level]
+	if !ok {
+		n = newRNode()
+		this.rnodes[level] = n
+	}
+
+	added, err := n.rinsert(rem, msg)
+	if added {
+		this.count++
+	}
+
+	// Don't leave an empty node behind if the message couldn't be added
+	if n.count == 0 {
+		delete(this.rnodes, level)
+	}
+
+	return added, err
+}
+
+// Remove the retained message for the supplied topic. It returns whether there
+// was one.
+func (this *rnode) rremove(topic []byte) (bool, error) {
+	// If the topic is empty, it means we are at the final matching rnode. If so,
+	// let's remove the buffer and message.
+	if len(topic) == 0 {
+		removed := this.msg != nil
+
+		this.buf = nil
+		this.msg = nil
+
+		if removed {
+			this.count--
+		}
+
+		return removed, nil
+	}
+
+	// Not the last level, so let's find the next level rnode, and recursively
+	// call it's remove().
+
+	// ntl = next topic level
+	ntl, rem, err := nextTopicLevel(topic)
+	if err != nil {
+		return false, err
+	}
+
+	level := string(ntl)
+
+	// Find the rnode that matches the topic level
+	n, ok := this.rnodes[level]
+	if !ok {
+		return false, fmt.Errorf("memtopics/rremove: No topic found")
+	}
+
+	// Remove the subscriber from the next level rnode
+	removed, err := n.rremove(rem)
+	if err != nil {
+		return false, err
+	}
+
+	if removed {
+		this.count--
+	}
+
+	// If there are no more retained messages under the next level we just visited
+	// let's remove it
+	if n.count == 0 {
+		delete(this.rnodes, level)
+	}
+
+	return removed, nil
+}
+
+// rmatch() finds the retained messages for the topic and qos provided. It's somewhat
+// of a reverse match compare to match() since the supplied topic can contain
+// wildcards, whereas the retained message topic is a full (no wildcard) topic.
+// If max is greater than 0, it stops once it has added max messages to msgs.
+//
+// It goes through the tree with a stack rather than recursively, and only
+// allocates if msgs has to grow.
+func (this *rnode) rmatch(topic []byte, max int, msgs *[]*message.PublishMessage) error {
+	if this.count == 0 {
+		return nil
+	}
+
+	sc := rscratchPool.Get().(*rscratch)
+	defer rscratchPool.Put(sc)
+
+	// Split the filter up front, which also checks it
+	sc.levels = sc.levels[0:0]
+
+	for rem := topic; len(rem) > 0; {
+		ntl, next, err := nextTopicLevel(rem)
+		if err != nil {
+			return err
+		}
+
+		sc.levels = append(sc.levels, ntl)
+		rem = next
+	}
+
+	left := max
+	if left <= 0 {
+		left = this.count
+	}
+
+	sc.stack = append(sc.stack[0:0], rframe{this, 0})
+
+	// The most frames on the stack at any time, to clear them at the end
+	high := 0
+
+	for len(sc.stack) > 0 && left > 0 {
+		if len(sc.stack) > high {
+			high = len(sc.stack)
+		}
+
+		f := sc.stack[len(sc.stack)-1]
+		sc.stack = sc.stack[:len(sc.stack)-1]
+
+		switch {
+		case f.i == matchAll:
+			// Under a '#', every retained message matches
+			if f.n.msg != nil {
+				*msgs = append(*msgs, f.n.msg)
+				left--
+			}
+
+			for _, n := range f.n.rnodes {
+				sc.stack = append(sc.stack, rframe{n, matchAll})
+			}
+
+		case f.i == len(sc.levels):
+			// If there are no more levels, it means we are at the final matching
+			// rnode. If so, add the retained msg to the list.
+			if f.n.msg != nil {
+				*msgs = append(*msgs, f.n.msg)
+				left--
+			}
+
+		case string(sc.levels[f.i]) == MWC && f.i == 0:
+			// [MQTT-4.7.2-1] A filter starting with a wildcard doesn't match the
+			// topics starting with $
+			for name, n := range f.n.rnodes {
+				if !isSys([]byte(name)) {
+					sc.stack = append(sc.stack, rframe{n, matchAll})
+				}
+			}
+
+		case string(sc.levels[f.i]) == MWC:
+			// If '#', add all retained messages starting this node
+			sc.stack = append(sc.stack, rframe{f.n, matchAll})
+
+		case string(sc.levels[f.i]) == SWC:
+			// If '+', check all nodes at this level. Next levels must be matched.
+			for name, n := range f.n.rnodes {
+				if f.i > 0 || !isSys([]byte(name)) {
+					sc.stack = append(sc.stack, rframe{n, f.i + 1})
+				}
+			}
+
+		default:
+			// Otherwise, find the matching node, go to the next level
+			if n, ok := f.n.rnodes[string(sc.levels[f.i])]; ok {
+				sc.stack = append(sc.stack, rframe{n, f.i + 1})
+			}
+		}
+	}
+
+	// Don't keep the nodes and the filter alive in the pool
+	used := sc.stack[:high]
+	for i := range used {
+		used[i] = rframe{}
+	}
+
+	for i := range sc.levels {
+		sc.levels[i] = nil
+	}
+
+	return nil
+}
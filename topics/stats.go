@@ -0,0 +1,219 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// The rough cost of each next level entry in a sync.Map, i.e. the key, the entry
+// and its share of the underlying map, on 64 bit platforms
+const syncMapEntrySize = 96
+
+// TreeStats describes the shape of a subscription tree.
+type TreeStats struct {
+	// The number of nodes, not counting the root. There's one for each topic
+	// level of each topic filter subscribed to.
+	Nodes int `json:"nodes"`
+
+	// The number of subscriptions, i.e. subscribers of all the nodes
+	Subscriptions int `json:"subscriptions"`
+
+	// The number of nodes at each depth, starting with the first topic level
+	Depth []int `json:"depth"`
+
+	// The nodes with the most next levels, widest first. Matching goes through
+	// these, so they are where a slow match would be.
+	Widest []NodeFanout `json:"widest"`
+
+	// A rough estimate of the memory used by the tree, in bytes. It doesn't
+	// include the subscribers themselves.
+	Memory int64 `json:"memory"`
+}
+
+// NodeFanout is the number of next levels of a node.
+type NodeFanout struct {
+	// The topic filter of the node, "" for the root
+	Topic string `json:"topic"`
+
+	// The number of next levels
+	Children int `json:"children"`
+}
+
+// TreeNode is a node of a subscription tree, rendered with its next levels.
+type TreeNode struct {
+	// The topic level, and the topic filter up to and including it
+	Level string `json:"level"`
+	Topic string `json:"topic"`
+
+	// The number of subscribers to the topic filter
+	Subscribers int `json:"subscribers"`
+
+	// The next levels, sorted by level
+	Children []*TreeNode `json:"children,omitempty"`
+
+	// The number of next levels that were left out
+	Truncated int `json:"truncated,omitempty"`
+}
+
+// Inspector is implemented by TopicsProviders that can report the shape of
+// their subscription tree, for operators to see why matching is slow or memory
+// use is high. Stats walks the whole tree and returns the widest nodes it finds.
+// Tree renders the subtree under the topic filter prefix, up to depth levels
+// deep and width next levels per node.
+type Inspector interface {
+	Stats(widest int) (*TreeStats, error)
+	Tree(prefix string, depth, width int) (*TreeNode, error)
+}
+
+var _ Inspector = (*memTopics)(nil)
+
+// Stats doesn't take any locks, the same as Subscribers, so it doesn't hold up
+// subscribing while it walks the tree. The numbers are not a snapshot if the
+// tree is being changed at the same time.
+func (this *memTopics) Stats(widest int) (*TreeStats, error) {
+	st := &TreeStats{
+		Depth:  []int{},
+		Widest: []NodeFanout{},
+	}
+
+	this.sroot.sstats("", 0, widest, st)
+
+	return st, nil
+}
+
+// Tree doesn't take any locks either.
+func (this *memTopics) Tree(prefix string, depth, width int) (*TreeNode, error) {
+	n := this.sroot
+	level := ""
+
+	if prefix != "" {
+		for _, l := range strings.Split(prefix, SEP) {
+			next, ok := n.child(l)
+			if !ok {
+				return nil, ErrTopicNotFound
+			}
+
+			n, level = next, l
+		}
+	}
+
+	return n.stree(level, prefix, depth, width), nil
+}
+
+// sstats adds the node and everything under it to the stats.
+func (this *snode) sstats(topic string, depth, widest int, st *TreeStats) {
+	ss := this.subscribers()
+
+	if depth > 0 {
+		st.Nodes++
+
+		for len(st.Depth) < depth {
+			st.Depth = append(st.Depth, 0)
+		}
+		st.Depth[depth-1]++
+	}
+
+	st.Subscriptions += len(ss.subs)
+	st.Memory += int64(unsafe.Sizeof(*this)) + int64(unsafe.Sizeof(*ss)) +
+		int64(cap(ss.subs))*int64(unsafe.Sizeof(interface{}(nil))) + int64(cap(ss.qos))
+
+	children := 0
+
+	this.snodes.Range(func(k, v interface{}) bool {
+		level := k.(string)
+
+		children++
+		st.Memory += syncMapEntrySize + int64(len(level))
+
+		v.(*snode).sstats(join(topic, level), depth+1, widest, st)
+		return true
+	})
+
+	if children > 0 && widest > 0 {
+		st.addWidest(NodeFanout{Topic: topic, Children: children}, widest)
+	}
+}
+
+// addWidest keeps the widest nodes seen so far, up to max of them.
+func (this *TreeStats) addWidest(f NodeFanout, max int) {
+	if len(this.Widest) == max && this.Widest[max-1].Children >= f.Children {
+		return
+	}
+
+	i := sort.Search(len(this.Widest), func(i int) bool {
+		return this.Widest[i].Children < f.Children
+	})
+
+	if len(this.Widest) < max {
+		this.Widest = append(this.Widest, NodeFanout{})
+	}
+
+	copy(this.Widest[i+1:], this.Widest[i:])
+	this.Widest[i] = f
+}
+
+// stree renders the node with depth levels under it.
+func (this *snode) stree(level, topic string, depth, width int) *TreeNode {
+	tn := &TreeNode{
+		Level:       level,
+		Topic:       topic,
+		Subscribers: len(this.subscribers().subs),
+	}
+
+	if depth <= 0 {
+		this.snodes.Range(func(k, v interface{}) bool {
+			tn.Truncated++
+			return true
+		})
+
+		return tn
+	}
+
+	var levels []string
+
+	this.snodes.Range(func(k, v interface{}) bool {
+		levels = append(levels, k.(string))
+		return true
+	})
+
+	sort.Strings(levels)
+
+	if len(levels) > width {
+		tn.Truncated = len(levels) - width
+		levels = levels[:width]
+	}
+
+	for _, l := range levels {
+		// It could have been removed since
+		if n, ok := this.child(l); ok {
+			tn.Children = append(tn.Children, n.stree(l, join(topic, l), depth-1, width))
+		}
+	}
+
+	return tn
+}
+
+// join appends the level to the topic filter of its parent, which is "" for the
+// root. The first level is never empty, a leading / is the level "+".
+func join(topic, level string) string {
+	if topic == "" {
+		return level
+	}
+
+	return topic + SEP + level
+}
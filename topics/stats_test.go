@@ -0,0 +1,95 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newStatsProvider(t *testing.T, filters ...string) *memTopics {
+	p := NewMemProvider()
+
+	for i, f := range filters {
+		_, err := p.Subscribe([]byte(f), 1, i)
+		require.NoError(t, err)
+	}
+
+	return p
+}
+
+func TestMemTopicsStats(t *testing.T) {
+	p := newStatsProvider(t, "a/b/c", "a/b/d", "a/e", "a/+/c", "f", "f/#")
+
+	st, err := p.Stats(1)
+	require.NoError(t, err)
+
+	// a, a/b, a/b/c, a/b/d, a/e, a/+, a/+/c, f, f/#
+	require.Equal(t, 9, st.Nodes)
+	require.Equal(t, 6, st.Subscriptions)
+	require.Equal(t, []int{2, 4, 3}, st.Depth)
+	require.Equal(t, []NodeFanout{{Topic: "a", Children: 3}}, st.Widest)
+	require.True(t, st.Memory > 0)
+
+	st, err = p.Stats(0)
+	require.NoError(t, err)
+	require.Len(t, st.Widest, 0)
+
+	empty, err := NewMemProvider().Stats(10)
+	require.NoError(t, err)
+	require.Equal(t, 0, empty.Nodes)
+	require.Equal(t, []int{}, empty.Depth)
+}
+
+func TestMemTopicsTree(t *testing.T) {
+	p := newStatsProvider(t, "a/b/c", "a/b/d", "a/e", "a/+/c", "f")
+
+	tn, err := p.Tree("", 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, "", tn.Topic)
+	require.Len(t, tn.Children, 2)
+	require.Equal(t, "a", tn.Children[0].Topic)
+	require.Equal(t, 3, tn.Children[0].Truncated)
+	require.Len(t, tn.Children[0].Children, 0)
+	require.Equal(t, "f", tn.Children[1].Topic)
+	require.Equal(t, 1, tn.Children[1].Subscribers)
+
+	// The next levels are sorted, and the ones past the width are counted
+	tn, err = p.Tree("a", 2, 2)
+	require.NoError(t, err)
+	require.Equal(t, "a", tn.Level)
+	require.Equal(t, 1, tn.Truncated)
+	require.Len(t, tn.Children, 2)
+	require.Equal(t, "a/+", tn.Children[0].Topic)
+	require.Equal(t, "a/b", tn.Children[1].Topic)
+	require.Len(t, tn.Children[1].Children, 2)
+	require.Equal(t, "a/b/c", tn.Children[1].Children[0].Topic)
+	require.Equal(t, "c", tn.Children[1].Children[0].Level)
+	require.Equal(t, 1, tn.Children[1].Children[0].Subscribers)
+
+	_, err = p.Tree("a/x", 1, 1)
+	require.Equal(t, ErrTopicNotFound, err)
+}
+
+func TestAddWidest(t *testing.T) {
+	st := &TreeStats{}
+
+	for i, n := range []int{3, 1, 5, 2, 5, 4} {
+		st.addWidest(NodeFanout{Topic: string(rune('a' + i)), Children: n}, 3)
+	}
+
+	require.Equal(t, []NodeFanout{{"c", 5}, {"e", 5}, {"f", 4}}, st.Widest)
+}
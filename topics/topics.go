@@ -23,6 +23,7 @@
 package topics
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 
@@ -46,6 +47,38 @@ const (
 	_WC = "#+"
 )
 
+// The MQTT 5 subscription options. They are packed with the QoS into the byte
+// that subscriptions are made with, the same as in an MQTT 5 SUBSCRIBE. The
+// providers keep the whole byte, return the options with the subscribers, and
+// only compare the QoS bits.
+const (
+	// QosMask is the bits of the QoS.
+	QosMask byte = 0x03
+
+	// NoLocal keeps the messages a client publishes from being sent back to it.
+	NoLocal byte = 0x04
+
+	// RetainAsPublished keeps the RETAIN flag of the messages as they were
+	// published, rather than clearing it.
+	RetainAsPublished byte = 0x08
+
+	// RetainHandlingMask is the bits of the retain handling, which is whether
+	// the retained messages are sent on subscribe: always, only if the
+	// subscription is new, or never.
+	RetainHandlingMask byte = 0x30
+	RetainSendAlways   byte = 0x00
+	RetainSendIfNew    byte = 0x10
+	RetainSendNever    byte = 0x20
+)
+
+// ValidOptions returns whether the QoS and the subscription options packed into
+// opts are valid.
+func ValidOptions(opts byte) bool {
+	return message.ValidQos(opts&QosMask) &&
+		opts&^(QosMask|NoLocal|RetainAsPublished|RetainHandlingMask) == 0 &&
+		opts&RetainHandlingMask != RetainHandlingMask
+}
+
 var (
 	// ErrAuthFailure is returned when the user/pass supplied are invalid
 	ErrAuthFailure = errors.New("auth: Authentication failure")
@@ -54,10 +87,21 @@ var (
 	// It probably hasn't been registered yet.
 	ErrAuthProviderNotFound = errors.New("auth: Authentication provider not found")
 
+	// ErrTopicNotFound is returned when there's nothing subscribed to the topic
+	// filter, or under it.
+	ErrTopicNotFound = errors.New("topics: Topic not found")
+
+	// ErrInspectNotSupported is returned when the provider can't report the shape
+	// of its subscription tree.
+	ErrInspectNotSupported = errors.New("topics: Provider does not support inspection")
+
 	providers = make(map[string]TopicsProvider)
 )
 
-// TopicsProvider
+// TopicsProvider keeps the subscriptions and the retained messages. The qos given
+// to Subscribe can carry subscription options, such as NoLocal, and the qoss
+// returned by Subscribers are the QoS of the message along with the options of
+// each subscription.
 type TopicsProvider interface {
 	Subscribe(topic []byte, qos byte, subscriber interface{}) (byte, error)
 	Unsubscribe(topic []byte, subscriber interface{}) error
@@ -67,6 +111,78 @@ type TopicsProvider interface {
 	Close() error
 }
 
+// BadRecord is a persisted record that a provider could not read back.
+type BadRecord struct {
+	// Key identifies the record in the provider, e.g., the topic
+	Key string
+
+	// Err is the reason the record could not be read
+	Err error
+}
+
+// Recoverer is implemented by TopicsProviders that persist retained messages.
+// Recover is called once on server startup to load the persisted messages, and
+// returns the number of retained messages restored. If safe is false, any
+// unreadable record fails the recovery. If safe is true, unreadable records are
+// set aside by the provider instead, and returned so they can be inspected.
+type Recoverer interface {
+	Recover(safe bool) (int, []BadRecord, error)
+}
+
+// RetainedLimiter is implemented by TopicsProviders that can stop looking for
+// retained messages once they have found enough, rather than finding them all
+// first. RetainedLimit is the same as Retained, except it adds at most max
+// messages to msgs, or all of them if max is 0.
+type RetainedLimiter interface {
+	RetainedLimit(topic []byte, max int, msgs *[]*message.PublishMessage) error
+}
+
+// Match returns whether the topic name matches the topic filter, using the same
+// wildcard rules as subscriptions. Topics starting with $ are not matched by
+// filters starting with a wildcard.
+func Match(filter, topic []byte) bool {
+	if isSys(topic) && len(filter) > 0 && (filter[0] == MWC[0] || filter[0] == SWC[0]) {
+		return false
+	}
+
+	for {
+		fl, frem := level(filter)
+		tl, trem := level(topic)
+
+		switch {
+		case string(fl) == MWC:
+			return true
+
+		case string(fl) != SWC && !bytes.Equal(fl, tl):
+			return false
+
+		case frem == nil && trem == nil:
+			return true
+
+		case frem == nil || trem == nil:
+			// "a/#" matches "a" as well
+			return trem == nil && string(frem) == MWC
+		}
+
+		filter, topic = frem, trem
+	}
+}
+
+// level splits the first topic level from the rest. rem is nil if there are no
+// levels left.
+func level(topic []byte) (ntl, rem []byte) {
+	if i := bytes.IndexByte(topic, SEP[0]); i >= 0 {
+		return topic[:i], topic[i+1:]
+	}
+
+	return topic, nil
+}
+
+// isSys returns whether the topic is a system level one, starting with $.
+func isSys(topic []byte) bool {
+	return len(topic) > 0 && topic[0] == SYS[0]
+}
+
 func Register(name string, provider TopicsProvider) {
 	if provider == nil {
 		panic("topics: Register provide is nil")
@@ -116,6 +232,59 @@ func (this *Manager) Retained(topic []byte, msgs *[]*message.PublishMessage) err
 	return this.p.Retained(topic, msgs)
 }
 
+// RetainedLimit returns at most max of the retained messages matching the topic
+// filter, or all of them if max is 0. Providers that can't stop early find them
+// all, and the ones over the limit are dropped.
+func (this *Manager) RetainedLimit(topic []byte, max int, msgs *[]*message.PublishMessage) error {
+	if r, ok := this.p.(RetainedLimiter); ok {
+		return r.RetainedLimit(topic, max, msgs)
+	}
+
+	n := len(*msgs)
+
+	if err := this.p.Retained(topic, msgs); err != nil {
+		return err
+	}
+
+	if max > 0 && len(*msgs)-n > max {
+		*msgs = (*msgs)[:n+max]
+	}
+
+	return nil
+}
+
+// Recover loads the persisted retained messages if the provider supports it.
+// Providers that don't persist anything have nothing to recover.
+func (this *Manager) Recover(safe bool) (int, []BadRecord, error) {
+	r, ok := this.p.(Recoverer)
+	if !ok {
+		return 0, nil, nil
+	}
+
+	return r.Recover(safe)
+}
+
+// Stats returns the shape of the subscription tree if the provider supports it.
+func (this *Manager) Stats(widest int) (*TreeStats, error) {
+	i, ok := this.p.(Inspector)
+	if !ok {
+		return nil, ErrInspectNotSupported
+	}
+
+	return i.Stats(widest)
+}
+
+// Tree renders the subscription subtree under the topic filter prefix if the
+// provider supports it.
+func (this *Manager) Tree(prefix string, depth, width int) (*TreeNode, error) {
+	i, ok := this.p.(Inspector)
+	if !ok {
+		return nil, ErrInspectNotSupported
+	}
+
+	return i.Tree(prefix, depth, width)
+}
+
 func (this *Manager) Close() error {
 	return this.p.Close()
 }
@@ -0,0 +1,48 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"sport/tennis", "sport/tennis", true},
+		{"sport/tennis", "sport/golf", false},
+		{"sport/tennis", "sport/tennis/player1", false},
+		{"sport/+", "sport/tennis", true},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"sport/+/player1", "sport/tennis/player1", true},
+		{"+/+", "/finance", true},
+		{"+", "/finance", false},
+		{"sport/#", "sport", true},
+		{"sport/#", "sport/tennis/player1", true},
+		{"#", "sport/tennis", true},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.match, Match([]byte(test.filter), []byte(test.topic)), "%q %q", test.filter, test.topic)
+	}
+}
@@ -0,0 +1,476 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package topicstest checks that a topics.TopicsProvider behaves the way the
+// server expects it to.
+//
+// The server relies on more than the method signatures of the provider: the
+// wildcard rules of MQTT topic filters, subscribing twice updating the QoS
+// rather than adding a second subscription, retained messages being copied as
+// the server reuses its own, and lookups being safe while others subscribe.
+// TestProvider checks all of that, along with the optional interfaces the
+// provider implements, such as topics.RetainedLimiter and topics.Inspector. A
+// provider that passes it can be registered in place of the "mem" provider.
+//
+// To check a provider, call TestProvider from one of its tests with a function
+// that returns a new, empty provider each time it's called:
+//
+//	func TestConformance(t *testing.T) {
+//		topicstest.TestProvider(t, func() topics.TopicsProvider {
+//			return newTrieProvider()
+//		})
+//	}
+//
+// Each subtest closes the provider it was given once it's done.
+package topicstest
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surgemq/message"
+	"github.com/surgemq/surgemq/topics"
+)
+
+// subscriber stands in for the clients the server subscribes. Each one is a
+// different pointer, which is what the server passes too.
+type subscriber struct {
+	name string
+}
+
+// TestProvider runs the conformance tests against the providers returned by
+// newProvider.
+func TestProvider(t *testing.T, newProvider func() topics.TopicsProvider) {
+	tests := []struct {
+		name string
+		f    func(*testing.T, topics.TopicsProvider)
+	}{
+		{"Subscribe", testSubscribe},
+		{"SubscribeInvalid", testSubscribeInvalid},
+		{"Resubscribe", testResubscribe},
+		{"Unsubscribe", testUnsubscribe},
+		{"Wildcards", testWildcards},
+		{"QoS", testQos},
+		{"Options", testOptions},
+		{"Retain", testRetain},
+		{"RetainCopies", testRetainCopies},
+		{"RetainDelete", testRetainDelete},
+		{"RetainedWildcards", testRetainedWildcards},
+		{"RetainedLimit", testRetainedLimit},
+		{"Inspector", testInspector},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			p := newProvider()
+			require.NotNil(t, p, "newProvider returned nil")
+			defer p.Close()
+
+			test.f(t, p)
+		})
+	}
+}
+
+func testSubscribe(t *testing.T, p topics.TopicsProvider) {
+	sub1 := &subscriber{"sub1"}
+	sub2 := &subscriber{"sub2"}
+
+	subscribe(t, p, "a/b/c", 1, sub1)
+	subscribe(t, p, "a/b/c", 1, sub2)
+	subscribe(t, p, "a/b", 1, sub1)
+
+	require.Equal(t, []string{"sub1", "sub2"}, subscribers(t, p, "a/b/c", 1))
+	require.Equal(t, []string{"sub1"}, subscribers(t, p, "a/b", 1))
+	require.Empty(t, subscribers(t, p, "a", 1))
+	require.Empty(t, subscribers(t, p, "a/b/c/d", 1))
+}
+
+// testSubscribeInvalid checks the provider refuses what the server would never
+// want it to keep.
+func testSubscribeInvalid(t *testing.T, p topics.TopicsProvider) {
+	sub := &subscriber{"sub1"}
+
+	qos, err := p.Subscribe([]byte("a/b"), 3, sub)
+	require.Error(t, err)
+	require.Equal(t, byte(message.QosFailure), qos)
+
+	qos, err = p.Subscribe([]byte("a/b"), 1, nil)
+	require.Error(t, err)
+	require.Equal(t, byte(message.QosFailure), qos)
+
+	for _, filter := range []string{"a/#/c", "a/b#", "a/+b"} {
+		qos, err = p.Subscribe([]byte(filter), 1, sub)
+		require.Error(t, err, "filter %q", filter)
+		require.Equal(t, byte(message.QosFailure), qos, "filter %q", filter)
+	}
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	require.Error(t, p.Subscribers([]byte("a/b"), 3, &subs, &qoss))
+}
+
+// testResubscribe checks subscribing to the same topic filter again replaces the
+// subscription, so the subscriber isn't sent every message twice.
+func testResubscribe(t *testing.T, p topics.TopicsProvider) {
+	sub := &subscriber{"sub1"}
+
+	subscribe(t, p, "a/b", 1, sub)
+	subscribe(t, p, "a/b", 0, sub)
+
+	require.Equal(t, []string{"sub1"}, subscribers(t, p, "a/b", 0))
+
+	subscribe(t, p, "a/b", 1, sub)
+	require.Equal(t, []string{"sub1"}, subscribers(t, p, "a/b", 1))
+}
+
+func testUnsubscribe(t *testing.T, p topics.TopicsProvider) {
+	sub1 := &subscriber{"sub1"}
+	sub2 := &subscriber{"sub2"}
+
+	subscribe(t, p, "a/b", 1, sub1)
+	subscribe(t, p, "a/b", 1, sub2)
+	subscribe(t, p, "a/+", 1, sub1)
+
+	require.NoError(t, p.Unsubscribe([]byte("a/b"), sub1))
+	require.Equal(t, []string{"sub1", "sub2"}, subscribers(t, p, "a/b", 1))
+
+	require.NoError(t, p.Unsubscribe([]byte("a/+"), sub1))
+	require.Equal(t, []string{"sub2"}, subscribers(t, p, "a/b", 1))
+
+	require.Error(t, p.Unsubscribe([]byte("a/+"), sub1))
+	require.Error(t, p.Unsubscribe([]byte("x/y"), sub1))
+}
+
+// testWildcards checks the topic filters match the topic names the way the MQTT
+// spec says, the same as topics.Match.
+func testWildcards(t *testing.T, p topics.TopicsProvider) {
+	filters := []string{
+		"#",
+		"a/#",
+		"a/+",
+		"a/+/c",
+		"+/+/c",
+		"a/b/#",
+		"+",
+		"a/b/c",
+	}
+
+	for i, filter := range filters {
+		subscribe(t, p, filter, 1, &subscriber{fmt.Sprintf("%02d:%s", i, filter)})
+	}
+
+	for _, topic := range []string{"a", "a/b", "a/b/c", "a/x/c", "x/y/c", "a/b/c/d", "b", "x/y"} {
+		var want []string
+
+		for i, filter := range filters {
+			if topics.Match([]byte(filter), []byte(topic)) {
+				want = append(want, fmt.Sprintf("%02d:%s", i, filter))
+			}
+		}
+
+		if want == nil {
+			want = []string{}
+		}
+
+		require.Equal(t, want, subscribers(t, p, topic, 1), "topic %q", topic)
+	}
+}
+
+// testQos checks the subscribers are returned with at most the QoS of the
+// published message, and that all the subscriptions granted at least the QoS of
+// the message are returned. The provider can grant a lower QoS than requested.
+func testQos(t *testing.T, p topics.TopicsProvider) {
+	granted := make(map[string]byte)
+
+	for qos := byte(0); qos <= 2; qos++ {
+		name := fmt.Sprintf("sub%d", qos)
+
+		g, err := p.Subscribe([]byte("a/b"), qos, &subscriber{name})
+		require.NoError(t, err)
+		require.True(t, g <= qos, "granted QoS %d for requested %d", g, qos)
+
+		granted[name] = g
+	}
+
+	for qos := byte(0); qos <= 2; qos++ {
+		var (
+			subs []interface{}
+			qoss []byte
+		)
+
+		require.NoError(t, p.Subscribers([]byte("a/b"), qos, &subs, &qoss))
+		require.Equal(t, len(subs), len(qoss))
+
+		got := make(map[string]bool)
+		for i, sub := range subs {
+			got[sub.(*subscriber).name] = true
+			require.True(t, qoss[i] <= qos, "QoS %d for a QoS %d message", qoss[i], qos)
+		}
+
+		for name, g := range granted {
+			if g >= qos {
+				require.True(t, got[name], "%s granted QoS %d missing for a QoS %d message", name, g, qos)
+			}
+		}
+	}
+}
+
+// testOptions checks the subscription options are kept with the subscription and
+// returned with the subscribers, without getting in the way of the QoS.
+func testOptions(t *testing.T, p topics.TopicsProvider) {
+	opts := topics.NoLocal | topics.RetainAsPublished | topics.RetainSendIfNew
+
+	g, err := p.Subscribe([]byte("a/b"), 1|opts, &subscriber{"sub1"})
+	require.NoError(t, err)
+	require.True(t, g <= 1, "granted QoS %d with options for requested 1", g)
+
+	_, err = p.Subscribe([]byte("a/b"), 1|topics.RetainHandlingMask, &subscriber{"sub2"})
+	require.Error(t, err)
+
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	require.NoError(t, p.Subscribers([]byte("a/b"), g, &subs, &qoss))
+	require.Equal(t, 1, len(subs))
+	require.Equal(t, g|opts, qoss[0])
+
+	require.Empty(t, subscribers(t, p, "a/b", g+1))
+}
+
+func testRetain(t *testing.T, p topics.TopicsProvider) {
+	require.NoError(t, p.Retain(newPublishMessage("a/b", "1")))
+	require.NoError(t, p.Retain(newPublishMessage("a/c", "2")))
+	require.NoError(t, p.Retain(newPublishMessage("a/b", "3")))
+
+	require.Equal(t, []string{"a/b=3"}, retained(t, p, "a/b"))
+	require.Equal(t, []string{"a/c=2"}, retained(t, p, "a/c"))
+	require.Empty(t, retained(t, p, "a"))
+	require.Empty(t, retained(t, p, "a/d"))
+
+	// Retained adds to the messages already there, rather than replacing them
+	msgs := []*message.PublishMessage{newPublishMessage("x", "0")}
+	require.NoError(t, p.Retained([]byte("a/b"), &msgs))
+	require.Equal(t, 2, len(msgs))
+}
+
+// testRetainCopies checks the provider keeps its own copy of the retained
+// message, as the server reuses the message and its buffers once it's done with
+// them.
+func testRetainCopies(t *testing.T, p topics.TopicsProvider) {
+	msg := newPublishMessage("a/b", "1")
+	require.NoError(t, p.Retain(msg))
+
+	msg.SetTopic([]byte("x/y"))
+	msg.SetPayload([]byte("2"))
+
+	require.Equal(t, []string{"a/b=1"}, retained(t, p, "a/b"))
+}
+
+// testRetainDelete checks a retained message with an empty payload deletes the
+// one retained for the topic, as the MQTT spec says.
+func testRetainDelete(t *testing.T, p topics.TopicsProvider) {
+	require.NoError(t, p.Retain(newPublishMessage("a/b", "1")))
+	require.NoError(t, p.Retain(newPublishMessage("a/b/c", "2")))
+	require.NoError(t, p.Retain(newPublishMessage("a/b", "")))
+
+	require.Empty(t, retained(t, p, "a/b"))
+	require.Equal(t, []string{"a/b/c=2"}, retained(t, p, "a/#"))
+}
+
+func testRetainedWildcards(t *testing.T, p topics.TopicsProvider) {
+	names := []string{"a", "a/b", "a/b/c", "a/x/c", "x/y/c", "a/b/c/d", "b"}
+
+	for _, name := range names {
+		require.NoError(t, p.Retain(newPublishMessage(name, name)))
+	}
+
+	for _, filter := range []string{"#", "a/#", "a/+", "a/+/c", "+/+/c", "a/b/#", "+", "a/b/c"} {
+		want := []string{}
+
+		for _, name := range names {
+			if topics.Match([]byte(filter), []byte(name)) {
+				want = append(want, name+"="+name)
+			}
+		}
+
+		sort.Strings(want)
+
+		require.Equal(t, want, retained(t, p, filter), "filter %q", filter)
+	}
+}
+
+// testRetainedLimit checks providers implementing topics.RetainedLimiter stop
+// at the number of messages they were asked for.
+func testRetainedLimit(t *testing.T, p topics.TopicsProvider) {
+	r, ok := p.(topics.RetainedLimiter)
+	if !ok {
+		t.Skip("provider does not implement topics.RetainedLimiter")
+	}
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, p.Retain(newPublishMessage(fmt.Sprintf("a/%d", i), "1")))
+	}
+
+	for _, test := range []struct{ max, want int }{{0, 10}, {3, 3}, {10, 10}, {20, 10}} {
+		msgs := []*message.PublishMessage{newPublishMessage("x", "0")}
+
+		require.NoError(t, r.RetainedLimit([]byte("a/+"), test.max, &msgs))
+		require.Equal(t, test.want+1, len(msgs), "max %d", test.max)
+	}
+}
+
+// testInspector checks providers implementing topics.Inspector report what was
+// subscribed.
+func testInspector(t *testing.T, p topics.TopicsProvider) {
+	i, ok := p.(topics.Inspector)
+	if !ok {
+		t.Skip("provider does not implement topics.Inspector")
+	}
+
+	subscribe(t, p, "a/b", 1, &subscriber{"sub1"})
+	subscribe(t, p, "a/b", 1, &subscriber{"sub2"})
+	subscribe(t, p, "a/c", 1, &subscriber{"sub1"})
+
+	stats, err := i.Stats(1)
+	require.NoError(t, err)
+	require.Equal(t, 3, stats.Nodes)
+	require.Equal(t, 3, stats.Subscriptions)
+	require.Equal(t, []int{1, 2}, stats.Depth)
+	require.Equal(t, []topics.NodeFanout{{Topic: "a", Children: 2}}, stats.Widest)
+
+	tree, err := i.Tree("a", 1, 10)
+	require.NoError(t, err)
+	require.Equal(t, "a", tree.Topic)
+	require.Equal(t, 2, len(tree.Children))
+	require.Equal(t, "a/b", tree.Children[0].Topic)
+	require.Equal(t, 2, tree.Children[0].Subscribers)
+
+	_, err = i.Tree("x/y", 1, 10)
+	require.Equal(t, topics.ErrTopicNotFound, err)
+}
+
+// testConcurrent checks subscribers can be looked up while others subscribe and
+// unsubscribe, and retained messages while others are retained. It's most
+// useful with the race detector on.
+func testConcurrent(t *testing.T, p topics.TopicsProvider) {
+	const n = 10
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, 4*n)
+	)
+
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+
+			sub := &subscriber{fmt.Sprintf("sub%d", i)}
+			filter := []byte(fmt.Sprintf("a/%d/#", i))
+
+			_, err := p.Subscribe(filter, 1, sub)
+			errs <- err
+			errs <- p.Unsubscribe(filter, sub)
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+
+			var (
+				subs []interface{}
+				qoss []byte
+				msgs []*message.PublishMessage
+			)
+
+			errs <- p.Subscribers([]byte(fmt.Sprintf("a/%d/b", i)), 1, &subs, &qoss)
+			errs <- p.Retain(newPublishMessage(fmt.Sprintf("a/%d", i), "1"))
+			p.Retained([]byte("a/#"), &msgs)
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	require.Empty(t, subscribers(t, p, "a/1/b", 1))
+	require.Equal(t, n, len(retained(t, p, "a/+")))
+}
+
+func subscribe(t *testing.T, p topics.TopicsProvider, filter string, qos byte, sub *subscriber) {
+	granted, err := p.Subscribe([]byte(filter), qos, sub)
+	require.NoError(t, err, "filter %q", filter)
+	require.True(t, granted <= qos, "granted QoS %d for requested %d", granted, qos)
+}
+
+// subscribers returns the names of the subscribers to the topic, sorted.
+func subscribers(t *testing.T, p topics.TopicsProvider, topic string, qos byte) []string {
+	var (
+		subs []interface{}
+		qoss []byte
+	)
+
+	require.NoError(t, p.Subscribers([]byte(topic), qos, &subs, &qoss), "topic %q", topic)
+	require.Equal(t, len(subs), len(qoss), "topic %q", topic)
+
+	names := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		names = append(names, sub.(*subscriber).name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// retained returns the retained messages matching the topic filter as
+// "topic=payload", sorted.
+func retained(t *testing.T, p topics.TopicsProvider, filter string) []string {
+	var msgs []*message.PublishMessage
+
+	require.NoError(t, p.Retained([]byte(filter), &msgs), "filter %q", filter)
+
+	names := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		names = append(names, string(msg.Topic())+"="+string(msg.Payload()))
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func newPublishMessage(topic, payload string) *message.PublishMessage {
+	msg := message.NewPublishMessage()
+	msg.SetTopic([]byte(topic))
+	msg.SetPayload([]byte(payload))
+	msg.SetQoS(1)
+	msg.SetRetain(true)
+
+	return msg
+}
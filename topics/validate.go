@@ -0,0 +1,182 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// MaxTopicLength is the longest a topic name or filter can be, in bytes, as
+// the length is encoded in two bytes.
+const MaxTopicLength = 65535
+
+var (
+	// ErrTopicEmpty is returned for an empty topic name or filter, which the
+	// spec doesn't allow.
+	ErrTopicEmpty = errors.New("topics: Topic is empty")
+
+	// ErrTopicTooLong is returned for a topic name or filter longer than
+	// MaxTopicLength, or the limits of a Validator.
+	ErrTopicTooLong = errors.New("topics: Topic is too long")
+
+	// ErrTopicTooManyLevels is returned for a topic name or filter with more
+	// levels than the Validator allows.
+	ErrTopicTooManyLevels = errors.New("topics: Topic has too many levels")
+
+	// ErrInvalidUTF8 is returned for a topic name or filter that isn't well
+	// formed UTF-8, including the encodings of the UTF-16 surrogates.
+	ErrInvalidUTF8 = errors.New("topics: Topic is not valid UTF-8")
+
+	// ErrNullCharacter is returned for a topic name or filter with a U+0000 in
+	// it.
+	ErrNullCharacter = errors.New("topics: Topic contains U+0000")
+
+	// ErrByteOrderMark is returned for a topic name or filter with a U+FEFF in
+	// it, by the Validators with RejectBOM set.
+	ErrByteOrderMark = errors.New("topics: Topic contains U+FEFF")
+
+	// ErrWildcardInTopic is returned for a topic name, which is what messages
+	// are published to, with a wildcard in it.
+	ErrWildcardInTopic = errors.New("topics: Topic name contains wildcards")
+
+	// ErrInvalidWildcard is returned for a topic filter with a wildcard that
+	// isn't a level of its own, or a multi-level wildcard that isn't the last
+	// level.
+	ErrInvalidWildcard = errors.New("topics: Wildcards must occupy a whole level, and '#' must be the last")
+)
+
+var bom = []byte("\ufeff")
+
+// Validator checks topic names and filters against the rules of the spec, and
+// whatever limits are set on top of them. The zero Validator only checks the
+// rules of the spec.
+type Validator struct {
+	// MaxLength is the longest a topic can be, in bytes, and MaxLevels and
+	// MaxLevelLength the most levels it can have, and the longest each of them
+	// can be. If not set then they're only limited by MaxTopicLength.
+	MaxLength      int
+	MaxLevels      int
+	MaxLevelLength int
+
+	// RejectBOM rejects the topics with a U+FEFF in them. The spec allows it
+	// anywhere, but it's invisible, so two topics that look the same may not be.
+	RejectBOM bool
+}
+
+// TopicName returns why topic can't be published to, or nil if it can. The
+// encoding is checked last, so any other error comes first.
+func (this Validator) TopicName(topic []byte) error {
+	if err := this.limits(topic); err != nil {
+		return err
+	}
+
+	if bytes.ContainsAny(topic, _WC) {
+		return ErrWildcardInTopic
+	}
+
+	return this.String(topic)
+}
+
+// TopicFilter returns why filter can't be subscribed to, or nil if it can. The
+// encoding is checked last, so any other error comes first.
+func (this Validator) TopicFilter(filter []byte) error {
+	if err := this.limits(filter); err != nil {
+		return err
+	}
+
+	for rem := filter; rem != nil; {
+		var l []byte
+		l, rem = level(rem)
+
+		if len(l) > 1 && bytes.ContainsAny(l, _WC) {
+			return ErrInvalidWildcard
+		}
+
+		if string(l) == MWC && rem != nil {
+			return ErrInvalidWildcard
+		}
+	}
+
+	return this.String(filter)
+}
+
+// String returns why s isn't a valid UTF-8 string for a topic, or nil if it is.
+func (this Validator) String(s []byte) error {
+	if !utf8.Valid(s) {
+		return ErrInvalidUTF8
+	}
+
+	if bytes.IndexByte(s, 0) >= 0 {
+		return ErrNullCharacter
+	}
+
+	if this.RejectBOM && bytes.Contains(s, bom) {
+		return ErrByteOrderMark
+	}
+
+	return nil
+}
+
+// limits checks the length and the levels of topic.
+func (this Validator) limits(topic []byte) error {
+	if len(topic) == 0 {
+		return ErrTopicEmpty
+	}
+
+	if len(topic) > MaxTopicLength || (this.MaxLength > 0 && len(topic) > this.MaxLength) {
+		return ErrTopicTooLong
+	}
+
+	if this.MaxLevels == 0 && this.MaxLevelLength == 0 {
+		return nil
+	}
+
+	levels := 0
+
+	for rem := topic; rem != nil; {
+		var l []byte
+		l, rem = level(rem)
+
+		if levels++; this.MaxLevels > 0 && levels > this.MaxLevels {
+			return ErrTopicTooManyLevels
+		}
+
+		if this.MaxLevelLength > 0 && len(l) > this.MaxLevelLength {
+			return ErrTopicTooLong
+		}
+	}
+
+	return nil
+}
+
+// ValidateTopicName is TopicName of the zero Validator, which only checks the
+// rules of the spec.
+func ValidateTopicName(topic []byte) error {
+	return Validator{}.TopicName(topic)
+}
+
+// ValidateTopicFilter is TopicFilter of the zero Validator, which only checks
+// the rules of the spec.
+func ValidateTopicFilter(filter []byte) error {
+	return Validator{}.TopicFilter(filter)
+}
+
+// IsEncodingError returns whether err is one of the errors about how a topic is
+// encoded, rather than what's in it.
+func IsEncodingError(err error) bool {
+	return err == ErrInvalidUTF8 || err == ErrNullCharacter || err == ErrByteOrderMark
+}
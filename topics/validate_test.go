@@ -0,0 +1,125 @@
+// Copyright (c) 2014 The SurgeMQ Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package topics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTopicName(t *testing.T) {
+	tests := []struct {
+		topic string
+		err   error
+	}{
+		{"sport/tennis", nil},
+		{"/", nil},
+		{"$SYS/uptime", nil},
+		{"sport/tennis/\ufeff", nil},
+		{"", ErrTopicEmpty},
+		{strings.Repeat("a", MaxTopicLength+1), ErrTopicTooLong},
+		{"sport/+", ErrWildcardInTopic},
+		{"sport/#", ErrWildcardInTopic},
+		{"sport/\xff", ErrInvalidUTF8},
+		{"sport/\xed\xa0\x80", ErrInvalidUTF8},
+		{"sport/\x00", ErrNullCharacter},
+
+		// The encoding is checked last
+		{"sport/#/\xff", ErrWildcardInTopic},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.err, ValidateTopicName([]byte(test.topic)), "%q", test.topic)
+	}
+}
+
+func TestValidateTopicFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		err    error
+	}{
+		{"sport/tennis", nil},
+		{"#", nil},
+		{"+", nil},
+		{"/+", nil},
+		{"+/tennis/#", nil},
+		{"sport/+/player1", nil},
+		{"", ErrTopicEmpty},
+		{"sport/tennis#", ErrInvalidWildcard},
+		{"sport/#/ranking", ErrInvalidWildcard},
+		{"sport+", ErrInvalidWildcard},
+		{"sport/+tennis", ErrInvalidWildcard},
+		{"sport/\x00", ErrNullCharacter},
+	}
+
+	for _, test := range tests {
+		require.Equal(t, test.err, ValidateTopicFilter([]byte(test.filter)), "%q", test.filter)
+	}
+}
+
+func TestValidatorLimits(t *testing.T) {
+	v := Validator{MaxLength: 10, MaxLevels: 3, MaxLevelLength: 4, RejectBOM: true}
+
+	require.NoError(t, v.TopicName([]byte("a/bb/cccc")))
+	require.Equal(t, ErrTopicTooLong, v.TopicName([]byte("aaaa/bbbb/c")))
+	require.Equal(t, ErrTopicTooManyLevels, v.TopicFilter([]byte("a/b/c/#")))
+	require.Equal(t, ErrTopicTooLong, v.TopicName([]byte("abcde")))
+	require.Equal(t, ErrByteOrderMark, v.TopicName([]byte("a/\ufeff")))
+}
+
+// FuzzValidateTopicName checks that the topics that can be published to are
+// matched by themselves as filters, and by "#".
+func FuzzValidateTopicName(f *testing.F) {
+	for _, s := range []string{"sport/tennis", "/", "$SYS/uptime", "a//b", "sport/#", "\xff"} {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, topic []byte) {
+		if ValidateTopicName(topic) != nil {
+			return
+		}
+
+		require.NoError(t, ValidateTopicFilter(topic))
+		require.True(t, Match(topic, topic), "%q", topic)
+
+		if topic[0] != SYS[0] {
+			require.True(t, Match([]byte(MWC), topic), "%q", topic)
+		}
+	})
+}
+
+// FuzzValidateTopicFilter checks that the filters that can be subscribed to
+// have their wildcards on levels of their own, and "#" only as the last.
+func FuzzValidateTopicFilter(f *testing.F) {
+	for _, s := range []string{"sport/+/player1", "#", "+/#", "sport/#/x", "a+", "\x00"} {
+		f.Add([]byte(s))
+	}
+
+	f.Fuzz(func(t *testing.T, filter []byte) {
+		if ValidateTopicFilter(filter) != nil {
+			return
+		}
+
+		levels := strings.Split(string(filter), SEP)
+
+		for i, l := range levels {
+			if strings.ContainsAny(l, _WC) {
+				require.True(t, l == SWC || (l == MWC && i == len(levels)-1), "%q", filter)
+			}
+		}
+	})
+}